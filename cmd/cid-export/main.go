@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/ipfs"
+)
+
+// CLI tool to export cached original icons keyed by CID (content hash),
+// optionally pinning each one to an IPFS node.
+// Usage: go run cmd/cid-export/main.go -cache-dir ./cache -out ./export [-ipfs-api http://127.0.0.1:5001]
+
+func main() {
+	cacheDir := flag.String("cache-dir", "./cache", "directory of the server disk cache")
+	outDir := flag.String("out", "", "output directory for CID-named files and index.json")
+	maxAge := flag.Duration("max-age", 0, "only export originals newer than this (0=all)")
+	ipfsAPI := flag.String("ipfs-api", "", "IPFS node RPC API URL to pin exported blocks (empty=no pinning)")
+	flag.Parse()
+
+	if *outDir == "" {
+		fmt.Println("Usage: go run cmd/cid-export/main.go -cache-dir ./cache -out ./export [-ipfs-api http://127.0.0.1:5001]")
+		os.Exit(1)
+	}
+
+	cm := cache.New(*cacheDir, 0)
+	entries, err := cm.ExportOrigByCID(*outDir, *maxAge)
+	if err != nil {
+		fmt.Printf("Export failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	unique := make(map[string]struct{})
+	for _, e := range entries {
+		unique[e.CID] = struct{}{}
+	}
+	fmt.Printf("Exported %d cached icons (%d unique CIDs) to %s\n", len(entries), len(unique), *outDir)
+
+	if *ipfsAPI == "" {
+		return
+	}
+
+	client := ipfs.NewClient(*ipfsAPI)
+	pinned, failed := 0, 0
+	for cid := range unique {
+		data, err := os.ReadFile(filepath.Join(*outDir, cid))
+		if err != nil {
+			failed++
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		got, err := client.PutBlock(ctx, data)
+		cancel()
+		if err != nil {
+			fmt.Printf("Pin failed for %s: %v\n", cid, err)
+			failed++
+			continue
+		}
+		if got != cid {
+			fmt.Printf("CID mismatch for %s: node reported %s\n", cid, got)
+			failed++
+			continue
+		}
+		pinned++
+	}
+	fmt.Printf("Pinned %d blocks to %s (%d failed)\n", pinned, *ipfsAPI, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/handler"
+	imgpkg "faviconsvc/internal/image"
+)
+
+// Subcommands working on a server's disk cache directory. They share its
+// layout with a running server, whose reads tolerate them: every write is
+// an atomic rename and a purged entry is simply a miss. The metadata index
+// is opened per lookup or write, so it is shared too; only while a server
+// keeps it busy do prefetch cache no metadata and stats leave it out, and
+// purge and cache show, which find icons through it, fail with
+// cache.ErrIndexInUse.
+
+// addCacheDirFlag defines -cache-dir on fs with the server's default.
+func addCacheDirFlag(fs *flag.FlagSet) *string {
+	return fs.String("cache-dir", "./cache", "cache directory, as the server's -cache-dir")
+}
+
+// prefetchResult is one domain warmed by `favicon prefetch`, as printed by
+// -output json.
+type prefetchResult struct {
+	Domain string `json:"domain"`
+	// Status is "ok", "no_icon" (the placeholder was cached) or "error"
+	Status      string `json:"status"`
+	Cache       string `json:"cache,omitempty"` // X-Cache of the response
+	ContentHash string `json:"content_hash,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	DurationMS  int64  `json:"duration_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (r prefetchResult) text() string {
+	switch r.Status {
+	case "error":
+		return fmt.Sprintf("%s: %s", r.Domain, r.Error)
+	case "no_icon":
+		return fmt.Sprintf("%s: no icon, placeholder cached (%dms)", r.Domain, r.DurationMS)
+	}
+	return fmt.Sprintf("%s: %s, %d bytes (%dms)", r.Domain, strings.ToLower(r.Cache), r.Bytes, r.DurationMS)
+}
+
+// prefetchCommand implements `favicon prefetch`: it resolves every domain
+// through the /favicons handler into a cache directory, so a server started
+// on it answers them from cache.
+func prefetchCommand(fs *flag.FlagSet) func(args []string) int {
+	cacheDir := addCacheDirFlag(fs)
+	cacheTTL := fs.Duration("cache-ttl", 24*time.Hour, "TTL for cache entries, as the server's -cache-ttl")
+	size := fs.Int("size", handler.DefaultSize, "icon size in pixels (16-256)")
+	format := fs.String("format", "png", "output format by encoder name, e.g. png, webp, ico")
+	from := fs.String("from", "", "also read domains, one per line, from this file (-=stdin)")
+	parallel := fs.Int("parallel", 4, "domains fetched at once")
+	output := outputFlag(fs)
+	client := addClientFlags(fs)
+
+	return func(args []string) int {
+		domains := args
+		if *from != "" {
+			more, err := readDomains(*from)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read domains: %v\n", err)
+				return 1
+			}
+			domains = append(domains, more...)
+		}
+		if len(domains) == 0 {
+			return usageError(fs, "No domains given")
+		}
+		if *parallel < 1 {
+			return usageError(fs, "-parallel must be at least 1")
+		}
+		enc, ok := imgpkg.LookupEncoder(*format)
+		if !ok {
+			return usageError(fs, "Unknown format %q", *format)
+		}
+		if err := client.apply(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		cm := cache.New(*cacheDir, *cacheTTL)
+		if err := cm.EnsureDirs(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create cache directories: %v\n", err)
+			return 1
+		}
+		cfg := handler.NewConfig(cm, 0, 0, false)
+		cfg.ExposeCacheInfo = true
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		var (
+			mu     sync.Mutex
+			counts = map[string]int{}
+			wg     sync.WaitGroup
+			queue  = make(chan string)
+		)
+		for i := 0; i < *parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for domain := range queue {
+					res := prefetch(ctx, cfg, domain, *size, enc.Name())
+					if ctx.Err() != nil {
+						continue
+					}
+					mu.Lock()
+					counts[res.Status]++
+					output.emit(res, res.text())
+					mu.Unlock()
+				}
+			}()
+		}
+	feed:
+		for _, d := range domains {
+			select {
+			case queue <- d:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(queue)
+		wg.Wait()
+
+		if *output == "text" {
+			fmt.Printf("Prefetched %d domains: %d cached, %d without icon, %d failed\n",
+				counts["ok"]+counts["no_icon"]+counts["error"], counts["ok"], counts["no_icon"], counts["error"])
+		}
+		if counts["error"] > 0 {
+			return 1
+		}
+		return 0
+	}
+}
+
+func prefetch(ctx context.Context, cfg *handler.Config, domain string, size int, format string) prefetchResult {
+	start := time.Now()
+	rec, err := serveIcon(ctx, cfg, domain, size, format)
+	res := prefetchResult{Domain: domain, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+	res.Status, res.Cache, res.Bytes = "ok", rec.Header().Get(handler.HeaderCache), rec.Body.Len()
+	res.ContentHash = rec.Header().Get(handler.HeaderContentHash)
+	if res.Cache == handler.CacheFallback {
+		res.Status = "no_icon"
+	}
+	return res
+}
+
+// readDomains reads one domain per line from path ("-" = stdin), skipping
+// blank lines and # comments.
+func readDomains(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var domains []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	return domains, sc.Err()
+}
+
+// purgeResult is what `favicon purge` removed, shaped like the response of
+// the server's /admin/purge.
+type purgeResult struct {
+	Host    string             `json:"host"`
+	DryRun  bool               `json:"dry_run"`
+	Count   int                `json:"count"`
+	Bytes   int64              `json:"bytes"`
+	Entries []cache.PurgeEntry `json:"entries"`
+}
+
+func (r purgeResult) text() string {
+	var b strings.Builder
+	for _, e := range r.Entries {
+		fmt.Fprintf(&b, "%-10s %8d  %s\n", e.Tier, e.Bytes, e.Key)
+	}
+	verb := "Deleted"
+	if r.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Fprintf(&b, "%s %d entries (%d bytes) of hosts matching %s", verb, r.Count, r.Bytes, r.Host)
+	return b.String()
+}
+
+// purgeCommand implements `favicon purge`, deleting every variant of the
+// icons of hosts matching a glob as /admin/purge does.
+func purgeCommand(fs *flag.FlagSet) func(args []string) int {
+	cacheDir := addCacheDirFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "list matching entries without deleting them")
+	output := outputFlag(fs)
+
+	return func(args []string) int {
+		if len(args) != 1 {
+			return usageError(fs, "Expected one host glob, e.g. example.com or *.example.com")
+		}
+		cm := cache.New(*cacheDir, 0)
+		entries, err := cm.Purge(cache.PurgeOptions{HostPattern: args[0], DryRun: *dryRun, AllVariants: true})
+		if errors.Is(err, cache.ErrBadHostPattern) {
+			return usageError(fs, "Invalid host glob %q", args[0])
+		}
+		if errors.Is(err, cache.ErrIndexInUse) {
+			fmt.Fprintf(os.Stderr, "Purge failed: %v; try again or use the server's /admin/purge\n", err)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Purge failed: %v\n", err)
+			return 1
+		}
+		res := purgeResult{Host: args[0], DryRun: *dryRun, Count: len(entries), Entries: entries}
+		if res.Entries == nil {
+			res.Entries = []cache.PurgeEntry{}
+		}
+		for _, e := range entries {
+			res.Bytes += e.Bytes
+		}
+		output.emit(res, res.text())
+		return 0
+	}
+}
+
+// statsResult is what `favicon stats` reports, as printed by -output json.
+type statsResult struct {
+	CacheDir string                     `json:"cache_dir"`
+	Entries  int                        `json:"entries"`
+	Bytes    int64                      `json:"bytes"`
+	Tiers    map[string]cache.TierUsage `json:"tiers"`
+}
+
+func (r statsResult) text() string {
+	tiers := make([]string, 0, len(r.Tiers))
+	for tier := range r.Tiers {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-10s %8s %12s  %-20s  %s\n", "TIER", "ENTRIES", "BYTES", "OLDEST", "NEWEST")
+	for _, tier := range tiers {
+		u := r.Tiers[tier]
+		fmt.Fprintf(&b, "%-10s %8d %12d  %-20s  %s\n", tier, u.Entries, u.Bytes,
+			u.Oldest.UTC().Format(time.RFC3339), u.Newest.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "%-10s %8d %12d", "total", r.Entries, r.Bytes)
+	return b.String()
+}
+
+// statsCommand implements `favicon stats`, summarizing a cache directory
+// per tier.
+func statsCommand(fs *flag.FlagSet) func(args []string) int {
+	cacheDir := addCacheDirFlag(fs)
+	output := outputFlag(fs)
+
+	return func(args []string) int {
+		if len(args) != 0 {
+			return usageError(fs, "Unexpected arguments")
+		}
+		usage, err := cache.New(*cacheDir, 0).Usage()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache: %v\n", err)
+			return 1
+		}
+		res := statsResult{CacheDir: *cacheDir, Tiers: usage}
+		for _, u := range usage {
+			res.Entries += u.Entries
+			res.Bytes += u.Bytes
+		}
+		output.emit(res, res.text())
+		return 0
+	}
+}
+
+// cacheShowResult is what `favicon cache show` prints with -output json.
+type cacheShowResult struct {
+	Host     string `json:"host"`
+	CacheDir string `json:"cache_dir"`
+	cache.Inspection
+}
+
+func (r cacheShowResult) text() string {
+	if len(r.Pages) == 0 && len(r.Icons) == 0 {
+		return fmt.Sprintf("Nothing cached for %s in %s", r.Host, r.CacheDir)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s in %s\n", r.Host, r.CacheDir)
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	if len(r.Pages) > 0 {
+		fmt.Fprintln(tw, "\nPAGE\tTIER\tHOLDS\tEXPIRES")
+		for _, p := range r.Pages {
+			holds := p.IconURL
+			switch {
+			case p.Tier == cache.TierCandidates:
+				holds = fmt.Sprintf("%d candidates", p.Candidates)
+				if p.Candidates == 1 {
+					holds = "1 candidate"
+				}
+			case p.Negative != "":
+				holds = "no icon (" + p.Negative + ")"
+			case p.InheritedFrom != "":
+				holds += " (from " + p.InheritedFrom + ")"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Key, p.Tier, holds, expiry(p.CachedFile))
+		}
+	}
+	tw.Flush()
+	for _, ic := range r.Icons {
+		fmt.Fprintf(&b, "\n%s\n", ic.URL)
+		if o := ic.Original; o != nil {
+			fmt.Fprintf(&b, "  original  %s, %d bytes, %s, expires %s\n", ic.ContentType, o.Bytes, ic.ContentHash, expiry(*o))
+		} else {
+			b.WriteString("  original  evicted\n")
+		}
+		if m := ic.Meta; m != nil {
+			fmt.Fprintf(&b, "  meta      ETag %s, Last-Modified %s, updated %s\n",
+				orDash(m.ETag), orDash(m.LastModified), m.UpdatedAt.UTC().Format(time.RFC3339))
+		}
+		if len(ic.Variants) == 0 {
+			continue
+		}
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  variants\tSIZE\tFORMAT\tBYTES\tEXPIRES")
+		for _, v := range ic.Variants {
+			size := strconv.Itoa(v.Size)
+			if v.Size < 0 {
+				size = "?"
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%d\t%s\n", size, v.Format, v.Bytes, expiry(v.CachedFile))
+		}
+		tw.Flush()
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// expiry renders when f expires, marking already expired entries.
+func expiry(f cache.CachedFile) string {
+	switch {
+	case f.Expires == nil:
+		return "never"
+	case f.Expired:
+		return f.Expires.UTC().Format(time.RFC3339) + " (expired)"
+	}
+	return f.Expires.UTC().Format(time.RFC3339)
+}
+
+// cacheCommand implements `favicon cache show`, listing every entry a cache
+// directory holds for a domain: its pages' resolved mappings and candidate
+// lists, and the originals, metadata and resized variants of their icons.
+// Expiry times follow the TTLs given, which should match the server's.
+func cacheCommand(fs *flag.FlagSet) func(args []string) int {
+	cacheDir := addCacheDirFlag(fs)
+	cacheTTL := fs.Duration("cache-ttl", 24*time.Hour, "TTL for cache entries, as the server's -cache-ttl")
+	candidatesTTL := fs.Duration("candidates-ttl", 6*time.Hour, "TTL for cached candidate lists, as the server's -candidates-ttl (0 = -cache-ttl)")
+	output := outputFlag(fs)
+
+	return func(args []string) int {
+		if len(args) == 0 || args[0] != "show" {
+			return usageError(fs, "Expected: show <domain>")
+		}
+		// Flags may also follow the action word
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() != 1 {
+			return usageError(fs, "Expected one domain or host glob")
+		}
+		host := fs.Arg(0)
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Hostname()
+		}
+		cm := cache.New(*cacheDir, *cacheTTL)
+		cm.CandidatesTTL = *candidatesTTL
+		if _, err := os.Stat(*cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache: %v\n", err)
+			return 1
+		}
+		ins, err := cm.Inspect(host)
+		if errors.Is(err, cache.ErrBadHostPattern) {
+			return usageError(fs, "Invalid domain %q", fs.Arg(0))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache: %v\n", err)
+			return 1
+		}
+		res := cacheShowResult{Host: host, CacheDir: *cacheDir, Inspection: ins}
+		output.emit(res, res.text())
+		return 0
+	}
+}
+
+// migrateResult is what `favicon migrate` reports, as printed by -output
+// json.
+type migrateResult struct {
+	CacheDir string   `json:"cache_dir"`
+	DryRun   bool     `json:"dry_run"`
+	From     int      `json:"from"`
+	To       int      `json:"to"`
+	Steps    []string `json:"steps"`
+}
+
+func (r migrateResult) text() string {
+	if len(r.Steps) == 0 {
+		return fmt.Sprintf("%s is at schema %d, nothing to migrate", r.CacheDir, r.From)
+	}
+	verb := "Migrated"
+	if r.DryRun {
+		verb = "Would migrate"
+	}
+	return fmt.Sprintf("%s %s from schema %d to %d: %s", verb, r.CacheDir, r.From, r.To, strings.Join(r.Steps, ", "))
+}
+
+// migrateCommand implements `favicon migrate`, running the cache layout
+// migrations a server would run at startup, for large caches better
+// upgraded while no server uses them.
+func migrateCommand(fs *flag.FlagSet) func(args []string) int {
+	cacheDir := addCacheDirFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without running them")
+	output := outputFlag(fs)
+
+	return func(args []string) int {
+		if len(args) != 0 {
+			return usageError(fs, "Unexpected arguments")
+		}
+		if _, err := os.Stat(*cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache: %v\n", err)
+			return 1
+		}
+		cm := cache.New(*cacheDir, 0)
+		from, err := cm.Schema()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the cache: %v\n", err)
+			return 1
+		}
+		pending, err := cm.PendingMigrations()
+		if err == nil && !*dryRun {
+			// Progress goes to stderr, keeping stdout for the result
+			pending, err = cm.Migrate(func(format string, args ...any) {
+				fmt.Fprintf(os.Stderr, format+"\n", args...)
+			})
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+		res := migrateResult{CacheDir: *cacheDir, DryRun: *dryRun, From: from, To: from, Steps: []string{}}
+		for _, mig := range pending {
+			res.Steps = append(res.Steps, mig.Name)
+			res.To = mig.From + 1
+		}
+		output.emit(res, res.text())
+		return 0
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+)
+
+// Shell completion scripts, generated from the commands table and the flag
+// sets of the subcommands so they never fall behind the flags.
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// flagCompletion says what follows a flag taking a value: one of values, a
+// file name, or a directory name.
+type flagCompletion struct {
+	values func() []string
+	file   bool
+	dir    bool
+}
+
+var flagCompletions = map[string]flagCompletion{
+	"output":     {values: func() []string { return []string{"text", "json"} }},
+	"format":     {values: encoderNames},
+	"rank":       {values: discovery.RankingStrategies},
+	"o":          {file: true},
+	"from":       {file: true},
+	"icon-hints": {file: true},
+	"cache-dir":  {dir: true},
+}
+
+func encoderNames() []string {
+	var names []string
+	for _, e := range imgpkg.Encoders() {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// completionFlag is a subcommand flag as the scripts see it.
+type completionFlag struct {
+	name     string
+	usage    string
+	hasValue bool
+	flagCompletion
+}
+
+// spelling is how the scripts offer the flag: -o, --cache-dir.
+func (f completionFlag) spelling() string {
+	if len(f.name) == 1 {
+		return "-" + f.name
+	}
+	return "--" + f.name
+}
+
+func commandFlags(c *command) []completionFlag {
+	fs, _ := c.flags()
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		_, usage := flag.UnquoteUsage(f)
+		flags = append(flags, completionFlag{
+			name:           f.Name,
+			usage:          usage,
+			hasValue:       !ok || !b.IsBoolFlag(),
+			flagCompletion: flagCompletions[f.Name],
+		})
+	})
+	return flags
+}
+
+// completionCommand implements `favicon completion`, printing the script
+// for a shell. Typical installs:
+//
+//	favicon completion bash > /etc/bash_completion.d/favicon
+//	favicon completion zsh > "${fpath[1]}/_favicon"
+//	favicon completion fish > ~/.config/fish/completions/favicon.fish
+func completionCommand(fs *flag.FlagSet) func(args []string) int {
+	return func(args []string) int {
+		if len(args) != 1 {
+			return usageError(fs, "Expected a shell: %s", strings.Join(completionShells, ", "))
+		}
+		var script string
+		switch args[0] {
+		case "bash":
+			script = bashCompletion()
+		case "zsh":
+			script = zshCompletion()
+		case "fish":
+			script = fishCompletion()
+		default:
+			return usageError(fs, "Unsupported shell %q", args[0])
+		}
+		fmt.Fprint(os.Stdout, script)
+		return 0
+	}
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	b.WriteString("# bash completion for favicon\n_favicon() {\n")
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(&b, "    if [[ $COMP_CWORD -eq 1 ]]; then\n        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n        return\n    fi\n", strings.Join(commandNames(), " "))
+	b.WriteString("    case \"${COMP_WORDS[1]}\" in\n")
+	for i := range commands {
+		c := &commands[i]
+		flags := commandFlags(c)
+		fmt.Fprintf(&b, "    %s)\n        case \"$prev\" in\n", c.name)
+		var words []string
+		for _, f := range flags {
+			words = append(words, f.spelling())
+			if !f.hasValue {
+				continue
+			}
+			fmt.Fprintf(&b, "        -%s|--%s)\n            ", f.name, f.name)
+			switch {
+			case f.values != nil:
+				fmt.Fprintf(&b, "COMPREPLY=($(compgen -W %q -- \"$cur\"))", strings.Join(f.values(), " "))
+			case f.dir:
+				b.WriteString("COMPREPLY=($(compgen -d -- \"$cur\"))")
+			case f.file:
+				b.WriteString("COMPREPLY=($(compgen -f -- \"$cur\"))")
+			default:
+				b.WriteString("COMPREPLY=()")
+			}
+			b.WriteString("\n            return ;;\n")
+		}
+		b.WriteString("        esac\n")
+		if c.name == "completion" {
+			fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(completionShells, " "))
+			continue
+		}
+		if c.name == "cache" {
+			words = append(words, "show")
+		}
+		fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(words, " "))
+	}
+	b.WriteString("    esac\n}\ncomplete -F _favicon favicon\n")
+	return b.String()
+}
+
+// zshQuote escapes s for a single-quoted _arguments or _describe spec.
+func zshQuote(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+	b.WriteString("#compdef favicon\n\n_favicon() {\n    local -a commands\n    commands=(\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "        '%s:%s'\n", c.name, zshQuote(c.summary))
+	}
+	b.WriteString("    )\n    if (( CURRENT == 2 )); then\n        _describe 'command' commands\n        return\n    fi\n")
+	b.WriteString("    shift words\n    (( CURRENT-- ))\n    case $words[1] in\n")
+	for i := range commands {
+		c := &commands[i]
+		fmt.Fprintf(&b, "    %s)\n        _arguments", c.name)
+		for _, f := range commandFlags(c) {
+			spec := "'" + f.spelling() + "[" + zshQuote(f.usage) + "]"
+			if f.hasValue {
+				action := ""
+				switch {
+				case f.values != nil:
+					action = "(" + strings.Join(f.values(), " ") + ")"
+				case f.dir:
+					action = "_files -/"
+				case f.file:
+					action = "_files"
+				}
+				spec += ":" + f.name + ":" + action
+			}
+			fmt.Fprintf(&b, " \\\n            %s'", spec)
+		}
+		switch c.name {
+		case "completion":
+			fmt.Fprintf(&b, " \\\n            '1:shell:(%s)'", strings.Join(completionShells, " "))
+		case "fetch", "discover", "prefetch":
+			b.WriteString(" \\\n            '*:domain:_hosts'")
+		case "purge":
+			b.WriteString(" \\\n            '1:host glob:_hosts'")
+		case "cache":
+			b.WriteString(" \\\n            '1:action:(show)' \\\n            '2:domain:_hosts'")
+		}
+		b.WriteString(" ;;\n")
+	}
+	b.WriteString("    esac\n}\n\n_favicon \"$@\"\n")
+	return b.String()
+}
+
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString("# fish completion for favicon\ncomplete -c favicon -f\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c favicon -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+	for i := range commands {
+		c := &commands[i]
+		cond := fishQuote("__fish_seen_subcommand_from " + c.name)
+		for _, f := range commandFlags(c) {
+			opt := "-l " + f.name
+			if len(f.name) == 1 {
+				opt = "-s " + f.name
+			}
+			if f.hasValue {
+				switch {
+				case f.values != nil:
+					opt += " -x -a " + fishQuote(strings.Join(f.values(), " "))
+				case f.dir:
+					opt += " -x -a '(__fish_complete_directories)'"
+				case f.file:
+					opt += " -r -F"
+				default:
+					opt += " -x"
+				}
+			}
+			fmt.Fprintf(&b, "complete -c favicon -n %s %s -d %s\n", cond, opt, fishQuote(f.usage))
+		}
+		switch c.name {
+		case "completion":
+			fmt.Fprintf(&b, "complete -c favicon -n %s -a %s\n", cond, fishQuote(strings.Join(completionShells, " ")))
+		case "cache":
+			fmt.Fprintf(&b, "complete -c favicon -n %s -a show\n", cond)
+		}
+	}
+	return b.String()
+}
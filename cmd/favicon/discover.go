@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/handler"
+	"faviconsvc/internal/security"
+)
+
+// discoverCandidate is one candidate listed by `favicon discover`, with
+// the fields /debug/discover reports before anything is fetched.
+type discoverCandidate struct {
+	// Order is the candidate's place in fetch order, from 1
+	Order      int    `json:"order"`
+	URL        string `json:"url"`
+	Source     string `json:"source"`
+	Rel        string `json:"rel"`
+	Type       string `json:"type,omitempty"`
+	Format     string `json:"format,omitempty"`
+	Sizes      []int  `json:"sizes,omitempty"`
+	RelRank    int    `json:"rel_rank"`
+	FormatRank int    `json:"format_rank"`
+	SizeScore  int    `json:"size_score"`
+}
+
+// discoverStage is one discovery pass, as in /debug/discover: hinted icon
+// URLs, the page, then optionally its apex domain.
+type discoverStage struct {
+	Page       string              `json:"page"`
+	Hint       bool                `json:"hint,omitempty"`
+	Apex       bool                `json:"apex,omitempty"`
+	DurationMs float64             `json:"duration_ms"`
+	Candidates []discoverCandidate `json:"candidates"`
+}
+
+// discoverResult is what `favicon discover` prints with -output json.
+type discoverResult struct {
+	URL    string          `json:"url"`
+	Size   int             `json:"size"`
+	Rank   string          `json:"rank"`
+	Stages []discoverStage `json:"stages"`
+}
+
+func (r discoverResult) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (size %d, rank %s)\n", r.URL, r.Size, r.Rank)
+	for _, st := range r.Stages {
+		kind := "page"
+		switch {
+		case st.Hint:
+			kind = "hints for"
+		case st.Apex:
+			kind = "apex"
+		}
+		fmt.Fprintf(&b, "\n%s %s (%.0fms)\n", kind, st.Page, st.DurationMs)
+		if len(st.Candidates) == 0 {
+			b.WriteString("  no candidates\n")
+			continue
+		}
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  #\tREL\tSOURCE\tFORMAT\tSIZES\tURL")
+		for _, c := range st.Candidates {
+			fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%s\t%s\n", c.Order, c.Rel, c.Source, orDash(c.Format), formatSizes(c.Sizes), c.URL)
+		}
+		tw.Flush()
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// discoverCommand implements `favicon discover`: it lists the candidates
+// the service would try for a page, in the order it would fetch them,
+// without fetching any image. Only the page (and the pages it redirects
+// to) and the manifest are requested.
+func discoverCommand(fs *flag.FlagSet) func(args []string) int {
+	size := fs.Int("size", handler.DefaultSize, "icon size in pixels (16-256) candidates are ranked for")
+	rankName := fs.String("rank", discovery.DefaultRankingStrategy, "candidate ranking strategy: "+strings.Join(discovery.RankingStrategies(), ", "))
+	apex := fs.Bool("apex", false, "also list the apex domain's candidates, which the service tries when none of the page's decodes")
+	hintsFile := fs.String("icon-hints", "", "JSON or CSV file of known icon URLs per host, as the server's -icon-hints")
+	output := outputFlag(fs)
+	client := addClientFlags(fs)
+
+	return func(args []string) int {
+		if len(args) != 1 {
+			return usageError(fs, "Expected one URL or domain")
+		}
+		rank, ok := discovery.LookupRankingStrategy(*rankName)
+		if !ok {
+			return usageError(fs, "Unknown ranking strategy %q", *rankName)
+		}
+		*size = min(max(*size, handler.MinSize), handler.MaxSize)
+		if err := client.apply(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *hintsFile != "" {
+			hints, err := discovery.LoadHintsFile(*hintsFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load icon hints: %v\n", err)
+				return 1
+			}
+			discovery.IconHints = hints
+		}
+		raw := args[0]
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, err := security.NormalizeURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid URL %q: %v\n", args[0], err)
+			return 1
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		res := discoverResult{URL: discovery.CanonicalizeURLString(u.String()), Size: *size, Rank: rank.Name()}
+		if hints := discovery.HintCandidates(u); len(hints) > 0 {
+			st := newDiscoverStage(u, hints, time.Now())
+			st.Hint = true
+			res.Stages = append(res.Stages, st)
+		}
+		start := time.Now()
+		cands := discovery.DiscoverFromPageThenRoot(ctx, u, *size)
+		rank.Order(cands, *size)
+		res.Stages = append(res.Stages, newDiscoverStage(u, cands, start))
+		if apexURL := discovery.ApexURL(u); apexURL != nil && (*apex || len(cands) == 0) && ctx.Err() == nil {
+			start := time.Now()
+			cands := discovery.DiscoverFromPageThenRoot(ctx, apexURL, *size)
+			rank.Order(cands, *size)
+			st := newDiscoverStage(apexURL, cands, start)
+			st.Apex = true
+			res.Stages = append(res.Stages, st)
+		}
+		if ctx.Err() != nil {
+			return 1
+		}
+		output.emit(res, res.text())
+		return 0
+	}
+}
+
+func newDiscoverStage(u *url.URL, cands []discovery.IconCandidate, start time.Time) discoverStage {
+	st := discoverStage{
+		Page:       discovery.CanonicalizeURLString(u.String()),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Candidates: make([]discoverCandidate, 0, len(cands)),
+	}
+	for i, c := range cands {
+		st.Candidates = append(st.Candidates, discoverCandidate{
+			Order:      i + 1,
+			URL:        shortURL(c.URL),
+			Source:     c.Source,
+			Rel:        c.Rel(),
+			Type:       c.Type,
+			Format:     c.Format(),
+			Sizes:      c.Sizes,
+			RelRank:    c.RelRank,
+			FormatRank: c.FormatRank,
+			SizeScore:  c.SizeScore,
+		})
+	}
+	return st
+}
+
+// formatSizes renders declared edge sizes as 16,32 or - for none.
+func formatSizes(sizes []int) string {
+	if len(sizes) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(sizes))
+	for i, n := range sizes {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// shortURL cuts inline data: URIs down to a readable prefix.
+func shortURL(s string) string {
+	const max = 80
+	if discovery.IsDataURI(s) && len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/handler"
+	imgpkg "faviconsvc/internal/image"
+)
+
+// errNoIcon is returned when the site has no usable icon and /favicons would
+// serve its placeholder.
+var errNoIcon = errors.New("no icon found")
+
+// fetchResult is one check of `favicon fetch`, as printed by -output json.
+type fetchResult struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	// Status is "new" (no earlier output file), "changed", "unchanged" or
+	// "error"
+	Status string `json:"status"`
+	File   string `json:"file,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+	// Similarity and ChangedPixels compare a changed icon with the
+	// previous output, when both decode (see image.DiffResult)
+	Similarity    *float64 `json:"similarity,omitempty"`
+	ChangedPixels *float64 `json:"changed_pixels,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+func (r fetchResult) text() string {
+	prefix := r.Time.Format(time.RFC3339) + " " + r.Domain + ": "
+	switch r.Status {
+	case "error":
+		return prefix + r.Error
+	case "unchanged":
+		return prefix + "unchanged, " + r.File + " is up to date"
+	case "new":
+		return fmt.Sprintf("%snew icon, wrote %s (%d bytes)", prefix, r.File, r.Bytes)
+	}
+	change := "icon changed"
+	if r.Similarity != nil {
+		change = fmt.Sprintf("icon changed (similarity %.3f, %.1f%% of pixels differ)", *r.Similarity, 100**r.ChangedPixels)
+	}
+	return fmt.Sprintf("%s%s, wrote %s (%d bytes)", prefix, change, r.File, r.Bytes)
+}
+
+// fetchCommand implements `favicon fetch`. With -watch it keeps checking
+// and rewrites the output file, printing what changed, whenever the icon
+// changes.
+func fetchCommand(fs *flag.FlagSet) func(args []string) int {
+	out := fs.String("o", "", "output file (empty=<domain>.<format>)")
+	size := fs.Int("size", handler.DefaultSize, "icon size in pixels (16-256)")
+	format := fs.String("format", "png", "output format by encoder name, e.g. png, webp, ico")
+	watch := fs.Bool("watch", false, "keep checking the domain and rewrite the output file when the icon changes")
+	interval := fs.Duration("interval", time.Hour, "time between checks with -watch")
+	output := outputFlag(fs)
+	client := addClientFlags(fs)
+
+	return func(args []string) int {
+		if len(args) != 1 {
+			return usageError(fs, "Expected one domain")
+		}
+		domain := args[0]
+		if *watch && *interval <= 0 {
+			return usageError(fs, "-interval must be positive")
+		}
+		enc, ok := imgpkg.LookupEncoder(*format)
+		if !ok {
+			return usageError(fs, "Unknown format %q", *format)
+		}
+		if *out == "" {
+			*out = domain + "." + enc.Name()
+		}
+		if err := client.apply(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		l := fetchLoop{
+			domain:   domain,
+			out:      *out,
+			size:     *size,
+			watch:    *watch,
+			interval: *interval,
+			output:   *output,
+			fetch: func(ctx context.Context) ([]byte, error) {
+				return fetchIcon(ctx, domain, *size, enc.Name())
+			},
+			stdout: os.Stdout,
+			stderr: os.Stderr,
+		}
+		return l.run(ctx)
+	}
+}
+
+// fetchLoop is the work of `favicon fetch`: one check of the icon, or with
+// watch one every interval, each reported unless the icon is unchanged.
+type fetchLoop struct {
+	domain, out    string
+	size           int
+	watch          bool
+	interval       time.Duration
+	output         outputFormat
+	fetch          func(ctx context.Context) ([]byte, error)
+	stdout, stderr io.Writer
+}
+
+// run checks the icon until ctx ends, or once without watch, and returns
+// the exit code. Ending ctx stops a watch cleanly, but interrupts a single
+// check, which then fails.
+func (l *fetchLoop) run(ctx context.Context) int {
+	// The file left by an earlier run is the baseline, so restarting a
+	// watch does not report a change
+	prev, _ := os.ReadFile(l.out)
+	for {
+		icon, err := l.fetch(ctx)
+		if ctx.Err() != nil {
+			if !l.watch {
+				fmt.Fprintf(l.stderr, "%s: interrupted\n", l.domain)
+				return 1
+			}
+			return 0
+		}
+		res := fetchResult{Time: time.Now().UTC().Truncate(time.Second), Domain: l.domain, File: l.out}
+		writeFailed := false
+		if err == nil && !bytes.Equal(icon, prev) {
+			err = writeFileAtomic(l.out, icon)
+			writeFailed = err != nil
+		}
+		switch {
+		case err != nil:
+			res.Status, res.File, res.Error = "error", "", err.Error()
+		case bytes.Equal(icon, prev):
+			res.Status = "unchanged"
+		default:
+			res.Status, res.Bytes = "changed", len(icon)
+			if len(prev) == 0 {
+				res.Status = "new"
+			} else if d, ok := compareIcons(prev, icon, l.size); ok {
+				res.Similarity, res.ChangedPixels = &d.Similarity, &d.Changed
+			}
+			prev = icon
+		}
+		// Errors go to stderr as text, unless a script asked for JSON
+		if res.Status == "error" && l.output == "text" {
+			fmt.Fprintln(l.stderr, res.text())
+		} else if res.Status != "unchanged" || !l.watch {
+			l.output.emitTo(l.stdout, res, res.text())
+		}
+		switch {
+		case writeFailed, res.Status == "error" && !l.watch:
+			return 1
+		case !l.watch:
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+// fetchIcon renders domain's icon through the /favicons handler. Each call
+// gets an empty cache of its own, so every check sees what the site serves
+// now.
+func fetchIcon(ctx context.Context, domain string, size int, format string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "favicon-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	cm := cache.New(dir, 24*time.Hour)
+	if err := cm.EnsureDirs(); err != nil {
+		return nil, err
+	}
+	rec, err := serveIcon(ctx, handler.NewConfig(cm, 0, 0, false), domain, size, format)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Header().Get(handler.HeaderCache) == handler.CacheFallback {
+		return nil, errNoIcon
+	}
+	return rec.Body.Bytes(), nil
+}
+
+// serveIcon runs a /favicons request for domain through cfg's handler. It
+// fails unless the handler served an icon or placeholder.
+func serveIcon(ctx context.Context, cfg *handler.Config, domain string, size int, format string) (*httptest.ResponseRecorder, error) {
+	q := url.Values{"domain": {domain}, "sz": {strconv.Itoa(size)}, "format": {format}}
+	req := httptest.NewRequest(http.MethodGet, "/favicons?"+q.Encode(), nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		msg := bytes.TrimSpace(rec.Body.Bytes())
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return nil, fmt.Errorf("status %d: %s", rec.Code, msg)
+	}
+	return rec, nil
+}
+
+// compareIcons compares icon with prev, the previous output, at size; ok is
+// false unless both decode.
+func compareIcons(prev, icon []byte, size int) (d imgpkg.DiffResult, ok bool) {
+	a, _, errA := imgpkg.Decode(prev, "", "", size)
+	b, _, errB := imgpkg.Decode(icon, "", "", size)
+	if errA != nil || errB != nil {
+		return d, false
+	}
+	return imgpkg.CompareImages(a, b, size), true
+}
+
+// writeFileAtomic replaces path with b through a rename, so scripts reading
+// the file never see it half written.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func solidPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// check is the outcome of one fake fetch: an icon or an error.
+type check struct {
+	icon []byte
+	err  error
+}
+
+// newFetchLoop returns a loop writing to out, whose checks return checks
+// in turn. Once they run out, the next check calls cancel, as an interrupt
+// would.
+func newFetchLoop(out string, watch bool, checks []check, cancel context.CancelFunc) (*fetchLoop, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+	n := 0
+	l := &fetchLoop{
+		domain:   "example.com",
+		out:      out,
+		size:     32,
+		watch:    watch,
+		interval: time.Millisecond,
+		output:   "json",
+		fetch: func(ctx context.Context) ([]byte, error) {
+			if n == len(checks) {
+				cancel()
+				return nil, ctx.Err()
+			}
+			c := checks[n]
+			n++
+			return c.icon, c.err
+		},
+		stdout: &stdout,
+		stderr: &stderr,
+	}
+	return l, &stdout, &stderr
+}
+
+// results decodes the JSON lines the loop printed.
+func results(t *testing.T, out *bytes.Buffer) []fetchResult {
+	t.Helper()
+	var rs []fetchResult
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r fetchResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("output line %q: %v", line, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestFetchLoopWatch(t *testing.T) {
+	red, blue := solidPNG(t, color.NRGBA{R: 255, A: 255}), solidPNG(t, color.NRGBA{B: 255, A: 255})
+	out := filepath.Join(t.TempDir(), "example.com.png")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, stdout, _ := newFetchLoop(out, true, []check{
+		{icon: red},
+		{icon: red},
+		{icon: blue},
+		{err: errors.New("status 503")},
+		{icon: blue},
+	}, cancel)
+	if code := l.run(ctx); code != 0 {
+		t.Errorf("watch stopped by its context: exit %d, want 0", code)
+	}
+	// Unchanged checks are not reported while watching; errors are, and
+	// do not end the watch
+	rs := results(t, stdout)
+	var statuses []string
+	for _, r := range rs {
+		statuses = append(statuses, r.Status)
+	}
+	if strings.Join(statuses, ",") != "new,changed,error" {
+		t.Fatalf("statuses %v, want new, changed, error", statuses)
+	}
+	if rs[1].Similarity == nil || *rs[1].Similarity >= 1 || rs[1].Bytes != len(blue) {
+		t.Errorf("change = %+v, want a similarity below 1 and the new size", rs[1])
+	}
+	if rs[2].Error != "status 503" || rs[2].File != "" {
+		t.Errorf("error = %+v", rs[2])
+	}
+	if b, _ := os.ReadFile(out); !bytes.Equal(b, blue) {
+		t.Error("output file does not hold the latest icon")
+	}
+
+	// A restarted watch takes the file as its baseline
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	l, stdout, _ = newFetchLoop(out, true, []check{{icon: blue}}, cancel)
+	if code := l.run(ctx); code != 0 || stdout.Len() != 0 {
+		t.Errorf("restarted watch: exit %d, output %q; want 0 and nothing reported", code, stdout)
+	}
+}
+
+func TestFetchLoopOnce(t *testing.T) {
+	red := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	dir := t.TempDir()
+	out := filepath.Join(dir, "example.com.png")
+
+	for _, tc := range []struct {
+		name   string
+		out    string
+		checks []check
+		code   int
+		status string
+	}{
+		{"new", out, []check{{icon: red}}, 0, "new"},
+		{"unchanged", out, []check{{icon: red}}, 0, "unchanged"},
+		{"error", out, []check{{err: errNoIcon}}, 1, "error"},
+		{"write failure", filepath.Join(dir, "missing", "icon.png"), []check{{icon: red}}, 1, "error"},
+		// An interrupt during the check fails it, reporting nothing
+		{"interrupted", out, nil, 1, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			l, stdout, stderr := newFetchLoop(tc.out, false, tc.checks, cancel)
+			if code := l.run(ctx); code != tc.code {
+				t.Errorf("exit %d, want %d", code, tc.code)
+			}
+			rs := results(t, stdout)
+			switch {
+			case tc.status == "":
+				if len(rs) != 0 || !strings.Contains(stderr.String(), "interrupted") {
+					t.Errorf("results %+v, stderr %q; want none and an interruption", rs, stderr)
+				}
+			case len(rs) != 1 || rs[0].Status != tc.status:
+				t.Errorf("results %+v, want one %s", rs, tc.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/logger"
+)
+
+// Command-line client resolving site icons the way the server's /favicons
+// does, without running the server, and managing a server's disk cache.
+// Every subcommand takes -output json to print results as JSON on stdout
+// instead of text, for scripts.
+// Usage: favicon <fetch|discover|prefetch|purge|stats|cache|migrate|completion> [flags] [args]
+
+// command is one favicon subcommand. setup defines its flags on fs and
+// returns the function running it on the remaining arguments, which
+// returns the exit code.
+type command struct {
+	name    string
+	summary string
+	args    string // positional arguments, for usage and completion
+	setup   func(fs *flag.FlagSet) func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Assigned here: completionCommand walks commands, which would make
+	// the declaration an initialization cycle
+	commands = []command{
+		{"fetch", "resolve a site's icon and write it to a file", "<domain>", fetchCommand},
+		{"discover", "list a page's icon candidates in fetch order, without fetching them", "<url|domain>", discoverCommand},
+		{"prefetch", "warm a cache directory with the icons of many sites", "[domain...]", prefetchCommand},
+		{"purge", "delete a host's entries from a cache directory", "<host-glob>", purgeCommand},
+		{"stats", "summarize what a cache directory holds", "", statsCommand},
+		{"cache", "show everything a cache directory holds for a domain", "show <domain>", cacheCommand},
+		{"migrate", "upgrade a cache directory to this build's layout", "", migrateCommand},
+		{"completion", "print a shell completion script", "<bash|zsh|fish>", completionCommand},
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run dispatches args to their subcommand and returns the exit code.
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return 2
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+	fs, runCmd := cmd.flags()
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	return runCmd(fs.Args())
+}
+
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// flags returns c's flag set and the function running it.
+func (c *command) flags() (*flag.FlagSet, func(args []string) int) {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: favicon %s [flags] %s\n\n%s.\n\nFlags:\n", c.name, c.args, capitalize(c.summary))
+		fs.PrintDefaults()
+	}
+	return fs, c.setup(fs)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: favicon <command> [flags] [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-11s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'favicon <command> -h' for a command's flags.")
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// usageError reports a bad invocation of fs and returns exit code 2.
+func usageError(fs *flag.FlagSet, format string, a ...any) int {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	fs.Usage()
+	return 2
+}
+
+// outputFormat is the value of -output: "text" or "json".
+type outputFormat string
+
+func (o *outputFormat) String() string { return string(*o) }
+
+func (o *outputFormat) Set(s string) error {
+	switch s {
+	case "text", "json":
+		*o = outputFormat(s)
+		return nil
+	}
+	return errors.New(`must be "text" or "json"`)
+}
+
+// outputFlag defines -output on fs.
+func outputFlag(fs *flag.FlagSet) *outputFormat {
+	o := outputFormat("text")
+	fs.Var(&o, "output", "`format` of the results: text or json")
+	return &o
+}
+
+// emit prints one result: v as a line of JSON with -output json, text
+// otherwise. Streams of results (fetch -watch, prefetch) are thus
+// newline-delimited JSON.
+func (o outputFormat) emit(v any, text string) {
+	o.emitTo(os.Stdout, v, text)
+}
+
+// emitTo is emit printing to w.
+func (o outputFormat) emitTo(w io.Writer, v any, text string) {
+	if o == "json" {
+		b, err := json.Marshal(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode result: %v\n", err)
+			return
+		}
+		w.Write(append(b, '\n'))
+		return
+	}
+	fmt.Fprintln(w, text)
+}
+
+// clientFlags are the flags of subcommands that fetch from sites.
+type clientFlags struct {
+	allowPrivate *bool
+	verbose      *bool
+}
+
+func addClientFlags(fs *flag.FlagSet) clientFlags {
+	return clientFlags{
+		allowPrivate: fs.Bool("allow-private", false, "allow fetching from private networks (RFC 1918, CGNAT, IPv6 ULA)"),
+		verbose:      fs.Bool("v", false, "log discovery and fetches to stderr"),
+	}
+}
+
+// apply sets up logging and the HTTP clients as the server does.
+func (c clientFlags) apply() error {
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(logger.ERROR)
+	if *c.verbose {
+		logger.SetLevel(logger.INFO)
+	}
+	fetch.InitHTTPClient()
+	if err := fetch.InitPageClient(""); err != nil {
+		return fmt.Errorf("failed to set up the page client: %w", err)
+	}
+	security.AllowPrivate = *c.allowPrivate
+	return nil
+}
@@ -52,7 +52,7 @@ func main() {
 
 	// Try encoding to PNG
 	fmt.Printf("\n💾 Testing PNG encoding...\n")
-	pngData, contentType := image.EncodeByFormat(resized, "png")
+	pngData, contentType := image.EncodeByFormat(resized, "png", 0)
 	if len(pngData) > 0 {
 		fmt.Printf("✅ PNG encoding successful: %d bytes, type=%s\n", len(pngData), contentType)
 		
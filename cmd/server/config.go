@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configEntry is one setting read from a -config file.
+type configEntry struct {
+	line       int
+	key, value string
+}
+
+// readConfigFile parses a flat YAML mapping of flag names to values:
+//
+//	cache-dir: /var/cache/favicon
+//	cache-ttl: 12h
+//	etag: true # comments are allowed
+//	image-comment: "Icons via example.org"
+//
+// Nested mappings and lists are rejected; every setting is a flag.
+func readConfigFile(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed != line[:len(trimmed)] || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: nested values and lists are not supported", n)
+		}
+		key, raw, ok := strings.Cut(trimmed, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("line %d: expected \"flag-name: value\"", n)
+		}
+		value, err := configValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n, key, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		seen[key] = true
+		entries = append(entries, configEntry{line: n, key: key, value: value})
+	}
+	return entries, sc.Err()
+}
+
+// configValue parses the value part of a config line: plain text up to a
+// " #" comment, or a single- or double-quoted YAML string.
+func configValue(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := strings.LastIndex(raw, `"`)
+		if end == 0 || !isComment(raw[end+1:]) {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return strconv.Unquote(raw[:end+1])
+	case strings.HasPrefix(raw, "'"):
+		end := strings.LastIndex(raw, "'")
+		if end == 0 || !isComment(raw[end+1:]) {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return strings.ReplaceAll(raw[1:end], "''", "'"), nil
+	}
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw), nil
+}
+
+func isComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
+
+// applyConfigFile sets the flags named in the config file at path, except
+// those given on the command line, which take precedence.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, e := range entries {
+		if e.key == "config" || e.key == "help" || fs.Lookup(e.key) == nil {
+			return fmt.Errorf("line %d: unknown setting %q", e.line, e.key)
+		}
+		if explicit[e.key] {
+			continue
+		}
+		if err := fs.Set(e.key, e.value); err != nil {
+			return fmt.Errorf("line %d: %s: %v", e.line, e.key, err)
+		}
+	}
+	return nil
+}
+
+// writeEffectiveConfig writes every setting of fs in the -config format,
+// sorted by name. Secrets are left out so the output can be logged.
+func writeEffectiveConfig(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "help":
+			return
+		case "admin-token", "auth-keys", "jwt-secret":
+			if f.Value.String() != "" {
+				fmt.Fprintf(w, "# %s: set, not shown\n", f.Name)
+				return
+			}
+		}
+		fmt.Fprintf(w, "%s: %s\n", f.Name, configQuote(f.Value.String()))
+	})
+}
+
+// configQuote quotes v when it would not read back as the same plain value.
+func configQuote(v string) string {
+	if v == "" || v != strings.TrimSpace(v) || strings.Contains(v, " #") || strings.ContainsAny(v[:1], `"'#`) ||
+		strings.ContainsAny(v, "\n\t") {
+		return strconv.Quote(v)
+	}
+	return v
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a -config file holding body and returns its path.
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	entries, err := readConfigFile(writeConfig(t, `---
+# settings
+cache-dir: /var/cache/favicon
+cache-ttl: 12h # half a day
+etag: true
+image-comment: "Icons via example.org # not a comment"
+log-level: 'it''s'
+empty: ""
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configEntry{
+		{3, "cache-dir", "/var/cache/favicon"},
+		{4, "cache-ttl", "12h"},
+		{5, "etag", "true"},
+		{6, "image-comment", "Icons via example.org # not a comment"},
+		{7, "log-level", "it's"},
+		{8, "empty", ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	for name, body := range map[string]string{
+		"nested":       "archive:\n  dir: /a\n",
+		"list":         "- cache-dir\n",
+		"no colon":     "cache-dir /a\n",
+		"quoted key":   "\"cache-dir\": /a\n",
+		"set twice":    "cache-dir: /a\ncache-dir: /b\n",
+		"unterminated": "image-comment: \"Icons\n",
+		"trailing":     "image-comment: \"Icons\" here\n",
+	} {
+		if _, err := readConfigFile(writeConfig(t, body)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *string, *time.Duration) {
+		fs := flag.NewFlagSet("server", flag.ContinueOnError)
+		dir := fs.String("cache-dir", "./cache", "")
+		ttl := fs.Duration("cache-ttl", 24*time.Hour, "")
+		fs.String("config", "", "")
+		return fs, dir, ttl
+	}
+
+	// Flags on the command line win over the file
+	fs, dir, ttl := newFlags()
+	_ = fs.Parse([]string{"-cache-ttl", "1h"})
+	if err := applyConfigFile(fs, writeConfig(t, "cache-dir: /srv/cache\ncache-ttl: 12h\n")); err != nil {
+		t.Fatal(err)
+	}
+	if *dir != "/srv/cache" || *ttl != time.Hour {
+		t.Errorf("cache-dir %q, cache-ttl %v; want /srv/cache from the file and 1h from the command line", *dir, *ttl)
+	}
+
+	for name, body := range map[string]string{
+		"unknown":   "cache-size: 1\n",
+		"config":    "config: other.yaml\n",
+		"bad value": "cache-ttl: soon\n",
+	} {
+		fs, _, _ := newFlags()
+		if err := applyConfigFile(fs, writeConfig(t, body)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%s: error = %v, want one naming line 1", name, err)
+		}
+	}
+}
+
+func TestWriteEffectiveConfig(t *testing.T) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.String("admin-token", "hunter2", "")
+	fs.String("auth-keys", "", "")
+	fs.String("jwt-secret", "s3cret", "")
+	fs.String("image-comment", " padded", "")
+	fs.String("cache-dir", "/var/cache/favicon", "")
+	fs.String("config", "server.yaml", "")
+
+	var out bytes.Buffer
+	writeEffectiveConfig(&out, fs)
+	got := out.String()
+	for _, secret := range []string{"hunter2", "s3cret"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("effective configuration shows a secret:\n%s", got)
+		}
+	}
+	for _, line := range []string{
+		"# admin-token: set, not shown\n",
+		"# jwt-secret: set, not shown\n",
+		"auth-keys: \"\"\n",
+		"cache-dir: /var/cache/favicon\n",
+		"image-comment: \" padded\"\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("effective configuration lacks %q:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, "config:") {
+		t.Errorf("effective configuration names -config:\n%s", got)
+	}
+
+	// What is printed reads back as the same settings
+	path := writeConfig(t, got)
+	entries, err := readConfigFile(path)
+	if err != nil {
+		t.Fatalf("reading back: %v", err)
+	}
+	for _, e := range entries {
+		if want := fs.Lookup(e.key).Value.String(); e.value != want {
+			t.Errorf("%s reads back as %q, want %q", e.key, e.value, want)
+		}
+	}
+}
+
+// TestMain runs the server's main when re-executed by runServer, as flags
+// are registered on the process-wide flag.CommandLine and parse errors
+// exit.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAVICON_TEST_MAIN") == "1" {
+		os.Args = append([]string{"server"}, strings.Fields(os.Getenv("FAVICON_TEST_ARGS"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runServer runs the server binary with args and returns its exit code,
+// stdout and stderr.
+func runServer(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "FAVICON_TEST_MAIN=1", "FAVICON_TEST_ARGS="+strings.Join(args, " "))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return cmd.ProcessState.ExitCode(), stdout.String(), stderr.String()
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := writeConfig(t, "cache-dir: "+filepath.Join(dir, "cache")+"\nadmin-token: hunter2\njwt-secret: s3cret\n")
+
+	code, stdout, stderr := runServer(t, "validate-config", "-config", valid)
+	if code != 0 {
+		t.Fatalf("valid configuration: exit %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "# effective configuration") || !strings.Contains(stdout, "cache-dir: "+filepath.Join(dir, "cache")+"\n") {
+		t.Errorf("valid configuration: stdout lacks the effective configuration:\n%s", stdout)
+	}
+	if strings.Contains(stdout+stderr, "hunter2") || strings.Contains(stdout+stderr, "s3cret") {
+		t.Errorf("valid configuration: output shows a secret:\n%s%s", stdout, stderr)
+	}
+
+	// Command-line flags are checked and win over the file
+	code, stdout, stderr = runServer(t, "validate-config", "-config", valid, "-cache-ttl", "-1h", "-log-level", "loud")
+	if code != 1 || stdout != "" {
+		t.Errorf("invalid values: exit %d, stdout %q; want 1 and nothing printed", code, stdout)
+	}
+	for _, want := range []string{"-cache-ttl must not be negative", "-log-level \"loud\"", "configuration invalid: 2 error(s)"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("invalid values: stderr lacks %q:\n%s", want, stderr)
+		}
+	}
+
+	code, _, stderr = runServer(t, "validate-config", "-config", writeConfig(t, "cache-size: 1\n"))
+	if code != 2 || !strings.Contains(stderr, `unknown setting "cache-size"`) {
+		t.Errorf("unknown setting: exit %d, stderr %q; want 2", code, stderr)
+	}
+	code, _, _ = runServer(t, "validate-config", "-config", filepath.Join(dir, "missing.yaml"))
+	if code != 2 {
+		t.Errorf("missing configuration file: exit %d, want 2", code)
+	}
+}
@@ -2,86 +2,248 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"faviconsvc/internal/archive"
+	"faviconsvc/internal/auth"
+	"faviconsvc/internal/batch"
 	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
 	"faviconsvc/internal/fetch"
 	"faviconsvc/internal/handler"
+	"faviconsvc/internal/image"
+	"faviconsvc/internal/render"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/analytics"
+	"faviconsvc/pkg/loadctl"
 	"faviconsvc/pkg/logger"
 	"faviconsvc/pkg/metrics"
 	"faviconsvc/pkg/ratelimit"
+	"faviconsvc/pkg/watchdog"
 )
 
 var (
 	addrFlag        string
 	portFlag        int
+	internalAddr    string
+	debugRecord     bool
 	cacheDir        string
 	cacheTTL        time.Duration
 	browserMaxAge   time.Duration
 	cdnSMaxAge      time.Duration
 	useETag         bool
+	etagHash        string
+	weakETag        bool
 	janitorInterval time.Duration
+	candidatesTTL   time.Duration
+	historyTTL      time.Duration
+	historyVersions int
 	maxCacheSize    int64
 	showHelp        bool
+	configFile      string
 	logLevel        string
 	// Rate limiting
 	rateLimit       int
 	rateLimitBurst  int
 	ipRateLimit     int
 	ipRateLimitBurst int
+	// Candidate fetching
+	parallelFetches    int
+	goodEnoughSize     int
+	trustDeclared      bool
+	speculativeRoot    bool
+	rankingStrategy    string
+	pageTLSFingerprint string
+	preflightURL       string
+	preflightTimeout   time.Duration
+	// Analytics
+	analyticsDB              string
+	analyticsRetention       time.Duration
+	analyticsRollupRetention time.Duration
+	// Latency objectives
+	sloSpec string
+	// Background load control
+	bgLatencyThreshold time.Duration
+	bgCPUThreshold     float64
+	selfCheckInterval  time.Duration
+	// Request context
+	requestBudget       time.Duration
+	allowDebugHeader    bool
+	allowDeadlineHeader bool
+	// SVG rendering
+	svgRendererName string
+	resvgPath       string
+	// Output metadata
+	imageComment       string
+	maxImagePixels     int64
+	disableEncoders    string
+	disableDecoders    string
+	exposeCacheHeaders bool
+	blurhashHeader     bool
+	dedupVariants      bool
+	serverTiming       bool
+	maxVariants        int
+	notFoundTTL        time.Duration
+	unavailableTTL     time.Duration
+	responseHeaders    string
+	proxyAllow         string
+	proxyMaxBytes      int64
+	defaultImageAllow  string
+	dprClientHints     bool
+	// Resizing
+	resampleFilter string
+	sharpen        float64
+	fitMode        string
+	// Fallback placeholder
+	fallbackStyle  string
+	fallbackStatus int
+	letterTileFont string
+	// External converter
+	externalConverter            string
+	externalConverterPath        string
+	externalConverterTimeout     time.Duration
+	externalConverterConcurrency int
+	// Post-processing hook
+	postProcessCmd         string
+	postProcessTimeout     time.Duration
+	postProcessConcurrency int
+	// Headless rendering
+	renderJS          bool
+	renderChromePath  string
+	renderTimeout     time.Duration
+	renderConcurrency int
+	// Admin endpoints
+	adminToken string
+	// API authentication
+	authMethod    string
+	authKeys      string
+	authKeyLimits string
+	authMaxSkew   time.Duration
+	jwtSecret   string
+	jwtIssuer   string
+	jwtAudience string
+	jwtJWKSURL  string
+	jwtRefresh  time.Duration
+	jwtPerms    string
+	// Known icon URLs
+	iconHintsFile string
+	// Per-tenant branding
+	tenantsFile string
+	// Origin headers passed through
+	upstreamHeaders string
+	// Root favicon.ico probing
+	httpsOnly bool
+
+	// Network policy
+	allowPrivate     bool
+	requireDot       bool
+	singleLabelHosts string
+	// AMP/mobile alternate pass
+	alternatePages bool
+	// Snapshot archive
+	archiveDomains    string
+	archiveDir        string
+	archiveS3         string
+	archiveS3Endpoint string
+	archiveS3Region   string
+	archiveInterval   time.Duration
+	// Batch jobs
+	batchConcurrency  int
+	batchPerHost      int
+	batchHostInterval time.Duration
+	batchMaxDomains   int
+	batchJobTTL       time.Duration
+	batchResultsDir   string
 )
 
 func main() {
-	parseFlags()
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(runValidateConfig(os.Args[2:]))
+	}
+	parseFlags(os.Args[1:])
 
 	if showHelp {
 		flag.Usage()
 		return
 	}
 
+	resolveDefaults()
+
 	// Initialize logger
 	initLogger()
 
 	// Initialize fetch client
 	fetch.InitHTTPClient()
+	if err := fetch.InitPageClient(pageTLSFingerprint); err != nil {
+		logger.Error("Invalid -page-tls-fingerprint: %v", err)
+		os.Exit(1)
+	}
+
+	// Which hosts may be fetched from
+	security.AllowPrivate = allowPrivate
+	security.RequireDot = requireDot
+	hostPatterns, err := security.ParseHostPatterns(singleLabelHosts)
+	if err != nil {
+		logger.Error("Invalid -single-label-hosts: %v", err)
+		os.Exit(1)
+	}
+	security.SingleLabelHosts = hostPatterns
+	if allowPrivate {
+		logger.Warn("Private networks may be fetched from (-allow-private); keep the service away from untrusted callers")
+	}
+
+	// Fail fast when upstream fetches cannot get out
+	if preflightURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+		start := time.Now()
+		status, err := fetch.Preflight(ctx, preflightURL)
+		cancel()
+		if err != nil {
+			logger.Error("Startup preflight failed, check the network, DNS, proxy and CA settings: %v", err)
+			os.Exit(1)
+		}
+		logger.Info("Startup preflight: %s answered %d in %v", preflightURL, status, time.Since(start).Round(time.Millisecond))
+	}
 
 	// Setup cache
 	cacheManager := cache.New(cacheDir, cacheTTL)
+	cacheManager.CandidatesTTL = candidatesTTL
+	cacheManager.TimelineVersions = historyVersions
 	if err := cacheManager.EnsureDirs(); err != nil {
 		logger.Error("Failed to create cache directories: %v", err)
 		os.Exit(1)
 	}
-
-	// Resolve effective cache headers
-	effectiveBrowserMaxAge := browserMaxAge
-	if effectiveBrowserMaxAge <= 0 {
-		effectiveBrowserMaxAge = cacheTTL
-	}
-	effectiveCDNSMaxAge := cdnSMaxAge
-	if effectiveCDNSMaxAge <= 0 {
-		effectiveCDNSMaxAge = effectiveBrowserMaxAge
+	if _, err := cacheManager.Migrate(logger.Info); err != nil {
+		logger.Error("Failed to migrate the cache: %v", err)
+		os.Exit(1)
 	}
 
 	// Setup rate limiter
+	keyLimits, err := rateLimitKeyLimits()
+	if err != nil {
+		logger.Error("Invalid -auth-key-limits: %v", err)
+		os.Exit(1)
+	}
+	if len(keyLimits) > 0 {
+		logger.Info("Per-key rate limits: %d keys", len(keyLimits))
+	}
 	var rateLimiter *ratelimit.Limiter
-	if rateLimit > 0 || ipRateLimit > 0 {
-		// Set default burst values
-		if rateLimitBurst == 0 && rateLimit > 0 {
-			rateLimitBurst = rateLimit * 2
-		}
-		if ipRateLimitBurst == 0 && ipRateLimit > 0 {
-			ipRateLimitBurst = ipRateLimit * 2
-		}
-		
-		rateLimiter = ratelimit.NewLimiter(rateLimit, rateLimitBurst, ipRateLimit, ipRateLimitBurst)
+	if rateLimit > 0 || ipRateLimit > 0 || len(keyLimits) > 0 {
+		rateLimiter = ratelimit.NewKeyedLimiter(rateLimit, rateLimitBurst, ipRateLimit, ipRateLimitBurst, keyLimits)
 		
 		// Log rate limiting configuration
 		if rateLimit > 0 && ipRateLimit > 0 {
@@ -98,55 +260,323 @@ func main() {
 		logger.Info("Rate limiting disabled (unlimited requests)")
 	}
 
+	// Setup authentication
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		logger.Error("Invalid authentication settings: %v", err)
+		os.Exit(1)
+	}
+	logger.Info("API authentication: %s", strings.ToLower(authMethod))
+	// Bearer tokens that grant purge or upload also open the admin endpoints
+	adminJWT, _ := authenticator.(*auth.JWT)
+
+	// Setup latency objectives
+	if sloSpec != "" {
+		slos, err := metrics.ParseSLOs(sloSpec)
+		if err != nil {
+			logger.Error("Invalid -slo: %v", err)
+			os.Exit(1)
+		}
+		metrics.Get().SetSLOs(slos)
+		for _, o := range slos {
+			tier := o.Tier
+			if tier == "" {
+				tier = "*"
+			}
+			logger.Info("SLO %s: %.2f%% of %s requests < %v", o.Name, o.Target*100, tier, o.Threshold)
+		}
+	}
+
 	// Setup HTTP handler
 	handlerCfg := handler.NewConfig(
 		cacheManager,
-		effectiveBrowserMaxAge,
-		effectiveCDNSMaxAge,
+		browserMaxAge,
+		cdnSMaxAge,
 		useETag,
 	)
+	handlerCfg.ParallelFetches = parallelFetches
+	handlerCfg.GoodEnoughSize = goodEnoughSize
+	handlerCfg.TrustDeclaredSizes = trustDeclared
+	handlerCfg.SpeculativeRootFetch = speculativeRoot
+	handlerCfg.ResampleFilter = resampleFilter
+	handlerCfg.Fit = fitMode
+	handlerCfg.FallbackStyle = fallbackStyle
+	handlerCfg.FallbackStatus = fallbackStatus
+	handlerCfg.ExposeCacheInfo = exposeCacheHeaders
+	handlerCfg.Blurhash = blurhashHeader
+	handlerCfg.DedupVariants = dedupVariants
+	handlerCfg.ServerTiming = serverTiming
+	handlerCfg.MaxVariantsPerDomain = maxVariants
+	handlerCfg.NotFoundTTL = notFoundTTL
+	handlerCfg.UnavailableTTL = unavailableTTL
+	handlerCfg.ProxyAllow = splitList(proxyAllow)
+	handlerCfg.ProxyMaxBytes = proxyMaxBytes
+	handlerCfg.DefaultImageAllow = splitList(defaultImageAllow)
+	handlerCfg.DPRClientHints = dprClientHints
+	if responseHeaders != "" {
+		h, err := handler.ParseResponseHeaders(responseHeaders)
+		if err != nil {
+			logger.Error("Invalid -response-headers: %v", err)
+			os.Exit(1)
+		}
+		handlerCfg.ResponseHeaders = h
+	}
+	if upstreamHeaders != "" {
+		names, err := handler.ParseUpstreamHeaders(upstreamHeaders)
+		if err != nil {
+			logger.Error("Invalid -upstream-headers: %v", err)
+			os.Exit(1)
+		}
+		handlerCfg.UpstreamHeaders = names
+	}
+	if _, ok := discovery.LookupRankingStrategy(rankingStrategy); !ok {
+		logger.Error("Unknown ranking strategy %q (available: %s)", rankingStrategy, strings.Join(discovery.RankingStrategies(), ", "))
+		os.Exit(1)
+	}
+	handlerCfg.Ranking = rankingStrategy
+	if !slices.Contains(handler.ETagHashes, etagHash) {
+		logger.Error("Unknown -etag-hash %q (available: %s)", etagHash, strings.Join(handler.ETagHashes, ", "))
+		os.Exit(1)
+	}
+	handlerCfg.ETagHash, handlerCfg.WeakETag = etagHash, weakETag
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/favicons", handler.FaviconHandler(handlerCfg))
-	mux.HandleFunc("/health", healthHandler)
-	mux.HandleFunc("/metrics", metrics.Get().Handler())
+	// Setup request analytics
+	var analyticsStore *analytics.Store
+	if analyticsDB != "" {
+		var err error
+		analyticsStore, err = analytics.Open(analyticsDB, analyticsRetention, analyticsRollupRetention)
+		if err != nil {
+			logger.Error("Failed to open analytics database: %v", err)
+			os.Exit(1)
+		}
+		handlerCfg.Analytics = analyticsStore
+		logger.Info("Request analytics enabled: %s (raw retention: %v, rollup retention: %v)",
+			analyticsDB, analyticsRetention, analyticsRollupRetention)
+	}
 
-	addr := resolveListenAddr()
+	// Select SVG rasterization backend
+	svgRenderer, err := image.NewSVGRenderer(svgRendererName, resvgPath)
+	if err != nil {
+		logger.Error("Failed to set up SVG renderer: %v", err)
+		os.Exit(1)
+	}
+	image.SetSVGRenderer(svgRenderer)
+	logger.Info("SVG renderer: %s", svgRenderer.Name())
 
-	// Build middleware chain: rate limit -> metrics -> logging
-	var finalHandler http.Handler = mux
-	if rateLimiter != nil {
-		finalHandler = ratelimit.Middleware(rateLimiter)(finalHandler)
+	image.OutputComment = imageComment
+	image.Sharpen = sharpen
+	image.MaxPixels = maxImagePixels
+	if letterTileFont != "" {
+		if err := image.LoadTileFont(letterTileFont); err != nil {
+			logger.Error("Failed to load -letter-tile-font: %v", err)
+			os.Exit(1)
+		}
 	}
-	finalHandler = metrics.Middleware(finalHandler)
-	finalHandler = logMiddleware(finalHandler)
 
-	srv := &http.Server{
-		Addr:              addr,
-		Handler:           finalHandler,
-		ReadHeaderTimeout: 5 * time.Second,
+	// Hand payloads the native decoders reject to an external tool
+	var externalConv *image.ExternalConverter
+	if externalConverter != "" {
+		var err error
+		externalConv, err = image.NewExternalConverter(image.ExternalConverterOptions{
+			Tool:        externalConverter,
+			Path:        externalConverterPath,
+			Timeout:     externalConverterTimeout,
+			Concurrency: externalConverterConcurrency,
+		})
+		if err != nil {
+			logger.Error("Failed to set up external converter: %v", err)
+			os.Exit(1)
+		}
+		image.RegisterDecoder(externalConv.Decoder())
+		logger.Info("External converter: %s (timeout: %v)", externalConv.Name(), externalConverterTimeout)
+	}
+
+	// Operator transforms of every final image, such as watermarks
+	var postProcessHook *image.PostProcessCommand
+	if postProcessCmd != "" {
+		hook, err := image.NewPostProcessCommand(image.PostProcessCommandOptions{
+			Path:        postProcessCmd,
+			Timeout:     postProcessTimeout,
+			Concurrency: postProcessConcurrency,
+		})
+		if err != nil {
+			logger.Error("Failed to set up -post-process-cmd: %v", err)
+			os.Exit(1)
+		}
+		image.RegisterPostProcessor(hook.PostProcessor())
+		postProcessHook = hook
+		logger.Info("Post-processing: %s (timeout: %v)", hook.Name(), postProcessTimeout)
 	}
 
-	// Start server
-	go func() {
-		printAddr := addr
-		if strings.HasPrefix(addr, ":") {
-			printAddr = "localhost" + addr
+	// Codecs are detected at run time; configuration can turn them off
+	if err := image.SetDisabledFormats(splitList(disableEncoders), splitList(disableDecoders)); err != nil {
+		logger.Error("Invalid -disable-encoders or -disable-decoders: %v", err)
+		os.Exit(1)
+	}
+	var outputFormats []string
+	for _, e := range image.Encoders() {
+		outputFormats = append(outputFormats, e.Name())
+	}
+	logger.Info("Output formats: %s", strings.Join(outputFormats, ", "))
+
+	// Setup headless rendering for JavaScript-only pages
+	var pageRenderer *render.Renderer
+	if renderJS {
+		var err error
+		pageRenderer, err = render.New(render.Options{
+			ChromePath:  renderChromePath,
+			Timeout:     renderTimeout,
+			Concurrency: renderConcurrency,
+		})
+		if err != nil {
+			logger.Error("Failed to start headless browser: %v", err)
+			os.Exit(1)
 		}
-		logger.Info("Starting favicon service on http://%s", printAddr)
-		logger.Info("Cache directory: %s (TTL: %v)", cacheDir, cacheTTL)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("Server error: %v", err)
+		discovery.PageRenderer = pageRenderer
+		logger.Info("Headless rendering enabled (timeout: %v, concurrency: %d)", renderTimeout, renderConcurrency)
+	}
+
+	// Dated snapshots for ?as_of, optionally collected on a schedule
+	var archiveSched *archive.Scheduler
+	if archiveDir != "" || archiveS3 != "" {
+		var store archive.Store
+		var err error
+		if archiveS3 != "" {
+			store, err = archive.NewS3Store(archiveS3, archiveS3Endpoint, archiveS3Region)
+		} else {
+			store, err = archive.NewLocalStore(archiveDir)
+		}
+		if err != nil {
+			logger.Error("Failed to set up archive store: %v", err)
 			os.Exit(1)
 		}
-	}()
+		handlerCfg.Archive = archive.New(store)
+		if archiveDomains != "" {
+			domains, err := archive.ParseDomains(archiveDomains)
+			if err != nil {
+				logger.Error("Invalid -archive-domains: %v", err)
+				os.Exit(1)
+			}
+			archiveSched = &archive.Scheduler{
+				Archive:  handlerCfg.Archive,
+				Domains:  domains,
+				Fetch:    handler.ArchiveFetcher(handlerCfg),
+				Interval: archiveInterval,
+			}
+		}
+	} else if archiveDomains != "" {
+		logger.Error("-archive-domains requires -archive-dir or -archive-s3")
+		os.Exit(1)
+	}
+
+	discovery.HTTPSOnly = httpsOnly
+	discovery.AlternatePages = alternatePages
+
+	// Known-good icon URLs tried before page discovery
+	if iconHintsFile != "" {
+		hints, err := discovery.LoadHintsFile(iconHintsFile)
+		if err != nil {
+			logger.Error("Failed to load icon hints: %v", err)
+			os.Exit(1)
+		}
+		discovery.IconHints = hints
+		logger.Info("Icon hints loaded: %d hosts from %s", hints.Len(), iconHintsFile)
+	} else if adminToken != "" || adminJWT != nil {
+		// Start empty so hints can be added through the admin API
+		discovery.IconHints = discovery.NewHints()
+	}
+
+	// Branding of tenants, applied by the tenant of a request's credentials
+	if tenantsFile != "" {
+		tenants, err := handler.LoadTenantStore(tenantsFile)
+		if err != nil {
+			logger.Error("Failed to load tenant branding: %v", err)
+			os.Exit(1)
+		}
+		handlerCfg.Tenants = tenants
+		logger.Info("Tenant branding loaded: %d tenants from %s", len(tenants.All()), tenantsFile)
+	}
+
+	// Asynchronous batches, throttled per site so one batch cannot flood an origin
+	batchDir := batchResultsDir
+	if batchDir == "-" {
+		batchDir = ""
+	}
+	batchMgr := batch.NewManager(handler.BatchResolver(handlerCfg), batch.Options{
+		Concurrency:  batchConcurrency,
+		PerHost:      batchPerHost,
+		HostInterval: batchHostInterval,
+		MaxDomains:   batchMaxDomains,
+		JobTTL:       batchJobTTL,
+		Dir:          batchDir,
+	})
+
+	// Health self-checks, which also pet the systemd watchdog when the unit
+	// sets WatchdogSec=
+	addr := resolveListenAddr()
+	health := watchdog.Start(watchdog.Config{
+		Interval: selfCheckInterval,
+		Checks:   selfChecks(addr, cacheManager),
+	})
+
+	publicMux, internalMux := newMuxes(handlerCfg, batchMgr, health, adminJWT)
+
+	if internalAddr != "" && internalAddr == addr {
+		logger.Error("-internal-addr must differ from the public listen address %s", addr)
+		os.Exit(1)
+	}
+
+	// Rate limiting and authentication apply to public traffic only; a
+	// separate internal listener is neither throttled nor authenticated
+	servers := []*http.Server{newServer(addr, wrapHandler(publicMux, rateLimiter, authenticator))}
+	if internalAddr != "" {
+		servers = append(servers, newServer(internalAddr, wrapHandler(internalMux, nil, nil)))
+	}
+
+	// Start listeners
+	logger.Info("Cache directory: %s (TTL: %v)", cacheDir, cacheTTL)
+	for i, srv := range servers {
+		name := "favicon service"
+		if i > 0 {
+			name = "internal endpoints"
+		}
+		go func(srv *http.Server, name string) {
+			printAddr := srv.Addr
+			if strings.HasPrefix(printAddr, ":") {
+				printAddr = "localhost" + printAddr
+			}
+			logger.Info("Starting %s on http://%s", name, printAddr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Server error on %s: %v", srv.Addr, err)
+				os.Exit(1)
+			}
+		}(srv, name)
+	}
+
+	if sent, err := watchdog.Notify(watchdog.StateReady); err != nil {
+		logger.Warn("Failed to notify systemd of readiness: %v", err)
+	} else if sent {
+		logger.Info("Readiness reported to systemd")
+	}
+
+	// Background work backs off when foreground latency or CPU run hot
+	loadctl.Get().Start(loadctl.Config{
+		LatencyThreshold: bgLatencyThreshold,
+		CPUThreshold:     bgCPUThreshold,
+	})
 
 	// Start janitor if enabled
 	var janCtx context.Context
 	var janCancel context.CancelFunc
 	if janitorInterval > 0 {
 		janCtx, janCancel = context.WithCancel(context.Background())
-		go cache.RunJanitor(janCtx, janitorInterval, cacheDir, cacheTTL, maxCacheSize)
+		go cache.RunJanitor(janCtx, janitorInterval, cacheDir, cacheTTL, historyTTL, maxCacheSize)
+	}
+
+	archiveCtx, archiveCancel := context.WithCancel(context.Background())
+	defer archiveCancel()
+	if archiveSched != nil {
+		go archiveSched.Run(archiveCtx)
 	}
 
 	// Wait for shutdown signal
@@ -155,10 +585,14 @@ func main() {
 	<-ctx.Done()
 
 	logger.Info("Shutting down gracefully...")
+	_, _ = watchdog.Notify(watchdog.StateStopping)
+	health.Stop()
 
 	if janCancel != nil {
 		janCancel()
 	}
+	archiveCancel()
+	batchMgr.Close()
 
 	if rateLimiter != nil {
 		rateLimiter.Stop()
@@ -166,19 +600,48 @@ func main() {
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_ = srv.Shutdown(shutdownCtx)
+	for _, srv := range servers {
+		_ = srv.Shutdown(shutdownCtx)
+	}
+
+	loadctl.Get().Stop()
+
+	if pageRenderer != nil {
+		pageRenderer.Close()
+	}
+
+	if externalConv != nil {
+		_ = externalConv.Close()
+	}
+
+	if postProcessHook != nil {
+		_ = postProcessHook.Close()
+	}
+
+	if analyticsStore != nil {
+		if err := analyticsStore.Close(); err != nil {
+			logger.Warn("Failed to close analytics database: %v", err)
+		}
+	}
 
 	logger.Info("Server stopped")
 }
 
-func parseFlags() {
+func parseFlags(args []string) {
 	flag.StringVar(&addrFlag, "addr", "", "listen address, e.g. ':9090' or '0.0.0.0:9090'")
 	flag.IntVar(&portFlag, "port", 0, "port number (alternative to -addr)")
+	flag.StringVar(&internalAddr, "internal-addr", "", "separate listen address for admin, metrics, stats and debug endpoints, e.g. '127.0.0.1:9091' (empty=serve them on -addr)")
+	flag.BoolVar(&debugRecord, "enable-debug-record", false, "Serve /debug/record and /debug/replay on -addr when -internal-addr is unset")
 	flag.StringVar(&cacheDir, "cache-dir", "./cache", "directory for disk cache")
 	flag.DurationVar(&cacheTTL, "cache-ttl", 24*time.Hour, "TTL for disk cache entries")
 	flag.DurationVar(&browserMaxAge, "browser-max-age", 0, "Cache-Control: max-age (default=cache-ttl)")
 	flag.DurationVar(&cdnSMaxAge, "cdn-smax-age", 0, "Cache-Control: s-maxage (default=browser-max-age)")
 	flag.BoolVar(&useETag, "etag", true, "Enable ETag/If-None-Match")
+	flag.StringVar(&etagHash, "etag-hash", handler.ETagSHA256, "ETag hash: sha256, or crc32c for less CPU per response")
+	flag.BoolVar(&weakETag, "weak-etag", false, "Send weak ETags (W/\"...\")")
+	flag.DurationVar(&candidatesTTL, "candidates-ttl", 6*time.Hour, "How long discovered icon candidates are reused across sizes (0=cache-ttl)")
+	flag.DurationVar(&historyTTL, "history-ttl", 30*24*time.Hour, "How long superseded icon versions are kept for /favicons/diff (0=until the size limit evicts them)")
+	flag.IntVar(&historyVersions, "history-versions", cache.DefaultTimelineVersions, "Icon changes kept per host for /api/history and as_of")
 	flag.DurationVar(&janitorInterval, "janitor-interval", 30*time.Minute, "Purge expired cache (0=disabled)")
 	flag.Int64Var(&maxCacheSize, "max-cache-size-bytes", 0, "Max cache size in bytes (0=unlimited)")
 	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
@@ -186,8 +649,120 @@ func parseFlags() {
 	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 0, "Global burst capacity (0=auto: rate*2)")
 	flag.IntVar(&ipRateLimit, "ip-rate-limit", 0, "Requests/second per IP (0=unlimited)")
 	flag.IntVar(&ipRateLimitBurst, "ip-rate-limit-burst", 0, "Per-IP burst capacity (0=auto: rate*2)")
+	flag.IntVar(&parallelFetches, "parallel-fetches", handler.DefaultParallelFetches, "Icon candidates fetched concurrently (1=sequential)")
+	flag.IntVar(&goodEnoughSize, "good-enough-size", 0, "Stop fetching candidates once one decodes at this edge size (0=requested size)")
+	flag.BoolVar(&trustDeclared, "trust-declared-sizes", false, "Fetch candidates whose declared sizes suffice first, and stop at the first of them that decodes, whatever its actual size")
+	flag.BoolVar(&speculativeRoot, "speculative-root-fetch", true, "Fetch /favicon.ico concurrently with the page HTML during discovery")
+	flag.StringVar(&rankingStrategy, "ranking", discovery.DefaultRankingStrategy, "Default candidate ranking: largest, closest-size, vector-first")
+	flag.StringVar(&pageTLSFingerprint, "page-tls-fingerprint", "", "Mimic a browser TLS ClientHello for page fetches: chrome, firefox, safari or random (empty=Go default)")
+	flag.StringVar(&preflightURL, "preflight-url", "", "URL fetched at startup through the upstream proxy, dialer and TLS settings; the service exits when it cannot be reached (empty=no preflight)")
+	flag.DurationVar(&preflightTimeout, "preflight-timeout", 10*time.Second, "How long the -preflight-url fetch may take")
+	flag.StringVar(&analyticsDB, "analytics-db", "", "SQLite file for per-request analytics (empty=disabled)")
+	flag.DurationVar(&analyticsRetention, "analytics-retention", 7*24*time.Hour, "How long raw analytics rows are kept before daily rollup")
+	flag.DurationVar(&analyticsRollupRetention, "analytics-rollup-retention", 365*24*time.Hour, "How long daily analytics rollups are kept (0=forever)")
+	flag.StringVar(&sloSpec, "slo", "", "Latency SLOs as name:tier:threshold:target, comma-separated (e.g. cache-hit:resized:50ms:99)")
+	flag.DurationVar(&bgLatencyThreshold, "bg-latency-threshold", 2*time.Second, "Pause background work when smoothed request latency exceeds this (0=ignore)")
+	flag.DurationVar(&selfCheckInterval, "self-check-interval", 0, "How often health self-checks (listener, image pipeline, cache writes) run, reported on /health; under a systemd watchdog they run every WatchdogSec/2 at most and gate its pings (0=only under the watchdog)")
+	flag.Float64Var(&bgCPUThreshold, "bg-cpu-threshold", 0.8, "Pause background work when process CPU exceeds this fraction of all cores (0=ignore)")
+	flag.DurationVar(&requestBudget, "request-budget", 0, "Overall time allowed per request (0=unlimited)")
+	flag.BoolVar(&allowDebugHeader, "allow-debug-header", false, "Honour X-Debug request header (verbose,nocache)")
+	flag.BoolVar(&allowDeadlineHeader, "allow-deadline-header", false, "Honour X-Deadline-Ms request header, shortening -request-budget per request")
+	flag.StringVar(&svgRendererName, "svg-renderer", image.SVGRendererEmbedded, "SVG backend: resvg-wasm (embedded) or resvg-cli (external binary)")
+	flag.StringVar(&resvgPath, "resvg-path", "resvg", "resvg binary for -svg-renderer=resvg-cli")
+	flag.StringVar(&resampleFilter, "resample-filter", image.FilterAuto, "Resampling filter for resizing: auto, nearest, bilinear, catmullrom, lanczos, fast")
+	flag.Float64Var(&sharpen, "sharpen", 0, "Unsharp-mask strength applied after downscaling to 32px or less, e.g. 0.8 (0=off)")
+	flag.StringVar(&fitMode, "fit", image.FitStretch, "How non-square icons are made square: stretch, contain (letterbox on transparency) or cover (crop)")
+	flag.StringVar(&fallbackStyle, "fallback-style", image.FallbackGlobe, "Placeholder when no icon is found: globe, letter (a tile with the domain's initial) or error-image (one per failure: blocked, timeout, not found)")
+	flag.IntVar(&fallbackStatus, "fallback-status", http.StatusOK, "Status of placeholder responses: 200, or 404 so monitoring can tell them from icons")
+	flag.StringVar(&letterTileFont, "letter-tile-font", "", "Extra TrueType/OpenType font for letter-tile initials the bundled font lacks, e.g. CJK or emoji (empty=none)")
+	flag.BoolVar(&exposeCacheHeaders, "expose-cache-headers", false, "Add X-Icon-Content-Hash (CID of the original icon) and X-Cache-Key (cache key of the variant) to icon responses")
+	flag.BoolVar(&blurhashHeader, "blurhash", false, "Add X-Icon-Blurhash (BlurHash placeholder of the icon) to icon responses and a blurhash field to multi-size JSON responses")
+	flag.StringVar(&responseHeaders, "response-headers", "", "Static headers for icon responses as class:Name: value, ';'-separated or @file with one per line; classes icon, sizes, bundle or * (empty value removes a header)")
+	flag.BoolVar(&serverTiming, "server-timing", false, "Add a Server-Timing header with discovery, fetch, decode, encode and cache durations to icon responses")
+	flag.IntVar(&maxVariants, "max-variants-per-domain", handler.DefaultMaxVariantsPerDomain, "Resized variants (size and format) cached per domain before new sizes are snapped to the nearest cached one (0 = unlimited)")
+	flag.StringVar(&proxyAllow, "proxy-allow", "", "Comma-separated hosts /proxy serves images from, each with its subdomains (empty=proxy disabled)")
+	flag.Int64Var(&proxyMaxBytes, "proxy-max-bytes", handler.DefaultProxyMaxBytes, "Largest image /proxy serves, in bytes (at most 4 MiB)")
+	flag.StringVar(&defaultImageAllow, "default-image-allow", "", "Comma-separated hosts, each with its subdomains, whose images the default parameter may name to replace the placeholder (empty=only default=404)")
+	flag.StringVar(&upstreamHeaders, "upstream-headers", "", "Comma-separated origin headers of the source icon passed through: last-modified (replaces the service's Last-Modified) and etag (sent as X-Upstream-ETag) (empty=service values only)")
+	flag.BoolVar(&dprClientHints, "dpr-client-hints", false, "Take the device pixel ratio of requests without dpr from the Sec-CH-DPR client hint and request it with Accept-CH")
+	flag.DurationVar(&notFoundTTL, "not-found-ttl", handler.DefaultNotFoundTTL, "How long a page with no icon is remembered before it is looked up again (0=disabled)")
+	flag.DurationVar(&unavailableTTL, "unavailable-ttl", handler.DefaultUnavailableTTL, "How long a page whose lookup failed on upstream errors (5xx, 408, 429, timeouts) is remembered (0=disabled)")
+	flag.BoolVar(&dedupVariants, "dedup-variants", true, "Store byte-identical resized variants of different icons once, as hard links")
+	flag.Int64Var(&maxImagePixels, "max-image-pixels", image.DefaultMaxPixels, "Max width×height an upstream image may declare; larger ones are rejected before decoding (0=unlimited)")
+	flag.StringVar(&disableEncoders, "disable-encoders", "", "Comma-separated output formats to turn off, e.g. avif (requests for them fall back as for unavailable formats)")
+	flag.StringVar(&disableDecoders, "disable-decoders", "", "Comma-separated input decoders to turn off, e.g. heif (their payloads go to the external converter, if any)")
+	flag.StringVar(&imageComment, "image-comment", "", "Attribution text embedded in PNG responses as a tEXt comment (empty=none)")
+	flag.StringVar(&externalConverter, "external-converter", "", "Fallback converter for images the native decoders reject: vips or magick (empty=disabled)")
+	flag.StringVar(&externalConverterPath, "external-converter-path", "", "Binary for -external-converter (empty=tool name on PATH)")
+	flag.DurationVar(&externalConverterTimeout, "external-converter-timeout", image.DefaultExternalTimeout, "Max time for one external conversion")
+	flag.IntVar(&externalConverterConcurrency, "external-converter-concurrency", image.DefaultExternalConcurrency, "External conversions run at once")
+	flag.StringVar(&postProcessCmd, "post-process-cmd", "", "Executable every final image is piped through as PNG before encoding, e.g. to watermark (empty=disabled)")
+	flag.DurationVar(&postProcessTimeout, "post-process-timeout", image.DefaultPostProcessTimeout, "Max time for one -post-process-cmd run; on failure the image is served untransformed")
+	flag.IntVar(&postProcessConcurrency, "post-process-concurrency", image.DefaultExternalConcurrency, "-post-process-cmd runs at once")
+	flag.BoolVar(&renderJS, "render-js", false, "Render pages in headless Chrome when static HTML has no icon links")
+	flag.StringVar(&renderChromePath, "render-chrome-path", "", "Chrome/Chromium binary for -render-js (empty=search PATH)")
+	flag.DurationVar(&renderTimeout, "render-timeout", render.DefaultTimeout, "Max time to render one page")
+	flag.IntVar(&renderConcurrency, "render-concurrency", render.DefaultConcurrency, "Pages rendered at once")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("FAVICON_ADMIN_TOKEN"), "Bearer token for /admin endpoints (empty=disabled; default $FAVICON_ADMIN_TOKEN)")
+	flag.StringVar(&authMethod, "auth", auth.MethodNone, "API authentication for public endpoints: none, apikey, hmac or jwt")
+	flag.StringVar(&authKeys, "auth-keys", os.Getenv("FAVICON_AUTH_KEYS"), "Credentials for -auth=apikey|hmac as id:secret, comma-separated, or @file with one per line (default $FAVICON_AUTH_KEYS)")
+	flag.StringVar(&authKeyLimits, "auth-key-limits", "", "Rate limits of -auth-keys keys as id=rate[/burst], comma-separated, replacing -ip-rate-limit for them (rate 0=unlimited, burst default rate*2)")
+	flag.DurationVar(&authMaxSkew, "auth-max-skew", auth.DefaultMaxSkew, "How far an HMAC-signed request's timestamp may be from the server clock")
+	flag.StringVar(&jwtSecret, "jwt-secret", os.Getenv("FAVICON_JWT_SECRET"), "HS256 key bearer tokens are signed with for -auth=jwt (default $FAVICON_JWT_SECRET)")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "Required iss claim of bearer tokens (empty=any)")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "Required aud claim of bearer tokens (empty=any; required for OIDC tokens)")
+	flag.StringVar(&jwtJWKSURL, "jwt-jwks-url", "", "Key set URL for tokens of the OIDC provider -jwt-issuer (empty=from discovery)")
+	flag.DurationVar(&jwtRefresh, "jwt-jwks-refresh", auth.DefaultJWKSRefresh, "How often the OIDC provider's key set is fetched again")
+	flag.StringVar(&jwtPerms, "jwt-permissions", "", "Scopes and claims granting read, purge and upload, e.g. purge=favicons.admin|groups:ops (empty=scopes of the same name; read=any token)")
+	flag.StringVar(&tenantsFile, "tenants-file", "", "JSON file of per-tenant branding (fallback image, letter-tile palette, default size and format), managed through /admin/tenants (empty=disabled)")
+	flag.StringVar(&iconHintsFile, "icon-hints", "", "JSON or CSV file of known icon URLs per host, tried before page discovery")
+	flag.BoolVar(&alternatePages, "alternate-pages", false, "Search a page's AMP and mobile alternates for icon links when the page itself has none")
+	flag.BoolVar(&allowPrivate, "allow-private", false, "Allow fetching from private networks (RFC 1918, CGNAT, IPv6 ULA) for intranet sites; loopback and link-local stay blocked")
+	flag.BoolVar(&requireDot, "require-dot", true, "Reject hostnames without a dot unless they match -single-label-hosts")
+	flag.StringVar(&singleLabelHosts, "single-label-hosts", "", "Dotless hostnames accepted with -require-dot, as comma-separated globs, e.g. wiki,intranet-*")
+	flag.BoolVar(&httpsOnly, "https-only", false, "Never probe http:// for the root favicon.ico (HTTPS pages sending HSTS skip it regardless)")
+	flag.StringVar(&archiveDomains, "archive-domains", "", "Domains to archive daily, comma-separated or @file with one per line (empty=no scheduled archival)")
+	flag.StringVar(&archiveDir, "archive-dir", "", "Directory for dated icon snapshots served with ?as_of (empty=disabled)")
+	flag.StringVar(&archiveS3, "archive-s3", "", "S3 location for dated icon snapshots, s3://bucket/prefix (overrides -archive-dir)")
+	flag.StringVar(&archiveS3Endpoint, "archive-s3-endpoint", "", "S3-compatible endpoint URL for -archive-s3 (empty=AWS)")
+	flag.StringVar(&archiveS3Region, "archive-s3-region", "", "Region for -archive-s3 (empty=AWS_REGION or us-east-1)")
+	flag.DurationVar(&archiveInterval, "archive-interval", 24*time.Hour, "How often to archive domains missing today's snapshot")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", batch.DefaultConcurrency, "Lookups one batch job runs at once")
+	flag.IntVar(&batchPerHost, "batch-per-host", batch.DefaultPerHost, "Max concurrent batch lookups against one site (registrable domain), across all jobs")
+	flag.DurationVar(&batchHostInterval, "batch-host-interval", batch.DefaultHostInterval, "Min time between batch lookup starts for one site")
+	flag.IntVar(&batchMaxDomains, "batch-max-domains", batch.DefaultMaxDomains, "Max distinct domains in one batch request")
+	flag.DurationVar(&batchJobTTL, "batch-job-ttl", batch.DefaultJobTTL, "How long finished batch jobs and their downloadable results are kept")
+	flag.StringVar(&batchResultsDir, "batch-results-dir", "", "Directory persisting finished batch results across restarts (empty=<cache-dir>/batch, \"-\"=memory only)")
+	flag.StringVar(&configFile, "config", "", "Flat YAML file of flag settings (flag-name: value); command-line flags take precedence")
 	flag.BoolVar(&showHelp, "help", false, "Show help and exit")
-	flag.Parse()
+	_ = flag.CommandLine.Parse(args)
+	if configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "-config %s: %v\n", configFile, err)
+			os.Exit(2)
+		}
+	}
+}
+
+// resolveDefaults fills in settings whose defaults derive from others, so
+// the server and validate-config see the same effective configuration.
+func resolveDefaults() {
+	addrFlag = resolveListenAddr()
+	if browserMaxAge <= 0 {
+		browserMaxAge = cacheTTL
+	}
+	if cdnSMaxAge <= 0 {
+		cdnSMaxAge = browserMaxAge
+	}
+	if rateLimitBurst == 0 && rateLimit > 0 {
+		rateLimitBurst = rateLimit * 2
+	}
+	if ipRateLimitBurst == 0 && ipRateLimit > 0 {
+		ipRateLimitBurst = ipRateLimit * 2
+	}
+	if batchResultsDir == "" {
+		batchResultsDir = filepath.Join(cacheDir, "batch")
+	}
 }
 
 func initLogger() {
@@ -219,10 +794,157 @@ func resolveListenAddr() string {
 	return ":9090"
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+// wrapHandler builds the middleware chain every listener shares. A
+// request passes through request state -> logging -> metrics ->
+// authentication (when authn is non-nil) -> rate limit (when rl is
+// non-nil), which is keyed by the principal authentication set. /health and
+// the admin endpoints, which check a token of their own, skip
+// authentication. Failed authentications are charged to the client IP's
+// bucket of rl.
+func wrapHandler(h http.Handler, rl *ratelimit.Limiter, authn auth.Authenticator) http.Handler {
+	var allowFailure func(r *http.Request) bool
+	if rl != nil {
+		h = ratelimit.KeyedMiddleware(rl, rateLimitKey)(h)
+		allowFailure = func(r *http.Request) bool { return rl.Allow(ratelimit.ClientIP(r)) }
+	}
+	if authn != nil {
+		h = auth.LimitedMiddleware(authn, allowFailure, "/health", "/admin/")(h)
+	}
+	h = metrics.Middleware(h)
+	h = logMiddleware(h)
+	return reqctx.Middleware(reqctx.Options{
+		Budget:        requestBudget,
+		AllowDebug:    allowDebugHeader,
+		AllowDeadline: allowDeadlineHeader,
+	})(h)
+}
+
+// rateLimitKey buckets authenticated callers by principal, so the clients
+// of one key share a limit however many addresses they use, and anonymous
+// callers by IP.
+func rateLimitKey(r *http.Request) string {
+	if p := reqctx.From(r.Context()).Principal; !p.Anonymous() {
+		return p.Method + ":" + p.ID
+	}
+	return ratelimit.ClientIP(r)
+}
+
+// rateLimitKeyLimits returns the -auth-key-limits limits keyed as
+// rateLimitKey buckets the callers of those keys.
+func rateLimitKeyLimits() (map[string]ratelimit.Limit, error) {
+	limits, err := ratelimit.ParseLimits(authKeyLimits)
+	if err != nil || len(limits) == 0 {
+		return nil, err
+	}
+	method := strings.ToLower(strings.TrimSpace(authMethod))
+	keyed := make(map[string]ratelimit.Limit, len(limits))
+	for id, lim := range limits {
+		keyed[method+":"+id] = lim
+	}
+	return keyed, nil
+}
+
+// newAuthenticator builds the authenticator selected by -auth.
+func newAuthenticator() (auth.Authenticator, error) {
+	keys, err := auth.ParseKeys(authKeys)
+	if err != nil {
+		return nil, fmt.Errorf("-auth-keys: %w", err)
+	}
+	perms, err := auth.ParsePermissionMap(jwtPerms)
+	if err != nil {
+		return nil, fmt.Errorf("-jwt-permissions: %w", err)
+	}
+	return auth.New(auth.Config{
+		Method:      authMethod,
+		Keys:        keys,
+		MaxSkew:     authMaxSkew,
+		JWTSecret:   []byte(jwtSecret),
+		Issuer:      jwtIssuer,
+		Audience:    jwtAudience,
+		JWKSURL:     jwtJWKSURL,
+		JWKSRefresh: jwtRefresh,
+		Permissions: perms,
+	})
+}
+
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// splitList returns the non-empty, trimmed entries of a comma-separated
+// flag value.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// healthHandler answers /health: ok, or 503 with the failing check while
+// the latest round of self-checks failed.
+func healthHandler(health *watchdog.Watchdog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if st := health.Status(); !st.Healthy {
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": "unhealthy", "check": st})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+	}
+}
+
+// selfChecks are the health checks run every -self-check-interval and
+// before each systemd watchdog ping: the public listener at addr still
+// answers, the image pipeline still renders, and the cache directory
+// still takes writes.
+func selfChecks(addr string, cm *cache.Manager) []watchdog.Check {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", strings.TrimPrefix(addr, ":")
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	healthURL := "http://" + net.JoinHostPort(host, port) + "/health"
+	client := &http.Client{}
+	return []watchdog.Check{
+		{Name: "listener", Func: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+			if err != nil {
+				return err
+			}
+			// Any answer will do; /health itself reports failed checks
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		}},
+		{Name: "pipeline", Func: func(context.Context) error {
+			img, err := image.CreateFallbackImage(handler.DefaultSize)
+			if err != nil {
+				return err
+			}
+			if data, _ := image.EncodeByFormat(image.ResizeImage(img, 16), "png", 0); len(data) == 0 {
+				return errors.New("encoding a PNG failed")
+			}
+			return nil
+		}},
+		{Name: "cache", Func: func(context.Context) error {
+			return cm.Probe()
+		}},
+	}
 }
 
 func logMiddleware(next http.Handler) http.Handler {
@@ -231,7 +953,13 @@ func logMiddleware(next http.Handler) http.Handler {
 		rw := &statusRecorder{ResponseWriter: w, status: 200}
 		next.ServeHTTP(rw, r)
 		duration := time.Since(start)
-		logger.Info("%s %s %d %v", r.Method, r.URL.String(), rw.status, duration)
+		st := reqctx.From(r.Context())
+		if p := st.Principal; !p.Anonymous() {
+			metrics.Get().IncPrincipalRequest(p.Method, p.ID, rw.status)
+			logger.Info("[%s] %s %s %d %v principal=%s:%s", st.RequestID, r.Method, auth.RedactedURL(r), rw.status, duration, p.Method, p.ID)
+			return
+		}
+		logger.Info("[%s] %s %s %d %v", st.RequestID, r.Method, auth.RedactedURL(r), rw.status, duration)
 	})
 }
 
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"faviconsvc/internal/auth"
+	"faviconsvc/internal/batch"
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/handler"
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+	"faviconsvc/pkg/watchdog"
+)
+
+// newMuxes registers the service's routes. Public routes serve icons;
+// internal routes expose operations and debugging. With -internal-addr
+// the two sets get separate muxes, otherwise one mux serves both and is
+// returned twice.
+func newMuxes(cfg *handler.Config, batchMgr *batch.Manager, health *watchdog.Watchdog, adminJWT *auth.JWT) (publicMux, internalMux *http.ServeMux) {
+	publicMux = http.NewServeMux()
+	internalMux = publicMux
+	if internalAddr != "" {
+		internalMux = http.NewServeMux()
+		internalMux.HandleFunc("/health", healthHandler(health))
+	}
+	publicMux.HandleFunc("/favicons", handler.FaviconHandler(cfg))
+	publicMux.HandleFunc("/favicons/diff", handler.DiffHandler(cfg))
+	publicMux.HandleFunc("/favicons/bundle.ico", handler.BundleHandler(cfg))
+	publicMux.HandleFunc("/api/icon", handler.IconInfoHandler(cfg))
+	publicMux.HandleFunc("/api/history", handler.HistoryHandler(cfg))
+	publicMux.HandleFunc("/api/capabilities", handler.CapabilitiesHandler())
+	publicMux.HandleFunc("/report", handler.ReportHandler(cfg))
+	publicMux.HandleFunc("/favicons/batch", handler.BatchHandler(batchMgr))
+	publicMux.HandleFunc("/favicons/batch/", handler.BatchStatusHandler(batchMgr, cfg))
+	publicMux.HandleFunc("/health", healthHandler(health))
+	if len(cfg.ProxyAllow) > 0 {
+		publicMux.HandleFunc("/proxy", handler.ProxyHandler(cfg))
+		logger.Info("Image proxy enabled for %s", strings.Join(cfg.ProxyAllow, ", "))
+	}
+	internalMux.HandleFunc("/debug/discover", handler.DebugDiscoverHandler(cfg))
+	// Recording fetches any URL live on the caller's behalf, and replay
+	// runs the pipeline on uploaded bundles, so neither is served where
+	// the public can reach it unless asked for
+	if internalAddr != "" || debugRecord {
+		internalMux.HandleFunc("/debug/record", handler.DebugRecordHandler(cfg))
+		internalMux.HandleFunc("/debug/replay", handler.DebugReplayHandler(cfg))
+	}
+	internalMux.HandleFunc("/stats", handler.StatsHandler(cfg))
+	internalMux.HandleFunc("/metrics", metrics.Get().Handler())
+	internalMux.HandleFunc("/slo", metrics.Get().SLOHandler())
+	if adminToken != "" || adminJWT != nil {
+		internalMux.Handle("/admin/purge", handler.AdminAuthJWT(adminToken, adminJWT, auth.PermPurge, handler.AdminPurgeHandler(cfg)))
+		internalMux.Handle("/admin/hints", handler.AdminAuthJWT(adminToken, adminJWT, auth.PermUpload, handler.AdminHintsHandler(discovery.IconHints)))
+		if cfg.Tenants != nil {
+			internalMux.Handle("/admin/tenants", handler.AdminAuthJWT(adminToken, adminJWT, auth.PermUpload, handler.AdminTenantsHandler(cfg.Tenants)))
+		}
+		logger.Info("Admin endpoints enabled")
+	}
+	return publicMux, internalMux
+}
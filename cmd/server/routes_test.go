@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"faviconsvc/internal/batch"
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/handler"
+)
+
+// servedRoutes returns which of paths mux has a handler for.
+func servedRoutes(mux *http.ServeMux, paths []string) map[string]bool {
+	served := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		_, pattern := mux.Handler(httptest.NewRequest("GET", p, nil))
+		served[p] = pattern != ""
+	}
+	return served
+}
+
+func TestNewMuxes(t *testing.T) {
+	publicRoutes := []string{"/favicons", "/favicons/diff", "/favicons/bundle.ico", "/favicons/batch", "/favicons/batch/job1",
+		"/api/icon", "/api/history", "/api/capabilities", "/report", "/proxy"}
+	internalRoutes := []string{"/debug/discover", "/debug/record", "/debug/replay", "/stats", "/metrics", "/slo",
+		"/admin/purge", "/admin/hints", "/admin/tenants"}
+	all := append(append([]string{"/health"}, publicRoutes...), internalRoutes...)
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.ProxyAllow = []string{"*.example.com"}
+	tenants, err := handler.LoadTenantStore(filepath.Join(t.TempDir(), "tenants.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Tenants = tenants
+	batchMgr := batch.NewManager(handler.BatchResolver(cfg), batch.Options{})
+	defer batchMgr.Close()
+
+	prevInternal, prevRecord, prevToken := internalAddr, debugRecord, adminToken
+	defer func() { internalAddr, debugRecord, adminToken = prevInternal, prevRecord, prevToken }()
+	adminToken = "secret"
+
+	for _, tc := range []struct {
+		name                  string
+		internalAddr          string
+		debugRecord           bool
+		public, internal, off []string
+	}{
+		{name: "one listener", public: all, off: []string{"/debug/record", "/debug/replay"}},
+		{name: "one listener with debug record", debugRecord: true, public: all},
+		{name: "separate listeners", internalAddr: "127.0.0.1:9091", public: append([]string{"/health"}, publicRoutes...), internal: internalRoutes},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			internalAddr, debugRecord = tc.internalAddr, tc.debugRecord
+			public, internal := newMuxes(cfg, batchMgr, nil, nil)
+			want := make(map[string]bool)
+			for _, p := range tc.public {
+				want[p] = true
+			}
+			for _, p := range tc.off {
+				want[p] = false
+			}
+			got := servedRoutes(public, all)
+			for _, p := range all {
+				if got[p] != want[p] {
+					t.Errorf("public listener serves %s: %v, want %v", p, got[p], want[p])
+				}
+			}
+			if tc.internalAddr == "" {
+				if internal != public {
+					t.Error("internal routes got a mux of their own without -internal-addr")
+				}
+				return
+			}
+			want = map[string]bool{"/health": true}
+			for _, p := range tc.internal {
+				want[p] = true
+			}
+			got = servedRoutes(internal, all)
+			for _, p := range all {
+				if got[p] != want[p] {
+					t.Errorf("internal listener serves %s: %v, want %v", p, got[p], want[p])
+				}
+			}
+		})
+	}
+}
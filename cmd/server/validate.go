@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/auth"
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/handler"
+	"faviconsvc/internal/image"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/metrics"
+	"faviconsvc/pkg/ratelimit"
+)
+
+// chromeNames are the browser binaries -render-js finds on PATH when
+// -render-chrome-path is empty.
+var chromeNames = []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "headless-shell", "chrome"}
+
+// configCheck collects the problems found by validate-config.
+type configCheck struct {
+	errors, warnings []string
+}
+
+func (c *configCheck) errorf(format string, args ...any) {
+	c.errors = append(c.errors, fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) warnf(format string, args ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// runValidateConfig implements `server validate-config [flags]`: it checks
+// the configuration given by flags and -config without starting the
+// service, prints problems to stderr and, when there are no errors, the
+// effective configuration to stdout in -config format. It returns the
+// process exit code.
+func runValidateConfig(args []string) int {
+	parseFlags(args)
+	if showHelp {
+		flag.Usage()
+		return 0
+	}
+	// Raw values are checked before derived defaults copy them around
+	var c configCheck
+	c.checkValues(flag.CommandLine)
+	resolveDefaults()
+	c.checkListeners()
+	c.checkPaths()
+	c.checkTTLs()
+	c.checkBackends()
+
+	for _, w := range c.warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	for _, e := range c.errors {
+		fmt.Fprintln(os.Stderr, "error:", e)
+	}
+	if len(c.errors) > 0 {
+		fmt.Fprintf(os.Stderr, "configuration invalid: %d error(s)\n", len(c.errors))
+		return 1
+	}
+
+	var encoders []string
+	for _, e := range image.Encoders() {
+		encoders = append(encoders, e.Name())
+	}
+	fmt.Printf("# effective configuration; output formats available: %s\n", strings.Join(encoders, ", "))
+	writeEffectiveConfig(os.Stdout, flag.CommandLine)
+	return 0
+}
+
+// checkValues rejects negative durations and counts, which no setting
+// gives a meaning to.
+func (c *configCheck) checkValues(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		g, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		switch v := g.Get().(type) {
+		case time.Duration:
+			if v < 0 {
+				c.errorf("-%s must not be negative (got %v)", f.Name, v)
+			}
+		case int:
+			if v < 0 {
+				c.errorf("-%s must not be negative (got %d)", f.Name, v)
+			}
+		case int64:
+			if v < 0 {
+				c.errorf("-%s must not be negative (got %d)", f.Name, v)
+			}
+		case float64:
+			if v < 0 {
+				c.errorf("-%s must not be negative (got %g)", f.Name, v)
+			}
+		}
+	})
+
+	switch strings.ToLower(logLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		c.errorf("-log-level %q is not one of debug, info, warn, error", logLevel)
+	}
+	if _, ok := discovery.LookupRankingStrategy(rankingStrategy); !ok {
+		c.errorf("-ranking %q is unknown (available: %s)", rankingStrategy, strings.Join(discovery.RankingStrategies(), ", "))
+	}
+	switch fallbackStyle {
+	case image.FallbackGlobe, image.FallbackLetter, image.FallbackErrorImage:
+	default:
+		c.errorf("-fallback-style %q is not one of globe, letter, error-image", fallbackStyle)
+	}
+	if !slices.Contains(handler.ETagHashes, etagHash) {
+		c.errorf("-etag-hash %q is not one of %s", etagHash, strings.Join(handler.ETagHashes, ", "))
+	}
+	if proxyMaxBytes > fetch.MaxFetchBytes {
+		c.warnf("-proxy-max-bytes %d exceeds the %d-byte fetch limit, which applies instead", proxyMaxBytes, fetch.MaxFetchBytes)
+	}
+	if err := image.SetDisabledFormats(splitList(disableEncoders), splitList(disableDecoders)); err != nil {
+		c.errorf("-disable-encoders or -disable-decoders: %v", err)
+	}
+	if fallbackStatus != http.StatusOK && fallbackStatus != http.StatusNotFound {
+		c.errorf("-fallback-status %d is not 200 or 404", fallbackStatus)
+	}
+	if image.ParseFilter(resampleFilter) == "" {
+		c.errorf("-resample-filter %q is not one of %s", resampleFilter, strings.Join(image.Filters, ", "))
+	}
+	if image.ParseFit(fitMode) == "" {
+		c.errorf("-fit %q is not one of %s", fitMode, strings.Join(image.Fits, ", "))
+	}
+	if pageTLSFingerprint != "" && !slices.Contains(fetch.TLSFingerprints, strings.ToLower(pageTLSFingerprint)) {
+		c.errorf("-page-tls-fingerprint %q is not one of %s", pageTLSFingerprint, strings.Join(fetch.TLSFingerprints, ", "))
+	}
+	if preflightURL != "" {
+		if u, err := url.Parse(preflightURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.errorf("-preflight-url %q is not an http or https URL", preflightURL)
+		}
+		if preflightTimeout <= 0 {
+			c.errorf("-preflight-timeout must be positive")
+		}
+	}
+	if _, err := newAuthenticator(); err != nil {
+		c.errorf("-auth: %v", err)
+	}
+	if limits, err := ratelimit.ParseLimits(authKeyLimits); err != nil {
+		c.errorf("-auth-key-limits: %v", err)
+	} else if len(limits) > 0 {
+		keys, _ := auth.ParseKeys(authKeys)
+		for id := range limits {
+			if _, ok := keys[id]; !ok {
+				c.warnf("-auth-key-limits names %q, which is not a key of -auth-keys", id)
+			}
+		}
+	}
+	if _, err := security.ParseHostPatterns(singleLabelHosts); err != nil {
+		c.errorf("-single-label-hosts: %v", err)
+	}
+	if (singleLabelHosts != "" || !requireDot) && !allowPrivate {
+		c.warnf("single-label hosts usually resolve to private addresses, which stay blocked without -allow-private")
+	}
+	if authMethod == auth.MethodJWT && jwtSecret == "" && jwtIssuer != "" && jwtAudience == "" {
+		c.errorf("-jwt-audience is required for OIDC tokens, or tokens the provider issued to any other client are accepted")
+	}
+	if jwtJWKSURL != "" && (jwtSecret != "" || jwtIssuer == "") {
+		c.warnf("-jwt-jwks-url is only used for OIDC tokens (-jwt-issuer without -jwt-secret)")
+	}
+	if jwtRefresh < time.Minute {
+		c.errorf("-jwt-jwks-refresh must be at least 1m (got %v)", jwtRefresh)
+	}
+	if sloSpec != "" {
+		if _, err := metrics.ParseSLOs(sloSpec); err != nil {
+			c.errorf("-slo: %v", err)
+		}
+	}
+	if responseHeaders != "" {
+		if _, err := handler.ParseResponseHeaders(responseHeaders); err != nil {
+			c.errorf("-response-headers: %v", err)
+		}
+	}
+	if _, err := handler.ParseUpstreamHeaders(upstreamHeaders); err != nil {
+		c.errorf("-upstream-headers: %v", err)
+	}
+	if bgCPUThreshold > 1 {
+		c.warnf("-bg-cpu-threshold %g is above 1 (all cores busy), so CPU load never pauses background work", bgCPUThreshold)
+	}
+	if rateLimit > 0 && rateLimitBurst < rateLimit {
+		c.warnf("-rate-limit-burst %d is below -rate-limit %d", rateLimitBurst, rateLimit)
+	}
+	if ipRateLimit > 0 && ipRateLimitBurst < ipRateLimit {
+		c.warnf("-ip-rate-limit-burst %d is below -ip-rate-limit %d", ipRateLimitBurst, ipRateLimit)
+	}
+}
+
+func (c *configCheck) checkListeners() {
+	for _, l := range []struct{ name, addr string }{{"addr", addrFlag}, {"internal-addr", internalAddr}} {
+		if l.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(l.addr); err != nil {
+			c.errorf("-%s %q: %v", l.name, l.addr, err)
+		}
+	}
+	if internalAddr != "" && internalAddr == addrFlag {
+		c.errorf("-internal-addr must differ from the public listen address %s", addrFlag)
+	}
+	if debugRecord && internalAddr != "" {
+		c.warnf("-enable-debug-record has no effect with -internal-addr, which serves the debug endpoints")
+	}
+}
+
+func (c *configCheck) checkPaths() {
+	c.writableDir("cache-dir", cacheDir)
+	if batchResultsDir != "-" {
+		c.writableDir("batch-results-dir", batchResultsDir)
+	}
+	if archiveDir != "" && archiveS3 == "" {
+		c.writableDir("archive-dir", archiveDir)
+	}
+	if analyticsDB != "" {
+		c.writableDir("analytics-db", filepath.Dir(analyticsDB))
+	}
+
+	if letterTileFont != "" {
+		if err := image.LoadTileFont(letterTileFont); err != nil {
+			c.errorf("-letter-tile-font: %v", err)
+		}
+	}
+	if iconHintsFile != "" {
+		if _, err := discovery.LoadHintsFile(iconHintsFile); err != nil {
+			c.errorf("-icon-hints: %v", err)
+		}
+	}
+	if archiveS3 != "" && !strings.HasPrefix(archiveS3, "s3://") {
+		c.errorf("-archive-s3 %q must have the form s3://bucket/prefix", archiveS3)
+	}
+	if archiveDomains != "" {
+		if archiveDir == "" && archiveS3 == "" {
+			c.errorf("-archive-domains requires -archive-dir or -archive-s3")
+		}
+		if file, ok := strings.CutPrefix(archiveDomains, "@"); ok {
+			if _, err := os.ReadFile(file); err != nil {
+				c.errorf("-archive-domains: %v", err)
+			}
+		}
+	}
+}
+
+// writableDir checks that dir, or the nearest ancestor the service would
+// create it in, accepts new files.
+func (c *configCheck) writableDir(name, dir string) {
+	d := dir
+	for {
+		info, err := os.Stat(d)
+		if err == nil {
+			if !info.IsDir() {
+				c.errorf("-%s: %s is not a directory", name, d)
+				return
+			}
+			break
+		}
+		parent := filepath.Dir(d)
+		if !errors.Is(err, fs.ErrNotExist) || parent == d {
+			c.errorf("-%s: %v", name, err)
+			return
+		}
+		d = parent
+	}
+	f, err := os.CreateTemp(d, ".validate-config-*")
+	if err != nil {
+		c.errorf("-%s: %s is not writable: %v", name, d, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// checkTTLs flags lifetimes that contradict each other.
+func (c *configCheck) checkTTLs() {
+	if cacheTTL <= 0 {
+		if cacheTTL == 0 {
+			c.errorf("-cache-ttl must be positive")
+		}
+		return
+	}
+	if browserMaxAge > cacheTTL {
+		c.warnf("-browser-max-age %v exceeds -cache-ttl %v; clients keep icons the service has already refreshed", browserMaxAge, cacheTTL)
+	}
+	if candidatesTTL > cacheTTL {
+		c.warnf("-candidates-ttl %v exceeds -cache-ttl %v; discovered candidates outlive the icons they point to", candidatesTTL, cacheTTL)
+	}
+	if historyTTL > 0 && historyTTL < cacheTTL {
+		c.warnf("-history-ttl %v is shorter than -cache-ttl %v; /favicons/diff can lose versions still being served", historyTTL, cacheTTL)
+	}
+	if unavailableTTL > notFoundTTL && notFoundTTL > 0 {
+		c.warnf("-unavailable-ttl %v exceeds -not-found-ttl %v; lookups that failed on upstream errors are retried later than ones that found nothing", unavailableTTL, notFoundTTL)
+	}
+	if janitorInterval > cacheTTL {
+		c.warnf("-janitor-interval %v exceeds -cache-ttl %v; expired entries stay on disk for up to an interval", janitorInterval, cacheTTL)
+	}
+	if analyticsDB != "" && analyticsRollupRetention > 0 && analyticsRollupRetention < analyticsRetention {
+		c.warnf("-analytics-rollup-retention %v is shorter than -analytics-retention %v; rollups expire before the rows they summarise", analyticsRollupRetention, analyticsRetention)
+	}
+	if archiveDomains != "" && archiveInterval <= 0 {
+		c.errorf("-archive-interval must be positive with -archive-domains")
+	}
+	if requestBudget > 0 && renderJS && renderTimeout > requestBudget {
+		c.warnf("-render-timeout %v exceeds -request-budget %v; renders are cut short by the budget", renderTimeout, requestBudget)
+	}
+}
+
+// checkBackends checks that the external programs the configuration relies
+// on exist.
+func (c *configCheck) checkBackends() {
+	if _, err := image.NewSVGRenderer(svgRendererName, resvgPath); err != nil {
+		c.errorf("-svg-renderer: %v", err)
+	}
+	if externalConverter != "" {
+		if externalConverter != image.ExternalConverterVips && externalConverter != image.ExternalConverterMagick {
+			c.errorf("-external-converter %q is not vips or magick", externalConverter)
+		} else {
+			path := externalConverterPath
+			if path == "" {
+				path = externalConverter
+			}
+			if _, err := exec.LookPath(path); err != nil {
+				c.errorf("-external-converter: %v", err)
+			}
+		}
+	}
+	if postProcessCmd != "" {
+		if _, err := exec.LookPath(postProcessCmd); err != nil {
+			c.errorf("-post-process-cmd: %v", err)
+		}
+		if postProcessTimeout <= 0 {
+			c.errorf("-post-process-timeout must be positive")
+		}
+		if postProcessConcurrency <= 0 {
+			c.errorf("-post-process-concurrency must be positive")
+		}
+	}
+	if renderJS {
+		if renderChromePath != "" {
+			if _, err := exec.LookPath(renderChromePath); err != nil {
+				c.errorf("-render-chrome-path: %v", err)
+			}
+		} else if !anyOnPath(chromeNames) {
+			c.warnf("-render-js: no Chrome or Chromium binary found on PATH (%s)", strings.Join(chromeNames, ", "))
+		}
+	}
+	if _, ok := image.LookupEncoder("avif"); !ok {
+		c.warnf("AVIF output is not available in this build; clients accepting AVIF get WebP")
+	}
+}
+
+func anyOnPath(names []string) bool {
+	for _, n := range names {
+		if _, err := exec.LookPath(n); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -1,18 +1,43 @@
 module faviconsvc
 
-go 1.25.1
+go 1.26
 
 require (
 	github.com/HugoSmits86/nativewebp v1.2.1
+	github.com/chromedp/cdproto v0.0.0-20260714215040-dc233986426f
+	github.com/chromedp/chromedp v0.16.0
 	github.com/gen2brain/avif v0.4.4
+	github.com/gen2brain/heic v0.7.2
 	github.com/kanrichan/resvg-go v0.0.1
+	github.com/refraction-networking/utls v1.8.2
 	github.com/sergeymakinen/go-ico v1.0.0
+	go.etcd.io/bbolt v1.5.0
 	golang.org/x/image v0.33.0
 	golang.org/x/net v0.47.0
+	golang.org/x/text v0.31.0
+	modernc.org/sqlite v1.39.1
 )
 
 require (
-	github.com/ebitengine/purego v0.9.0 // indirect
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/chromedp/sysutil v1.1.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/ebitengine/purego v0.10.1 // indirect
+	github.com/go-json-experiment/json v0.0.0-20260623181947-01eb4420fa68 // indirect
+	github.com/gobwas/httphead v0.1.0 // indirect
+	github.com/gobwas/pool v0.2.1 // indirect
+	github.com/gobwas/ws v1.4.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/sergeymakinen/go-bmp v1.0.0 // indirect
-	github.com/tetratelabs/wazero v1.9.0 // indirect
+	github.com/tetratelabs/wazero v1.12.0 // indirect
+	golang.org/x/crypto v0.44.0 // indirect
+	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	modernc.org/libc v1.66.10 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
 )
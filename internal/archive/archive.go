@@ -0,0 +1,157 @@
+// Package archive keeps dated snapshots of site icons in a date-partitioned
+// object store (a local directory or an S3 bucket), building a historical
+// favicon dataset that /favicons serves with ?as_of=YYYY-MM-DD.
+//
+// Each snapshot is two objects under "<YYYY-MM-DD>/<domain>/": "icon" with
+// the original icon bytes and "meta.json" describing them. meta.json is
+// written last, so a snapshot without it is incomplete and ignored.
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/security"
+)
+
+// DateLayout is the format of snapshot dates and of the as_of parameter.
+const DateLayout = "2006-01-02"
+
+// MaxLookback is how many days before as_of Lookup searches for a snapshot.
+const MaxLookback = 31
+
+// ErrNotFound is returned when an object or snapshot does not exist.
+var ErrNotFound = errors.New("archive: not found")
+
+// Store is a flat key/value object store. Keys use "/" separators.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns ErrNotFound for missing keys.
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// Meta describes one archived icon.
+type Meta struct {
+	Domain        string    `json:"domain"`
+	Date          string    `json:"date"`
+	PageURL       string    `json:"page_url"`
+	IconURL       string    `json:"icon_url"`
+	InheritedFrom string    `json:"inherited_from,omitempty"`
+	CID           string    `json:"cid"`
+	ContentType   string    `json:"content_type"`
+	Bytes         int       `json:"bytes"`
+	ArchivedAt    time.Time `json:"archived_at"`
+}
+
+// Archive reads and writes dated icon snapshots in a Store.
+type Archive struct {
+	store Store
+}
+
+// New returns an Archive backed by store.
+func New(store Store) *Archive {
+	return &Archive{store: store}
+}
+
+func snapshotPrefix(day, domain string) string {
+	return day + "/" + domain + "/"
+}
+
+// Put stores icon as the snapshot of meta.Domain for meta.Date.
+func (a *Archive) Put(ctx context.Context, meta Meta, icon []byte) error {
+	if !ValidDomain(meta.Domain) {
+		return fmt.Errorf("archive: invalid domain %q", meta.Domain)
+	}
+	if _, err := time.Parse(DateLayout, meta.Date); err != nil {
+		return fmt.Errorf("archive: invalid date %q", meta.Date)
+	}
+	prefix := snapshotPrefix(meta.Date, meta.Domain)
+	if err := a.store.Put(ctx, prefix+"icon", icon, meta.ContentType); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	return a.store.Put(ctx, prefix+"meta.json", data, "application/json")
+}
+
+// Has reports whether a complete snapshot of domain exists for day.
+func (a *Archive) Has(ctx context.Context, domain, day string) bool {
+	_, err := a.store.Get(ctx, snapshotPrefix(day, domain)+"meta.json")
+	return err == nil
+}
+
+// Lookup returns the most recent snapshot of domain taken on or before
+// asOf, searching back at most MaxLookback days.
+func (a *Archive) Lookup(ctx context.Context, domain string, asOf time.Time) (Meta, []byte, error) {
+	if !ValidDomain(domain) {
+		return Meta{}, nil, ErrNotFound
+	}
+	for i := 0; i <= MaxLookback; i++ {
+		day := asOf.AddDate(0, 0, -i).Format(DateLayout)
+		prefix := snapshotPrefix(day, domain)
+		raw, err := a.store.Get(ctx, prefix+"meta.json")
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return Meta{}, nil, err
+		}
+		var meta Meta
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return Meta{}, nil, fmt.Errorf("archive: %s: %w", prefix+"meta.json", err)
+		}
+		icon, err := a.store.Get(ctx, prefix+"icon")
+		if err != nil {
+			return Meta{}, nil, err
+		}
+		return meta, icon, nil
+	}
+	return Meta{}, nil, ErrNotFound
+}
+
+// DomainOf extracts the lowercased host, in punycode, from a url or bare
+// domain, or "" if it is not a valid domain name. No DNS lookups are made,
+// so domains that no longer resolve can still be looked up in the archive.
+func DomainOf(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	host, err := security.ASCIIHost(strings.ToLower(u.Hostname()))
+	if err != nil {
+		return ""
+	}
+	host = strings.TrimSuffix(host, ".")
+	if !ValidDomain(host) {
+		return ""
+	}
+	return host
+}
+
+// ValidDomain reports whether s is a plausible DNS name or IPv4 literal,
+// which also makes it safe to use as a key segment.
+func ValidDomain(s string) bool {
+	if s == "" || len(s) > 253 || !strings.Contains(s, ".") {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/pkg/loadctl"
+	"faviconsvc/pkg/logger"
+)
+
+// Icon is the result of resolving a domain's icon for archival.
+type Icon struct {
+	PageURL       string
+	IconURL       string
+	InheritedFrom string
+	Data          []byte
+	ContentType   string
+}
+
+// Fetcher resolves the current icon of a domain.
+type Fetcher func(ctx context.Context, domain string) (Icon, error)
+
+// Scheduler archives the icons of a fixed domain list once per day.
+type Scheduler struct {
+	Archive  *Archive
+	Domains  []string
+	Fetch    Fetcher
+	Interval time.Duration // how often to check for domains missing today's snapshot
+}
+
+// Run archives immediately and then every Interval until ctx is done.
+// Domains already archived for the current UTC date are skipped, so
+// restarts and intervals shorter than a day do not create duplicates.
+func (s *Scheduler) Run(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	logger.Info("Archive scheduler started: %d domains, interval=%v", len(s.Domains), interval)
+	for {
+		s.RunOnce(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			logger.Info("Archive scheduler stopped")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce archives every domain that has no snapshot for now's UTC date and
+// returns how many snapshots were written.
+func (s *Scheduler) RunOnce(ctx context.Context, now time.Time) int {
+	day := now.UTC().Format(DateLayout)
+	written := 0
+	for _, domain := range s.Domains {
+		if ctx.Err() != nil {
+			break
+		}
+		if s.Archive.Has(ctx, domain, day) {
+			continue
+		}
+		// Archival is background work; yield to live traffic
+		if err := loadctl.Get().Wait(ctx); err != nil {
+			break
+		}
+		icon, err := s.Fetch(ctx, domain)
+		if err != nil {
+			logger.Warn("Archive %s: %v", domain, err)
+			continue
+		}
+		meta := Meta{
+			Domain:        domain,
+			Date:          day,
+			PageURL:       icon.PageURL,
+			IconURL:       icon.IconURL,
+			InheritedFrom: icon.InheritedFrom,
+			CID:           cache.ContentCID(icon.Data),
+			ContentType:   icon.ContentType,
+			Bytes:         len(icon.Data),
+			ArchivedAt:    now.UTC(),
+		}
+		if err := s.Archive.Put(ctx, meta, icon.Data); err != nil {
+			logger.Warn("Archive %s: %v", domain, err)
+			continue
+		}
+		written++
+	}
+	if written > 0 {
+		logger.Info("Archived %d icons for %s", written, day)
+	}
+	return written
+}
+
+// ParseDomains parses a comma-separated domain list, or with a leading "@"
+// a file with one domain per line ("#" starts a comment). URLs are reduced
+// to their host; duplicates are dropped.
+func ParseDomains(spec string) ([]string, error) {
+	var raw []string
+	if path, ok := strings.CutPrefix(spec, "@"); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			raw = append(raw, line)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		raw = strings.Split(spec, ",")
+	}
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, r := range raw {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		d := DomainOf(r)
+		if d == "" {
+			return nil, fmt.Errorf("archive: invalid domain %q", r)
+		}
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
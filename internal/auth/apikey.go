@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+)
+
+// HeaderAPIKey is the request header APIKey reads keys from.
+const HeaderAPIKey = "X-API-Key"
+
+// QueryAPIKey is the query parameter APIKey reads keys from, for clients
+// such as <img> tags that cannot set headers.
+const QueryAPIKey = "api_key"
+
+// keyPermissions are the permissions of API key and HMAC principals: the
+// public endpoints only, as admin endpoints have a token of their own.
+var keyPermissions = []string{PermRead}
+
+// APIKey authenticates requests by a static key sent in the X-API-Key
+// header, as a bearer token or in the api_key query parameter.
+type APIKey struct {
+	// ids maps the SHA-256 of each key to its principal ID. Looking keys
+	// up by hash keeps the lookup time independent of how much of a
+	// guessed key is right.
+	ids map[[sha256.Size]byte]string
+}
+
+// NewAPIKey returns an APIKey accepting keys, which maps principal IDs to
+// their key.
+func NewAPIKey(keys map[string]string) (*APIKey, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("apikey auth needs at least one key")
+	}
+	a := &APIKey{ids: make(map[[sha256.Size]byte]string, len(keys))}
+	for id, key := range keys {
+		sum := sha256.Sum256([]byte(key))
+		if other, dup := a.ids[sum]; dup {
+			return nil, errors.New("keys " + other + " and " + id + " are the same")
+		}
+		a.ids[sum] = id
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *APIKey) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		key = r.URL.Query().Get(QueryAPIKey)
+	}
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	id, ok := a.ids[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{ID: id, Method: MethodAPIKey, Permissions: keyPermissions}, nil
+}
+
+// Challenge implements Challenger.
+func (a *APIKey) Challenge() string {
+	return `Bearer realm="favicons"`
+}
+
+// RedactedURL returns the URL of r with the value of an api_key query
+// parameter masked, for logging.
+func RedactedURL(r *http.Request) string {
+	q := r.URL.Query()
+	if !q.Has(QueryAPIKey) {
+		return r.URL.String()
+	}
+	q.Set(QueryAPIKey, "REDACTED")
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.String()
+}
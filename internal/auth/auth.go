@@ -0,0 +1,250 @@
+// Package auth authenticates API callers. An Authenticator turns the
+// credentials of a request into a Principal; Middleware rejects requests
+// without valid credentials and records the Principal in the request state
+// (reqctx), where rate limiting and access logging pick it up.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/metrics"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal = reqctx.Principal
+
+// Authentication methods New accepts.
+const (
+	MethodNone   = "none"
+	MethodAPIKey = "apikey"
+	MethodHMAC   = "hmac"
+	MethodJWT    = "jwt"
+)
+
+// Methods lists every authentication method, MethodNone first.
+var Methods = []string{MethodNone, MethodAPIKey, MethodHMAC, MethodJWT}
+
+var (
+	// ErrNoCredentials is returned by Authenticate for requests that carry
+	// no credentials of its kind.
+	ErrNoCredentials = errors.New("credentials required")
+	// ErrInvalidCredentials is returned, possibly wrapped with the reason,
+	// for credentials that do not check out.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator identifies the caller of a request.
+type Authenticator interface {
+	// Authenticate returns the caller of r, or ErrNoCredentials or an
+	// error wrapping ErrInvalidCredentials.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// Challenger is implemented by Authenticators that name their scheme in the
+// WWW-Authenticate header of rejected requests.
+type Challenger interface {
+	Challenge() string
+}
+
+// Config selects and configures the Authenticator New builds.
+type Config struct {
+	// Method is one of Methods ("" = MethodNone).
+	Method string
+	// Keys maps principal IDs to their secret: the API key for
+	// MethodAPIKey, the signing secret for MethodHMAC.
+	Keys map[string]string
+	// MaxSkew is how far the timestamp of an HMAC-signed request may be
+	// from the server clock (0 = DefaultMaxSkew).
+	MaxSkew time.Duration
+	// JWTSecret is the HS256 key bearer tokens are signed with. Without
+	// it, tokens are verified with the keys of the OpenID Connect provider
+	// at Issuer.
+	JWTSecret []byte
+	// Issuer and Audience, when set, must match the iss and aud claims of
+	// bearer tokens. Tokens of an OpenID Connect provider need both.
+	Issuer   string
+	Audience string
+	// JWKSURL and JWKSRefresh are OIDCConfig.JWKSURL and Refresh.
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	// Permissions maps token scopes and claims to permissions (nil =
+	// DefaultPermissionMap).
+	Permissions PermissionMap
+}
+
+// New returns the Authenticator cfg selects.
+func New(cfg Config) (Authenticator, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.Method)) {
+	case "", MethodNone:
+		return None{}, nil
+	case MethodAPIKey:
+		return NewAPIKey(cfg.Keys)
+	case MethodHMAC:
+		return NewHMAC(cfg.Keys, cfg.MaxSkew)
+	case MethodJWT:
+		if len(cfg.JWTSecret) == 0 && cfg.Issuer != "" {
+			return NewOIDC(OIDCConfig{
+				Issuer:      cfg.Issuer,
+				Audience:    cfg.Audience,
+				JWKSURL:     cfg.JWKSURL,
+				Refresh:     cfg.JWKSRefresh,
+				Permissions: cfg.Permissions,
+			})
+		}
+		return NewJWT(cfg.JWTSecret, cfg.Issuer, cfg.Audience, cfg.Permissions)
+	}
+	return nil, fmt.Errorf("unknown auth method %q (available: %s)", cfg.Method, strings.Join(Methods, ", "))
+}
+
+// ParseKeys parses a comma-separated list of id:secret pairs, as taken by
+// the -auth-keys flag. With a leading "@" the pairs are read from a key
+// file instead, one per line ("#" starts a comment line).
+func ParseKeys(s string) (map[string]string, error) {
+	pairs := strings.Split(s, ",")
+	if path, ok := strings.CutPrefix(strings.TrimSpace(s), "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pairs = nil
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); !strings.HasPrefix(line, "#") {
+				pairs = append(pairs, line)
+			}
+		}
+	}
+	keys := make(map[string]string)
+	for _, pair := range pairs {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		id, secret = strings.TrimSpace(id), strings.TrimSpace(secret)
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("key %q is not id:secret", redact(pair))
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		keys[id] = secret
+	}
+	return keys, nil
+}
+
+// redact keeps the part of an id:secret pair that can be shown in errors.
+func redact(pair string) string {
+	if id, _, ok := strings.Cut(pair, ":"); ok {
+		return id + ":..."
+	}
+	return "..."
+}
+
+// None lets every request through as an anonymous caller.
+type None struct{}
+
+// Authenticate implements Authenticator.
+func (None) Authenticate(*http.Request) (Principal, error) {
+	return Principal{}, nil
+}
+
+// Middleware authenticates every request with a, answering 401 when that
+// fails and 403 when the caller lacks PermRead, and stores the caller in
+// the request state. A tenant carried by the credentials replaces the
+// client-supplied X-Tenant-ID. Requests for the paths in exempt (a trailing
+// "/" matches the whole subtree) pass through anonymously, for health
+// checks and endpoints that check credentials of their own.
+func Middleware(a Authenticator, exempt ...string) func(http.Handler) http.Handler {
+	return LimitedMiddleware(a, nil, exempt...)
+}
+
+// LimitedMiddleware is like Middleware but calls allow for every request
+// whose authentication fails, answering 429 instead of 401 when it returns
+// false. A rate limiter keyed by principal sits behind authentication, so
+// allow charges failures to the client's address instead, which bounds how
+// fast credentials can be guessed.
+func LimitedMiddleware(a Authenticator, allow func(r *http.Request) bool, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isExempt(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, err := a.Authenticate(r)
+			if err != nil {
+				if allow != nil && !allow(r) {
+					reqctx.Debugf(r.Context(), "Authentication failed, rate limited: %v", err)
+					writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+					return
+				}
+				Reject(w, r, a, err)
+				return
+			}
+			if !p.Anonymous() && !p.Can(PermRead) {
+				Forbid(w, r, p, PermRead)
+				return
+			}
+
+			ctx, st := reqctx.Ensure(r.Context())
+			st.Principal = p
+			if p.Tenant != "" {
+				st.Tenant = p.Tenant
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Reject answers a request whose authentication by a failed with err:
+// 401 with a's challenge, if it has one, and a JSON error naming whether
+// credentials were missing or wrong.
+func Reject(w http.ResponseWriter, r *http.Request, a Authenticator, err error) {
+	reqctx.Debugf(r.Context(), "Authentication failed: %v", err)
+	metrics.Get().IncError("auth_failed")
+	if c, ok := a.(Challenger); ok {
+		w.Header().Set("WWW-Authenticate", c.Challenge())
+	}
+	msg := ErrInvalidCredentials.Error()
+	if errors.Is(err, ErrNoCredentials) {
+		msg = ErrNoCredentials.Error()
+	}
+	writeError(w, http.StatusUnauthorized, msg)
+}
+
+// Forbid answers a request whose caller p lacks permission with 403.
+func Forbid(w http.ResponseWriter, r *http.Request, p Principal, permission string) {
+	reqctx.Debugf(r.Context(), "Principal %s:%s lacks permission %s", p.Method, p.ID, permission)
+	metrics.Get().IncError("auth_forbidden")
+	writeError(w, http.StatusForbidden, "permission "+permission+" required")
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func isExempt(path string, exempt []string) bool {
+	for _, e := range exempt {
+		if path == e || strings.HasSuffix(e, "/") && strings.HasPrefix(path, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
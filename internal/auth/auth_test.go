@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"faviconsvc/internal/reqctx"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(" alice:s3cret , bob:other:part,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["alice"] != "s3cret" || keys["bob"] != "other:part" || len(keys) != 2 {
+		t.Errorf("ParseKeys = %v", keys)
+	}
+	for _, bad := range []string{"alice", "alice:", ":s3cret", "a:1,a:2"} {
+		if _, err := ParseKeys(bad); err == nil {
+			t.Errorf("ParseKeys(%q) accepted", bad)
+		}
+	}
+	if _, err := ParseKeys("alice"); err == nil || err.Error() != `key "..." is not id:secret` {
+		t.Errorf("error does not redact the pair: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# partners\nalice:s3cret\n\nbob:a,b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = ParseKeys("@" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["alice"] != "s3cret" || keys["bob"] != "a,b" || len(keys) != 2 {
+		t.Errorf("ParseKeys(@file) = %v", keys)
+	}
+	if _, err := ParseKeys("@" + path + ".missing"); err == nil {
+		t.Error("ParseKeys accepted a missing key file")
+	}
+}
+
+func TestNew(t *testing.T) {
+	keys := map[string]string{"alice": "s3cret"}
+	for _, tt := range []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Method: "NONE"}, false},
+		{Config{Method: MethodAPIKey, Keys: keys}, false},
+		{Config{Method: MethodAPIKey}, true},
+		{Config{Method: MethodHMAC, Keys: keys}, false},
+		{Config{Method: MethodJWT, JWTSecret: []byte("k")}, false},
+		{Config{Method: MethodJWT}, true},
+		{Config{Method: "basic"}, true},
+	} {
+		if _, err := New(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("New(%+v) error = %v, want error %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	a, err := NewAPIKey(map[string]string{"alice": "key-a", "bob": "key-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantID  string
+		wantErr error
+	}{
+		{"header", http.Header{HeaderAPIKey: {"key-b"}}, "bob", nil},
+		{"bearer", http.Header{"Authorization": {"Bearer key-a"}}, "alice", nil},
+		{"wrong key", http.Header{HeaderAPIKey: {"key-c"}}, "", ErrInvalidCredentials},
+		{"none", http.Header{}, "", ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/favicons", nil)
+		for k, v := range tt.header {
+			r.Header.Set(k, v[0])
+		}
+		p, err := a.Authenticate(r)
+		if !errors.Is(err, tt.wantErr) || p.ID != tt.wantID {
+			t.Errorf("%s: got %+v, %v; want %q, %v", tt.name, p, err, tt.wantID, tt.wantErr)
+		}
+	}
+	r := httptest.NewRequest("GET", "/favicons?url=example.com&api_key=key-b", nil)
+	if p, err := a.Authenticate(r); err != nil || p.ID != "bob" {
+		t.Errorf("query parameter: got %+v, %v; want bob", p, err)
+	}
+	if got := RedactedURL(r); got != "/favicons?api_key=REDACTED&url=example.com" {
+		t.Errorf("RedactedURL = %q", got)
+	}
+	if _, err := NewAPIKey(map[string]string{"a": "same", "b": "same"}); err == nil {
+		t.Error("NewAPIKey accepted two principals with one key")
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a, err := NewHMAC(map[string]string{"svc": "secret"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+
+	signed := func(target, secret string, at time.Time) *http.Request {
+		r := httptest.NewRequest("GET", target, nil)
+		SignRequest(r, "svc", secret, at)
+		return r
+	}
+
+	if p, err := a.Authenticate(signed("/favicons?url=example.com", "secret", now)); err != nil || p.ID != "svc" || p.Method != MethodHMAC {
+		t.Errorf("valid signature: %+v, %v", p, err)
+	}
+	if _, err := a.Authenticate(signed("/favicons", "secret", now.Add(-DefaultMaxSkew-time.Second))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("stale timestamp: %v", err)
+	}
+	if _, err := a.Authenticate(signed("/favicons", "wrong", now)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong secret: %v", err)
+	}
+	// A signature does not carry over to another URL
+	r := signed("/favicons?url=example.com", "secret", now)
+	r.URL.RawQuery = "url=evil.example"
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("tampered query: %v", err)
+	}
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/favicons", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("unsigned request: %v", err)
+	}
+}
+
+// signJWT returns an HS256 token for claims; alg overrides the header's.
+func signJWT(t *testing.T, secret, alg string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signing := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signing))
+	return signing + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a, err := NewJWT([]byte("k"), "https://idp.example", "favicons", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+	base := func() map[string]any {
+		return map[string]any{"sub": "alice", "iss": "https://idp.example", "aud": []string{"other", "favicons"}, "exp": now.Add(time.Hour).Unix()}
+	}
+	auth := func(token string) (Principal, error) {
+		r := httptest.NewRequest("GET", "/favicons", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(r)
+	}
+
+	claims := base()
+	claims["tenant"] = "acme"
+	claims["scope"] = "read purge"
+	p, err := auth(signJWT(t, "k", "HS256", claims))
+	if err != nil || p.ID != "alice" || p.Tenant != "acme" || !slices.Equal(p.Scopes, []string{"read", "purge"}) {
+		t.Errorf("valid token: %+v, %v", p, err)
+	}
+	if !slices.Equal(p.Permissions, []string{PermRead, PermPurge}) {
+		t.Errorf("valid token: permissions %v, want read and purge", p.Permissions)
+	}
+
+	invalid := map[string]string{}
+	expired := base()
+	expired["exp"] = now.Add(-2 * jwtLeeway).Unix()
+	invalid["expired"] = signJWT(t, "k", "HS256", expired)
+	early := base()
+	early["nbf"] = now.Add(2 * jwtLeeway).Unix()
+	invalid["not yet valid"] = signJWT(t, "k", "HS256", early)
+	wrongAud := base()
+	wrongAud["aud"] = "other"
+	invalid["audience"] = signJWT(t, "k", "HS256", wrongAud)
+	wrongIss := base()
+	wrongIss["iss"] = "https://evil.example"
+	invalid["issuer"] = signJWT(t, "k", "HS256", wrongIss)
+	invalid["secret"] = signJWT(t, "other", "HS256", base())
+	invalid["alg none"] = signJWT(t, "k", "none", base())
+	invalid["malformed"] = "not.a-token"
+	for name, token := range invalid {
+		if _, err := auth(token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: error = %v, want ErrInvalidCredentials", name, err)
+		}
+	}
+}
+
+func TestParsePermissionMap(t *testing.T) {
+	m, err := ParsePermissionMap("read=favicons.read, purge=favicons.admin|groups:ops|scope:https://api.example/purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m[PermUpload], DefaultPermissionMap[PermUpload]) {
+		t.Errorf("upload = %v, want the default %v", m[PermUpload], DefaultPermissionMap[PermUpload])
+	}
+	tests := []struct {
+		name   string
+		scopes []string
+		claims map[string]any
+		want   []string
+	}{
+		{"no scopes", nil, nil, nil},
+		{"scope", []string{"favicons.read", "upload"}, nil, []string{PermRead, PermUpload}},
+		{"claim in array", nil, map[string]any{"groups": []any{"dev", "ops"}}, []string{PermPurge}},
+		{"claim string", nil, map[string]any{"groups": "ops"}, []string{PermPurge}},
+		{"other claim value", nil, map[string]any{"groups": "dev"}, nil},
+		{"scope with colon", []string{"https://api.example/purge"}, nil, []string{PermPurge}},
+	}
+	for _, tt := range tests {
+		if got := m.grant(tt.scopes, tt.claims); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: grant = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"delete=admin", "purge"} {
+		if _, err := ParsePermissionMap(bad); err == nil {
+			t.Errorf("ParsePermissionMap(%q) accepted", bad)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a, _ := NewAPIKey(map[string]string{"alice": "key-a"})
+	var got reqctx.State
+	h := Middleware(a, "/health", "/admin/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *reqctx.From(r.Context())
+	}))
+	serve := func(path, key string) *httptest.ResponseRecorder {
+		got = reqctx.State{}
+		r := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			r.Header.Set(HeaderAPIKey, key)
+		}
+		r = r.WithContext(reqctx.With(r.Context(), &reqctx.State{Tenant: "from-header"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("/favicons", "key-a"); w.Code != http.StatusOK || got.Principal.ID != "alice" || got.Tenant != "from-header" {
+		t.Errorf("valid key: status %d, state %+v", w.Code, got)
+	}
+	w := serve("/favicons", "")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no key: status %d, WWW-Authenticate %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if w := serve("/favicons", "key-b"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d", w.Code)
+	}
+	for _, path := range []string{"/health", "/admin/purge"} {
+		if w := serve(path, ""); w.Code != http.StatusOK || !got.Principal.Anonymous() {
+			t.Errorf("%s: status %d, principal %+v", path, w.Code, got.Principal)
+		}
+	}
+	if w := serve("/healthz", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("/healthz was exempted with /health: status %d", w.Code)
+	}
+
+	// A tenant bound to the credentials wins over the header
+	j, _ := NewJWT([]byte("k"), "", "", nil)
+	h = Middleware(j)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *reqctx.From(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/favicons", nil)
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, "k", "HS256", map[string]any{"sub": "bob", "tenant": "acme"}))
+	r = r.WithContext(reqctx.With(r.Context(), &reqctx.State{Tenant: "from-header"}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got.Tenant != "acme" || got.Principal.Method != MethodJWT {
+		t.Errorf("token tenant: state %+v", got)
+	}
+
+	// Tokens without read permission are authenticated but turned away
+	j, _ = NewJWT([]byte("k"), "", "", PermissionMap{PermRead: {"favicons.read"}})
+	h = Middleware(j)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for scope, want := range map[string]int{"favicons.read": http.StatusOK, "other": http.StatusForbidden} {
+		r := httptest.NewRequest("GET", "/favicons", nil)
+		r.Header.Set("Authorization", "Bearer "+signJWT(t, "k", "HS256", map[string]any{"sub": "bob", "scope": scope}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("scope %s: status %d, want %d", scope, w.Code, want)
+		}
+	}
+}
+
+func TestLimitedMiddleware(t *testing.T) {
+	a, _ := NewAPIKey(map[string]string{"alice": "key-a"})
+	failures := 0
+	allow := func(*http.Request) bool {
+		failures++
+		return failures <= 2
+	}
+	h := LimitedMiddleware(a, allow, "/health")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	serve := func(path, key string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(HeaderAPIKey, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if got := serve("/favicons", "guess"); got != want {
+			t.Errorf("failed attempt %d: status %d, want %d", i+1, got, want)
+		}
+	}
+	// Only failures are charged
+	if got := serve("/favicons", "key-a"); got != http.StatusOK || failures != 3 {
+		t.Errorf("valid key: status %d, %d failures charged", got, failures)
+	}
+	if got := serve("/health", "guess"); got != http.StatusOK || failures != 3 {
+		t.Errorf("exempt path: status %d, %d failures charged", got, failures)
+	}
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"faviconsvc/pkg/logger"
+)
+
+const (
+	// DefaultJWKSRefresh is how often, by default, an OIDC provider's keys
+	// are fetched again.
+	DefaultJWKSRefresh = time.Hour
+	// jwksMinRefetch is the least time between fetches triggered by tokens
+	// naming an unknown key, so forged kids cannot hammer the provider.
+	jwksMinRefetch = 30 * time.Second
+	// maxJWKSBytes caps discovery documents and key sets.
+	maxJWKSBytes = 1 << 20
+)
+
+// OIDCConfig configures NewOIDC.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL. Tokens must carry it as iss,
+	// and its /.well-known/openid-configuration names the key set.
+	Issuer string
+	// Audience must be among a token's aud claim: the client ID the
+	// provider issues tokens for this service to. It is required, as a
+	// provider signs the tokens of all its clients with the same keys.
+	Audience string
+	// JWKSURL overrides the key set URL from discovery.
+	JWKSURL string
+	// Refresh is how often the key set is fetched again (0 =
+	// DefaultJWKSRefresh). Tokens naming an unknown key also trigger a
+	// fetch, at most every 30 seconds, so rotated keys are picked up.
+	Refresh time.Duration
+	// Permissions maps scopes and claims to permissions (nil =
+	// DefaultPermissionMap).
+	Permissions PermissionMap
+	// Client fetches the discovery document and key set (nil = a client
+	// with a 10 second timeout).
+	Client *http.Client
+}
+
+// NewOIDC returns a JWT accepting tokens of an OpenID Connect provider,
+// verified with the keys it publishes. Tokens must carry exp. Nothing is
+// fetched until the first token arrives, so the service starts while the
+// provider is unreachable.
+func NewOIDC(cfg OIDCConfig) (*JWT, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("oidc auth needs an issuer")
+	}
+	if cfg.Audience == "" {
+		return nil, errors.New("oidc auth needs an audience: without one, tokens the provider issued to any other client are accepted")
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = DefaultJWKSRefresh
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	keys := &jwks{issuer: strings.TrimSuffix(cfg.Issuer, "/"), url: cfg.JWKSURL, refresh: cfg.Refresh, client: cfg.Client}
+	a := newJWT(keys, cfg.Issuer, cfg.Audience, cfg.Permissions)
+	a.requireExp = true
+	return a, nil
+}
+
+// jwks is the keySource of an OIDC provider: its JSON Web Key Set, fetched
+// on first use and refreshed when stale or when a token names a key it
+// lacks.
+type jwks struct {
+	issuer  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	url       string // key set URL, found through discovery if unset
+	keys      map[string]any
+	fetched   time.Time     // last successful fetch
+	attempted time.Time     // last fetch, successful or not
+	fetching  chan struct{} // closed when the fetch in flight ends
+	err       error         // of the last fetch
+}
+
+// key returns the key named kid. At most one fetch is in flight, and none
+// starts within jwksMinRefetch of the last, whether the keys are stale or
+// kid is unknown. Meanwhile the keys fetched last are used; only callers
+// with no keys at all wait for the fetch.
+func (s *jwks) key(kid, alg string) (any, error) {
+	if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") && !strings.HasPrefix(alg, "ES") {
+		return nil, fmt.Errorf("unsupported alg %q", alg)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	_, known := s.lookup(kid)
+	due := now.Sub(s.fetched) > s.refresh || !known
+	switch {
+	case due && s.fetching == nil && now.Sub(s.attempted) > jwksMinRefetch:
+		s.attempted = now
+		done := make(chan struct{})
+		s.fetching = done
+		url := s.url
+		s.mu.Unlock()
+		keys, url, err := s.fetch(url)
+		s.mu.Lock()
+		s.fetching, s.err = nil, err
+		close(done)
+		if err != nil {
+			// Keep serving the keys we have while the provider is down
+			logger.Warn("OIDC key set from %s: %v", s.issuer, err)
+		} else {
+			s.url, s.keys, s.fetched = url, keys, now
+		}
+	case s.keys == nil && s.fetching != nil:
+		done := s.fetching
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("no keys: %v", s.err)
+	}
+	k, ok := s.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// lookup returns the key named kid, or the only key when kid is "" and the
+// set holds just one. Called with mu held.
+func (s *jwks) lookup(kid string) (any, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+// fetch returns the provider's current key set and the URL it was read
+// from, which is found through discovery when url is "". Called without mu
+// held, so tokens are verified with the old keys meanwhile.
+func (s *jwks) fetch(url string) (map[string]any, string, error) {
+	if url == "" {
+		var doc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := s.getJSON(s.issuer+"/.well-known/openid-configuration", &doc); err != nil {
+			return nil, "", fmt.Errorf("discovery: %w", err)
+		}
+		if strings.TrimSuffix(doc.Issuer, "/") != s.issuer {
+			return nil, "", fmt.Errorf("discovery: document is for issuer %q", doc.Issuer)
+		}
+		if doc.JWKSURI == "" {
+			return nil, "", errors.New("discovery: no jwks_uri")
+		}
+		url = doc.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := s.getJSON(url, &set); err != nil {
+		return nil, "", err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			logger.Warn("OIDC key %q from %s skipped: %v", k.Kid, url, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("key set has no usable signing keys")
+	}
+	return keys, url, nil
+}
+
+func (s *jwks) getJSON(url string, v any) error {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(v)
+}
+
+// jwk is a JSON Web Key; only RSA and EC public keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("bad key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
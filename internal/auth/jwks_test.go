@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is an OpenID Connect provider serving discovery and a key
+// set that tests can swap.
+type testProvider struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     []map[string]string
+	fetches  int
+	requests int // including those failed while down
+	down     bool
+	issuer   string        // advertised in discovery ("" = the server URL)
+	hold     chan struct{} // if set, key set requests wait until it is closed
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	p := &testProvider{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		hold := p.hold
+		p.mu.Unlock()
+		if hold != nil && r.URL.Path == "/keys" {
+			<-hold
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.requests++
+		if p.down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			issuer := p.issuer
+			if issuer == "" {
+				issuer = p.URL
+			}
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": p.URL + "/keys"})
+		case "/keys":
+			p.fetches++
+			json.NewEncoder(w).Encode(map[string]any{"keys": p.keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) publish(keys ...map[string]string) {
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+}
+
+// signAsym returns a token for claims signed with key under alg and kid.
+func signAsym(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b64(b)
+	}
+	signing := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signing))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + b64(sig)
+}
+
+func TestOIDC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := newTestProvider(t)
+	idp.publish(rsaJWK("r1", rsaKey), ecJWK("e1", ecKey))
+
+	perms := PermissionMap{PermRead: {anyToken}, PermPurge: {"groups:ops"}}
+	a, err := NewOIDC(OIDCConfig{Issuer: idp.URL, Audience: "favicons", Permissions: perms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(sub string) map[string]any {
+		return map[string]any{"sub": sub, "iss": idp.URL, "aud": "favicons", "exp": time.Now().Add(time.Hour).Unix(), "groups": []string{"ops"}}
+	}
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{{"RS256", "r1", rsaKey}, {"ES256", "e1", ecKey}} {
+		p, err := a.Verify(signAsym(t, tc.key, tc.alg, tc.kid, claims("alice")))
+		if err != nil || p.ID != "alice" || !slices.Equal(p.Permissions, []string{PermRead, PermPurge}) {
+			t.Errorf("%s token: %+v, %v", tc.alg, p, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"alg of another key": signAsym(t, rsaKey, "RS256", "e1", claims("alice")),
+		"HS256":              signJWT(t, "secret", "HS256", claims("alice")),
+		"unknown key":        signAsym(t, rsaKey, "RS256", "r9", claims("alice")),
+	}
+	wrongAud := claims("alice")
+	wrongAud["aud"] = "other"
+	invalid["audience"] = signAsym(t, rsaKey, "RS256", "r1", wrongAud)
+	noExp := claims("alice")
+	delete(noExp, "exp")
+	invalid["no exp"] = signAsym(t, rsaKey, "RS256", "r1", noExp)
+	for name, token := range invalid {
+		if _, err := a.Verify(token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: error = %v, want ErrInvalidCredentials", name, err)
+		}
+	}
+
+	// A rotated-in key is fetched when a token names it, but unknown kids
+	// cannot make the provider be asked again right away
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.publish(ecJWK("e2", rotated))
+	keys := a.keys.(*jwks)
+	fetches := idp.fetches
+	if _, err := a.Verify(signAsym(t, rotated, "ES256", "e2", claims("bob"))); err == nil || idp.fetches != fetches {
+		t.Errorf("unknown kid within %v of the last fetch: err %v, fetches %d -> %d", jwksMinRefetch, err, fetches, idp.fetches)
+	}
+	keys.attempted = time.Time{}
+	if p, err := a.Verify(signAsym(t, rotated, "ES256", "e2", claims("bob"))); err != nil || p.ID != "bob" {
+		t.Errorf("rotated key: %+v, %v", p, err)
+	}
+
+	// Stale keys keep working while the provider is down
+	idp.mu.Lock()
+	idp.down = true
+	idp.mu.Unlock()
+	keys.fetched, keys.attempted = time.Time{}, time.Time{}
+	if _, err := a.Verify(signAsym(t, rotated, "ES256", "e2", claims("bob"))); err != nil {
+		t.Errorf("provider down: %v", err)
+	}
+}
+
+func TestOIDCRefetchLimits(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := newTestProvider(t)
+	idp.publish(ecJWK("e1", key))
+	a, _ := NewOIDC(OIDCConfig{Issuer: idp.URL, Audience: "favicons"})
+	token := signAsym(t, key, "ES256", "e1", map[string]any{"sub": "alice", "iss": idp.URL, "aud": "favicons", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := a.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+	keys := a.keys.(*jwks)
+
+	// Stale keys with the provider down are fetched again once per
+	// jwksMinRefetch, not on every token
+	idp.mu.Lock()
+	idp.down = true
+	requests := idp.requests
+	idp.mu.Unlock()
+	keys.mu.Lock()
+	keys.fetched, keys.attempted = time.Time{}, time.Time{}
+	keys.mu.Unlock()
+	for range 10 {
+		if _, err := a.Verify(token); err != nil {
+			t.Fatalf("stale keys: %v", err)
+		}
+	}
+	idp.mu.Lock()
+	if got := idp.requests - requests; got != 1 {
+		t.Errorf("provider asked %d times for 10 tokens with stale keys, want 1", got)
+	}
+	// While a fetch hangs, other tokens are verified with the old keys
+	idp.down = false
+	idp.hold = make(chan struct{})
+	idp.mu.Unlock()
+	keys.mu.Lock()
+	keys.fetched, keys.attempted = time.Time{}, time.Time{}
+	keys.mu.Unlock()
+
+	fetching := make(chan error)
+	go func() {
+		_, err := a.Verify(token)
+		fetching <- err
+	}()
+	for {
+		keys.mu.Lock()
+		started := keys.fetching != nil
+		keys.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := a.Verify(token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("token during a fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("token waited for the fetch in flight")
+	}
+	idp.mu.Lock()
+	close(idp.hold)
+	idp.hold = nil
+	idp.mu.Unlock()
+	if err := <-fetching; err != nil {
+		t.Errorf("token that fetched: %v", err)
+	}
+}
+
+func TestNewOIDCNeedsAudience(t *testing.T) {
+	if _, err := NewOIDC(OIDCConfig{Issuer: "https://accounts.example"}); err == nil {
+		t.Error("NewOIDC without an audience succeeded")
+	}
+	if _, err := New(Config{Method: MethodJWT, Issuer: "https://accounts.example"}); err == nil {
+		t.Error("New for OIDC without an audience succeeded")
+	}
+	// A shared secret is only known to this service's own token issuer
+	if _, err := New(Config{Method: MethodJWT, JWTSecret: []byte("secret"), Issuer: "https://accounts.example"}); err != nil {
+		t.Errorf("New for HS256 without an audience: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestProvider(t)
+	idp.issuer = "https://evil.example"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.publish(ecJWK("e1", key))
+	a, _ := NewOIDC(OIDCConfig{Issuer: idp.URL, Audience: "favicons"})
+	token := signAsym(t, key, "ES256", "e1", map[string]any{"sub": "alice", "iss": idp.URL, "aud": "favicons", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := a.Verify(token); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("error = %v, want ErrInvalidCredentials", err)
+	}
+	if idp.fetches != 0 {
+		t.Errorf("key set fetched %d times despite the discovery mismatch", idp.fetches)
+	}
+}
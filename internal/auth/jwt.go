@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated on exp and nbf claims.
+const jwtLeeway = time.Minute
+
+// JWT authenticates requests by a signed JSON Web Token sent as a bearer
+// token: HS256 with a shared secret (NewJWT), or RS*, PS* or ES* with the
+// keys an OpenID Connect provider publishes (NewOIDC). The token's sub
+// claim becomes the principal ID, its tenant claim the tenant and its scope
+// (space-separated) or scp (array) claim the scopes; permissions follow from
+// those and the other claims through a PermissionMap. exp and nbf are
+// enforced when present; tokens of an OIDC provider must carry exp.
+type JWT struct {
+	keys       keySource
+	issuer     string
+	audience   string
+	requireExp bool
+	perms      PermissionMap
+	now        func() time.Time
+}
+
+// keySource returns the key that verifies tokens signed with alg by the
+// key named kid ("" when the token names none).
+type keySource interface {
+	key(kid, alg string) (any, error)
+}
+
+// secretKey is the keySource of HS256 tokens.
+type secretKey []byte
+
+func (k secretKey) key(kid, alg string) (any, error) {
+	// Only the configured algorithm is accepted, never "none" or one the
+	// token picks for itself
+	if alg != "HS256" {
+		return nil, fmt.Errorf("unsupported alg %q", alg)
+	}
+	return []byte(k), nil
+}
+
+// NewJWT returns a JWT accepting HS256 tokens signed with secret whose iss
+// and aud claims match issuer and audience ("" = any), granting permissions
+// by perms (nil = DefaultPermissionMap).
+func NewJWT(secret []byte, issuer, audience string, perms PermissionMap) (*JWT, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("jwt auth needs a signing secret or an OIDC issuer")
+	}
+	return newJWT(secretKey(secret), issuer, audience, perms), nil
+}
+
+func newJWT(keys keySource, issuer, audience string, perms PermissionMap) *JWT {
+	if perms == nil {
+		perms = DefaultPermissionMap
+	}
+	return &JWT{keys: keys, issuer: issuer, audience: audience, perms: perms, now: time.Now}
+}
+
+// jwtClaims holds the registered and service claims JWT reads.
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	Tenant    string      `json:"tenant"`
+	Scope     string      `json:"scope"`
+	Scp       []string    `json:"scp"`
+}
+
+// jwtAudience is an aud claim, which may be a string or an array of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (a *JWT) Authenticate(r *http.Request) (Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	return a.Verify(token)
+}
+
+// Verify checks the signature and claims of a raw token and returns the
+// principal it names.
+func (a *JWT) Verify(token string) (Principal, error) {
+	claims, raw, err := a.verify(token)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	scopes := claims.Scp
+	if claims.Scope != "" {
+		scopes = strings.Fields(claims.Scope)
+	}
+	return Principal{
+		ID:          claims.Subject,
+		Method:      MethodJWT,
+		Tenant:      claims.Tenant,
+		Scopes:      scopes,
+		Permissions: a.perms.grant(scopes, raw),
+	}, nil
+}
+
+// verify checks the signature and claims of token and returns its claims,
+// parsed and raw.
+func (a *JWT) verify(token string) (*jwtClaims, map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("malformed signature")
+	}
+	key, err := a.keys.key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, nil, err
+	}
+
+	var claims jwtClaims
+	var raw map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, fmt.Errorf("claims: %v", err)
+	}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, nil, fmt.Errorf("claims: %v", err)
+	}
+	now := a.now()
+	if claims.ExpiresAt == nil && a.requireExp {
+		return nil, nil, errors.New("token has no exp claim")
+	}
+	if claims.ExpiresAt != nil && now.After(numericDate(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return nil, nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Before(numericDate(*claims.NotBefore).Add(-jwtLeeway)) {
+		return nil, nil, errors.New("token not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, nil, fmt.Errorf("issuer %q not accepted", claims.Issuer)
+	}
+	if a.audience != "" && !slices.Contains(claims.Audience, a.audience) {
+		return nil, nil, errors.New("token not issued for this audience")
+	}
+	if claims.Subject == "" {
+		return nil, nil, errors.New("token has no subject")
+	}
+	return &claims, raw, nil
+}
+
+// jwtHashes maps each supported asymmetric alg's size suffix to its hash.
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+// esCurveBits is the curve size each ES alg is defined for (P-256, P-384,
+// P-521).
+var esCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifySignature checks sig over signing for alg with key, which must be
+// of the type alg calls for.
+func verifySignature(alg string, key any, signing, sig []byte) error {
+	if alg == "HS256" {
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key does not fit alg %s", alg)
+		}
+		mac := hmac.New(crypto.SHA256.New, secret)
+		mac.Write(signing)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+
+	if len(alg) != 5 || !slices.Contains([]string{"RS", "PS", "ES"}, alg[:2]) {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write(signing)
+	digest := h.Sum(nil)
+
+	var err error
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("key does not fit alg %s", alg)
+		}
+	case *ecdsa.PublicKey:
+		bits := pub.Curve.Params().BitSize
+		if alg[:2] != "ES" || esCurveBits[alg] != bits {
+			return fmt.Errorf("key does not fit alg %s", alg)
+		}
+		// ES signatures are r and s as fixed-size big-endian halves
+		n := (bits + 7) / 8
+		if len(sig) != 2*n {
+			return errors.New("bad signature")
+		}
+		if !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])) {
+			err = errors.New("bad signature")
+		}
+	default:
+		return fmt.Errorf("key does not fit alg %s", alg)
+	}
+	if err != nil {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericDate(f float64) time.Time {
+	return time.Unix(0, int64(f*float64(time.Second)))
+}
+
+// Challenge implements Challenger.
+func (a *JWT) Challenge() string {
+	return `Bearer realm="favicons"`
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Permissions a Principal can hold.
+const (
+	// PermRead allows the public icon endpoints.
+	PermRead = "read"
+	// PermPurge allows /admin/purge.
+	PermPurge = "purge"
+	// PermUpload allows changing icon hints through /admin/hints and
+	// tenant branding through /admin/tenants.
+	PermUpload = "upload"
+)
+
+// Perms lists every permission.
+var Perms = []string{PermRead, PermPurge, PermUpload}
+
+// anyToken is the grant that every valid token matches.
+const anyToken = "*"
+
+// PermissionMap maps each permission to the grants that confer it: a scope
+// name, "claim:value" for a claim holding value (as a string or among an
+// array's strings), or "*" for any valid token. Scopes containing a colon,
+// such as URIs, are written "scope:<scope>". A permission without an entry
+// is not conferred by tokens at all.
+type PermissionMap map[string][]string
+
+// DefaultPermissionMap gives every valid token read access and the admin
+// permissions to tokens with the scope of the same name.
+var DefaultPermissionMap = PermissionMap{
+	PermRead:   {anyToken},
+	PermPurge:  {PermPurge},
+	PermUpload: {PermUpload},
+}
+
+// ParsePermissionMap parses a -jwt-permissions value: comma-separated
+// permission=grant|grant entries, e.g.
+// "read=*,purge=favicons.admin|groups:ops". Permissions left out keep
+// their DefaultPermissionMap grants.
+func ParsePermissionMap(s string) (PermissionMap, error) {
+	m := make(PermissionMap, len(DefaultPermissionMap))
+	for perm, grants := range DefaultPermissionMap {
+		m[perm] = grants
+	}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		perm, list, ok := strings.Cut(entry, "=")
+		perm = strings.ToLower(strings.TrimSpace(perm))
+		if !ok || !slices.Contains(Perms, perm) {
+			return nil, fmt.Errorf("entry %q is not <%s>=grant|grant", entry, strings.Join(Perms, "|"))
+		}
+		var grants []string
+		for _, g := range strings.Split(list, "|") {
+			if g = strings.TrimSpace(g); g != "" {
+				grants = append(grants, g)
+			}
+		}
+		m[perm] = grants
+	}
+	return m, nil
+}
+
+// grant returns the permissions m confers on a token with scopes and the
+// raw claims.
+func (m PermissionMap) grant(scopes []string, claims map[string]any) []string {
+	var perms []string
+	for _, perm := range Perms {
+		for _, g := range m[perm] {
+			if grantMatches(g, scopes, claims) {
+				perms = append(perms, perm)
+				break
+			}
+		}
+	}
+	return perms
+}
+
+func grantMatches(grant string, scopes []string, claims map[string]any) bool {
+	if grant == anyToken {
+		return true
+	}
+	name, want, isClaim := strings.Cut(grant, ":")
+	if !isClaim {
+		return slices.Contains(scopes, grant)
+	}
+	if name == "scope" || name == "scp" {
+		return slices.Contains(scopes, want)
+	}
+	switch v := claims[name].(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
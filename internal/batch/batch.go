@@ -0,0 +1,461 @@
+// Package batch runs asynchronous batches of icon lookups. Work is spread
+// politely across origins: lookups for one site (registrable domain) never
+// exceed a per-site concurrency limit, starts are spaced by a minimum
+// interval, and batches pause while foreground traffic is under pressure.
+package batch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/loadctl"
+	"faviconsvc/pkg/logger"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	DefaultConcurrency  = 8
+	DefaultPerHost      = 2
+	DefaultHostInterval = 250 * time.Millisecond
+	DefaultMaxDomains   = 1000
+	DefaultJobTTL       = time.Hour
+)
+
+// ErrTooManyDomains is returned by Submit when a batch, after duplicates
+// are merged, exceeds Options.MaxDomains.
+var ErrTooManyDomains = errors.New("batch: too many domains")
+
+// Job states.
+const (
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StateDone    = "done"
+)
+
+// Result is the outcome of one lookup.
+type Result struct {
+	Domain        string  `json:"domain"`
+	IconURL       string  `json:"icon_url,omitempty"`
+	InheritedFrom string  `json:"inherited_from,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+// Resolver looks up the icon of one domain.
+type Resolver func(ctx context.Context, domain string) Result
+
+// Options configures a Manager. Zero values select the defaults.
+type Options struct {
+	// Concurrency is how many lookups one batch runs at once.
+	Concurrency int
+	// PerHost is how many lookups may run at once against one site, across
+	// all batches.
+	PerHost int
+	// HostInterval is the minimum time between lookup starts for one site.
+	HostInterval time.Duration
+	// MaxDomains caps the size of a single batch.
+	MaxDomains int
+	// JobTTL is how long finished jobs and their results stay queryable.
+	JobTTL time.Duration
+	// Dir, if set, persists finished jobs and their downloads there, so
+	// they can still be fetched after a restart until JobTTL passes.
+	Dir string
+}
+
+// ThrottleStats describes how politeness and backpressure shaped a batch.
+type ThrottleStats struct {
+	PerHostLimit       int     `json:"per_host_limit"`
+	HostIntervalMs     float64 `json:"host_interval_ms"`
+	Sites              int     `json:"sites"`
+	MaxSiteLookups     int     `json:"max_site_lookups"`     // lookups queued for the busiest site
+	PeakSiteConcurrent int     `json:"peak_site_concurrent"` // most lookups seen running against one site
+	HostWaits          int     `json:"host_waits"`           // lookups delayed by the per-site limits
+	HostWaitMs         float64 `json:"host_wait_ms"`         // total time spent in those delays
+	LoadPauses         int     `json:"load_pauses"`          // lookups delayed because the service was under load
+	LoadPauseMs        float64 `json:"load_pause_ms"`
+}
+
+// Status is a point-in-time view of a job.
+type Status struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Submitted counts the input entries; Total the distinct domains they
+	// canonicalized to, which is what gets resolved.
+	Submitted  int `json:"submitted"`
+	Duplicates int `json:"duplicates"`
+	// Aliases maps every input entry that was rewritten or merged to the
+	// domain it was resolved as.
+	Aliases    map[string]string `json:"aliases,omitempty"`
+	Total      int               `json:"total"`
+	Completed  int               `json:"completed"`
+	Failed     int               `json:"failed"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Throttle   ThrottleStats     `json:"throttle"`
+	Results    []Result          `json:"results"`
+}
+
+// Job is one submitted batch.
+type Job struct {
+	mu       sync.Mutex
+	status   Status
+	finished chan struct{}
+
+	// artMu guards artifacts, the downloads built by Manager.Artifact
+	artMu     sync.Mutex
+	artifacts map[string]artifact
+}
+
+// Status returns a copy of the job's current status.
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := j.status
+	st.Results = append([]Result(nil), j.status.Results...)
+	if j.status.Aliases != nil {
+		st.Aliases = make(map[string]string, len(j.status.Aliases))
+		for k, v := range j.status.Aliases {
+			st.Aliases[k] = v
+		}
+	}
+	return st
+}
+
+// Done is closed when every lookup has finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.finished
+}
+
+// Manager schedules batch jobs and keeps their status for JobTTL.
+type Manager struct {
+	opts    Options
+	resolve Resolver
+	gate    *siteGate
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	lastSweep time.Time
+}
+
+// NewManager returns a Manager that resolves domains with resolve.
+func NewManager(resolve Resolver, opts Options) *Manager {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.PerHost <= 0 {
+		opts.PerHost = DefaultPerHost
+	}
+	if opts.HostInterval < 0 {
+		opts.HostInterval = 0
+	}
+	if opts.MaxDomains <= 0 {
+		opts.MaxDomains = DefaultMaxDomains
+	}
+	if opts.JobTTL <= 0 {
+		opts.JobTTL = DefaultJobTTL
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+			logger.Warn("Batch results directory %s unusable, keeping results in memory: %v", opts.Dir, err)
+			opts.Dir = ""
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		opts:    opts,
+		resolve: resolve,
+		gate:    newSiteGate(opts.PerHost, opts.HostInterval),
+		ctx:     ctx,
+		cancel:  cancel,
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// MaxDomains returns the most distinct domains Submit accepts.
+func (m *Manager) MaxDomains() int {
+	return m.opts.MaxDomains
+}
+
+// Close cancels all running jobs.
+func (m *Manager) Close() {
+	m.cancel()
+}
+
+// Submit canonicalizes and dedupes inputs (see Dedupe) and starts a job
+// resolving each distinct domain once. It fails with ErrTooManyDomains if
+// more than MaxDomains remain.
+func (m *Manager) Submit(inputs []string) (*Job, error) {
+	domains, aliases := Dedupe(inputs)
+	if len(domains) > m.opts.MaxDomains {
+		return nil, ErrTooManyDomains
+	}
+	id := newJobID()
+	j := &Job{
+		status: Status{
+			ID:         id,
+			State:      StateQueued,
+			Submitted:  len(inputs),
+			Duplicates: len(inputs) - len(domains),
+			Aliases:    aliases,
+			Total:      len(domains),
+			CreatedAt:  time.Now().UTC(),
+			Results:    make([]Result, len(domains)),
+			Throttle: ThrottleStats{
+				PerHostLimit:   m.opts.PerHost,
+				HostIntervalMs: float64(m.opts.HostInterval) / float64(time.Millisecond),
+			},
+		},
+		finished: make(chan struct{}),
+	}
+	for i, d := range domains {
+		j.status.Results[i].Domain = d
+	}
+
+	m.mu.Lock()
+	m.expireLocked()
+	m.jobs[id] = j
+	m.mu.Unlock()
+
+	go m.run(j, domains)
+	return j, nil
+}
+
+// Get returns the job with the given id.
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	if j, ok := m.jobs[id]; ok {
+		return j, true
+	}
+	return m.loadLocked(id)
+}
+
+func (m *Manager) expireLocked() {
+	now := time.Now()
+	defer m.sweepDirLocked(now)
+	cutoff := now.Add(-m.opts.JobTTL)
+	for id, j := range m.jobs {
+		j.mu.Lock()
+		expired := j.status.FinishedAt != nil && j.status.FinishedAt.Before(cutoff)
+		j.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *Manager) run(j *Job, domains []string) {
+	order, sites := interleaveBySite(domains)
+	j.mu.Lock()
+	j.status.State = StateRunning
+	j.status.Throttle.Sites = len(sites)
+	for _, n := range sites {
+		j.status.Throttle.MaxSiteLookups = max(j.status.Throttle.MaxSiteLookups, n)
+	}
+	j.mu.Unlock()
+
+	tasks := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(m.opts.Concurrency, len(domains)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				m.lookup(j, i, domains[i])
+			}
+		}()
+	}
+	for _, i := range order {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+
+	now := time.Now().UTC()
+	j.mu.Lock()
+	j.status.State = StateDone
+	j.status.FinishedAt = &now
+	st := j.status
+	j.mu.Unlock()
+	m.persist(st)
+	close(j.finished)
+	logger.Info("Batch %s done: %d/%d resolved, %d host waits, %d load pauses",
+		st.ID, st.Completed-st.Failed, st.Total, st.Throttle.HostWaits, st.Throttle.LoadPauses)
+}
+
+func (m *Manager) lookup(j *Job, i int, domain string) {
+	ctx := m.ctx
+	fail := func(msg string) {
+		j.mu.Lock()
+		j.status.Results[i].Error = msg
+		j.status.Completed++
+		j.status.Failed++
+		j.mu.Unlock()
+	}
+
+	// Batches are background work; let foreground requests drain first
+	if loadctl.Get().Throttled() {
+		start := time.Now()
+		_ = loadctl.Get().Wait(ctx)
+		j.mu.Lock()
+		j.status.Throttle.LoadPauses++
+		j.status.Throttle.LoadPauseMs += msSince(start)
+		j.mu.Unlock()
+	}
+
+	site := siteOf(domain)
+	waited, active, err := m.gate.acquire(ctx, site)
+	if err != nil {
+		fail("cancelled")
+		return
+	}
+	j.mu.Lock()
+	if waited > 0 {
+		j.status.Throttle.HostWaits++
+		j.status.Throttle.HostWaitMs += float64(waited) / float64(time.Millisecond)
+	}
+	j.status.Throttle.PeakSiteConcurrent = max(j.status.Throttle.PeakSiteConcurrent, active)
+	j.mu.Unlock()
+
+	start := time.Now()
+	res := m.resolve(ctx, domain)
+	m.gate.release(site)
+	res.Domain = domain
+	res.DurationMs = msSince(start)
+
+	j.mu.Lock()
+	j.status.Results[i] = res
+	j.status.Completed++
+	if res.Error != "" {
+		j.status.Failed++
+	}
+	j.mu.Unlock()
+}
+
+// Dedupe canonicalizes input domains with CanonicalDomain and drops
+// duplicates, keeping first-seen order. aliases maps each input that was
+// rewritten or merged into an earlier one to its canonical domain; it is
+// nil when every input was already canonical and distinct.
+func Dedupe(inputs []string) (domains []string, aliases map[string]string) {
+	seen := make(map[string]bool, len(inputs))
+	for _, in := range inputs {
+		d := CanonicalDomain(in)
+		if d != in || seen[d] {
+			if aliases == nil {
+				aliases = make(map[string]string)
+			}
+			aliases[in] = d
+		}
+		if !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	return domains, aliases
+}
+
+// CanonicalDomain reduces a sloppy domain entry to the host it names:
+// surrounding space, scheme, credentials, path, query, trailing dots and a
+// leading "www." are dropped, and the host is lowercased and converted to
+// punycode. A non-default port is kept. Entries that do not parse are
+// returned trimmed, to fail on resolution.
+func CanonicalDomain(raw string) string {
+	s := strings.TrimSpace(raw)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" {
+		return strings.TrimSpace(raw)
+	}
+	host := strings.TrimRight(strings.ToLower(u.Hostname()), ".")
+	if ascii, err := security.ASCIIHost(host); err == nil {
+		host = ascii
+	}
+	if net.ParseIP(host) == nil {
+		if rest, ok := strings.CutPrefix(host, "www."); ok && strings.Contains(rest, ".") {
+			host = rest
+		}
+	}
+	if host == "" {
+		return strings.TrimSpace(raw)
+	}
+	switch port := u.Port(); {
+	case port != "" && port != "443" && !(port == "80" && u.Scheme == "http"):
+		host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		host = "[" + host + "]"
+	}
+	return host
+}
+
+// siteOf returns the politeness key for a domain: its registrable domain, so
+// that many subdomains of one site share a single budget.
+func siteOf(domain string) string {
+	host := strings.ToLower(strings.TrimSuffix(domain, "."))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return site
+	}
+	return host
+}
+
+// interleaveBySite orders domain indices round-robin across sites, keeping
+// input order within a site, so workers are not all parked behind one
+// site's limit while other sites have work. It also returns the number of
+// lookups per site.
+func interleaveBySite(domains []string) ([]int, map[string]int) {
+	var sites []string
+	queues := make(map[string][]int)
+	for i, d := range domains {
+		s := siteOf(d)
+		if _, ok := queues[s]; !ok {
+			sites = append(sites, s)
+		}
+		queues[s] = append(queues[s], i)
+	}
+	counts := make(map[string]int, len(queues))
+	for s, q := range queues {
+		counts[s] = len(q)
+	}
+
+	order := make([]int, 0, len(domains))
+	for len(order) < len(domains) {
+		for _, s := range sites {
+			if q := queues[s]; len(q) > 0 {
+				order = append(order, q[0])
+				queues[s] = q[1:]
+			}
+		}
+	}
+	return order, counts
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
+
+func newJobID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,107 @@
+package batch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// siteGate enforces per-site politeness shared by all jobs: at most limit
+// lookups in flight per site, and starts spaced at least interval apart.
+type siteGate struct {
+	limit    int
+	interval time.Duration
+
+	mu    sync.Mutex
+	sites map[string]*siteState
+}
+
+// maxIdleSites is how many sites are tracked before idle ones are swept.
+const maxIdleSites = 1024
+
+type siteState struct {
+	active    int
+	nextStart time.Time
+	// changed is closed and replaced whenever a slot is released
+	changed chan struct{}
+}
+
+func newSiteGate(limit int, interval time.Duration) *siteGate {
+	return &siteGate{limit: limit, interval: interval, sites: make(map[string]*siteState)}
+}
+
+// acquire blocks until a lookup against site may start. It returns how long
+// the caller was held back (0 if not at all) and how many lookups are
+// running against site including this one.
+func (g *siteGate) acquire(ctx context.Context, site string) (time.Duration, int, error) {
+	start := time.Now()
+	for blocked := false; ; blocked = true {
+		g.mu.Lock()
+		now := time.Now()
+		s := g.sites[site]
+		if s == nil {
+			if len(g.sites) >= maxIdleSites {
+				g.sweepLocked(now)
+			}
+			s = &siteState{changed: make(chan struct{})}
+			g.sites[site] = s
+		}
+		if s.active < g.limit && !now.Before(s.nextStart) {
+			s.active++
+			s.nextStart = now.Add(g.interval)
+			active := s.active
+			g.mu.Unlock()
+			if !blocked {
+				return 0, active, nil
+			}
+			return time.Since(start), active, nil
+		}
+
+		// At the limit, wait for a release; otherwise for the spacing to pass
+		var t *time.Timer
+		var timer <-chan time.Time
+		if s.active < g.limit {
+			t = time.NewTimer(s.nextStart.Sub(now))
+			timer = t.C
+		}
+		changed := s.changed
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-timer:
+		case <-changed:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return time.Since(start), 0, err
+		}
+	}
+}
+
+// sweepLocked forgets sites with nothing running whose spacing has passed.
+func (g *siteGate) sweepLocked(now time.Time) {
+	for name, s := range g.sites {
+		if s.active == 0 && now.After(s.nextStart) {
+			delete(g.sites, name)
+		}
+	}
+}
+
+// release frees the slot taken by acquire.
+func (g *siteGate) release(site string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.sites[site]
+	if s == nil {
+		return
+	}
+	s.active--
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if s.active == 0 && time.Now().After(s.nextStart) {
+		delete(g.sites, site)
+	}
+}
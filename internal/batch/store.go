@@ -0,0 +1,186 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"faviconsvc/pkg/logger"
+)
+
+// ErrNotFinished is returned by Artifact for jobs still running.
+var ErrNotFinished = errors.New("batch: job not finished")
+
+// sweepEvery is the minimum time between scans of Options.Dir for expired
+// jobs.
+const sweepEvery = time.Minute
+
+// validJobID reports whether id has the form produced by newJobID, which
+// also makes it safe to use in a file name.
+func validJobID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// jobPath returns where a job's status, or a derived artifact when name is
+// non-empty, is persisted.
+func (m *Manager) jobPath(id, name string) string {
+	if name == "" {
+		return filepath.Join(m.opts.Dir, id+".json")
+	}
+	return filepath.Join(m.opts.Dir, id+"."+name)
+}
+
+// persist saves a finished job's status so it can be served after a restart.
+func (m *Manager) persist(st Status) {
+	if m.opts.Dir == "" {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err == nil {
+		err = writeFileAtomic(m.jobPath(st.ID, ""), data)
+	}
+	if err != nil {
+		logger.Warn("Failed to persist batch %s: %v", st.ID, err)
+	}
+}
+
+// loadLocked restores a persisted job that has not expired.
+func (m *Manager) loadLocked(id string) (*Job, bool) {
+	if m.opts.Dir == "" || !validJobID(id) {
+		return nil, false
+	}
+	data, err := os.ReadFile(m.jobPath(id, ""))
+	if err != nil {
+		return nil, false
+	}
+	var st Status
+	if err := json.Unmarshal(data, &st); err != nil || st.FinishedAt == nil ||
+		st.FinishedAt.Before(time.Now().Add(-m.opts.JobTTL)) {
+		return nil, false
+	}
+	j := &Job{status: st, finished: make(chan struct{})}
+	close(j.finished)
+	m.jobs[id] = j
+	return j, true
+}
+
+// sweepDirLocked removes the files of persisted jobs older than JobTTL.
+func (m *Manager) sweepDirLocked(now time.Time) {
+	if m.opts.Dir == "" || now.Sub(m.lastSweep) < sweepEvery {
+		return
+	}
+	m.lastSweep = now
+	des, err := os.ReadDir(m.opts.Dir)
+	if err != nil {
+		return
+	}
+	cutoff := now.Add(-m.opts.JobTTL)
+	for _, de := range des {
+		id, _, _ := strings.Cut(de.Name(), ".")
+		if !validJobID(id) {
+			continue
+		}
+		if _, live := m.jobs[id]; live {
+			continue
+		}
+		if info, err := de.Info(); err == nil && info.ModTime().Before(cutoff) {
+			_ = os.Remove(filepath.Join(m.opts.Dir, de.Name()))
+		}
+	}
+}
+
+// Artifact returns a download derived from a finished job, such as an
+// archive of its results, building it with build on first use. The bytes
+// are fixed once built, so clients can resume an interrupted download with
+// a range request; they are stored next to the persisted job and expire
+// with it, or are kept in memory when Options.Dir is unset. The returned
+// time is when the artifact was built.
+//
+// Concurrent calls for one job build each artifact once.
+func (m *Manager) Artifact(j *Job, name string, build func(w io.Writer, st Status) error) ([]byte, time.Time, error) {
+	j.artMu.Lock()
+	defer j.artMu.Unlock()
+	if a, ok := j.artifacts[name]; ok {
+		return a.data, a.built, nil
+	}
+
+	st := j.Status()
+	if st.State != StateDone {
+		return nil, time.Time{}, ErrNotFinished
+	}
+	var p string
+	if m.opts.Dir != "" {
+		p = m.jobPath(st.ID, name)
+		if info, err := os.Stat(p); err == nil {
+			if data, err := os.ReadFile(p); err == nil {
+				return data, info.ModTime(), nil
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := build(&buf, st); err != nil {
+		return nil, time.Time{}, err
+	}
+	built := time.Now().UTC().Truncate(time.Second)
+	if p != "" {
+		err := writeFileAtomic(p, buf.Bytes())
+		if err == nil {
+			err = os.Chtimes(p, built, built)
+		}
+		if err == nil {
+			return buf.Bytes(), built, nil
+		}
+		logger.Warn("Failed to persist batch %s %s: %v", st.ID, name, err)
+	}
+	j.keepArtifact(name, buf.Bytes(), built)
+	return buf.Bytes(), built, nil
+}
+
+type artifact struct {
+	data  []byte
+	built time.Time
+}
+
+func (j *Job) keepArtifact(name string, data []byte, built time.Time) {
+	if j.artifacts == nil {
+		j.artifacts = make(map[string]artifact)
+	}
+	j.artifacts[name] = artifact{data: data, built: built}
+}
+
+func writeFileAtomic(p string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -3,9 +3,12 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,22 +20,34 @@ import (
 type Manager struct {
 	CacheDir string
 	TTL      time.Duration
+	// CandidatesTTL is how long discovered icon candidate lists are reused
+	// (0 = TTL).
+	CandidatesTTL time.Duration
+	// TimelineVersions is how many icon changes are kept per host
+	// (0 = DefaultTimelineVersions).
+	TimelineVersions int
 }
 
 // OrigMeta contains metadata about cached original images.
-// It stores ETags and Last-Modified headers for conditional HTTP requests.
+// It stores ETags and Last-Modified headers for conditional HTTP requests,
+// and the icon's perceptual hash and average colour once computed.
 type OrigMeta struct {
 	URL          string    `json:"url"`
 	ETag         string    `json:"etag,omitempty"`
 	LastModified string    `json:"last_modified,omitempty"`
+	PHash        string    `json:"phash,omitempty"`
+	AvgColor     string    `json:"avg_color,omitempty"` // #rrggbb
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // ResolvedIcon contains the mapping from a page URL to its best icon URL.
+// InheritedFrom is set when the icon was found on the apex domain rather
+// than the page's own host.
 type ResolvedIcon struct {
-	PageURL    string    `json:"page_url"`
-	IconURL    string    `json:"icon_url"`
-	ResolvedAt time.Time `json:"resolved_at"`
+	PageURL       string    `json:"page_url"`
+	IconURL       string    `json:"icon_url"`
+	InheritedFrom string    `json:"inherited_from,omitempty"`
+	ResolvedAt    time.Time `json:"resolved_at"`
 }
 
 // New creates a new cache Manager with the specified directory and TTL.
@@ -50,8 +65,11 @@ func (m *Manager) EnsureDirs() error {
 	for _, p := range []string{
 		m.OrigCacheDir(),
 		m.ResizedCacheDir(),
+		m.SharedResizedCacheDir(),
 		m.FallbackCacheDir(),
 		m.ResolvedCacheDir(),
+		m.CandidatesCacheDir(),
+		m.HistoryCacheDir(),
 	} {
 		if err := os.MkdirAll(p, 0o755); err != nil {
 			return err
@@ -80,110 +98,118 @@ func (m *Manager) ResolvedCacheDir() string {
 	return filepath.Join(m.CacheDir, "resolved")
 }
 
+// CandidatesCacheDir returns the path to the discovered candidate lists cache directory.
+func (m *Manager) CandidatesCacheDir() string {
+	return filepath.Join(m.CacheDir, "candidates")
+}
+
+// shardPath returns where the cache file name of dir is stored: in the
+// subdirectory named by its first two characters, which are hex for every
+// sharded tier, so no directory holds more than a 256th of the entries.
+func shardPath(dir, name string) string {
+	return filepath.Join(dir, name[:2], name)
+}
+
+// origKey returns the file name of an icon's original, which also keys its
+// metadata in the index.
+func origKey(iconURL string) string {
+	return hash("orig|" + iconURL)
+}
+
+func (m *Manager) origPath(iconURL string) string {
+	return shardPath(m.OrigCacheDir(), origKey(iconURL))
+}
+
+func (m *Manager) resolvedPath(pageURL string) string {
+	return shardPath(m.ResolvedCacheDir(), hash("resolved|"+pageURL)+".json")
+}
+
 // ReadOrigFromCache attempts to read an original image from cache.
 // Returns the image data and true if found and not expired, nil and false otherwise.
 // Note: There's a small race window where janitor might delete the file between
 // stat and read, but this is handled gracefully by returning cache miss.
 func (m *Manager) ReadOrigFromCache(iconURL string) ([]byte, bool) {
-	p := filepath.Join(m.OrigCacheDir(), hash("orig|"+iconURL))
-	info, err := os.Stat(p)
-	if err != nil {
-		return nil, false
-	}
-	if time.Since(info.ModTime()) > m.TTL {
-		return nil, false
-	}
-	b, err := os.ReadFile(p)
-	if err != nil {
-		// File was deleted between stat and read (race with janitor)
-		return nil, false
-	}
-	return b, true
+	b, _, ok := readEntry(TierOrig, m.origPath(iconURL), m.TTL)
+	return b, ok
+}
+
+// ReadOrigFromCacheWithMod reads an original image as ReadOrigFromCache
+// does, and also returns when it was last fetched or revalidated.
+func (m *Manager) ReadOrigFromCacheWithMod(iconURL string) ([]byte, bool, time.Time) {
+	b, mod, ok := readEntry(TierOrig, m.origPath(iconURL), m.TTL)
+	return b, ok, mod
 }
 
 // WriteOrigToCache writes an original image to cache.
 // The write is atomic to prevent partial writes on failure.
+// Each distinct version is also recorded in the icon history.
 func (m *Manager) WriteOrigToCache(iconURL string, b []byte) error {
-	return atomicWriteFile(filepath.Join(m.OrigCacheDir(), hash("orig|"+iconURL)), b)
+	_ = m.writeHistory(b)
+	return writeEntry(TierOrig, m.origPath(iconURL), b)
 }
 
 // TouchOrigCache updates the modification time of a cached original image.
 // This is used to refresh TTL on cache hits with 304 Not Modified responses.
 func (m *Manager) TouchOrigCache(iconURL string) error {
-	p := filepath.Join(m.OrigCacheDir(), hash("orig|"+iconURL))
-	now := time.Now()
-	return os.Chtimes(p, now, now)
+	return touchEntry(TierOrig, m.origPath(iconURL))
 }
 
-// ReadOrigMeta reads metadata for a cached original image.
+// ReadOrigMeta reads metadata for a cached original image from the index.
 // Returns the metadata and true if found, empty metadata and false otherwise.
 func (m *Manager) ReadOrigMeta(iconURL string) (OrigMeta, bool) {
-	p := filepath.Join(m.OrigCacheDir(), hash("orig|"+iconURL)+".meta")
-	data, err := os.ReadFile(p)
-	if err != nil {
-		return OrigMeta{}, false
-	}
-	var meta OrigMeta
-	if err := json.Unmarshal(data, &meta); err != nil {
-		return OrigMeta{}, false
-	}
-	return meta, true
+	start := time.Now()
+	meta, _, err := m.lookupMeta(origKey(iconURL))
+	observe(TierMeta, opRead, start, err)
+	return meta, err == nil
 }
 
-// WriteOrigMeta writes metadata for a cached original image.
-// The write is atomic to prevent corruption.
+// WriteOrigMeta writes metadata for a cached original image to the index.
 func (m *Manager) WriteOrigMeta(iconURL string, meta OrigMeta) error {
-	p := filepath.Join(m.OrigCacheDir(), hash("orig|"+iconURL)+".meta")
-	data, _ := json.MarshalIndent(meta, "", "  ")
-	return atomicWriteFile(p, data)
+	start := time.Now()
+	err := m.storeMeta(origKey(iconURL), meta, start)
+	observe(TierMeta, opWrite, start, err)
+	return err
 }
 
 // ResizedCachePath returns the cache path for a resized image.
-// The path includes the size and format in the hash to prevent collisions.
+// The path includes the size and format in the hash to prevent collisions;
+// every variant of an icon shares the prefix resizedPrefix(iconURL).
 func (m *Manager) ResizedCachePath(iconURL string, size int, format string) string {
 	ext := "." + format
 	key := hash("res|" + iconURL + "|" + strconv.Itoa(size) + "|" + format)
-	return filepath.Join(m.ResizedCacheDir(), key+ext)
+	return shardPath(m.ResizedCacheDir(), resizedPrefix(iconURL)+key[:32]+ext)
+}
+
+// ResizedCacheKey returns the key of a resized variant as Purge reports it
+// in PurgeEntry.Path: its cache file path relative to the cache directory.
+func (m *Manager) ResizedCacheKey(iconURL string, size int, format string) string {
+	name := filepath.Base(m.ResizedCachePath(iconURL, size, format))
+	return "resized/" + name[:2] + "/" + name
+}
+
+// resizedPrefix returns the file name prefix of an icon's resized variants.
+func resizedPrefix(iconURL string) string {
+	return hash("res|" + iconURL)[:32] + "-"
 }
 
 // WriteResizedToCache writes a resized image to cache.
 // The write is atomic to prevent partial writes on failure.
 func (m *Manager) WriteResizedToCache(iconURL string, size int, format string, b []byte) error {
-	return atomicWriteFile(m.ResizedCachePath(iconURL, size, format), b)
+	return writeEntry(TierResized, m.ResizedCachePath(iconURL, size, format), b)
 }
 
 // ReadResizedFromCacheWithMod attempts to read a resized image from cache.
 // Returns the image data, true if found and not expired, and the modification time.
 func (m *Manager) ReadResizedFromCacheWithMod(iconURL string, size int, format string) ([]byte, bool, time.Time) {
-	p := m.ResizedCachePath(iconURL, size, format)
-	info, err := os.Stat(p)
-	if err != nil {
-		return nil, false, time.Time{}
-	}
-	if time.Since(info.ModTime()) > m.TTL {
-		return nil, false, time.Time{}
-	}
-	b, err := os.ReadFile(p)
-	if err != nil {
-		// File was deleted between stat and read (race with janitor)
-		return nil, false, time.Time{}
-	}
-	return b, true, info.ModTime()
+	b, mod, ok := readEntry(TierResized, m.ResizedCachePath(iconURL, size, format), m.TTL)
+	return b, ok, mod
 }
 
 // ReadResolvedIcon reads the cached icon URL mapping for a page URL.
 // Returns the resolved icon info and true if found and not expired.
 func (m *Manager) ReadResolvedIcon(pageURL string) (ResolvedIcon, bool) {
-	p := filepath.Join(m.ResolvedCacheDir(), hash("resolved|"+pageURL)+".json")
-	info, err := os.Stat(p)
-	if err != nil {
-		return ResolvedIcon{}, false
-	}
-	if time.Since(info.ModTime()) > m.TTL {
-		return ResolvedIcon{}, false
-	}
-	data, err := os.ReadFile(p)
-	if err != nil {
+	data, _, ok := readEntry(TierResolved, m.resolvedPath(pageURL), m.TTL)
+	if !ok {
 		return ResolvedIcon{}, false
 	}
 	var resolved ResolvedIcon
@@ -195,19 +221,69 @@ func (m *Manager) ReadResolvedIcon(pageURL string) (ResolvedIcon, bool) {
 
 // WriteResolvedIcon writes the icon URL mapping for a page URL to cache.
 func (m *Manager) WriteResolvedIcon(pageURL, iconURL string) error {
-	p := filepath.Join(m.ResolvedCacheDir(), hash("resolved|"+pageURL)+".json")
+	return m.WriteInheritedIcon(pageURL, iconURL, "")
+}
+
+// WriteInheritedIcon writes the icon URL mapping for a page URL whose icon
+// was taken from the apex host inheritedFrom. An empty inheritedFrom is
+// equivalent to WriteResolvedIcon.
+func (m *Manager) WriteInheritedIcon(pageURL, iconURL, inheritedFrom string) error {
+	p := m.resolvedPath(pageURL)
 	resolved := ResolvedIcon{
-		PageURL:    pageURL,
-		IconURL:    iconURL,
-		ResolvedAt: time.Now(),
+		PageURL:       pageURL,
+		IconURL:       iconURL,
+		InheritedFrom: inheritedFrom,
+		ResolvedAt:    time.Now(),
 	}
 	data, _ := json.MarshalIndent(resolved, "", "  ")
-	return atomicWriteFile(p, data)
+	return writeEntry(TierResolved, p, data)
+}
+
+// candidatesEntry is the on-disk form of a discovered candidate list.
+type candidatesEntry struct {
+	PageURL      string          `json:"page_url"`
+	Candidates   json.RawMessage `json:"candidates"`
+	DiscoveredAt time.Time       `json:"discovered_at"`
+}
+
+func (m *Manager) candidatesPath(pageURL string) string {
+	return shardPath(m.CandidatesCacheDir(), hash("candidates|"+pageURL)+".json")
+}
+
+// ReadCandidates decodes the cached candidate list for a page URL into v.
+// Returns true if an entry was found and is younger than CandidatesTTL.
+func (m *Manager) ReadCandidates(pageURL string, v any) bool {
+	ttl := m.CandidatesTTL
+	if ttl <= 0 {
+		ttl = m.TTL
+	}
+	data, _, ok := readEntry(TierCandidates, m.candidatesPath(pageURL), ttl)
+	if !ok {
+		return false
+	}
+	var entry candidatesEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.PageURL != pageURL {
+		return false
+	}
+	return json.Unmarshal(entry.Candidates, v) == nil
+}
+
+// WriteCandidates stores the discovered candidate list v for a page URL.
+func (m *Manager) WriteCandidates(pageURL string, v any) error {
+	cands, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(candidatesEntry{
+		PageURL:      pageURL,
+		Candidates:   cands,
+		DiscoveredAt: time.Now(),
+	}, "", "  ")
+	return writeEntry(TierCandidates, m.candidatesPath(pageURL), data)
 }
 
 func atomicWriteFile(p string, data []byte) error {
-	dir := filepath.Dir(p)
-	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	tmp, err := createTemp(filepath.Dir(p))
 	if err != nil {
 		return err
 	}
@@ -239,6 +315,46 @@ func atomicWriteFile(p string, data []byte) error {
 	return nil
 }
 
+// Probe writes, reads back and removes a small file in the cache directory,
+// for health checks to tell a full, read-only or hung filesystem.
+func (m *Manager) Probe() error {
+	f, err := os.CreateTemp(m.CacheDir, ".tmp-probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	want := []byte(time.Now().Format(time.RFC3339Nano))
+	if _, err := f.Write(want); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("probe file read back differently")
+	}
+	return nil
+}
+
+// createTemp creates a temp file in dir for an atomic write, creating dir,
+// such as the shard of a new entry, when it does not exist yet.
+func createTemp(dir string) (*os.File, error) {
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		tmp, err = os.CreateTemp(dir, ".tmp-*")
+	}
+	return tmp, err
+}
+
 func hash(s string) string {
 	sum := sha256.Sum256([]byte(s))
 	return hex.EncodeToString(sum[:])
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"faviconsvc/pkg/logger"
+)
+
+// ExportEntry describes one original icon exported into a content-addressed store.
+type ExportEntry struct {
+	CID       string    `json:"cid"`
+	URL       string    `json:"url,omitempty"`
+	Size      int       `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// cidBase32 is the RFC 4648 lowercase alphabet used by the "b" multibase prefix.
+var cidBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// ContentCID returns the CIDv1 (raw codec, sha2-256 multihash, base32) for b.
+// This is the same CID an IPFS node assigns to b when stored as a single raw block.
+func ContentCID(b []byte) string {
+	sum := sha256.Sum256(b)
+	// version 1, codec raw (0x55), multihash sha2-256 (0x12) with 32-byte digest
+	buf := make([]byte, 0, 4+len(sum))
+	buf = append(buf, 0x01, 0x55, 0x12, 0x20)
+	buf = append(buf, sum[:]...)
+	return "b" + cidBase32.EncodeToString(buf)
+}
+
+// ExportOrigByCID copies every non-expired original icon into dst, naming each
+// file by its CID, and writes an index.json mapping CIDs back to source URLs.
+// Identical content fetched from several URLs is stored once. Source URLs
+// come from the metadata index and are left out while it is busy.
+// A zero maxAge exports everything regardless of TTL.
+func (m *Manager) ExportOrigByCID(dst string, maxAge time.Duration) ([]ExportEntry, error) {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(m.OrigCacheDir()); err != nil {
+		return nil, err
+	}
+	// Source URLs come from the metadata index. Without it, such as while
+	// another process keeps it busy, originals are exported without them
+	urls := make(map[string]string)
+	err := scanIndex(m.CacheDir, func(key string, _ time.Time, data []byte) {
+		var meta OrigMeta
+		if json.Unmarshal(data, &meta) == nil {
+			urls[key] = meta.URL
+		}
+	})
+	if err != nil {
+		logger.Warn("Exporting without source URLs: %v", err)
+	}
+	var paths []string
+	_ = filepath.WalkDir(m.OrigCacheDir(), func(p string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return nil
+		}
+		if !strings.HasPrefix(de.Name(), ".tmp-") {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+
+	seen := make(map[string]struct{})
+	var out []ExportEntry
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+			continue
+		}
+		b, err := os.ReadFile(p)
+		if err != nil || len(b) == 0 {
+			continue
+		}
+
+		entry := ExportEntry{CID: ContentCID(b), URL: urls[filepath.Base(p)], Size: len(b), UpdatedAt: info.ModTime()}
+		out = append(out, entry)
+
+		if _, dup := seen[entry.CID]; dup {
+			continue
+		}
+		seen[entry.CID] = struct{}{}
+		if err := atomicWriteFile(filepath.Join(dst, entry.CID), b); err != nil {
+			return out, err
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CID != out[j].CID {
+			return out[i].CID < out[j].CID
+		}
+		return out[i].URL < out[j].URL
+	})
+
+	data, _ := json.MarshalIndent(out, "", "  ")
+	if err := atomicWriteFile(filepath.Join(dst, "index.json"), data); err != nil {
+		return out, err
+	}
+	return out, nil
+}
@@ -0,0 +1,23 @@
+package cache
+
+import "path/filepath"
+
+// fallbackPath returns where the placeholder cached under key is stored.
+// Placeholders do not depend on the page, so the directory stays small
+// and is not sharded.
+func (m *Manager) fallbackPath(key string) string {
+	return filepath.Join(m.FallbackCacheDir(), hash("fallback|" + key)[:32])
+}
+
+// ReadFallback returns the encoded placeholder cached under key, if it has
+// not expired.
+func (m *Manager) ReadFallback(key string) ([]byte, bool) {
+	b, _, ok := readEntry(TierFallback, m.fallbackPath(key), m.TTL)
+	return b, ok
+}
+
+// WriteFallback caches an encoded placeholder under key, which should name
+// everything it was drawn from, such as its kind, size and format.
+func (m *Manager) WriteFallback(key string, b []byte) error {
+	return writeEntry(TierFallback, m.fallbackPath(key), b)
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryCacheDir returns the path to the content-addressed icon history.
+// Every original icon version is kept there under its CID so later
+// versions can be compared against it.
+func (m *Manager) HistoryCacheDir() string {
+	return filepath.Join(m.CacheDir, "history")
+}
+
+// writeHistory stores b under its CID. Content already present only has its
+// modification time refreshed, so versions still being served do not expire.
+func (m *Manager) writeHistory(b []byte) error {
+	p := filepath.Join(m.HistoryCacheDir(), ContentCID(b))
+	if _, err := os.Stat(p); err == nil {
+		return touchEntry(TierHistory, p)
+	}
+	return writeEntry(TierHistory, p, b)
+}
+
+// ReadHistory returns the icon version with the given CID, if still retained.
+func (m *Manager) ReadHistory(cid string) ([]byte, bool) {
+	if !ValidCID(cid) {
+		return nil, false
+	}
+	b, _, ok := readEntry(TierHistory, filepath.Join(m.HistoryCacheDir(), cid), noExpiry)
+	return b, ok
+}
+
+// ValidCID reports whether s has the form produced by ContentCID.
+func ValidCID(s string) bool {
+	// "b" multibase prefix + base32 of the 36-byte CID
+	if len(s) != 59 || s[0] != 'b' {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < '2' || c > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultTimelineVersions is how many versions a host's timeline keeps
+// when Manager.TimelineVersions is unset.
+const DefaultTimelineVersions = 256
+
+// timelineMu serialises read-modify-write cycles on timeline files.
+var timelineMu sync.Mutex
+
+// IconVersion is one entry in a host's icon timeline: the icon it served
+// from Time until the next entry.
+type IconVersion struct {
+	Time    time.Time `json:"time"`
+	CID     string    `json:"cid"`
+	IconURL string    `json:"icon_url"`
+}
+
+func (m *Manager) timelinePath(host string) string {
+	return filepath.Join(m.HistoryCacheDir(), "timeline", hash("timeline|"+host)+".json")
+}
+
+func (m *Manager) readTimeline(host string) []IconVersion {
+	data, err := os.ReadFile(m.timelinePath(host))
+	if err != nil {
+		return nil
+	}
+	var versions []IconVersion
+	_ = json.Unmarshal(data, &versions)
+	return versions
+}
+
+// RecordIconVersion notes that host served the icon b (from iconURL) at t.
+// The bytes are kept in the history under their CID, and a timeline entry
+// is appended when the CID differs from the host's latest version.
+func (m *Manager) RecordIconVersion(host, iconURL string, b []byte, t time.Time) error {
+	if err := m.writeHistory(b); err != nil {
+		return err
+	}
+	cid := ContentCID(b)
+
+	timelineMu.Lock()
+	defer timelineMu.Unlock()
+	p := m.timelinePath(host)
+	versions := m.readTimeline(host)
+	if n := len(versions); n > 0 && versions[n-1].CID == cid {
+		// Still current; keep the janitor from expiring the timeline
+		now := time.Now()
+		return os.Chtimes(p, now, now)
+	}
+	versions = append(versions, IconVersion{Time: t.UTC(), CID: cid, IconURL: iconURL})
+	limit := m.TimelineVersions
+	if limit <= 0 {
+		limit = DefaultTimelineVersions
+	}
+	if len(versions) > limit {
+		versions = versions[len(versions)-limit:]
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(versions)
+	return atomicWriteFile(p, data)
+}
+
+// IconTimeline returns every version recorded for host, oldest first.
+func (m *Manager) IconTimeline(host string) []IconVersion {
+	return m.readTimeline(host)
+}
+
+// IconVersionAt returns the version host was serving at t: the latest
+// timeline entry recorded at or before t.
+func (m *Manager) IconVersionAt(host string, t time.Time) (IconVersion, bool) {
+	versions := m.readTimeline(host)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].Time.After(t) {
+			return versions[i], true
+		}
+	}
+	return IconVersion{}, false
+}
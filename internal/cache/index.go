@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"faviconsvc/pkg/logger"
+)
+
+// indexFile is the bbolt database in the cache directory holding the
+// metadata of cached originals, keyed by their file name in orig; schema 2
+// kept it in a .meta file next to each. It is not a cache file, so the
+// janitor does not walk it.
+const indexFile = "index.db"
+
+var metaBucket = []byte("meta")
+
+// indexOpenTimeout bounds the wait for the lock on an index. Processes only
+// hold it for one transaction, readers sharing it, so a longer wait means
+// one of them is stuck or working through a migration.
+const indexOpenTimeout = time.Second
+
+// ErrIndexInUse is returned when another process using the same cache
+// directory held its metadata index for longer than indexOpenTimeout.
+var ErrIndexInUse = errors.New("cache: metadata index busy in another process")
+
+var (
+	indexesMu sync.Mutex
+	// The lock on an index is taken per open file, so the transactions of
+	// one process are ordered here rather than lock each other out
+	indexLocks = make(map[string]*sync.RWMutex)
+)
+
+// indexLock returns the in-process lock of the index of dir, named by its
+// absolute path.
+func indexLock(dir string) (string, *sync.RWMutex, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	l := indexLocks[abs]
+	if l == nil {
+		l = new(sync.RWMutex)
+		indexLocks[abs] = l
+	}
+	return abs, l, nil
+}
+
+// viewIndex runs fn in a read-only transaction on the index of dir, whose
+// bucket is nil while the index has no records. The index is opened for the
+// transaction alone, so the servers and commands sharing a cache directory
+// all get to it; readers share the lock. An error wrapping fs.ErrNotExist
+// means there is no index yet.
+func viewIndex(dir string, fn func(b *bolt.Bucket) error) error {
+	abs, l, err := indexLock(dir)
+	if err != nil {
+		return err
+	}
+	l.RLock()
+	defer l.RUnlock()
+	db, err := bolt.Open(filepath.Join(abs, indexFile), 0o644, &bolt.Options{ReadOnly: true, Timeout: indexOpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return ErrIndexInUse
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(metaBucket))
+	})
+}
+
+// updateIndex runs fn in a read-write transaction on the index of dir,
+// creating the index if needed, and closes it again as viewIndex does.
+func updateIndex(dir string, fn func(b *bolt.Bucket) error) error {
+	abs, l, err := indexLock(dir)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	db, err := openIndexFile(filepath.Join(abs, indexFile))
+	if errors.Is(err, bolt.ErrTimeout) {
+		return ErrIndexInUse
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+func openIndexFile(p string) (*bolt.DB, error) {
+	opts := &bolt.Options{Timeout: indexOpenTimeout}
+	db, err := bolt.Open(p, 0o644, opts)
+	if unreadableIndex(err) {
+		// Metadata is only cached, so start over rather than go without
+		logger.Warn("Cache metadata index %s is unreadable, starting a new one: %v", p, err)
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+		db, err = bolt.Open(p, 0o644, opts)
+	}
+	if err != nil && !errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("cache index %s: %w", p, err)
+	}
+	return db, err
+}
+
+// unreadableIndex reports whether bolt.Open failed on the contents of the
+// index file, such as a truncated or corrupt file, rather than to open,
+// lock or map it.
+func unreadableIndex(err error) bool {
+	var pathErr *fs.PathError
+	var errno syscall.Errno
+	return err != nil && !errors.Is(err, bolt.ErrTimeout) && !errors.As(err, &pathErr) && !errors.As(err, &errno)
+}
+
+// An index record is the time it was written, as 8 bytes of Unix
+// nanoseconds, followed by the entry's JSON.
+func encodeRecord(written time.Time, data []byte) []byte {
+	rec := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(rec, uint64(written.UnixNano()))
+	return append(rec, data...)
+}
+
+func decodeRecord(rec []byte) (time.Time, []byte, bool) {
+	if len(rec) < 8 {
+		return time.Time{}, nil, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(rec))), rec[8:], true
+}
+
+// lookupMeta reads the indexed metadata of the original whose file name is
+// key. It returns an error wrapping fs.ErrNotExist if there is none.
+func (m *Manager) lookupMeta(key string) (OrigMeta, int, error) {
+	var data []byte
+	size := 0
+	err := viewIndex(m.CacheDir, func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		rec := b.Get([]byte(key))
+		if _, d, ok := decodeRecord(rec); ok {
+			// Records are only valid during the transaction
+			data, size = append([]byte(nil), d...), len(rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return OrigMeta{}, 0, err
+	}
+	var meta OrigMeta
+	if data == nil || json.Unmarshal(data, &meta) != nil {
+		return OrigMeta{}, 0, fs.ErrNotExist
+	}
+	return meta, size, nil
+}
+
+// storeMeta indexes meta under key.
+func (m *Manager) storeMeta(key string, meta OrigMeta, written time.Time) error {
+	data, _ := json.Marshal(meta)
+	return updateIndex(m.CacheDir, func(b *bolt.Bucket) error {
+		return b.Put([]byte(key), encodeRecord(written, data))
+	})
+}
+
+// scanIndex calls fn with every record of the index of dir, whose data is
+// only valid during the call. A missing index has no records.
+func scanIndex(dir string, fn func(key string, written time.Time, data []byte)) error {
+	err := viewIndex(dir, func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if written, data, ok := decodeRecord(v); ok {
+				fn(string(k), written, data)
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// deleteMeta removes the records of keys from the index of dir.
+func deleteMeta(dir string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return updateIndex(dir, func(b *bolt.Bucket) error {
+		for _, k := range keys {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// evictMeta removes the records of keys on behalf of the janitor, as
+// evictEntry removes files.
+func evictMeta(dir string, keys []string) error {
+	start := time.Now()
+	err := deleteMeta(dir, keys)
+	for range keys {
+		observe(TierMeta, opEvict, start, err)
+	}
+	return err
+}
+
+// pruneIndex removes the records of the index of dir written before before
+// whose original is not in live, and returns how many it removed. Records
+// written since may belong to originals stored after live was listed.
+func pruneIndex(dir string, before time.Time, live map[string]struct{}) (int, error) {
+	var orphans []string
+	err := scanIndex(dir, func(key string, written time.Time, _ []byte) {
+		if _, ok := live[key]; !ok && written.Before(before) {
+			orphans = append(orphans, key)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := evictMeta(dir, orphans); err != nil {
+		return 0, err
+	}
+	return len(orphans), nil
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxInspectSize is the largest variant size Inspect recovers from a
+// resized file name; variants above it are reported with size -1.
+const maxInspectSize = 2048
+
+// CachedFile is one cache file as Inspect reports it.
+type CachedFile struct {
+	Path     string    `json:"path"` // relative to the cache directory
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+	// Expires is when reads start treating the file as a miss; nil for
+	// files kept until evicted
+	Expires *time.Time `json:"expires,omitempty"`
+	Expired bool       `json:"expired,omitempty"`
+}
+
+// CachedPage is a page's resolved icon mapping or candidate list.
+type CachedPage struct {
+	Tier string `json:"tier"` // TierResolved or TierCandidates
+	// Key is the page URL; non-default rankings append " rank=<name>"
+	Key           string `json:"key"`
+	IconURL       string `json:"icon_url,omitempty"`
+	InheritedFrom string `json:"inherited_from,omitempty"`
+	Candidates    int    `json:"candidates,omitempty"`
+	// Negative is the status of a failed lookup cached for the page
+	// (see NegativeEntry)
+	Negative string `json:"negative,omitempty"`
+	CachedFile
+}
+
+// CachedVariant is a resized variant of a cached icon.
+type CachedVariant struct {
+	Size   int    `json:"size"`
+	Format string `json:"format"` // format key, with any variant suffixes
+	CachedFile
+}
+
+// CachedIcon is an icon's original, its metadata and its resized variants.
+// Original is nil once the original has been evicted while variants remain.
+type CachedIcon struct {
+	URL         string          `json:"url"`
+	ContentHash string          `json:"content_hash,omitempty"` // ContentCID of the original
+	ContentType string          `json:"content_type,omitempty"`
+	Original    *CachedFile     `json:"original,omitempty"`
+	Meta        *OrigMeta       `json:"meta,omitempty"`
+	Variants    []CachedVariant `json:"variants"`
+}
+
+// Inspection is everything the cache holds for the hosts matching a glob.
+type Inspection struct {
+	Pages []CachedPage `json:"pages"`
+	Icons []CachedIcon `json:"icons"`
+}
+
+// Inspect reports the cache entries Purge would remove for hostPattern,
+// with what each holds and when it expires under m's TTLs. It reads the
+// files directly, so expired entries are listed too, and touches nothing.
+func (m *Manager) Inspect(hostPattern string) (Inspection, error) {
+	entries, err := m.Purge(PurgeOptions{HostPattern: hostPattern, DryRun: true, AllVariants: true})
+	if err != nil {
+		return Inspection{}, err
+	}
+	candidatesTTL := m.CandidatesTTL
+	if candidatesTTL <= 0 {
+		candidatesTTL = m.TTL
+	}
+
+	res := Inspection{Pages: []CachedPage{}, Icons: []CachedIcon{}}
+	icons := make(map[string]*CachedIcon)
+	icon := func(iconURL string) *CachedIcon {
+		if ic, ok := icons[iconURL]; ok {
+			return ic
+		}
+		ic := &CachedIcon{URL: iconURL, Variants: []CachedVariant{}}
+		icons[iconURL] = ic
+		return ic
+	}
+	for _, e := range entries {
+		if e.Tier == TierMeta {
+			if meta, _, err := m.lookupMeta(origKey(e.Key)); err == nil {
+				icon(e.Key).Meta = &meta
+			}
+			continue
+		}
+		p := filepath.Join(m.CacheDir, filepath.FromSlash(e.Path))
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		file := func(ttl time.Duration) CachedFile {
+			f := CachedFile{Path: e.Path, Bytes: info.Size(), Modified: info.ModTime()}
+			if ttl >= 0 {
+				exp := info.ModTime().Add(ttl)
+				f.Expires, f.Expired = &exp, time.Now().After(exp)
+			}
+			return f
+		}
+
+		switch {
+		case e.Tier == TierResolved:
+			var r ResolvedIcon
+			_ = json.Unmarshal(data, &r)
+			res.Pages = append(res.Pages, CachedPage{Tier: e.Tier, Key: e.Key, IconURL: r.IconURL,
+				InheritedFrom: r.InheritedFrom, CachedFile: file(m.TTL)})
+		case e.Tier == TierNegative:
+			// Listed as a resolved mapping without an icon, which it is
+			// stored as
+			var neg NegativeEntry
+			_ = json.Unmarshal(data, &neg)
+			page := CachedPage{Tier: TierResolved, Key: e.Key, Negative: neg.Status, CachedFile: file(m.TTL)}
+			page.Expires, page.Expired = &neg.Until, time.Now().After(neg.Until)
+			res.Pages = append(res.Pages, page)
+		case e.Tier == TierCandidates:
+			var c candidatesEntry
+			var list []json.RawMessage
+			if json.Unmarshal(data, &c) == nil {
+				_ = json.Unmarshal(c.Candidates, &list)
+			}
+			res.Pages = append(res.Pages, CachedPage{Tier: e.Tier, Key: e.Key, Candidates: len(list),
+				CachedFile: file(candidatesTTL)})
+		case e.Tier == TierOrig:
+			ic := icon(e.Key)
+			f := file(m.TTL)
+			ic.Original = &f
+			ic.ContentHash = ContentCID(data)
+			ic.ContentType = http.DetectContentType(data)
+		case e.Tier == TierResized:
+			size, format := m.resizedVariant(e.Key, filepath.Base(p))
+			ic := icon(e.Key)
+			ic.Variants = append(ic.Variants, CachedVariant{Size: size, Format: format, CachedFile: file(m.TTL)})
+		}
+	}
+
+	for _, ic := range icons {
+		sort.Slice(ic.Variants, func(i, j int) bool {
+			if ic.Variants[i].Format != ic.Variants[j].Format {
+				return ic.Variants[i].Format < ic.Variants[j].Format
+			}
+			return ic.Variants[i].Size < ic.Variants[j].Size
+		})
+		res.Icons = append(res.Icons, *ic)
+	}
+	sort.Slice(res.Icons, func(i, j int) bool { return res.Icons[i].URL < res.Icons[j].URL })
+	sort.SliceStable(res.Pages, func(i, j int) bool { return res.Pages[i].Key < res.Pages[j].Key })
+	return res, nil
+}
+
+// resizedVariant recovers the size and format key of the resized file name
+// of iconURL. The format is the file extension; the size is only hashed
+// into the name, so it is found by trying every size up to maxInspectSize.
+func (m *Manager) resizedVariant(iconURL, name string) (int, string) {
+	_, format, _ := strings.Cut(name, ".")
+	for size := 0; size <= maxInspectSize; size++ {
+		if filepath.Base(m.ResizedCachePath(iconURL, size, format)) == name {
+			return size, format
+		}
+	}
+	return -1, format
+}
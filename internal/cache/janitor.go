@@ -8,16 +8,23 @@ import (
 	"strings"
 	"time"
 
+	"faviconsvc/pkg/loadctl"
 	"faviconsvc/pkg/logger"
 )
 
+// janitorYieldEvery is how many files the janitor handles between load checks.
+const janitorYieldEvery = 256
+
 type fileEntry struct {
 	path  string
 	size  int64
 	mtime time.Time
 }
 
-func RunJanitor(ctx context.Context, interval time.Duration, root string, ttl time.Duration, maxSize int64) {
+// RunJanitor periodically purges cache entries older than ttl and icon
+// history older than historyTTL (0 = only the size limit applies), then
+// evicts the oldest files while the cache exceeds maxSize.
+func RunJanitor(ctx context.Context, interval time.Duration, root string, ttl, historyTTL time.Duration, maxSize int64) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
 
@@ -28,8 +35,8 @@ func RunJanitor(ctx context.Context, interval time.Duration, root string, ttl ti
 		return
 	}
 
-	logger.Info("Janitor started: interval=%v, ttl=%v, maxSize=%d", interval, ttl, maxSize)
-	purgeOnce(root, ttl, maxSize)
+	logger.Info("Janitor started: interval=%v, ttl=%v, historyTTL=%v, maxSize=%d", interval, ttl, historyTTL, maxSize)
+	purgeOnce(ctx, root, ttl, historyTTL, maxSize)
 
 	for {
 		select {
@@ -37,19 +44,25 @@ func RunJanitor(ctx context.Context, interval time.Duration, root string, ttl ti
 			logger.Info("Janitor stopped")
 			return
 		case <-t.C:
-			purgeOnce(root, ttl, maxSize)
+			purgeOnce(ctx, root, ttl, historyTTL, maxSize)
 		}
 	}
 }
 
-func purgeOnce(root string, ttl time.Duration, maxSize int64) {
+func purgeOnce(ctx context.Context, root string, ttl, historyTTL time.Duration, maxSize int64) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("Janitor panic: %v", r)
 		}
 	}()
 
+	// Hold off while foreground traffic is struggling
+	if loadctl.Get().Wait(ctx) != nil {
+		return
+	}
+
 	expireBefore := time.Now().Add(-ttl)
+	historyExpireBefore := time.Now().Add(-historyTTL)
 	expiredCount := 0
 	orphanMetaCount := 0
 	tempFileCount := 0
@@ -57,7 +70,8 @@ func purgeOnce(root string, ttl time.Duration, maxSize int64) {
 	// Collect all cache files
 	var dataFiles []string
 	var tempFiles []string
-	metaFiles := make(map[string]string) // base path -> meta path
+	origKeys := make(map[string]struct{}) // originals, keying the metadata index
+	scanned := time.Now()
 
 	_ = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
@@ -76,49 +90,42 @@ func purgeOnce(root string, ttl time.Duration, maxSize int64) {
 			return nil
 		}
 
-		if strings.HasSuffix(p, ".meta") {
-			baseWithoutMeta := strings.TrimSuffix(p, ".meta")
-			metaFiles[baseWithoutMeta] = p
-		} else {
-			dataFiles = append(dataFiles, p)
+		if tierOf(p) == TierOrig {
+			origKeys[base] = struct{}{}
 		}
+		dataFiles = append(dataFiles, p)
 		return nil
 	})
 
-	// Create set of existing data files for quick lookup
-	dataFileSet := make(map[string]struct{}, len(dataFiles))
-	for _, f := range dataFiles {
-		dataFileSet[f] = struct{}{}
-	}
-
-	// Purge expired data files and their meta files
-	for _, p := range dataFiles {
+	// Purge expired data files
+	for i, p := range dataFiles {
+		if i%janitorYieldEvery == 0 && i > 0 && loadctl.Get().Wait(ctx) != nil {
+			return
+		}
 		info, err := os.Stat(p)
 		if err != nil {
 			continue
 		}
 
-		if info.ModTime().Before(expireBefore) {
-			if err := os.Remove(p); err == nil {
-				expiredCount++
-				// Also remove associated meta file
-				if metaPath, ok := metaFiles[p]; ok {
-					_ = os.Remove(metaPath)
-					delete(metaFiles, p)
-				}
+		expiry := expireBefore
+		if isHistoryFile(p) {
+			if historyTTL <= 0 {
+				continue
 			}
+			expiry = historyExpireBefore
 		}
-	}
-
-	// Purge orphan meta files (meta without data file)
-	for base, metaPath := range metaFiles {
-		if _, exists := dataFileSet[base]; !exists {
-			if err := os.Remove(metaPath); err == nil {
-				orphanMetaCount++
+		if info.ModTime().Before(expiry) {
+			if err := evictEntry(p); err == nil {
+				expiredCount++
+				delete(origKeys, filepath.Base(p))
 			}
 		}
 	}
 
+	// Purge the metadata of originals gone, expired or evicted by other means;
+	// a busy index is pruned on the next run
+	orphanMetaCount, _ = pruneIndex(root, scanned, origKeys)
+
 	// Purge leftover temp files (older than 5 minutes)
 	tempExpire := time.Now().Add(-5 * time.Minute)
 	for _, p := range tempFiles {
@@ -140,11 +147,11 @@ func purgeOnce(root string, ttl time.Duration, maxSize int64) {
 
 	// Purge by size if needed
 	if maxSize > 0 {
-		purgeBySizeLimit(root, maxSize)
+		purgeBySizeLimit(ctx, root, maxSize)
 	}
 }
 
-func purgeBySizeLimit(root string, maxSize int64) {
+func purgeBySizeLimit(ctx context.Context, root string, maxSize int64) {
 	var files []fileEntry
 	var total int64
 
@@ -161,9 +168,9 @@ func purgeBySizeLimit(root string, maxSize int64) {
 			return nil
 		}
 
-		// Skip meta files and temp files in size calculation
+		// Skip temp files in size calculation
 		base := filepath.Base(p)
-		if strings.HasSuffix(p, ".meta") || strings.HasPrefix(base, ".tmp-") {
+		if strings.HasPrefix(base, ".tmp-") {
 			return nil
 		}
 
@@ -187,24 +194,26 @@ func purgeBySizeLimit(root string, maxSize int64) {
 
 	removedCount := 0
 	freedBytes := int64(0)
+	var evictedOrig []string
 
-	for _, fe := range files {
+	for i, fe := range files {
 		if total <= maxSize {
 			break
 		}
-		if err := os.Remove(fe.path); err == nil {
+		if i%janitorYieldEvery == 0 && i > 0 && loadctl.Get().Wait(ctx) != nil {
+			break
+		}
+		if err := evictEntry(fe.path); err == nil {
 			total -= fe.size
 			freedBytes += fe.size
 			removedCount++
-
-			// Also remove associated meta file
-			metaPath := fe.path + ".meta"
-			if info, err := os.Stat(metaPath); err == nil {
-				freedBytes += info.Size()
-				_ = os.Remove(metaPath)
+			if tierOf(fe.path) == TierOrig {
+				evictedOrig = append(evictedOrig, filepath.Base(fe.path))
 			}
 		}
 	}
+	// Also remove the metadata of evicted originals
+	_ = evictMeta(root, evictedOrig)
 
 	if removedCount > 0 {
 		logger.Info("Janitor purged %d files by size limit (freed %d bytes, current size: %d bytes)",
@@ -217,5 +226,24 @@ func isCacheFile(p string) bool {
 	return strings.Contains(p, sep+"orig"+sep) ||
 		strings.Contains(p, sep+"resized"+sep) ||
 		strings.Contains(p, sep+"fallback"+sep) ||
-		strings.Contains(p, sep+"resolved"+sep)
+		strings.Contains(p, sep+"resolved"+sep) ||
+		strings.Contains(p, sep+"candidates"+sep) ||
+		isHistoryFile(p)
+}
+
+// tierOf returns the cache tier a janitor-managed file belongs to, as
+// reported in cache operation metrics.
+func tierOf(p string) string {
+	sep := string(filepath.Separator)
+	for _, tier := range []string{TierOrig, TierResized, TierFallback, TierResolved, TierCandidates, TierHistory} {
+		if strings.Contains(p, sep+tier+sep) {
+			return tier
+		}
+	}
+	return "other"
+}
+
+func isHistoryFile(p string) bool {
+	sep := string(filepath.Separator)
+	return strings.Contains(p, sep+"history"+sep)
 }
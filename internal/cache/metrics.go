@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"faviconsvc/pkg/metrics"
+)
+
+// Cache tiers that appear only in operation metrics; the others are shared
+// with PurgeEntry.Tier.
+const (
+	TierHistory  = "history"
+	TierFallback = "fallback"
+)
+
+// Cache operations reported to metrics.ObserveCacheOp.
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opTouch = "touch"
+	opEvict = "evict"
+)
+
+// observe reports a cache operation on tier that began at start. A file
+// that does not exist is a miss, not an error.
+func observe(tier, op string, start time.Time, err error) {
+	result := metrics.CacheOK
+	switch {
+	case err == nil && op == opRead:
+		result = metrics.CacheHit
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		result = metrics.CacheMiss
+	default:
+		result = metrics.CacheError
+	}
+	metrics.Get().ObserveCacheOp(tier, op, result, time.Since(start))
+}
+
+// noExpiry is the ttl of readEntry for entries kept until evicted.
+const noExpiry time.Duration = -1
+
+// readEntry reads the cache file p of tier, treating it as absent once it
+// is older than ttl. It returns the file's contents and modification time.
+func readEntry(tier, p string, ttl time.Duration) ([]byte, time.Time, bool) {
+	start := time.Now()
+	info, err := os.Stat(p)
+	if err == nil && ttl >= 0 && time.Since(info.ModTime()) > ttl {
+		err = fs.ErrNotExist
+	}
+	var b []byte
+	if err == nil {
+		// A file deleted between stat and read (race with janitor) is a miss
+		b, err = os.ReadFile(p)
+	}
+	observe(tier, opRead, start, err)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return b, info.ModTime(), true
+}
+
+// writeEntry atomically writes the cache file p of tier.
+func writeEntry(tier, p string, data []byte) error {
+	start := time.Now()
+	err := atomicWriteFile(p, data)
+	observe(tier, opWrite, start, err)
+	return err
+}
+
+// touchEntry refreshes the modification time of the cache file p of tier.
+func touchEntry(tier, p string) error {
+	start := time.Now()
+	now := time.Now()
+	err := os.Chtimes(p, now, now)
+	observe(tier, opTouch, start, err)
+	return err
+}
+
+// evictEntry removes the cache file p on behalf of the janitor.
+func evictEntry(p string) error {
+	start := time.Now()
+	err := os.Remove(p)
+	observe(tierOf(p), opEvict, start, err)
+	return err
+}
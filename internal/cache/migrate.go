@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the cache layout this build reads and writes. Every
+// change to where or how entries are stored bumps it and adds a Migration
+// from the previous version, so existing caches are upgraded in place
+// rather than wiped.
+const SchemaVersion = 3
+
+// schemaFile holds the layout version of a cache directory. It is not a
+// cache file, so the janitor leaves it alone.
+const schemaFile = "SCHEMA"
+
+// ErrNewerSchema is returned by Migrate for cache directories written by a
+// newer build, whose layout this one does not know.
+var ErrNewerSchema = errors.New("cache: directory has a newer schema")
+
+// Migration upgrades a cache directory from schema From to From+1. Run
+// reports its progress through progress, which it may call as often as it
+// likes, and must be safe to run again after an interruption: a step is
+// only recorded as done once Run returns.
+type Migration struct {
+	From int
+	Name string
+	Run  func(m *Manager, progress func(done, total int)) error
+}
+
+// migrations lists every step, in order.
+var migrations = []Migration{
+	{From: 1, Name: "shard entries into subdirectories", Run: shardEntries},
+	{From: 2, Name: "move metadata into the index", Run: indexMeta},
+}
+
+// indexBatch is how many metadata files indexMeta moves per transaction.
+const indexBatch = 1000
+
+// shardedDirs returns the tier directories whose entries are sharded by
+// shardPath.
+func (m *Manager) shardedDirs() []string {
+	return []string{m.OrigCacheDir(), m.ResizedCacheDir(), m.ResolvedCacheDir(), m.CandidatesCacheDir()}
+}
+
+// Schema returns the layout version of the cache directory. Directories
+// without a version that hold unsharded entries predate versioning and are
+// version 1, those with .meta files in the shards of orig are version 2;
+// others are taken to be current.
+func (m *Manager) Schema() (int, error) {
+	data, err := os.ReadFile(filepath.Join(m.CacheDir, schemaFile))
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || v < 1 {
+			return 0, fmt.Errorf("cache: invalid %s file %q", schemaFile, strings.TrimSpace(string(data)))
+		}
+		return v, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, dir := range m.shardedDirs() {
+		des, _ := os.ReadDir(dir)
+		for _, de := range des {
+			if de.Type().IsRegular() {
+				return 1, nil
+			}
+		}
+	}
+	if len(sidecarMeta(m, 1)) > 0 {
+		return 2, nil
+	}
+	return SchemaVersion, nil
+}
+
+// PendingMigrations returns the steps Migrate would run, in order.
+func (m *Manager) PendingMigrations() ([]Migration, error) {
+	v, err := m.Schema()
+	if err != nil {
+		return nil, err
+	}
+	if v > SchemaVersion {
+		return nil, fmt.Errorf("%w %d, this build reads %d", ErrNewerSchema, v, SchemaVersion)
+	}
+	var pending []Migration
+	for _, mig := range migrations {
+		if mig.From >= v {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate upgrades the cache directory to SchemaVersion, running each
+// pending step in order and recording the version reached after each, so
+// an interrupted upgrade resumes where it stopped. logf, if not nil, gets
+// a line when each step starts and ends and about every tenth of its
+// entries. It returns the steps run.
+//
+// Migrations move files a running server may be reading, so they are run
+// at startup before serving, or offline with `favicon migrate`.
+func (m *Manager) Migrate(logf func(format string, args ...any)) ([]Migration, error) {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	pending, err := m.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for i, mig := range pending {
+		start := time.Now()
+		logf("Cache migration %d/%d: %s (schema %d to %d)", i+1, len(pending), mig.Name, mig.From, mig.From+1)
+		step := -1
+		err := mig.Run(m, func(done, total int) {
+			if total > 0 && done*10/total != step {
+				step = done * 10 / total
+				logf("Cache migration %d/%d: %d/%d entries (%d%%)", i+1, len(pending), done, total, done*100/total)
+			}
+		})
+		if err != nil {
+			return pending[:i], fmt.Errorf("cache migration %q: %w", mig.Name, err)
+		}
+		if err := m.writeSchema(mig.From + 1); err != nil {
+			return pending[:i], err
+		}
+		logf("Cache migration %d/%d done in %s", i+1, len(pending), time.Since(start).Round(time.Millisecond))
+	}
+	if len(pending) == 0 {
+		if _, err := os.Stat(filepath.Join(m.CacheDir, schemaFile)); os.IsNotExist(err) {
+			return nil, m.writeSchema(SchemaVersion)
+		}
+	}
+	return pending, nil
+}
+
+func (m *Manager) writeSchema(v int) error {
+	return atomicWriteFile(filepath.Join(m.CacheDir, schemaFile), []byte(strconv.Itoa(v)+"\n"))
+}
+
+// isShard reports whether name is a shard directory of shardPath.
+func isShard(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// shardEntries moves the entries of schema 1, stored directly in their
+// tier directory, into the shards of shardPath. The shared variants under
+// resized/shared stay where they are; links to them are renamed, so they
+// keep sharing the file. Leftover temp files are removed.
+func shardEntries(m *Manager, progress func(done, total int)) error {
+	type move struct{ dir, name string }
+	var moves []move
+	for _, dir := range m.shardedDirs() {
+		des, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, de := range des {
+			if de.Type().IsRegular() {
+				moves = append(moves, move{dir, de.Name()})
+			}
+		}
+	}
+	for i, mv := range moves {
+		src := filepath.Join(mv.dir, mv.name)
+		if strings.HasPrefix(mv.name, ".tmp-") || len(mv.name) < 2 {
+			_ = os.Remove(src)
+		} else {
+			dst := shardPath(mv.dir, mv.name)
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		progress(i+1, len(moves))
+	}
+	return nil
+}
+
+// sidecarMeta returns the paths of up to limit (0 = all) .meta files of
+// schema 2 in the shards of orig.
+func sidecarMeta(m *Manager, limit int) []string {
+	var paths []string
+	shards, _ := os.ReadDir(m.OrigCacheDir())
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShard(shard.Name()) {
+			continue
+		}
+		dir := filepath.Join(m.OrigCacheDir(), shard.Name())
+		des, _ := os.ReadDir(dir)
+		for _, de := range des {
+			if de.Type().IsRegular() && strings.HasSuffix(de.Name(), ".meta") && !strings.HasPrefix(de.Name(), ".tmp-") {
+				paths = append(paths, filepath.Join(dir, de.Name()))
+				if len(paths) == limit {
+					return paths
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// indexMeta moves the metadata of schema 2, a .meta file next to each
+// original, into the index, indexBatch files per transaction. The files of
+// a batch are removed once it is committed, so a rerun after an
+// interruption moves only the rest. Records keep the modification time of
+// their file; unreadable files are dropped, as reads ignored them.
+func indexMeta(m *Manager, progress func(done, total int)) error {
+	paths := sidecarMeta(m, 0)
+	if len(paths) == 0 {
+		return nil
+	}
+	for start := 0; start < len(paths); start += indexBatch {
+		batch := paths[start:min(start+indexBatch, len(paths))]
+		err := updateIndex(m.CacheDir, func(b *bolt.Bucket) error {
+			for _, p := range batch {
+				info, err := os.Stat(p)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				data, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				var meta OrigMeta
+				if json.Unmarshal(data, &meta) != nil {
+					continue
+				}
+				data, _ = json.Marshal(meta)
+				key := strings.TrimSuffix(filepath.Base(p), ".meta")
+				if err := b.Put([]byte(key), encodeRecord(info.ModTime(), data)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		progress(start+len(batch), len(paths))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// NegativeEntry records that no usable icon was found for a page, so the
+// lookup is not repeated before Until. It is stored among the resolved
+// mappings; Purge reports it as TierNegative, and Inspect lists it as one
+// without an icon.
+type NegativeEntry struct {
+	PageURL string    `json:"page_url"`
+	Status  string    `json:"status"` // why the lookup failed, e.g. "not-found"
+	Until   time.Time `json:"until"`
+}
+
+func (m *Manager) negativePath(pageURL string) string {
+	return shardPath(m.ResolvedCacheDir(), hash("negative|"+pageURL)+".json")
+}
+
+// ReadNegative returns the failed lookup recorded for a page URL, if there
+// is one that has not expired.
+func (m *Manager) ReadNegative(pageURL string) (NegativeEntry, bool) {
+	data, _, ok := readEntry(TierResolved, m.negativePath(pageURL), noExpiry)
+	if !ok {
+		return NegativeEntry{}, false
+	}
+	var entry NegativeEntry
+	if json.Unmarshal(data, &entry) != nil || entry.PageURL != pageURL || time.Now().After(entry.Until) {
+		return NegativeEntry{}, false
+	}
+	return entry, true
+}
+
+// WriteNegative records a failed lookup for a page URL for ttl. A ttl of
+// zero or less records nothing.
+func (m *Manager) WriteNegative(pageURL, status string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	data, _ := json.MarshalIndent(NegativeEntry{PageURL: pageURL, Status: status, Until: time.Now().Add(ttl)}, "", "  ")
+	return writeEntry(TierResolved, m.negativePath(pageURL), data)
+}
@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache tiers reported in PurgeEntry.Tier.
+const (
+	TierOrig       = "orig"
+	TierResized    = "resized"
+	TierResolved   = "resolved"
+	TierCandidates = "candidates"
+	TierNegative   = "negative" // failed lookups, kept among the resolved mappings
+	TierMeta       = "meta"     // records of the metadata index
+)
+
+// ErrBadHostPattern is returned by Purge for malformed host globs.
+var ErrBadHostPattern = errors.New("cache: invalid host pattern")
+
+// PurgeOptions selects what Purge removes.
+type PurgeOptions struct {
+	// HostPattern is a glob matched against lowercased host names, e.g.
+	// "*.example.com" (subdomains only) or "example.*". "*" matches across dots.
+	HostPattern string
+	// DryRun lists matching entries without deleting them.
+	DryRun bool
+	// Sizes and Formats enumerate the resized variants to look for per icon,
+	// unless AllVariants is set.
+	Sizes   []int
+	Formats []string
+	// AllVariants finds every resized variant of a matching icon, whatever
+	// its size, format or processing, by scanning the resized directory.
+	AllVariants bool
+}
+
+// PurgeEntry is one cache file, or metadata index record, matched by Purge.
+type PurgeEntry struct {
+	Tier string `json:"tier"`
+	Key  string `json:"key"` // URL the entry is keyed by
+	// Path is relative to the cache directory; for TierMeta it is the
+	// index file holding the record
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ValidHostPattern reports whether p is a usable Purge host glob.
+func ValidHostPattern(p string) bool {
+	if p == "" || strings.ContainsAny(p, "/\\") {
+		return false
+	}
+	_, err := path.Match(p, "")
+	return err == nil
+}
+
+// Purge removes the cache entries of every host matching opts.HostPattern:
+// resolved mappings, failed lookups and candidate lists of matching pages,
+// and the original
+// and resized copies of both icons hosted there and icons those pages
+// resolved to (which may live on another host, such as a CDN). The
+// content-addressed icon history is kept.
+//
+// Entries are returned sorted by tier and path. With DryRun nothing is
+// deleted. Icons are found through the metadata index, so Purge fails with
+// ErrIndexInUse if another process keeps it busy.
+func (m *Manager) Purge(opts PurgeOptions) ([]PurgeEntry, error) {
+	pattern := strings.ToLower(strings.TrimSpace(opts.HostPattern))
+	if !ValidHostPattern(pattern) {
+		return nil, ErrBadHostPattern
+	}
+	match := func(rawURL string) bool {
+		// Non-default rankings key resolved entries as "<url> rank=<name>"
+		rawURL, _, _ = strings.Cut(rawURL, " ")
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		ok, _ := path.Match(pattern, strings.ToLower(u.Hostname()))
+		return ok
+	}
+
+	var entries []PurgeEntry
+	add := func(tier, key, p string) {
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		rel, _ := filepath.Rel(m.CacheDir, p)
+		entries = append(entries, PurgeEntry{Tier: tier, Key: key, Path: filepath.ToSlash(rel), Bytes: info.Size()})
+	}
+
+	icons := make(map[string]bool)
+	scanJSON(m.ResolvedCacheDir(), ".json", func(p string, data []byte) {
+		var r ResolvedIcon
+		if json.Unmarshal(data, &r) != nil || !match(r.PageURL) {
+			return
+		}
+		var neg NegativeEntry
+		if r.IconURL == "" && json.Unmarshal(data, &neg) == nil && neg.Status != "" {
+			add(TierNegative, r.PageURL, p)
+			return
+		}
+		add(TierResolved, r.PageURL, p)
+		icons[r.IconURL] = true
+	})
+	scanJSON(m.CandidatesCacheDir(), ".json", func(p string, data []byte) {
+		var c candidatesEntry
+		if json.Unmarshal(data, &c) == nil && match(c.PageURL) {
+			add(TierCandidates, c.PageURL, p)
+		}
+	})
+	err := scanIndex(m.CacheDir, func(_ string, _ time.Time, data []byte) {
+		var meta OrigMeta
+		if json.Unmarshal(data, &meta) == nil && match(meta.URL) {
+			icons[meta.URL] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make(map[string]string)
+	for iconURL := range icons {
+		if iconURL == "" {
+			continue
+		}
+		orig := m.origPath(iconURL)
+		add(TierOrig, iconURL, orig)
+		if _, size, err := m.lookupMeta(origKey(iconURL)); err == nil {
+			entries = append(entries, PurgeEntry{Tier: TierMeta, Key: iconURL, Path: indexFile, Bytes: int64(size)})
+		}
+		if opts.AllVariants {
+			prefixes[resizedPrefix(iconURL)] = iconURL
+			continue
+		}
+		for _, format := range opts.Formats {
+			for _, size := range opts.Sizes {
+				add(TierResized, iconURL, m.ResizedCachePath(iconURL, size, format))
+			}
+		}
+	}
+	// An icon's variants share its prefix, and so its shard
+	shards := make(map[string]bool)
+	for prefix := range prefixes {
+		shards[prefix[:2]] = true
+	}
+	for shard := range shards {
+		dir := filepath.Join(m.ResizedCacheDir(), shard)
+		des, _ := os.ReadDir(dir)
+		for _, de := range des {
+			if i := strings.IndexByte(de.Name(), '-'); i > 0 {
+				if iconURL, ok := prefixes[de.Name()[:i+1]]; ok {
+					add(TierResized, iconURL, filepath.Join(dir, de.Name()))
+				}
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tier != entries[j].Tier {
+			return entries[i].Tier < entries[j].Tier
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	if opts.DryRun {
+		return entries, nil
+	}
+
+	var firstErr error
+	var metaKeys []string
+	for _, e := range entries {
+		if e.Tier == TierMeta {
+			metaKeys = append(metaKeys, origKey(e.Key))
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.CacheDir, filepath.FromSlash(e.Path))); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := deleteMeta(m.CacheDir, metaKeys); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return entries, firstErr
+}
+
+// scanJSON calls fn with the contents of every regular file in the shards
+// of dir whose name ends in suffix.
+func scanJSON(dir, suffix string, fn func(p string, data []byte)) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		if de.IsDir() && isShard(de.Name()) {
+			scanJSON(filepath.Join(dir, de.Name()), suffix, fn)
+			continue
+		}
+		if !de.Type().IsRegular() || !strings.HasSuffix(de.Name(), suffix) || strings.HasPrefix(de.Name(), ".tmp-") {
+			continue
+		}
+		p := filepath.Join(dir, de.Name())
+		if data, err := os.ReadFile(p); err == nil {
+			fn(p, data)
+		}
+	}
+}
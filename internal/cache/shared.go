@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SharedResizedCacheDir returns the directory holding resized variants
+// shared by several icons (see WriteResizedShared).
+func (m *Manager) SharedResizedCacheDir() string {
+	return filepath.Join(m.ResizedCacheDir(), "shared")
+}
+
+// sharedResizedPath returns where the variant of icons with shareKey at
+// size and format is stored once.
+func (m *Manager) sharedResizedPath(shareKey string, size int, format string) string {
+	key := hash("shared|" + shareKey + "|" + strconv.Itoa(size) + "|" + format)
+	return filepath.Join(m.SharedResizedCacheDir(), key[:32]+"."+format)
+}
+
+// WriteResizedShared writes a resized variant as WriteResizedToCache does,
+// but stores its bytes once per shareKey: the variants at one size and
+// format of every icon with shareKey are hard links to a single file, so
+// icons served by many hosts take the space of one. If that file exists
+// and has not expired, b is dropped and the icon's variant links to it,
+// expiring with it, so shareKey must identify b exactly, e.g. by its
+// digest.
+//
+// Without a key, or where hard links are unsupported, the variant is
+// written on its own.
+func (m *Manager) WriteResizedShared(iconURL string, size int, format, shareKey string, b []byte) error {
+	if shareKey == "" {
+		return m.WriteResizedToCache(iconURL, size, format, b)
+	}
+	shared := m.sharedResizedPath(shareKey, size, format)
+	info, err := os.Stat(shared)
+	if err != nil || (m.TTL >= 0 && time.Since(info.ModTime()) > m.TTL) {
+		if err := os.MkdirAll(filepath.Dir(shared), 0o755); err != nil {
+			return m.WriteResizedToCache(iconURL, size, format, b)
+		}
+		if err := writeEntry(TierResized, shared, b); err != nil {
+			return m.WriteResizedToCache(iconURL, size, format, b)
+		}
+		if info, err = os.Stat(shared); err != nil {
+			return m.WriteResizedToCache(iconURL, size, format, b)
+		}
+	}
+	p := m.ResizedCachePath(iconURL, size, format)
+	if cur, err := os.Stat(p); err == nil && os.SameFile(cur, info) {
+		// Already linked; renaming a link over itself would be a no-op
+		return nil
+	}
+	start := time.Now()
+	err = atomicLink(shared, p)
+	observe(TierResized, opWrite, start, err)
+	if err != nil {
+		return m.WriteResizedToCache(iconURL, size, format, b)
+	}
+	return nil
+}
+
+// atomicLink makes p a hard link to target, replacing any file at p in a
+// single rename as atomicWriteFile does.
+func atomicLink(target, p string) error {
+	tmp, err := createTemp(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	_ = tmp.Close()
+	_ = os.Remove(tmpName)
+	if err := os.Link(target, tmpName); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, p); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TierUsage is what one cache tier holds on disk.
+type TierUsage struct {
+	Entries int       `json:"entries"`
+	Bytes   int64     `json:"bytes"`
+	Oldest  time.Time `json:"oldest"`
+	Newest  time.Time `json:"newest"`
+}
+
+// Usage reports the files of every cache tier under the cache directory,
+// keyed by tier name as in tierOf ("orig", "resized", "fallback",
+// "resolved", "candidates" and "history"), and the records of the metadata
+// index as "meta", which is left out while another process keeps the
+// index busy. Leftover temp files from interrupted writes are not counted.
+func (m *Manager) Usage() (map[string]TierUsage, error) {
+	usage := make(map[string]TierUsage)
+	err := filepath.WalkDir(m.CacheDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if p == m.CacheDir {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() || !isCacheFile(p) || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		tier := tierOf(p)
+		usage[tier] = usage[tier].add(info.Size(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return usage, err
+	}
+	err = scanIndex(m.CacheDir, func(_ string, written time.Time, data []byte) {
+		usage[TierMeta] = usage[TierMeta].add(int64(len(data)), written)
+	})
+	if errors.Is(err, ErrIndexInUse) {
+		err = nil
+	}
+	return usage, err
+}
+
+// add counts an entry of size bytes last written at mt.
+func (u TierUsage) add(size int64, mt time.Time) TierUsage {
+	u.Entries++
+	u.Bytes += size
+	if u.Oldest.IsZero() || mt.Before(u.Oldest) {
+		u.Oldest = mt
+	}
+	if mt.After(u.Newest) {
+		u.Newest = mt
+	}
+	return u
+}
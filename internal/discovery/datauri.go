@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/url"
+	"strings"
+
+	"faviconsvc/internal/fetch"
+)
+
+// IsDataURI reports whether s is an RFC 2397 data: URI.
+func IsDataURI(s string) bool {
+	return len(s) >= 5 && strings.EqualFold(s[:5], "data:")
+}
+
+// DecodeDataURI decodes the inline payload of a data: URI.
+// It returns the payload and its declared media type (text/plain when absent).
+// Payloads larger than fetch.MaxFetchBytes are rejected.
+func DecodeDataURI(s string) ([]byte, string, error) {
+	if !IsDataURI(s) {
+		return nil, "", errors.New("not a data uri")
+	}
+	comma := strings.IndexByte(s, ',')
+	if comma < 0 {
+		return nil, "", errors.New("data uri: missing comma")
+	}
+	header, payload := s[5:comma], s[comma+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		isBase64 = true
+		header = header[:len(header)-len(";base64")]
+	}
+	contentType := strings.TrimSpace(header)
+	if contentType == "" || strings.HasPrefix(contentType, ";") {
+		contentType = "text/plain" + contentType
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return nil, "", err
+	}
+
+	var data []byte
+	if isBase64 {
+		// Inline base64 in HTML attributes is often wrapped or percent-encoded
+		clean, err := url.PathUnescape(payload)
+		if err != nil {
+			clean = payload
+		}
+		clean = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\n', '\r':
+				return -1
+			}
+			return r
+		}, clean)
+		if base64.StdEncoding.DecodedLen(len(clean)) > fetch.MaxFetchBytes {
+			return nil, "", errors.New("data uri: payload too large")
+		}
+		data, err = base64.StdEncoding.DecodeString(clean)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "="))
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	} else {
+		unescaped, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, "", err
+		}
+		data = []byte(unescaped)
+	}
+
+	if len(data) > fetch.MaxFetchBytes {
+		return nil, "", errors.New("data uri: payload too large")
+	}
+	return data, contentType, nil
+}
+
+// dataURIMediaType returns the declared media type of a data: URI without decoding it.
+func dataURIMediaType(s string) string {
+	comma := strings.IndexByte(s, ',')
+	if comma < 0 {
+		return ""
+	}
+	header := strings.ToLower(s[5:comma])
+	header = strings.TrimSuffix(header, ";base64")
+	ct, _, _ := mime.ParseMediaType(header)
+	return ct
+}
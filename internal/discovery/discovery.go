@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -12,12 +13,35 @@ import (
 	"strings"
 
 	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/reqctx"
 	"faviconsvc/internal/security"
 	"faviconsvc/pkg/logger"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/publicsuffix"
 )
 
+// Candidate sources recorded in IconCandidate.Source.
+const (
+	SourceLink      = "link"      // <link> tag in the page HTML
+	SourceDataURI   = "data-uri"  // inline data: URI in a <link> tag
+	SourceRedirect  = "redirect"  // <link> tag on a meta refresh or canonical target
+	SourceAlternate = "alternate" // <link> tag on the AMP or mobile alternate page
+	SourceRendered  = "rendered"  // <link> tag in the headless-rendered DOM
+	SourceRoot      = "root"      // /favicon.ico probe at the domain root
+	SourceHint      = "hint"      // known-good URL from IconHints
+)
+
+// AlternatePages, when set, searches the page's AMP and mobile alternates
+// (<link rel="amphtml">, <link rel="alternate" media=...>) for icon links
+// when the page itself, and any page it redirects to, declares none.
+var AlternatePages bool
+
+// HTTPSOnly, when set, drops the plaintext http:// root favicon.ico probe
+// for every page, not just for HTTPS pages whose host sends HSTS.
+var HTTPSOnly bool
+
 type IconCandidate struct {
 	URL        string
 	Type       string
@@ -25,54 +49,87 @@ type IconCandidate struct {
 	SizeScore  int
 	FormatRank int
 	RelRank    int
+	Source     string
+}
+
+// Rel names the kind of link a candidate came from: icon,
+// apple-touch-icon, or root for the /favicon.ico probe.
+func (c IconCandidate) Rel() string {
+	switch {
+	case c.Source == SourceRoot:
+		return "root"
+	case c.RelRank == 2:
+		return "apple-touch-icon"
+	}
+	return "icon"
+}
+
+// Format names the image format a candidate declares through its type
+// attribute, or else its URL's extension, e.g. png, svg or ico ("" =
+// unknown). The file may turn out to be something else once fetched.
+func (c IconCandidate) Format() string {
+	ct, _, _ := mime.ParseMediaType(c.Type)
+	switch ct {
+	case "image/svg+xml":
+		return "svg"
+	case "image/x-icon", "image/vnd.microsoft.icon":
+		return "ico"
+	}
+	if sub, ok := strings.CutPrefix(ct, "image/"); ok {
+		return sub
+	}
+	if IsDataURI(c.URL) {
+		return ""
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	switch ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), ".")); ext {
+	case "jpg":
+		return "jpeg"
+	case "svgz":
+		return "svg"
+	default:
+		return ext
+	}
 }
 
 func DiscoverFromPageThenRoot(ctx context.Context, pageURL *url.URL, targetSize int) []IconCandidate {
-	cands := collectPageIcons(ctx, pageURL, targetSize)
+	cands, hsts := collectPageIcons(ctx, pageURL, targetSize)
 
 	// If no icons found from page, try root of current domain
 	if len(cands) == 0 && pageURL.Path != "/" && pageURL.Path != "" {
 		rootURL := &url.URL{Scheme: pageURL.Scheme, Host: pageURL.Host, Path: "/"}
-		cands = collectPageIcons(ctx, rootURL, targetSize)
+		var rootHSTS bool
+		cands, rootHSTS = collectPageIcons(ctx, rootURL, targetSize)
+		hsts = hsts || rootHSTS
 	}
 
-	// Add fallback root paths for current domain
-	rootHTTPS := "https://" + pageURL.Host + "/favicon.ico"
-	rootHTTP := "http://" + pageURL.Host + "/favicon.ico"
-
-	if pageURL.Scheme == "https" {
-		cands = append(cands, IconCandidate{URL: rootHTTPS, RelRank: 3})
-		cands = append(cands, IconCandidate{URL: rootHTTP, RelRank: 3})
-	} else {
-		cands = append(cands, IconCandidate{URL: rootHTTP, RelRank: 3})
-		cands = append(cands, IconCandidate{URL: rootHTTPS, RelRank: 3})
+	// Static HTML had no icon links; the page may inject them with JavaScript
+	if len(cands) == 0 && PageRenderer != nil {
+		cands = collectRenderedIcons(ctx, pageURL, targetSize)
 	}
 
-	// Fallback to parent domain (e.g., app.docker.com -> docker.com)
-	parentHost := getParentDomain(pageURL.Host)
-	if parentHost != "" && parentHost != pageURL.Host {
-		parentURL := &url.URL{Scheme: pageURL.Scheme, Host: parentHost, Path: "/"}
-		parentCands := collectPageIcons(ctx, parentURL, targetSize)
-		for i := range parentCands {
-			parentCands[i].RelRank += 10 // Lower priority than current domain
-		}
-		cands = append(cands, parentCands...)
-
-		// Add parent domain favicon.ico
-		cands = append(cands, IconCandidate{URL: "https://" + parentHost + "/favicon.ico", RelRank: 13})
-		cands = append(cands, IconCandidate{URL: "http://" + parentHost + "/favicon.ico", RelRank: 13})
+	// Add fallback root paths for current domain. An HTTPS page whose host
+	// sends HSTS will never serve anything over plain HTTP, so the
+	// cross-scheme probe would only leak a plaintext request
+	rootHTTPS := rootIconURL("https", pageURL)
+	rootHTTP := rootIconURL("http", pageURL)
+
+	if HTTPSOnly || (pageURL.Scheme == "https" && hsts) {
+		reqctx.Debugf(ctx, "Skipping http:// root probe for %s (https-only=%v, hsts=%v)", pageURL.Host, HTTPSOnly, hsts)
+		cands = append(cands, IconCandidate{URL: rootHTTPS, RelRank: 3, Source: SourceRoot})
+	} else if pageURL.Scheme == "https" {
+		cands = append(cands, IconCandidate{URL: rootHTTPS, RelRank: 3, Source: SourceRoot})
+		cands = append(cands, IconCandidate{URL: rootHTTP, RelRank: 3, Source: SourceRoot})
+	} else {
+		cands = append(cands, IconCandidate{URL: rootHTTP, RelRank: 3, Source: SourceRoot})
+		cands = append(cands, IconCandidate{URL: rootHTTPS, RelRank: 3, Source: SourceRoot})
 	}
 
 	// Sort by priority
-	sort.SliceStable(cands, func(i, j int) bool {
-		if cands[i].RelRank != cands[j].RelRank {
-			return cands[i].RelRank < cands[j].RelRank
-		}
-		if cands[i].FormatRank != cands[j].FormatRank {
-			return cands[i].FormatRank < cands[j].FormatRank
-		}
-		return cands[i].SizeScore < cands[j].SizeScore
-	})
+	sortCandidates(cands)
 
 	// Deduplicate
 	uniq := make(map[string]struct{})
@@ -87,38 +144,144 @@ func DiscoverFromPageThenRoot(ctx context.Context, pageURL *url.URL, targetSize
 		out = append(out, c)
 	}
 
-	logger.Debug("Discovered %d icon candidates for %s", len(out), pageURL.String())
+	reqctx.Debugf(ctx, "Discovered %d icon candidates for %s", len(out), pageURL.String())
 	return out
 }
 
-func collectPageIcons(ctx context.Context, pageURL *url.URL, targetSize int) []IconCandidate {
+// RootIconURL returns the /favicon.ico candidate DiscoverFromPageThenRoot
+// lists first for pageURL's host, in canonical form: over the page's own
+// scheme, or always HTTPS with HTTPSOnly.
+func RootIconURL(pageURL *url.URL) string {
+	scheme := "https"
+	if pageURL.Scheme == "http" && !HTTPSOnly {
+		scheme = "http"
+	}
+	return CanonicalizeURLString(rootIconURL(scheme, pageURL))
+}
+
+func rootIconURL(scheme string, pageURL *url.URL) string {
+	return scheme + "://" + pageURL.Host + "/favicon.ico"
+}
+
+// RankCandidates rescores a previously discovered candidate list for a new
+// target size and re-sorts it in place, so one discovery can serve every size.
+func RankCandidates(cands []IconCandidate, targetSize int) {
+	for i := range cands {
+		// "any" is stored as no sizes, which scores the same
+		cands[i].SizeScore = computeSizeScore(cands[i].Sizes, false, targetSize)
+	}
+	sortCandidates(cands)
+}
+
+func sortCandidates(cands []IconCandidate) {
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].RelRank != cands[j].RelRank {
+			return cands[i].RelRank < cands[j].RelRank
+		}
+		if cands[i].FormatRank != cands[j].FormatRank {
+			return cands[i].FormatRank < cands[j].FormatRank
+		}
+		return cands[i].SizeScore < cands[j].SizeScore
+	})
+}
+
+// collectPageIcons fetches pageURL and returns the icons it declares, and
+// whether the page's host answered over HTTPS with an HSTS policy.
+func collectPageIcons(ctx context.Context, pageURL *url.URL, targetSize int) ([]IconCandidate, bool) {
+	return collectPageIconsFollow(ctx, pageURL, targetSize, true)
+}
+
+// collectPageIconsFollow is collectPageIcons with control over whether a
+// meta-refresh or canonical link may be followed when the page has no icons.
+func collectPageIconsFollow(ctx context.Context, pageURL *url.URL, targetSize int, follow bool) ([]IconCandidate, bool) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
 	if err != nil {
 		logger.Warn("Failed to create request for %s: %v", pageURL.String(), err)
-		return nil
+		return nil, false
 	}
 	req.Header.Set("User-Agent", fetch.UABrowser)
 	req.Header.Set("Accept", "text/html,*/*;q=0.8")
 
-	resp, err := fetch.HTTPClient.Do(req)
+	resp, err := fetch.Do(fetch.PageHTTPClient(), req)
 	if err != nil {
 		logger.Warn("Failed to fetch HTML for %s: %v", pageURL.String(), err)
-		return nil
+		return nil, false
 	}
 	defer resp.Body.Close()
 
+	hsts := sendsHSTS(resp, pageURL.Host)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		logger.Warn("Got status %d for HTML fetch of %s", resp.StatusCode, pageURL.String())
-		return nil
+		return nil, hsts
 	}
 
-	lr := io.LimitReader(resp.Body, fetch.MaxHTMLBytes)
-	root, err := html.Parse(lr)
+	// Decode to UTF-8 first (Content-Type charset, BOM or <meta charset>) so
+	// non-ASCII hrefs in GBK, Shift-JIS etc. pages resolve to the right paths
+	var body io.Reader = io.LimitReader(resp.Body, fetch.MaxHTMLBytes)
+	if utf8Body, err := charset.NewReader(body, resp.Header.Get("Content-Type")); err == nil {
+		body = utf8Body
+	} else {
+		reqctx.Debugf(ctx, "Charset detection failed for %s: %v", pageURL.String(), err)
+	}
+	root, err := html.Parse(body)
 	if err != nil {
 		logger.Warn("Failed to parse HTML for %s: %v", pageURL.String(), err)
-		return nil
+		return nil, hsts
+	}
+
+	cands := iconsFromDocument(root, pageURL, targetSize)
+	if len(cands) == 0 && follow {
+		// Splash pages and bare domains often point elsewhere for the real site
+		if target := findPageRedirect(ctx, root, pageURL); target != nil {
+			reqctx.Debugf(ctx, "No icons on %s, following redirect to %s", pageURL.String(), target.String())
+			// The target may be another host, so its HSTS says nothing about this one
+			cands, _ = collectPageIconsFollow(ctx, target, targetSize, false)
+			for i := range cands {
+				if cands[i].Source == SourceLink {
+					cands[i].Source = SourceRedirect
+				}
+			}
+		}
+	}
+	if len(cands) == 0 && follow && AlternatePages {
+		// Interstitial main pages sometimes keep icon metadata only on the
+		// AMP or mobile variant
+		for _, alt := range findAlternatePages(ctx, root, pageURL) {
+			reqctx.Debugf(ctx, "No icons on %s, trying alternate %s", pageURL.String(), alt.String())
+			cands, _ = collectPageIconsFollow(ctx, alt, targetSize, false)
+			for i := range cands {
+				if cands[i].Source == SourceLink {
+					cands[i].Source = SourceAlternate
+				}
+			}
+			if len(cands) > 0 {
+				break
+			}
+		}
+	}
+	return cands, hsts
+}
+
+// sendsHSTS reports whether resp is an HTTPS response from host carrying a
+// Strict-Transport-Security policy that has not been revoked (max-age=0).
+// Redirects to a different host do not count.
+func sendsHSTS(resp *http.Response, host string) bool {
+	if resp.Request == nil || resp.Request.URL.Scheme != "https" || !strings.EqualFold(resp.Request.URL.Host, host) {
+		return false
+	}
+	for _, directive := range strings.Split(resp.Header.Get("Strict-Transport-Security"), ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			n, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			return err == nil && n > 0
+		}
 	}
+	return false
+}
 
+// iconsFromDocument extracts icon candidates from the <link> tags of a parsed
+// HTML document, resolving hrefs against pageURL (or its <base href>).
+func iconsFromDocument(root *html.Node, pageURL *url.URL, targetSize int) []IconCandidate {
 	var baseHref *url.URL
 	baseURL := pageURL
 	var out []IconCandidate
@@ -169,7 +332,30 @@ func collectPageIcons(ctx context.Context, pageURL *url.URL, targetSize int) []I
 					isApple = true
 				}
 
-				if hasIcon || isApple {
+				if (hasIcon || isApple) && IsDataURI(href) {
+					// Inline icon: no fetch needed, decoded later by the handler
+					mt := dataURIMediaType(href)
+					if !strings.HasPrefix(mt, "image/") || len(href) > fetch.MaxHTMLBytes {
+						goto NEXT
+					}
+					edgeSizes, any := parseSizes(sizesAttr)
+					relRank := 1
+					if isApple && !hasIcon {
+						relRank = 2
+					}
+					if typ == "" {
+						typ = mt
+					}
+					out = append(out, IconCandidate{
+						URL:        href,
+						Type:       typ,
+						Sizes:      edgeSizes,
+						SizeScore:  computeSizeScore(edgeSizes, any, targetSize),
+						FormatRank: formatPreference(typ, ""),
+						RelRank:    relRank,
+						Source:     SourceDataURI,
+					})
+				} else if hasIcon || isApple {
 					base := baseURL
 					if baseHref != nil {
 						base = baseHref
@@ -194,6 +380,7 @@ func collectPageIcons(ctx context.Context, pageURL *url.URL, targetSize int) []I
 							SizeScore:  score,
 							FormatRank: formatRank,
 							RelRank:    relRank,
+							Source:     SourceLink,
 						})
 					}
 				}
@@ -255,6 +442,10 @@ func formatPreference(typ, resolved string) int {
 // CanonicalizeURLString normalizes a URL string for consistent comparison.
 // It removes fragments, normalizes scheme and host, cleans paths, and sorts query parameters.
 func CanonicalizeURLString(raw string) string {
+	if IsDataURI(raw) {
+		// Inline payloads are compared byte-for-byte
+		return raw
+	}
 	u, err := url.Parse(raw)
 	if err != nil {
 		return raw
@@ -262,6 +453,9 @@ func CanonicalizeURLString(raw string) string {
 	u.Fragment = ""
 	u.Scheme = strings.ToLower(u.Scheme)
 	h := strings.ToLower(u.Hostname())
+	if ascii, err := security.ASCIIHost(h); err == nil {
+		h = ascii
+	}
 	port := u.Port()
 	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
 		port = ""
@@ -302,42 +496,23 @@ func abs(x int) int {
 	return x
 }
 
-// getParentDomain returns the parent domain (e.g., app.docker.com -> docker.com)
-// Returns empty string if no valid parent exists
-func getParentDomain(host string) string {
-	// Remove port if present
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
-	}
-
-	parts := strings.Split(host, ".")
-	
-	// Need at least 3 parts (sub.domain.tld)
-	if len(parts) < 3 {
-		return ""
+// ApexURL returns the root page of the registrable domain above
+// pageURL's host (blog.example.co.uk -> https://example.co.uk/), or nil
+// when the host is already the apex, is an IP address, or has no
+// registrable domain.
+func ApexURL(pageURL *url.URL) *url.URL {
+	host := strings.TrimSuffix(strings.ToLower(pageURL.Hostname()), ".")
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
 	}
-
-	// Handle common TLDs like .co.uk, .com.br, etc.
-	if len(parts) >= 3 {
-		lastTwo := parts[len(parts)-2] + "." + parts[len(parts)-1]
-		if isCompoundTLD(lastTwo) && len(parts) >= 4 {
-			// e.g., app.example.co.uk -> example.co.uk
-			return strings.Join(parts[1:], ".")
-		}
+	apex, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil || apex == host {
+		return nil
 	}
-
-	// Normal case: app.docker.com -> docker.com
-	return strings.Join(parts[1:], ".")
-}
-
-// isCompoundTLD checks for common compound TLDs
-func isCompoundTLD(tld string) bool {
-	compoundTLDs := map[string]bool{
-		"co.uk": true, "co.jp": true, "co.kr": true, "co.nz": true,
-		"com.au": true, "com.br": true, "com.cn": true, "com.mx": true,
-		"org.uk": true, "net.au": true, "ac.uk": true, "gov.uk": true,
+	if port := pageURL.Port(); port != "" {
+		apex = net.JoinHostPort(apex, port)
 	}
-	return compoundTLDs[tld]
+	return &url.URL{Scheme: pageURL.Scheme, Host: apex, Path: "/"}
 }
 
 func IsICO(contentType, srcURL string) bool {
@@ -353,7 +528,8 @@ func IsSVGContentType(contentType, srcURL string) bool {
 	if ct == "image/svg+xml" {
 		return true
 	}
-	return strings.EqualFold(path.Ext(srcURL), ".svg")
+	ext := path.Ext(srcURL)
+	return strings.EqualFold(ext, ".svg") || strings.EqualFold(ext, ".svgz")
 }
 
 func LooksLikeHTML(b []byte, contentType string) bool {
@@ -0,0 +1,198 @@
+package discovery
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"faviconsvc/internal/security"
+)
+
+// IconHints, when set, supplies known-good icon URLs per host that are tried
+// before the page is fetched at all.
+var IconHints *Hints
+
+// Hints maps hosts to icon URLs already known to work, e.g. exported from
+// another system. It is safe for concurrent use.
+type Hints struct {
+	mu    sync.RWMutex
+	hosts map[string][]string
+}
+
+// NewHints returns an empty hints store.
+func NewHints() *Hints {
+	return &Hints{hosts: make(map[string][]string)}
+}
+
+// LoadHintsFile reads hints from a CSV file (".csv": rows of host followed
+// by one or more icon URLs, optional "domain,url" header) or a JSON object
+// mapping each host to an icon URL or a list of them.
+func LoadHintsFile(path string) (*Hints, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := NewHints()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = h.loadCSV(f)
+	} else {
+		err = h.loadJSON(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return h, nil
+}
+
+func (h *Hints) loadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 && len(rec) > 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "domain") {
+			continue
+		}
+		if len(rec) < 2 {
+			return fmt.Errorf("line %d: want domain,url", line)
+		}
+		if err := h.Set(rec[0], rec[1:]); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (h *Hints) loadJSON(r io.Reader) error {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return err
+	}
+	for host, v := range raw {
+		var urls []string
+		if err := json.Unmarshal(v, &urls); err != nil {
+			var one string
+			if err := json.Unmarshal(v, &one); err != nil {
+				return fmt.Errorf("%s: want a URL or a list of URLs", host)
+			}
+			urls = []string{one}
+		}
+		if err := h.Set(host, urls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hintHost normalises a hint key: a bare host or a URL, lowercased and in
+// punycode, without port or trailing dot.
+func hintHost(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if ascii, err := security.ASCIIHost(host); err == nil {
+		host = ascii
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// Set replaces the hinted icon URLs for host, in order of preference.
+func (h *Hints) Set(host string, urls []string) error {
+	key := hintHost(host)
+	if key == "" {
+		return fmt.Errorf("invalid hint host %q", host)
+	}
+	var clean []string
+	for _, raw := range urls {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !IsDataURI(raw) {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid hint URL %q for %s", raw, key)
+			}
+		}
+		clean = append(clean, raw)
+	}
+	if len(clean) == 0 {
+		return fmt.Errorf("no hint URLs for %s", key)
+	}
+	h.mu.Lock()
+	h.hosts[key] = clean
+	h.mu.Unlock()
+	return nil
+}
+
+// Delete removes the hints for host and reports whether there were any.
+func (h *Hints) Delete(host string) bool {
+	key := hintHost(host)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.hosts[key]
+	delete(h.hosts, key)
+	return ok
+}
+
+// Lookup returns the hinted icon URLs for host.
+func (h *Hints) Lookup(host string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string(nil), h.hosts[hintHost(host)]...)
+}
+
+// All returns a copy of every hint.
+func (h *Hints) All() map[string][]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string][]string, len(h.hosts))
+	for k, v := range h.hosts {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// Len returns the number of hinted hosts.
+func (h *Hints) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.hosts)
+}
+
+// HintCandidates returns the IconHints entries for the page's host as
+// candidates, in hint order, or nil if there are none.
+func HintCandidates(pageURL *url.URL) []IconCandidate {
+	if IconHints == nil {
+		return nil
+	}
+	urls := IconHints.Lookup(pageURL.Hostname())
+	if len(urls) == 0 {
+		return nil
+	}
+	out := make([]IconCandidate, 0, len(urls))
+	for _, u := range urls {
+		out = append(out, IconCandidate{URL: CanonicalizeURLString(u), Source: SourceHint})
+	}
+	return out
+}
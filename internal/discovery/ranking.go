@@ -0,0 +1,193 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultRankingStrategy is used when no strategy is configured or requested.
+const DefaultRankingStrategy = "largest"
+
+// RankedIcon describes a candidate after it has been fetched and decoded.
+type RankedIcon struct {
+	Candidate IconCandidate
+	Width     int // source dimensions; 0 for vectors
+	Height    int
+	Vector    bool
+}
+
+// RankingStrategy decides which candidates are fetched first, which decoded
+// icon wins, and when fetching can stop early.
+type RankingStrategy interface {
+	Name() string
+	// Order sorts candidates in place into fetch order for targetSize.
+	Order(cands []IconCandidate, targetSize int)
+	// Score rates a decoded icon for targetSize; the highest score wins.
+	Score(icon RankedIcon, targetSize int) int64
+	// Sufficient reports whether icon is good enough to cancel remaining
+	// fetches. threshold is the configured "good enough" edge size.
+	Sufficient(icon RankedIcon, targetSize, threshold int) bool
+}
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[string]RankingStrategy{}
+)
+
+func init() {
+	RegisterRankingStrategy(largestStrategy{})
+	RegisterRankingStrategy(closestSizeStrategy{})
+	RegisterRankingStrategy(vectorFirstStrategy{})
+}
+
+// RegisterRankingStrategy adds s to the registry, replacing any strategy with the same name.
+func RegisterRankingStrategy(s RankingStrategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[s.Name()] = s
+}
+
+// LookupRankingStrategy returns the strategy registered under name.
+func LookupRankingStrategy(name string) (RankingStrategy, bool) {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	s, ok := strategies[name]
+	return s, ok
+}
+
+// RankingStrategies returns the names of all registered strategies, sorted.
+func RankingStrategies() []string {
+	strategiesMu.RLock()
+	out := make([]string, 0, len(strategies))
+	for name := range strategies {
+		out = append(out, name)
+	}
+	strategiesMu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// vectorScore ranks vectors above any raster in area-based strategies.
+const vectorScore = int64(1) << 50
+
+func edge(icon RankedIcon) int {
+	if icon.Width < icon.Height {
+		return icon.Width
+	}
+	return icon.Height
+}
+
+// largestStrategy prefers the biggest source image; vectors count as
+// infinitely large. This is the historical behaviour.
+type largestStrategy struct{}
+
+func (largestStrategy) Name() string { return "largest" }
+
+func (largestStrategy) Order(cands []IconCandidate, targetSize int) {
+	RankCandidates(cands, targetSize)
+}
+
+func (largestStrategy) Score(icon RankedIcon, targetSize int) int64 {
+	if icon.Vector {
+		return vectorScore
+	}
+	return int64(icon.Width) * int64(icon.Height)
+}
+
+func (s largestStrategy) Sufficient(icon RankedIcon, targetSize, threshold int) bool {
+	return s.Score(icon, targetSize) >= int64(threshold)*int64(threshold)
+}
+
+// closestSizeStrategy prefers a raster whose edge matches the requested size
+// exactly (crisp at small sizes), then the nearest one, favouring downscaling
+// over upscaling. Vectors rank just below an exact raster match.
+type closestSizeStrategy struct{}
+
+func (closestSizeStrategy) Name() string { return "closest-size" }
+
+func (closestSizeStrategy) Order(cands []IconCandidate, targetSize int) {
+	RankCandidates(cands, targetSize)
+}
+
+func (closestSizeStrategy) Score(icon RankedIcon, targetSize int) int64 {
+	if icon.Vector {
+		return -1
+	}
+	// Exact match scores 0; at equal distance a larger source beats a smaller one
+	d := int64(edge(icon) - targetSize)
+	if d >= 0 {
+		return -2 * d
+	}
+	return 2*d - 1
+}
+
+func (closestSizeStrategy) Sufficient(icon RankedIcon, targetSize, threshold int) bool {
+	return !icon.Vector && edge(icon) == targetSize
+}
+
+// vectorFirstStrategy fetches SVG candidates first and takes the first one
+// that renders; otherwise it falls back to the largest raster.
+type vectorFirstStrategy struct{}
+
+func (vectorFirstStrategy) Name() string { return "vector-first" }
+
+func (vectorFirstStrategy) Order(cands []IconCandidate, targetSize int) {
+	RankCandidates(cands, targetSize)
+	sort.SliceStable(cands, func(i, j int) bool {
+		return isVectorCandidate(cands[i]) && !isVectorCandidate(cands[j])
+	})
+}
+
+func (vectorFirstStrategy) Score(icon RankedIcon, targetSize int) int64 {
+	return largestStrategy{}.Score(icon, targetSize)
+}
+
+func (vectorFirstStrategy) Sufficient(icon RankedIcon, targetSize, threshold int) bool {
+	return icon.Vector
+}
+
+func isVectorCandidate(c IconCandidate) bool {
+	return IsSVGContentType(c.Type, c.URL)
+}
+
+// TrustDeclaredSizes wraps s to trust the sizes icons declare in their
+// links. Candidates whose declared size s would find sufficient are
+// fetched first, and the first of them to decode stops the search
+// whatever it decodes to, instead of more candidates being fetched to
+// compare their actual sizes. A site that declares its icons correctly then
+// costs a single icon download.
+//
+// Only PNG, ICO, WebP and AVIF declarations are trusted; vectors declare
+// no size, and other formats may not decode.
+func TrustDeclaredSizes(s RankingStrategy) RankingStrategy {
+	return declaredStrategy{s}
+}
+
+type declaredStrategy struct{ RankingStrategy }
+
+// Order orders like the wrapped strategy, then moves the candidates whose
+// declaration is sufficient at targetSize first.
+func (s declaredStrategy) Order(cands []IconCandidate, targetSize int) {
+	s.RankingStrategy.Order(cands, targetSize)
+	sort.SliceStable(cands, func(i, j int) bool {
+		return s.declaredSufficient(cands[i], targetSize, targetSize) && !s.declaredSufficient(cands[j], targetSize, targetSize)
+	})
+}
+
+func (s declaredStrategy) Sufficient(icon RankedIcon, targetSize, threshold int) bool {
+	return s.RankingStrategy.Sufficient(icon, targetSize, threshold) || s.declaredSufficient(icon.Candidate, targetSize, threshold)
+}
+
+// declaredSufficient reports whether the wrapped strategy would find c
+// sufficient if it decoded at one of the sizes it declares.
+func (s declaredStrategy) declaredSufficient(c IconCandidate, targetSize, threshold int) bool {
+	if c.FormatRank != 0 || isVectorCandidate(c) {
+		return false
+	}
+	for _, e := range c.Sizes {
+		if s.RankingStrategy.Sufficient(RankedIcon{Candidate: c, Width: e, Height: e}, targetSize, threshold) {
+			return true
+		}
+	}
+	return false
+}
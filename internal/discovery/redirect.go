@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"faviconsvc/internal/security"
+
+	"golang.org/x/net/html"
+)
+
+// findPageRedirect returns the page a document points to via
+// <meta http-equiv="refresh"> or, failing that, <link rel="canonical">.
+// Targets are resolved against the document (honouring <base href>) and must
+// pass the same URL validation as user input. Returns nil if there is no
+// usable target or it is the page itself.
+func findPageRedirect(ctx context.Context, root *html.Node, pageURL *url.URL) *url.URL {
+	var baseHref *url.URL
+	var refresh, canonical string
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "base":
+				if href := attr(n, "href"); href != "" && baseHref == nil {
+					if bu, err := url.Parse(href); err == nil {
+						baseHref = pageURL.ResolveReference(bu)
+					}
+				}
+			case "meta":
+				if refresh == "" && strings.EqualFold(attr(n, "http-equiv"), "refresh") {
+					refresh = parseMetaRefresh(attr(n, "content"))
+				}
+			case "link":
+				if canonical == "" && hasRelToken(attr(n, "rel"), "canonical") {
+					canonical = attr(n, "href")
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(root)
+
+	base := pageURL
+	if baseHref != nil {
+		base = baseHref
+	}
+	self := CanonicalizeURLString(pageURL.String())
+	for _, raw := range []string{refresh, canonical} {
+		if raw == "" {
+			continue
+		}
+		ref, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		target, err := security.NormalizeURLContext(ctx, base.ResolveReference(ref).String())
+		if err != nil {
+			continue
+		}
+		if CanonicalizeURLString(target.String()) == self {
+			continue
+		}
+		return target
+	}
+	return nil
+}
+
+// maxAlternatePages caps how many alternates of one page are fetched.
+const maxAlternatePages = 2
+
+// findAlternatePages returns the AMP version of a document
+// (<link rel="amphtml">) followed by its mobile alternates
+// (<link rel="alternate" media=...>), at most maxAlternatePages. Feeds and
+// other non-HTML alternates are ignored, as are language alternates, which
+// are separate pages rather than variants. Targets are validated like
+// findPageRedirect's.
+func findAlternatePages(ctx context.Context, root *html.Node, pageURL *url.URL) []*url.URL {
+	var baseHref *url.URL
+	var amp, mobile []string
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "base":
+				if href := attr(n, "href"); href != "" && baseHref == nil {
+					if bu, err := url.Parse(href); err == nil {
+						baseHref = pageURL.ResolveReference(bu)
+					}
+				}
+			case "link":
+				rel, href := attr(n, "rel"), attr(n, "href")
+				typ := strings.ToLower(attr(n, "type"))
+				switch {
+				case href == "":
+				case hasRelToken(rel, "amphtml"):
+					amp = append(amp, href)
+				case hasRelToken(rel, "alternate") && attr(n, "media") != "" && attr(n, "hreflang") == "" &&
+					(typ == "" || typ == "text/html"):
+					mobile = append(mobile, href)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(root)
+
+	base := pageURL
+	if baseHref != nil {
+		base = baseHref
+	}
+	seen := map[string]bool{CanonicalizeURLString(pageURL.String()): true}
+	var out []*url.URL
+	for _, raw := range append(amp, mobile...) {
+		ref, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		target, err := security.NormalizeURLContext(ctx, base.ResolveReference(ref).String())
+		if err != nil {
+			continue
+		}
+		key := CanonicalizeURLString(target.String())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, target)
+		if len(out) == maxAlternatePages {
+			break
+		}
+	}
+	return out
+}
+
+// parseMetaRefresh extracts the URL from a refresh directive such as
+// `0; url='https://www.example.com/'`. Returns "" for plain reloads.
+func parseMetaRefresh(content string) string {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	rest := strings.TrimSpace(content[i+1:])
+	if len(rest) >= 4 && strings.EqualFold(rest[:3], "url") {
+		after := strings.TrimSpace(rest[3:])
+		if strings.HasPrefix(after, "=") {
+			rest = strings.TrimSpace(after[1:])
+		}
+	}
+	rest = strings.Trim(rest, `"'`)
+	return strings.TrimSpace(rest)
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+func hasRelToken(rel, token string) bool {
+	for _, t := range strings.Fields(strings.ToLower(rel)) {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
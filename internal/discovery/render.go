@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/logger"
+
+	"golang.org/x/net/html"
+)
+
+// Renderer produces the final DOM of a page after its JavaScript has run.
+type Renderer interface {
+	RenderDOM(ctx context.Context, pageURL string) (string, error)
+}
+
+// minRenderBudget is the least remaining request budget worth starting a render with.
+const minRenderBudget = time.Second
+
+// PageRenderer, when set, is used for pages whose static HTML declares no icons
+// (e.g. single-page apps that inject <link rel="icon"> at runtime).
+var PageRenderer Renderer
+
+func collectRenderedIcons(ctx context.Context, pageURL *url.URL, targetSize int) []IconCandidate {
+	if fetch.Intercepted(ctx) {
+		reqctx.Debugf(ctx, "Skipping render of %s: upstream traffic is being recorded or replayed", pageURL.String())
+		return nil
+	}
+	if b := reqctx.Budget(ctx); b != 0 && b < minRenderBudget {
+		reqctx.Debugf(ctx, "Skipping render of %s: request budget nearly spent", pageURL.String())
+		return nil
+	}
+	dom, err := PageRenderer.RenderDOM(ctx, pageURL.String())
+	if err != nil {
+		logger.Warn("Failed to render %s: %v", pageURL.String(), err)
+		return nil
+	}
+	root, err := html.Parse(strings.NewReader(dom))
+	if err != nil {
+		logger.Warn("Failed to parse rendered DOM for %s: %v", pageURL.String(), err)
+		return nil
+	}
+	cands := iconsFromDocument(root, pageURL, targetSize)
+	for i := range cands {
+		if cands[i].Source == SourceLink {
+			cands[i].Source = SourceRendered
+		}
+	}
+	reqctx.Debugf(ctx, "Rendered DOM of %s yielded %d icon candidates", pageURL.String(), len(cands))
+	return cands
+}
@@ -0,0 +1,153 @@
+package fetch
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+
+	"faviconsvc/internal/security"
+)
+
+// TLS fingerprints InitPageClient can mimic.
+const (
+	TLSFingerprintChrome  = "chrome"
+	TLSFingerprintFirefox = "firefox"
+	TLSFingerprintSafari  = "safari"
+	// TLSFingerprintRandom sends a different randomized ClientHello on
+	// every connection.
+	TLSFingerprintRandom = "random"
+)
+
+// TLSFingerprints lists every fingerprint InitPageClient accepts.
+var TLSFingerprints = []string{TLSFingerprintChrome, TLSFingerprintFirefox, TLSFingerprintSafari, TLSFingerprintRandom}
+
+var tlsFingerprintIDs = map[string]utls.ClientHelloID{
+	TLSFingerprintChrome:  utls.HelloChrome_Auto,
+	TLSFingerprintFirefox: utls.HelloFirefox_Auto,
+	TLSFingerprintSafari:  utls.HelloSafari_Auto,
+	TLSFingerprintRandom:  utls.HelloRandomizedNoALPN,
+}
+
+// PageClient, when set, replaces HTTPClient for HTML page fetches during
+// discovery. Icons themselves are always fetched with HTTPClient.
+var PageClient *http.Client
+
+// PageHTTPClient returns the client page fetches use.
+func PageHTTPClient() *http.Client {
+	if PageClient != nil {
+		return PageClient
+	}
+	return HTTPClient
+}
+
+// InitPageClient sets PageClient to a client whose TLS ClientHello mimics
+// fingerprint (one of TLSFingerprints), for anti-bot CDNs that reject Go's
+// own handshake even from a browser User-Agent. An empty fingerprint
+// leaves page fetches on HTTPClient.
+//
+// The mimicked hello offers only HTTP/1.1 in ALPN, which the JA3 hash does
+// not cover. Requests sent through an HTTP proxy (HTTPS_PROXY) keep Go's
+// fingerprint, as the TLS session is then set up by net/http.
+func InitPageClient(fingerprint string) error {
+	if fingerprint == "" {
+		PageClient = nil
+		return nil
+	}
+	t, err := newBrowserTLSTransport(fingerprint, security.ValidatedDialContext, nil)
+	if err != nil {
+		return err
+	}
+	PageClient = newClient(t)
+	return nil
+}
+
+// newBrowserTLSTransport returns a transport that dials with dial and
+// performs the TLS handshake of fingerprint, verifying certificates against
+// roots (nil = system roots).
+func newBrowserTLSTransport(fingerprint string, dial func(ctx context.Context, network, addr string) (net.Conn, error), roots *x509.CertPool) (*http.Transport, error) {
+	id, ok := tlsFingerprintIDs[strings.ToLower(fingerprint)]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS fingerprint %q (available: %s)", fingerprint, strings.Join(TLSFingerprints, ", "))
+	}
+	return &http.Transport{
+		DialContext: dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tc, err := browserHandshake(ctx, conn, host, id, roots)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		},
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 4,
+	}, nil
+}
+
+// maxRandomHellos bounds how often randomizedClient draws a new hello.
+const maxRandomHellos = 32
+
+// randomizedClient returns a client on conn with a freshly randomized
+// ClientHello, drawn again while it lists X25519MLKEM768 without a key
+// share for it. Servers pick that group first whenever it is offered and
+// ask for its key share in a HelloRetryRequest, which utls cannot answer
+// for hybrid groups, so about one randomized handshake in ten would fail
+// with "CurvePreferences includes unsupported curve". Nothing is sent on
+// conn until the handshake.
+func randomizedClient(conn net.Conn, cfg *utls.Config) (*utls.UConn, error) {
+	for range maxRandomHellos {
+		tc := utls.UClient(conn, cfg.Clone(), utls.HelloRandomizedNoALPN)
+		if err := tc.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		if hello := tc.HandshakeState.Hello; !slices.Contains(hello.SupportedCurves, utls.X25519MLKEM768) ||
+			slices.ContainsFunc(hello.KeyShares, func(ks utls.KeyShare) bool { return ks.Group == utls.X25519MLKEM768 }) {
+			return tc, nil
+		}
+	}
+	return nil, errors.New("tls: no usable randomized ClientHello")
+}
+
+// browserHandshake runs the client side of a TLS handshake on conn with the
+// ClientHello of id, restricted to HTTP/1.1.
+func browserHandshake(ctx context.Context, conn net.Conn, host string, id utls.ClientHelloID, roots *x509.CertPool) (*utls.UConn, error) {
+	cfg := &utls.Config{ServerName: host, RootCAs: roots}
+	if id == utls.HelloRandomizedNoALPN {
+		tc, err := randomizedClient(conn, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return tc, tc.HandshakeContext(ctx)
+	}
+
+	// Specs hold per-connection state, so each handshake builds its own
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+	tc := utls.UClient(conn, cfg, utls.HelloCustom)
+	if err := tc.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return tc, tc.HandshakeContext(ctx)
+}
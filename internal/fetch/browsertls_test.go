@@ -0,0 +1,101 @@
+package fetch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestBrowserTLSTransport(t *testing.T) {
+	var mu sync.Mutex
+	var hello *tls.ClientHelloInfo
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		hello = h
+		mu.Unlock()
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	dial := (&net.Dialer{}).DialContext
+
+	// GREASE values are what browsers send and crypto/tls never does
+	grease := func(suites []uint16) bool {
+		return slices.ContainsFunc(suites, func(s uint16) bool { return s&0x0f0f == 0x0a0a })
+	}
+
+	for _, fp := range TLSFingerprints {
+		t.Run(fp, func(t *testing.T) {
+			tr, err := newBrowserTLSTransport(fp, dial, roots)
+			if err != nil {
+				t.Fatalf("newBrowserTLSTransport: %v", err)
+			}
+			defer tr.CloseIdleConnections()
+			resp, err := newClient(tr).Get(srv.URL)
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "HTTP/1.1" {
+				t.Errorf("proto = %q, want HTTP/1.1", body)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(hello.SupportedProtos) > 0 && !slices.Equal(hello.SupportedProtos, []string{"http/1.1"}) {
+				t.Errorf("ALPN = %v, want http/1.1 only", hello.SupportedProtos)
+			}
+			if fp == TLSFingerprintChrome && !grease(hello.CipherSuites) {
+				t.Errorf("Chrome hello has no GREASE cipher suite: %x", hello.CipherSuites)
+			}
+		})
+	}
+
+	// Certificates are still verified
+	tr, _ := newBrowserTLSTransport(TLSFingerprintChrome, dial, x509.NewCertPool())
+	defer tr.CloseIdleConnections()
+	if resp, err := newClient(tr).Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Untrusted certificate accepted")
+	}
+
+	if _, err := newBrowserTLSTransport("netscape", dial, roots); err == nil {
+		t.Error("Unknown fingerprint accepted")
+	}
+}
+
+func TestBrowserTLSTransportRandomHandshakes(t *testing.T) {
+	// crypto/tls servers, like most, prefer X25519MLKEM768 whenever it is
+	// offered, which sends some randomized hellos a HelloRetryRequest
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tr, err := newBrowserTLSTransport(TLSFingerprintRandom, (&net.Dialer{}).DialContext, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.DisableKeepAlives = true
+	client := newClient(tr)
+	for i := 0; i < 50; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("handshake %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+}
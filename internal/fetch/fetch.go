@@ -6,9 +6,11 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"faviconsvc/internal/reqctx"
 	"faviconsvc/internal/security"
 	"faviconsvc/pkg/logger"
 )
@@ -22,14 +24,20 @@ const (
 var HTTPClient *http.Client
 
 func InitHTTPClient() {
-	HTTPClient = &http.Client{
-		Timeout: 12 * time.Second,
-		Transport: &http.Transport{
-			DialContext:         security.ValidatedDialContext,
-			ForceAttemptHTTP2:   true,
-			Proxy:               http.ProxyFromEnvironment,
-			MaxIdleConnsPerHost: 4,
-		},
+	HTTPClient = newClient(&http.Transport{
+		DialContext:         security.ValidatedDialContext,
+		ForceAttemptHTTP2:   true,
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 4,
+	})
+}
+
+// newClient returns a client for upstream fetches over transport, with the
+// service's timeout and redirect policy.
+func newClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   12 * time.Second,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) > 8 {
 				return errors.New("too many redirects")
@@ -37,11 +45,23 @@ func InitHTTPClient() {
 			if !security.IsAllowedScheme(req.URL) {
 				return errors.New("blocked redirect scheme")
 			}
+			if check, ok := req.Context().Value(redirectCheckKey{}).(func(*url.URL) error); ok {
+				return check(req.URL)
+			}
 			return nil
 		},
 	}
 }
 
+type redirectCheckKey struct{}
+
+// WithRedirectCheck returns a context under which redirects followed by
+// the service's clients are also checked by check, for requests that may
+// only reach some hosts; a non-nil error stops the fetch.
+func WithRedirectCheck(ctx context.Context, check func(*url.URL) error) context.Context {
+	return context.WithValue(ctx, redirectCheckKey{}, check)
+}
+
 func FetchURLFull(ctx context.Context, canonURL string) ([]byte, string, string, string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, canonURL, nil)
 	if err != nil {
@@ -51,8 +71,8 @@ func FetchURLFull(ctx context.Context, canonURL string) ([]byte, string, string,
 	req.Header.Set("Accept", "image/*,image/avif,image/webp,*/*;q=0.8")
 	req.Header.Set("Accept-Encoding", "gzip")
 
-	logger.Debug("Fetching URL: %s", canonURL)
-	resp, err := HTTPClient.Do(req)
+	reqctx.Debugf(ctx, "Fetching URL: %s", canonURL)
+	resp, err := Do(HTTPClient, req)
 	if err != nil {
 		logger.Warn("Fetch failed for %s: %v", canonURL, err)
 		return nil, "", "", "", err
@@ -66,6 +86,7 @@ func FetchURLFull(ctx context.Context, canonURL string) ([]byte, string, string,
 
 	body, err := readPossiblyGzipped(resp)
 	if err != nil {
+		observeOutcome(ctx, 0, err)
 		return nil, "", "", "", err
 	}
 
@@ -76,7 +97,7 @@ func FetchURLFull(ctx context.Context, canonURL string) ([]byte, string, string,
 	etag := strings.TrimSpace(resp.Header.Get("ETag"))
 	lastMod := strings.TrimSpace(resp.Header.Get("Last-Modified"))
 
-	logger.Debug("Fetched %s: %d bytes, content-type: %s", canonURL, len(body), ct)
+	reqctx.Debugf(ctx, "Fetched %s: %d bytes, content-type: %s", canonURL, len(body), ct)
 	return body, ct, etag, lastMod, nil
 }
 
@@ -96,15 +117,15 @@ func FetchURLConditional(ctx context.Context, canonURL string, etag, lastMod str
 		req.Header.Set("If-Modified-Since", lastMod)
 	}
 
-	logger.Debug("Conditional fetch for %s (ETag: %s, LastMod: %s)", canonURL, etag, lastMod)
-	resp, err := HTTPClient.Do(req)
+	reqctx.Debugf(ctx, "Conditional fetch for %s (ETag: %s, LastMod: %s)", canonURL, etag, lastMod)
+	resp, err := Do(HTTPClient, req)
 	if err != nil {
 		return nil, "", 0, "", "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotModified {
-		logger.Debug("Cache hit (304) for %s", canonURL)
+		reqctx.Debugf(ctx, "Cache hit (304) for %s", canonURL)
 		return nil, "", 304, etag, lastMod, nil
 	}
 
@@ -114,6 +135,7 @@ func FetchURLConditional(ctx context.Context, canonURL string, etag, lastMod str
 
 	body, err := readPossiblyGzipped(resp)
 	if err != nil {
+		observeOutcome(ctx, 0, err)
 		return nil, "", resp.StatusCode, "", "", err
 	}
 
@@ -124,7 +146,7 @@ func FetchURLConditional(ctx context.Context, canonURL string, etag, lastMod str
 	newETag := strings.TrimSpace(resp.Header.Get("ETag"))
 	newLM := strings.TrimSpace(resp.Header.Get("Last-Modified"))
 
-	logger.Debug("Fetched (conditional) %s: %d bytes", canonURL, len(body))
+	reqctx.Debugf(ctx, "Fetched (conditional) %s: %d bytes", canonURL, len(body))
 	return body, ct, resp.StatusCode, newETag, newLM, nil
 }
 
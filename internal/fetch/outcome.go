@@ -0,0 +1,50 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type outcomesKey struct{}
+
+// Outcomes tallies the upstream requests sent under a context (see
+// WithOutcomes), so a lookup that found nothing can tell a site that has
+// no icon from one that could not be reached.
+type Outcomes struct {
+	transient atomic.Int64
+}
+
+// WithOutcomes returns a context under which the requests sent through Do
+// are tallied in the returned Outcomes.
+func WithOutcomes(ctx context.Context) (context.Context, *Outcomes) {
+	o := &Outcomes{}
+	return context.WithValue(ctx, outcomesKey{}, o), o
+}
+
+// Transient reports whether any request failed in a way that may not
+// last: a transport error or timeout, including while reading the body,
+// or a TransientStatus.
+func (o *Outcomes) Transient() bool {
+	return o.transient.Load() > 0
+}
+
+func (o *Outcomes) observe(status int, err error) {
+	if err != nil || TransientStatus(status) {
+		o.transient.Add(1)
+	}
+}
+
+// TransientStatus reports whether an upstream response status may clear
+// up on retry: server errors, request timeouts and rate limiting. Other
+// client errors, such as 404 and 410, are taken as lasting.
+func TransientStatus(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// observeOutcome tallies a request sent under ctx, if ctx carries Outcomes.
+func observeOutcome(ctx context.Context, status int, err error) {
+	if o, ok := ctx.Value(outcomesKey{}).(*Outcomes); ok {
+		o.observe(status, err)
+	}
+}
@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"faviconsvc/internal/security"
+)
+
+// Preflight fetches probeURL the way icons are fetched: validated and
+// resolved like any requested URL, then sent with HTTPClient through its
+// proxy, dialer and TLS settings. It returns the status the probe was
+// answered with, so a service that cannot reach the internet fails at
+// startup with the reason instead of timing out on every request.
+//
+// Any response of the origin passes, whatever its status, as it proves
+// the way out works. A proxy refusing the request (407), or failing to
+// reach the origin (502, 504), does not.
+func Preflight(ctx context.Context, probeURL string) (int, error) {
+	u, err := security.NormalizeURLContext(ctx, probeURL)
+	if err != nil {
+		return 0, fmt.Errorf("%s for %s: %w", preflightStage(err), probeURL, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", UABrowser)
+	req.Header.Set("Accept", "image/*,image/avif,image/webp,*/*;q=0.8")
+
+	via := ""
+	if proxy := proxyFor(req); proxy != nil {
+		via = " via proxy " + proxy.Redacted()
+	}
+	resp, err := Do(HTTPClient, req)
+	if err != nil {
+		return 0, fmt.Errorf("%s for %s%s: %w", preflightStage(err), u, via, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, MaxHTMLBytes))
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return resp.StatusCode, fmt.Errorf("proxy authentication required for %s%s", u, via)
+	case via != "" && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout):
+		return resp.StatusCode, fmt.Errorf("proxy could not reach %s%s: status %s", u, via, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// proxyFor returns the proxy HTTPClient sends req through, or nil when it
+// connects directly or the proxy cannot be told.
+func proxyFor(req *http.Request) *url.URL {
+	t, ok := HTTPClient.Transport.(*http.Transport)
+	if !ok || t.Proxy == nil {
+		return nil
+	}
+	proxy, err := t.Proxy(req)
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
+
+// preflightStage names the step of a fetch that err failed in.
+func preflightStage(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, security.ErrNotResolvable) || errors.As(err, &dnsErr):
+		return "DNS lookup failed"
+	case errors.As(err, &certErr):
+		return "TLS certificate verification failed"
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return "connecting to the proxy failed"
+	case errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err):
+		return "timed out"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connecting failed"
+	}
+	return "request failed"
+}
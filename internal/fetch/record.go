@@ -0,0 +1,236 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BundleVersion is the format version of bundles written by Recorder.
+const BundleVersion = 1
+
+// Exchange is one upstream HTTP request and the response it got, as sent
+// on the wire: redirects are separate exchanges and bodies are kept in
+// their transfer form (gzip stays compressed).
+type Exchange struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+	Body          []byte      `json:"body,omitempty"`
+	// Truncated marks a body longer than MaxFetchBytes, of which only the
+	// first MaxFetchBytes were kept. Such an exchange cannot be replayed.
+	Truncated bool `json:"truncated,omitempty"`
+	// Error is the transport error the request failed with instead of a
+	// response, such as a timeout or refused connection.
+	Error string `json:"error,omitempty"`
+}
+
+// BundleResponse summarises the response a recorded request was served.
+type BundleResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes"`
+	SHA256      string `json:"sha256"`
+}
+
+// Bundle is the upstream traffic of one service request, enough to serve
+// the request again without the network.
+type Bundle struct {
+	Version  int       `json:"version"`
+	Recorded time.Time `json:"recorded"`
+	// Request is the recorded request URI, e.g. /favicons?domain=example.com,
+	// and Accept its Accept header.
+	Request   string          `json:"request"`
+	Accept    string          `json:"accept,omitempty"`
+	Response  *BundleResponse `json:"response,omitempty"`
+	Exchanges []Exchange      `json:"exchanges"`
+}
+
+type recorderKey struct{}
+type replayerKey struct{}
+
+// Recorder collects the upstream exchanges of the requests whose context
+// carries it (see WithRecorder). It is safe for concurrent use, so raced
+// candidate fetches all land in one bundle.
+type Recorder struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// WithRecorder returns a context under which Do records into rec.
+func WithRecorder(ctx context.Context, rec *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, rec)
+}
+
+// Exchanges returns the exchanges recorded so far, in the order they
+// completed.
+func (rec *Recorder) Exchanges() []Exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Exchange(nil), rec.exchanges...)
+}
+
+func (rec *Recorder) add(e Exchange) {
+	rec.mu.Lock()
+	rec.exchanges = append(rec.exchanges, e)
+	rec.mu.Unlock()
+}
+
+// Replayer answers upstream requests from a bundle instead of the network.
+// Requests for the same method and URL get the recorded exchanges in turn,
+// the last one repeating once they run out; requests the bundle lacks fail.
+type Replayer struct {
+	mu      sync.Mutex
+	byKey   map[string][]Exchange
+	served  map[string]int
+	missing []string
+}
+
+// NewReplayer returns a Replayer serving the exchanges of b.
+func NewReplayer(b *Bundle) *Replayer {
+	rp := &Replayer{byKey: make(map[string][]Exchange), served: make(map[string]int)}
+	for _, e := range b.Exchanges {
+		k := e.Method + " " + e.URL
+		rp.byKey[k] = append(rp.byKey[k], e)
+	}
+	return rp
+}
+
+// WithReplayer returns a context under which Do answers from rp.
+func WithReplayer(ctx context.Context, rp *Replayer) context.Context {
+	return context.WithValue(ctx, replayerKey{}, rp)
+}
+
+// Missing returns the requests ("METHOD URL") that had no exchange in the
+// bundle, which means the replay diverged from the recording.
+func (rp *Replayer) Missing() []string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return append([]string(nil), rp.missing...)
+}
+
+func (rp *Replayer) next(req *http.Request) (Exchange, bool) {
+	k := req.Method + " " + req.URL.String()
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	list := rp.byKey[k]
+	if len(list) == 0 {
+		rp.missing = append(rp.missing, k)
+		return Exchange{}, false
+	}
+	i := min(rp.served[k], len(list)-1)
+	rp.served[k]++
+	return list[i], true
+}
+
+// Intercepted reports whether ctx carries a Recorder or Replayer. Work
+// that reaches the network other than through Do, such as headless
+// rendering, is skipped under it so replays match their recording.
+func Intercepted(ctx context.Context) bool {
+	return ctx.Value(replayerKey{}) != nil || ctx.Value(recorderKey{}) != nil
+}
+
+// Do sends req with client, like client.Do, but through the Recorder or
+// Replayer in req's context when there is one. Upstream fetches go through
+// Do so record and replay, and the per-domain upstream traffic metrics,
+// cover all of them, redirects included. Replayed requests never reach the
+// network and are not counted.
+func Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var rt http.RoundTripper
+	if rp, ok := ctx.Value(replayerKey{}).(*Replayer); ok {
+		rt = replayTransport{rp}
+	} else {
+		next := client.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		rt = accountingTransport{next}
+		if rec, ok := ctx.Value(recorderKey{}).(*Recorder); ok {
+			rt = recordTransport{rec, rt}
+		}
+	}
+	c := *client
+	c.Transport = rt
+	return c.Do(req)
+}
+
+type recordTransport struct {
+	rec  *Recorder
+	next http.RoundTripper
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := Exchange{Method: req.Method, URL: req.URL.String(), RequestHeader: req.Header.Clone()}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		e.Error = err.Error()
+		t.rec.add(e)
+		return nil, err
+	}
+	// One byte past the limit tells a body that was cut from one that fits
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxFetchBytes+1))
+	e.Status, e.Header, e.Body = resp.StatusCode, resp.Header.Clone(), body
+	if err != nil {
+		resp.Body.Close()
+		e.Error = err.Error()
+		t.rec.add(e)
+		return nil, err
+	}
+	if len(body) > MaxFetchBytes {
+		// The live request still gets the whole body, which the fetch
+		// limits apply to as without recording
+		e.Body, e.Truncated = body[:MaxFetchBytes], true
+		t.rec.add(e)
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	t.rec.add(e)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type replayTransport struct {
+	rp *Replayer
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e, ok := t.rp.next(req)
+	if !ok {
+		return nil, fmt.Errorf("replay: %s %s is not in the bundle", req.Method, req.URL)
+	}
+	if e.Error != "" {
+		return nil, fmt.Errorf("replay: %s", e.Error)
+	}
+	if e.Truncated {
+		return nil, fmt.Errorf("replay: body of %s %s was cut at %d bytes when recorded", req.Method, req.URL, MaxFetchBytes)
+	}
+	header := e.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}, nil
+}
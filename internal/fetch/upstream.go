@@ -0,0 +1,60 @@
+package fetch
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"faviconsvc/pkg/metrics"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// UpstreamDomain returns the domain upstream traffic to host is accounted
+// under: its registrable domain, the unit politeness limits apply to, or
+// the host itself for IP addresses and hosts without a public suffix.
+func UpstreamDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return site
+	}
+	return host
+}
+
+// accountingTransport counts every request it sends, and the response
+// bytes read back, against the upstream domain (see UpstreamDomain) in the
+// metrics, and in the Outcomes of the request's context.
+type accountingTransport struct {
+	next http.RoundTripper
+}
+
+func (t accountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	domain := UpstreamDomain(req.URL.Hostname())
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		metrics.Get().ObserveUpstreamRequest(domain, 0, err)
+		observeOutcome(req.Context(), 0, err)
+		return nil, err
+	}
+	metrics.Get().ObserveUpstreamRequest(domain, resp.StatusCode, nil)
+	observeOutcome(req.Context(), resp.StatusCode, nil)
+	resp.Body = &countingBody{ReadCloser: resp.Body, domain: domain}
+	return resp, nil
+}
+
+// countingBody adds the bytes read through it to its domain's upstream
+// traffic.
+type countingBody struct {
+	io.ReadCloser
+	domain string
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	metrics.Get().AddUpstreamBytes(b.domain, n)
+	return n, err
+}
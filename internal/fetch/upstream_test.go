@@ -0,0 +1,144 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"faviconsvc/pkg/metrics"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestUpstreamDomain(t *testing.T) {
+	for in, want := range map[string]string{
+		"www.example.com":          "example.com",
+		"cdn.assets.example.co.uk": "example.co.uk",
+		"Example.COM.":             "example.com",
+		"203.0.113.10":             "203.0.113.10",
+		"::1":                      "::1",
+		"localhost":                "localhost",
+	} {
+		if got := UpstreamDomain(in); got != want {
+			t.Errorf("UpstreamDomain(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDoAccountsUpstream(t *testing.T) {
+	metrics.Reset()
+	defer metrics.Reset()
+
+	client := newClient(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader("0123456789"))}
+		if req.URL.Host == "www.upstream.test" {
+			resp.StatusCode = http.StatusFound
+			resp.Header.Set("Location", "https://static.upstream.test/icon.png")
+		}
+		return resp, nil
+	}))
+	for _, ctx := range []context.Context{
+		context.Background(),
+		WithRecorder(context.Background(), &Recorder{}),
+		WithReplayer(context.Background(), NewReplayer(&Bundle{})), // not counted
+	} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.upstream.test/favicon.ico", nil)
+		if resp, err := Do(client, req); err == nil {
+			_, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	st := metrics.Get().UpstreamStats(10)
+	if len(st) != 1 || st[0].Domain != "upstream.test" {
+		t.Fatalf("UpstreamStats() = %+v, want upstream.test only", st)
+	}
+	// Two requests each, the redirect and its target; both bodies are read
+	// by the client or the recorder
+	if got, want := st[0].UpstreamCounts, (metrics.UpstreamCounts{Requests: 4, Bytes: 40}); got != want {
+		t.Errorf("upstream.test = %+v, want %+v", got, want)
+	}
+}
+
+func TestRecordTruncated(t *testing.T) {
+	sizes := map[string]int{"/small.ico": 10, "/large.ico": MaxFetchBytes + 10}
+	client := newClient(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := strings.Repeat("x", sizes[req.URL.Path])
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}))
+	rec := &Recorder{}
+	for path, size := range sizes {
+		req, _ := http.NewRequestWithContext(WithRecorder(context.Background(), rec), http.MethodGet, "https://upstream.test"+path, nil)
+		resp, err := Do(client, req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Recording does not change what the live request reads
+		if len(body) != size {
+			t.Errorf("%s: read %d bytes, want %d", path, len(body), size)
+		}
+	}
+
+	b := &Bundle{Exchanges: rec.Exchanges()}
+	for _, e := range b.Exchanges {
+		large := strings.HasSuffix(e.URL, "/large.ico")
+		if e.Truncated != large || (large && len(e.Body) != MaxFetchBytes) {
+			t.Errorf("%s: recorded %d bytes, truncated %v", e.URL, len(e.Body), e.Truncated)
+		}
+	}
+	rp := NewReplayer(b)
+	for path := range sizes {
+		req, _ := http.NewRequestWithContext(WithReplayer(context.Background(), rp), http.MethodGet, "https://upstream.test"+path, nil)
+		resp, err := Do(client, req)
+		if path == "/large.ico" {
+			if err == nil || !strings.Contains(err.Error(), "cut at") {
+				t.Errorf("replay of a truncated body: err = %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("replay of %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestWithRedirectCheck(t *testing.T) {
+	client := newClient(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader("icon"))}
+		if req.URL.Host == "allowed.test" {
+			resp.StatusCode = http.StatusFound
+			resp.Header.Set("Location", "https://elsewhere.test/icon.png")
+		}
+		return resp, nil
+	}))
+	get := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://allowed.test/icon.png", nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(context.Background()); err != nil {
+		t.Fatalf("without a check: %v", err)
+	}
+	ctx := WithRedirectCheck(context.Background(), func(u *url.URL) error {
+		if u.Hostname() != "allowed.test" {
+			return errors.New("not allowed")
+		}
+		return nil
+	})
+	if err := get(ctx); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("redirect off the allowed host: err = %v, want the check's error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"faviconsvc/internal/auth"
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/logger"
+)
+
+// AdminAuth wraps an admin endpoint so it only answers requests carrying
+// "Authorization: Bearer <token>".
+func AdminAuth(token string, h http.Handler) http.Handler {
+	return AdminAuthJWT(token, nil, "", h)
+}
+
+// AdminAuthJWT is AdminAuth that also accepts bearer tokens jwt verifies,
+// when they grant permission (403 when they do not). token may be empty to
+// accept JWTs only.
+func AdminAuthJWT(token string, jwt *auth.JWT, permission string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ok && jwt != nil {
+			p, err := jwt.Verify(got)
+			if err == nil {
+				if !p.Can(permission) {
+					auth.Forbid(w, r, p, permission)
+					return
+				}
+				ctx, st := reqctx.Ensure(r.Context())
+				st.Principal = p
+				h.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			reqctx.Debugf(r.Context(), "Admin token rejected: %v", err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeJSONError(w, http.StatusUnauthorized, "admin token required")
+	})
+}
+
+// purgeResponse is the JSON body served by AdminPurgeHandler.
+type purgeResponse struct {
+	Host    string             `json:"host"`
+	DryRun  bool               `json:"dry_run"`
+	Count   int                `json:"count"`
+	Bytes   int64              `json:"bytes"`
+	Entries []cache.PurgeEntry `json:"entries"`
+}
+
+// AdminPurgeHandler deletes the cache entries of hosts matching a glob.
+//
+// Query parameters:
+//   - host: host glob, e.g. example.com, *.example.com or example.* (required)
+//   - dry_run: 1 to list the affected entries and byte counts without
+//     deleting anything
+//
+// Deleting requires POST; a dry run may also use GET.
+func AdminPurgeHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+		if r.Method != http.MethodPost && !(dryRun && r.Method == http.MethodGet) {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "purge requires POST (GET only with dry_run=1)")
+			return
+		}
+
+		host := strings.TrimSpace(q.Get("host"))
+		entries, err := cfg.CacheManager.Purge(cache.PurgeOptions{
+			HostPattern: host,
+			DryRun:      dryRun,
+			AllVariants: true,
+		})
+		if errors.Is(err, cache.ErrBadHostPattern) {
+			writeJSONError(w, http.StatusBadRequest, "host must be a host name or glob such as *.example.com")
+			return
+		}
+
+		resp := purgeResponse{Host: host, DryRun: dryRun, Count: len(entries), Entries: entries}
+		if resp.Entries == nil {
+			resp.Entries = []cache.PurgeEntry{}
+		}
+		for _, e := range entries {
+			resp.Bytes += e.Bytes
+		}
+		if err != nil {
+			logger.Warn("Purge %s: %v", host, err)
+			writeJSONError(w, http.StatusInternalServerError, "purge incomplete: "+err.Error())
+			return
+		}
+		if !dryRun {
+			logger.Info("Purged %d cache entries (%d bytes) for %s", resp.Count, resp.Bytes, host)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	}
+}
+
+// hintRequest is the JSON body accepted by AdminHintsHandler.
+type hintRequest struct {
+	Domain string   `json:"domain"`
+	URLs   []string `json:"urls"`
+}
+
+// AdminHintsHandler manages discovery.IconHints at runtime:
+//   - GET lists every hint
+//   - PUT or POST with a JSON body {"domain": "...", "urls": ["..."]}
+//     replaces the hints for a domain
+//   - DELETE with ?domain= removes them
+//
+// Changes are kept in memory only; the hints file is not rewritten.
+func AdminHintsHandler(hints *discovery.Hints) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		switch r.Method {
+		case http.MethodGet:
+			all := hints.All()
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(map[string]any{"count": len(all), "hints": all})
+
+		case http.MethodPut, http.MethodPost:
+			var req hintRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+				return
+			}
+			if err := hints.Set(req.Domain, req.URLs); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			logger.Info("Icon hint set for %s: %v", req.Domain, req.URLs)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(hintRequest{Domain: req.Domain, URLs: hints.Lookup(req.Domain)})
+
+		case http.MethodDelete:
+			domain := r.URL.Query().Get("domain")
+			if !hints.Delete(domain) {
+				writeJSONError(w, http.StatusNotFound, "no hints for "+domain)
+				return
+			}
+			logger.Info("Icon hint removed for %s", domain)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
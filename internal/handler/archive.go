@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"faviconsvc/internal/archive"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/analytics"
+	"faviconsvc/pkg/logger"
+)
+
+// HeaderArchivedDate names the date of the snapshot or icon version served
+// for an as_of request.
+const HeaderArchivedDate = "X-Favicon-Archived-Date"
+
+// serveAsOf answers a /favicons request carrying as_of with the icon that
+// was current on that date: the latest archive snapshot taken on or before
+// it, or else the version the icon history recorded for the host at the
+// end of that day. It never touches the network; a domain with neither gets
+// the fallback icon.
+func serveAsOf(ctx context.Context, w http.ResponseWriter, r *http.Request, pageURL, asOf string, rec *analytics.Record, cfg *Config) {
+	st := reqctx.From(ctx)
+	size, format := st.Size, st.Format
+	rec.CacheTier = "archive"
+
+	day, err := time.Parse(archive.DateLayout, asOf)
+	domain := archive.DomainOf(pageURL)
+	if err != nil || domain == "" {
+		logger.Warn("Invalid as_of lookup url=%q as_of=%q", pageURL, asOf)
+		rec.Outcome = "invalid"
+		serveImageVariant(w, r, nil, size, format, time.Now(), cfg)
+		return
+	}
+	rec.Domain = domain
+
+	var (
+		data          []byte
+		ct, src, date string
+		inheritedFrom string
+		lastMod       time.Time
+	)
+	if cfg.Archive != nil {
+		meta, b, err := cfg.Archive.Lookup(ctx, domain, day)
+		switch {
+		case err == nil:
+			data, ct, src, date = b, meta.ContentType, meta.IconURL, meta.Date
+			inheritedFrom, lastMod = meta.InheritedFrom, meta.ArchivedAt
+		case !errors.Is(err, archive.ErrNotFound):
+			logger.Warn("Archive lookup %s as_of=%s: %v", domain, asOf, err)
+		}
+	}
+	if data == nil {
+		endOfDay := day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		if v, ok := cfg.CacheManager.IconVersionAt(domain, endOfDay); ok {
+			if b, ok := cfg.CacheManager.ReadHistory(v.CID); ok {
+				data, ct, src = b, http.DetectContentType(peek512(b)), v.IconURL
+				date, lastMod = v.Time.Format(archive.DateLayout), v.Time
+			}
+		}
+	}
+	if data == nil {
+		serveImageVariant(w, r, nil, size, format, time.Now(), cfg)
+		return
+	}
+
+	img, err := decodeAndResize(ctx, data, ct, src, size, cfg)
+	if err != nil {
+		logger.Warn("Icon for %s as_of=%s: %v", domain, asOf, err)
+		serveImageVariant(w, r, nil, size, format, time.Now(), cfg)
+		return
+	}
+
+	reqctx.Debugf(ctx, "as_of=%s for %s -> version of %s", asOf, domain, date)
+	rec.Outcome = "ok"
+	w.Header().Set(HeaderArchivedDate, date)
+	setCacheStatus(w, CacheReencoded)
+	if inheritedFrom != "" {
+		w.Header().Set(HeaderInheritedFrom, inheritedFrom)
+	}
+	serveImageVariant(w, r, img, size, format, lastMod, cfg)
+}
+
+// ArchiveFetcher returns an archive.Fetcher that resolves a domain's icon
+// the way /favicons does at the largest size, bypassing the candidate cache
+// so each snapshot reflects what the site served that day.
+func ArchiveFetcher(cfg *Config) archive.Fetcher {
+	return func(ctx context.Context, domain string) (archive.Icon, error) {
+		u, err := security.NormalizeURL("https://" + domain)
+		if err != nil {
+			return archive.Icon{}, err
+		}
+		ctx, st := reqctx.Ensure(ctx)
+		st.Size, st.Format = MaxSize, "png"
+		rank := pickRankingStrategy("", cfg)
+
+		_, src, inheritedFrom := discoverBestIcon(ctx, u, rank, false, cfg)
+		if src == "" {
+			return archive.Icon{}, errors.New("no icon found")
+		}
+		data, ct, ok := readCachedIconBytes(src, cfg)
+		if !ok {
+			return archive.Icon{}, fmt.Errorf("icon %s is not cached", src)
+		}
+		return archive.Icon{
+			PageURL:       u.String(),
+			IconURL:       src,
+			InheritedFrom: inheritedFrom,
+			Data:          data,
+			ContentType:   ct,
+		}, nil
+	}
+}
@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"faviconsvc/internal/batch"
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/logger"
+)
+
+// BatchResolver returns a batch.Resolver that resolves a domain's icon the
+// way /favicons does at the default size and stores the result in the
+// cache, so later /favicons requests for it are cache hits. Domains already
+// resolved are answered from the cache without touching the network.
+func BatchResolver(cfg *Config) batch.Resolver {
+	return func(ctx context.Context, domain string) batch.Result {
+		raw := domain
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, err := security.NormalizeURL(raw)
+		if err != nil {
+			return batch.Result{Error: err.Error()}
+		}
+		pageKey := discovery.CanonicalizeURLString(u.String())
+		if resolved, ok := cfg.CacheManager.ReadResolvedIcon(pageKey); ok {
+			if _, _, ok := readCachedIconBytes(resolved.IconURL, cfg); ok {
+				return batch.Result{IconURL: resolved.IconURL, InheritedFrom: resolved.InheritedFrom}
+			}
+		}
+
+		// Requests with wait join the lookup rather than repeating it
+		if _, finish := cfg.lookups.join(pageKey); finish != nil {
+			defer finish()
+		}
+		ctx, st := reqctx.Ensure(ctx)
+		st.Size, st.Format = DefaultSize, "png"
+		rank := pickRankingStrategy("", cfg)
+		best, src, inheritedFrom := discoverBestIcon(ctx, u, rank, true, cfg)
+		if best == nil {
+			if ctx.Err() != nil {
+				return batch.Result{Error: "cancelled"}
+			}
+			return batch.Result{Error: "no icon found"}
+		}
+		_ = cfg.CacheManager.WriteInheritedIcon(pageKey, src, inheritedFrom)
+		recordIconVersion(strings.ToLower(u.Hostname()), src, cfg)
+		return batch.Result{IconURL: src, InheritedFrom: inheritedFrom}
+	}
+}
+
+// batchRequest is the JSON body accepted by BatchHandler.
+type batchRequest struct {
+	Domains []string `json:"domains"`
+}
+
+// batchAccepted is the JSON body BatchHandler answers with.
+type batchAccepted struct {
+	ID         string            `json:"id"`
+	State      string            `json:"state"`
+	Submitted  int               `json:"submitted"`
+	Duplicates int               `json:"duplicates"`
+	Aliases    map[string]string `json:"aliases,omitempty"`
+	Total      int               `json:"total"`
+	StatusURL  string            `json:"status_url"`
+}
+
+// BatchHandler accepts POST {"domains": [...]} and starts an asynchronous
+// batch job, answering 202 with the job id, the URL to poll for its status,
+// and how the input entries were canonicalized and deduped.
+func BatchHandler(mgr *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "batch requires POST")
+			return
+		}
+		var req batchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		var domains []string
+		for _, d := range req.Domains {
+			if strings.TrimSpace(d) != "" {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "domains must list at least one domain")
+			return
+		}
+
+		job, err := mgr.Submit(domains)
+		if errors.Is(err, batch.ErrTooManyDomains) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("too many distinct domains in one batch (max %d)", mgr.MaxDomains()))
+			return
+		}
+		st := job.Status()
+		statusURL := "/favicons/batch/" + st.ID
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", statusURL)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(batchAccepted{
+			ID:         st.ID,
+			State:      st.State,
+			Submitted:  st.Submitted,
+			Duplicates: st.Duplicates,
+			Aliases:    st.Aliases,
+			Total:      st.Total,
+			StatusURL:  statusURL,
+		})
+	}
+}
+
+// BatchStatusHandler serves GET /favicons/batch/<id> with the job's
+// progress, per-domain results and throttling stats, and, once the job is
+// done, GET /favicons/batch/<id>/results with its result set for download:
+// the status as JSON (format=json, the default), or a zip (format=zip) of
+// that JSON plus the original icon of every resolved domain under icons/.
+// Downloads are built once and support range requests, so interrupted
+// downloads can resume.
+func BatchStatusHandler(mgr *batch.Manager, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/favicons/batch/"), "/")
+		job, ok := mgr.Get(id)
+		if !ok || (sub != "" && sub != "results") {
+			writeJSONError(w, http.StatusNotFound, "unknown batch "+id)
+			return
+		}
+		if sub == "results" {
+			serveBatchResults(w, r, mgr, job, cfg)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(job.Status())
+	}
+}
+
+func serveBatchResults(w http.ResponseWriter, r *http.Request, mgr *batch.Manager, job *batch.Job, cfg *Config) {
+	var name, ct string
+	var build func(io.Writer, batch.Status) error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		name, ct, build = "results.json", "application/json", writeBatchJSON
+	case "zip":
+		name, ct = "results.zip", "application/zip"
+		build = func(w io.Writer, st batch.Status) error { return writeBatchZip(w, st, cfg) }
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or zip")
+		return
+	}
+
+	data, built, err := mgr.Artifact(job, name, build)
+	if errors.Is(err, batch.ErrNotFinished) {
+		writeJSONError(w, http.StatusConflict, "batch is still running")
+		return
+	}
+	if err != nil {
+		logger.Warn("Batch %s %s: %v", job.Status().ID, name, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build results")
+		return
+	}
+
+	id := job.Status().ID
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", `attachment; filename="batch-`+id+`-`+name+`"`)
+	w.Header().Set("ETag", `"`+id+`-`+name+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=0")
+	http.ServeContent(w, r, name, built, bytes.NewReader(data))
+}
+
+func writeBatchJSON(w io.Writer, st batch.Status) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st)
+}
+
+// writeBatchZip writes results.json followed by icons/<domain>.<ext> with
+// the cached original of every icon the batch resolved. Icons no longer in
+// the cache are left out.
+func writeBatchZip(w io.Writer, st batch.Status, cfg *Config) error {
+	zw := zip.NewWriter(w)
+	modified := st.CreatedAt
+	if st.FinishedAt != nil {
+		modified = *st.FinishedAt
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "results.json", Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	if err := writeBatchJSON(f, st); err != nil {
+		return err
+	}
+	for _, res := range st.Results {
+		if res.IconURL == "" {
+			continue
+		}
+		data, ct, ok := readCachedIconBytes(res.IconURL, cfg)
+		if !ok {
+			continue
+		}
+		name := "icons/" + zipSafeName.Replace(res.Domain) + "." + iconExt(ct, res.IconURL)
+		// Images are already compressed
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// zipSafeName maps a canonical batch domain, which may carry a port or
+// IPv6 brackets, to a file name.
+var zipSafeName = strings.NewReplacer(":", "_", "[", "", "]", "")
+
+// iconExt picks a file extension for an icon from its sniffed content type.
+func iconExt(ct, src string) string {
+	switch {
+	case discovery.IsSVGContentType(ct, src):
+		return "svg"
+	case discovery.IsICO(ct, src):
+		return "ico"
+	}
+	mt, _, _ := mime.ParseMediaType(ct)
+	switch mt {
+	case "image/png":
+		return "png"
+	case "image/jpeg":
+		return "jpg"
+	case "image/gif":
+		return "gif"
+	case "image/webp":
+		return "webp"
+	case "image/avif":
+		return "avif"
+	case "image/bmp":
+		return "bmp"
+	}
+	return "bin"
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+
+	imgpkg "faviconsvc/internal/image"
+)
+
+// blurhashVariant is the resized-cache format an icon's BlurHash is kept
+// under, at size 0, so it expires and is purged with the icon's variants.
+const blurhashVariant = "blurhash"
+
+// setBlurhashHeader sets HeaderBlurhash to the BlurHash of the icon at
+// srcURL, if cfg.Blurhash is set and its source can be decoded.
+func setBlurhashHeader(w http.ResponseWriter, srcURL string, cfg *Config) {
+	if !cfg.Blurhash {
+		return
+	}
+	if h := iconBlurhash(srcURL, cfg); h != "" {
+		w.Header().Set(HeaderBlurhash, h)
+	}
+}
+
+// iconBlurhash returns the BlurHash of the original icon at srcURL,
+// computing and caching it on first use. It is the same for every size,
+// format and variant of the icon.
+func iconBlurhash(srcURL string, cfg *Config) string {
+	cm := cfg.CacheManager
+	if b, ok, _ := cm.ReadResizedFromCacheWithMod(srcURL, 0, blurhashVariant); ok && len(b) > 0 {
+		return string(b)
+	}
+	orig, ct, ok := readCachedIconBytes(srcURL, cfg)
+	if !ok {
+		return ""
+	}
+	img, _, err := imgpkg.Decode(orig, ct, srcURL, DefaultSize)
+	if err != nil {
+		return ""
+	}
+	h := imgpkg.Blurhash(img)
+	_ = cm.WriteResizedToCache(srcURL, 0, blurhashVariant, []byte(h))
+	return h
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"image"
+	"net/http"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+// BundleSizes are the entry sizes, smallest first, of the ICO served by
+// BundleHandler.
+var BundleSizes = []int{16, 32, 48, 64}
+
+// BundleHandler serves a site's best icon as one multi-size ICO holding a
+// BundleSizes entry each, ready to be used as a site's own /favicon.ico.
+// Discovery and caching work as for /favicons, ranking candidates for the
+// largest entry; every entry is rendered from the original source so SVG
+// icons stay crisp at each size.
+//
+// Query parameters:
+//   - url or domain: the site, as for /favicons (required)
+//   - rank: candidate ranking strategy, as for /favicons
+func BundleHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		u, err := security.NormalizeURL(pageURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+
+		largest := BundleSizes[len(BundleSizes)-1]
+		ctx, st := reqctx.Ensure(r.Context())
+		startTimings(st, cfg)
+		r = r.WithContext(ctx)
+		st.Size, st.Format = largest, "ico"
+		st.Filter = filterParam(q, cfg)
+		st.Fit = fitParam(q, cfg)
+		useCache := !st.Debug.Has(reqctx.DebugNoCache)
+		rank := pickRankingStrategy(q.Get("rank"), cfg)
+		canonPageURL := discovery.CanonicalizeURLString(u.String())
+		resolvedKey := resolvedIconKey(canonPageURL, rank)
+
+		var src, inheritedFrom, ct string
+		var orig []byte
+		cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+		resolved, ok := cfg.CacheManager.ReadResolvedIcon(resolvedKey)
+		cacheDone()
+		if ok && useCache {
+			if b, c, ok := readCachedIconBytes(resolved.IconURL, cfg); ok {
+				src, inheritedFrom, orig, ct = resolved.IconURL, resolved.InheritedFrom, b, c
+			}
+		}
+		if src == "" {
+			var best image.Image
+			best, src, inheritedFrom = discoverBestIcon(ctx, u, rank, useCache, cfg)
+			if best == nil {
+				writeJSONError(w, http.StatusNotFound, "no icon found for "+u.Hostname())
+				return
+			}
+			cacheDone = reqctx.Time(ctx, reqctx.StageCache)
+			_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, src, inheritedFrom)
+			cacheDone()
+			if rank.Name() == discovery.DefaultRankingStrategy {
+				recordIconVersion(strings.ToLower(u.Hostname()), src, cfg)
+			}
+			var ok bool
+			if orig, ct, ok = readCachedIconBytes(src, cfg); !ok {
+				writeJSONError(w, http.StatusBadGateway, "icon is no longer available")
+				return
+			}
+		}
+
+		entries := make([]image.Image, len(BundleSizes))
+		for i, size := range BundleSizes {
+			img, err := decodeAndResize(ctx, orig, ct, src, size, cfg)
+			if err != nil {
+				writeJSONError(w, http.StatusBadGateway, "icon could not be decoded")
+				return
+			}
+			entries[i], _ = imgpkg.PostProcess(img)
+		}
+		encodeDone := reqctx.Time(ctx, reqctx.StageEncode)
+		data, err := imgpkg.EncodeICO(entries...)
+		encodeDone()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "encoding failed")
+			return
+		}
+
+		reqctx.Debugf(ctx, "Bundled %s for %s", src, canonPageURL)
+		if inheritedFrom != "" {
+			w.Header().Set(HeaderInheritedFrom, inheritedFrom)
+		}
+		w.Header().Set("Content-Disposition", `inline; filename="favicon.ico"`)
+		serveBytes(w, r, data, "image/x-icon", time.Now(), RouteBundle, cfg)
+	}
+}
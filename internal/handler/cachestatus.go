@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"faviconsvc/internal/discovery"
+)
+
+// HeaderCache reports on /favicons responses where the icon served came
+// from, for debugging and for correlating with CDN logs:
+//   - HIT: the resized variant was in the cache
+//   - REENCODED: the original icon was in the cache (or the archive) and
+//     was resized and encoded again, without asking its origin
+//   - REVALIDATED: the cached original was confirmed unchanged by a
+//     conditional request to its origin, then resized and encoded
+//   - MISS: the icon was fetched from its origin
+//   - STALE: the origin could not be reached, or the deadline ran out, and
+//     an older copy of the icon was served
+//   - FALLBACK: no icon was found and the placeholder was served
+const HeaderCache = "X-Cache"
+
+// HeaderCache values.
+const (
+	CacheHit         = "HIT"
+	CacheReencoded   = "REENCODED"
+	CacheRevalidated = "REVALIDATED"
+	CacheMiss        = "MISS"
+	CacheStale       = "STALE"
+	CacheFallback    = "FALLBACK"
+)
+
+type fetchLogKey struct{}
+
+// fetchLog records, for each icon URL fetched during one request, the
+// HeaderCache value describing where fetchURLCachedWithRevalidation got
+// its bytes. Raced candidates fetch concurrently, hence the lock.
+type fetchLog struct {
+	mu     sync.Mutex
+	status map[string]string
+	lookup string // HeaderStatus of a lookup that found no icon
+}
+
+// withFetchLog returns a context under which icon fetches are logged for
+// cacheStatusOf.
+func withFetchLog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fetchLogKey{}, &fetchLog{status: make(map[string]string)})
+}
+
+// noteFetch logs status for the canonical icon URL canon, if ctx carries a
+// fetch log.
+func noteFetch(ctx context.Context, canon, status string) {
+	if l, ok := ctx.Value(fetchLogKey{}).(*fetchLog); ok {
+		l.mu.Lock()
+		l.status[canon] = status
+		l.mu.Unlock()
+	}
+}
+
+// cacheStatusOf returns the HeaderCache value for an icon loaded under ctx
+// from iconURL: what its fetch logged, or CacheMiss for icons that were
+// not fetched through the cache, such as data: URIs.
+func cacheStatusOf(ctx context.Context, iconURL string) string {
+	if l, ok := ctx.Value(fetchLogKey{}).(*fetchLog); ok {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if s, ok := l.status[discovery.CanonicalizeURLString(iconURL)]; ok {
+			return s
+		}
+	}
+	return CacheMiss
+}
+
+func setCacheStatus(w http.ResponseWriter, status string) {
+	w.Header().Set(HeaderCache, status)
+}
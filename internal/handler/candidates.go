@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sync"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+)
+
+var errBlankSVG = errors.New("svg rendered blank")
+
+// candidateResult is the outcome of fetching and decoding a single candidate.
+// A zero src means the candidate was never attempted.
+type candidateResult struct {
+	img  image.Image // resized to the requested size
+	icon discovery.RankedIcon
+	src  string
+	err  error
+
+	// Diagnostics reported by /debug/discover
+	contentType string
+	bytes       int
+	decoder     string
+}
+
+// processCandidate fetches and decodes one icon candidate and resizes it to
+// the request's size.
+func processCandidate(ctx context.Context, cand discovery.IconCandidate, cfg *Config) candidateResult {
+	size := reqctx.From(ctx).Size
+	iconURL := cand.URL
+	res := candidateResult{src: iconURL, icon: discovery.RankedIcon{Candidate: cand}}
+
+	origBytes, ct, err := loadIconBytes(ctx, iconURL, cfg)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.contentType, res.bytes = ct, len(origBytes)
+	if len(origBytes) == 0 || discovery.LooksLikeHTML(origBytes, ct) {
+		res.err = errors.New("not an image")
+		return res
+	}
+
+	dec := decodeIcon(ctx, origBytes, ct, iconURL, size, cfg)
+	if dec.err != nil {
+		reqctx.Debugf(ctx, "Decode failed for %s: %v", iconURL, dec.err)
+		res.err = dec.err
+		return res
+	}
+	res.decoder = dec.dec.Name
+	if dec.dec.Vector {
+		if dec.blank {
+			reqctx.Debugf(ctx, "%s rendered as blank for %s, skipping", dec.dec.Name, iconURL)
+			res.err = errBlankSVG
+			return res
+		}
+		res.icon.Vector = true
+	} else {
+		res.icon.Width, res.icon.Height = dec.source.Dx(), dec.source.Dy()
+	}
+
+	res.img = dec.img
+	return res
+}
+
+// selectBestCandidate fetches candidates and returns the image, resized to the
+// request's size, that scores highest under rank, along with its URL.
+func selectBestCandidate(ctx context.Context, candidates []discovery.IconCandidate, rank discovery.RankingStrategy, cfg *Config) (image.Image, string) {
+	results := raceCandidates(ctx, candidates, rank, cfg)
+	if i := bestResult(results, rank, reqctx.From(ctx).Size); i >= 0 {
+		return results[i].img, results[i].src
+	}
+	return nil, ""
+}
+
+// raceCandidates fetches and decodes candidates, returning one result per
+// candidate in the same order. Up to cfg.ParallelFetches candidates are
+// fetched concurrently in rank order; once one is sufficient for the
+// strategy, outstanding fetches are cancelled and the rest are skipped.
+func raceCandidates(ctx context.Context, candidates []discovery.IconCandidate, rank discovery.RankingStrategy, cfg *Config) []candidateResult {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	workers := cfg.ParallelFetches
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(candidates) {
+		workers = len(candidates)
+	}
+	size := reqctx.From(ctx).Size
+	goodEnough := cfg.GoodEnoughSize
+	if goodEnough <= 0 {
+		goodEnough = size
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]candidateResult, len(candidates))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				// The dispatcher may hand out one more candidate after the
+				// search stopped; leave it unfetched
+				if fetchCtx.Err() != nil {
+					continue
+				}
+				res := processCandidate(fetchCtx, candidates[idx], cfg)
+				results[idx] = res
+				if res.err == nil && rank.Sufficient(res.icon, size, goodEnough) {
+					cancel()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range candidates {
+		select {
+		case next <- i:
+		case <-fetchCtx.Done():
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// bestResult returns the index of the highest-scoring usable result, or -1.
+// Ties go to the earlier candidate in fetch order.
+func bestResult(results []candidateResult, rank discovery.RankingStrategy, size int) int {
+	best := -1
+	var bestScore int64
+	for i, res := range results {
+		if res.err != nil || res.img == nil {
+			continue
+		}
+		if score := rank.Score(res.icon, size); best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
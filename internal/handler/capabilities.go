@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	imgpkg "faviconsvc/internal/image"
+)
+
+// codecInfo is one encoder or decoder in the CapabilitiesHandler response.
+type codecInfo struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type,omitempty"`
+	Vector      bool   `json:"vector,omitempty"`
+	Fallback    bool   `json:"fallback,omitempty"`
+	Available   bool   `json:"available"`
+	Disabled    bool   `json:"disabled,omitempty"`
+}
+
+// CapabilitiesHandler lists the output formats and input decoders of this
+// process as detected at run time, with those turned off by configuration
+// (see imgpkg.SetDisabledFormats) or not working here, such as an AVIF
+// encoder whose library failed to load, marked unavailable. Clients can
+// use it to pick a format parameter the service will honour.
+func CapabilitiesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encs, decs := imgpkg.Codecs()
+		resp := struct {
+			Encoders []codecInfo `json:"encoders"`
+			Decoders []codecInfo `json:"decoders"`
+		}{Encoders: []codecInfo{}, Decoders: []codecInfo{}}
+		for _, c := range encs {
+			resp.Encoders = append(resp.Encoders, codecInfo{Name: c.Name, ContentType: c.ContentType, Available: c.Available, Disabled: c.Disabled})
+		}
+		for _, c := range decs {
+			resp.Decoders = append(resp.Decoders, codecInfo{Name: c.Name, Vector: c.Vector, Fallback: c.Fallback, Available: c.Available, Disabled: c.Disabled})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
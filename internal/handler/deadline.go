@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/analytics"
+)
+
+// HeaderDeadlineStatus reports, on /favicons responses to requests with a
+// deadline (X-Deadline-Ms or -request-budget), how the deadline was met:
+//   - met: the response is what the request would have got without one
+//   - stale: the deadline expired during discovery and the last icon the
+//     history recorded for the host was served instead
+//   - fallback: the deadline expired and there was nothing to serve but the
+//     fallback icon
+const HeaderDeadlineStatus = "X-Favicon-Deadline"
+
+// deadlineExpired reports whether discovery under ctx was cut short by the
+// request's deadline rather than finding nothing.
+func deadlineExpired(ctx context.Context) bool {
+	return !reqctx.From(ctx).Deadline.IsZero() && ctx.Err() == context.DeadlineExceeded
+}
+
+// serveStale answers a request whose deadline expired during discovery with
+// the latest icon version recorded for host, however old. It reports false
+// when the history has none, leaving the response unwritten.
+func serveStale(ctx context.Context, w http.ResponseWriter, r *http.Request, host string, rec *analytics.Record, cfg *Config) bool {
+	v, ok := cfg.CacheManager.IconVersionAt(host, time.Now())
+	if !ok {
+		return false
+	}
+	b, ok := cfg.CacheManager.ReadHistory(v.CID)
+	if !ok {
+		return false
+	}
+	st := reqctx.From(ctx)
+	img, err := decodeAndResize(ctx, b, http.DetectContentType(peek512(b)), v.IconURL, st.Size, cfg)
+	if err != nil {
+		return false
+	}
+
+	reqctx.Debugf(ctx, "Deadline expired for %s, serving version of %s", host, v.Time.Format(time.RFC3339))
+	rec.CacheTier, rec.Outcome = "history", "stale"
+	w.Header().Set(HeaderDeadlineStatus, "stale")
+	setCacheStatus(w, CacheStale)
+	serveImageVariant(w, r, img, st.Size, st.Format, v.Time, cfg)
+	return true
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+// Candidate statuses reported by /debug/discover.
+const (
+	traceSelected = "selected" // served for this request
+	traceUsable   = "usable"   // decoded fine but scored lower
+	traceRejected = "rejected" // fetch or decode failed
+	traceSkipped  = "skipped"  // never fetched; the search had already stopped
+)
+
+// traceCandidate is one discovered candidate and what became of it.
+type traceCandidate struct {
+	URL         string `json:"url"`
+	Source      string `json:"source"`
+	Type        string `json:"type,omitempty"`
+	Sizes       []int  `json:"sizes,omitempty"`
+	RelRank     int    `json:"rel_rank"`
+	FormatRank  int    `json:"format_rank"`
+	SizeScore   int    `json:"size_score"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	Decoder     string `json:"decoder,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Vector      bool   `json:"vector,omitempty"`
+	Score       *int64 `json:"score,omitempty"`
+}
+
+// traceStage is one discovery pass: hinted icon URLs, the requested page,
+// then its apex domain.
+type traceStage struct {
+	Page       string           `json:"page"`
+	Hint       bool             `json:"hint,omitempty"`
+	Apex       bool             `json:"apex,omitempty"`
+	DurationMs float64          `json:"duration_ms"`
+	Candidates []traceCandidate `json:"candidates"`
+}
+
+type discoverTrace struct {
+	URL           string       `json:"url"`
+	Size          int          `json:"size"`
+	Rank          string       `json:"rank"`
+	Selected      string       `json:"selected,omitempty"`
+	InheritedFrom string       `json:"inherited_from,omitempty"`
+	Fallback      bool         `json:"fallback"`
+	Stages        []traceStage `json:"stages"`
+}
+
+// DebugDiscoverHandler runs discovery for a page without the resolved-icon
+// and candidate caches and returns a JSON trace of every candidate: where
+// it was found, how fetching and decoding went, and why it was selected or
+// rejected. It answers "why does this domain get the fallback icon?"
+// without reading server logs.
+//
+// Query parameters match /favicons: url or domain, sz or size, and rank.
+func DebugDiscoverHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		u, err := security.NormalizeURL(pageURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+
+		size := sizeParam(q, DefaultSize)
+		ctx, st := reqctx.Ensure(r.Context())
+		st.Size, st.Format = size, pickFormat(r)
+		rank := pickRankingStrategy(q.Get("rank"), cfg)
+
+		trace := discoverTrace{
+			URL:  discovery.CanonicalizeURLString(u.String()),
+			Size: size,
+			Rank: rank.Name(),
+		}
+		var selected string
+		if hints := discovery.HintCandidates(u); len(hints) > 0 {
+			var stage traceStage
+			stage, selected = traceCandidates(ctx, u, hints, rank, cfg, time.Now())
+			stage.Hint = true
+			trace.Stages = append(trace.Stages, stage)
+		}
+		if selected == "" && ctx.Err() == nil {
+			var stage traceStage
+			stage, selected = traceDiscovery(ctx, u, rank, cfg)
+			trace.Stages = append(trace.Stages, stage)
+		}
+		if selected == "" && ctx.Err() == nil {
+			if apex := discovery.ApexURL(u); apex != nil {
+				var stage traceStage
+				stage, selected = traceDiscovery(ctx, apex, rank, cfg)
+				stage.Apex = true
+				trace.Stages = append(trace.Stages, stage)
+				if selected != "" {
+					trace.InheritedFrom = apex.Hostname()
+				}
+			}
+		}
+		trace.Selected = selected
+		trace.Fallback = selected == ""
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(trace)
+	}
+}
+
+// traceDiscovery discovers and races candidates for one page exactly as a
+// favicon request would, returning the trace and the selected icon URL.
+func traceDiscovery(ctx context.Context, u *url.URL, rank discovery.RankingStrategy, cfg *Config) (traceStage, string) {
+	start := time.Now()
+	size := reqctx.From(ctx).Size
+	cands := discovery.DiscoverFromPageThenRoot(ctx, u, size)
+	rank.Order(cands, size)
+	return traceCandidates(ctx, u, cands, rank, cfg, start)
+}
+
+// traceCandidates races cands for the page u and traces the outcome of each.
+func traceCandidates(ctx context.Context, u *url.URL, cands []discovery.IconCandidate, rank discovery.RankingStrategy, cfg *Config, start time.Time) (traceStage, string) {
+	size := reqctx.From(ctx).Size
+	results := raceCandidates(ctx, cands, rank, cfg)
+	best := bestResult(results, rank, size)
+
+	stage := traceStage{
+		Page:       discovery.CanonicalizeURLString(u.String()),
+		Candidates: make([]traceCandidate, 0, len(cands)),
+	}
+	for i, c := range cands {
+		tc := traceCandidate{
+			URL:        traceURL(c.URL),
+			Source:     c.Source,
+			Type:       c.Type,
+			Sizes:      c.Sizes,
+			RelRank:    c.RelRank,
+			FormatRank: c.FormatRank,
+			SizeScore:  c.SizeScore,
+		}
+		var res candidateResult
+		if i < len(results) {
+			res = results[i]
+		}
+		tc.ContentType, tc.Bytes, tc.Decoder = res.contentType, res.bytes, res.decoder
+		tc.Width, tc.Height, tc.Vector = res.icon.Width, res.icon.Height, res.icon.Vector
+
+		switch {
+		case res.src == "":
+			tc.Status, tc.Reason = traceSkipped, "search stopped after a sufficient candidate"
+		case errors.Is(res.err, context.Canceled):
+			tc.Status, tc.Reason = traceSkipped, "cancelled after a sufficient candidate"
+		case res.err != nil:
+			tc.Status, tc.Reason = traceRejected, res.err.Error()
+		default:
+			score := rank.Score(res.icon, size)
+			tc.Score = &score
+			if i == best {
+				tc.Status, tc.Reason = traceSelected, fmt.Sprintf("highest %s score", rank.Name())
+			} else {
+				tc.Status, tc.Reason = traceUsable, "lower score than the selected icon"
+			}
+		}
+		stage.Candidates = append(stage.Candidates, tc)
+	}
+	stage.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if best < 0 {
+		return stage, ""
+	}
+	return stage, results[best].src
+}
+
+// traceURL shortens inline data URIs, which can be kilobytes long.
+func traceURL(s string) string {
+	const max = 80
+	if discovery.IsDataURI(s) && len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
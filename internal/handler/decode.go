@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"hash/crc32"
+	"image"
+	"strconv"
+	"sync"
+
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/metrics"
+)
+
+// decodedIcon is an icon decoded and resized for a request.
+type decodedIcon struct {
+	img    image.Image // resized to the request's size
+	source image.Rectangle
+	dec    imgpkg.Decoder
+	blank  bool // a vector that rendered completely blank
+	err    error
+}
+
+// decodeGroup coalesces concurrent decodes of the same icon bytes at the
+// same size. Responses in AVIF, WebP or PNG only differ in the encode, so
+// clients sending different Accept headers share the decode and resize
+// and only encode their format themselves. The images are shared, so
+// nothing may draw on them; variants and encoders only read them.
+type decodeGroup struct {
+	mu      sync.Mutex
+	running map[string]*decodeCall
+}
+
+type decodeCall struct {
+	done chan struct{}
+	res  decodedIcon
+}
+
+func newDecodeGroup() *decodeGroup {
+	return &decodeGroup{running: make(map[string]*decodeCall)}
+}
+
+// do returns the result of decode for key, running it unless a call for
+// key is already running, and reports whether the result was shared.
+func (g *decodeGroup) do(key string, decode func() decodedIcon) (decodedIcon, bool) {
+	g.mu.Lock()
+	if c, ok := g.running[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.res, true
+	}
+	c := &decodeCall{done: make(chan struct{})}
+	g.running[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.running, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.res = decode()
+	return c.res, false
+}
+
+// decodeIcon decodes icon bytes b and resizes them to size as the request
+// asks, sharing the work with concurrent requests for the same bytes,
+// size and resize options.
+func decodeIcon(ctx context.Context, b []byte, ct, srcURL string, size int, cfg *Config) decodedIcon {
+	defer reqctx.Time(ctx, reqctx.StageDecode)()
+	decode := func() decodedIcon {
+		img, dec, err := imgpkg.Decode(b, ct, srcURL, size)
+		if err != nil {
+			return decodedIcon{err: err}
+		}
+		res := decodedIcon{source: img.Bounds(), dec: dec}
+		// Only skip if the image is completely blank (all white/transparent)
+		// Don't skip black/dark SVGs as they might be valid (e.g., GitHub logo)
+		res.blank = dec.Vector && imgpkg.IsNearlyBlank(img)
+		res.img = resizeIcon(ctx, img, size)
+		return res
+	}
+	if cfg.decodes == nil {
+		return decode()
+	}
+	// The bytes are part of the key, so only identical sources are shared
+	key := srcURL + " " + ct + " " + strconv.Itoa(size) + resizeKey(reqctx.From(ctx)) + " " +
+		strconv.FormatUint(uint64(crc32.Checksum(b, castagnoli)), 16) + "-" + strconv.Itoa(len(b))
+	res, shared := cfg.decodes.do(key, decode)
+	metrics.Get().IncDecode(shared)
+	if shared {
+		reqctx.Debugf(ctx, "Shared the decode of %s at %d px", srcURL, size)
+	}
+	return res
+}
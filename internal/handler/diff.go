@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+// DefaultDiffSize is the edge length icons are compared at.
+const DefaultDiffSize = 64
+
+// diffResponse is the JSON body served by DiffHandler.
+type diffResponse struct {
+	URL           string  `json:"url"`
+	IconURL       string  `json:"icon_url"`
+	InheritedFrom string  `json:"inherited_from,omitempty"`
+	Old           string  `json:"old"`
+	Current       string  `json:"current"`
+	Changed       bool    `json:"changed"`
+	Similarity    float64 `json:"similarity"`
+	ChangedPixels float64 `json:"changed_pixels"`
+	Size          int     `json:"size"`
+	Composite     string  `json:"composite"`
+}
+
+// DiffHandler compares an earlier version of a site's icon with the one it
+// serves now and returns a similarity score and a side-by-side composite
+// (old, current, difference mask) as a PNG data URI.
+//
+// Query parameters:
+//   - url or domain: the site, as for /favicons
+//   - old: CID of the earlier icon version, as returned in "current" by a
+//     previous diff or listed by the CID export (required)
+//   - sz or size: comparison size in pixels (default: 64)
+//   - rank: candidate ranking strategy, as for /favicons
+func DiffHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		old := strings.TrimSpace(q.Get("old"))
+		if !cache.ValidCID(old) {
+			writeJSONError(w, http.StatusBadRequest, "old must be an icon CID")
+			return
+		}
+
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		u, err := security.NormalizeURL(pageURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+
+		size := sizeParam(q, DefaultDiffSize)
+
+		ctx, st := reqctx.Ensure(r.Context())
+		st.Size, st.Format = size, "png"
+		useCache := !st.Debug.Has(reqctx.DebugNoCache)
+		rank := pickRankingStrategy(q.Get("rank"), cfg)
+
+		// Bypass the resolved-icon cache; the point is to see what the site serves today
+		_, src, inheritedFrom := discoverBestIcon(ctx, u, rank, useCache, cfg)
+		if src == "" {
+			writeJSONError(w, http.StatusNotFound, "no icon found for "+u.Hostname())
+			return
+		}
+		curBytes, curCT, ok := readCachedIconBytes(src, cfg)
+		if !ok {
+			writeJSONError(w, http.StatusBadGateway, "current icon is no longer available")
+			return
+		}
+
+		resp := diffResponse{
+			URL:           discovery.CanonicalizeURLString(u.String()),
+			IconURL:       src,
+			InheritedFrom: inheritedFrom,
+			Old:           old,
+			Current:       cache.ContentCID(curBytes),
+			Size:          size,
+		}
+		resp.Changed = resp.Current != old
+
+		oldBytes := curBytes
+		if resp.Changed {
+			if oldBytes, ok = cfg.CacheManager.ReadHistory(old); !ok {
+				writeJSONError(w, http.StatusNotFound, "unknown or expired icon version "+old)
+				return
+			}
+		}
+
+		curImg, _, err := imgpkg.Decode(curBytes, curCT, src, size)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, "decode current icon: "+err.Error())
+			return
+		}
+		oldImg, _, err := imgpkg.Decode(oldBytes, http.DetectContentType(peek512(oldBytes)), "", size)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "decode old icon: "+err.Error())
+			return
+		}
+
+		diff := imgpkg.CompareImages(oldImg, curImg, size)
+		resp.Similarity, resp.ChangedPixels = diff.Similarity, diff.Changed
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, imgpkg.DiffComposite(oldImg, curImg, size)); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "encode composite: "+err.Error())
+			return
+		}
+		resp.Composite = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"faviconsvc/internal/reqctx"
+)
+
+// MaxDPR caps the device pixel ratio a request may ask for.
+const MaxDPR = 4
+
+// HeaderContentDPR tells clients the ratio of image pixels to CSS pixels of
+// a response rendered for a device pixel ratio, so it is laid out at its
+// logical size.
+const HeaderContentDPR = "Content-DPR"
+
+// headerClientDPR is the client hint of the device pixel ratio, honoured
+// with Config.DPRClientHints.
+const headerClientDPR = "Sec-CH-DPR"
+
+// dprParam returns the device pixel ratio of the request: its dpr query
+// parameter (e.g. 2, 1.5 or 2x) or, with Config.DPRClientHints and no
+// parameter, its Sec-CH-DPR header, clamped to [1, MaxDPR]. Missing or
+// invalid values give 1.
+func dprParam(r *http.Request, cfg *Config) float64 {
+	raw := strings.TrimSpace(r.URL.Query().Get("dpr"))
+	if raw == "" && cfg.DPRClientHints {
+		raw = strings.TrimSpace(r.Header.Get(headerClientDPR))
+	}
+	dpr, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(raw), "x"), 64)
+	if err != nil || math.IsNaN(dpr) {
+		return 1
+	}
+	return min(max(dpr, 1), MaxDPR)
+}
+
+// applyDPR scales the request's logical size (st.Size, and st.Height of a
+// WxH target) to device pixels at the request's dpr, capped at MaxSize,
+// and records the ratio reached in st.DPR for HeaderContentDPR. It returns
+// the size to render.
+func applyDPR(r *http.Request, st *reqctx.State, cfg *Config) int {
+	dpr := dprParam(r, cfg)
+	if dpr == 1 {
+		return st.Size
+	}
+	logical := st.Size
+	if st.Height > st.Size {
+		logical = st.Height
+	}
+	// The longer edge sets the ratio, so both keep the aspect ratio
+	dpr = min(dpr, float64(MaxSize)/float64(logical))
+	if dpr <= 1 {
+		return st.Size
+	}
+	st.Size = int(math.Round(float64(st.Size) * dpr))
+	if st.Height > 0 {
+		st.Height = int(math.Round(float64(st.Height) * dpr))
+	}
+	st.DPR = dpr
+	return st.Size
+}
+
+// setDPRHeaders sets HeaderContentDPR on a response rendered for a device
+// pixel ratio and, with Config.DPRClientHints, asks for the hint and
+// declares that responses depend on it.
+func setDPRHeaders(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	if cfg.DPRClientHints {
+		w.Header().Set("Accept-CH", headerClientDPR)
+		w.Header().Add("Vary", headerClientDPR)
+	}
+	if dpr := reqctx.From(r.Context()).DPR; dpr > 1 {
+		w.Header().Set(HeaderContentDPR, strconv.FormatFloat(math.Round(dpr*100)/100, 'f', -1, 64))
+	}
+}
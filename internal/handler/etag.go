@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ETag hash algorithms (see Config.ETagHash).
+const (
+	// ETagSHA256 is the first 128 bits of the body's SHA-256
+	ETagSHA256 = "sha256"
+	// ETagCRC32C is the body's CRC-32C and length. It is computed in
+	// hardware on most CPUs, many times faster than SHA-256, and is plenty
+	// to tell the versions of one response apart; ETags are not compared
+	// across URLs
+	ETagCRC32C = "crc32c"
+)
+
+// ETagHashes lists the algorithms Config.ETagHash accepts.
+var ETagHashes = []string{ETagSHA256, ETagCRC32C}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// makeETag returns the entity tag of a response body under cfg.ETagHash,
+// weak when cfg.WeakETag is set.
+func makeETag(b []byte, cfg *Config) string {
+	var tag string
+	switch cfg.ETagHash {
+	case ETagCRC32C:
+		tag = strconv.FormatUint(uint64(crc32.Checksum(b, castagnoli)), 16) + "-" + strconv.FormatInt(int64(len(b)), 16)
+	default:
+		s := sha256.Sum256(b)
+		tag = hex.EncodeToString(s[:16])
+	}
+	if cfg.WeakETag {
+		return `W/"` + tag + `"`
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag:
+// it is "*" or lists etag, compared weakly as RFC 9110 §13.1.2 requires,
+// so weak and strong forms of one tag match.
+func etagMatches(inm, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the conditional headers of r let a 200
+// response tagged etag and last modified at lastMod be answered with 304
+// Not Modified. As RFC 9110 §13.2.2 orders them, If-None-Match takes
+// precedence, and If-Modified-Since only applies to GET and HEAD requests
+// without it. With ETags off, If-None-Match is ignored.
+func notModified(r *http.Request, etag string, lastMod time.Time, cfg *Config) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" && cfg.UseETag {
+		return etagMatches(inm, etag)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastMod.IsZero() {
+		return false
+	}
+	// Last-Modified has a resolution of seconds
+	return !lastMod.Truncate(time.Second).After(ims)
+}
@@ -6,27 +6,72 @@ package handler
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"image"
+	"image/color"
 	"image/png"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"faviconsvc/internal/archive"
 	"faviconsvc/internal/cache"
 	"faviconsvc/internal/discovery"
 	"faviconsvc/internal/fetch"
 	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
 	"faviconsvc/internal/security"
+	"faviconsvc/pkg/analytics"
+	"faviconsvc/pkg/loadctl"
 	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
 )
 
 const (
 	DefaultSize = 32
 	MinSize     = 16
 	MaxSize     = 256
+
+	// DefaultParallelFetches is the default number of candidates raced concurrently
+	DefaultParallelFetches = 4
+
+	// DefaultMaxVariantsPerDomain is the default Config.MaxVariantsPerDomain
+	DefaultMaxVariantsPerDomain = 64
+	// DefaultMaxVariantDomains is the default Config.MaxVariantDomains
+	DefaultMaxVariantDomains = 100000
+
+	// DefaultNotFoundTTL and DefaultUnavailableTTL are the default
+	// Config.NotFoundTTL and Config.UnavailableTTL
+	DefaultNotFoundTTL    = 6 * time.Hour
+	DefaultUnavailableTTL = time.Minute
+
+	// HeaderInheritedFrom names the apex host an icon was borrowed from when
+	// the requested host had none of its own
+	HeaderInheritedFrom = "X-Favicon-Inherited-From"
+
+	// HeaderContentHash carries the CID of the original icon a response was
+	// rendered from, and HeaderCacheKey the cache key of the variant served
+	// (see Config.ExposeCacheInfo)
+	HeaderContentHash = "X-Icon-Content-Hash"
+	HeaderCacheKey    = "X-Cache-Key"
+
+	// HeaderPerceptualHash carries the perceptual hash of that icon, equal
+	// for icons that look the same (see Config.ExposeCacheInfo)
+	HeaderPerceptualHash = "X-Icon-Perceptual-Hash"
+
+	// HeaderBlurhash carries the BlurHash of the icon a response was
+	// rendered from (see Config.Blurhash)
+	HeaderBlurhash = "X-Icon-Blurhash"
+
+	// HeaderServerTiming carries the time a response spent per pipeline
+	// stage (see Config.ServerTiming)
+	HeaderServerTiming = "Server-Timing"
+
+	// HeaderIconFallback is "true" on responses serving the placeholder
+	// because no icon was found (see Config.FallbackStatus)
+	HeaderIconFallback = "X-Icon-Fallback"
 )
 
 // Config holds configuration for the favicon handler.
@@ -36,18 +81,120 @@ type Config struct {
 	BrowserMaxAge   time.Duration
 	CDNSMaxAge      time.Duration
 	UseETag         bool
+	// ETagHash is the algorithm ETags are computed with (one of
+	// ETagHashes; "" = ETagSHA256), and WeakETag marks them weak, for
+	// CDNs that only need to revalidate
+	ETagHash        string
+	WeakETag        bool
+	// ParallelFetches bounds how many candidates are fetched concurrently (1 = sequential)
+	ParallelFetches int
+	// GoodEnoughSize is the edge length at which a decoded candidate stops the
+	// search early (0 = requested size)
+	GoodEnoughSize  int
+	// TrustDeclaredSizes stops the search at the first candidate to decode
+	// whose declared sizes suffice, fetching those first (see
+	// discovery.TrustDeclaredSizes)
+	TrustDeclaredSizes bool
+	// Analytics receives one row per favicon request (nil = disabled)
+	Analytics       *analytics.Store
+	// Ranking names the default candidate RankingStrategy ("" = largest);
+	// requests may override it with the rank query parameter
+	Ranking         string
+	// Archive serves dated snapshots for requests with as_of (nil = disabled)
+	Archive         *archive.Archive
+	// SpeculativeRootFetch fetches a host's /favicon.ico while its page is
+	// still being discovered
+	SpeculativeRootFetch bool
+	// ResampleFilter is the default resampling filter (one of
+	// imgpkg.Filters; "" = auto); requests may override it with filter
+	ResampleFilter string
+	// Fit is the default fit mode for non-square icons (one of
+	// imgpkg.Fits; "" = stretch); requests may override it with fit
+	Fit string
+	// FallbackStyle is the placeholder served when no icon is found:
+	// imgpkg.FallbackGlobe ("" too), imgpkg.FallbackLetter or
+	// imgpkg.FallbackErrorImage; requests may override it with fallback
+	FallbackStyle string
+	// FallbackStatus is the status of placeholder responses:
+	// http.StatusOK (0 too) or http.StatusNotFound, with the placeholder
+	// as the body either way; requests may override it with
+	// fallback_status
+	FallbackStatus int
+	// ExposeCacheInfo adds HeaderContentHash, HeaderPerceptualHash and
+	// HeaderCacheKey to icon responses, so clients can dedupe by content
+	// and match responses to /admin/purge entries
+	ExposeCacheInfo bool
+	// Blurhash adds HeaderBlurhash to icon responses and a blurhash field
+	// to multi-size JSON ones, for clients to show a placeholder while
+	// the icon loads
+	Blurhash        bool
+	// ResponseHeaders are static headers added to icon responses per
+	// route class, e.g. CDN routing headers or Timing-Allow-Origin
+	ResponseHeaders ResponseHeaders
+	// DedupVariants stores byte-identical resized variants of different
+	// icons once, keyed by their digest (see cache.Manager.WriteResizedShared)
+	DedupVariants   bool
+	// ServerTiming adds HeaderServerTiming to icon responses, with the
+	// durations of discovery, fetch, decode, encode and cache work
+	ServerTiming    bool
+	// NotFoundTTL is how long a lookup that found no usable icon is
+	// remembered, and UnavailableTTL one that failed on transient upstream
+	// errors such as 5xx responses and timeouts (0 = not remembered)
+	NotFoundTTL    time.Duration
+	UnavailableTTL time.Duration
+	// MaxVariantsPerDomain caps the resized variants (size and format
+	// key) cached per domain; past it, new sizes are snapped to the
+	// nearest cached one (0 = unlimited)
+	MaxVariantsPerDomain int
+	// MaxVariantDomains caps the domains whose variants are counted for
+	// MaxVariantsPerDomain; past it, variants of new domains are served
+	// but not cached until others expire (0 = DefaultMaxVariantDomains)
+	MaxVariantDomains int
+	// ProxyAllow lists the hosts ProxyHandler serves images from, each
+	// with its subdomains (empty = proxy disabled), and ProxyMaxBytes
+	// caps the size of those images (0 = fetch.MaxFetchBytes)
+	ProxyAllow    []string
+	ProxyMaxBytes int64
+	// DefaultImageAllow lists the hosts, each with its subdomains, whose
+	// images requests may name with default to replace the placeholder
+	// (empty = only default=404 is honoured)
+	DefaultImageAllow []string
+	// DPRClientHints takes the device pixel ratio of requests without a
+	// dpr parameter from their Sec-CH-DPR header, and asks for it with
+	// Accept-CH
+	DPRClientHints bool
+	// Tenants holds per-tenant branding: fallback image, letter-tile
+	// palette and default size and format (nil = none)
+	Tenants *TenantStore
+	// UpstreamHeaders lists the headers of the origin's icon response
+	// passed through to clients, UpstreamLastModified and UpstreamETag
+	// (empty = service-generated values only)
+	UpstreamHeaders []string
 	fetchGroup      *cache.Group // Prevents thundering herd
+	decodes         *decodeGroup // Shares decodes across output formats
+	variants        *variantLimiter
+	lookups         *lookupTracker
 }
 
 // NewConfig creates a new handler configuration with the specified settings.
 // It also initializes the singleflight group for request deduplication.
 func NewConfig(cm *cache.Manager, browserMaxAge, cdnSMaxAge time.Duration, useETag bool) *Config {
 	return &Config{
-		CacheManager:  cm,
-		BrowserMaxAge: browserMaxAge,
-		CDNSMaxAge:    cdnSMaxAge,
-		UseETag:       useETag,
-		fetchGroup:    cache.NewGroup(),
+		CacheManager:    cm,
+		BrowserMaxAge:   browserMaxAge,
+		CDNSMaxAge:      cdnSMaxAge,
+		UseETag:         useETag,
+		ParallelFetches: DefaultParallelFetches,
+		SpeculativeRootFetch: true,
+		DedupVariants:   true,
+		MaxVariantsPerDomain: DefaultMaxVariantsPerDomain,
+		NotFoundTTL:     DefaultNotFoundTTL,
+		UnavailableTTL:  DefaultUnavailableTTL,
+		ProxyMaxBytes:   DefaultProxyMaxBytes,
+		fetchGroup:      cache.NewGroup(),
+		decodes:         newDecodeGroup(),
+		variants:        newVariantLimiter(),
+		lookups:         newLookupTracker(),
 	}
 }
 
@@ -57,10 +204,44 @@ func NewConfig(cm *cache.Manager, browserMaxAge, cdnSMaxAge time.Duration, useET
 //
 // Query parameters:
 //   - url or domain: Website URL or domain name (required)
-//   - sz or size: Output size in pixels (16-256, default: 32)
+//   - sz or size: Output size in pixels (16-256, default: 32), a
+//     comma-separated list of sizes answered in one response (see
+//     serveSizes), or WxH for a non-square image, e.g. 64x40
+//   - dpr: Device pixel ratio (1-4) the size is multiplied by, e.g.
+//     sz=32&dpr=2 for a 64px image laid out at 32px (see applyDPR)
+//   - rank: Candidate ranking strategy (largest, closest-size, vector-first)
+//   - format: Output format by encoder name (e.g. ico, jpeg or jpg),
+//     overriding Accept
+//   - theme: dark or light, adapting icons that would vanish on that
+//     background (see imgpkg.ApplyTheme)
+//   - mono: 1 turns the icon into a silhouette in the colour given by
+//     color, overriding theme (see imgpkg.Monochrome)
+//   - mask: circle, rounded or squircle, clipping the icon to that shape
+//     with transparent corners; radius sets the rounded mask's corner
+//     radius in percent of the edge (see imgpkg.ParseMask)
+//   - pad: trim the icon to its content and re-pad it by this margin,
+//     e.g. 10%; trim=1 trims without margin (see imgpkg.Normalize)
+//   - filter: Resampling filter (auto, nearest, bilinear, catmullrom,
+//     lanczos, fast), overriding Config.ResampleFilter
+//   - q: Encoder quality for lossy formats (jpeg, avif), 1-100
+//   - fit: How a non-square icon is made square (stretch, contain,
+//     cover), overriding Config.Fit; ignored with pad or trim
+//   - fallback: Placeholder when no icon is found (globe, letter,
+//     error-image), overriding Config.FallbackStyle
+//   - fallback_status: Status of placeholder responses (200, 404),
+//     overriding Config.FallbackStatus
+//   - default: Image served instead of the placeholder, on a host in
+//     Config.DefaultImageAllow, or 404 (see defaultImage)
+//   - wait: Look the page up in the background and wait up to this long
+//     (e.g. 5s, at most MaxWait) for the icon, serving the placeholder if
+//     it is not ready by then (see awaitLookup)
+//   - as_of: Serve the icon that was current on this date (YYYY-MM-DD)
+//     from the archive or icon history instead of the live one
+//   - response_type: redirect answers with a 302 to the original icon URL
+//     instead of the icon (see serveRedirect)
 //
 // Response headers:
-//   - Content-Type: image/png or image/webp
+//   - Content-Type: image/png, image/webp, image/avif, image/x-icon or image/gif
 //   - Cache-Control: Public caching directives
 //   - ETag: Entity tag for conditional requests
 //   - Last-Modified: Last modification time
@@ -68,227 +249,924 @@ func NewConfig(cm *cache.Manager, browserMaxAge, cdnSMaxAge time.Duration, useET
 func FaviconHandler(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-
-		// Parse size parameter
-		szStr := r.URL.Query().Get("sz")
-		if szStr == "" {
-			szStr = r.URL.Query().Get("size")
-		}
-		size := DefaultSize
-		if n, err := strconv.Atoi(szStr); err == nil {
-			if n < MinSize {
-				n = MinSize
+		start := time.Now()
+		rec := analytics.Record{Time: start, CacheTier: "none", Outcome: "fallback"}
+		defer func() {
+			rec.Latency = time.Since(start)
+			metrics.Get().ObserveRequest(rec.CacheTier, rec.Latency)
+			loadctl.Get().ObserveLatency(rec.Latency)
+			if cfg.Analytics != nil {
+				cfg.Analytics.Record(rec)
 			}
-			if n > MaxSize {
-				n = MaxSize
-			}
-			size = n
+		}()
+
+		// Clients debugging their requests may ask for errors as JSON
+		problems := wantsProblems(r)
+		if p := sizeProblem(r.URL.Query()); p != nil && problems {
+			rec.Outcome = "invalid"
+			writeProblem(w, p)
+			return
 		}
 
+		// Parse size parameter
+		defSize, defFormat := brandedDefaults(ctx, cfg)
+		size := sizeParam(r.URL.Query(), defSize)
+
 		// Determine output format
-		wantFormat := pickFormatByAccept(r.Header.Get("Accept"))
+		wantFormat := pickFormat(r)
+		if defFormat != "" && r.URL.Query().Get("format") == "" {
+			wantFormat = defFormat
+		}
+		rec.Size, rec.Format = size, wantFormat
+
+		// Downstream layers read the negotiated output from the request state
+		ctx, st := reqctx.Ensure(ctx)
+		startTimings(st, cfg)
+		st.Size, st.Format = size, wantFormat
+		st.Theme = themeParam(r.URL.Query())
+		st.Mask = imgpkg.ParseMask(r.URL.Query().Get("mask"), r.URL.Query().Get("radius"))
+		// A silhouette has one colour, so there is nothing to adapt to a theme
+		if st.Mono = imgpkg.ParseMono(r.URL.Query().Get("mono"), r.URL.Query().Get("color")); st.Mono != "" {
+			st.Theme = ""
+		}
+		st.Trim, st.Pad = trimParams(r.URL.Query())
+		st.Filter = filterParam(r.URL.Query(), cfg)
+		st.Fit = fitParam(r.URL.Query(), cfg)
+		setHeightParam(r.URL.Query(), st, cfg)
+		// Lists name their sizes in device pixels already
+		if len(sizesParam(r.URL.Query())) <= 1 {
+			size = applyDPR(r, st, cfg)
+			rec.Size = size
+		}
+		st.Quality = qualityParam(r.URL.Query())
+		ctx = withFetchLog(ctx)
+		r = r.WithContext(ctx)
+		useCache := !st.Debug.Has(reqctx.DebugNoCache)
+		if !st.Deadline.IsZero() {
+			w.Header().Set(HeaderDeadlineStatus, "met")
+		}
 
 		// Parse URL parameter
-		pageURL := strings.TrimSpace(r.URL.Query().Get("url"))
+		pageURL := pageURLParam(r.URL.Query())
+
 		if pageURL == "" {
-			if d := strings.TrimSpace(r.URL.Query().Get("domain")); d != "" {
-				pageURL = "https://" + d
+			if problems {
+				rec.Outcome = "invalid"
+				writeProblem(w, newProblem(http.StatusBadRequest, ProblemMissingURL, "url", "url or domain is required"))
+				return
 			}
+			serveImageVariant(w, r, nil, size, wantFormat, time.Now(), cfg)
+			return
 		}
 
-		if pageURL == "" {
-			serveImageVariant(w, r, nil, size, wantFormat, time.Now(), cfg)
+		// Historical lookups are answered from the archive and icon history alone
+		if asOf := strings.TrimSpace(r.URL.Query().Get("as_of")); asOf != "" {
+			serveAsOf(ctx, w, r, pageURL, asOf, &rec, cfg)
 			return
 		}
 
-		u, err := security.NormalizeURL(pageURL)
+		u, err := security.NormalizeURLContext(ctx, pageURL)
 		if err != nil {
 			logger.Warn("Invalid URL '%s': %v", pageURL, err)
+			rec.Outcome = "invalid"
+			if problems {
+				writeProblem(w, urlProblem(r.URL.Query(), err))
+				return
+			}
+			status := StatusBlocked
+			if errors.Is(err, security.ErrNotResolvable) {
+				status = StatusNotFound
+			}
+			noteLookup(ctx, status)
+			setLookupStatus(ctx, w)
 			serveImageVariant(w, r, nil, size, wantFormat, time.Now(), cfg)
 			return
 		}
 
 		// Canonical page URL for cache lookup
 		canonPageURL := discovery.CanonicalizeURLString(u.String())
+		rec.Domain = strings.ToLower(u.Hostname())
+
+		// Redirect mode serves the discovery result, not the icon
+		if strings.EqualFold(r.URL.Query().Get("response_type"), ResponseTypeRedirect) {
+			if serveRedirect(ctx, w, r, u, &rec, cfg) {
+				return
+			}
+		}
+
+		// Several sizes are answered together, from one decode of the icon
+		if sizes := sizesParam(r.URL.Query()); len(sizes) > 1 {
+			serveSizes(ctx, w, r, u, sizes, wantFormat, &rec, cfg)
+			return
+		}
+
+		// A domain past its variant limit gets the nearest size it has
+		if served := admitVariant(ctx, rec.Domain, size, cfg); served != size {
+			w.Header().Set(HeaderSize, strconv.Itoa(served))
+			if st.DPR > 0 {
+				st.DPR = st.DPR * float64(served) / float64(size)
+			}
+			size, st.Size, rec.Size = served, served, served
+		}
+
+		// The best icon depends on the ranking strategy, so non-default
+		// strategies keep their own resolved mapping
+		rank := pickRankingStrategy(r.URL.Query().Get("rank"), cfg)
+		resolvedKey := resolvedIconKey(canonPageURL, rank)
 
 		// Check if we have a cached resolved icon for this page
-		if resolved, ok := cfg.CacheManager.ReadResolvedIcon(canonPageURL); ok {
+		cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+		resolved, ok := cfg.CacheManager.ReadResolvedIcon(resolvedKey)
+		cacheDone()
+		if ok && useCache {
 			// Try to serve from resized cache directly
-			if b, ok, mod := cfg.CacheManager.ReadResizedFromCacheWithMod(resolved.IconURL, size, wantFormat); ok && len(b) > 0 {
-				logger.Debug("Cache hit for %s -> %s", canonPageURL, resolved.IconURL)
-				serveBytes(w, r, b, imgpkg.ContentTypeFor(wantFormat), mod, cfg)
+			if resolved.InheritedFrom != "" {
+				w.Header().Set(HeaderInheritedFrom, resolved.InheritedFrom)
+			}
+			cacheDone = reqctx.Time(ctx, reqctx.StageCache)
+			b, ok, mod := cfg.CacheManager.ReadResizedFromCacheWithMod(resolved.IconURL, size, variantKey(wantFormat, st))
+			cacheDone()
+			if ok && len(b) > 0 {
+				reqctx.Debugf(ctx, "Cache hit for %s -> %s", canonPageURL, resolved.IconURL)
+				rec.CacheTier, rec.Outcome = "resized", "ok"
+				setCacheStatus(w, CacheHit)
+				setCacheInfoHeaders(w, resolved.IconURL, size, variantKey(wantFormat, st), cfg)
+				setUpstreamHeaders(w, resolved.IconURL, cfg)
+				setBlurhashHeader(w, resolved.IconURL, cfg)
+				serveBytes(w, r, b, imgpkg.ContentTypeFor(wantFormat), mod, RouteIcon, cfg)
 				return
 			}
 			// If resized not found, try to re-encode from original
-			if origBytes, ok := cfg.CacheManager.ReadOrigFromCache(resolved.IconURL); ok {
-				img, err := decodeAndResize(origBytes, resolved.IconURL, size)
+			if origBytes, ct, ok := readCachedIconBytes(resolved.IconURL, cfg); ok {
+				img, err := decodeAndResize(ctx, origBytes, ct, resolved.IconURL, size, cfg)
 				if err == nil && img != nil {
+					rec.CacheTier, rec.Outcome = "orig", "ok"
+					setCacheStatus(w, CacheReencoded)
 					serveImageVariantWithSource(w, r, img, size, wantFormat, time.Now(), resolved.IconURL, cfg)
 					return
 				}
 			}
 			// Cache entry exists but icon is gone, fall through to re-discover
+			w.Header().Del(HeaderInheritedFrom)
 		}
 
-		// Discover and fetch icons
-		candidates := discovery.DiscoverFromPageThenRoot(ctx, u, size)
-		var best image.Image
-		var bestArea int64 = -1
-		var bestSrc string
-
-		for _, cand := range candidates {
-			iconURL := cand.URL
-			origBytes, ct, err := fetchURLCachedWithRevalidation(ctx, iconURL, cfg)
-			if err != nil || len(origBytes) == 0 || discovery.LooksLikeHTML(origBytes, ct) {
-				continue
+		// With wait the lookup runs in the background, so one that outlasts
+		// the wait still warms the cache; once done, the discovery below is
+		// answered from the caches it filled
+		if wait := waitParam(r.URL.Query()); wait > 0 && useCache {
+			if !awaitLookup(ctx, u, resolvedKey, rank, wait, cfg) {
+				rec.Outcome = "pending"
+				w.Header().Set(HeaderWait, WaitPending)
+				serveImageVariant(w, r, nil, size, wantFormat, time.Now(), cfg)
+				return
 			}
+			w.Header().Set(HeaderWait, WaitReady)
+		}
 
-			var img image.Image
-			var area int64
+		// Discover and fetch icons, reusing an earlier discovery of this page if cached
+		best, bestSrc, inheritedFrom := discoverBestIcon(ctx, u, rank, useCache, cfg)
+		rec.CacheTier = "fetch"
 
-			if discovery.IsSVGContentType(ct, iconURL) {
-				img, err = imgpkg.RasterizeSVG(origBytes, size, size)
-				if err != nil {
-					logger.Debug("SVG rasterization failed for %s: %v", iconURL, err)
-					continue
-				}
-				// Only skip if the image is completely blank (all white/transparent)
-				// Don't skip black/dark SVGs as they might be valid (e.g., GitHub logo)
-				if imgpkg.IsNearlyBlank(img) {
-					logger.Debug("SVG rendered as blank for %s, skipping", iconURL)
-					continue
-				}
-				area = 1 << 50 // SVG priority
-			} else if discovery.IsICO(ct, iconURL) {
-				img, err = imgpkg.DecodeICOSelectLargest(origBytes)
-				if err != nil {
-					continue
-				}
-				area = int64(img.Bounds().Dx()) * int64(img.Bounds().Dy())
-			} else {
-				img, err = imgpkg.DecodeImageRasterOnly(origBytes)
-				if err != nil {
-					continue
+		if best == nil {
+			// A caller out of time gets the last known icon rather than none
+			if deadlineExpired(ctx) {
+				if serveStale(ctx, w, r, rec.Domain, &rec, cfg) {
+					return
 				}
-				area = int64(img.Bounds().Dx()) * int64(img.Bounds().Dy())
-			}
-
-			dst := imgpkg.ResizeImage(img, size)
-			if area > bestArea {
-				bestArea, best, bestSrc = area, dst, iconURL
+				w.Header().Set(HeaderDeadlineStatus, "fallback")
 			}
-		}
-
-		if best == nil {
+			setLookupStatus(ctx, w)
 			serveImageVariant(w, r, nil, size, wantFormat, time.Now(), cfg)
 			return
 		}
 
 		// Cache the resolved icon mapping for future requests
-		_ = cfg.CacheManager.WriteResolvedIcon(canonPageURL, bestSrc)
+		cacheDone = reqctx.Time(ctx, reqctx.StageCache)
+		_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, bestSrc, inheritedFrom)
+		cacheDone()
+		if rank.Name() == discovery.DefaultRankingStrategy {
+			recordIconVersion(rec.Domain, bestSrc, cfg)
+		}
+		rec.Outcome = "ok"
+		if inheritedFrom != "" {
+			w.Header().Set(HeaderInheritedFrom, inheritedFrom)
+		}
 
+		setCacheStatus(w, cacheStatusOf(ctx, bestSrc))
 		serveImageVariantWithSource(w, r, best, size, wantFormat, time.Now(), bestSrc, cfg)
 	}
 }
 
+// discoverBestIcon discovers icons for the page u, trying hinted icon URLs
+// first and reusing a cached candidate list when useCache is set. It
+// returns the best one under rank resized to the request's size, its
+// source URL, and the apex host it was inherited from when the page's own
+// host had none.
+func discoverBestIcon(ctx context.Context, u *url.URL, rank discovery.RankingStrategy, useCache bool, cfg *Config) (best image.Image, bestSrc, inheritedFrom string) {
+	size := reqctx.From(ctx).Size
+	canonPageURL := discovery.CanonicalizeURLString(u.String())
+
+	// Known-good icon URLs skip page discovery entirely while they still work
+	if hints := discovery.HintCandidates(u); len(hints) > 0 {
+		if best, bestSrc = selectBestCandidate(ctx, hints, rank, cfg); best != nil {
+			reqctx.Debugf(ctx, "Using hinted icon %s for %s", bestSrc, canonPageURL)
+			return best, bestSrc, ""
+		}
+		reqctx.Debugf(ctx, "No hinted icon for %s decoded, discovering", canonPageURL)
+	}
+
+	// A recent lookup that found nothing is not repeated until it expires
+	if useCache {
+		if neg, ok := cfg.CacheManager.ReadNegative(canonPageURL); ok {
+			reqctx.Debugf(ctx, "Cached failed lookup for %s: %s", canonPageURL, neg.Status)
+			noteLookup(ctx, neg.Status)
+			return nil, "", ""
+		}
+	}
+	ctx, outcomes := fetch.WithOutcomes(ctx)
+	defer func() {
+		if best == nil {
+			writeNegative(ctx, canonPageURL, outcomes, cfg)
+		}
+	}()
+
+	var candidates []discovery.IconCandidate
+	cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+	fromCache := useCache && cfg.CacheManager.ReadCandidates(canonPageURL, &candidates)
+	cacheDone()
+	if !fromCache {
+		ctx, candidates = discoverCandidates(ctx, u, size, cfg)
+		writeCandidates(ctx, canonPageURL, candidates, cfg)
+	}
+	rank.Order(candidates, size)
+	best, bestSrc = selectBestCandidate(ctx, candidates, rank, cfg)
+	if best == nil && fromCache && ctx.Err() == nil {
+		// The page's icons may have moved since discovery; look again
+		ctx, candidates = discoverCandidates(ctx, u, size, cfg)
+		writeCandidates(ctx, canonPageURL, candidates, cfg)
+		rank.Order(candidates, size)
+		best, bestSrc = selectBestCandidate(ctx, candidates, rank, cfg)
+	}
+
+	// Subdomains often have no icon of their own; borrow the apex domain's
+	if best == nil && ctx.Err() == nil {
+		if apex := discovery.ApexURL(u); apex != nil {
+			reqctx.Debugf(ctx, "No usable icon for %s, trying apex %s", canonPageURL, apex.Host)
+			apexKey := discovery.CanonicalizeURLString(apex.String())
+			var apexCands []discovery.IconCandidate
+			if !useCache || !cfg.CacheManager.ReadCandidates(apexKey, &apexCands) {
+				ctx, apexCands = discoverCandidates(ctx, apex, size, cfg)
+				writeCandidates(ctx, apexKey, apexCands, cfg)
+			}
+			rank.Order(apexCands, size)
+			if best, bestSrc = selectBestCandidate(ctx, apexCands, rank, cfg); best != nil {
+				inheritedFrom = apex.Hostname()
+			}
+		}
+	}
+	return best, bestSrc, inheritedFrom
+}
+
+// writeCandidates caches a discovered candidate list, unless ctx ended
+// during discovery and the list may be incomplete.
+func writeCandidates(ctx context.Context, pageURL string, candidates []discovery.IconCandidate, cfg *Config) {
+	if ctx.Err() == nil {
+		defer reqctx.Time(ctx, reqctx.StageCache)()
+		_ = cfg.CacheManager.WriteCandidates(pageURL, candidates)
+	}
+}
+
 func serveImageVariantWithSource(w http.ResponseWriter, r *http.Request, img image.Image, size int, format string, lastMod time.Time, srcURL string, cfg *Config) {
+	st := reqctx.From(r.Context())
+
+	// An animated GIF asked for as GIF is passed through at its own size;
+	// re-encoding would keep a single frame
+	if format == "gif" && variantKey(format, st) == format {
+		if orig, _, ok := readCachedIconBytes(srcURL, cfg); ok && bytes.HasPrefix(orig, []byte("GIF")) && imgpkg.IsAnimated(orig) {
+			setCacheInfoHeaders(w, srcURL, 0, "", cfg)
+			setUpstreamHeaders(w, srcURL, cfg)
+			setBlurhashHeader(w, srcURL, cfg)
+			serveBytes(w, r, imgpkg.StripMetadata(orig), "image/gif", lastMod, RouteIcon, cfg)
+			return
+		}
+	}
+
 	// Try cache first
-	if b, ok, mod := cfg.CacheManager.ReadResizedFromCacheWithMod(srcURL, size, format); ok && len(b) > 0 {
-		serveBytes(w, r, b, imgpkg.ContentTypeFor(format), mod, cfg)
+	key := variantKey(format, st)
+	setCacheInfoHeaders(w, srcURL, size, key, cfg)
+	setUpstreamHeaders(w, srcURL, cfg)
+	setBlurhashHeader(w, srcURL, cfg)
+	cacheDone := reqctx.Time(r.Context(), reqctx.StageCache)
+	b, ok, mod := cfg.CacheManager.ReadResizedFromCacheWithMod(srcURL, size, key)
+	cacheDone()
+	if ok && len(b) > 0 {
+		setCacheStatus(w, CacheHit)
+		serveBytes(w, r, b, imgpkg.ContentTypeFor(format), mod, RouteIcon, cfg)
 		return
 	}
 
 	// Encode
-	data, ct := imgpkg.EncodeByFormat(img, format)
+	encodeDone := reqctx.Time(r.Context(), reqctx.StageEncode)
+	img, cacheable := applyVariant(r.Context(), img)
+	data, ct := imgpkg.EncodeByFormat(img, format, st.Quality)
 	if data == nil {
-		data, ct = imgpkg.EncodeByFormat(img, "png")
+		data, ct = imgpkg.EncodeByFormat(img, "png", 0)
 	}
 	if len(data) == 0 {
 		var buf bytes.Buffer
 		_ = png.Encode(&buf, imgpkg.CreateBlankImage())
 		data, ct = buf.Bytes(), "image/png"
 	}
+	encodeDone()
+
+	if cacheable {
+		cacheDone = reqctx.Time(r.Context(), reqctx.StageCache)
+		writeVariant(r.Context(), srcURL, size, key, data, cfg)
+		cacheDone()
+	}
+	serveBytes(w, r, data, ct, lastMod, RouteIcon, cfg)
+}
 
-	_ = cfg.CacheManager.WriteResizedToCache(srcURL, size, format, data)
-	serveBytes(w, r, data, ct, lastMod, cfg)
+// setCacheInfoHeaders sets HeaderContentHash to the CID of the original
+// icon at srcURL and HeaderCacheKey to the key of its variant at size
+// cached under format key ("" = not cached as a variant), if
+// cfg.ExposeCacheInfo is set.
+func setCacheInfoHeaders(w http.ResponseWriter, srcURL string, size int, key string, cfg *Config) {
+	if !cfg.ExposeCacheInfo {
+		return
+	}
+	if orig, _, ok := readCachedIconBytes(srcURL, cfg); ok {
+		w.Header().Set(HeaderContentHash, cache.ContentCID(orig))
+	}
+	if ph, _, ok := iconPerceptualHash(srcURL, cfg); ok {
+		w.Header().Set(HeaderPerceptualHash, ph)
+	}
+	if key != "" {
+		w.Header().Set(HeaderCacheKey, cfg.CacheManager.ResizedCacheKey(srcURL, size, key))
+	}
 }
 
 func serveImageVariant(w http.ResponseWriter, r *http.Request, img image.Image, size int, format string, lastMod time.Time, cfg *Config) {
 	if img == nil {
-		var err error
-		img, err = imgpkg.CreateFallbackImage(size)
-		if err != nil {
-			img = imgpkg.CreateBlankImage()
+		setCacheStatus(w, CacheFallback)
+		markFallback(w)
+		if serveErrorImage(w, r, size, format, cfg) {
+			return
 		}
+		img = fallbackImage(r, size, cfg)
 	}
+	encodeDone := reqctx.Time(r.Context(), reqctx.StageEncode)
+	img, _ = applyVariant(r.Context(), img)
 
-	data, ct := imgpkg.EncodeByFormat(img, format)
+	data, ct := imgpkg.EncodeByFormat(img, format, reqctx.From(r.Context()).Quality)
 	if data == nil {
-		data, ct = imgpkg.EncodeByFormat(img, "png")
+		data, ct = imgpkg.EncodeByFormat(img, "png", 0)
 	}
 	if len(data) == 0 {
 		var buf bytes.Buffer
 		_ = png.Encode(&buf, imgpkg.CreateBlankImage())
 		data, ct = buf.Bytes(), "image/png"
 	}
+	encodeDone()
 
-	serveBytes(w, r, data, ct, lastMod, cfg)
+	serveBytes(w, r, data, ct, lastMod, RouteIcon, cfg)
 }
 
-func serveBytes(w http.ResponseWriter, r *http.Request, body []byte, contentType string, lastMod time.Time, cfg *Config) {
+// serveErrorImage serves the error-image placeholder of a request without
+// a default image, reporting whether it did. The placeholders only depend
+// on the failure class and the variant, so they are cached once encoded
+// rather than drawn for every failed lookup.
+func serveErrorImage(w http.ResponseWriter, r *http.Request, size int, format string, cfg *Config) bool {
+	if fallbackStyle(r, cfg) != imgpkg.FallbackErrorImage || cfg.CacheManager == nil {
+		return false
+	}
+	if raw := strings.TrimSpace(r.URL.Query().Get("default")); raw != "" && raw != "404" {
+		return false
+	}
+	ctx := r.Context()
+	if b := tenantBranding(ctx, cfg); b != nil && b.fallback != nil {
+		return false
+	}
+	st := reqctx.From(ctx)
+	key := strings.Join([]string{errorClass(ctx), strconv.Itoa(size), strconv.Itoa(st.Height), variantKey(format, st)}, "|")
+	ct := imgpkg.ContentTypeFor(format)
+	if b, ok := cfg.CacheManager.ReadFallback(key); ok && len(b) > 0 {
+		serveBytes(w, r, b, ct, time.Now(), RouteIcon, cfg)
+		return true
+	}
+	encodeDone := reqctx.Time(ctx, reqctx.StageEncode)
+	img, cacheable := applyVariant(ctx, fallbackImage(r, size, cfg))
+	data, dataCT := encodeVariant(img, format, st.Quality)
+	encodeDone()
+	// Only the requested format is cached, so hits can serve it as such
+	if dataCT == ct && cacheable {
+		if err := cfg.CacheManager.WriteFallback(key, data); err != nil {
+			reqctx.Debugf(ctx, "Caching error image failed: %v", err)
+		}
+	}
+	serveBytes(w, r, data, dataCT, time.Now(), RouteIcon, cfg)
+	return true
+}
+
+func serveBytes(w http.ResponseWriter, r *http.Request, body []byte, contentType string, lastMod time.Time, route string, cfg *Config) {
 	w.Header().Set("Vary", "Accept")
+	setDPRHeaders(w, r, cfg)
 
-	etag := makeETag(body)
+	status := http.StatusOK
+	if w.Header().Get(HeaderIconFallback) != "" {
+		status = fallbackStatus(r, cfg)
+	}
+
+	etag := makeETag(body, cfg)
+	// The origin's Last-Modified, passed through by setUpstreamHeaders,
+	// wins over the service's and is what If-Modified-Since and If-Range
+	// are checked against
+	if t, err := http.ParseTime(w.Header().Get("Last-Modified")); err == nil {
+		lastMod = t
+	} else if !lastMod.IsZero() {
+		w.Header().Set("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	}
 	if cfg.UseETag {
-		if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
-			w.Header().Set("ETag", etag)
-			setCacheHeaders(w, cfg)
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
 		w.Header().Set("ETag", etag)
 	}
+	// Conditions only apply to responses that would be 2xx
+	if status == http.StatusOK && notModified(r, etag, lastMod, cfg) {
+		setCacheHeaders(w, cfg)
+		setTenantCacheHeaders(w, r, cfg)
+		setServerTiming(w, r)
+		cfg.ResponseHeaders.apply(w, route)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	w.Header().Set("Content-Type", contentType)
-	if !lastMod.IsZero() {
-		w.Header().Set("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	// Ranges only apply to 200 responses, not to placeholders sent as 404
+	if status == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if !cfg.UseETag {
+			etag = ""
+		}
+		start, end, rangeStatus := byteRange(r, len(body), etag, lastMod)
+		switch rangeStatus {
+		case http.StatusPartialContent:
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(end-1)+"/"+strconv.Itoa(len(body)))
+			body, status = body[start:end], rangeStatus
+		case http.StatusRequestedRangeNotSatisfiable:
+			w.Header().Set("Content-Range", "bytes */"+strconv.Itoa(len(body)))
+			w.Header().Del("Content-Type")
+			body, status = nil, rangeStatus
+		}
 	}
 	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	setCacheHeaders(w, cfg)
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(body)
+	setTenantCacheHeaders(w, r, cfg)
+	setServerTiming(w, r)
+	cfg.ResponseHeaders.apply(w, route)
+	w.WriteHeader(status)
+	// HEAD gets the headers of the GET response, which CDNs validate
+	// cached copies with, and no body
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// pageURLParam returns the page to look up: the url query parameter, or
+// https://<domain> when only domain is given.
+func pageURLParam(q url.Values) string {
+	if u := strings.TrimSpace(q.Get("url")); u != "" {
+		return u
+	}
+	if d := strings.TrimSpace(q.Get("domain")); d != "" {
+		return "https://" + d
+	}
+	return ""
+}
+
+// sizeParam parses the sz (or size) query parameter, clamped to
+// [MinSize, MaxSize], defaulting to def. Of a list of sizes (see
+// sizesParam) it returns the first, and of a WxH pair (see dimsParam) the
+// width.
+func sizeParam(q url.Values, def int) int {
+	if w, _, ok := dimsParam(q); ok {
+		return w
+	}
+	if sizes := sizesParam(q); len(sizes) > 0 {
+		return sizes[0]
+	}
+	return def
+}
+
+// resolvedIconKey returns the resolved-icon cache key of a page under rank.
+func resolvedIconKey(canonPageURL string, rank discovery.RankingStrategy) string {
+	if rank.Name() != discovery.DefaultRankingStrategy {
+		return canonPageURL + " rank=" + rank.Name()
+	}
+	return canonPageURL
+}
+
+// pickRankingStrategy resolves the request's rank parameter, falling back to
+// the configured strategy and then the default. Unknown names are ignored.
+func pickRankingStrategy(name string, cfg *Config) discovery.RankingStrategy {
+	s, ok := discovery.LookupRankingStrategy(strings.TrimSpace(name))
+	if !ok {
+		if s, ok = discovery.LookupRankingStrategy(strings.TrimSpace(cfg.Ranking)); !ok {
+			s, _ = discovery.LookupRankingStrategy(discovery.DefaultRankingStrategy)
+		}
+	}
+	if cfg.TrustDeclaredSizes {
+		return discovery.TrustDeclaredSizes(s)
+	}
+	return s
+}
+
+// pickFormat returns the output format named by the format query parameter
+// if an encoder for it is available, otherwise the one negotiated from
+// Accept. Unknown names are ignored.
+func pickFormat(r *http.Request) string {
+	if f := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))); f != "" {
+		if f == "jpg" {
+			f = "jpeg"
+		}
+		if _, ok := imgpkg.LookupEncoder(f); ok {
+			return f
+		}
+	}
+	return pickFormatByAccept(r.Header.Get("Accept"))
+}
+
+// themeParam returns the request's theme parameter if it names a supported
+// theme, or "".
+func themeParam(q url.Values) string {
+	theme := strings.ToLower(strings.TrimSpace(q.Get("theme")))
+	for _, t := range imgpkg.Themes {
+		if theme == t {
+			return t
+		}
+	}
+	return ""
+}
+
+// qualityParam returns the request's q parameter, capped at 100, or 0
+// (the encoder's default) when it is missing or not a positive number.
+func qualityParam(q url.Values) int {
+	v, err := strconv.Atoi(strings.TrimSpace(q.Get("q")))
+	if err != nil || v < 1 {
+		return 0
+	}
+	return min(v, 100)
+}
+
+// trimParams returns whether the request asks for its icon to be trimmed
+// and the margin to re-pad it by: pad=N% trims and pads, trim=1 only trims.
+// Invalid values are ignored.
+func trimParams(q url.Values) (bool, int) {
+	if pad, ok := imgpkg.ParsePad(q.Get("pad")); ok {
+		return true, pad
+	}
+	trim, _ := strconv.ParseBool(q.Get("trim"))
+	return trim, 0
+}
+
+// fallbackImage returns the placeholder for a request no icon was found
+// for: the request's default image, its tenant's fallback image, a letter
+// tile for the requested host in the letter style, or else the globe. A
+// square placeholder is letterboxed to a WxH request's height.
+func fallbackImage(r *http.Request, size int, cfg *Config) image.Image {
+	if img := defaultImage(r, size, cfg); img != nil {
+		return img
+	}
+	if b := tenantBranding(r.Context(), cfg); b != nil && b.fallback != nil {
+		return resizeIcon(r.Context(), b.fallback, size)
+	}
+	if h := reqctx.From(r.Context()).Height; h > 0 && h != size {
+		return imgpkg.ResizeImageRect(placeholderImage(r, min(size, h), cfg), size, h, imgpkg.FitContain, "")
+	}
+	return placeholderImage(r, size, cfg)
+}
+
+// placeholderImage returns the built-in square placeholder at size.
+func placeholderImage(r *http.Request, size int, cfg *Config) image.Image {
+	var img image.Image
+	var err error
+	switch fallbackStyle(r, cfg) {
+	case imgpkg.FallbackLetter:
+		if u, err := url.Parse(pageURLParam(r.URL.Query())); err == nil && u.Hostname() != "" {
+			var palette []color.NRGBA
+			if b := tenantBranding(r.Context(), cfg); b != nil {
+				palette = b.palette
+			}
+			return imgpkg.CreateLetterTileWithPalette(u.Hostname(), size, palette)
+		}
+		img, err = imgpkg.CreateFallbackImage(size)
+	case imgpkg.FallbackErrorImage:
+		img, err = imgpkg.CreateErrorImage(errorClass(r.Context()), size)
+	default:
+		img, err = imgpkg.CreateFallbackImage(size)
+	}
+	if err != nil {
+		return imgpkg.CreateBlankImage()
+	}
+	return img
+}
+
+// fallbackStyle returns the request's placeholder style: its fallback
+// parameter if that names one, or else its tenant's or Config.FallbackStyle.
+func fallbackStyle(r *http.Request, cfg *Config) string {
+	style := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("fallback")))
+	switch style {
+	case imgpkg.FallbackGlobe, imgpkg.FallbackLetter, imgpkg.FallbackErrorImage:
+		return style
+	}
+	if b := tenantBranding(r.Context(), cfg); b != nil && b.FallbackStyle != "" {
+		return b.FallbackStyle
+	}
+	return cfg.FallbackStyle
+}
+
+// errorClass returns the imgpkg failure class of a request that found no
+// icon, from the HeaderStatus of its lookup: blocked URLs, lookups that
+// ran out of time or failed on upstream errors, and not-found for the
+// rest, including requests without a URL.
+func errorClass(ctx context.Context) string {
+	switch lookupStatusOf(ctx) {
+	case StatusBlocked:
+		return imgpkg.ErrorBlocked
+	case StatusUnavailable:
+		return imgpkg.ErrorTimeout
+	}
+	if deadlineExpired(ctx) {
+		return imgpkg.ErrorTimeout
+	}
+	return imgpkg.ErrorNotFound
+}
+
+// defaultImage returns the image named by the request's default parameter,
+// resized to size, or nil when there is none or it cannot be used. Only
+// http(s) URLs on a host of Config.DefaultImageAllow are fetched, with the
+// icon client and cache, and redirects must stay on those hosts; anything
+// else, like a failed fetch, leaves the usual placeholder.
+func defaultImage(r *http.Request, size int, cfg *Config) image.Image {
+	raw := strings.TrimSpace(r.URL.Query().Get("default"))
+	if raw == "" || raw == "404" || len(cfg.DefaultImageAllow) == 0 {
+		return nil
+	}
+	ctx := r.Context()
+	u, err := security.NormalizeURLContext(ctx, raw)
+	if err != nil || !hostAllowed(u, cfg.DefaultImageAllow) {
+		reqctx.Debugf(ctx, "Ignoring default image %q", raw)
+		return nil
+	}
+	ctx = fetch.WithRedirectCheck(ctx, func(next *url.URL) error {
+		if !hostAllowed(next, cfg.DefaultImageAllow) {
+			return errors.New("redirect to " + next.Hostname() + " is not allowed")
+		}
+		return nil
+	})
+	srcURL := discovery.CanonicalizeURLString(u.String())
+	b, ct, err := loadIconBytes(ctx, srcURL, cfg)
+	if err != nil {
+		return nil
+	}
+	img, err := decodeAndResize(ctx, b, ct, srcURL, size, cfg)
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// markFallback flags a response as serving the placeholder, which gives
+// it the request's fallbackStatus, and counts it.
+func markFallback(w http.ResponseWriter) {
+	w.Header().Set(HeaderIconFallback, "true")
+	metrics.Get().IncFallback()
+}
+
+// fallbackStatus returns the status of a placeholder response: the
+// request's fallback_status parameter if it is 200 or 404, 404 for
+// default=404, or else Config.FallbackStatus.
+func fallbackStatus(r *http.Request, cfg *Config) int {
+	q := r.URL.Query()
+	status, _ := strconv.Atoi(strings.TrimSpace(q.Get("fallback_status")))
+	if status != http.StatusOK && status != http.StatusNotFound {
+		status = cfg.FallbackStatus
+		if strings.TrimSpace(q.Get("default")) == "404" {
+			status = http.StatusNotFound
+		}
+	}
+	if status == http.StatusNotFound {
+		return status
+	}
+	return http.StatusOK
+}
+
+// setHeightParam sets st.Height for a request for a non-square WxH size
+// (see dimsParam), st.Size holding the width. Such targets are letterboxed
+// unless the request or Config.Fit asks for cover, as stretching a square
+// icon to them would distort it.
+func setHeightParam(q url.Values, st *reqctx.State, cfg *Config) {
+	w, h, ok := dimsParam(q)
+	if !ok || w == h {
+		return
+	}
+	st.Height = h
+	if st.Fit == "" || st.Fit == imgpkg.FitStretch && imgpkg.ParseFit(q.Get("fit")) == "" {
+		st.Fit = imgpkg.FitContain
+	}
+}
+
+// fitParam returns the request's fit mode: its fit parameter if that names
+// one, or else the configured default.
+func fitParam(q url.Values, cfg *Config) string {
+	if f := imgpkg.ParseFit(q.Get("fit")); f != "" {
+		return f
+	}
+	return imgpkg.ParseFit(cfg.Fit)
+}
+
+// filterParam returns the request's resampling filter: its filter parameter
+// if that names one, or else the configured default.
+func filterParam(q url.Values, cfg *Config) string {
+	if f := imgpkg.ParseFilter(q.Get("filter")); f != "" {
+		return f
+	}
+	return imgpkg.ParseFilter(cfg.ResampleFilter)
+}
+
+// variantKey returns the format under which a resized variant is cached,
+// keeping processed variants (filter, theme, mono, mask, trim) apart from the
+// plain icon and from each other. It is format itself for the plain icon.
+func variantKey(format string, st *reqctx.State) string {
+	key := format + resizeKey(st)
+	// Quality only changes the output of encoders that take it
+	if st.Quality > 0 {
+		if e, ok := imgpkg.LookupEncoder(format); ok {
+			if _, ok := e.(imgpkg.QualityEncoder); ok {
+				key += "-q" + strconv.Itoa(st.Quality)
+			}
+		}
+	}
+	if st.Theme != "" {
+		key += "-" + st.Theme
+	}
+	if st.Mono != "" {
+		key += "-mono" + st.Mono
+	}
+	if st.Mask != "" {
+		key += "-" + st.Mask
+	}
+	if pp := imgpkg.PostProcessKey(); pp != "" {
+		key += "-pp" + pp
+	}
+	return key
+}
+
+// resizeKey returns the part of a variantKey that tells how resizeIcon
+// scales the icon, which all output formats share.
+func resizeKey(st *reqctx.State) string {
+	key := ""
+	if st.Trim {
+		key += "-pad" + strconv.Itoa(st.Pad)
+	}
+	if st.Filter != "" && st.Filter != imgpkg.FilterAuto {
+		key += "-" + st.Filter
+	}
+	if st.Height > 0 {
+		key += "-h" + strconv.Itoa(st.Height)
+	}
+	if st.Fit != "" && st.Fit != imgpkg.FitStretch && !st.Trim {
+		key += "-" + st.Fit
+	}
+	return key
+}
+
+// resizeIcon scales img to size with the request's resampling filter and
+// fit mode, or trims and re-pads it if the request asks for that, which
+// keeps the aspect ratio regardless of fit. For a WxH request size is the
+// width and st.Height the height; a trimmed icon is then normalized to the
+// shorter edge and letterboxed.
+func resizeIcon(ctx context.Context, img image.Image, size int) image.Image {
+	st := reqctx.From(ctx)
+	if st.Height > 0 && st.Height != size {
+		if st.Trim {
+			img = imgpkg.Normalize(img, min(size, st.Height), st.Pad, st.Filter)
+			return imgpkg.ResizeImageRect(img, size, st.Height, imgpkg.FitContain, st.Filter)
+		}
+		return imgpkg.ResizeImageRect(img, size, st.Height, st.Fit, st.Filter)
+	}
+	if st.Trim {
+		return imgpkg.Normalize(img, size, st.Pad, st.Filter)
+	}
+	return imgpkg.ResizeImageFit(img, size, st.Fit, st.Filter)
+}
+
+// applyVariant adapts img to the request's theme or turns it into a
+// monochrome silhouette, and then clips it to the request's mask, if it has
+// them. The result is passed through the registered post-processors, as it
+// is the final image to be encoded; cacheable is false if one of them
+// failed, so the untransformed image is served but never cached.
+func applyVariant(ctx context.Context, img image.Image) (_ image.Image, cacheable bool) {
+	st := reqctx.From(ctx)
+	if st.Theme != "" {
+		var adj imgpkg.ThemeAdjustment
+		img, adj = imgpkg.ApplyTheme(img, st.Theme)
+		reqctx.Debugf(ctx, "Theme %s: %s", st.Theme, adj)
+	}
+	if st.Mono != "" {
+		img = imgpkg.Monochrome(img, st.Mono)
+	}
+	if st.Mask != "" {
+		img = imgpkg.ApplyMask(img, st.Mask)
+	}
+	return imgpkg.PostProcess(img)
 }
 
 func pickFormatByAccept(accept string) string {
 	accept = strings.ToLower(accept)
 	// AVIF has better compression, prioritize it
-	if strings.Contains(accept, "image/avif") {
-		return "avif"
+	for _, f := range []string{"avif", "webp"} {
+		if e, ok := imgpkg.LookupEncoder(f); ok && strings.Contains(accept, e.ContentType()) {
+			return f
+		}
 	}
-	if strings.Contains(accept, "image/webp") {
-		return "webp"
+	// Other formats (ICO, those added by embedders) are only served when
+	// explicitly accepted. JPEG, which loses transparency, is only served
+	// when asked for with format
+	for _, e := range imgpkg.Encoders() {
+		switch e.Name() {
+		case "avif", "webp", "png", "jpeg":
+			continue
+		}
+		if strings.Contains(accept, e.ContentType()) {
+			return e.Name()
+		}
 	}
 	return "png"
 }
 
-func makeETag(b []byte) string {
-	s := sha256.Sum256(b)
-	return "\"" + hex.EncodeToString(s[:16]) + "\""
+func setCacheHeaders(w http.ResponseWriter, cfg *Config) {
+	// A placeholder served while the lookup runs is replaced on the next request
+	if w.Header().Get(HeaderWait) == WaitPending {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	bsec, csec := cacheMaxAges(cfg)
+	cc := "public, max-age=" + strconv.Itoa(bsec) + ", s-maxage=" + strconv.Itoa(csec) + ", immutable"
+	w.Header().Set("Cache-Control", cc)
+	w.Header().Set("Surrogate-Control", "max-age="+strconv.Itoa(csec))
+	w.Header().Set("Expires", time.Now().Add(time.Duration(bsec)*time.Second).UTC().Format(http.TimeFormat))
 }
 
-func setCacheHeaders(w http.ResponseWriter, cfg *Config) {
-	bsec := int(cfg.BrowserMaxAge.Seconds())
-	csec := int(cfg.CDNSMaxAge.Seconds())
+// cacheMaxAges returns the browser and CDN max-age of responses in seconds.
+func cacheMaxAges(cfg *Config) (bsec, csec int) {
+	bsec = int(cfg.BrowserMaxAge.Seconds())
+	csec = int(cfg.CDNSMaxAge.Seconds())
 	if bsec <= 0 {
 		bsec = 86400
 	}
 	if csec <= 0 {
 		csec = bsec
 	}
-	cc := "public, max-age=" + strconv.Itoa(bsec) + ", s-maxage=" + strconv.Itoa(csec) + ", immutable"
-	w.Header().Set("Cache-Control", cc)
-	w.Header().Set("Surrogate-Control", "max-age="+strconv.Itoa(csec))
-	w.Header().Set("Expires", time.Now().Add(time.Duration(bsec)*time.Second).UTC().Format(http.TimeFormat))
+	return bsec, csec
+}
+
+// loadIconBytes returns the raw bytes of an icon candidate. Inline data: URIs
+// are decoded directly; everything else goes through the revalidating fetch cache.
+func loadIconBytes(ctx context.Context, iconURL string, cfg *Config) ([]byte, string, error) {
+	if discovery.IsDataURI(iconURL) {
+		return discovery.DecodeDataURI(iconURL)
+	}
+	defer reqctx.Time(ctx, reqctx.StageFetch)()
+	if p := prefetched(ctx, iconURL); p != nil {
+		return p.data, p.contentType, p.err
+	}
+	return fetchURLCachedWithRevalidation(ctx, iconURL, cfg)
+}
+
+// recordIconVersion adds the icon just resolved for host to its timeline
+// for as_of lookups. Only default-ranked resolutions are recorded, so
+// per-request rank overrides do not show up as icon changes.
+func recordIconVersion(host, iconURL string, cfg *Config) {
+	b, _, ok := readCachedIconBytes(iconURL, cfg)
+	if !ok {
+		return
+	}
+	if err := cfg.CacheManager.RecordIconVersion(host, iconURL, b, time.Now()); err != nil {
+		logger.Warn("Failed to record icon version for %s: %v", host, err)
+	}
+}
+
+// readCachedIconBytes returns the original bytes of a previously resolved icon
+// without touching the network.
+func readCachedIconBytes(iconURL string, cfg *Config) ([]byte, string, bool) {
+	if discovery.IsDataURI(iconURL) {
+		b, ct, err := discovery.DecodeDataURI(iconURL)
+		return b, ct, err == nil
+	}
+	b, ok := cfg.CacheManager.ReadOrigFromCache(iconURL)
+	if !ok {
+		return nil, "", false
+	}
+	return b, http.DetectContentType(peek512(b)), true
 }
 
 func fetchURLCachedWithRevalidation(ctx context.Context, rawURL string, cfg *Config) ([]byte, string, error) {
@@ -302,16 +1180,23 @@ func fetchURLCachedWithRevalidation(ctx context.Context, rawURL string, cfg *Con
 			nb, ct, status, etag, lm, err := fetch.FetchURLConditional(ctx, canon, m.ETag, m.LastModified)
 			if err == nil && status == 304 {
 				_ = cm.TouchOrigCache(canon)
-				_ = cm.WriteOrigMeta(canon, cache.OrigMeta{URL: canon, ETag: m.ETag, LastModified: m.LastModified, UpdatedAt: time.Now()})
+				// Unchanged, so its perceptual hash still holds
+				m.UpdatedAt = time.Now()
+				_ = cm.WriteOrigMeta(canon, m)
+				noteFetch(ctx, canon, CacheRevalidated)
 				return b, ct, nil
 			}
 			if err == nil && status == 200 && len(nb) > 0 {
 				_ = cm.WriteOrigToCache(canon, nb)
 				_ = cm.WriteOrigMeta(canon, cache.OrigMeta{URL: canon, ETag: etag, LastModified: lm, UpdatedAt: time.Now()})
+				noteFetch(ctx, canon, CacheMiss)
 				return nb, ct, nil
 			}
+			// The origin could not confirm the cached copy; serve it anyway
+			noteFetch(ctx, canon, CacheStale)
 			return b, http.DetectContentType(peek512(b)), nil
 		}
+		noteFetch(ctx, canon, CacheReencoded)
 		return b, http.DetectContentType(peek512(b)), nil
 	}
 
@@ -344,9 +1229,22 @@ func fetchURLCachedWithRevalidation(ctx context.Context, rawURL string, cfg *Con
 	})
 
 	if err != nil {
-		return nil, "", err
+		// A coalesced fetch owned by another request may have been cancelled
+		// by that request's early termination; retry once under our own context.
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			b, _, etag, lm, ferr := fetch.FetchURLFull(ctx, canon)
+			if ferr != nil {
+				return nil, "", ferr
+			}
+			_ = cm.WriteOrigToCache(canon, b)
+			_ = cm.WriteOrigMeta(canon, cache.OrigMeta{URL: canon, ETag: etag, LastModified: lm, UpdatedAt: time.Now()})
+			data = b
+		} else {
+			return nil, "", err
+		}
 	}
 
+	noteFetch(ctx, canon, CacheMiss)
 	ct := http.DetectContentType(peek512(data))
 	return data, ct, nil
 }
@@ -364,22 +1262,7 @@ func CanonicalizeURLString(raw string) string {
 }
 
 // decodeAndResize decodes image bytes and resizes to target size
-func decodeAndResize(origBytes []byte, srcURL string, size int) (image.Image, error) {
-	ct := http.DetectContentType(peek512(origBytes))
-	var img image.Image
-	var err error
-
-	if discovery.IsSVGContentType(ct, srcURL) {
-		img, err = imgpkg.RasterizeSVG(origBytes, size, size)
-	} else if discovery.IsICO(ct, srcURL) {
-		img, err = imgpkg.DecodeICOSelectLargest(origBytes)
-	} else {
-		img, err = imgpkg.DecodeImageRasterOnly(origBytes)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	return imgpkg.ResizeImage(img, size), nil
+func decodeAndResize(ctx context.Context, origBytes []byte, ct, srcURL string, size int, cfg *Config) (image.Image, error) {
+	res := decodeIcon(ctx, origBytes, ct, srcURL, size, cfg)
+	return res.img, res.err
 }
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Route classes static response headers can be configured for (see
+// Config.ResponseHeaders).
+const (
+	RouteIcon   = "icon"   // single icons from /favicons
+	RouteSizes  = "sizes"  // multi-size /favicons responses, JSON or multipart
+	RouteBundle = "bundle" // /favicons/bundle.ico
+	RouteAll    = "*"      // every class above
+)
+
+// RouteClasses lists the classes ParseResponseHeaders accepts.
+var RouteClasses = []string{RouteAll, RouteIcon, RouteSizes, RouteBundle}
+
+// ResponseHeaders are static headers per route class, set after the
+// handler's own so they can override them. Headers of RouteAll come first,
+// then the class's own. An empty value removes the header.
+type ResponseHeaders map[string]http.Header
+
+// ParseResponseHeaders parses a -response-headers value: entries of the
+// form "class:Name: value", separated by ";", e.g.
+// "*:Timing-Allow-Origin: *;icon:X-CDN-Route: favicons". With a leading "@"
+// the entries are read from a file, one per line ("#" starts a comment
+// line), which allows values containing ";". Repeating a header within a
+// class sends it once per value.
+func ParseResponseHeaders(spec string) (ResponseHeaders, error) {
+	var entries []string
+	if path, ok := strings.CutPrefix(spec, "@"); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		entries = strings.Split(spec, ";")
+	}
+
+	h := make(ResponseHeaders)
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		class, header, _ := strings.Cut(entry, ":")
+		name, value, ok := strings.Cut(header, ":")
+		class, name = strings.ToLower(strings.TrimSpace(class)), strings.TrimSpace(name)
+		if !ok || !slices.Contains(RouteClasses, class) {
+			return nil, fmt.Errorf("entry %q is not <%s>:Name: value", entry, strings.Join(RouteClasses, "|"))
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("entry %q: invalid header name %q", entry, name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Transfer-Encoding":
+			// These describe the body serveBytes writes
+			return nil, fmt.Errorf("entry %q: %s cannot be configured", entry, name)
+		}
+		value = strings.TrimSpace(value)
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("entry %q: header values cannot span lines", entry)
+		}
+		if h[class] == nil {
+			h[class] = http.Header{}
+		}
+		h[class].Add(name, value)
+	}
+	return h, nil
+}
+
+// validHeaderName reports whether name is an HTTP token (RFC 9110 §5.6.2).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the headers of class on w.
+func (h ResponseHeaders) apply(w http.ResponseWriter, class string) {
+	for _, c := range []string{RouteAll, class} {
+		for name, values := range h[c] {
+			if len(values) == 1 && values[0] == "" {
+				w.Header().Del(name)
+				continue
+			}
+			w.Header()[name] = values
+		}
+	}
+}
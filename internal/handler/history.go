@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/archive"
+)
+
+// iconChange is one entry of the change log served by HistoryHandler.
+type iconChange struct {
+	Time        time.Time `json:"time"`
+	CID         string    `json:"cid"`
+	IconURL     string    `json:"icon_url"`
+	PreviousCID string    `json:"previous_cid,omitempty"`
+}
+
+// historyResponse is the JSON body served by HistoryHandler.
+type historyResponse struct {
+	Domain  string       `json:"domain"`
+	Current string       `json:"current"`
+	Count   int          `json:"count"`
+	Changes []iconChange `json:"changes"`
+}
+
+// HistoryHandler serves the favicon change log of a host: every distinct
+// icon it was seen serving, newest first, with the CID it replaced. The
+// log comes from the per-host icon timeline and never touches the network.
+//
+// Query parameters:
+//   - url or domain: the site, as for /favicons (required)
+//   - since: only list changes at or after this time (YYYY-MM-DD or RFC 3339)
+func HistoryHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		domain := archive.DomainOf(pageURL)
+		if domain == "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid domain")
+			return
+		}
+		var since time.Time
+		if s := strings.TrimSpace(q.Get("since")); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				if t, err = time.Parse(archive.DateLayout, s); err != nil {
+					writeJSONError(w, http.StatusBadRequest, "since must be YYYY-MM-DD or RFC 3339")
+					return
+				}
+			}
+			since = t
+		}
+
+		versions := cfg.CacheManager.IconTimeline(domain)
+		if len(versions) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no icon history for "+domain)
+			return
+		}
+
+		resp := historyResponse{Domain: domain, Current: versions[len(versions)-1].CID, Changes: []iconChange{}}
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			if v.Time.Before(since) {
+				break
+			}
+			c := iconChange{Time: v.Time, CID: v.CID, IconURL: v.IconURL}
+			if i > 0 {
+				c.PreviousCID = versions[i-1].CID
+			}
+			resp.Changes = append(resp.Changes, c)
+		}
+		resp.Count = len(resp.Changes)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	}
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+// iconInfoResponse is the JSON body served by IconInfoHandler.
+type iconInfoResponse struct {
+	URL           string `json:"url"`
+	IconURL       string `json:"icon_url,omitempty"`
+	InheritedFrom string `json:"inherited_from,omitempty"`
+	// Fallback is set when no icon was found, and /favicons would serve
+	// its placeholder; the fields below are then empty but Status
+	Fallback bool `json:"fallback"`
+	// Status is the HeaderStatus of a lookup that found no icon
+	Status         string `json:"status,omitempty"`
+	Format         string `json:"format,omitempty"` // decoder name, e.g. "png", "ico" or "svg"
+	ContentType    string `json:"content_type,omitempty"`
+	Bytes          int    `json:"bytes,omitempty"`
+	Width          int    `json:"width,omitempty"` // native size; zero for vectors
+	Height         int    `json:"height,omitempty"`
+	Vector         bool   `json:"vector,omitempty"`
+	ContentHash    string `json:"content_hash,omitempty"` // CID, as X-Icon-Content-Hash
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+	DominantColor  string `json:"dominant_color,omitempty"` // #rrggbb
+	// Cache is omitted for icons that are not cached, such as data: URIs
+	Cache *iconCacheInfo `json:"cache,omitempty"`
+}
+
+// iconCacheInfo is the freshness of the cached original of an icon.
+type iconCacheInfo struct {
+	Status    string    `json:"status"`     // X-Cache-Status of the lookup
+	FetchedAt time.Time `json:"fetched_at"` // when it was last fetched or revalidated
+	// ExpiresAt is when it is next revalidated; nil when the cache keeps
+	// originals until evicted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// The origin's validators, with Config.UpstreamHeaders listing them
+	OriginLastModified *time.Time `json:"origin_last_modified,omitempty"`
+	OriginETag         string     `json:"origin_etag,omitempty"`
+}
+
+// IconInfoHandler describes the icon /favicons would serve for a site as
+// JSON instead of its bytes: the source it was chosen from, its native
+// dimensions and format, content hash, dominant colour and how fresh the
+// cached copy is, for clients that host the bytes themselves. Discovery
+// and caching work as for /favicons.
+//
+// Query parameters:
+//   - url or domain: the site, as for /favicons (required)
+//   - sz or size: the size candidates are ranked for, as for /favicons
+//   - rank: candidate ranking strategy, as for /favicons
+func IconInfoHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		ctx, st := reqctx.Ensure(withFetchLog(r.Context()))
+		u, err := security.NormalizeURLContext(ctx, pageURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+
+		st.Size = sizeParam(q, DefaultSize)
+		useCache := !st.Debug.Has(reqctx.DebugNoCache)
+		rank := pickRankingStrategy(q.Get("rank"), cfg)
+		canonPageURL := discovery.CanonicalizeURLString(u.String())
+		resolvedKey := resolvedIconKey(canonPageURL, rank)
+		resp := iconInfoResponse{URL: canonPageURL}
+
+		status := CacheHit
+		if resolved, ok := cfg.CacheManager.ReadResolvedIcon(resolvedKey); ok && useCache {
+			if _, _, ok := readCachedIconBytes(resolved.IconURL, cfg); ok {
+				resp.IconURL, resp.InheritedFrom = resolved.IconURL, resolved.InheritedFrom
+			}
+		}
+		if resp.IconURL == "" {
+			var best image.Image
+			best, resp.IconURL, resp.InheritedFrom = discoverBestIcon(ctx, u, rank, useCache, cfg)
+			status = cacheStatusOf(ctx, resp.IconURL)
+			if best != nil && resp.IconURL != "" {
+				_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, resp.IconURL, resp.InheritedFrom)
+				if rank.Name() == discovery.DefaultRankingStrategy {
+					recordIconVersion(strings.ToLower(u.Hostname()), resp.IconURL, cfg)
+				}
+			}
+		}
+
+		var orig []byte
+		var ct string
+		ok := false
+		if resp.IconURL != "" {
+			orig, ct, ok = readCachedIconBytes(resp.IconURL, cfg)
+		}
+		if !ok {
+			setCacheStatus(w, CacheFallback)
+			setLookupStatus(ctx, w)
+			writeIconInfo(w, iconInfoResponse{URL: canonPageURL, Fallback: true, Status: lookupStatusOf(ctx)})
+			return
+		}
+		img, dec, err := imgpkg.Decode(orig, ct, resp.IconURL, st.Size)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, "icon could not be decoded")
+			return
+		}
+		resp.Format, resp.ContentType, resp.Bytes = dec.Name, ct, len(orig)
+		if dec.Vector {
+			resp.Vector = true
+		} else {
+			resp.Width, resp.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		}
+		resp.ContentHash = cache.ContentCID(orig)
+		if ph, _, ok := iconPerceptualHash(resp.IconURL, cfg); ok {
+			resp.PerceptualHash = ph
+		}
+		if c, ok := imgpkg.DominantColor(img); ok {
+			resp.DominantColor = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+		}
+		if !discovery.IsDataURI(resp.IconURL) {
+			if _, ok, mod := cfg.CacheManager.ReadOrigFromCacheWithMod(resp.IconURL); ok {
+				resp.Cache = &iconCacheInfo{Status: status, FetchedAt: mod.UTC()}
+				if cfg.CacheManager.TTL >= 0 {
+					expires := mod.Add(cfg.CacheManager.TTL).UTC()
+					resp.Cache.ExpiresAt = &expires
+				}
+				setOriginValidators(resp.Cache, resp.IconURL, cfg)
+			}
+		}
+
+		setCacheStatus(w, status)
+		writeIconInfo(w, resp)
+	}
+}
+
+func writeIconInfo(w http.ResponseWriter, resp iconInfoResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(resp)
+}
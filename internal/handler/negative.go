@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/reqctx"
+)
+
+// HeaderStatus tells on placeholder responses why no icon was found:
+//   - not-found: every candidate was missing (such as 404 or 410) or was
+//     not a usable image, so the lookup is not repeated for
+//     Config.NotFoundTTL
+//   - unavailable: the site or an icon failed in a way that may clear up,
+//     such as a 5xx response or a timeout, so the lookup is retried after
+//     Config.UnavailableTTL
+//   - blocked: the URL was refused without a lookup, such as one of a
+//     private address
+const HeaderStatus = "X-Favicon-Status"
+
+// HeaderStatus values.
+const (
+	StatusNotFound    = "not-found"
+	StatusUnavailable = "unavailable"
+	StatusBlocked     = "blocked"
+)
+
+// writeNegative caches the failed lookup of the page canonPageURL, telling
+// permanent failures from transient ones by the outcomes of its upstream
+// requests. A lookup cut short by the request's deadline or cancellation
+// says nothing about the site and is not cached.
+func writeNegative(ctx context.Context, canonPageURL string, outcomes *fetch.Outcomes, cfg *Config) {
+	if ctx.Err() != nil {
+		return
+	}
+	status, ttl := StatusNotFound, cfg.NotFoundTTL
+	if outcomes.Transient() {
+		status, ttl = StatusUnavailable, cfg.UnavailableTTL
+	}
+	reqctx.Debugf(ctx, "No icon for %s (%s), not retrying for %v", canonPageURL, status, ttl)
+	noteLookup(ctx, status)
+	defer reqctx.Time(ctx, reqctx.StageCache)()
+	_ = cfg.CacheManager.WriteNegative(canonPageURL, status, ttl)
+}
+
+// noteLookup logs the HeaderStatus of a lookup that found no icon, if ctx
+// carries a fetch log.
+func noteLookup(ctx context.Context, status string) {
+	if l, ok := ctx.Value(fetchLogKey{}).(*fetchLog); ok {
+		l.mu.Lock()
+		l.lookup = status
+		l.mu.Unlock()
+	}
+}
+
+// lookupStatusOf returns the HeaderStatus logged under ctx, or "".
+func lookupStatusOf(ctx context.Context) string {
+	if l, ok := ctx.Value(fetchLogKey{}).(*fetchLog); ok {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.lookup
+	}
+	return ""
+}
+
+// setLookupStatus sets HeaderStatus from the lookup logged under ctx, if
+// it found no icon.
+func setLookupStatus(ctx context.Context, w http.ResponseWriter) {
+	if s := lookupStatusOf(ctx); s != "" {
+		w.Header().Set(HeaderStatus, s)
+	}
+}
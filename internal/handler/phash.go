@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+)
+
+// iconPerceptualHash returns the perceptual hash and average colour
+// (#rrggbb) of the original icon at srcURL. They are computed on first use
+// and kept in the icon's cache metadata until the icon changes; icons
+// without metadata, such as data: URIs, are hashed every time.
+func iconPerceptualHash(srcURL string, cfg *Config) (phash, avgColor string, ok bool) {
+	cm := cfg.CacheManager
+	meta, hasMeta := cm.ReadOrigMeta(srcURL)
+	if hasMeta && meta.PHash != "" && meta.AvgColor != "" {
+		return meta.PHash, meta.AvgColor, true
+	}
+	orig, ct, ok := readCachedIconBytes(srcURL, cfg)
+	if !ok {
+		return "", "", false
+	}
+	img, _, err := imgpkg.Decode(orig, ct, srcURL, DefaultSize)
+	if err != nil {
+		return "", "", false
+	}
+	c := imgpkg.AverageColor(img)
+	phash, avgColor = imgpkg.PHash(img).String(), fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	if hasMeta {
+		meta.PHash, meta.AvgColor = phash, avgColor
+		_ = cm.WriteOrigMeta(srcURL, meta)
+	}
+	return phash, avgColor, true
+}
+
+// writeVariant caches a resized variant of the icon at srcURL, sharing its
+// storage with byte-identical variants of other icons when
+// cfg.DedupVariants is set, unless the request is over its domain's
+// variant limit. Sharing is keyed by the variant's bytes rather than by
+// perceptual hash: icons that merely look alike would otherwise be served
+// each other's pixels.
+func writeVariant(ctx context.Context, srcURL string, size int, key string, data []byte, cfg *Config) {
+	if reqctx.From(ctx).SkipVariantCache {
+		return
+	}
+	var contentKey string
+	if cfg.DedupVariants {
+		sum := sha256.Sum256(data)
+		contentKey = hex.EncodeToString(sum[:])
+	}
+	_ = cfg.CacheManager.WriteResizedShared(srcURL, size, key, contentKey, data)
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+)
+
+// rootPrefetch is a fetch of a host's /favicon.ico started alongside page
+// discovery. Most sites without icon links, and many with them, end up
+// served their root icon, so on a cold cache it is already in hand when
+// the candidates are fetched instead of costing another round trip.
+type rootPrefetch struct {
+	url  string
+	done chan struct{}
+
+	// Set before done is closed
+	data        []byte
+	contentType string
+	err         error
+}
+
+type prefetchKey struct{}
+
+// discoverCandidates discovers the icon candidates of u, fetching the root
+// icon concurrently when cfg.SpeculativeRootFetch is set. The returned
+// context carries the prefetch for loadIconBytes to pick up.
+func discoverCandidates(ctx context.Context, u *url.URL, size int, cfg *Config) (context.Context, []discovery.IconCandidate) {
+	if cfg.SpeculativeRootFetch {
+		p := &rootPrefetch{url: discovery.RootIconURL(u), done: make(chan struct{})}
+		// Under the request's context, so a candidate that wins the race
+		// early does not cancel it; the result is cached either way
+		go func(ctx context.Context) {
+			defer close(p.done)
+			p.data, p.contentType, p.err = fetchURLCachedWithRevalidation(ctx, p.url, cfg)
+		}(ctx)
+		ctx = context.WithValue(ctx, prefetchKey{}, p)
+	}
+	defer reqctx.Time(ctx, reqctx.StageDiscovery)()
+	return ctx, discovery.DiscoverFromPageThenRoot(ctx, u, size)
+}
+
+// prefetched waits for the prefetch of iconURL carried by ctx. It returns
+// nil when there is none for that URL or it was cancelled, in which case
+// the caller fetches as usual.
+func prefetched(ctx context.Context, iconURL string) *rootPrefetch {
+	p, _ := ctx.Value(prefetchKey{}).(*rootPrefetch)
+	if p == nil || p.url != discovery.CanonicalizeURLString(iconURL) {
+		return nil
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil
+	}
+	if errors.Is(p.err, context.Canceled) {
+		return nil
+	}
+	return p
+}
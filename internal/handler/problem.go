@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"faviconsvc/internal/security"
+)
+
+// Error codes of the problem documents /favicons answers invalid requests
+// with in problem mode (see wantsProblems).
+const (
+	ProblemMissingURL       = "missing-url"
+	ProblemInvalidURL       = "invalid-url"
+	ProblemBlockedHost      = "blocked-host"
+	ProblemUnresolvableHost = "unresolvable-host"
+	ProblemInvalidSize      = "invalid-size"
+)
+
+// ErrorsJSON is the errors query parameter value asking for problem
+// documents instead of placeholder images; ErrorsImage keeps the images
+// whatever the Accept header says.
+const (
+	ErrorsJSON  = "json"
+	ErrorsImage = "image"
+)
+
+// problem is an RFC 7807 problem details document, with the error code and
+// the offending query parameter as extension members.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	Param  string `json:"param,omitempty"`
+}
+
+func newProblem(status int, code, param, detail string) *problem {
+	return &problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail, Code: code, Param: param}
+}
+
+// wantsProblems reports whether a /favicons request that fails validation
+// should be answered with a problem document rather than the placeholder:
+// asked for with errors=json, or with an Accept header listing
+// application/problem+json or application/json. errors=image turns it off.
+func wantsProblems(r *http.Request) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get("errors"))) {
+	case ErrorsJSON:
+		return true
+	case ErrorsImage:
+		return false
+	}
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	return strings.Contains(accept, "application/problem+json") || strings.Contains(accept, "application/json")
+}
+
+// writeProblem answers with p. Like the placeholder it replaces, it
+// depends on the Accept header.
+func writeProblem(w http.ResponseWriter, p *problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// sizeProblem validates the sz (or size) parameter, which sizeParam,
+// sizesParam and dimsParam otherwise clamp or ignore: a size, a list of at
+// most MaxSizes sizes or WxH, each in [MinSize, MaxSize].
+func sizeProblem(q url.Values) *problem {
+	raw := strings.TrimSpace(szValue(q))
+	if raw == "" {
+		return nil
+	}
+	param := "sz"
+	if q.Get("sz") == "" {
+		param = "size"
+	}
+	invalid := func(format string, args ...any) *problem {
+		return newProblem(http.StatusBadRequest, ProblemInvalidSize, param, fmt.Sprintf(format, args...))
+	}
+
+	parts := strings.Split(raw, ",")
+	if ws, hs, found := strings.Cut(strings.ToLower(raw), "x"); found && len(parts) == 1 {
+		parts = []string{ws, hs}
+	} else if len(parts) > MaxSizes {
+		return invalid("%s lists %d sizes, at most %d are allowed", param, len(parts), MaxSizes)
+	}
+	for _, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return invalid("%s %q is not a size, a comma-separated list of sizes or WxH", param, raw)
+		}
+		if n < MinSize || n > MaxSize {
+			return invalid("%s %d is outside %d-%d", param, n, MinSize, MaxSize)
+		}
+	}
+	return nil
+}
+
+// urlProblem describes why security.NormalizeURLContext refused the page
+// of a request with query q.
+func urlProblem(q url.Values, err error) *problem {
+	param := "url"
+	if strings.TrimSpace(q.Get("url")) == "" {
+		param = "domain"
+	}
+	switch {
+	case errors.Is(err, security.ErrBlockedHost):
+		return newProblem(http.StatusForbidden, ProblemBlockedHost, param, err.Error())
+	case errors.Is(err, security.ErrNotResolvable):
+		return newProblem(http.StatusNotFound, ProblemUnresolvableHost, param, err.Error())
+	}
+	return newProblem(http.StatusBadRequest, ProblemInvalidURL, param, err.Error())
+}
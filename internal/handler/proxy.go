@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/fetch"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+// DefaultProxyMaxBytes is the default Config.ProxyMaxBytes.
+const DefaultProxyMaxBytes = 2 << 20
+
+// ProxyHandler serves arbitrary images from allowlisted hosts through the
+// icon pipeline: fetched with the same SSRF-validated client, cached and
+// revalidated as originals, resized to a square and encoded as for
+// /favicons. Nothing of the client's request but the URL reaches the
+// origin, and nothing of the origin's response but the image reaches the
+// client, so no cookies pass either way. It is disabled (404) unless
+// Config.ProxyAllow lists hosts.
+//
+// Query parameters:
+//   - url: the image, on a host in Config.ProxyAllow (required)
+//   - sz or size: Output size in pixels (16-256, default: 32), or WxH
+//   - dpr: Device pixel ratio (1-4) the size is multiplied by
+//   - fit: How a non-square image is made square, default contain
+//   - format, q, filter, theme, mono, mask, pad, trim: as for /favicons
+func ProxyHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.ProxyAllow) == 0 {
+			writeJSONError(w, http.StatusNotFound, "the image proxy is disabled")
+			return
+		}
+		q := r.URL.Query()
+		raw := strings.TrimSpace(q.Get("url"))
+		if raw == "" {
+			writeJSONError(w, http.StatusBadRequest, "url is required")
+			return
+		}
+		ctx, st := reqctx.Ensure(withFetchLog(r.Context()))
+		u, err := security.NormalizeURLContext(ctx, raw)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+		if !hostAllowed(u, cfg.ProxyAllow) {
+			writeJSONError(w, http.StatusForbidden, u.Hostname()+" is not allowed")
+			return
+		}
+		// Redirects must stay on allowed hosts too
+		ctx = fetch.WithRedirectCheck(ctx, func(next *url.URL) error {
+			if !hostAllowed(next, cfg.ProxyAllow) {
+				return errors.New("redirect to " + next.Hostname() + " is not allowed")
+			}
+			return nil
+		})
+
+		startTimings(st, cfg)
+		size := sizeParam(q, DefaultSize)
+		format := pickFormat(r)
+		st.Size, st.Format = size, format
+		st.Theme = themeParam(q)
+		st.Mask = imgpkg.ParseMask(q.Get("mask"), q.Get("radius"))
+		if st.Mono = imgpkg.ParseMono(q.Get("mono"), q.Get("color")); st.Mono != "" {
+			st.Theme = ""
+		}
+		st.Trim, st.Pad = trimParams(q)
+		st.Filter = filterParam(q, cfg)
+		// Stretching would distort photos and banners, so images are
+		// letterboxed unless asked otherwise
+		if st.Fit = imgpkg.ParseFit(q.Get("fit")); st.Fit == "" {
+			st.Fit = imgpkg.FitContain
+		}
+		setHeightParam(q, st, cfg)
+		size = applyDPR(r, st, cfg)
+		st.Quality = qualityParam(q)
+		r = r.WithContext(ctx)
+
+		host := strings.ToLower(u.Hostname())
+		if served := admitVariant(ctx, host, size, cfg); served != size {
+			w.Header().Set(HeaderSize, strconv.Itoa(served))
+			if st.DPR > 0 {
+				st.DPR = st.DPR * float64(served) / float64(size)
+			}
+			size, st.Size = served, served
+		}
+
+		srcURL := discovery.CanonicalizeURLString(u.String())
+		key := variantKey(format, st)
+		cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+		b, ok, mod := cfg.CacheManager.ReadResizedFromCacheWithMod(srcURL, size, key)
+		cacheDone()
+		if ok && len(b) > 0 {
+			setCacheStatus(w, CacheHit)
+			setUpstreamHeaders(w, srcURL, cfg)
+			serveBytes(w, r, b, imgpkg.ContentTypeFor(format), mod, RouteIcon, cfg)
+			return
+		}
+
+		orig, ct, err := loadIconBytes(ctx, srcURL, cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, "image could not be fetched")
+			return
+		}
+		// Bodies are cut at fetch.MaxFetchBytes, so one that long may be
+		// truncated
+		if int64(len(orig)) > proxyMaxBytes(cfg) || len(orig) >= fetch.MaxFetchBytes {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "image exceeds "+strconv.FormatInt(proxyMaxBytes(cfg), 10)+" bytes")
+			return
+		}
+		img, err := decodeAndResize(ctx, orig, ct, srcURL, size, cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "not a supported image")
+			return
+		}
+		reqctx.Debugf(ctx, "Proxied %s at %dpx", srcURL, size)
+		setCacheStatus(w, cacheStatusOf(ctx, srcURL))
+		serveImageVariantWithSource(w, r, img, size, format, time.Now(), srcURL, cfg)
+	}
+}
+
+// hostAllowed reports whether u is on one of hosts or a subdomain of one,
+// as Config.ProxyAllow and Config.DefaultImageAllow list them.
+func hostAllowed(u *url.URL, hosts []string) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, allowed := range hosts {
+		allowed = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(allowed)), "*.")
+		if allowed != "" && (host == allowed || strings.HasSuffix(host, "."+allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyMaxBytes returns Config.ProxyMaxBytes, or fetch.MaxFetchBytes when
+// it is unset or larger.
+func proxyMaxBytes(cfg *Config) int64 {
+	if cfg.ProxyMaxBytes <= 0 || cfg.ProxyMaxBytes > fetch.MaxFetchBytes {
+		return fetch.MaxFetchBytes
+	}
+	return cfg.ProxyMaxBytes
+}
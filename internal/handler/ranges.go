@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange returns the part of a body of size bytes that r asks for with
+// a Range header, as [start, end), and the status to answer with:
+// http.StatusPartialContent for a satisfiable range,
+// http.StatusRequestedRangeNotSatisfiable for one past the end, and
+// http.StatusOK, with the whole body, otherwise. Only single byte ranges
+// are served; lists of ranges, malformed headers and ranges whose If-Range
+// no longer matches get the whole body, as RFC 9110 §14.2 allows.
+func byteRange(r *http.Request, size int, etag string, lastMod time.Time) (start, end, status int) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(r.Header.Get("Range")), "bytes=")
+	if !ok || strings.Contains(spec, ",") || !ifRangeMatches(r.Header.Get("If-Range"), etag, lastMod) {
+		return 0, size, http.StatusOK
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, http.StatusOK
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return 0, size, http.StatusOK
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable
+		}
+		return size - min(n, size), size, http.StatusPartialContent
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, size, http.StatusOK
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < start {
+			return 0, size, http.StatusOK
+		}
+		end = min(n+1, size)
+	}
+	if start >= size {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable
+	}
+	return start, end, http.StatusPartialContent
+}
+
+// ifRangeMatches reports whether an If-Range header value allows a range
+// to be served: it is empty, the strong etag, or exactly lastMod. Weak
+// tags never match, as RFC 9110 §13.1.5 requires.
+func ifRangeMatches(ifRange, etag string, lastMod time.Time) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !lastMod.IsZero() && t.Equal(lastMod.UTC().Truncate(time.Second))
+}
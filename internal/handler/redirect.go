@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/analytics"
+)
+
+// ResponseTypeRedirect is the response_type of /favicons requests answered
+// with a redirect to the original icon (see serveRedirect).
+const ResponseTypeRedirect = "redirect"
+
+// serveRedirect answers a response_type=redirect request for the page u
+// with a 302 to the URL of its best icon, for clients that want discovery
+// but fetch icons themselves. The icon is found as for image responses and
+// the resolved mapping is cached, so repeated requests are answered
+// without contacting the site; the icon itself is never fetched once the
+// mapping is known. A page without an icon gets the placeholder.
+//
+// It returns false, serving nothing, for icons inlined as data: URIs,
+// which cannot be redirected to; the caller serves them as images.
+func serveRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request, u *url.URL, rec *analytics.Record, cfg *Config) bool {
+	st := reqctx.From(ctx)
+	useCache := !st.Debug.Has(reqctx.DebugNoCache)
+	rank := pickRankingStrategy(r.URL.Query().Get("rank"), cfg)
+	resolvedKey := resolvedIconKey(discovery.CanonicalizeURLString(u.String()), rank)
+
+	cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+	resolved, ok := cfg.CacheManager.ReadResolvedIcon(resolvedKey)
+	cacheDone()
+	iconURL, inheritedFrom, status := resolved.IconURL, resolved.InheritedFrom, CacheHit
+	rec.CacheTier = "resolved"
+	if !ok || !useCache || iconURL == "" {
+		best, bestSrc, inherited := discoverBestIcon(ctx, u, rank, useCache, cfg)
+		rec.CacheTier = "fetch"
+		if best == nil {
+			setLookupStatus(ctx, w)
+			serveImageVariant(w, r, nil, st.Size, st.Format, time.Now(), cfg)
+			return true
+		}
+		cacheDone = reqctx.Time(ctx, reqctx.StageCache)
+		_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, bestSrc, inherited)
+		cacheDone()
+		if rank.Name() == discovery.DefaultRankingStrategy {
+			recordIconVersion(rec.Domain, bestSrc, cfg)
+		}
+		iconURL, inheritedFrom, status = bestSrc, inherited, cacheStatusOf(ctx, bestSrc)
+	}
+	if discovery.IsDataURI(iconURL) {
+		return false
+	}
+
+	reqctx.Debugf(ctx, "Redirecting %s to %s", u, iconURL)
+	rec.Outcome = "redirect"
+	if inheritedFrom != "" {
+		w.Header().Set(HeaderInheritedFrom, inheritedFrom)
+	}
+	setCacheStatus(w, status)
+	// Unlike rendered icons the target can change on the next discovery,
+	// so the redirect is cached for max-age but not immutable
+	bsec, csec := cacheMaxAges(cfg)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(bsec)+", s-maxage="+strconv.Itoa(csec))
+	setServerTiming(w, r)
+	cfg.ResponseHeaders.apply(w, RouteIcon)
+	http.Redirect(w, r, iconURL, http.StatusFound)
+	return true
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/logger"
+)
+
+const (
+	// HeaderReplayMatch reports whether a replayed response is byte for
+	// byte the recorded one ("true" or "false"; absent when the bundle has
+	// no recorded response).
+	HeaderReplayMatch = "X-Replay-Match"
+	// HeaderReplayMissing counts upstream requests of a replay that the
+	// bundle had no exchange for.
+	HeaderReplayMissing = "X-Replay-Missing"
+
+	// maxBundleBytes caps bundles uploaded to DebugReplayHandler.
+	maxBundleBytes = 64 << 20
+)
+
+// DebugRecordHandler serves a /favicons request on an empty scratch cache
+// and returns a bundle of every upstream request it made, with headers and
+// bodies, and a summary of the response. Feeding the bundle to
+// DebugReplayHandler later reproduces the response exactly, however the
+// site has changed since.
+//
+// Query parameters are those of /favicons; the Accept header is kept too.
+func DebugRecordHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pageURLParam(r.URL.Query()) == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		scratch, cleanup, err := scratchConfig(cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "scratch cache: "+err.Error())
+			return
+		}
+		defer cleanup()
+
+		b := &fetch.Bundle{
+			Version:  fetch.BundleVersion,
+			Recorded: time.Now().UTC(),
+			Request:  "/favicons?" + r.URL.RawQuery,
+			Accept:   r.Header.Get("Accept"),
+		}
+		rec := &fetch.Recorder{}
+		resp, err := serveBundleRequest(fetch.WithRecorder(r.Context(), rec), b, scratch)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		b.Response = resp.summary()
+		b.Exchanges = rec.Exchanges()
+		logger.Info("Recorded %d upstream exchanges for %s", len(b.Exchanges), b.Request)
+		for _, e := range b.Exchanges {
+			if e.Truncated {
+				logger.Warn("Recording of %s: body of %s %s exceeds %d bytes and was cut; the bundle cannot replay it", b.Request, e.Method, e.URL, fetch.MaxFetchBytes)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", `attachment; filename="favicon-bundle.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(b)
+	}
+}
+
+// DebugReplayHandler serves the request of a bundle posted by a client
+// (see DebugRecordHandler) from its recorded exchanges alone: no network
+// access, no DNS lookups, and an empty scratch cache. The response is the
+// one the pipeline now produces, with HeaderReplayMatch telling whether it
+// equals the recorded one and HeaderReplayMissing counting requests the
+// bundle could not answer (those fail as if the site were unreachable).
+func DebugReplayHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "replay requires POST with a bundle")
+			return
+		}
+		var b fetch.Bundle
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBundleBytes)).Decode(&b); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid bundle: "+err.Error())
+			return
+		}
+		if b.Version != fetch.BundleVersion {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unsupported bundle version %d (want %d)", b.Version, fetch.BundleVersion))
+			return
+		}
+		scratch, cleanup, err := scratchConfig(cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "scratch cache: "+err.Error())
+			return
+		}
+		defer cleanup()
+
+		rp := fetch.NewReplayer(&b)
+		ctx := fetch.WithReplayer(security.WithoutResolve(r.Context()), rp)
+		resp, err := serveBundleRequest(ctx, &b, scratch)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		missing := rp.Missing()
+		for _, m := range missing {
+			reqctx.Debugf(r.Context(), "Replay of %s: %s not in bundle", b.Request, m)
+		}
+
+		for k, v := range resp.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(HeaderReplayMissing, strconv.Itoa(len(missing)))
+		if b.Response != nil {
+			got := resp.summary()
+			w.Header().Set(HeaderReplayMatch, strconv.FormatBool(got.Status == b.Response.Status && got.SHA256 == b.Response.SHA256))
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
+	}
+}
+
+// serveBundleRequest runs the /favicons request of b under ctx against cfg
+// and returns the buffered response.
+func serveBundleRequest(ctx context.Context, b *fetch.Bundle, cfg *Config) (*capturedResponse, error) {
+	u, err := url.Parse(b.Request)
+	if err != nil || u.Path != "/favicons" {
+		return nil, fmt.Errorf("bundle request %q is not a /favicons request", b.Request)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Accept != "" {
+		req.Header.Set("Accept", b.Accept)
+	}
+	resp := &capturedResponse{header: http.Header{}}
+	FaviconHandler(cfg)(resp, req)
+	return resp, nil
+}
+
+// scratchConfig returns a copy of cfg on an empty temporary cache, so a
+// recorded or replayed request neither reads nor changes the live cache
+// and analytics. cleanup removes the cache.
+func scratchConfig(cfg *Config) (scratch *Config, cleanup func(), err error) {
+	dir, err := os.MkdirTemp("", "favicon-scratch-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cm := cache.New(dir, cfg.CacheManager.TTL)
+	if err := cm.EnsureDirs(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	c := *cfg
+	c.CacheManager = cm
+	c.Analytics = nil
+	c.fetchGroup = cache.NewGroup()
+	c.lookups = newLookupTracker()
+	// Which raced candidates get fetched before the search stops depends on
+	// timing, and the speculative fetch can outlive the request and miss
+	// the bundle; fetching candidates in order keeps replays in step with
+	// their recording
+	c.ParallelFetches = 1
+	c.SpeculativeRootFetch = false
+	return &c, func() { os.RemoveAll(dir) }, nil
+}
+
+// capturedResponse buffers a response so it can be inspected before it is
+// sent on.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header { return c.header }
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(p)
+}
+
+func (c *capturedResponse) summary() *fetch.BundleResponse {
+	sum := sha256.Sum256(c.body.Bytes())
+	return &fetch.BundleResponse{
+		Status:      c.status,
+		ContentType: c.header.Get("Content-Type"),
+		Bytes:       c.body.Len(),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+}
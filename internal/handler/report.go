@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/internal/security"
+)
+
+const (
+	// reportMinEdge is the smallest largest-icon edge the report accepts
+	// without recommending a bigger one: the apple-touch-icon size.
+	reportMinEdge = 180
+	// reportMaxBytes is the icon file size above which the report flags
+	// the file as heavy.
+	reportMaxBytes = 100 << 10
+)
+
+// Recommendation codes in a site report.
+const (
+	recNoIconLinks   = "no_icon_links"
+	recRenderedOnly  = "rendered_only"
+	recBrokenIcons   = "broken_icons"
+	recNoRootFavicon = "no_root_favicon"
+	recNoAppleTouch  = "missing_apple_touch_icon"
+	recNoSVG         = "no_svg"
+	recSmallIcons    = "small_icons"
+	recSizeMismatch  = "size_mismatch"
+	recHeavyIcon     = "heavy_icon"
+	recTypeMismatch  = "type_mismatch"
+	recNoUsableIcon  = "no_usable_icon"
+)
+
+// Recommendation severities.
+const (
+	recSeverityError   = "error"
+	recSeverityWarning = "warning"
+	recSeverityInfo    = "info"
+)
+
+// reportIcon is one icon declared by, or probed for, the site.
+type reportIcon struct {
+	URL    string `json:"url"`
+	Source string `json:"source"`
+	// Rel is icon, apple-touch-icon, or root for the /favicon.ico probe
+	Rel string `json:"rel"`
+	// Type and Sizes are what the page declared
+	Type  string `json:"type,omitempty"`
+	Sizes []int  `json:"sizes,omitempty"`
+	// OK is false when the icon could not be fetched or decoded; Error
+	// says why
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Vector      bool   `json:"vector,omitempty"`
+	Selected    bool   `json:"selected,omitempty"`
+}
+
+// reportRecommendation is one suggested fix, most severe first.
+type reportRecommendation struct {
+	Code     string   `json:"code"`
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	URLs     []string `json:"urls,omitempty"`
+}
+
+// siteReport is the body of a /report response.
+type siteReport struct {
+	Domain          string                 `json:"domain"`
+	Page            string                 `json:"page"`
+	GeneratedAt     time.Time              `json:"generated_at"`
+	Selected        string                 `json:"selected,omitempty"`
+	Icons           []reportIcon           `json:"icons"`
+	Recommendations []reportRecommendation `json:"recommendations"`
+}
+
+// exhaustiveRank ranks like its strategy but is never satisfied, so every
+// candidate gets fetched.
+type exhaustiveRank struct{ discovery.RankingStrategy }
+
+func (exhaustiveRank) Sufficient(discovery.RankedIcon, int, int) bool { return false }
+
+// ReportHandler returns a handler describing a site's icon setup for its
+// owner: every icon the page links and the /favicon.ico probe, each
+// fetched and decoded, which one /favicons would serve, and what to fix.
+// Discovery runs fresh, as for /debug/discover, but hinted URLs are left
+// out since they are not part of the site.
+//
+// Query parameters:
+//   - url or domain: the page to report on
+//   - format: json (default) or html; html is also served to clients
+//     whose Accept header prefers it, such as browsers
+func ReportHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		pageURL := pageURLParam(q)
+		if pageURL == "" {
+			writeJSONError(w, http.StatusBadRequest, "url or domain is required")
+			return
+		}
+		u, err := security.NormalizeURLContext(r.Context(), pageURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid url: "+err.Error())
+			return
+		}
+
+		ctx, st := reqctx.Ensure(r.Context())
+		st.Size, st.Format = DefaultSize, "png"
+		rank := pickRankingStrategy("", cfg)
+
+		cands := discovery.DiscoverFromPageThenRoot(ctx, u, st.Size)
+		rank.Order(cands, st.Size)
+		results := raceCandidates(ctx, cands, exhaustiveRank{rank}, cfg)
+		best := bestResult(results, rank, st.Size)
+
+		rep := siteReport{
+			Domain:      strings.ToLower(u.Hostname()),
+			Page:        discovery.CanonicalizeURLString(u.String()),
+			GeneratedAt: time.Now().UTC(),
+			Icons:       make([]reportIcon, 0, len(cands)),
+		}
+		for i, c := range cands {
+			ic := reportIcon{URL: traceURL(c.URL), Source: c.Source, Rel: c.Rel(), Type: c.Type, Sizes: c.Sizes}
+			if i < len(results) {
+				res := results[i]
+				ic.ContentType, ic.Bytes, ic.Format = res.contentType, res.bytes, res.decoder
+				ic.Width, ic.Height, ic.Vector = res.icon.Width, res.icon.Height, res.icon.Vector
+				ic.OK = res.src != "" && res.err == nil
+				if res.err != nil {
+					ic.Error = res.err.Error()
+				}
+			}
+			if i == best {
+				ic.Selected = true
+				rep.Selected = ic.URL
+			}
+			rep.Icons = append(rep.Icons, ic)
+		}
+		rep.Recommendations = recommend(rep.Icons)
+
+		w.Header().Set("Cache-Control", "no-store")
+		if wantsHTMLReport(r) {
+			var buf bytes.Buffer
+			if err := reportTemplate.Execute(&buf, rep); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "rendering report failed")
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write(buf.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	}
+}
+
+// wantsHTMLReport reports whether the report should be HTML: asked for
+// with format=html, or preferred by the Accept header over JSON.
+func wantsHTMLReport(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	h, j := strings.Index(accept, "text/html"), strings.Index(accept, "application/json")
+	return h >= 0 && (j < 0 || h < j)
+}
+
+// recommend returns what a site should fix about icons, most severe first.
+func recommend(icons []reportIcon) []reportRecommendation {
+	var (
+		out                           []reportRecommendation
+		linked, rendered, broken      []string
+		rootOK, appleOK, svgOK, anyOK bool
+		largest                       int
+		mismatched, heavy, wrongType  []string
+	)
+	for _, ic := range icons {
+		if ic.Rel == "root" {
+			rootOK = rootOK || ic.OK
+			continue
+		}
+		linked = append(linked, ic.URL)
+		if ic.Source == discovery.SourceRendered {
+			rendered = append(rendered, ic.URL)
+		}
+		if !ic.OK {
+			broken = append(broken, ic.URL)
+			continue
+		}
+		anyOK = true
+		appleOK = appleOK || ic.Rel == "apple-touch-icon"
+		svgOK = svgOK || ic.Vector
+		largest = max(largest, ic.Width, ic.Height)
+		if edge := max(ic.Width, ic.Height); !ic.Vector && len(ic.Sizes) > 0 && !slices.Contains(ic.Sizes, edge) {
+			mismatched = append(mismatched, ic.URL)
+		}
+		if ic.Bytes > reportMaxBytes {
+			heavy = append(heavy, ic.URL)
+		}
+		if ic.Type != "" && ic.ContentType != "" && !reportTypesAgree(ic.Type, ic.ContentType) {
+			wrongType = append(wrongType, ic.URL)
+		}
+	}
+	add := func(code, severity, msg string, urls []string) {
+		out = append(out, reportRecommendation{Code: code, Severity: severity, Message: msg, URLs: urls})
+	}
+
+	if !anyOK && !rootOK {
+		add(recNoUsableIcon, recSeverityError, "No icon could be fetched and decoded; browsers and this service show a placeholder.", nil)
+	}
+	if len(linked) == 0 {
+		add(recNoIconLinks, recSeverityError, `The page has no <link rel="icon">; clients can only guess /favicon.ico.`, nil)
+	} else if len(rendered) == len(linked) {
+		add(recRenderedOnly, recSeverityWarning, "Icon links only appear after JavaScript runs; put them in the HTML so crawlers and link previews find them.", rendered)
+	}
+	if len(broken) > 0 {
+		add(recBrokenIcons, recSeverityError, "Some linked icons fail to load or are not valid images; fix or remove the links.", broken)
+	}
+	if !rootOK {
+		add(recNoRootFavicon, recSeverityWarning, "/favicon.ico is missing; some clients request it without reading the page.", nil)
+	}
+	if !appleOK {
+		add(recNoAppleTouch, recSeverityWarning, `No working <link rel="apple-touch-icon">; add a 180x180 PNG for home screens and bookmarks.`, nil)
+	}
+	if !svgOK {
+		add(recNoSVG, recSeverityInfo, `No SVG icon; one <link rel="icon" type="image/svg+xml"> stays sharp at every size.`, nil)
+	}
+	if anyOK && !svgOK && largest < reportMinEdge {
+		add(recSmallIcons, recSeverityWarning, fmt.Sprintf("The largest icon is %dpx; provide at least %dx%d so high-density displays need not upscale.", largest, reportMinEdge, reportMinEdge), nil)
+	}
+	if len(mismatched) > 0 {
+		add(recSizeMismatch, recSeverityInfo, "The sizes attribute does not match the image's actual size.", mismatched)
+	}
+	if len(wrongType) > 0 {
+		add(recTypeMismatch, recSeverityInfo, "The type attribute does not match what the server sends.", wrongType)
+	}
+	if len(heavy) > 0 {
+		add(recHeavyIcon, recSeverityInfo, fmt.Sprintf("Icons over %d KB slow down page loads; optimize or resize them.", reportMaxBytes>>10), heavy)
+	}
+	if out == nil {
+		out = []reportRecommendation{}
+	}
+	return out
+}
+
+// reportTypesAgree reports whether a declared type attribute and the
+// content type the icon was detected as describe the same format.
+func reportTypesAgree(declared, detected string) bool {
+	norm := func(t string) string {
+		t, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(t)), ";")
+		switch t {
+		case "image/x-icon", "image/vnd.microsoft.icon", "image/ico":
+			return "ico"
+		case "image/svg+xml", "text/xml", "application/xml":
+			return "svg"
+		}
+		return strings.TrimPrefix(t, "image/")
+	}
+	d, c := norm(declared), norm(detected)
+	// Content sniffing reports plain text for some SVGs and octet-stream for
+	// formats it does not know
+	return d == c || c == "text/plain" || c == "application/octet-stream"
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Icon report for {{.Domain}}</title>
+<style>
+body { font: 15px/1.5 system-ui, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: .4em .6em; text-align: left; vertical-align: top; }
+td.url { word-break: break-all; }
+.error { color: #b3261e; } .warning { color: #8a5a00; } .info { color: #555; }
+.ok { color: #1b6e20; }
+</style>
+</head>
+<body>
+<h1>Icon report for {{.Domain}}</h1>
+<p>Page <code>{{.Page}}</code>, checked {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}.
+{{if .Selected}}This service serves <code>{{.Selected}}</code>.{{else}}No usable icon was found.{{end}}</p>
+
+<h2>Recommendations</h2>
+{{if .Recommendations}}<ul>
+{{range .Recommendations}}<li class="{{.Severity}}"><strong>{{.Severity}}</strong>: {{.Message}}{{if .URLs}}<ul>{{range .URLs}}<li><code>{{.}}</code></li>{{end}}</ul>{{end}}</li>
+{{end}}</ul>{{else}}<p class="ok">Nothing to fix.</p>{{end}}
+
+<h2>Icons</h2>
+<table>
+<tr><th>URL</th><th>Rel</th><th>Declared</th><th>Actual</th><th>Status</th></tr>
+{{range .Icons}}<tr>
+<td class="url">{{.URL}}{{if .Selected}} <strong>(served)</strong>{{end}}</td>
+<td>{{.Rel}}</td>
+<td>{{.Type}}{{range .Sizes}} {{.}}px{{end}}</td>
+<td>{{if .OK}}{{.Format}}{{if .Vector}} vector{{else}} {{.Width}}x{{.Height}}{{end}}, {{.Bytes}} bytes{{end}}</td>
+<td>{{if .OK}}<span class="ok">ok</span>{{else}}<span class="error">broken</span>: {{.Error}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
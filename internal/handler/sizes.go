@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/analytics"
+)
+
+// MaxSizes caps how many sizes one multi-size request may ask for; further
+// sizes are ignored.
+const MaxSizes = 8
+
+// HeaderSize names the edge length of each part of a multipart multi-size
+// response, and of a single icon served at another size than asked for
+// because its domain is over Config.MaxVariantsPerDomain.
+const HeaderSize = "X-Favicon-Size"
+
+// sizesResponse is the JSON body of a multi-size response.
+type sizesResponse struct {
+	IconURL       string `json:"icon_url,omitempty"`
+	InheritedFrom string `json:"inherited_from,omitempty"`
+	// Blurhash is the icon's BlurHash, with Config.Blurhash
+	Blurhash string `json:"blurhash,omitempty"`
+	// Fallback is set when no icon was found and the icons are placeholders
+	Fallback bool        `json:"fallback,omitempty"`
+	Icons    []sizedIcon `json:"icons"`
+}
+
+// sizedIcon is one size of a multi-size response.
+type sizedIcon struct {
+	Size        int    `json:"size"`
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+	DataURI     string `json:"data_uri"`
+	data        []byte
+}
+
+// sizesParam parses the sz (or size) query parameter as a comma-separated
+// list of sizes, each clamped to [MinSize, MaxSize], in the order given.
+// Invalid entries, WxH pairs (see dimsParam) and repeats are skipped, and
+// at most MaxSizes are kept.
+func sizesParam(q url.Values) []int {
+	var sizes []int
+	for _, part := range strings.Split(szValue(q), ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		n = min(max(n, MinSize), MaxSize)
+		if !slices.Contains(sizes, n) && len(sizes) < MaxSizes {
+			sizes = append(sizes, n)
+		}
+	}
+	return sizes
+}
+
+// szValue returns the sz query parameter, or size when sz is missing.
+func szValue(q url.Values) string {
+	if sz := q.Get("sz"); sz != "" {
+		return sz
+	}
+	return q.Get("size")
+}
+
+// dimsParam parses an sz (or size) parameter of the form WxH, e.g. 64x40,
+// returning the width and height, each clamped to [MinSize, MaxSize]. It
+// returns ok=false for anything else, including lists.
+func dimsParam(q url.Values) (width, height int, ok bool) {
+	ws, hs, found := strings.Cut(strings.ToLower(strings.TrimSpace(szValue(q))), "x")
+	if !found {
+		return 0, 0, false
+	}
+	w, err1 := strconv.Atoi(strings.TrimSpace(ws))
+	h, err2 := strconv.Atoi(strings.TrimSpace(hs))
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return min(max(w, MinSize), MaxSize), min(max(h, MinSize), MaxSize), true
+}
+
+// serveSizes answers a /favicons request for several sizes at once. The
+// best icon is looked up and ranked for the largest size, its source is
+// decoded once (vector sources are rendered again at every size so each
+// stays crisp), and the sizes missing from the resized cache are produced
+// in parallel and cached like single-size responses.
+//
+// The response is JSON with a data: URI per size, or multipart/mixed with
+// a part per size when the client accepts that.
+func serveSizes(ctx context.Context, w http.ResponseWriter, r *http.Request, u *url.URL, sizes []int, format string, rec *analytics.Record, cfg *Config) {
+	st := reqctx.From(ctx)
+	// A domain past its variant limit gets the nearest sizes it has
+	var admitted []int
+	for _, size := range sizes {
+		if size = admitVariant(ctx, rec.Domain, size, cfg); !slices.Contains(admitted, size) {
+			admitted = append(admitted, size)
+		}
+	}
+	sizes = admitted
+	st.Size = slices.Max(sizes)
+	rec.Size = st.Size
+	useCache := !st.Debug.Has(reqctx.DebugNoCache)
+	rank := pickRankingStrategy(r.URL.Query().Get("rank"), cfg)
+	canonPageURL := discovery.CanonicalizeURLString(u.String())
+	resolvedKey := resolvedIconKey(canonPageURL, rank)
+
+	var resp sizesResponse
+	var best image.Image
+	status := CacheReencoded
+	cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+	resolved, ok := cfg.CacheManager.ReadResolvedIcon(resolvedKey)
+	cacheDone()
+	if ok && useCache {
+		if _, _, ok := readCachedIconBytes(resolved.IconURL, cfg); ok {
+			resp.IconURL, resp.InheritedFrom = resolved.IconURL, resolved.InheritedFrom
+			rec.CacheTier = "orig"
+		}
+	}
+	if resp.IconURL == "" {
+		best, resp.IconURL, resp.InheritedFrom = discoverBestIcon(ctx, u, rank, useCache, cfg)
+		rec.CacheTier = "fetch"
+		status = cacheStatusOf(ctx, resp.IconURL)
+		if best != nil {
+			cacheDone = reqctx.Time(ctx, reqctx.StageCache)
+			_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, resp.IconURL, resp.InheritedFrom)
+			cacheDone()
+			if rank.Name() == discovery.DefaultRankingStrategy {
+				recordIconVersion(rec.Domain, resp.IconURL, cfg)
+			}
+		}
+	}
+
+	if resp.IconURL != "" {
+		var allCached bool
+		resp.Icons, allCached = renderSizes(ctx, resp.IconURL, best, sizes, format, cfg)
+		if allCached {
+			status = CacheHit
+		}
+	}
+	if resp.Icons == nil {
+		resp = sizesResponse{Fallback: true, Icons: fallbackSizes(r, sizes, format, cfg)}
+		status = CacheFallback
+		setLookupStatus(ctx, w)
+		markFallback(w)
+	} else {
+		rec.Outcome = "ok"
+	}
+
+	if resp.InheritedFrom != "" {
+		w.Header().Set(HeaderInheritedFrom, resp.InheritedFrom)
+	}
+	setCacheStatus(w, status)
+	if !resp.Fallback {
+		// Each size has a cache key of its own, so only the hash applies
+		setCacheInfoHeaders(w, resp.IconURL, 0, "", cfg)
+		setUpstreamHeaders(w, resp.IconURL, cfg)
+		setBlurhashHeader(w, resp.IconURL, cfg)
+		resp.Blurhash = w.Header().Get(HeaderBlurhash)
+	}
+	if strings.Contains(strings.ToLower(r.Header.Get("Accept")), "multipart/mixed") {
+		body, ct := multipartSizes(resp.Icons)
+		serveBytes(w, r, body, ct, time.Now(), RouteSizes, cfg)
+		return
+	}
+	for i := range resp.Icons {
+		ic := &resp.Icons[i]
+		ic.DataURI = "data:" + ic.ContentType + ";base64," + base64.StdEncoding.EncodeToString(ic.data)
+	}
+	body, _ := json.Marshal(resp)
+	serveBytes(w, r, body, "application/json", time.Now(), RouteSizes, cfg)
+}
+
+// renderSizes returns the icon at srcURL encoded at each of sizes, or nil
+// if its source can no longer be decoded, and whether every size came from
+// the resized cache. best, when not nil, is the icon already decoded for
+// the largest size, used if the source bytes are gone.
+func renderSizes(ctx context.Context, srcURL string, best image.Image, sizes []int, format string, cfg *Config) ([]sizedIcon, bool) {
+	st := reqctx.From(ctx)
+	key := variantKey(format, st)
+	icons := make([]sizedIcon, len(sizes))
+	var missing []int
+	cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+	for i, size := range sizes {
+		if b, ok, _ := cfg.CacheManager.ReadResizedFromCacheWithMod(srcURL, size, key); ok && len(b) > 0 {
+			icons[i] = sizedIcon{Size: size, ContentType: imgpkg.ContentTypeFor(format), Bytes: len(b), data: b}
+			continue
+		}
+		missing = append(missing, i)
+	}
+	cacheDone()
+	if len(missing) == 0 {
+		return icons, true
+	}
+
+	// Decode once; vector sources are rendered per size instead
+	src := best
+	var dec imgpkg.Decoder
+	orig, ct, ok := readCachedIconBytes(srcURL, cfg)
+	if ok {
+		decodeDone := reqctx.Time(ctx, reqctx.StageDecode)
+		img, d, err := imgpkg.Decode(orig, ct, srcURL, st.Size)
+		decodeDone()
+		if err == nil {
+			src, dec = img, d
+		}
+	}
+	if src == nil {
+		return nil, false
+	}
+
+	var wg sync.WaitGroup
+	for _, i := range missing {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := sizes[i]
+			img := src
+			decodeDone := reqctx.Time(ctx, reqctx.StageDecode)
+			if dec.Vector {
+				if v, err := dec.Decode(orig, size); err == nil {
+					img = v
+				}
+			}
+			img = resizeIcon(ctx, img, size)
+			decodeDone()
+			encodeDone := reqctx.Time(ctx, reqctx.StageEncode)
+			img, cacheable := applyVariant(ctx, img)
+			data, ct := encodeVariant(img, format, st.Quality)
+			encodeDone()
+			if cacheable {
+				cacheDone := reqctx.Time(ctx, reqctx.StageCache)
+				writeVariant(ctx, srcURL, size, key, data, cfg)
+				cacheDone()
+			}
+			icons[i] = sizedIcon{Size: size, ContentType: ct, Bytes: len(data), data: data}
+		}(i)
+	}
+	wg.Wait()
+	return icons, false
+}
+
+// fallbackSizes returns the request's placeholder encoded at each of sizes.
+func fallbackSizes(r *http.Request, sizes []int, format string, cfg *Config) []sizedIcon {
+	st := reqctx.From(r.Context())
+	icons := make([]sizedIcon, len(sizes))
+	defer reqctx.Time(r.Context(), reqctx.StageEncode)()
+	for i, size := range sizes {
+		img, _ := applyVariant(r.Context(), fallbackImage(r, size, cfg))
+		data, ct := encodeVariant(img, format, st.Quality)
+		icons[i] = sizedIcon{Size: size, ContentType: ct, Bytes: len(data), data: data}
+	}
+	return icons
+}
+
+// encodeVariant encodes img in format, falling back to PNG and then to a
+// blank PNG as single-size responses do.
+func encodeVariant(img image.Image, format string, quality int) ([]byte, string) {
+	data, ct := imgpkg.EncodeByFormat(img, format, quality)
+	if data == nil {
+		data, ct = imgpkg.EncodeByFormat(img, "png", 0)
+	}
+	if len(data) == 0 {
+		data, ct = imgpkg.EncodeByFormat(imgpkg.CreateBlankImage(), "png", 0)
+	}
+	return data, ct
+}
+
+// multipartSizes returns icons as a multipart/mixed body and its content
+// type. The boundary is derived from the parts, so equal responses are
+// byte for byte equal and keep their ETag.
+func multipartSizes(icons []sizedIcon) ([]byte, string) {
+	h := sha256.New()
+	for _, ic := range icons {
+		h.Write(ic.data)
+	}
+	boundary := "favicon-" + hex.EncodeToString(h.Sum(nil)[:16])
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.SetBoundary(boundary)
+	for _, ic := range icons {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {ic.ContentType},
+			"Content-Length": {strconv.Itoa(len(ic.data))},
+			HeaderSize:       {strconv.Itoa(ic.Size)},
+		})
+		_, _ = part.Write(ic.data)
+	}
+	_ = mw.Close()
+	return buf.Bytes(), "multipart/mixed; boundary=" + boundary
+}
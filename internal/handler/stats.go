@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+)
+
+// StatsHandler returns an HTTP handler serving historical request statistics as JSON.
+//
+// Query parameters:
+//   - window: Duration of raw history to summarize (default: 24h)
+//   - days: Number of daily rollups to include (default: 30)
+//   - top: Number of top domains to list (default: 10), both requested and
+//     upstream
+//
+// The upstream section lists the sites icons are fetched from that had the
+// most traffic in the last hour, with request, byte, error and throttle
+// counts over rolling windows and since startup.
+func StatsHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		window := 24 * time.Hour
+		if d, err := time.ParseDuration(q.Get("window")); err == nil && d > 0 {
+			window = d
+		}
+		days := 30
+		if n, err := strconv.Atoi(q.Get("days")); err == nil && n >= 0 {
+			days = n
+		}
+		top := 10
+		if n, err := strconv.Atoi(q.Get("top")); err == nil && n >= 0 {
+			top = n
+		}
+
+		out := map[string]interface{}{
+			"generated_at": time.Now().UTC(),
+			"upstream":     metrics.Get().UpstreamStats(top),
+		}
+
+		if cfg.Analytics != nil {
+			section := map[string]interface{}{}
+			summary, err := cfg.Analytics.Summary(r.Context(), time.Now().Add(-window), top)
+			if err != nil {
+				logger.Warn("Stats: analytics summary failed: %v", err)
+				http.Error(w, "analytics query failed", http.StatusInternalServerError)
+				return
+			}
+			section["summary"] = summary
+			if days > 0 {
+				daily, err := cfg.Analytics.Daily(r.Context(), days)
+				if err != nil {
+					logger.Warn("Stats: analytics rollup failed: %v", err)
+					http.Error(w, "analytics query failed", http.StatusInternalServerError)
+					return
+				}
+				section["daily"] = daily
+			}
+			out["analytics"] = section
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(out)
+	}
+}
@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"faviconsvc/internal/discovery"
+	imgpkg "faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/logger"
+)
+
+// MaxTenantImageBytes caps the fallback image of a tenant.
+const MaxTenantImageBytes = 256 << 10
+
+// maxTenantPalette caps the letter-tile colours of a tenant.
+const maxTenantPalette = 32
+
+// ErrInvalidBranding is returned by TenantStore.Set for branding that does
+// not validate.
+var ErrInvalidBranding = errors.New("invalid branding")
+
+// TenantBranding customizes the responses to one tenant's requests. The
+// tenant is the one the request's credentials belong to, such as the
+// tenant claim of a JSON Web Token, never the client-supplied X-Tenant-ID.
+// Request parameters still take precedence over it.
+type TenantBranding struct {
+	// FallbackImage replaces the placeholder, as a data: URI of an image
+	// of at most MaxTenantImageBytes
+	FallbackImage string `json:"fallback_image,omitempty"`
+	// FallbackStyle is the placeholder without a FallbackImage; "" keeps
+	// Config.FallbackStyle
+	FallbackStyle string `json:"fallback_style,omitempty"`
+	// Palette lists the letter-tile background colours as hex, e.g.
+	// "#1a73e8" (empty = the built-in colours)
+	Palette []string `json:"palette,omitempty"`
+	// Size and Format are used for requests without sz or format, Format
+	// replacing Accept negotiation (0 and "" = the service defaults)
+	Size   int    `json:"size,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	fallback image.Image
+	palette  []color.NRGBA
+}
+
+// prepare validates b and decodes its fallback image and palette.
+func (b *TenantBranding) prepare() error {
+	if b.FallbackImage != "" {
+		if !discovery.IsDataURI(b.FallbackImage) {
+			return errors.New("fallback_image must be a data: URI")
+		}
+		data, ct, err := discovery.DecodeDataURI(b.FallbackImage)
+		if err != nil {
+			return fmt.Errorf("fallback_image: %w", err)
+		}
+		if len(data) > MaxTenantImageBytes {
+			return fmt.Errorf("fallback_image exceeds %d bytes", MaxTenantImageBytes)
+		}
+		if b.fallback, _, err = imgpkg.Decode(data, ct, "", MaxSize); err != nil {
+			return fmt.Errorf("fallback_image is not a supported image: %w", err)
+		}
+	}
+	switch b.FallbackStyle {
+	case "", imgpkg.FallbackGlobe, imgpkg.FallbackLetter, imgpkg.FallbackErrorImage:
+	default:
+		return fmt.Errorf("fallback_style %q is not one of globe, letter, error-image", b.FallbackStyle)
+	}
+	if len(b.Palette) > maxTenantPalette {
+		return fmt.Errorf("palette has more than %d colours", maxTenantPalette)
+	}
+	var err error
+	if b.palette, err = imgpkg.ParsePalette(b.Palette); err != nil {
+		return fmt.Errorf("palette: %w", err)
+	}
+	if b.Size != 0 && (b.Size < MinSize || b.Size > MaxSize) {
+		return fmt.Errorf("size %d is not within %d-%d", b.Size, MinSize, MaxSize)
+	}
+	if b.Format = strings.ToLower(strings.TrimSpace(b.Format)); b.Format == "jpg" {
+		b.Format = "jpeg"
+	}
+	if b.Format != "" {
+		if _, ok := imgpkg.LookupEncoder(b.Format); !ok {
+			return fmt.Errorf("format %q is not an available encoder", b.Format)
+		}
+	}
+	return nil
+}
+
+// TenantStore holds the branding of every tenant, persisted as JSON to a
+// file so changes made through AdminTenantsHandler survive restarts.
+type TenantStore struct {
+	mu      sync.RWMutex
+	path    string
+	tenants map[string]*TenantBranding
+}
+
+// LoadTenantStore returns the store persisted at path, or an empty one when
+// the file does not exist yet.
+func LoadTenantStore(path string) (*TenantStore, error) {
+	s := &TenantStore{path: path, tenants: make(map[string]*TenantBranding)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]*TenantBranding
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for tenant, b := range all {
+		if !validTenant(tenant) || b == nil {
+			return nil, fmt.Errorf("%s: invalid tenant %q", path, tenant)
+		}
+		if err := b.prepare(); err != nil {
+			return nil, fmt.Errorf("%s: tenant %s: %w", path, tenant, err)
+		}
+		s.tenants[tenant] = b
+	}
+	return s, nil
+}
+
+// validTenant reports whether tenant is a tenant ID as reqctx accepts them.
+func validTenant(tenant string) bool {
+	if tenant == "" || len(tenant) > 64 {
+		return false
+	}
+	for _, c := range tenant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the branding of tenant, or nil when it has none. A nil
+// store has no tenants.
+func (s *TenantStore) Lookup(tenant string) *TenantBranding {
+	if s == nil || tenant == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenants[tenant]
+}
+
+// All returns the branding of every tenant.
+func (s *TenantStore) All() map[string]TenantBranding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make(map[string]TenantBranding, len(s.tenants))
+	for tenant, b := range s.tenants {
+		all[tenant] = *b
+	}
+	return all
+}
+
+// Set validates and stores the branding of tenant, replacing any earlier
+// one, and persists the store.
+func (s *TenantStore) Set(tenant string, b TenantBranding) error {
+	if !validTenant(tenant) {
+		return fmt.Errorf("%w: tenant %q must be 1-64 letters, digits, '-', '_' or '.'", ErrInvalidBranding, tenant)
+	}
+	if err := b.prepare(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBranding, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, had := s.tenants[tenant]
+	s.tenants[tenant] = &b
+	if err := s.save(); err != nil {
+		if had {
+			s.tenants[tenant] = prev
+		} else {
+			delete(s.tenants, tenant)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the branding of tenant, reporting whether it had one.
+func (s *TenantStore) Delete(tenant string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.tenants[tenant]
+	if !ok {
+		return false, nil
+	}
+	delete(s.tenants, tenant)
+	if err := s.save(); err != nil {
+		s.tenants[tenant] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the store to its file, through a temp file so a crash never
+// leaves it half written. The caller holds s.mu.
+func (s *TenantStore) save() error {
+	data, err := json.MarshalIndent(s.tenants, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".tmp-tenants-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// tenantBranding returns the branding of the tenant the request under ctx
+// authenticated as, or nil.
+func tenantBranding(ctx context.Context, cfg *Config) *TenantBranding {
+	return cfg.Tenants.Lookup(reqctx.From(ctx).Principal.Tenant)
+}
+
+// brandedDefaults returns the default size and format of a request: those
+// of its tenant's branding, or DefaultSize and none.
+func brandedDefaults(ctx context.Context, cfg *Config) (size int, format string) {
+	size = DefaultSize
+	if b := tenantBranding(ctx, cfg); b != nil {
+		if b.Size > 0 {
+			size = b.Size
+		}
+		format = b.Format
+	}
+	return size, format
+}
+
+// setTenantCacheHeaders keeps responses to branded tenants out of shared
+// caches: their placeholders and defaults differ from those other callers
+// of the same URL get.
+func setTenantCacheHeaders(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	if tenantBranding(r.Context(), cfg) == nil || w.Header().Get("Cache-Control") == "no-store" {
+		return
+	}
+	bsec, _ := cacheMaxAges(cfg)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", bsec))
+	w.Header().Del("Surrogate-Control")
+}
+
+// tenantRequest is the JSON body accepted by AdminTenantsHandler.
+type tenantRequest struct {
+	Tenant string `json:"tenant"`
+	TenantBranding
+}
+
+// AdminTenantsHandler manages the branding of tenants:
+//   - GET lists every tenant's branding, or one with ?tenant=
+//   - PUT or POST with a JSON body {"tenant": "...", ...TenantBranding}
+//     replaces the branding of a tenant
+//   - DELETE with ?tenant= removes it
+//
+// Changes are persisted to the store's file and apply to the next request.
+func AdminTenantsHandler(store *TenantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		switch r.Method {
+		case http.MethodGet:
+			all := store.All()
+			if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+				b, ok := all[tenant]
+				if !ok {
+					writeJSONError(w, http.StatusNotFound, "no branding for tenant "+tenant)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(tenantRequest{Tenant: tenant, TenantBranding: b})
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(map[string]any{"count": len(all), "tenants": all})
+
+		case http.MethodPut, http.MethodPost:
+			var req tenantRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxTenantImageBytes)).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+				return
+			}
+			if err := store.Set(req.Tenant, req.TenantBranding); err != nil {
+				status := http.StatusBadRequest
+				if !errors.Is(err, ErrInvalidBranding) {
+					logger.Warn("Saving branding of tenant %s: %v", req.Tenant, err)
+					status = http.StatusInternalServerError
+				}
+				writeJSONError(w, status, err.Error())
+				return
+			}
+			logger.Info("Branding set for tenant %s", req.Tenant)
+			req.TenantBranding = *store.Lookup(req.Tenant)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(req)
+
+		case http.MethodDelete:
+			tenant := r.URL.Query().Get("tenant")
+			ok, err := store.Delete(tenant)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "no branding for tenant "+tenant)
+				return
+			}
+			logger.Info("Branding removed for tenant %s", tenant)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
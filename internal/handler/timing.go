@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"net/http"
+
+	"faviconsvc/internal/reqctx"
+)
+
+// startTimings starts recording the stage durations of the request with
+// state st, if cfg.ServerTiming is set.
+func startTimings(st *reqctx.State, cfg *Config) {
+	if cfg.ServerTiming && st.Timings == nil {
+		st.Timings = reqctx.NewTimings()
+	}
+}
+
+// setServerTiming sets HeaderServerTiming to the stage durations recorded
+// for r, if any.
+func setServerTiming(w http.ResponseWriter, r *http.Request) {
+	if h := reqctx.From(r.Context()).Timings.Header(); h != "" {
+		w.Header().Set(HeaderServerTiming, h)
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"faviconsvc/internal/discovery"
+)
+
+// Upstream headers Config.UpstreamHeaders may pass through.
+const (
+	// UpstreamLastModified sends the origin's Last-Modified of the source
+	// icon instead of the time the service cached the response
+	UpstreamLastModified = "last-modified"
+	// UpstreamETag sends the origin's ETag of the source icon as
+	// HeaderUpstreamETag. The ETag itself stays the service's: it tags the
+	// bytes served, which differ from the origin's for every variant
+	UpstreamETag = "etag"
+)
+
+// HeaderUpstreamETag carries the origin's ETag of the source icon, with
+// UpstreamETag.
+const HeaderUpstreamETag = "X-Upstream-ETag"
+
+// ParseUpstreamHeaders parses an -upstream-headers value: a comma-separated
+// list of UpstreamLastModified and UpstreamETag, in any case.
+func ParseUpstreamHeaders(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "":
+		case UpstreamLastModified, UpstreamETag:
+			names = append(names, name)
+		default:
+			return nil, fmt.Errorf("upstream header %q is not one of %s, %s", name, UpstreamLastModified, UpstreamETag)
+		}
+	}
+	return names, nil
+}
+
+// setUpstreamHeaders sets the headers Config.UpstreamHeaders passes
+// through from the origin's response for srcURL, as recorded in its cached
+// metadata. Origins that sent none leave the service's values in place;
+// serveBytes keeps a Last-Modified set here.
+func setUpstreamHeaders(w http.ResponseWriter, srcURL string, cfg *Config) {
+	if len(cfg.UpstreamHeaders) == 0 || discovery.IsDataURI(srcURL) {
+		return
+	}
+	m, ok := cfg.CacheManager.ReadOrigMeta(discovery.CanonicalizeURLString(srcURL))
+	if !ok {
+		return
+	}
+	if slices.Contains(cfg.UpstreamHeaders, UpstreamLastModified) {
+		if t, err := http.ParseTime(m.LastModified); err == nil {
+			w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+		}
+	}
+	if slices.Contains(cfg.UpstreamHeaders, UpstreamETag) && m.ETag != "" {
+		w.Header().Set(HeaderUpstreamETag, m.ETag)
+	}
+}
+
+// setOriginValidators fills the origin fields of info from the cached
+// metadata of srcURL, as setUpstreamHeaders passes them through.
+func setOriginValidators(info *iconCacheInfo, srcURL string, cfg *Config) {
+	if len(cfg.UpstreamHeaders) == 0 {
+		return
+	}
+	m, ok := cfg.CacheManager.ReadOrigMeta(discovery.CanonicalizeURLString(srcURL))
+	if !ok {
+		return
+	}
+	if slices.Contains(cfg.UpstreamHeaders, UpstreamLastModified) {
+		if t, err := http.ParseTime(m.LastModified); err == nil {
+			t = t.UTC()
+			info.OriginLastModified = &t
+		}
+	}
+	if slices.Contains(cfg.UpstreamHeaders, UpstreamETag) {
+		info.OriginETag = m.ETag
+	}
+}
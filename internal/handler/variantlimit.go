@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"faviconsvc/internal/reqctx"
+)
+
+// variantID is one resized variant of a domain's icon: its size and the
+// format key it is cached under (see variantKey).
+type variantID struct {
+	size int
+	key  string
+}
+
+// variantLimiter tracks the variants each domain has been served, for
+// Config.MaxVariantsPerDomain. It lives in memory, so the count starts
+// over on restart; variants still cached on disk are then counted again
+// as they are asked for.
+type variantLimiter struct {
+	mu        sync.Mutex
+	domains   map[string]map[variantID]time.Time // variant -> when last served
+	lastSweep time.Time
+}
+
+const (
+	// variantSweepEvery is how often expired variants of every domain are
+	// forgotten, and variantFullSweepEvery how often at most while the
+	// limiter tracks Config.MaxVariantDomains domains.
+	variantSweepEvery     = time.Minute
+	variantFullSweepEvery = time.Second
+)
+
+func newVariantLimiter() *variantLimiter {
+	return &variantLimiter{domains: make(map[string]map[variantID]time.Time)}
+}
+
+// admit returns the size to serve a variant of domain at size under key
+// as, and whether that variant may be cached. Variants served before, and
+// any while the domain has fewer than limit, are served as asked. Past
+// the limit a new size is snapped to the nearest one the domain has under
+// the same key (the smaller on ties), and a key it has none for is
+// rendered at size but not cached. Variants not served within ttl are
+// forgotten, as their cache entries expire, and so are domains left
+// without any. While maxDomains domains are tracked, variants of other
+// domains are rendered but not cached. limit <= 0 disables the limit.
+func (l *variantLimiter) admit(domain string, size int, key string, limit, maxDomains int, ttl time.Duration) (int, bool) {
+	if l == nil || limit <= 0 || domain == "" {
+		return size, true
+	}
+	if maxDomains <= 0 {
+		maxDomains = DefaultMaxVariantDomains
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	full := len(l.domains) >= maxDomains
+	if ttl >= 0 && (now.Sub(l.lastSweep) >= variantSweepEvery || full && now.Sub(l.lastSweep) >= variantFullSweepEvery) {
+		l.sweepLocked(now, ttl)
+	}
+	seen := l.domains[domain]
+	if seen == nil {
+		if len(l.domains) >= maxDomains {
+			return size, false
+		}
+		seen = make(map[variantID]time.Time)
+		l.domains[domain] = seen
+	}
+	if ttl >= 0 {
+		expireVariants(seen, now, ttl)
+	}
+
+	id := variantID{size, key}
+	if _, ok := seen[id]; ok || len(seen) < limit {
+		seen[id] = now
+		return size, true
+	}
+	best := -1
+	for v := range seen {
+		if v.key != key {
+			continue
+		}
+		d, bd := absInt(v.size-size), absInt(best-size)
+		if best < 0 || d < bd || d == bd && v.size < best {
+			best = v.size
+		}
+	}
+	if best < 0 {
+		return size, false
+	}
+	seen[variantID{best, key}] = now
+	return best, true
+}
+
+// sweepLocked forgets the variants of every domain not served within ttl,
+// and the domains left without any.
+func (l *variantLimiter) sweepLocked(now time.Time, ttl time.Duration) {
+	l.lastSweep = now
+	for domain, seen := range l.domains {
+		if expireVariants(seen, now, ttl); len(seen) == 0 {
+			delete(l.domains, domain)
+		}
+	}
+}
+
+// expireVariants deletes the variants of seen not served within ttl.
+func expireVariants(seen map[variantID]time.Time, now time.Time, ttl time.Duration) {
+	for v, at := range seen {
+		if now.Sub(at) > ttl {
+			delete(seen, v)
+		}
+	}
+}
+
+// admitVariant applies Config.MaxVariantsPerDomain to a request of domain
+// for size, returning the size to serve. A variant that may not be cached
+// marks the request's state so writeVariant skips it.
+func admitVariant(ctx context.Context, domain string, size int, cfg *Config) int {
+	st := reqctx.From(ctx)
+	served, store := cfg.variants.admit(domain, size, variantKey(st.Format, st), cfg.MaxVariantsPerDomain, cfg.MaxVariantDomains, cfg.CacheManager.TTL)
+	if !store {
+		st.SkipVariantCache = true
+		reqctx.Debugf(ctx, "%s is over its variant limit, not caching %dpx %s", domain, size, variantKey(st.Format, st))
+	}
+	if served != size {
+		reqctx.Debugf(ctx, "%s is over its variant limit, serving %dpx for %dpx", domain, served, size)
+	}
+	return served
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/reqctx"
+)
+
+// MaxWait caps the wait parameter.
+const MaxWait = 30 * time.Second
+
+// backgroundLookupTimeout bounds a lookup started for a wait request, which
+// carries on after the request has been answered.
+const backgroundLookupTimeout = 30 * time.Second
+
+// HeaderWait reports, on /favicons responses to requests with wait, how
+// the wait ended:
+//   - ready: the lookup finished in time and the response is what the
+//     request would have got without wait
+//   - pending: the wait ran out and the placeholder was served, with
+//     Cache-Control: no-store, while the lookup carries on to warm the
+//     cache for the next request
+const HeaderWait = "X-Favicon-Wait"
+
+// HeaderWait values.
+const (
+	WaitReady   = "ready"
+	WaitPending = "pending"
+)
+
+// lookupTracker records the page lookups running in the background, so
+// requests for a page being looked up wait for that lookup rather than
+// starting another.
+type lookupTracker struct {
+	mu      sync.Mutex
+	running map[string]chan struct{}
+}
+
+func newLookupTracker() *lookupTracker {
+	return &lookupTracker{running: make(map[string]chan struct{})}
+}
+
+// join returns a channel closed when the lookup of key finishes. When none
+// is running it registers one and returns the func its owner must call
+// when done; callers joining a running lookup get a nil func.
+func (t *lookupTracker) join(key string) (<-chan struct{}, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if done, ok := t.running[key]; ok {
+		return done, nil
+	}
+	done := make(chan struct{})
+	t.running[key] = done
+	return done, func() {
+		t.mu.Lock()
+		delete(t.running, key)
+		t.mu.Unlock()
+		close(done)
+	}
+}
+
+// waitParam parses the wait query parameter as a duration (e.g. 5s or
+// 500ms), capped at MaxWait. Missing, invalid and non-positive values
+// give 0, for no wait.
+func waitParam(q url.Values) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(q.Get("wait")))
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return min(d, MaxWait)
+}
+
+// awaitLookup looks up page u in the background, or joins the lookup of
+// it already running there, such as one of an earlier wait request or a
+// batch job, and waits up to wait, or until ctx is done, for it to finish.
+// It reports whether it did, leaving its result in the cache. The lookup
+// is detached from ctx and bounded by backgroundLookupTimeout instead, so
+// a request that stops waiting still warms the cache.
+func awaitLookup(ctx context.Context, u *url.URL, resolvedKey string, rank discovery.RankingStrategy, wait time.Duration, cfg *Config) bool {
+	done, finish := cfg.lookups.join(resolvedKey)
+	if finish != nil {
+		st := reqctx.From(ctx)
+		bctx, bst := reqctx.Ensure(context.Background())
+		bst.Tenant, bst.Size, bst.Format = st.Tenant, st.Size, st.Format
+		go func() {
+			defer finish()
+			bctx, cancel := context.WithTimeout(bctx, backgroundLookupTimeout)
+			defer cancel()
+			best, src, inheritedFrom := discoverBestIcon(bctx, u, rank, true, cfg)
+			if best == nil {
+				return
+			}
+			_ = cfg.CacheManager.WriteInheritedIcon(resolvedKey, src, inheritedFrom)
+			if rank.Name() == discovery.DefaultRankingStrategy {
+				recordIconVersion(strings.ToLower(u.Hostname()), src, cfg)
+			}
+		}()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	reqctx.Debugf(ctx, "Lookup of %s still running after %s", resolvedKey, wait)
+	return false
+}
@@ -0,0 +1,375 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+)
+
+// maxAnimFrames caps how many frames of an animation are composed when
+// choosing the one to serve; icons rarely need more than the first few.
+const maxAnimFrames = 64
+
+// maxAnimPixels caps the canvas size of animations composed frame by
+// frame. Larger ones fall back to decoding their first image only.
+const maxAnimPixels = 4096 * 4096
+
+// frameSelector keeps the most representative of a sequence of composed
+// animation frames.
+type frameSelector struct {
+	best  *image.RGBA
+	score int
+}
+
+// offer considers canvas, copying it if it beats the frames seen so far.
+func (s *frameSelector) offer(canvas *image.RGBA) {
+	if sc := frameScore(canvas); s.best == nil || sc > s.score {
+		s.best = image.NewRGBA(canvas.Rect)
+		copy(s.best.Pix, canvas.Pix)
+		s.score = sc
+	}
+}
+
+// frameScore rates a frame by its opaque and coloured coverage on a 20x20
+// sample grid, the same grid IsNearlyBlank uses, so blank, white or
+// mostly transparent frames lose to ones showing the actual logo. Earlier
+// frames win ties.
+func frameScore(img *image.RGBA) int {
+	b := img.Bounds()
+	stepX, stepY := max(b.Dx()/20, 1), max(b.Dy()/20, 1)
+	score := 0
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			c := img.RGBAAt(x, y)
+			if c.A < 0x80 {
+				continue
+			}
+			score++
+			if !(c.R > 240 && c.G > 240 && c.B > 240) && !(c.R < 15 && c.G < 15 && c.B < 15) {
+				score++
+			}
+		}
+	}
+	return score
+}
+
+// decodeGIF decodes a GIF, composing the frames of an animation onto the
+// logical screen and returning the most representative one rather than the
+// first, which is often blank or only a partial update.
+func decodeGIF(b []byte, _ int) (image.Image, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if gifFrameCount(b) < 2 || cfg.Width*cfg.Height > maxAnimPixels {
+		return gif.Decode(bytes.NewReader(b))
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	var sel frameSelector
+	err = eachGIFFrame(b, maxAnimFrames, func(frame *image.Paletted, disposal byte) {
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = image.NewRGBA(canvas.Rect)
+			copy(prev.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		sel.offer(canvas)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sel.best, nil
+}
+
+// walkGIF calls visit with each extension and image block of a GIF, after
+// the header, logical screen descriptor and global colour table (whose
+// combined length it returns). ok is false for malformed streams.
+func walkGIF(b []byte, visit func(block []byte)) (headerLen int, ok bool) {
+	if len(b) < 13 || !(bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a"))) {
+		return 0, false
+	}
+	p := 13
+	if b[10]&0x80 != 0 {
+		p += 3 << (b[10]&7 + 1)
+	}
+	headerLen = p
+	// skipSubBlocks returns the offset after a sub-block sequence at q
+	skipSubBlocks := func(q int) int {
+		for q < len(b) {
+			n := int(b[q])
+			q++
+			if n == 0 {
+				return q
+			}
+			q += n
+		}
+		return -1
+	}
+	for p < len(b) {
+		start := p
+		switch b[p] {
+		case 0x3b: // trailer
+			return headerLen, true
+		case 0x21: // extension: label, then sub-blocks
+			p = skipSubBlocks(p + 2)
+		case 0x2c: // image descriptor, local colour table, LZW code size, data
+			if p+10 > len(b) {
+				return headerLen, false
+			}
+			q := p + 10
+			if b[p+9]&0x80 != 0 {
+				q += 3 << (b[p+9]&7 + 1)
+			}
+			p = skipSubBlocks(q + 1)
+		default:
+			return headerLen, false
+		}
+		if p < 0 || p > len(b) {
+			return headerLen, false
+		}
+		visit(b[start:p])
+	}
+	// Streams cut off before the trailer still decode
+	return headerLen, true
+}
+
+// eachGIFFrame calls visit with the first limit frames of a GIF and their
+// disposal methods. Each frame is decoded on its own, from the header, its
+// graphic control extension and its image block, so unlike gif.DecodeAll
+// only one frame is held in memory and frames past limit are never
+// decoded, however many the stream has.
+func eachGIFFrame(b []byte, limit int, visit func(frame *image.Paletted, disposal byte)) error {
+	var frames [][2][]byte // graphic control extension (or nil), image block
+	var gce []byte
+	headerLen, _ := walkGIF(b, func(block []byte) {
+		switch {
+		case len(frames) == limit:
+		case block[0] == 0x21 && len(block) > 1 && block[1] == 0xf9:
+			gce = block
+		case block[0] == 0x2c:
+			frames = append(frames, [2][]byte{gce, block})
+			gce = nil
+		}
+	})
+	for _, f := range frames {
+		one := make([]byte, 0, headerLen+len(f[0])+len(f[1])+1)
+		one = append(append(append(append(one, b[:headerLen]...), f[0]...), f[1]...), 0x3b)
+		g, err := gif.DecodeAll(bytes.NewReader(one))
+		if err != nil {
+			return err
+		}
+		var disposal byte
+		if len(g.Disposal) > 0 {
+			disposal = g.Disposal[0]
+		}
+		visit(g.Image[0], disposal)
+	}
+	return nil
+}
+
+// gifFrameCount returns the number of images in a GIF, or 0 if b is not one.
+func gifFrameCount(b []byte) int {
+	n := 0
+	walkGIF(b, func(block []byte) {
+		if block[0] == 0x2c {
+			n++
+		}
+	})
+	return n
+}
+
+// stripGIF drops comment extensions and application extensions other than
+// the looping ones browsers honour (NETSCAPE2.0, ANIMEXTS1.0).
+func stripGIF(b []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(b))
+	headerLen, ok := walkGIF(b, func(block []byte) {
+		if block[0] == 0x21 {
+			switch block[1] {
+			case 0xfe:
+				return
+			case 0xff:
+				if len(block) < 14 || block[2] != 11 ||
+					(string(block[3:14]) != "NETSCAPE2.0" && string(block[3:14]) != "ANIMEXTS1.0") {
+					return
+				}
+			}
+		}
+		out = append(out, block...)
+	})
+	if !ok {
+		return nil, false
+	}
+	out = append(append(append([]byte(nil), b[:headerLen]...), out...), 0x3b)
+	return out, true
+}
+
+// IsAnimated reports whether b is a GIF with more than one frame or an
+// APNG.
+func IsAnimated(b []byte) bool {
+	if gifFrameCount(b) > 1 {
+		return true
+	}
+	_, ok := apngInfo(b)
+	return ok
+}
+
+// apngInfo returns the frame count from the acTL chunk of an APNG. ok is
+// false for plain PNGs and anything else.
+func apngInfo(b []byte) (frames int, ok bool) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return 0, false
+	}
+	for p := len(pngSignature); p+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		typ := string(b[p+4 : p+8])
+		if n < 0 || p+12+n > len(b) || typ == "IDAT" {
+			return 0, false
+		}
+		if typ == "acTL" && n >= 8 {
+			frames = int(binary.BigEndian.Uint32(b[p+8:]))
+			return frames, frames > 1
+		}
+		p += 12 + n
+	}
+	return 0, false
+}
+
+// decodePNG decodes a PNG. For an APNG it composes the animation frames and
+// returns the most representative one, as decodeGIF does.
+func decodePNG(b []byte, _ int) (image.Image, error) {
+	if _, ok := apngInfo(b); ok {
+		if img, ok := decodeAPNGFrame(b); ok {
+			return img, nil
+		}
+	}
+	return png.Decode(bytes.NewReader(b))
+}
+
+// apngFrame is one frame's fcTL fields and image data.
+type apngFrame struct {
+	rect           image.Rectangle
+	dispose, blend byte
+	data           [][]byte // IDAT or fdAT payloads, sequence numbers removed
+}
+
+// decodeAPNGFrame composes the frames of an APNG (see decodePNG). It
+// returns false if the stream cannot be composed, so the caller can fall
+// back to the default image.
+func decodeAPNGFrame(b []byte) (image.Image, bool) {
+	var ihdr []byte
+	var shared [][]byte // PLTE and tRNS, needed to decode every frame
+	var frames []*apngFrame
+	var cur *apngFrame
+	for p := len(pngSignature); p+12 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		if n < 0 || p+12+n > len(b) {
+			return nil, false
+		}
+		typ, data := string(b[p+4:p+8]), b[p+8:p+8+n]
+		switch typ {
+		case "IHDR":
+			if n != 13 {
+				return nil, false
+			}
+			ihdr = data
+		case "PLTE", "tRNS":
+			shared = append(shared, b[p:p+12+n])
+		case "fcTL":
+			cur = nil
+			if n < 26 || len(frames) == maxAnimFrames {
+				break
+			}
+			w, h := int(binary.BigEndian.Uint32(data[4:])), int(binary.BigEndian.Uint32(data[8:]))
+			x, y := int(binary.BigEndian.Uint32(data[12:])), int(binary.BigEndian.Uint32(data[16:]))
+			cur = &apngFrame{rect: image.Rect(x, y, x+w, y+h), dispose: data[24], blend: data[25]}
+			frames = append(frames, cur)
+		case "IDAT":
+			// The default image is only part of the animation when an fcTL precedes it
+			if cur != nil {
+				cur.data = append(cur.data, data)
+			}
+		case "fdAT":
+			if cur != nil && n >= 4 {
+				cur.data = append(cur.data, data[4:])
+			}
+		case "IEND":
+			p = len(b)
+			continue
+		}
+		p += 12 + n
+	}
+	if ihdr == nil || len(frames) == 0 {
+		return nil, false
+	}
+	width, height := int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:]))
+	if width <= 0 || height <= 0 || width*height > maxAnimPixels {
+		return nil, false
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	var sel frameSelector
+	for i, f := range frames {
+		if f.rect.Empty() || !f.rect.In(canvas.Rect) || len(f.data) == 0 {
+			return nil, false
+		}
+		img, err := png.Decode(bytes.NewReader(apngFramePNG(ihdr, f, shared)))
+		if err != nil {
+			return nil, false
+		}
+		var prev *image.RGBA
+		if f.dispose == 2 && i > 0 {
+			prev = image.NewRGBA(canvas.Rect)
+			copy(prev.Pix, canvas.Pix)
+		}
+		op := draw.Over
+		if f.blend == 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, f.rect, img, image.Point{}, op)
+		sel.offer(canvas)
+		switch {
+		case f.dispose == 1 || (f.dispose == 2 && i == 0):
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		case f.dispose == 2:
+			canvas = prev
+		}
+	}
+	return sel.best, true
+}
+
+// apngFramePNG builds a standalone PNG of one APNG frame: the stream's
+// IHDR resized to the frame, its palette chunks, and the frame data as IDAT.
+func apngFramePNG(ihdr []byte, f *apngFrame, shared [][]byte) []byte {
+	hdr := append([]byte(nil), ihdr...)
+	binary.BigEndian.PutUint32(hdr, uint32(f.rect.Dx()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(f.rect.Dy()))
+
+	out := append([]byte(nil), pngSignature...)
+	out = appendPNGChunk(out, "IHDR", hdr)
+	for _, c := range shared {
+		out = append(out, c...)
+	}
+	for _, d := range f.data {
+		out = appendPNGChunk(out, "IDAT", d)
+	}
+	return appendPNGChunk(out, "IEND", nil)
+}
+
+func appendPNGChunk(out []byte, typ string, data []byte) []byte {
+	start := len(out)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start+4:]))
+}
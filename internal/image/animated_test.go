@@ -0,0 +1,235 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	white = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+func fill(r image.Rectangle, c color.Color) *image.RGBA {
+	img := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// animatedGIF returns a 16x16 GIF whose first frame is blank white and whose
+// second paints a red square over it.
+func animatedGIF(t *testing.T) []byte {
+	t.Helper()
+	pal := color.Palette(palette.Plan9)
+	frame := func(r image.Rectangle, c color.Color) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				p.Set(x, y, c)
+			}
+		}
+		return p
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:    []*image.Paletted{frame(image.Rect(0, 0, 16, 16), white), frame(image.Rect(4, 4, 12, 12), red)},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{ColorModel: pal, Width: 16, Height: 16},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// idat returns the concatenated image data of a PNG.
+func idat(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	var data []byte
+	for p := len(pngSignature); p+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		if string(b[p+4:p+8]) == "IDAT" {
+			data = append(data, b[p+8:p+8+n]...)
+		}
+		p += 12 + n
+	}
+	return data
+}
+
+// animatedPNG returns a 16x16 APNG whose default image, also its first
+// frame, is fully transparent and whose second frame blends a red square
+// over it.
+func animatedPNG(t *testing.T) []byte {
+	t.Helper()
+	fcTL := func(seq, w, h, x, y int) []byte {
+		d := make([]byte, 26)
+		for i, v := range []int{seq, w, h, x, y} {
+			binary.BigEndian.PutUint32(d[4*i:], uint32(v))
+		}
+		binary.BigEndian.PutUint16(d[20:], 1)
+		binary.BigEndian.PutUint16(d[22:], 10)
+		d[25] = 1 // blend over
+		return d
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, 16)
+	binary.BigEndian.PutUint32(ihdr[4:], 16)
+	ihdr[8], ihdr[9] = 8, 6 // 8-bit RGBA
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl, 2)
+
+	var b []byte
+	b = append(b, pngSignature...)
+	b = append(b, pngChunk("IHDR", ihdr)...)
+	b = append(b, pngChunk("acTL", actl)...)
+	b = append(b, pngChunk("fcTL", fcTL(0, 16, 16, 0, 0))...)
+	b = append(b, pngChunk("IDAT", idat(t, image.NewRGBA(image.Rect(0, 0, 16, 16))))...)
+	b = append(b, pngChunk("fcTL", fcTL(1, 8, 8, 4, 4))...)
+	// A transparent corner keeps png.Encode writing RGBA, matching IHDR
+	square := fill(image.Rect(0, 0, 8, 8), red)
+	square.Set(0, 0, color.Transparent)
+	b = append(b, pngChunk("fdAT", append([]byte{0, 0, 0, 2}, idat(t, square)...))...)
+	return append(b, pngChunk("IEND", nil)...)
+}
+
+func TestDecodeGIFStopsAtFrameCap(t *testing.T) {
+	// Only frames past maxAnimFrames show the logo, so composing any of
+	// them would pick it, and decoding them at all would fail
+	pal := color.Palette(palette.Plan9)
+	g := &gif.GIF{Config: image.Config{ColorModel: pal, Width: 16, Height: 16}}
+	for i := 0; i < maxAnimFrames+36; i++ {
+		p := image.NewPaletted(image.Rect(0, 0, 16, 16), pal)
+		c := color.Color(white)
+		if i >= maxAnimFrames {
+			c = red
+		}
+		for j := range p.Pix {
+			p.Pix[j] = uint8(pal.Index(c))
+		}
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	// A frame past the cap that gif.DecodeAll would fail on
+	b := buf.Bytes()
+	n := 0
+	walkGIF(b, func(block []byte) {
+		if block[0] == 0x2c {
+			if n == maxAnimFrames {
+				lct := 0
+				if block[9]&0x80 != 0 {
+					lct = 3 << (block[9]&7 + 1)
+				}
+				block[10+lct] = 12 // LZW code size
+			}
+			n++
+		}
+	})
+	if _, err := gif.DecodeAll(bytes.NewReader(b)); err == nil {
+		t.Fatal("corrupting the frame past the cap did not break the GIF")
+	}
+
+	img, err := decodeGIF(b, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBAModel.Convert(img.At(6, 6)); got != white {
+		t.Errorf("centre = %v, want a frame within the first %d", got, maxAnimFrames)
+	}
+}
+
+func TestDecodeAnimatedPicksRepresentativeFrame(t *testing.T) {
+	for name, b := range map[string][]byte{"gif": animatedGIF(t), "apng": animatedPNG(t)} {
+		t.Run(name, func(t *testing.T) {
+			if !IsAnimated(b) {
+				t.Error("IsAnimated = false")
+			}
+			img, dec, err := Decode(b, "", "", 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dec.Name != name && !(name == "apng" && dec.Name == "png") {
+				t.Errorf("decoded by %s", dec.Name)
+			}
+			if img.Bounds() != image.Rect(0, 0, 16, 16) {
+				t.Fatalf("bounds = %v, want the full canvas", img.Bounds())
+			}
+			if got := color.RGBAModel.Convert(img.At(6, 6)); got != red {
+				t.Errorf("centre = %v, want the red frame", got)
+			}
+		})
+	}
+
+	single := idat(t, fill(image.Rect(0, 0, 4, 4), red))
+	var still bytes.Buffer
+	_ = png.Encode(&still, fill(image.Rect(0, 0, 4, 4), red))
+	if IsAnimated(still.Bytes()) || IsAnimated(single) {
+		t.Error("IsAnimated = true for a still image")
+	}
+}
+
+func TestStripMetadataGIF(t *testing.T) {
+	b := animatedGIF(t)
+	comment := []byte{0x21, 0xfe, 5, 'h', 'e', 'l', 'l', 'o', 0}
+	xmp := append([]byte{0x21, 0xff, 11}, "XMP DataXMP"...)
+	xmp = append(xmp, 3, 'x', 'm', 'p', 0)
+	i := bytes.Index(b, []byte{0x21, 0xf9}) // first graphic control extension
+	dirty := append(append(append(append([]byte(nil), b[:i]...), comment...), xmp...), b[i:]...)
+
+	out := StripMetadata(dirty)
+	if bytes.Contains(out, []byte("hello")) || bytes.Contains(out, []byte("XMP Data")) {
+		t.Error("GIF comment or XMP survived stripping")
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("stripped GIF does not decode: %v", err)
+	}
+	if len(g.Image) != 2 {
+		t.Errorf("stripped GIF has %d frames, want 2", len(g.Image))
+	}
+
+	looping := new(bytes.Buffer)
+	_ = gif.EncodeAll(looping, &gif.GIF{Image: g.Image, Delay: g.Delay, LoopCount: 3})
+	if out := StripMetadata(looping.Bytes()); !bytes.Contains(out, []byte("NETSCAPE2.0")) {
+		t.Error("loop extension was stripped")
+	}
+}
+
+func TestGIFEncoderKeepsTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	img.Set(2, 2, red)
+	b, ct := EncodeByFormat(img, "gif", 0)
+	if ct != "image/gif" {
+		t.Fatalf("content type = %s", ct)
+	}
+	out, err := gif.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := out.At(0, 0).RGBA(); a != 0 {
+		t.Error("transparent pixel became opaque")
+	}
+	if got := color.RGBAModel.Convert(out.At(2, 2)); got != red {
+		t.Errorf("red pixel = %v", got)
+	}
+}
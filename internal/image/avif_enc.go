@@ -1,10 +1,10 @@
-//go:build !noavif
-
 package image
 
 import (
 	"bytes"
 	"image"
+	"image/color"
+	"sync"
 
 	"github.com/gen2brain/avif"
 )
@@ -33,7 +33,23 @@ func encodeAsAVIF(img image.Image, quality int) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// isAVIFSupported returns true when AVIF encoding is available.
+// isAVIFSupported reports whether AVIF encoding works in this process and
+// is not disabled (see SetDisabledFormats).
 func isAVIFSupported() bool {
-	return true
+	return !encoderDisabled("avif") && avifWorks()
 }
+
+// avifWorks encodes and decodes one pixel the first time it is called.
+// gen2brain/avif runs libavif through purego when the shared library is
+// installed and an embedded WASM build otherwise, either of which can fail
+// at run time, e.g. where executable memory for the WASM compiler is denied.
+var avifWorks = sync.OnceValue(func() bool {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{A: 255})
+	var buf bytes.Buffer
+	if err := avif.Encode(&buf, img, avif.Options{Quality: 50, Speed: 10}); err != nil {
+		return false
+	}
+	_, err := avif.Decode(bytes.NewReader(buf.Bytes()))
+	return err == nil
+})
@@ -16,7 +16,7 @@ func TestEncodeByFormat_AVIF(t *testing.T) {
 	}
 
 	// Test AVIF encoding
-	data, contentType := EncodeByFormat(img, "avif")
+	data, contentType := EncodeByFormat(img, "avif", 0)
 
 	if isAVIFSupported() {
 		// AVIF is available
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// BlurhashComponents is how many cosine components a blurhash has along
+// each axis. Icons are a few flat colour areas, which 4×4 components
+// already render recognisably.
+const BlurhashComponents = 4
+
+// blurhashSampleSize is the edge an icon is scaled to before hashing. The
+// components are the lowest frequencies, so more pixels change nothing.
+const blurhashSampleSize = 32
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash returns the BlurHash (https://blurha.sh) of img: a 36 character
+// string clients decode into a blurred stand-in to show while the icon
+// loads. BlurHash has no alpha, so transparent areas are taken as white,
+// as in CompareImages.
+func Blurhash(img image.Image) string {
+	const n, comps = blurhashSampleSize, BlurhashComponents
+	px := flattenForDiff(img, n)
+	lin := make([][3]float64, n*n)
+	for i := range lin {
+		for c := 0; c < 3; c++ {
+			lin[i][c] = srgbToLinear(float64(px.Pix[4*i+c]) / 255)
+		}
+	}
+	var basis [comps][n]float64
+	for k := range basis {
+		for x := range basis[k] {
+			basis[k][x] = math.Cos(math.Pi * float64(k) * float64(x) / n)
+		}
+	}
+
+	factors := make([][3]float64, comps*comps)
+	for j := 0; j < comps; j++ {
+		for i := 0; i < comps; i++ {
+			var f [3]float64
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					b := basis[i][x] * basis[j][y]
+					for c := 0; c < 3; c++ {
+						f[c] += b * lin[y*n+x][c]
+					}
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			for c := 0; c < 3; c++ {
+				f[c] *= norm / (n * n)
+			}
+			factors[j*comps+i] = f
+		}
+	}
+
+	var sb strings.Builder
+	writeBase83(&sb, (comps-1)+(comps-1)*9, 1)
+	maxAC := 0.0
+	for _, f := range factors[1:] {
+		for _, v := range f {
+			maxAC = math.Max(maxAC, math.Abs(v))
+		}
+	}
+	quantMax := min(max(int(math.Floor(maxAC*166-0.5)), 0), 82)
+	writeBase83(&sb, quantMax, 1)
+	acScale := float64(quantMax+1) / 166
+
+	dc := factors[0]
+	writeBase83(&sb, srgb8(dc[0])<<16|srgb8(dc[1])<<8|srgb8(dc[2]), 4)
+	for _, f := range factors[1:] {
+		v := 0
+		for _, c := range f {
+			// Square-root companding spends the 19 levels on small values
+			q := math.Copysign(math.Sqrt(math.Abs(c/acScale)), c)
+			v = v*19 + min(max(int(math.Floor(q*9+9.5)), 0), 18)
+		}
+		writeBase83(&sb, v, 2)
+	}
+	return sb.String()
+}
+
+// srgb8 encodes a linear channel value as an 8-bit sRGB one.
+func srgb8(v float64) int {
+	return int(math.Round(linearToSRGB(math.Min(math.Max(v, 0), 1)) * 255))
+}
+
+// writeBase83 appends v as the given number of base-83 digits, most
+// significant first.
+func writeBase83(sb *strings.Builder, v, digits int) {
+	div := 1
+	for i := 1; i < digits; i++ {
+		div *= 83
+	}
+	for ; div > 0; div /= 83 {
+		sb.WriteByte(base83Chars[v/div%83])
+	}
+}
@@ -0,0 +1,79 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func decodeBase83(t *testing.T, s string) int {
+	t.Helper()
+	v := 0
+	for _, r := range s {
+		d := strings.IndexRune(base83Chars, r)
+		if d < 0 {
+			t.Fatalf("%q is not base 83", s)
+		}
+		v = v*83 + d
+	}
+	return v
+}
+
+// blurhashAC decodes AC component i (1-based, row-major) of h as signed
+// values in -1..1 per channel.
+func blurhashAC(t *testing.T, h string, i int) [3]float64 {
+	t.Helper()
+	v := decodeBase83(t, h[6+2*(i-1):8+2*(i-1)])
+	q := [3]int{v / 361, v / 19 % 19, v % 19}
+	var out [3]float64
+	for c := range q {
+		out[c] = float64(q[c]-9) / 9
+	}
+	return out
+}
+
+func TestBlurhash(t *testing.T) {
+	t.Run("solid", func(t *testing.T) {
+		h := Blurhash(solidNRGBA(color.NRGBA{R: 200, G: 30, B: 30, A: 255}))
+		if len(h) != 36 || h[0] != 'U' {
+			t.Fatalf("hash = %q, want 36 characters of 4×4 components", h)
+		}
+		if dc := decodeBase83(t, h[2:6]); dc != 200<<16|30<<8|30 {
+			t.Errorf("DC = %06x, want c81e1e", dc)
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				c := color.NRGBA{R: 255, A: 255}
+				if x >= 32 {
+					c = color.NRGBA{B: 255, A: 255}
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+		h := Blurhash(img)
+		// The first horizontal cosine is high on the left, low on the
+		// right, and the largest component
+		first := blurhashAC(t, h, 1)
+		if first[0] != 1 || first[2] != -1 || first[1] != 0 {
+			t.Errorf("first horizontal component = %.2f, want red up and blue down", first)
+		}
+		for i := 2; i < BlurhashComponents*BlurhashComponents; i++ {
+			if ac := blurhashAC(t, h, i); math.Abs(ac[0]) >= 1 || math.Abs(ac[2]) >= 1 {
+				t.Errorf("component %d = %.2f, larger than the first", i, ac)
+			}
+		}
+	})
+
+	t.Run("transparent over white", func(t *testing.T) {
+		h := Blurhash(image.NewNRGBA(image.Rect(0, 0, 16, 16)))
+		if dc := decodeBase83(t, h[2:6]); dc != 0xffffff {
+			t.Errorf("DC = %06x, want ffffff", dc)
+		}
+	})
+}
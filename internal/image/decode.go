@@ -5,16 +5,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"image"
-	"image/gif"
-	"image/jpeg"
 	"image/png"
 	"io"
 	"sort"
 
-	"github.com/gen2brain/avif"
 	ico "github.com/sergeymakinen/go-ico"
 	"golang.org/x/image/bmp"
-	xwebp "golang.org/x/image/webp"
 )
 
 func DecodeICOSelectLargest(b []byte) (image.Image, error) {
@@ -99,11 +95,18 @@ func DecodeICOSelectLargest(b []byte) (image.Image, error) {
 	})
 
 	// Try to decode in priority order
+	var budgetErr error
 	for _, e := range entries {
 		if int(e.offset+e.size) > len(b) || e.size == 0 {
 			continue
 		}
 		slice := b[e.offset : e.offset+e.size]
+		// PNG and full BMP entries may declare any size, whatever the
+		// directory says
+		if err := checkDeclaredPixels(slice); err != nil {
+			budgetErr = err
+			continue
+		}
 
 		// Try PNG first
 		if e.isPNG {
@@ -112,34 +115,52 @@ func DecodeICOSelectLargest(b []byte) (image.Image, error) {
 			}
 		}
 		
-		// Try BMP (might not have alpha channel)
-		if img, err := bmp.Decode(bytes.NewReader(slice)); err == nil {
-			// BMP in ICO doesn't handle transparency well
-			// Check if it looks blank and skip if so
+		// BMP entries take their transparency from the alpha channel or
+		// the AND mask; entries that are still blank are skipped
+		if img, err := decodeICOBMP(slice); err == nil {
 			if !IsNearlyBlank(img) {
 				return img, nil
 			}
+		} else if img, err := bmp.Decode(bytes.NewReader(slice)); err == nil && !IsNearlyBlank(img) {
+			// A full BMP file stored as the entry
+			return img, nil
 		}
 	}
 
+	// go-ico would decode the oversized entry regardless
+	if budgetErr != nil {
+		return nil, budgetErr
+	}
 	return ico.Decode(bytes.NewReader(b))
 }
 
+// DecodeImageRasterOnly decodes b with the registered raster decoders,
+// trying those whose sniffer matches first and then the rest in order.
+// ICO and vector decoders are not used. Like Decode, it rejects payloads
+// declaring more than MaxPixels and converts embedded colour profiles to
+// sRGB.
 func DecodeImageRasterOnly(b []byte) (image.Image, error) {
-	if img, err := png.Decode(bytes.NewReader(b)); err == nil {
-		return img, nil
-	}
-	if img, err := jpeg.Decode(bytes.NewReader(b)); err == nil {
-		return img, nil
-	}
-	if img, err := gif.Decode(bytes.NewReader(b)); err == nil {
-		return img, nil
+	if err := checkDeclaredPixels(b); err != nil {
+		return nil, err
 	}
-	if img, err := xwebp.Decode(bytes.NewReader(b)); err == nil {
-		return img, nil
+	decs := rasterDecoders()
+	for _, d := range decs {
+		if d.Sniff(b, "", "") {
+			if img, err := d.Decode(b, 0); err == nil {
+				return toSRGB(img, b), nil
+			}
+		}
 	}
-	if img, err := avif.Decode(bytes.NewReader(b)); err == nil {
-		return img, nil
+	for _, d := range decs {
+		if img, err := d.Decode(b, 0); err == nil {
+			return toSRGB(img, b), nil
+		}
 	}
 	return nil, errors.New("unsupported raster format")
 }
+
+func decodeWith(decode func(io.Reader) (image.Image, error)) func([]byte, int) (image.Image, error) {
+	return func(b []byte, _ int) (image.Image, error) {
+		return decode(bytes.NewReader(b))
+	}
+}
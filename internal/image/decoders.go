@@ -0,0 +1,239 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gen2brain/avif"
+	"golang.org/x/image/bmp"
+	xwebp "golang.org/x/image/webp"
+)
+
+// Decoder pairs a content sniffer with a decode function for one input format.
+type Decoder struct {
+	Name string
+	// Sniff reports whether the payload is in this format. contentType and
+	// srcURL are hints from the fetch and may be empty or wrong.
+	Sniff func(b []byte, contentType, srcURL string) bool
+	// Decode decodes the payload. size is the requested output edge; raster
+	// decoders ignore it, vector decoders render at it.
+	Decode func(b []byte, size int) (image.Image, error)
+	// Vector marks decoders whose output is rendered at the requested size
+	// rather than decoded at a native resolution.
+	Vector bool
+	// Raster marks plain single-image raster formats tried by DecodeImageRasterOnly.
+	Raster bool
+	// Fallback decoders are only consulted after every native decoder,
+	// including the blind raster pass, has failed.
+	Fallback bool
+	// Available reports whether the decoder works in this process; nil
+	// means it always does.
+	Available func() bool
+}
+
+var (
+	decodersMu sync.RWMutex
+	decoders   []Decoder
+)
+
+// Magic-byte sniffers come first so a mislabelled payload (e.g. PNG served as
+// .ico) still reaches the right decoder; hint-based formats follow.
+func init() {
+	RegisterDecoder(Decoder{Name: "png", Sniff: magicSniffer("\x89PNG\r\n\x1a\n"), Decode: decodePNG, Raster: true})
+	RegisterDecoder(Decoder{Name: "jpeg", Sniff: magicSniffer("\xff\xd8\xff"), Decode: decodeJPEG, Raster: true})
+	RegisterDecoder(Decoder{Name: "gif", Sniff: magicSniffer("GIF87a", "GIF89a"), Decode: decodeGIF, Raster: true})
+	RegisterDecoder(Decoder{Name: "webp", Sniff: sniffWebP, Decode: decodeWith(xwebp.Decode), Raster: true})
+	RegisterDecoder(Decoder{Name: "avif", Sniff: sniffAVIF, Decode: decodeWith(avif.Decode), Raster: true, Available: avifWorks})
+	RegisterDecoder(Decoder{Name: "ico", Sniff: sniffICO, Decode: func(b []byte, _ int) (image.Image, error) {
+		return DecodeICOSelectLargest(b)
+	}})
+	RegisterDecoder(Decoder{Name: "bmp", Sniff: magicSniffer("BM"), Decode: decodeWith(bmp.Decode)})
+	RegisterDecoder(Decoder{Name: "svg", Sniff: sniffSVG, Decode: func(b []byte, size int) (image.Image, error) {
+		return RasterizeSVG(b, size, size)
+	}, Vector: true})
+}
+
+// RegisterDecoder appends d to the registry, replacing a decoder with the same
+// name in place. Later registrations are sniffed after earlier ones.
+func RegisterDecoder(d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	for i := range decoders {
+		if decoders[i].Name == d.Name {
+			decoders[i] = d
+			return
+		}
+	}
+	decoders = append(decoders, d)
+}
+
+// Decoders returns a snapshot of the registered decoders in sniff order,
+// leaving out those that are unavailable or disabled (see
+// SetDisabledFormats).
+func Decoders() []Decoder {
+	decodersMu.RLock()
+	regs := append([]Decoder(nil), decoders...)
+	decodersMu.RUnlock()
+	out := regs[:0]
+	for _, d := range regs {
+		if !decoderDisabled(d.Name) && (d.Available == nil || d.Available()) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func rasterDecoders() []Decoder {
+	var out []Decoder
+	for _, d := range Decoders() {
+		if d.Raster {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// ErrUnknownFormat is returned by Decode when no registered decoder accepts the payload.
+var ErrUnknownFormat = errors.New("unsupported image format")
+
+// Decode decodes an icon payload with the first registered decoder whose
+// sniffer matches and that succeeds. If none match, the raster decoders are
+// tried blindly, and fallback decoders get the payload last. The chosen
+// decoder is returned so callers can tell vector output apart. Payloads
+// declaring more than MaxPixels fail with ErrTooManyPixels before any
+// decoder runs, and native raster output is converted to sRGB when the
+// payload embeds another colour profile.
+func Decode(b []byte, contentType, srcURL string, size int) (image.Image, Decoder, error) {
+	if err := checkDeclaredPixels(b); err != nil {
+		return nil, Decoder{}, err
+	}
+	var lastErr error
+	var fallbacks []Decoder
+	for _, d := range Decoders() {
+		if d.Fallback {
+			fallbacks = append(fallbacks, d)
+			continue
+		}
+		if !d.Sniff(b, contentType, srcURL) {
+			continue
+		}
+		img, err := d.Decode(b, size)
+		if err == nil {
+			return decoded(img, d, b), d, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		for _, d := range rasterDecoders() {
+			if img, err := d.Decode(b, size); err == nil {
+				return decoded(img, d, b), d, nil
+			}
+		}
+	}
+	for _, d := range fallbacks {
+		if !d.Sniff(b, contentType, srcURL) {
+			continue
+		}
+		img, err := d.Decode(b, size)
+		if err == nil {
+			return decoded(img, d, b), d, nil
+		}
+		// Keep the native error; it says more about the payload
+		if lastErr == nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, Decoder{}, lastErr
+	}
+	return nil, Decoder{}, ErrUnknownFormat
+}
+
+// decoded finishes what the native decoder d produced from b by converting
+// it to sRGB (see toSRGB). Vector output has no embedded profile, and
+// fallback converters manage colour themselves.
+func decoded(img image.Image, d Decoder, b []byte) image.Image {
+	if d.Vector || d.Fallback {
+		return img
+	}
+	return toSRGB(img, b)
+}
+
+func magicSniffer(prefixes ...string) func([]byte, string, string) bool {
+	return func(b []byte, _, _ string) bool {
+		for _, p := range prefixes {
+			if bytes.HasPrefix(b, []byte(p)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func sniffWebP(b []byte, _, _ string) bool {
+	return len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP"
+}
+
+func sniffAVIF(b []byte, _, _ string) bool {
+	if len(b) < 12 || string(b[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(b[8:12])
+	return brand == "avif" || brand == "avis"
+}
+
+// sniffHEIF reports whether b is an HEIF image or sequence (HEIC and
+// other HEVC-coded brands) by its ftyp box.
+func sniffHEIF(b []byte, _, _ string) bool {
+	if len(b) < 12 || string(b[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(b[8:12]) {
+	case "heic", "heix", "hevc", "heim", "heis", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+func sniffICO(b []byte, contentType, srcURL string) bool {
+	if bytes.HasPrefix(b, []byte{0, 0, 1, 0}) {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(contentType)
+	if ct == "image/x-icon" || ct == "image/vnd.microsoft.icon" {
+		return true
+	}
+	return urlExt(srcURL) == ".ico"
+}
+
+// urlExt returns the lower-cased extension of the path of srcURL, ignoring
+// its query and fragment.
+func urlExt(srcURL string) string {
+	if u, err := url.Parse(srcURL); err == nil {
+		srcURL = u.Path
+	}
+	return strings.ToLower(path.Ext(srcURL))
+}
+
+// sniffSVG matches SVG by content type, .svg or .svgz extension, or an
+// <svg element near the start of the body, gzip-compressed or not.
+func sniffSVG(b []byte, contentType, srcURL string) bool {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	ext := urlExt(srcURL)
+	if ct == "image/svg+xml" || ext == ".svg" || ext == ".svgz" {
+		return true
+	}
+	head := b
+	if isGzip(b) {
+		head = gunzipHead(b, 512)
+	} else if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
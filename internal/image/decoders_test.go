@@ -0,0 +1,167 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, enc func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := enc(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeSniffing(t *testing.T) {
+	pngData := encodeTestImage(t, func(b *bytes.Buffer, i image.Image) error { return png.Encode(b, i) })
+	jpegData := encodeTestImage(t, func(b *bytes.Buffer, i image.Image) error { return jpeg.Encode(b, i, nil) })
+	gifData := encodeTestImage(t, func(b *bytes.Buffer, i image.Image) error { return gif.Encode(b, i, nil) })
+
+	tests := []struct {
+		name    string
+		data    []byte
+		ct, url string
+		want    string
+	}{
+		{"png", pngData, "image/png", "https://example.com/a.png", "png"},
+		{"jpeg", jpegData, "", "", "jpeg"},
+		{"gif", gifData, "", "", "gif"},
+		// Magic bytes win over a misleading content type or extension
+		{"png served as ico", pngData, "image/x-icon", "https://example.com/favicon.ico", "png"},
+		{"png served as svg", pngData, "image/svg+xml", "https://example.com/logo.svg", "png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, dec, err := Decode(tt.data, tt.ct, tt.url, 32)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if dec.Name != tt.want {
+				t.Errorf("decoder = %s, want %s", dec.Name, tt.want)
+			}
+			if img.Bounds().Dx() != 4 {
+				t.Errorf("width = %d, want 4", img.Bounds().Dx())
+			}
+		})
+	}
+
+	if _, _, err := Decode([]byte("not an image"), "", "", 32); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Decode(garbage) error = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestSniffers(t *testing.T) {
+	tests := []struct {
+		name  string
+		sniff func([]byte, string, string) bool
+		data  string
+		ct    string
+		url   string
+		want  bool
+	}{
+		{"webp", sniffWebP, "RIFF\x00\x00\x00\x00WEBPVP8 ", "", "", true},
+		{"webp wrong fourcc", sniffWebP, "RIFF\x00\x00\x00\x00WAVE", "", "", false},
+		{"avif", sniffAVIF, "\x00\x00\x00\x1cftypavif", "", "", true},
+		{"heic is not avif", sniffAVIF, "\x00\x00\x00\x1cftypheic", "", "", false},
+		{"heic", sniffHEIF, "\x00\x00\x00\x1cftypheic", "", "", true},
+		{"heif sequence", sniffHEIF, "\x00\x00\x00\x1cftypmsf1", "", "", true},
+		{"avif is not heic", sniffHEIF, "\x00\x00\x00\x1cftypavif", "", "", false},
+		{"ico magic", sniffICO, "\x00\x00\x01\x00\x01\x00", "", "", true},
+		{"ico by type", sniffICO, "", "image/vnd.microsoft.icon", "", true},
+		{"svg body", sniffSVG, `<?xml version="1.0"?><SVG xmlns="http://www.w3.org/2000/svg">`, "text/plain", "", true},
+		{"svg by ext", sniffSVG, "", "", "https://example.com/logo.SVG", true},
+		{"not svg", sniffSVG, "<html></html>", "text/html", "https://example.com/", false},
+		{"svg by ext with query", sniffSVG, "", "", "https://example.com/icon.svg?v=2", true},
+		{"svg ext in query only", sniffSVG, "", "", "https://example.com/icon?x=.svg", false},
+		{"ico by ext with query", sniffICO, "", "", "https://example.com/favicon.ico?v=3", true},
+		{"svgz by ext", sniffSVG, "", "application/octet-stream", "https://example.com/logo.svgz", true},
+		{"gzipped svg body", sniffSVG, gzipString(`<svg xmlns="http://www.w3.org/2000/svg"/>`), "application/x-gzip", "", true},
+		{"gzipped html", sniffSVG, gzipString("<html></html>"), "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sniff([]byte(tt.data), tt.ct, tt.url); got != tt.want {
+				t.Errorf("sniff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func gzipString(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+func TestDecodeSVGZ(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect width="10" height="10" fill="#f00"/></svg>`
+	// Pre-compressed SVG served without Content-Encoding, under every hint
+	for _, hint := range []struct{ ct, url string }{
+		{"image/svg+xml", "https://example.com/logo.svg"},
+		{"application/octet-stream", "https://example.com/logo.svgz"},
+		{"", ""},
+	} {
+		img, dec, err := Decode([]byte(gzipString(svg)), hint.ct, hint.url, 32)
+		if err != nil {
+			t.Fatalf("Decode(%+v) error = %v", hint, err)
+		}
+		if dec.Name != "svg" || img.Bounds().Dx() != 32 {
+			t.Errorf("Decode(%+v) = %s at %d px, want svg at 32", hint, dec.Name, img.Bounds().Dx())
+		}
+		if r, _, _, a := img.At(16, 16).RGBA(); r>>8 != 0xff || a>>8 != 0xff {
+			t.Errorf("Decode(%+v) centre = %v, want opaque red", hint, img.At(16, 16))
+		}
+	}
+
+	bomb := gzipString("<svg>" + strings.Repeat(" ", MaxSVGBytes) + "</svg>")
+	if _, err := RasterizeSVG([]byte(bomb), 16, 16); !errors.Is(err, ErrSVGTooLarge) {
+		t.Errorf("RasterizeSVG(bomb) error = %v, want ErrSVGTooLarge", err)
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	saved := Decoders()
+	defer func() {
+		decodersMu.Lock()
+		decoders = saved
+		decodersMu.Unlock()
+	}()
+
+	custom := image.NewGray(image.Rect(0, 0, 7, 7))
+	RegisterDecoder(Decoder{
+		Name:   "x-proprietary",
+		Sniff:  magicSniffer("XPRP"),
+		Decode: func([]byte, int) (image.Image, error) { return custom, nil },
+	})
+
+	img, dec, err := Decode([]byte("XPRP...."), "application/octet-stream", "", 32)
+	if err != nil || dec.Name != "x-proprietary" || img != custom {
+		t.Fatalf("Decode() = %v, %s, %v", img, dec.Name, err)
+	}
+
+	// Re-registering by name replaces in place rather than appending
+	n := len(Decoders())
+	RegisterDecoder(Decoder{Name: "x-proprietary", Sniff: magicSniffer("XPRP"), Decode: func([]byte, int) (image.Image, error) {
+		return nil, errors.New("broken")
+	}})
+	if len(Decoders()) != n {
+		t.Errorf("RegisterDecoder duplicated an entry")
+	}
+	if _, _, err := Decode([]byte("XPRP...."), "", "", 32); err == nil {
+		t.Error("replaced decoder should have been used")
+	}
+}
@@ -0,0 +1,100 @@
+package image
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// diffThreshold is the per-channel difference above which a pixel counts
+// as changed; small deltas are resampling noise.
+const diffThreshold = 24
+
+// diffGap is the spacing between panels in DiffComposite.
+const diffGap = 4
+
+// DiffResult describes how two icons differ at a common size.
+type DiffResult struct {
+	// Similarity is 1 minus the mean absolute channel difference, so 1 means
+	// pixel-identical and 0 means fully inverted.
+	Similarity float64
+	// Changed is the fraction of pixels with a noticeable difference.
+	Changed float64
+}
+
+// CompareImages scales a and b to size×size over white and compares them
+// pixel by pixel.
+func CompareImages(a, b image.Image, size int) DiffResult {
+	pa, pb := flattenForDiff(a, size), flattenForDiff(b, size)
+	var sum, changed int
+	for i := 0; i < len(pa.Pix); i += 4 {
+		px := 0
+		for c := 0; c < 3; c++ {
+			d := absDiff(pa.Pix[i+c], pb.Pix[i+c])
+			sum += d
+			if d > px {
+				px = d
+			}
+		}
+		if px > diffThreshold {
+			changed++
+		}
+	}
+	pixels := size * size
+	return DiffResult{
+		Similarity: 1 - float64(sum)/float64(pixels*3*255),
+		Changed:    float64(changed) / float64(pixels),
+	}
+}
+
+// DiffComposite lays out a, b and a difference mask side by side, each
+// size×size on white. Changed pixels are red in the mask; unchanged ones
+// show a faded copy of b for context.
+func DiffComposite(a, b image.Image, size int) image.Image {
+	pa, pb := flattenForDiff(a, size), flattenForDiff(b, size)
+	dst := image.NewRGBA(image.Rect(0, 0, 3*size+2*diffGap, size))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(0, 0, size, size), pa, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(size+diffGap, 0, 2*size+diffGap, size), pb, image.Point{}, draw.Src)
+
+	red := color.RGBA{R: 0xe5, G: 0x39, B: 0x35, A: 0xff}
+	x0 := 2 * (size + diffGap)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			i := pa.PixOffset(x, y)
+			px := 0
+			for c := 0; c < 3; c++ {
+				if d := absDiff(pa.Pix[i+c], pb.Pix[i+c]); d > px {
+					px = d
+				}
+			}
+			if px > diffThreshold {
+				dst.SetRGBA(x0+x, y, red)
+				continue
+			}
+			// 25% of b blended into white
+			dst.SetRGBA(x0+x, y, color.RGBA{
+				R: 191 + pb.Pix[i]/4,
+				G: 191 + pb.Pix[i+1]/4,
+				B: 191 + pb.Pix[i+2]/4,
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+func flattenForDiff(img image.Image, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return dst
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"image"
+	"image/color"
+)
+
+// dominantSamples bounds the pixels DominantColor looks at per axis, so
+// large icons cost no more than a 64×64 one.
+const dominantSamples = 64
+
+// DominantColor returns the most common colour of img's visible pixels:
+// colours are grouped by their 4 high bits per channel, and the mean of
+// the largest group is returned, so antialiasing and encoding noise do not
+// split a flat area. Unlike AverageColor it ignores transparent pixels
+// rather than flattening them over white. ok is false when no pixel is
+// visible.
+func DominantColor(img image.Image) (c color.RGBA, ok bool) {
+	b := img.Bounds()
+	stepX, stepY := max(b.Dx()/dominantSamples, 1), max(b.Dy()/dominantSamples, 1)
+	type bucket struct{ n, r, g, b int }
+	var buckets [4096]bucket
+	best := -1
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			p := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if p.A < 0x80 {
+				continue
+			}
+			i := int(p.R>>4)<<8 | int(p.G>>4)<<4 | int(p.B>>4)
+			bk := &buckets[i]
+			bk.n++
+			bk.r += int(p.R)
+			bk.g += int(p.G)
+			bk.b += int(p.B)
+			if best < 0 || bk.n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return color.RGBA{}, false
+	}
+	bk := buckets[best]
+	return color.RGBA{
+		R: uint8((bk.r + bk.n/2) / bk.n),
+		G: uint8((bk.g + bk.n/2) / bk.n),
+		B: uint8((bk.b + bk.n/2) / bk.n),
+		A: 0xff,
+	}, true
+}
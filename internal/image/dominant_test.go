@@ -0,0 +1,32 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDominantColor(t *testing.T) {
+	// A blue disc with an orange bar on a transparent canvas
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			dx, dy := x-100, y-100
+			switch {
+			case y >= 90 && y < 110:
+				img.SetNRGBA(x, y, color.NRGBA{R: 240, G: 160, B: 20, A: 255})
+			case dx*dx+dy*dy < 80*80:
+				// Noise within a bucket must not move the result out of it
+				img.SetNRGBA(x, y, color.NRGBA{R: 20 + uint8(x%3), G: 60, B: 160, A: 255})
+			}
+		}
+	}
+	c, ok := DominantColor(img)
+	if !ok || c.R < 20 || c.R > 22 || c.G != 60 || c.B != 160 {
+		t.Errorf("DominantColor = %v, %v; want the disc's blue", c, ok)
+	}
+
+	if c, ok := DominantColor(image.NewNRGBA(image.Rect(0, 0, 16, 16))); ok {
+		t.Errorf("DominantColor(transparent) = %v, want none", c)
+	}
+}
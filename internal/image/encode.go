@@ -3,37 +3,219 @@ package image
 import (
 	"bytes"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
+	"sort"
+	"sync"
 )
 
-func EncodeByFormat(img image.Image, format string) ([]byte, string) {
-	switch format {
-	case "avif":
-		if b, err := encodeAsAVIF(img, 75); err == nil && len(b) > 0 {
-			return b, "image/avif"
+// Encoder produces one output format. Implementations registered with
+// RegisterEncoder become selectable by name in EncodeByFormat.
+type Encoder interface {
+	// Name is the format key used in cache paths and by EncodeByFormat (e.g. "webp").
+	Name() string
+	// ContentType is the MIME type of the encoded bytes.
+	ContentType() string
+	Encode(img image.Image) ([]byte, error)
+	// Available reports whether the encoder works in this process.
+	Available() bool
+}
+
+// QualityEncoder is implemented by lossy encoders whose quality can be
+// chosen per call, on a 1-100 scale where higher is better and larger.
+type QualityEncoder interface {
+	Encoder
+	EncodeQuality(img image.Image, quality int) ([]byte, error)
+}
+
+// JPEGBackground is the colour transparent pixels are flattened onto for
+// JPEG output, which has no alpha channel.
+var JPEGBackground color.Color = color.White
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{}
+
+	// encoderFallbacks lists where a format degrades to when its encoder
+	// is unavailable or fails; every chain ends at PNG.
+	encoderFallbacks = map[string]string{"avif": "webp"}
+)
+
+func init() {
+	RegisterEncoder(pngEncoder{})
+	RegisterEncoder(webpEncoder{quality: 85})
+	RegisterEncoder(avifEncoder{quality: 75})
+	RegisterEncoder(icoEncoder{})
+	RegisterEncoder(gifEncoder{})
+	RegisterEncoder(jpegEncoder{quality: 85})
+}
+
+// RegisterEncoder adds e to the registry, replacing any encoder with the same name.
+func RegisterEncoder(e Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[e.Name()] = e
+}
+
+// UnregisterEncoder removes the encoder registered under name.
+func UnregisterEncoder(name string) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	delete(encoders, name)
+}
+
+// LookupEncoder returns the encoder registered under name if it is available
+// and not disabled (see SetDisabledFormats).
+func LookupEncoder(name string) (Encoder, bool) {
+	encodersMu.RLock()
+	e, ok := encoders[name]
+	encodersMu.RUnlock()
+	if !ok || !e.Available() || encoderDisabled(name) {
+		return nil, false
+	}
+	return e, true
+}
+
+// Encoders returns all available, enabled encoders sorted by name.
+func Encoders() []Encoder {
+	encodersMu.RLock()
+	out := make([]Encoder, 0, len(encoders))
+	for _, e := range encoders {
+		if e.Available() && !encoderDisabled(e.Name()) {
+			out = append(out, e)
 		}
-		// Fall through to WebP if AVIF fails
-		fallthrough
-	case "webp":
-		if b, err := encodeAsWebP(img, 85); err == nil && len(b) > 0 {
-			return b, "image/webp"
+	}
+	encodersMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+// EncodeByFormat encodes img with the encoder registered for format,
+// following the fallback chain (AVIF → WebP → PNG) on failure. quality
+// (1-100, clamped; 0 = each encoder's default) is passed to encoders that
+// implement QualityEncoder and ignored by the rest. Metadata an encoder adds
+// is stripped (see StripMetadata), and OutputComment is added.
+func EncodeByFormat(img image.Image, format string, quality int) ([]byte, string) {
+	if quality != 0 {
+		quality = min(max(quality, 1), 100)
+	}
+	for f, seen := format, map[string]bool{}; f != "" && !seen[f]; f = encoderFallbacks[f] {
+		seen[f] = true
+		e, ok := LookupEncoder(f)
+		if !ok {
+			continue
+		}
+		var b []byte
+		var err error
+		if qe, ok := e.(QualityEncoder); ok && quality > 0 {
+			b, err = qe.EncodeQuality(img, quality)
+		} else {
+			b, err = e.Encode(img)
+		}
+		if err == nil && len(b) > 0 {
+			return finishOutput(b), e.ContentType()
 		}
 	}
 
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, img); err == nil {
-		return buf.Bytes(), "image/png"
+		return finishOutput(buf.Bytes()), "image/png"
 	}
 	return nil, ""
 }
 
+// ContentTypeFor returns the MIME type for a format, defaulting to PNG.
 func ContentTypeFor(format string) string {
-	switch format {
-	case "avif":
-		return "image/avif"
-	case "webp":
-		return "image/webp"
-	default:
-		return "image/png"
+	encodersMu.RLock()
+	e, ok := encoders[format]
+	encodersMu.RUnlock()
+	if ok {
+		return e.ContentType()
+	}
+	return "image/png"
+}
+
+type pngEncoder struct{}
+
+func (pngEncoder) Name() string        { return "png" }
+func (pngEncoder) ContentType() string { return "image/png" }
+func (pngEncoder) Available() bool     { return true }
+
+func (pngEncoder) Encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type webpEncoder struct{ quality int }
+
+func (webpEncoder) Name() string        { return "webp" }
+func (webpEncoder) ContentType() string { return "image/webp" }
+func (webpEncoder) Available() bool     { return true }
+
+func (e webpEncoder) Encode(img image.Image) ([]byte, error) {
+	return encodeAsWebP(img, e.quality)
+}
+
+type avifEncoder struct{ quality int }
+
+func (avifEncoder) Name() string        { return "avif" }
+func (avifEncoder) ContentType() string { return "image/avif" }
+func (avifEncoder) Available() bool     { return isAVIFSupported() }
+
+func (e avifEncoder) Encode(img image.Image) ([]byte, error) {
+	return encodeAsAVIF(img, e.quality)
+}
+
+func (avifEncoder) EncodeQuality(img image.Image, quality int) ([]byte, error) {
+	return encodeAsAVIF(img, quality)
+}
+
+// jpegEncoder writes baseline JPEGs, flattening transparency onto
+// JPEGBackground.
+type jpegEncoder struct{ quality int }
+
+func (jpegEncoder) Name() string        { return "jpeg" }
+func (jpegEncoder) ContentType() string { return "image/jpeg" }
+func (jpegEncoder) Available() bool     { return true }
+
+func (e jpegEncoder) Encode(img image.Image) ([]byte, error) {
+	return e.EncodeQuality(img, e.quality)
+}
+
+func (jpegEncoder) EncodeQuality(img image.Image, quality int) ([]byte, error) {
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Rect, &image.Uniform{JPEGBackground}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Rect, img, b.Min, draw.Over)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gifEncoder writes static GIFs, quantized to a palette with one fully
+// transparent entry so icon transparency survives.
+type gifEncoder struct{}
+
+func (gifEncoder) Name() string        { return "gif" }
+func (gifEncoder) ContentType() string { return "image/gif" }
+func (gifEncoder) Available() bool     { return true }
+
+func (gifEncoder) Encode(img image.Image) ([]byte, error) {
+	pal := append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+	dst := image.NewPaletted(img.Bounds(), pal)
+	draw.FloydSteinberg.Draw(dst, dst.Rect, img, img.Bounds().Min)
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, dst, nil); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,107 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+type fakeEncoder struct {
+	name      string
+	available bool
+	fail      bool
+}
+
+func (e fakeEncoder) Name() string        { return e.name }
+func (e fakeEncoder) ContentType() string { return "image/x-" + e.name }
+func (e fakeEncoder) Available() bool     { return e.available }
+
+func (e fakeEncoder) Encode(img image.Image) ([]byte, error) {
+	if e.fail {
+		return nil, errors.New("encode failed")
+	}
+	return []byte(e.name), nil
+}
+
+func TestEncoderRegistry(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	RegisterEncoder(fakeEncoder{name: "fake", available: true})
+	RegisterEncoder(fakeEncoder{name: "fake-off", available: false})
+	RegisterEncoder(fakeEncoder{name: "fake-broken", available: true, fail: true})
+	defer func() {
+		encodersMu.Lock()
+		delete(encoders, "fake")
+		delete(encoders, "fake-off")
+		delete(encoders, "fake-broken")
+		encodersMu.Unlock()
+	}()
+
+	tests := []struct {
+		format string
+		wantCT string
+	}{
+		{"fake", "image/x-fake"},
+		{"fake-off", "image/png"},
+		{"fake-broken", "image/png"},
+		{"unknown", "image/png"},
+		{"png", "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			data, ct := EncodeByFormat(img, tt.format, 0)
+			if ct != tt.wantCT || len(data) == 0 {
+				t.Errorf("EncodeByFormat(%q) = %d bytes, %q; want %q", tt.format, len(data), ct, tt.wantCT)
+			}
+		})
+	}
+
+	if _, ok := LookupEncoder("fake-off"); ok {
+		t.Error("LookupEncoder should skip unavailable encoders")
+	}
+	for _, e := range Encoders() {
+		if e.Name() == "fake-off" {
+			t.Error("Encoders() should skip unavailable encoders")
+		}
+	}
+}
+
+func TestJPEGEncoder(t *testing.T) {
+	// Left half transparent, right half a colour gradient
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 32; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x40, A: 0xff})
+		}
+	}
+
+	low, ct := EncodeByFormat(img, "jpeg", 10)
+	if ct != "image/jpeg" {
+		t.Fatalf("content type = %q, want image/jpeg", ct)
+	}
+	high, _ := EncodeByFormat(img, "jpeg", 95)
+	if len(low) >= len(high) {
+		t.Errorf("q=10 gave %d bytes, q=95 %d; want smaller", len(low), len(high))
+	}
+	if def, _ := EncodeByFormat(img, "jpeg", 0); len(def) == len(low) || len(def) == len(high) {
+		t.Errorf("default quality output matches an explicit one (%d bytes)", len(def))
+	}
+
+	dec, err := jpeg.Decode(bytes.NewReader(high))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := dec.At(8, 8).RGBA(); r < 0xf000 || g < 0xf000 || b < 0xf000 {
+		t.Errorf("transparent pixel = %v, want flattened onto white", dec.At(8, 8))
+	}
+
+	// Lossless encoders ignore the quality
+	a, _ := EncodeByFormat(img, "png", 10)
+	b, _ := EncodeByFormat(img, "png", 0)
+	if !bytes.Equal(a, b) {
+		t.Error("quality changed PNG output")
+	}
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	"fmt"
+	"image"
+)
+
+// FallbackErrorImage is the fallback style drawn by CreateErrorImage: a
+// placeholder that shows why no icon was found.
+const FallbackErrorImage = "error-image"
+
+// Failure classes CreateErrorImage draws a placeholder for.
+const (
+	// ErrorBlocked is a URL the service refuses, such as a private address
+	ErrorBlocked = "blocked"
+	// ErrorTimeout is a lookup that ran out of time or hit upstream errors
+	// that may clear up
+	ErrorTimeout = "timeout"
+	// ErrorNotFound is a site without a usable icon
+	ErrorNotFound = "not-found"
+)
+
+// errorImageSVG holds the drawing of each failure class on a 100x100
+// canvas. They differ in colour and shape, so they can be told apart at
+// 16 px and by colour-blind viewers: a red no-entry sign, an amber clock
+// and a grey dashed frame around a question mark.
+var errorImageSVG = map[string]string{
+	ErrorBlocked: `<circle cx="50" cy="50" r="42" fill="#ffebee" stroke="#d32f2f" stroke-width="10"/>
+  <line x1="22" y1="78" x2="78" y2="22" stroke="#d32f2f" stroke-width="10" stroke-linecap="round"/>`,
+	ErrorTimeout: `<circle cx="50" cy="50" r="42" fill="#fff8e1" stroke="#f9a825" stroke-width="8"/>
+  <path d="M50 24 V50 L68 62" fill="none" stroke="#f57f17" stroke-width="8" stroke-linecap="round" stroke-linejoin="round"/>`,
+	ErrorNotFound: `<rect x="8" y="8" width="84" height="84" rx="14" fill="#f5f5f5" stroke="#757575" stroke-width="6" stroke-dasharray="14 8"/>
+  <path d="M36 38 A14 14 0 1 1 56 50 C51 53 50 56 50 62" fill="none" stroke="#616161" stroke-width="8" stroke-linecap="round"/>
+  <circle cx="50" cy="76" r="5" fill="#616161"/>`,
+}
+
+// ParseErrorClass returns class if it is one of the failure classes
+// CreateErrorImage draws, or ErrorNotFound.
+func ParseErrorClass(class string) string {
+	if _, ok := errorImageSVG[class]; ok {
+		return class
+	}
+	return ErrorNotFound
+}
+
+// CreateErrorImage draws the size x size placeholder of a failure class
+// (see ParseErrorClass) with the SVG renderer, as CreateFallbackImage
+// draws the globe.
+func CreateErrorImage(class string, size int) (image.Image, error) {
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 100 100">
+  %s
+</svg>`, size, size, errorImageSVG[ParseErrorClass(class)])
+	return RasterizeSVG([]byte(svg), size, size)
+}
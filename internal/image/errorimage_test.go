@@ -0,0 +1,39 @@
+package image
+
+import "testing"
+
+func TestCreateErrorImage(t *testing.T) {
+	// The dominant colour tells the classes apart: red, amber and grey
+	tint := func(class string, size int) (r, g, b uint32) {
+		img, err := CreateErrorImage(class, size)
+		if err != nil {
+			t.Fatalf("%s: %v", class, err)
+		}
+		if got := img.Bounds(); got.Dx() != size || got.Dy() != size {
+			t.Fatalf("%s: image is %dx%d, want %dx%d", class, got.Dx(), got.Dy(), size, size)
+		}
+		// The ring of the sign and clock, and the frame edge, at 8% in
+		x, y := size/2, size*8/100
+		if class == ErrorNotFound {
+			x = size * 9 / 100
+		}
+		r, g, b, _ = img.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+
+	for _, size := range []int{16, 64} {
+		if r, g, b := tint(ErrorBlocked, size); r < 0xa0 || g > 0x80 || b > 0x80 {
+			t.Errorf("blocked at %dpx: colour %02x%02x%02x, want red", size, r, g, b)
+		}
+		if r, g, b := tint(ErrorTimeout, size); r < 0xc0 || g < 0x80 || b > 0x60 {
+			t.Errorf("timeout at %dpx: colour %02x%02x%02x, want amber", size, r, g, b)
+		}
+	}
+	if r, g, b := tint(ErrorNotFound, 64); r != g || g != b {
+		t.Errorf("not-found: colour %02x%02x%02x, want grey", r, g, b)
+	}
+
+	if got := ParseErrorClass("bogus"); got != ErrorNotFound {
+		t.Errorf("ParseErrorClass(bogus) = %q, want %q", got, ErrorNotFound)
+	}
+}
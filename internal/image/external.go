@@ -0,0 +1,285 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+)
+
+// External converter tools accepted by NewExternalConverter.
+const (
+	ExternalConverterVips   = "vips"
+	ExternalConverterMagick = "magick"
+)
+
+const (
+	// DefaultExternalTimeout bounds one conversion.
+	DefaultExternalTimeout = 5 * time.Second
+	// DefaultExternalConcurrency is how many conversions may run at once.
+	DefaultExternalConcurrency = 2
+
+	maxExternalInput  = 8 << 20
+	maxExternalOutput = 32 << 20
+	maxExternalEdge   = 8192
+)
+
+var errExternalOutputTooLarge = errors.New("converter output too large")
+
+// externalFormats maps sniffed input formats to ImageMagick coder names.
+// Only these formats are ever handed to a converter; everything else
+// (text, SVG, PostScript, PDF, ...) is refused before a process starts.
+var externalFormats = map[string]string{
+	"png":  "PNG",
+	"jpeg": "JPEG",
+	"gif":  "GIF",
+	"webp": "WEBP",
+	"avif": "AVIF",
+	"ico":  "ICO",
+	"bmp":  "BMP",
+	"heic": "HEIC",
+	"tiff": "TIFF",
+	"jxl":  "JXL",
+	"jp2":  "JP2",
+	"psd":  "PSD",
+	"qoi":  "QOI",
+}
+
+// magickPolicy restricts ImageMagick to the coders above, with no delegates,
+// indirect file reads or temporary disk use.
+const magickPolicy = `<policymap>
+  <policy domain="delegate" rights="none" pattern="*"/>
+  <policy domain="coder" rights="none" pattern="*"/>
+  <policy domain="coder" rights="read" pattern="{PNG,JPEG,GIF,WEBP,AVIF,ICO,BMP,HEIC,TIFF,JXL,JP2,PSD,QOI}"/>
+  <policy domain="coder" rights="write" pattern="PNG"/>
+  <policy domain="path" rights="none" pattern="@*"/>
+  <policy domain="resource" name="memory" value="256MiB"/>
+  <policy domain="resource" name="map" value="512MiB"/>
+  <policy domain="resource" name="disk" value="0"/>
+  <policy domain="resource" name="width" value="8KP"/>
+  <policy domain="resource" name="height" value="8KP"/>
+</policymap>
+`
+
+// ExternalConverterOptions configures NewExternalConverter.
+type ExternalConverterOptions struct {
+	Tool        string        // vips or magick
+	Path        string        // binary, resolved via PATH ("" = tool name)
+	Timeout     time.Duration // per conversion (0 = DefaultExternalTimeout)
+	Concurrency int           // parallel conversions (0 = DefaultExternalConcurrency)
+}
+
+// ExternalConverter decodes payloads the native decoders reject by piping
+// them through libvips or ImageMagick and reading back a PNG. Each process
+// runs with a minimal environment in a private working directory, under a
+// timeout and with capped input and output sizes.
+type ExternalConverter struct {
+	tool    string
+	path    string
+	timeout time.Duration
+	dir     string
+	sem     chan struct{}
+}
+
+// NewExternalConverter locates the converter binary and prepares its
+// sandbox directory. Call Close to remove the directory.
+func NewExternalConverter(opts ExternalConverterOptions) (*ExternalConverter, error) {
+	if opts.Tool != ExternalConverterVips && opts.Tool != ExternalConverterMagick {
+		return nil, fmt.Errorf("unknown external converter %q", opts.Tool)
+	}
+	path := opts.Path
+	if path == "" {
+		path = opts.Tool
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s binary: %w", opts.Tool, err)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultExternalTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultExternalConcurrency
+	}
+
+	dir, err := os.MkdirTemp("", "favicon-convert-")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tool == ExternalConverterMagick {
+		if err := os.WriteFile(filepath.Join(dir, "policy.xml"), []byte(magickPolicy), 0o600); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return &ExternalConverter{
+		tool:    opts.Tool,
+		path:    resolved,
+		timeout: opts.Timeout,
+		dir:     dir,
+		sem:     make(chan struct{}, opts.Concurrency),
+	}, nil
+}
+
+// Name returns the converter tool.
+func (c *ExternalConverter) Name() string { return c.tool }
+
+// Close removes the sandbox directory.
+func (c *ExternalConverter) Close() error {
+	return os.RemoveAll(c.dir)
+}
+
+// Decoder returns a fallback registry entry backed by c.
+func (c *ExternalConverter) Decoder() Decoder {
+	return Decoder{
+		Name: "external-" + c.tool,
+		Sniff: func(b []byte, _, _ string) bool {
+			return sniffExternalFormat(b) != ""
+		},
+		Decode: func(b []byte, _ int) (image.Image, error) {
+			return c.Convert(b)
+		},
+		Fallback: true,
+	}
+}
+
+// Convert decodes b with the external tool. Every call is counted in the
+// favicon_external_conversions_total metric by input format and result.
+func (c *ExternalConverter) Convert(b []byte) (image.Image, error) {
+	format := sniffExternalFormat(b)
+	if format == "" {
+		metrics.Get().IncExternalConversion(c.tool, "unknown", "rejected")
+		return nil, ErrUnknownFormat
+	}
+	if len(b) > maxExternalInput {
+		metrics.Get().IncExternalConversion(c.tool, format, "rejected")
+		return nil, fmt.Errorf("%s: input too large (%d bytes)", c.tool, len(b))
+	}
+
+	start := time.Now()
+	img, err := c.run(b, format)
+	result := "ok"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	}
+	metrics.Get().IncExternalConversion(c.tool, format, result)
+	logger.Debug("External %s conversion of %s: %s in %v", c.tool, format, result, time.Since(start))
+	return img, err
+}
+
+func (c *ExternalConverter) run(b []byte, format string) (image.Image, error) {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var args, env []string
+	switch c.tool {
+	case ExternalConverterMagick:
+		// Name the coder explicitly so ImageMagick cannot pick its own
+		// based on the payload; [0] keeps only the first frame
+		args = []string{
+			"-limit", "time", strconv.Itoa(int(c.timeout/time.Second) + 1),
+			externalFormats[format] + ":-[0]",
+			"-strip", "png:-",
+		}
+		env = []string{"MAGICK_CONFIGURE_PATH=" + c.dir, "MAGICK_THREAD_LIMIT=1"}
+	case ExternalConverterVips:
+		args = []string{"copy", "stdin", ".png[strip]"}
+		env = []string{"VIPS_BLOCK_UNTRUSTED=1", "VIPS_CONCURRENCY=1"}
+	}
+
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Dir = c.dir
+	cmd.Env = append(env, "PATH=/usr/bin:/bin", "HOME="+c.dir, "TMPDIR="+c.dir)
+	cmd.Stdin = bytes.NewReader(b)
+	stdout := &cappedBuffer{max: maxExternalOutput}
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	sandboxCommand(cmd)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", c.tool, ctx.Err())
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			if len(msg) > 200 {
+				msg = msg[:200]
+			}
+			return nil, fmt.Errorf("%s: %v: %s", c.tool, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", c.tool, err)
+	}
+
+	cfg, err := png.DecodeConfig(bytes.NewReader(stdout.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("%s output: %w", c.tool, err)
+	}
+	if cfg.Width > maxExternalEdge || cfg.Height > maxExternalEdge {
+		return nil, fmt.Errorf("%s output too large: %dx%d", c.tool, cfg.Width, cfg.Height)
+	}
+	if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+		return nil, fmt.Errorf("%s output: %w", c.tool, err)
+	}
+	return png.Decode(bytes.NewReader(stdout.Bytes()))
+}
+
+// cappedBuffer fails writes once max bytes have been buffered, which makes
+// a runaway converter exit on a broken pipe.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.Len()+len(p) > c.max {
+		return 0, errExternalOutputTooLarge
+	}
+	return c.Buffer.Write(p)
+}
+
+// sniffExternalFormat identifies payloads worth handing to a converter by
+// magic bytes alone: formats without a native decoder, and native raster
+// formats whose decoder may have failed on an unsupported variant. Returns
+// "" for anything else.
+func sniffExternalFormat(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("II*\x00")), bytes.HasPrefix(b, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(b, []byte("\xff\x0a")), bytes.HasPrefix(b, []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")):
+		return "jxl"
+	case bytes.HasPrefix(b, []byte("\x00\x00\x00\x0cjP  \r\n\x87\n")), bytes.HasPrefix(b, []byte("\xff\x4f\xff\x51")):
+		return "jp2"
+	case bytes.HasPrefix(b, []byte("8BPS")):
+		return "psd"
+	case bytes.HasPrefix(b, []byte("qoif")):
+		return "qoi"
+	case sniffHEIF(b, "", ""):
+		return "heic"
+	}
+	for _, d := range Decoders() {
+		if d.Vector || d.Fallback {
+			continue
+		}
+		if _, ok := externalFormats[d.Name]; ok && d.Sniff(b, "", "") {
+			return d.Name
+		}
+	}
+	return ""
+}
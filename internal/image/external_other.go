@@ -0,0 +1,9 @@
+//go:build !unix
+
+package image
+
+import "os/exec"
+
+// sandboxCommand is a no-op where process groups are unavailable; the
+// timeout still kills the converter itself.
+func sandboxCommand(cmd *exec.Cmd) {}
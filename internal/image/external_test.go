@@ -0,0 +1,157 @@
+//go:build unix
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"faviconsvc/pkg/metrics"
+)
+
+var tiffPayload = []byte("II*\x00\x08\x00\x00\x00fake tiff body")
+
+// fakeConverter writes an executable shell script standing in for magick.
+func fakeConverter(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "magick")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExternalConverter(t *testing.T) {
+	metrics.Reset()
+	defer metrics.Reset()
+
+	dir := t.TempDir()
+	fixture := filepath.Join(dir, "out.png")
+	var buf bytes.Buffer
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	src.Set(1, 1, color.NRGBA{R: 255, A: 255})
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fixture, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	argsFile := filepath.Join(dir, "args")
+	path := fakeConverter(t, `echo "$@" > `+argsFile+`
+cat > /dev/null
+cat `+fixture)
+
+	conv, err := NewExternalConverter(ExternalConverterOptions{Tool: ExternalConverterMagick, Path: path})
+	if err != nil {
+		t.Fatalf("NewExternalConverter() error = %v", err)
+	}
+	defer conv.Close()
+
+	d := conv.Decoder()
+	if !d.Fallback || !d.Sniff(tiffPayload, "", "") {
+		t.Fatalf("decoder %+v should be a fallback accepting TIFF", d.Name)
+	}
+	img, err := d.Decode(tiffPayload, 32)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Errorf("decoded %dx%d, want native 40x20", b.Dx(), b.Dy())
+	}
+	args, _ := os.ReadFile(argsFile)
+	if !strings.Contains(string(args), "TIFF:-[0]") {
+		t.Errorf("converter args = %q, want explicit TIFF coder", args)
+	}
+	if _, err := os.Stat(filepath.Join(conv.dir, "policy.xml")); err != nil {
+		t.Errorf("magick policy not written: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Get().Handler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`format="tiff"`, `result="ok"`, `converter="magick"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestExternalConverterTimeout(t *testing.T) {
+	// The child sleep keeps stdout open; only a process-group kill ends it
+	path := fakeConverter(t, "sleep 10")
+	conv, err := NewExternalConverter(ExternalConverterOptions{
+		Tool:    ExternalConverterMagick,
+		Path:    path,
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conv.Close()
+
+	start := time.Now()
+	_, err = conv.Convert(tiffPayload)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Convert() error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Convert() took %v after timeout", elapsed)
+	}
+}
+
+func TestSniffExternalFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"tiff", tiffPayload, "tiff"},
+		{"heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), "heic"},
+		{"jxl", []byte("\xff\x0a\x00"), "jxl"},
+		{"png", []byte("\x89PNG\r\n\x1a\ncorrupt"), "png"},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), ""},
+		{"html", []byte("<!doctype html><html></html>"), ""},
+		{"postscript", []byte("%!PS-Adobe-3.0"), ""},
+		{"pdf", []byte("%PDF-1.7"), ""},
+	}
+	for _, tt := range tests {
+		if got := sniffExternalFormat(tt.in); got != tt.want {
+			t.Errorf("sniffExternalFormat(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeFallbackOrder(t *testing.T) {
+	calls := 0
+	RegisterDecoder(Decoder{
+		Name:  "test-fallback",
+		Sniff: magicSniffer("FALLBACKFMT"),
+		Decode: func([]byte, int) (image.Image, error) {
+			calls++
+			return image.NewNRGBA(image.Rect(0, 0, 1, 1)), nil
+		},
+		Fallback: true,
+	})
+
+	// Native formats never reach the fallback
+	var png1 bytes.Buffer
+	_ = png.Encode(&png1, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	if _, d, err := Decode(png1.Bytes(), "", "", 16); err != nil || d.Name != "png" {
+		t.Errorf("Decode(png) = %q, %v", d.Name, err)
+	}
+	if _, d, err := Decode([]byte("FALLBACKFMT..."), "", "", 16); err != nil || d.Name != "test-fallback" {
+		t.Errorf("Decode(fallback payload) = %q, %v", d.Name, err)
+	}
+	if calls != 1 {
+		t.Errorf("fallback called %d times, want 1", calls)
+	}
+}
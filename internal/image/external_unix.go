@@ -0,0 +1,17 @@
+//go:build unix
+
+package image
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// sandboxCommand runs the converter in its own process group so a timeout
+// kills any helpers it forked, not just the top-level process.
+func sandboxCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
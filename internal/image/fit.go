@@ -0,0 +1,118 @@
+package image
+
+import (
+	"image"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit modes ResizeImageFit accepts: how a non-square source is made square.
+const (
+	// FitStretch scales each axis on its own, distorting the source.
+	FitStretch = "stretch"
+	// FitContain scales the whole source to fit and letterboxes it on
+	// transparency.
+	FitContain = "contain"
+	// FitCover scales the source to fill the square and crops the excess
+	// around its centre.
+	FitCover = "cover"
+)
+
+// Fits lists every fit mode, FitStretch first.
+var Fits = []string{FitStretch, FitContain, FitCover}
+
+// ParseFit returns the canonical name of a fit mode, or "" if name is not
+// one of Fits.
+func ParseFit(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, f := range Fits {
+		if name == f {
+			return f
+		}
+	}
+	return ""
+}
+
+// ResizeImageFit scales img to size x size using the resampling filter
+// named by filter, making a non-square img square as fit (one of Fits)
+// says. Square sources, FitStretch and unknown modes resize like
+// ResizeImageWith.
+func ResizeImageFit(img image.Image, size int, fit, filter string) image.Image {
+	b := img.Bounds()
+	if b.Dx() == b.Dy() || b.Empty() {
+		return ResizeImageWith(img, size, filter)
+	}
+
+	dst := newScaleDst(img, size)
+	switch ParseFit(fit) {
+	case FitContain:
+		scale := float64(size) / float64(max(b.Dx(), b.Dy()))
+		w, h := int(float64(b.Dx())*scale+0.5), int(float64(b.Dy())*scale+0.5)
+		w, h = max(w, 1), max(h, 1)
+		r := image.Rect((size-w)/2, (size-h)/2, (size-w)/2+w, (size-h)/2+h)
+		scaler(filter, img, size).Scale(dst, r, img, b, draw.Over, nil)
+	case FitCover:
+		side := min(b.Dx(), b.Dy())
+		x, y := b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2
+		crop := image.Rect(x, y, x+side, y+side)
+		src := img
+		if s, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			src = s.SubImage(crop)
+		}
+		scaler(filter, src, size).Scale(dst, dst.Bounds(), img, crop, draw.Over, nil)
+	default:
+		return ResizeImageWith(img, size, filter)
+	}
+	return dst
+}
+
+// ResizeImageRect scales img to width x height using the resampling filter
+// named by filter. When img's aspect ratio differs from the target's, fit
+// says how it is matched as for ResizeImageFit: FitContain letterboxes it,
+// FitCover crops it around its centre and FitStretch or an unknown mode
+// distorts it. A square target resizes like ResizeImageFit.
+func ResizeImageRect(img image.Image, width, height int, fit, filter string) image.Image {
+	if width == height {
+		return ResizeImageFit(img, width, fit, filter)
+	}
+	b := img.Bounds()
+	if b.Dx() == width && b.Dy() == height {
+		return img
+	}
+	dst := newScaleDstRect(img, width, height)
+	if b.Empty() {
+		return dst
+	}
+	edge := max(width, height)
+	switch ParseFit(fit) {
+	case FitContain:
+		scale := min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+		w, h := int(float64(b.Dx())*scale+0.5), int(float64(b.Dy())*scale+0.5)
+		w, h = max(min(w, width), 1), max(min(h, height), 1)
+		r := image.Rect((width-w)/2, (height-h)/2, (width-w)/2+w, (height-h)/2+h)
+		scaler(filter, img, edge).Scale(dst, r, img, b, draw.Over, nil)
+	case FitCover:
+		// The largest centred part of img with the target's aspect ratio
+		cw, ch := b.Dx(), b.Dy()
+		if cw*height > ch*width {
+			cw = max(ch*width/height, 1)
+		} else {
+			ch = max(cw*height/width, 1)
+		}
+		x, y := b.Min.X+(b.Dx()-cw)/2, b.Min.Y+(b.Dy()-ch)/2
+		crop := image.Rect(x, y, x+cw, y+ch)
+		src := img
+		if s, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			src = s.SubImage(crop)
+		}
+		scaler(filter, src, edge).Scale(dst, dst.Bounds(), img, crop, draw.Over, nil)
+	default:
+		scaler(filter, img, edge).Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	}
+	return dst
+}
@@ -0,0 +1,117 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// banner returns a w x h opaque image, red in its left half and blue in
+// its right.
+func banner(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: 0xff, A: 0xff}
+			if x >= w/2 {
+				c = color.NRGBA{B: 0xff, A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestParseFit(t *testing.T) {
+	for in, want := range map[string]string{"contain": FitContain, " Cover ": FitCover, "stretch": FitStretch, "fill": "", "": ""} {
+		if got := ParseFit(in); got != want {
+			t.Errorf("ParseFit(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestResizeImageFit(t *testing.T) {
+	alpha := func(img image.Image, x, y int) uint32 {
+		_, _, _, a := img.At(x, y).RGBA()
+		return a
+	}
+	src := banner(64, 16)
+
+	// contain: the 4:1 banner becomes a 32x8 strip centred on transparency
+	img := ResizeImageFit(src, 32, FitContain, FilterBilinear)
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Fatalf("contain bounds = %v", b)
+	}
+	if alpha(img, 16, 2) != 0 || alpha(img, 16, 29) != 0 {
+		t.Error("contain did not letterbox above and below")
+	}
+	if alpha(img, 1, 15) != 0xffff || alpha(img, 30, 16) != 0xffff {
+		t.Error("contain lost the banner's ends")
+	}
+
+	// cover: the centre square fills the tile, cropping the ends away, so
+	// both halves still meet in the middle
+	img = ResizeImageFit(src, 32, FitCover, FilterBilinear)
+	if alpha(img, 16, 0) != 0xffff || alpha(img, 16, 31) != 0xffff {
+		t.Error("cover left transparent rows")
+	}
+	if r, _, b, _ := img.At(2, 16).RGBA(); r < 0xf000 || b != 0 {
+		t.Errorf("cover left edge = %v, want red", img.At(2, 16))
+	}
+	if r, _, b, _ := img.At(29, 16).RGBA(); b < 0xf000 || r != 0 {
+		t.Errorf("cover right edge = %v, want blue", img.At(29, 16))
+	}
+
+	// stretch fills every pixel
+	img = ResizeImageFit(src, 32, FitStretch, FilterBilinear)
+	if alpha(img, 16, 0) != 0xffff || alpha(img, 0, 0) != 0xffff {
+		t.Error("stretch left transparent pixels")
+	}
+
+	// Cropping a sub-image keeps to its own bounds
+	sub := banner(96, 16).SubImage(image.Rect(16, 0, 80, 16))
+	img = ResizeImageFit(sub, 16, FitCover, FilterNearest)
+	if r, _, _, _ := img.At(0, 8).RGBA(); r != 0xffff {
+		t.Errorf("cover of sub-image left edge = %v, want red", img.At(0, 8))
+	}
+}
+
+func TestResizeImageRect(t *testing.T) {
+	alpha := func(img image.Image, x, y int) uint32 {
+		_, _, _, a := img.At(x, y).RGBA()
+		return a
+	}
+	square := banner(32, 32)
+
+	// contain: a square icon in a 64x40 target is pillarboxed
+	img := ResizeImageRect(square, 64, 40, FitContain, FilterBilinear)
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 40 {
+		t.Fatalf("contain bounds = %v", b)
+	}
+	if alpha(img, 5, 20) != 0 || alpha(img, 58, 20) != 0 {
+		t.Error("contain did not pillarbox left and right")
+	}
+	if alpha(img, 32, 0) != 0xffff || alpha(img, 32, 39) != 0xffff {
+		t.Error("contain did not fill the height")
+	}
+
+	// cover: the 64x16 banner's centre fills 32x20 with both halves
+	img = ResizeImageRect(banner(64, 16), 32, 20, FitCover, FilterBilinear)
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 20 {
+		t.Fatalf("cover bounds = %v", b)
+	}
+	if alpha(img, 0, 0) != 0xffff || alpha(img, 31, 19) != 0xffff {
+		t.Error("cover left transparent pixels")
+	}
+	if r, _, b, _ := img.At(2, 10).RGBA(); r < 0xf000 || b != 0 {
+		t.Errorf("cover left edge = %v, want red", img.At(2, 10))
+	}
+
+	// stretch fills every pixel, and a square target resizes as before
+	if img := ResizeImageRect(square, 48, 16, FitStretch, FilterBilinear); alpha(img, 0, 0) != 0xffff || img.Bounds().Dx() != 48 {
+		t.Error("stretch did not fill 48x16")
+	}
+	if b := ResizeImageRect(square, 16, 16, FitContain, FilterBilinear).Bounds(); b.Dx() != 16 || b.Dy() != 16 {
+		t.Errorf("square target bounds = %v", b)
+	}
+}
@@ -0,0 +1,116 @@
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	disabledMu       sync.RWMutex
+	disabledEncoders = map[string]bool{}
+	disabledDecoders = map[string]bool{}
+)
+
+// SetDisabledFormats turns off the named encoders and decoders at run time,
+// replacing any earlier set: disabled encoders are left out of
+// LookupEncoder and Encoders, so requests for them fall back as for an
+// unavailable format, and disabled decoders are left out of Decoders, so
+// their payloads go to the fallback decoders. PNG, which every encoder
+// fallback chain ends at, cannot be disabled, and names that are not
+// registered are rejected.
+func SetDisabledFormats(encoderNames, decoderNames []string) error {
+	enc, dec := map[string]bool{}, map[string]bool{}
+	for _, name := range encoderNames {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		encodersMu.RLock()
+		_, ok := encoders[name]
+		encodersMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown encoder %q", name)
+		}
+		if name == "png" {
+			return fmt.Errorf("the png encoder cannot be disabled")
+		}
+		enc[name] = true
+	}
+	for _, name := range decoderNames {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !decoderRegistered(name) {
+			return fmt.Errorf("unknown decoder %q", name)
+		}
+		dec[name] = true
+	}
+	disabledMu.Lock()
+	disabledEncoders, disabledDecoders = enc, dec
+	disabledMu.Unlock()
+	return nil
+}
+
+func encoderDisabled(name string) bool {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return disabledEncoders[name]
+}
+
+func decoderDisabled(name string) bool {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return disabledDecoders[name]
+}
+
+func decoderRegistered(name string) bool {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	for _, d := range decoders {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Codec describes a registered encoder or decoder and whether it can be
+// used in this process.
+type Codec struct {
+	Name        string
+	ContentType string // encoders only
+	Vector      bool   // decoders only
+	Fallback    bool   // decoders only, see Decoder.Fallback
+	// Available is false when the codec does not work here, such as an
+	// AVIF encoder whose library fails to load, or is disabled
+	Available bool
+	Disabled  bool // turned off by SetDisabledFormats
+}
+
+// Codecs returns every registered encoder, sorted by name, and decoder, in
+// sniff order, with their state at run time.
+func Codecs() (encs, decs []Codec) {
+	encodersMu.RLock()
+	all := make([]Encoder, 0, len(encoders))
+	for _, e := range encoders {
+		all = append(all, e)
+	}
+	encodersMu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	for _, e := range all {
+		disabled := encoderDisabled(e.Name())
+		encs = append(encs, Codec{Name: e.Name(), ContentType: e.ContentType(), Available: !disabled && e.Available(), Disabled: disabled})
+	}
+
+	decodersMu.RLock()
+	regs := append([]Decoder(nil), decoders...)
+	decodersMu.RUnlock()
+	for _, d := range regs {
+		disabled := decoderDisabled(d.Name)
+		decs = append(decs, Codec{Name: d.Name, Vector: d.Vector, Fallback: d.Fallback, Available: !disabled && (d.Available == nil || d.Available()), Disabled: disabled})
+	}
+	return encs, decs
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"image"
+	"testing"
+)
+
+func TestSetDisabledFormats(t *testing.T) {
+	defer SetDisabledFormats(nil, nil)
+
+	if err := SetDisabledFormats([]string{"png"}, nil); err == nil {
+		t.Error("disabling png succeeded")
+	}
+	if err := SetDisabledFormats([]string{"bogus"}, nil); err == nil {
+		t.Error("disabling an unknown encoder succeeded")
+	}
+	if err := SetDisabledFormats(nil, []string{"bogus"}); err == nil {
+		t.Error("disabling an unknown decoder succeeded")
+	}
+
+	if err := SetDisabledFormats([]string{" AVIF ", "webp"}, []string{"heif"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LookupEncoder("avif"); ok {
+		t.Error("LookupEncoder(avif) found a disabled encoder")
+	}
+	for _, e := range Encoders() {
+		if e.Name() == "webp" {
+			t.Error("Encoders() lists a disabled encoder")
+		}
+	}
+	// The fallback chain skips both and ends at PNG
+	if _, ct := EncodeByFormat(image.NewNRGBA(image.Rect(0, 0, 8, 8)), "avif", 0); ct != "image/png" {
+		t.Errorf("EncodeByFormat(avif) = %s, want image/png", ct)
+	}
+	for _, d := range Decoders() {
+		if d.Name == "heif" {
+			t.Error("Decoders() lists a disabled decoder")
+		}
+	}
+	if isHEIFSupported() {
+		t.Error("isHEIFSupported() with heif disabled")
+	}
+
+	encs, decs := Codecs()
+	byName := func(codecs []Codec, name string) Codec {
+		for _, c := range codecs {
+			if c.Name == name {
+				return c
+			}
+		}
+		return Codec{}
+	}
+	if c := byName(encs, "webp"); c.Available || !c.Disabled {
+		t.Errorf("Codecs() webp encoder = %+v, want disabled", c)
+	}
+	if c := byName(decs, "webp"); !c.Available || c.Disabled {
+		t.Errorf("Codecs() webp decoder = %+v, want available", c)
+	}
+	if c := byName(encs, "png"); !c.Available || c.Disabled {
+		t.Errorf("Codecs() png encoder = %+v, want available", c)
+	}
+	if c := byName(decs, "heif"); c.Available || !c.Disabled {
+		t.Errorf("Codecs() heif decoder = %+v, want disabled", c)
+	}
+
+	// A new set replaces the old one
+	if err := SetDisabledFormats(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LookupEncoder("webp"); !ok {
+		t.Error("webp still disabled after clearing the set")
+	}
+}
@@ -0,0 +1,17 @@
+package image
+
+import "github.com/gen2brain/heic"
+
+// The gen2brain/heic library decodes HEIF/HEIC through an embedded WASM
+// build of a pure-Rust decoder (or libheif when installed), so no cgo is
+// needed. Sequences decode to their first frame.
+func init() {
+	RegisterDecoder(Decoder{Name: "heif", Sniff: sniffHEIF, Decode: decodeWith(heic.Decode), Raster: true})
+}
+
+// isHEIFSupported reports whether HEIF decoding is not disabled (see
+// SetDisabledFormats). HEIF payloads are otherwise left to the external
+// converter, if one is configured.
+func isHEIFSupported() bool {
+	return !decoderDisabled("heif")
+}
@@ -0,0 +1,33 @@
+package image
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDecodeHEIF(t *testing.T) {
+	b, err := os.ReadFile("testdata/icon.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHEIFSupported() {
+		// Without the native decoder HEIF is left to the external converter
+		if _, err := DecodeImageRasterOnly(b); err == nil {
+			t.Error("HEIF decoded with HEIF support disabled")
+		}
+		return
+	}
+
+	img, err := DecodeImageRasterOnly(b)
+	if err != nil {
+		t.Fatalf("DecodeImageRasterOnly() error = %v", err)
+	}
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 480 || h != 640 {
+		t.Errorf("size = %dx%d, want 480x640", w, h)
+	}
+
+	_, d, err := Decode(b, "image/heic", "https://example.com/apple-touch-icon.heic", 64)
+	if err != nil || d.Name != "heif" {
+		t.Errorf("Decode() chose %q, error = %v", d.Name, err)
+	}
+}
@@ -0,0 +1,431 @@
+package image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+)
+
+// maxICCSize bounds the embedded profiles read; matrix/TRC profiles are a
+// few KiB, only LUT-based print profiles get near this.
+const maxICCSize = 1 << 20
+
+// iccTolerance is how far a profile's primaries and curves may stray from
+// sRGB, in XYZ units and curve output, and still be treated as sRGB.
+// Vendors' sRGB profiles differ by rounding and chromatic adaptation.
+const iccTolerance = 0.005
+
+// srgbD50 holds the sRGB primaries adapted to the D50 PCS white, as the
+// rXYZ, gXYZ and bXYZ columns of the reference sRGB profile.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccTransform converts colours from an RGB matrix/TRC profile to sRGB.
+type iccTransform struct {
+	// linear maps each 8-bit input channel to linear light
+	linear [3][256]float64
+	// matrix takes linear profile RGB to linear sRGB
+	matrix [3][3]float64
+}
+
+// toSRGB converts img, decoded from b, to sRGB if b embeds an RGB ICC
+// profile that differs from sRGB. Icons exported from design tools often
+// carry Display P3 or Adobe RGB profiles; responses are stripped of
+// metadata, so the pixels themselves must be sRGB or their colours come out
+// wrong (usually washed out). Grey, CMYK and LUT-only profiles, and images
+// already in sRGB, are returned as they are.
+func toSRGB(img image.Image, b []byte) image.Image {
+	p := embeddedICC(b)
+	if p == nil {
+		return img
+	}
+	t, ok := parseICC(p)
+	if !ok {
+		return img
+	}
+	return t.apply(img)
+}
+
+// embeddedICC returns the ICC profile embedded in an encoded PNG, JPEG,
+// WebP, AVIF or HEIF image, or nil if there is none or b is malformed.
+func embeddedICC(b []byte) []byte {
+	var p []byte
+	switch {
+	case bytes.HasPrefix(b, pngSignature):
+		p = pngICC(b)
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8, 0xff}):
+		p = jpegICC(b)
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		p = webpICC(b)
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		p = isobmffICC(b)
+	}
+	if len(p) > maxICCSize {
+		return nil
+	}
+	return p
+}
+
+// pngICC inflates the iCCP chunk, which must come before the image data.
+func pngICC(b []byte) []byte {
+	for p := len(pngSignature); len(b)-p >= 12; {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		if n < 0 || p+12+n > len(b) {
+			return nil
+		}
+		typ, data := string(b[p+4:p+8]), b[p+8:p+8+n]
+		switch typ {
+		case "IDAT":
+			return nil
+		case "iCCP":
+			// Profile name, NUL, compression method (0 = zlib)
+			i := bytes.IndexByte(data, 0)
+			if i < 0 || i+2 > len(data) || data[i+1] != 0 {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+			if err != nil {
+				return nil
+			}
+			defer zr.Close()
+			prof, err := io.ReadAll(io.LimitReader(zr, maxICCSize+1))
+			if err != nil {
+				return nil
+			}
+			return prof
+		}
+		p += 12 + n
+	}
+	return nil
+}
+
+// jpegICC joins the APP2 ICC_PROFILE segments a profile too large for one
+// segment is split across, in their sequence order.
+func jpegICC(b []byte) []byte {
+	type part struct {
+		seq  byte
+		data []byte
+	}
+	var parts []part
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		m := b[i+1]
+		if m == 0xff {
+			i++
+			continue
+		}
+		if m == 0xda || m == 0xd9 { // start of scan, end of image
+			break
+		}
+		n := int(b[i+2])<<8 | int(b[i+3])
+		if n < 2 || i+2+n > len(b) {
+			break
+		}
+		seg := b[i+4 : i+2+n]
+		if m == 0xe2 && len(seg) > 14 && bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00")) {
+			parts = append(parts, part{seq: seg[12], data: seg[14:]})
+		}
+		i += 2 + n
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].seq < parts[j].seq })
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p.data...)
+	}
+	return out
+}
+
+// webpICC returns the ICCP chunk of an extended (VP8X) WebP.
+func webpICC(b []byte) []byte {
+	for p := 12; len(b)-p >= 8; {
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		end := p + 8 + n + n&1
+		if n < 0 || p+8+n > len(b) {
+			return nil
+		}
+		if string(b[p:p+4]) == "ICCP" {
+			return b[p+8 : p+8+n]
+		}
+		p = min(end, len(b))
+	}
+	return nil
+}
+
+// isobmffICC returns the profile of the first colr box of type prof (or
+// rICC) among the item properties, meta/iprp/ipco, of an AVIF or HEIF file.
+func isobmffICC(b []byte) []byte {
+	meta := findBox(b, "meta")
+	if len(meta) < 4 {
+		return nil
+	}
+	// meta is a full box: version and flags precede its children
+	ipco := findBox(findBox(meta[4:], "iprp"), "ipco")
+	for rest := ipco; ; {
+		typ, body, next, ok := nextBox(rest)
+		if !ok {
+			return nil
+		}
+		if typ == "colr" && len(body) >= 4 && (string(body[:4]) == "prof" || string(body[:4]) == "rICC") {
+			return body[4:]
+		}
+		rest = next
+	}
+}
+
+// findBox returns the body of the first box of type typ in b.
+func findBox(b []byte, typ string) []byte {
+	for {
+		t, body, next, ok := nextBox(b)
+		if !ok {
+			return nil
+		}
+		if t == typ {
+			return body
+		}
+		b = next
+	}
+}
+
+// nextBox splits the ISOBMFF box at the start of b from the rest.
+func nextBox(b []byte) (typ string, body, rest []byte, ok bool) {
+	if len(b) < 8 {
+		return "", nil, nil, false
+	}
+	size, hdr := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+	switch size {
+	case 0: // to the end
+		size = uint64(len(b))
+	case 1: // 64-bit size follows the type
+		if len(b) < 16 {
+			return "", nil, nil, false
+		}
+		size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+	}
+	if size < hdr || size > uint64(len(b)) {
+		return "", nil, nil, false
+	}
+	return string(b[4:8]), b[hdr:size], b[size:], true
+}
+
+// parseICC builds the transform to sRGB for an RGB display profile with
+// colorant (rXYZ, gXYZ, bXYZ) and curve (rTRC, gTRC, bTRC) tags. ok is
+// false for profiles it cannot apply and for profiles that are sRGB
+// already.
+func parseICC(p []byte) (t *iccTransform, ok bool) {
+	if len(p) < 132 || string(p[16:20]) != "RGB " || string(p[20:24]) != "XYZ " {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint32(p[128:]))
+	if n < 0 || n > (len(p)-132)/12 {
+		return nil, false
+	}
+	tags := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		e := p[132+12*i:]
+		off, size := uint64(binary.BigEndian.Uint32(e[4:])), uint64(binary.BigEndian.Uint32(e[8:]))
+		if off+size > uint64(len(p)) {
+			return nil, false
+		}
+		tags[string(e[:4])] = p[off : off+size]
+	}
+
+	var m [3][3]float64
+	var curves [3]func(float64) float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := iccXYZ(tags[name+"XYZ"])
+		if !ok {
+			return nil, false
+		}
+		for row := 0; row < 3; row++ {
+			m[row][c] = xyz[row]
+		}
+		if curves[c], ok = iccCurve(tags[name+"TRC"]); !ok {
+			return nil, false
+		}
+	}
+
+	if isSRGB(m, curves) {
+		return nil, false
+	}
+	inv, ok := invert3(srgbD50)
+	if !ok {
+		return nil, false
+	}
+	t = &iccTransform{matrix: mul3(inv, m)}
+	for c := range curves {
+		for v := 0; v < 256; v++ {
+			t.linear[c][v] = curves[c](float64(v) / 255)
+		}
+	}
+	return t, true
+}
+
+// isSRGB reports whether colorants m and curves match sRGB within
+// iccTolerance.
+func isSRGB(m [3][3]float64, curves [3]func(float64) float64) bool {
+	for r := range m {
+		for c := range m[r] {
+			if math.Abs(m[r][c]-srgbD50[r][c]) > iccTolerance {
+				return false
+			}
+		}
+	}
+	for _, f := range curves {
+		for v := 0.0; v <= 1; v += 1.0 / 16 {
+			if math.Abs(f(v)-srgbToLinear(v)) > iccTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// iccXYZ decodes an XYZType tag: one s15Fixed16 X, Y, Z triple.
+func iccXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// iccCurve decodes a curveType or parametricCurveType tag into the function
+// from encoded to linear values, both in [0, 1].
+func iccCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			g := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case n < 2 || n > (len(tag)-12)/2:
+			return nil, false
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 0xffff
+		}
+		return func(x float64) float64 {
+			pos := math.Min(math.Max(x, 0), 1) * float64(n-1)
+			i := min(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, true
+	case "para":
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if fn >= len(counts) || len(tag) < 12+4*counts[fn] {
+			return nil, false
+		}
+		// g, a, b, c, d, e, f; missing ones keep the values that reduce
+		// the general form to the simpler ones
+		v := [7]float64{1, 1, 0, 0, math.Inf(-1), 0, 0}
+		for i := 0; i < counts[fn]; i++ {
+			v[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		switch fn {
+		case 1, 2:
+			// Below -b/a the curve is flat at c (0 for type 1)
+			if a == 0 {
+				return nil, false
+			}
+			d, e, f = -b/a, c, c
+			c = 0
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				return math.Pow(math.Max(a*x+b, 0), g) + e
+			}
+			return c*x + f
+		}, true
+	}
+	return nil, false
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// apply converts img's colours, with alpha kept straight, returning an
+// NRGBA image. Colours outside sRGB are clipped.
+func (t *iccTransform) apply(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	var encode [4096]uint8
+	for i := range encode {
+		encode[i] = uint8(linearToSRGB(float64(i)/4095)*255 + 0.5)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			in := [3]float64{t.linear[0][c.R], t.linear[1][c.G], t.linear[2][c.B]}
+			var rgb [3]uint8
+			for r := range rgb {
+				l := t.matrix[r][0]*in[0] + t.matrix[r][1]*in[1] + t.matrix[r][2]*in[2]
+				rgb[r] = encode[int(math.Min(math.Max(l, 0), 1)*4095+0.5)]
+			}
+			out.SetNRGBA(x-b.Min.X, y-b.Min.Y, color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: c.A})
+		}
+	}
+	return out
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				m[r][c] += a[r][k] * b[k][c]
+			}
+		}
+	}
+	return m
+}
+
+func invert3(m [3][3]float64) ([3][3]float64, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return [3][3]float64{}, false
+	}
+	var inv [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			// Cofactor of (c, r), which transposes the adjugate
+			r1, r2 := (c+1)%3, (c+2)%3
+			c1, c2 := (r+1)%3, (r+2)%3
+			inv[r][c] = (m[r1][c1]*m[r2][c2] - m[r1][c2]*m[r2][c1]) / det
+		}
+	}
+	return inv, true
+}
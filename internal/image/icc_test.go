@@ -0,0 +1,223 @@
+package image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// testICC builds an ICC profile of colour space space ("RGB ", "CMYK")
+// holding tags.
+func testICC(space string, tags map[string][]byte) []byte {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	p := make([]byte, 132+12*len(names))
+	copy(p[16:], space)
+	copy(p[20:], "XYZ ")
+	copy(p[36:], "acsp")
+	binary.BigEndian.PutUint32(p[128:], uint32(len(names)))
+	for i, name := range names {
+		e := p[132+12*i:]
+		copy(e, name)
+		binary.BigEndian.PutUint32(e[4:], uint32(len(p)))
+		binary.BigEndian.PutUint32(e[8:], uint32(len(tags[name])))
+		p = append(p, tags[name]...)
+		for len(p)%4 != 0 {
+			p = append(p, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(p, uint32(len(p)))
+	return p
+}
+
+func s15(v float64) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+}
+
+func xyzTag(x, y, z float64) []byte {
+	t := append([]byte("XYZ \x00\x00\x00\x00"), s15(x)...)
+	return append(append(t, s15(y)...), s15(z)...)
+}
+
+// srgbCurveTag is the sRGB transfer function as a type 3 parametric curve.
+func srgbCurveTag() []byte {
+	t := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		t = append(t, s15(v)...)
+	}
+	return t
+}
+
+// rgbProfile returns an RGB profile with the given colorant columns and one
+// curve for all channels.
+func rgbProfile(m [3][3]float64, curve []byte) []byte {
+	tags := map[string][]byte{}
+	for c, name := range []string{"r", "g", "b"} {
+		tags[name+"XYZ"] = xyzTag(m[0][c], m[1][c], m[2][c])
+		tags[name+"TRC"] = curve
+	}
+	return testICC("RGB ", tags)
+}
+
+// displayP3D50 are the Display P3 colorants adapted to D50, as in Apple's
+// Display P3 profile.
+var displayP3D50 = [3][3]float64{
+	{0.515102, 0.291965, 0.157153},
+	{0.241182, 0.692236, 0.066582},
+	{-0.001050, 0.041883, 0.784073},
+}
+
+func solidNRGBA(c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// pngWithICC encodes img as a PNG carrying profile in an iCCP chunk.
+func pngWithICC(t *testing.T, img image.Image, profile []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(profile)
+	zw.Close()
+	b := buf.Bytes()
+	out := append([]byte(nil), b[:33]...) // signature and IHDR
+	out = appendPNGChunk(out, "iCCP", append([]byte("test\x00\x00"), z.Bytes()...))
+	return append(out, b[33:]...)
+}
+
+// jpegWithICC encodes img as a JPEG carrying profile in two APP2
+// segments, stored out of order.
+func jpegWithICC(t *testing.T, img image.Image, profile []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	half := len(profile) / 2
+	seg := func(seq byte, data []byte) []byte {
+		body := append([]byte("ICC_PROFILE\x00"), seq, 2)
+		body = append(body, data...)
+		return append([]byte{0xff, 0xe2, byte((len(body) + 2) >> 8), byte(len(body) + 2)}, body...)
+	}
+	b := buf.Bytes()
+	out := append([]byte(nil), b[:2]...)
+	out = append(out, seg(2, profile[half:])...)
+	out = append(out, seg(1, profile[:half])...)
+	return append(out, b[2:]...)
+}
+
+func TestToSRGB(t *testing.T) {
+	near := func(got color.NRGBA, want [3]float64) bool {
+		return math.Abs(float64(got.R)-want[0]) <= 2 && math.Abs(float64(got.G)-want[1]) <= 2 && math.Abs(float64(got.B)-want[2]) <= 2
+	}
+	decode := func(t *testing.T, b []byte) color.NRGBA {
+		t.Helper()
+		img, _, err := Decode(b, "", "", 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return color.NRGBAModel.Convert(img.At(1, 1)).(color.NRGBA)
+	}
+
+	t.Run("linear sRGB in PNG", func(t *testing.T) {
+		identity := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00")
+		src := color.NRGBA{R: 128, G: 64, B: 255, A: 200}
+		got := decode(t, pngWithICC(t, solidNRGBA(src), rgbProfile(srgbD50, identity)))
+		var want [3]float64
+		for i, v := range []uint8{src.R, src.G, src.B} {
+			want[i] = linearToSRGB(float64(v)/255) * 255
+		}
+		if !near(got, want) || got.A != src.A {
+			t.Errorf("pixel = %v, want %.0f alpha %d", got, want, src.A)
+		}
+	})
+
+	t.Run("Display P3 in JPEG", func(t *testing.T) {
+		// Linear P3 to linear sRGB, both D65, independent of the D50
+		// colorants above
+		p3ToSRGB := [3][3]float64{
+			{1.2249, -0.2247, 0},
+			{-0.0420, 1.0419, 0},
+			{-0.0197, -0.0786, 1.0979},
+		}
+		src := color.NRGBA{R: 200, G: 150, B: 100, A: 255}
+		got := decode(t, jpegWithICC(t, solidNRGBA(src), rgbProfile(displayP3D50, srgbCurveTag())))
+		in := [3]float64{srgbToLinear(200.0 / 255), srgbToLinear(150.0 / 255), srgbToLinear(100.0 / 255)}
+		var want [3]float64
+		for r := range want {
+			l := p3ToSRGB[r][0]*in[0] + p3ToSRGB[r][1]*in[1] + p3ToSRGB[r][2]*in[2]
+			want[r] = linearToSRGB(math.Min(math.Max(l, 0), 1)) * 255
+		}
+		if !near(got, want) {
+			t.Errorf("pixel = %v, want %.0f", got, want)
+		}
+	})
+
+	t.Run("left alone", func(t *testing.T) {
+		src := color.NRGBA{R: 200, G: 150, B: 100, A: 255}
+		for name, profile := range map[string][]byte{
+			"sRGB": rgbProfile(srgbD50, srgbCurveTag()),
+			"CMYK": testICC("CMYK", map[string][]byte{"A2B0": {0, 0, 0, 0}}),
+			"LUT":  testICC("RGB ", map[string][]byte{"A2B0": {0, 0, 0, 0}}),
+		} {
+			if _, ok := parseICC(profile); ok {
+				t.Errorf("%s: parsed for conversion", name)
+			}
+			if got := decode(t, pngWithICC(t, solidNRGBA(src), profile)); got != src {
+				t.Errorf("%s: pixel = %v, want %v", name, got, src)
+			}
+		}
+	})
+}
+
+func TestEmbeddedICC(t *testing.T) {
+	profile := rgbProfile(displayP3D50, srgbCurveTag())
+
+	chunk := func(fourCC string, data []byte) []byte {
+		c := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBP"), chunk("VP8X", make([]byte, 10))...)
+	webp = append(webp, chunk("ICCP", profile)...)
+	webp = append(webp, chunk("VP8L", []byte{0x2f})...)
+
+	box := func(typ string, body ...[]byte) []byte {
+		b := []byte("\x00\x00\x00\x00" + typ)
+		for _, p := range body {
+			b = append(b, p...)
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)))
+		return b
+	}
+	avif := append(box("ftyp", []byte("avif\x00\x00\x00\x00")),
+		box("meta", []byte{0, 0, 0, 0}, box("hdlr", make([]byte, 12)),
+			box("iprp", box("ipco", box("ispe", make([]byte, 12)), box("colr", []byte("nclx\x00\x01\x00\x0d\x00\x06\x80")), box("colr", []byte("prof"), profile))))...)
+
+	for name, b := range map[string][]byte{"webp": webp, "avif": avif} {
+		if got := embeddedICC(b); !bytes.Equal(got, profile) {
+			t.Errorf("%s: profile not found (%d bytes)", name, len(got))
+		}
+	}
+	if got := embeddedICC(avif[:len(avif)-10]); got != nil {
+		t.Errorf("truncated avif: %d bytes", len(got))
+	}
+}
@@ -0,0 +1,139 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// decodeICOBMP decodes a BMP entry of an ICO: a BITMAPINFOHEADER whose
+// height counts the colour (XOR) bitmap and the 1-bit AND mask together,
+// an optional palette, the bottom-up colour rows, then the mask rows, in
+// which a set bit marks a transparent pixel.
+//
+// 32-bit entries carry their own alpha; when every alpha byte is zero, as
+// in icons written before alpha was used, the AND mask decides instead.
+// Other depths (1, 4, 8, 16 and 24 bits) always take their transparency
+// from the mask.
+func decodeICOBMP(b []byte) (image.Image, error) {
+	if len(b) < 40 {
+		return nil, errors.New("ico bmp: header too small")
+	}
+	hdrSize := int(binary.LittleEndian.Uint32(b[0:]))
+	w := int(int32(binary.LittleEndian.Uint32(b[4:])))
+	h2 := int(int32(binary.LittleEndian.Uint32(b[8:])))
+	bpp := int(binary.LittleEndian.Uint16(b[14:]))
+	compression := binary.LittleEndian.Uint32(b[16:])
+	clrUsed := int(binary.LittleEndian.Uint32(b[32:]))
+	if hdrSize < 40 || hdrSize > len(b) {
+		return nil, fmt.Errorf("ico bmp: bad header size %d", hdrSize)
+	}
+	// BI_BITFIELDS is only accepted with the default masks 32-bit entries use
+	if compression != 0 && !(compression == 3 && bpp == 32) {
+		return nil, fmt.Errorf("ico bmp: unsupported compression %d", compression)
+	}
+	topDown := h2 < 0
+	if topDown {
+		h2 = -h2
+	}
+	h := h2 / 2
+	if w <= 0 || h <= 0 || w > 256 || h > 256 {
+		return nil, fmt.Errorf("ico bmp: bad dimensions %dx%d", w, h2)
+	}
+
+	off := hdrSize
+	if compression == 3 && hdrSize == 40 {
+		off += 12 // colour masks follow a plain BITMAPINFOHEADER
+	}
+	var palette []color.NRGBA
+	switch bpp {
+	case 1, 4, 8:
+		n := clrUsed
+		if n <= 0 || n > 1<<bpp {
+			n = 1 << bpp
+		}
+		if off+4*n > len(b) {
+			return nil, errors.New("ico bmp: truncated palette")
+		}
+		palette = make([]color.NRGBA, n)
+		for i := range palette {
+			p := b[off+4*i:]
+			palette[i] = color.NRGBA{R: p[2], G: p[1], B: p[0], A: 255}
+		}
+		off += 4 * n
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("ico bmp: unsupported bit depth %d", bpp)
+	}
+
+	stride := (w*bpp + 31) / 32 * 4
+	if off+stride*h > len(b) {
+		return nil, errors.New("ico bmp: truncated pixel data")
+	}
+	pixels := b[off : off+stride*h]
+	maskStride := (w + 31) / 32 * 4
+	var mask []byte
+	// Some writers leave the mask out; the icon is then opaque
+	if m := off + stride*h; m+maskStride*h <= len(b) {
+		mask = b[m : m+maskStride*h]
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	hasAlpha := false
+	for y := 0; y < h; y++ {
+		row := h - 1 - y
+		if topDown {
+			row = y
+		}
+		src := pixels[row*stride:]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				idx := int(src[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if idx < len(palette) {
+					c = palette[idx]
+				}
+			case 16:
+				v := binary.LittleEndian.Uint16(src[2*x:])
+				c = color.NRGBA{R: expand5(v >> 10), G: expand5(v >> 5), B: expand5(v), A: 255}
+			case 24:
+				p := src[3*x:]
+				c = color.NRGBA{R: p[2], G: p[1], B: p[0], A: 255}
+			case 32:
+				p := src[4*x:]
+				c = color.NRGBA{R: p[2], G: p[1], B: p[0], A: p[3]}
+				hasAlpha = hasAlpha || p[3] != 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	if bpp == 32 && hasAlpha {
+		return img, nil
+	}
+	for y := 0; y < h; y++ {
+		row := h - 1 - y
+		if topDown {
+			row = y
+		}
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			if mask != nil && mask[row*maskStride+x/8]&(0x80>>(x%8)) != 0 {
+				img.Pix[i+3] = 0
+			} else {
+				img.Pix[i+3] = 255
+			}
+		}
+	}
+	return img, nil
+}
+
+// expand5 widens the low 5 bits of v to 8 bits.
+func expand5(v uint16) uint8 {
+	v &= 0x1f
+	return uint8(v<<3 | v>>2)
+}
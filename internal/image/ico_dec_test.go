@@ -0,0 +1,178 @@
+package image
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testICOBMP builds an ICO BMP entry of w×h pixels at bpp bits, with
+// pixel(x, y) giving each pixel's raw value (a palette index or packed
+// BGR(A)) and transparent(x, y) its AND mask bit. A nil transparent
+// leaves the mask out.
+func testICOBMP(w, h, bpp int, palette []color.NRGBA, pixel func(x, y int) uint32, transparent func(x, y int) bool) []byte {
+	out := make([]byte, 40)
+	binary.LittleEndian.PutUint32(out[0:], 40)
+	binary.LittleEndian.PutUint32(out[4:], uint32(w))
+	binary.LittleEndian.PutUint32(out[8:], uint32(2*h))
+	binary.LittleEndian.PutUint16(out[12:], 1)
+	binary.LittleEndian.PutUint16(out[14:], uint16(bpp))
+	binary.LittleEndian.PutUint32(out[32:], uint32(len(palette)))
+	for _, c := range palette {
+		out = append(out, c.B, c.G, c.R, 0)
+	}
+	stride := (w*bpp + 31) / 32 * 4
+	for y := h - 1; y >= 0; y-- {
+		row := make([]byte, stride)
+		for x := 0; x < w; x++ {
+			v := pixel(x, y)
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				row[bit/8] |= byte(v) << (8 - bpp - bit%8)
+			case 24:
+				row[3*x], row[3*x+1], row[3*x+2] = byte(v), byte(v>>8), byte(v>>16)
+			case 32:
+				binary.LittleEndian.PutUint32(row[4*x:], v)
+			}
+		}
+		out = append(out, row...)
+	}
+	if transparent == nil {
+		return out
+	}
+	maskStride := (w + 31) / 32 * 4
+	for y := h - 1; y >= 0; y-- {
+		row := make([]byte, maskStride)
+		for x := 0; x < w; x++ {
+			if transparent(x, y) {
+				row[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		out = append(out, row...)
+	}
+	return out
+}
+
+// testICO wraps one BMP entry in an ICO container.
+func testICO(w, h, bpp int, entry []byte) []byte {
+	out := make([]byte, 6+16)
+	binary.LittleEndian.PutUint16(out[2:], 1)
+	binary.LittleEndian.PutUint16(out[4:], 1)
+	out[6], out[7] = byte(w), byte(h)
+	binary.LittleEndian.PutUint16(out[6+6:], uint16(bpp))
+	binary.LittleEndian.PutUint32(out[6+8:], uint32(len(entry)))
+	binary.LittleEndian.PutUint32(out[6+12:], 22)
+	return append(out, entry...)
+}
+
+func TestDecodeICOBMPMask(t *testing.T) {
+	leftHalf := func(x, _ int) bool { return x < 8 }
+	red, blue := color.NRGBA{R: 220, A: 255}, color.NRGBA{B: 220, A: 255}
+	// Top row blue, the rest red
+	topBlue := func(_, y int) bool { return y == 0 }
+
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"32-bit without alpha", testICOBMP(16, 16, 32, nil, func(_, y int) uint32 {
+			if topBlue(0, y) {
+				return 220
+			}
+			return 220 << 16
+		}, leftHalf)},
+		{"24-bit", testICOBMP(16, 16, 24, nil, func(_, y int) uint32 {
+			if topBlue(0, y) {
+				return 220
+			}
+			return 220 << 16
+		}, leftHalf)},
+		{"8-bit", testICOBMP(16, 16, 8, []color.NRGBA{red, blue}, func(_, y int) uint32 {
+			if topBlue(0, y) {
+				return 1
+			}
+			return 0
+		}, leftHalf)},
+		{"4-bit", testICOBMP(16, 16, 4, []color.NRGBA{{}, red, blue}, func(_, y int) uint32 {
+			if topBlue(0, y) {
+				return 2
+			}
+			return 1
+		}, leftHalf)},
+		{"1-bit", testICOBMP(16, 16, 1, []color.NRGBA{red, blue}, func(_, y int) uint32 {
+			if topBlue(0, y) {
+				return 1
+			}
+			return 0
+		}, leftHalf)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := decodeICOBMP(tt.entry)
+			if err != nil {
+				t.Fatalf("decodeICOBMP() error = %v", err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 16, 16) {
+				t.Fatalf("bounds = %v, want 16x16 (height not halved?)", img.Bounds())
+			}
+			for _, c := range []struct {
+				x, y int
+				want color.NRGBA
+			}{{12, 0, blue}, {12, 8, red}, {15, 15, red}} {
+				if got := img.At(c.x, c.y).(color.NRGBA); got != c.want {
+					t.Errorf("pixel (%d,%d) = %v, want %v", c.x, c.y, got, c.want)
+				}
+			}
+			if a := img.At(3, 8).(color.NRGBA).A; a != 0 {
+				t.Errorf("masked pixel alpha = %d, want 0", a)
+			}
+		})
+	}
+}
+
+func TestDecodeICOBMPAlpha(t *testing.T) {
+	// With an alpha channel the mask is ignored, whatever it says
+	entry := testICOBMP(16, 16, 32, nil, func(x, _ int) uint32 {
+		return uint32(x*16)<<24 | 200<<8
+	}, func(int, int) bool { return true })
+	img, err := decodeICOBMP(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.At(8, 4).(color.NRGBA); got != (color.NRGBA{G: 200, A: 128}) {
+		t.Errorf("pixel = %v, want alpha from the channel", got)
+	}
+
+	// Without a mask, masked depths are opaque
+	entry = testICOBMP(16, 16, 24, nil, func(int, int) uint32 { return 200 << 8 }, nil)
+	if img, err := decodeICOBMP(entry); err != nil || img.At(0, 0).(color.NRGBA).A != 255 {
+		t.Errorf("maskless entry: err %v", err)
+	}
+
+	if _, err := decodeICOBMP(entry[:60]); err == nil {
+		t.Error("decodeICOBMP() accepted truncated pixel data")
+	}
+}
+
+func TestDecodeICOSelectLargestMaskedBMP(t *testing.T) {
+	// A classic icon: opaque colours on black, transparency in the mask only
+	circle := func(x, y int) bool { return (x-8)*(x-8)+(y-8)*(y-8) > 36 }
+	entry := testICOBMP(16, 16, 32, nil, func(x, y int) uint32 {
+		if circle(x, y) {
+			return 0
+		}
+		return 200 << 16
+	}, circle)
+	img, err := DecodeICOSelectLargest(testICO(16, 16, 32, entry))
+	if err != nil {
+		t.Fatalf("DecodeICOSelectLargest() error = %v", err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA); c.A != 0 {
+		t.Errorf("corner = %v, want transparent rather than black", c)
+	}
+	if c := color.NRGBAModel.Convert(img.At(8, 8)).(color.NRGBA); c != (color.NRGBA{R: 200, A: 255}) {
+		t.Errorf("centre = %v, want opaque red", c)
+	}
+}
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+)
+
+// icoPNGMinSize is the entry size from which ICO entries embed PNG data.
+// Smaller entries are 32-bit BMPs, the only form pre-Vista loaders and many
+// desktop toolkits read; they cover the classic 16, 24, 32 and 48 px sizes.
+const icoPNGMinSize = 64
+
+// icoMaxSize is the largest width or height an ICO entry can describe.
+const icoMaxSize = 256
+
+// EncodeICO writes imgs as the entries of one ICO file, in the given order.
+// Entries of icoPNGMinSize pixels or more are stored as PNG, smaller ones as
+// 32-bit BMP with an AND mask. Every image must fit within 256x256.
+func EncodeICO(imgs ...image.Image) ([]byte, error) {
+	if len(imgs) == 0 {
+		return nil, errors.New("ico: no images")
+	}
+	entries := make([][]byte, len(imgs))
+	for i, img := range imgs {
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		if w < 1 || h < 1 || w > icoMaxSize || h > icoMaxSize {
+			return nil, errors.New("ico: invalid entry size " + strconv.Itoa(w) + "x" + strconv.Itoa(h))
+		}
+		if max(w, h) >= icoPNGMinSize {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return nil, err
+			}
+			entries[i] = buf.Bytes()
+		} else {
+			entries[i] = icoBMP(img)
+		}
+	}
+
+	// ICONDIR, then one ICONDIRENTRY per image, then the image data
+	out := make([]byte, 6, 6+16*len(imgs))
+	binary.LittleEndian.PutUint16(out[2:], 1)
+	binary.LittleEndian.PutUint16(out[4:], uint16(len(imgs)))
+	offset := 6 + 16*len(imgs)
+	for i, img := range imgs {
+		var e [16]byte
+		e[0] = byte(img.Bounds().Dx()) // 256 wraps to 0, as the format requires
+		e[1] = byte(img.Bounds().Dy())
+		binary.LittleEndian.PutUint16(e[4:], 1)  // colour planes
+		binary.LittleEndian.PutUint16(e[6:], 32) // bits per pixel
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(entries[i])))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		out = append(out, e[:]...)
+		offset += len(entries[i])
+	}
+	for _, data := range entries {
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// icoBMP encodes img as an ICO BMP entry: a BITMAPINFOHEADER declaring twice
+// the height, bottom-up BGRA rows, then a 1-bit AND mask marking fully
+// transparent pixels for loaders that ignore the alpha channel.
+func icoBMP(img image.Image) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	maskStride := (w + 31) / 32 * 4
+	out := make([]byte, 40, 40+w*h*4+maskStride*h)
+	binary.LittleEndian.PutUint32(out[0:], 40)
+	binary.LittleEndian.PutUint32(out[4:], uint32(w))
+	binary.LittleEndian.PutUint32(out[8:], uint32(2*h))
+	binary.LittleEndian.PutUint16(out[12:], 1)
+	binary.LittleEndian.PutUint16(out[14:], 32)
+	binary.LittleEndian.PutUint32(out[20:], uint32(w*h*4+maskStride*h))
+
+	mask := make([]byte, maskStride*h)
+	for y := h - 1; y >= 0; y-- {
+		row := (h - 1 - y) * maskStride
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			out = append(out, c.B, c.G, c.R, c.A)
+			if c.A == 0 {
+				mask[row+x/8] |= 0x80 >> (x % 8)
+			}
+		}
+	}
+	return append(out, mask...)
+}
+
+type icoEncoder struct{}
+
+func (icoEncoder) Name() string        { return "ico" }
+func (icoEncoder) ContentType() string { return "image/x-icon" }
+func (icoEncoder) Available() bool     { return true }
+
+func (icoEncoder) Encode(img image.Image) ([]byte, error) {
+	return EncodeICO(img)
+}
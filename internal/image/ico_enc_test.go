@@ -0,0 +1,68 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	ico "github.com/sergeymakinen/go-ico"
+)
+
+func TestEncodeICO(t *testing.T) {
+	var imgs []image.Image
+	for _, size := range []int{16, 48, 64, 256} {
+		img := image.NewNRGBA(image.Rect(0, 0, size, size))
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: uint8(x * 255 / (size - 1))})
+			}
+		}
+		imgs = append(imgs, img)
+	}
+
+	b, err := EncodeICO(imgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.LittleEndian.Uint16(b[4:]); n != 4 {
+		t.Fatalf("entry count = %d, want 4", n)
+	}
+	for i, wantPNG := range []bool{false, false, true, true} {
+		e := b[6+16*i:]
+		if w := int(e[0]); w != imgs[i].Bounds().Dx()%256 {
+			t.Errorf("entry %d width byte = %d", i, w)
+		}
+		data := b[binary.LittleEndian.Uint32(e[12:]):]
+		if isPNG := bytes.HasPrefix(data, pngSignature); isPNG != wantPNG {
+			t.Errorf("entry %d PNG = %v, want %v", i, isPNG, wantPNG)
+		}
+	}
+
+	decoded, err := ico.DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("ICO does not decode: %v", err)
+	}
+	for i, got := range decoded {
+		want := imgs[i]
+		if got.Bounds() != want.Bounds() {
+			t.Errorf("entry %d bounds = %v, want %v", i, got.Bounds(), want.Bounds())
+			continue
+		}
+		for _, p := range []image.Point{{0, 0}, {5, 9}, {15, 15}} {
+			g := color.NRGBAModel.Convert(got.At(p.X, p.Y)).(color.NRGBA)
+			w := want.At(p.X, p.Y).(color.NRGBA)
+			if g.A != w.A || (w.A == 255 && g != w) {
+				t.Errorf("entry %d pixel %v = %v, want %v", i, p, g, w)
+			}
+		}
+	}
+
+	if _, err := EncodeICO(image.NewNRGBA(image.Rect(0, 0, 300, 300))); err == nil {
+		t.Error("EncodeICO accepted a 300px image")
+	}
+	if _, ct := EncodeByFormat(imgs[0], "ico", 0); ct != "image/x-icon" {
+		t.Errorf("EncodeByFormat(ico) content type = %s", ct)
+	}
+}
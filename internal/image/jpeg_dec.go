@@ -0,0 +1,115 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// maxJPEGPad caps the zero padding repairJPEG appends to a truncated scan.
+const maxJPEGPad = 16 << 20
+
+// adobeCMYK is an APP14 "Adobe" segment declaring untransformed CMYK.
+var adobeCMYK = []byte{0xff, 0xee, 0, 14, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0}
+
+// decodeJPEG decodes a JPEG with image/jpeg and, when that fails, gives a
+// repaired copy (see repairJPEG) a second chance. CMYK images come out
+// converted to RGB so later processing sees the colours they show.
+func decodeJPEG(b []byte, _ int) (image.Image, error) {
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		fixed, plainCMYK, ok := repairJPEG(b)
+		if !ok {
+			return nil, err
+		}
+		img2, err2 := jpeg.Decode(bytes.NewReader(fixed))
+		if err2 != nil {
+			return nil, err
+		}
+		img = img2
+		if c, ok := img.(*image.CMYK); ok && plainCMYK {
+			// image/jpeg reads the Adobe segment as inverted CMYK
+			for i, v := range c.Pix {
+				c.Pix[i] = 255 - v
+			}
+		}
+	}
+	if c, ok := img.(*image.CMYK); ok {
+		rgba := image.NewRGBA(c.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), c, c.Bounds().Min, draw.Src)
+		return rgba, nil
+	}
+	return img, nil
+}
+
+// repairJPEG fixes the damage image/jpeg rejects but other decoders shrug
+// off, and reports whether it changed anything:
+//   - bytes before the SOI marker (within the first KiB) are dropped
+//   - a 4-component image without Adobe APP14 metadata gets a segment
+//     declaring plain CMYK; plainCMYK is then set, as such files store
+//     ink amounts uninverted
+//   - a file truncated in its scan data, or missing only the EOI marker,
+//     gets its scan padded with zero bits and an EOI, so the part that
+//     arrived decodes
+//
+// Damage in the headers before the first scan is not repaired.
+func repairJPEG(b []byte) (fixed []byte, plainCMYK, ok bool) {
+	start := bytes.Index(b[:min(len(b), 1024)], []byte{0xff, 0xd8, 0xff})
+	if start < 0 {
+		return nil, false, false
+	}
+	b = b[start:]
+	changed := start > 0
+
+	var w, h, ncomp int
+	adobe := false
+	sos := -1
+	for i := 2; sos < 0; {
+		if i+4 > len(b) || b[i] != 0xff {
+			return nil, false, false
+		}
+		m := b[i+1]
+		switch {
+		case m == 0xff: // fill byte
+			i++
+			continue
+		case m == 0x01 || m >= 0xd0 && m <= 0xd7: // TEM, RSTn: no length
+			i += 2
+			continue
+		}
+		n := int(b[i+2])<<8 | int(b[i+3])
+		if n < 2 || i+2+n > len(b) {
+			return nil, false, false
+		}
+		seg := b[i+4 : i+2+n]
+		switch {
+		case m >= 0xc0 && m <= 0xc2 && len(seg) >= 6:
+			h, w, ncomp = int(seg[1])<<8|int(seg[2]), int(seg[3])<<8|int(seg[4]), int(seg[5])
+		case m == 0xee && bytes.HasPrefix(seg, []byte("Adobe")):
+			adobe = true
+		case m == 0xda:
+			sos = i
+		}
+		i += 2 + n
+	}
+	if w == 0 || h == 0 || checkPixels(w, h) != nil {
+		return nil, false, false
+	}
+
+	out := make([]byte, 0, len(b)+len(adobeCMYK)+2)
+	out = append(out, b[:2]...)
+	if ncomp == 4 && !adobe {
+		out = append(out, adobeCMYK...)
+		plainCMYK, changed = true, true
+	}
+	out = append(out, b[2:]...)
+	// Entropy-coded data stuffs every 0xff, so an EOI after the first scan
+	// is the real one
+	if !bytes.Contains(b[sos:], []byte{0xff, 0xd9}) {
+		out = append(out, make([]byte, min(w*h*ncomp/2+1024, maxJPEGPad))...)
+		out = append(out, 0xff, 0xd9)
+		changed = true
+	}
+	return out, plainCMYK, changed
+}
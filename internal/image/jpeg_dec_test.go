@@ -0,0 +1,151 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/bits"
+	"testing"
+)
+
+// testCMYKJPEG returns an 8×8 baseline JPEG of four components filled with
+// the stored values c, m, y and k, with Adobe APP14 metadata (which makes
+// them inverted ink amounts) or without. Blocks are DC only, with a DC
+// Huffman code of 4 bits per category and EOB as the only AC code.
+func testCMYKJPEG(stored [4]uint8, adobe bool) []byte {
+	out := []byte{0xff, 0xd8}
+	if adobe {
+		out = append(out, adobeCMYK...)
+	}
+	out = append(out, 0xff, 0xdb, 0, 67, 0)
+	out = append(out, bytes.Repeat([]byte{1}, 64)...)
+	out = append(out, 0xff, 0xc0, 0, 20, 8, 0, 8, 0, 8, 4)
+	for i := byte(1); i <= 4; i++ {
+		out = append(out, i, 0x11, 0)
+	}
+	out = append(out, 0xff, 0xc4, 0, 31, 0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	out = append(out, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	out = append(out, 0xff, 0xc4, 0, 20, 0x10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00)
+	out = append(out, 0xff, 0xda, 0, 14, 4)
+	for i := byte(1); i <= 4; i++ {
+		out = append(out, i, 0x00)
+	}
+	out = append(out, 0, 63, 0)
+
+	var acc uint64
+	var n uint
+	put := func(v uint64, width uint) { acc, n = acc<<width|v, n+width }
+	for _, v := range stored {
+		dc := (int(v) - 128) * 8
+		mag := dc
+		if mag < 0 {
+			mag = -mag
+		}
+		cat := uint(bits.Len(uint(mag)))
+		put(uint64(cat), 4)
+		if dc < 0 {
+			dc += 1<<cat - 1
+		}
+		put(uint64(dc), cat)
+		put(0, 1) // EOB
+	}
+	for n%8 != 0 {
+		put(1, 1)
+	}
+	for n > 0 {
+		n -= 8
+		c := byte(acc >> n)
+		out = append(out, c)
+		if c == 0xff {
+			out = append(out, 0)
+		}
+	}
+	return append(out, 0xff, 0xd9)
+}
+
+func testGradientJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 100, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeJPEGCMYK(t *testing.T) {
+	stored := [4]uint8{200, 40, 90, 230}
+	near := func(a, b uint8) bool { return a-b+2 <= 4 }
+	for _, tt := range []struct {
+		name  string
+		adobe bool
+		ink   color.CMYK
+	}{
+		{"adobe", true, color.CMYK{C: 255 - stored[0], M: 255 - stored[1], Y: 255 - stored[2], K: 255 - stored[3]}},
+		{"no adobe", false, color.CMYK{C: stored[0], M: stored[1], Y: stored[2], K: stored[3]}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testCMYKJPEG(stored, tt.adobe)
+			// image/jpeg reads Adobe CMYK but rejects CMYK without metadata
+			if _, err := jpeg.Decode(bytes.NewReader(data)); (err == nil) != tt.adobe {
+				t.Fatalf("image/jpeg on the test image: error = %v", err)
+			}
+			img, err := decodeJPEG(data, 0)
+			if err != nil {
+				t.Fatalf("decodeJPEG() error = %v", err)
+			}
+			if _, ok := img.(*image.RGBA); !ok {
+				t.Errorf("decoded %T, want RGB", img)
+			}
+			got := color.RGBAModel.Convert(img.At(4, 4)).(color.RGBA)
+			want := color.RGBAModel.Convert(tt.ink).(color.RGBA)
+			if !near(got.R, want.R) || !near(got.G, want.G) || !near(got.B, want.B) || got.A != 255 {
+				t.Errorf("pixel = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeJPEGRepair(t *testing.T) {
+	good := testGradientJPEG(t)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"missing EOI", good[:len(good)-2]},
+		{"truncated scan", good[:len(good)*9/10]},
+		{"leading garbage", append([]byte("\xef\xbb\xbf\n\n"), good...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := jpeg.Decode(bytes.NewReader(tt.data)); err == nil {
+				t.Fatal("image/jpeg accepts the damaged file; the case tests nothing")
+			}
+			img, err := decodeJPEG(tt.data, 0)
+			if err != nil {
+				t.Fatalf("decodeJPEG() error = %v", err)
+			}
+			if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+				t.Fatalf("bounds = %v", img.Bounds())
+			}
+			// The top of the image arrived intact
+			r, g, _, _ := img.At(40, 4).RGBA()
+			if r>>8 < 140 || r>>8 > 180 || g>>8 > 40 {
+				t.Errorf("pixel (40,4) = %v, want the gradient", img.At(40, 4))
+			}
+		})
+	}
+
+	if _, err := decodeJPEG(good[:40], 0); err == nil {
+		t.Error("decodeJPEG() accepted a file cut inside its headers")
+	}
+	if _, err := decodeJPEG([]byte("not a jpeg at all"), 0); err == nil {
+		t.Error("decodeJPEG() accepted garbage")
+	}
+}
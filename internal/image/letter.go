@@ -0,0 +1,261 @@
+package image
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Fallback styles: the globe drawn by CreateFallbackImage, or a letter tile
+// drawn by CreateLetterTile.
+const (
+	FallbackGlobe  = "globe"
+	FallbackLetter = "letter"
+)
+
+// tileScale is the letter's em size relative to the tile's edge.
+const tileScale = 0.6
+
+// tilePalette holds the tile background colours, all dark enough for a
+// white letter. A host always gets the same one.
+var tilePalette = []color.NRGBA{
+	{R: 0xc6, G: 0x28, B: 0x28, A: 0xff}, // red
+	{R: 0xad, G: 0x14, B: 0x57, A: 0xff}, // pink
+	{R: 0x6a, G: 0x1b, B: 0x9a, A: 0xff}, // purple
+	{R: 0x45, G: 0x27, B: 0xa0, A: 0xff}, // deep purple
+	{R: 0x28, G: 0x35, B: 0x93, A: 0xff}, // indigo
+	{R: 0x15, G: 0x65, B: 0xc0, A: 0xff}, // blue
+	{R: 0x00, G: 0x83, B: 0x8f, A: 0xff}, // cyan
+	{R: 0x00, G: 0x69, B: 0x5c, A: 0xff}, // teal
+	{R: 0x2e, G: 0x7d, B: 0x32, A: 0xff}, // green
+	{R: 0xbf, G: 0x36, B: 0x0c, A: 0xff}, // deep orange
+	{R: 0x4e, G: 0x34, B: 0x2e, A: 0xff}, // brown
+	{R: 0x37, G: 0x47, B: 0x4f, A: 0xff}, // blue grey
+}
+
+var (
+	tileFontsMu   sync.Mutex
+	tileFonts     []*sfnt.Font
+	tileFontsOnce sync.Once
+)
+
+// LoadTileFont adds the TrueType or OpenType font at path to the fonts
+// letter tiles are drawn with. The bundled Go Bold covers Latin, Greek and
+// Cyrillic; fonts added here are tried in order for initials it lacks,
+// such as CJK characters or emoji (outline fonts only, e.g. Noto Emoji).
+func LoadTileFont(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	loadTileFonts()
+	tileFontsMu.Lock()
+	tileFonts = append(tileFonts, f)
+	tileFontsMu.Unlock()
+	return nil
+}
+
+func loadTileFonts() []*sfnt.Font {
+	tileFontsOnce.Do(func() {
+		if f, err := opentype.Parse(gobold.TTF); err == nil {
+			tileFontsMu.Lock()
+			tileFonts = append([]*sfnt.Font{f}, tileFonts...)
+			tileFontsMu.Unlock()
+		}
+	})
+	tileFontsMu.Lock()
+	defer tileFontsMu.Unlock()
+	return append([]*sfnt.Font(nil), tileFonts...)
+}
+
+// TileInitial returns the character a letter tile shows for host: the
+// first user-perceived character of its leading label (after "www."), in
+// Unicode rather than punycode form, compatibility-normalized as IDNA
+// lookups are and upper-cased, so "xn--mnchen-3ya.de" gives "M" and an
+// emoji domain its emoji, with any modifiers and joined sequence kept
+// together. It returns "" when there is nothing printable.
+func TileInitial(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+	if u, err := idna.Punycode.ToUnicode(host); err == nil {
+		host = u
+	}
+	host = strings.TrimPrefix(host, "www.")
+	label, _, _ := strings.Cut(host, ".")
+
+	cluster := firstCluster([]rune(norm.NFKC.String(label)))
+	if len(cluster) == 0 || !unicode.IsGraphic(cluster[0]) || unicode.Is(unicode.Mn, cluster[0]) {
+		return ""
+	}
+	// Title case turns digraphs such as "ǆ" into "ǅ" rather than "Ǆ"
+	cluster[0] = unicode.ToTitle(cluster[0])
+	return norm.NFC.String(string(cluster))
+}
+
+// firstCluster returns the leading grapheme cluster of runes: a base
+// character with its combining marks, variation selectors, emoji skin-tone
+// modifiers and tags, zero-width-joined sequences, or a regional indicator
+// pair (a flag).
+func firstCluster(runes []rune) []rune {
+	if len(runes) == 0 {
+		return nil
+	}
+	n := 1
+	if isRegionalIndicator(runes[0]) && len(runes) > 1 && isRegionalIndicator(runes[1]) {
+		n = 2
+	}
+	for n < len(runes) {
+		switch r := runes[n]; {
+		case isClusterExtender(r):
+			n++
+		case r == '\u200d' && n+1 < len(runes):
+			n += 2
+		default:
+			return runes[:n]
+		}
+	}
+	return runes[:n]
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1f1e6 && r <= 0x1f1ff }
+
+// isClusterExtender reports whether r attaches to the character before it.
+func isClusterExtender(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) ||
+		r == '\ufe0e' || r == '\ufe0f' || // variation selectors
+		(r >= 0x1f3fb && r <= 0x1f3ff) || // skin tones
+		(r >= 0xe0020 && r <= 0xe007f) || // tags
+		r == '\u20e3' // keycap
+}
+
+// CreateLetterTile draws a size x size tile for host: its initial (see
+// TileInitial) in white on a colour picked from the Unicode host name. An
+// initial no loaded font can draw leaves the tile blank.
+func CreateLetterTile(host string, size int) image.Image {
+	return CreateLetterTileWithPalette(host, size, nil)
+}
+
+// CreateLetterTileWithPalette is CreateLetterTile picking the background
+// from palette instead of the built-in colours (nil or empty = those). The
+// letter stays white, so the colours should be dark enough for it.
+func CreateLetterTileWithPalette(host string, size int, palette []color.NRGBA) image.Image {
+	if len(palette) == 0 {
+		palette = tilePalette
+	}
+	initial := TileInitial(host)
+	name := strings.ToLower(host)
+	if u, err := idna.Punycode.ToUnicode(name); err == nil {
+		name = u
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.TrimPrefix(name, "www.")))
+	bg := palette[h.Sum32()%uint32(len(palette))]
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	text, f := drawableInitial(initial)
+	if f == nil {
+		return dst
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: float64(size) * tileScale, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return dst
+	}
+	defer face.Close()
+
+	// Centre the glyphs' ink box, not the advance box, in the tile
+	d := &font.Drawer{Dst: dst, Src: image.White, Face: face}
+	bounds, _ := d.BoundString(text)
+	w, hgt := bounds.Max.X-bounds.Min.X, bounds.Max.Y-bounds.Min.Y
+	d.Dot = fixed.Point26_6{
+		X: (fixed.I(size)-w)/2 - bounds.Min.X,
+		Y: (fixed.I(size)-hgt)/2 - bounds.Min.Y,
+	}
+	d.DrawString(text)
+	return dst
+}
+
+// drawableInitial returns the text to draw for initial and the font to draw
+// it with (nil = none can). When no font has the initial, its base letter
+// without accents is tried.
+func drawableInitial(initial string) (string, *sfnt.Font) {
+	if text, f := drawableRunes(initial); f != nil {
+		return text, f
+	}
+	if base := []rune(norm.NFKD.String(initial)); len(base) > 0 && string(base[0]) != initial {
+		return drawableRunes(string(base[0]))
+	}
+	return "", nil
+}
+
+// drawableRunes returns the runes of initial a face can draw on its own,
+// without shaping: the cluster minus joiners, selectors and modifiers, which
+// would otherwise render as separate glyphs, and the first loaded font that
+// has a glyph for every one of them, or nil.
+func drawableRunes(initial string) (string, *sfnt.Font) {
+	var runes []rune
+	for i, r := range initial {
+		if r == '\u200d' || (i > 0 && !unicode.In(r, unicode.Mn, unicode.Me) && isClusterExtender(r)) {
+			continue
+		}
+		// Only the first emoji of a joined sequence can be drawn unshaped
+		if i > 0 && !unicode.In(r, unicode.Mn, unicode.Me) && !isRegionalIndicator(r) {
+			break
+		}
+		runes = append(runes, r)
+	}
+	if len(runes) == 0 {
+		return "", nil
+	}
+	var buf sfnt.Buffer
+	for _, f := range loadTileFonts() {
+		ok := true
+		for _, r := range runes {
+			if idx, err := f.GlyphIndex(&buf, r); err != nil || idx == 0 {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return string(runes), f
+		}
+	}
+	return "", nil
+}
+
+// ParsePalette parses letter-tile background colours given as hex, with or
+// without a leading #, in the 6-digit or 3-digit form.
+func ParsePalette(colours []string) ([]color.NRGBA, error) {
+	palette := make([]color.NRGBA, 0, len(colours))
+	for _, c := range colours {
+		hex := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), "#"))
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return nil, fmt.Errorf("colour %q is not #rrggbb", c)
+		}
+		palette = append(palette, color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff})
+	}
+	return palette, nil
+}
@@ -0,0 +1,80 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTileInitial(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "E"},
+		{"www.example.com", "E"},
+		{"xn--mnchen-3ya.de", "M"},
+		{"münchen.de", "M"},
+		{"xn--80ak6aa92e.com", "А"}, // Cyrillic, not Latin A
+		{"ñandu.es", "Ñ"},
+		{"n\u0303andu.es", "Ñ"}, // decomposed
+		{"ﬁsh.com", "F"},        // ligature, as IDNA maps it
+		{"1password.com", "1"},
+		{"xn--ls8h.la", "💩"},
+		{"\U0001F44B\U0001F3FD.example", "\U0001F44B\U0001F3FD"}, // skin tone kept
+		{"\U0001F468‍\U0001F4BB.example", "\U0001F468‍\U0001F4BB"},                   // joined sequence
+		{"\U0001F1E9\U0001F1EA\U0001F1EB\U0001F1F7.example", "\U0001F1E9\U0001F1EA"}, // first flag only
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := TileInitial(tt.host); got != tt.want {
+			t.Errorf("TileInitial(%q) = %q (%U), want %q", tt.host, got, []rune(got), tt.want)
+		}
+	}
+}
+
+func TestCreateLetterTile(t *testing.T) {
+	white := func(img image.Image) int {
+		n := 0
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, g, bl, _ := img.At(x, y).RGBA(); r > 0xf000 && g > 0xf000 && bl > 0xf000 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	uni, puny := CreateLetterTile("münchen.de", 64), CreateLetterTile("xn--mnchen-3ya.de", 64)
+	if uni.At(0, 0) != puny.At(0, 0) {
+		t.Errorf("Unicode and punycode forms got different colours: %v, %v", uni.At(0, 0), puny.At(0, 0))
+	}
+	if _, _, _, a := uni.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("Tile background alpha = %d, want opaque", a)
+	}
+	if n := white(uni); n < 64 {
+		t.Errorf("Letter has %d white pixels, want a drawn glyph", n)
+	}
+	// The bundled font has no emoji: a plain tile rather than a missing-glyph box
+	if n := white(CreateLetterTile("xn--ls8h.la", 64)); n != 0 {
+		t.Errorf("Emoji tile without an emoji font has %d white pixels, want none", n)
+	}
+}
+
+func TestCreateLetterTileWithPalette(t *testing.T) {
+	palette, err := ParsePalette([]string{"#123456", "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if palette[1] != (color.NRGBA{R: 0xaa, G: 0xbb, B: 0xcc, A: 0xff}) {
+		t.Errorf("short form parsed as %v", palette[1])
+	}
+	tile := CreateLetterTileWithPalette("example.com", 32, palette[:1])
+	if got := color.NRGBAModel.Convert(tile.At(0, 0)); got != palette[0] {
+		t.Errorf("background = %v, want %v", got, palette[0])
+	}
+	if _, err := ParsePalette([]string{"#12345g"}); err == nil {
+		t.Error("ParsePalette accepted a malformed colour")
+	}
+}
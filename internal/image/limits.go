@@ -0,0 +1,65 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"net/url"
+	"strings"
+)
+
+// DefaultMaxPixels is the default MaxPixels: a 4096×4096 image, 64 MiB
+// once decoded to RGBA.
+const DefaultMaxPixels = 4096 * 4096
+
+// MaxPixels is the largest width×height an image may declare and still be
+// decoded (0 = no limit). Icons are small, but a few KiB of compressed
+// data can declare 30000×30000 pixels and make a decoder allocate
+// gigabytes, so dimensions are read from the header and checked before any
+// pixel is decoded.
+var MaxPixels int64 = DefaultMaxPixels
+
+// ErrTooManyPixels is returned for images whose declared dimensions exceed
+// MaxPixels.
+var ErrTooManyPixels = errors.New("image exceeds the pixel budget")
+
+// checkPixels returns ErrTooManyPixels if a w×h image is over MaxPixels.
+func checkPixels(w, h int) error {
+	if MaxPixels > 0 && int64(w)*int64(h) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooManyPixels, w, h)
+	}
+	return nil
+}
+
+// checkDeclaredPixels checks the dimensions b declares in its header, for
+// every format image.DecodeConfig knows (PNG, JPEG, GIF, WebP, BMP, AVIF,
+// HEIF and ICO). Payloads whose header it cannot read pass; their decoder
+// reports the error.
+func checkDeclaredPixels(b []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	return checkPixels(cfg.Width, cfg.Height)
+}
+
+// dataURIWithinBudget reports whether an image embedded in a data: URI
+// declares no more than MaxPixels, or cannot be read well enough to tell.
+func dataURIWithinBudget(ref string) bool {
+	meta, payload, ok := strings.Cut(strings.TrimSpace(ref), ",")
+	if !ok {
+		return true
+	}
+	var b []byte
+	var err error
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(payload), ""))
+	} else {
+		var s string
+		s, err = url.PathUnescape(payload)
+		b = []byte(s)
+	}
+	return err != nil || checkDeclaredPixels(b) == nil
+}
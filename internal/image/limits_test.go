@@ -0,0 +1,102 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// pngHeader returns the signature and IHDR chunk of a w×h RGBA PNG: enough
+// for DecodeConfig, far too little to decode.
+func pngHeader(w, h int) []byte {
+	ihdr := make([]byte, 4+13)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[8:], uint32(h))
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = binary.BigEndian.AppendUint32(out, 13)
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func setMaxPixels(t *testing.T, n int64) {
+	t.Helper()
+	old := MaxPixels
+	MaxPixels = n
+	t.Cleanup(func() { MaxPixels = old })
+}
+
+func TestPixelBudget(t *testing.T) {
+	setMaxPixels(t, DefaultMaxPixels)
+	bomb := pngHeader(30000, 30000)
+
+	if _, _, err := Decode(bomb, "image/png", "", 64); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("Decode = %v, want ErrTooManyPixels", err)
+	}
+	if _, err := DecodeImageRasterOnly(bomb); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("DecodeImageRasterOnly = %v, want ErrTooManyPixels", err)
+	}
+	// The ICO directory claims 16x16; the PNG entry says otherwise
+	if _, err := DecodeICOSelectLargest(testICO(16, 16, 32, bomb)); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("DecodeICOSelectLargest = %v, want ErrTooManyPixels", err)
+	}
+	if _, err := RasterizeSVG([]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 1 1"/>`), 20000, 20000); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("RasterizeSVG = %v, want ErrTooManyPixels", err)
+	}
+
+	var small bytes.Buffer
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range img.Pix {
+		img.Pix[i] = 0xc0
+	}
+	if err := png.Encode(&small, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Decode(small.Bytes(), "image/png", "", 64); err != nil {
+		t.Errorf("Decode of a 32x32 PNG: %v", err)
+	}
+}
+
+func TestPixelBudgetDisabled(t *testing.T) {
+	setMaxPixels(t, 0)
+	// Without a budget the header passes and decoding fails on the
+	// missing pixel data instead
+	if _, err := DecodeImageRasterOnly(pngHeader(30000, 30000)); err == nil || errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("DecodeImageRasterOnly = %v, want a decode error", err)
+	}
+	if err := checkPixels(1<<20, 1<<20); err != nil {
+		t.Errorf("checkPixels = %v", err)
+	}
+}
+
+func TestSanitizeSVGDropsOversizedDataImage(t *testing.T) {
+	setMaxPixels(t, DefaultMaxPixels)
+	var small bytes.Buffer
+	tile := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	tile.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	if err := png.Encode(&small, tile); err != nil {
+		t.Fatal(err)
+	}
+	bomb := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngHeader(30000, 30000))
+	ok := "data:image/png;base64," + base64.StdEncoding.EncodeToString(small.Bytes())
+	in := `<svg xmlns="http://www.w3.org/2000/svg"><image href="` + bomb + `"/><image href="` + ok + `"/></svg>`
+
+	out, err := SanitizeSVG([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), bomb) {
+		t.Error("oversized data: image kept")
+	}
+	if !strings.Contains(string(out), ok) {
+		t.Error("small data: image dropped")
+	}
+}
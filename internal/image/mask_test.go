@@ -0,0 +1,65 @@
+package image
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestParseMask(t *testing.T) {
+	tests := []struct {
+		shape, radius, want string
+	}{
+		{"circle", "", "circle"},
+		{" Squircle ", "30", "squircle"},
+		{"rounded", "", "rounded20"},
+		{"rounded", "12", "rounded10"},
+		{"rounded", "13", "rounded15"},
+		{"rounded", "0", "rounded5"},
+		{"rounded", "90", "rounded50"},
+		{"rounded", "big", "rounded20"},
+		{"hexagon", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseMask(tt.shape, tt.radius); got != tt.want {
+			t.Errorf("ParseMask(%q, %q) = %q, want %q", tt.shape, tt.radius, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMask(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	alpha := func(mask string, x, y int) uint8 {
+		return color.NRGBAModel.Convert(ApplyMask(glyph(red, true), mask).At(x, y)).(color.NRGBA).A
+	}
+
+	tests := []struct {
+		mask        string
+		x, y        int
+		transparent bool
+	}{
+		{"circle", 0, 0, true},
+		{"circle", 16, 16, false},
+		{"circle", 16, 0, false},
+		{"circle", 3, 3, true},
+		{"squircle", 0, 0, true},
+		{"squircle", 3, 3, false},
+		{"rounded20", 0, 0, true},
+		{"rounded20", 3, 3, false},
+		{"rounded50", 3, 3, true},
+		{"rounded5", 1, 1, false},
+	}
+	for _, tt := range tests {
+		a := alpha(tt.mask, tt.x, tt.y)
+		if tt.transparent && a != 0 {
+			t.Errorf("%s at (%d,%d): alpha %d, want transparent", tt.mask, tt.x, tt.y, a)
+		}
+		if !tt.transparent && a < 0x80 {
+			t.Errorf("%s at (%d,%d): alpha %d, want visible", tt.mask, tt.x, tt.y, a)
+		}
+	}
+
+	if got := ApplyMask(glyph(red, true), "bogus"); got.At(0, 0) != glyph(red, true).At(0, 0) {
+		t.Error("Unknown mask changed the image")
+	}
+}
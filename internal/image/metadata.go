@@ -0,0 +1,135 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// OutputComment, when set, is embedded in every PNG response as a tEXt
+// "Comment" chunk, e.g. an attribution line. WebP and AVIF have no
+// comparably small comment field and stay metadata-free.
+var OutputComment string
+
+// maxCommentLen caps OutputComment so it cannot bloat small icons.
+const maxCommentLen = 256
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngKeepChunks are the PNG chunks needed to render an image (including
+// APNG frames); everything else, such as text, eXIf, iCCP, tIME and pHYs,
+// is dropped. sRGB is kept as it only states the default colour space.
+var pngKeepChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "tRNS": true, "IDAT": true, "IEND": true,
+	"sRGB": true, "acTL": true, "fcTL": true, "fdAT": true,
+}
+
+// webpKeepChunks are the WebP chunks needed to render an image; EXIF, XMP
+// and ICCP are dropped.
+var webpKeepChunks = map[string]bool{
+	"VP8 ": true, "VP8L": true, "VP8X": true, "ALPH": true, "ANIM": true, "ANMF": true,
+}
+
+// VP8X feature flags announcing the chunks webpKeepChunks drops.
+const webpMetadataFlags = 0x20 | 0x08 | 0x04 // ICC, EXIF, XMP
+
+// StripMetadata removes ancillary metadata (text, EXIF, XMP, ICC profiles,
+// timestamps) from encoded PNG, WebP and GIF bytes, keeping only what is
+// needed to render and animate them. Other formats and malformed input are
+// returned unchanged.
+func StripMetadata(b []byte) []byte {
+	switch {
+	case bytes.HasPrefix(b, pngSignature):
+		if out, ok := stripPNG(b); ok {
+			return out
+		}
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		if out, ok := stripWebP(b); ok {
+			return out
+		}
+	case bytes.HasPrefix(b, []byte("GIF8")):
+		if out, ok := stripGIF(b); ok {
+			return out
+		}
+	}
+	return b
+}
+
+func stripPNG(b []byte) ([]byte, bool) {
+	out := append(make([]byte, 0, len(b)), pngSignature...)
+	for p := len(pngSignature); p < len(b); {
+		if len(b)-p < 12 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		end := p + 12 + n
+		if n < 0 || end > len(b) {
+			return nil, false
+		}
+		if pngKeepChunks[string(b[p+4:p+8])] {
+			out = append(out, b[p:end]...)
+		}
+		p = end
+	}
+	return out, true
+}
+
+func stripWebP(b []byte) ([]byte, bool) {
+	out := append(make([]byte, 0, len(b)), b[:12]...)
+	for p := 12; p < len(b); {
+		if len(b)-p < 8 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		end := p + 8 + n + n&1
+		if n < 0 || end > len(b) {
+			return nil, false
+		}
+		fourCC := string(b[p : p+4])
+		if webpKeepChunks[fourCC] {
+			start := len(out)
+			out = append(out, b[p:end]...)
+			if fourCC == "VP8X" && n > 0 {
+				out[start+8] &^= webpMetadataFlags
+			}
+		}
+		p = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, true
+}
+
+// addPNGComment inserts a tEXt "Comment" chunk holding text right after
+// the IHDR chunk of a PNG. Characters outside printable ASCII are replaced,
+// as tEXt is Latin-1 and the comment is meant to be short.
+func addPNGComment(b []byte, text string) []byte {
+	ihdrEnd := len(pngSignature) + 12 + 13
+	if text == "" || !bytes.HasPrefix(b, pngSignature) || len(b) < ihdrEnd || string(b[12:16]) != "IHDR" {
+		return b
+	}
+	clean := make([]byte, 0, len(text))
+	for _, r := range text {
+		if len(clean) == maxCommentLen {
+			break
+		}
+		if r < 0x20 || r > 0x7e {
+			r = '?'
+		}
+		clean = append(clean, byte(r))
+	}
+
+	chunk := appendPNGChunk(nil, "tEXt", append([]byte("Comment\x00"), clean...))
+
+	out := make([]byte, 0, len(b)+len(chunk))
+	out = append(out, b[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, b[ihdrEnd:]...)
+}
+
+// finishOutput strips metadata from encoded bytes and adds OutputComment.
+func finishOutput(b []byte) []byte {
+	b = StripMetadata(b)
+	if OutputComment != "" {
+		b = addPNGComment(b, OutputComment)
+	}
+	return b
+}
@@ -0,0 +1,183 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// pngChunks lists the chunk types of a PNG in order.
+func pngChunks(t *testing.T, b []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(b, pngSignature) {
+		t.Fatal("not a PNG")
+	}
+	var types []string
+	for p := len(pngSignature); p+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		types = append(types, string(b[p+4:p+8]))
+		p += 12 + n
+	}
+	return types
+}
+
+// webpChunks lists the top-level chunk FourCCs of a WebP in order and checks
+// the RIFF size.
+func webpChunks(t *testing.T, b []byte) []string {
+	t.Helper()
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		t.Fatal("not a WebP")
+	}
+	if got := int(binary.LittleEndian.Uint32(b[4:])); got != len(b)-8 {
+		t.Errorf("RIFF size = %d, want %d", got, len(b)-8)
+	}
+	var types []string
+	for p := 12; p+8 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		types = append(types, string(b[p:p+4]))
+		p += 8 + n + n&1
+	}
+	return types
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, typ...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func webpChunk(fourCC string, data []byte) []byte {
+	c := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func testIcon() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: uint8(255 - x)})
+		}
+	}
+	return img
+}
+
+func TestEncodedOutputChunks(t *testing.T) {
+	img := testIcon()
+
+	b, _ := EncodeByFormat(img, "png", 0)
+	if got := pngChunks(t, b); !reflect.DeepEqual(got, []string{"IHDR", "IDAT", "IEND"}) {
+		t.Errorf("PNG chunks = %v", got)
+	}
+
+	b, _ = EncodeByFormat(img, "webp", 0)
+	for _, c := range webpChunks(t, b) {
+		if !webpKeepChunks[c] {
+			t.Errorf("WebP carries %q chunk", c)
+		}
+	}
+
+	if _, ok := LookupEncoder("avif"); ok {
+		b, ct := EncodeByFormat(img, "avif", 0)
+		if ct != "image/avif" {
+			t.Fatalf("avif encoded as %s", ct)
+		}
+		// Exif and XMP would be "Exif" and "mime" items; ICC a "prof" or
+		// "rICC" colour box instead of "nclx"
+		meta := b[:min(len(b), bytes.Index(b, []byte("mdat"))+4)]
+		for _, marker := range []string{"Exif", "mime", "prof", "rICC"} {
+			if bytes.Contains(meta, []byte(marker)) {
+				t.Errorf("AVIF metadata contains %q", marker)
+			}
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	var clean bytes.Buffer
+	_ = png.Encode(&clean, testIcon())
+	chunks := clean.Bytes()[len(pngSignature):]
+	ihdr, rest := chunks[:25], chunks[25:]
+
+	var dirty []byte
+	dirty = append(dirty, pngSignature...)
+	dirty = append(dirty, ihdr...)
+	dirty = append(dirty, pngChunk("iCCP", []byte("profile\x00\x00xyz"))...)
+	dirty = append(dirty, pngChunk("sRGB", []byte{0})...)
+	dirty = append(dirty, pngChunk("tEXt", []byte("Software\x00editor"))...)
+	dirty = append(dirty, pngChunk("eXIf", []byte("MM\x00*"))...)
+	dirty = append(dirty, pngChunk("tIME", make([]byte, 7))...)
+	dirty = append(dirty, rest...)
+
+	out := StripMetadata(dirty)
+	if got := pngChunks(t, out); !reflect.DeepEqual(got, []string{"IHDR", "sRGB", "IDAT", "IEND"}) {
+		t.Errorf("stripped PNG chunks = %v", got)
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+
+	lossless, _ := EncodeByFormat(testIcon(), "webp", 0)
+	vp8l := lossless[12:]
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x20 | 0x08 | 0x04 // ICC, EXIF, XMP
+	vp8x[4], vp8x[7] = 15, 15    // canvas 16x16, stored minus one
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("ICCP", []byte("icc"))...)
+	body = append(body, vp8l...)
+	body = append(body, webpChunk("EXIF", []byte("MM\x00*"))...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	riff := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	dirtyWebP := append(riff, body...)
+
+	out = StripMetadata(dirtyWebP)
+	if got := webpChunks(t, out); !reflect.DeepEqual(got, []string{"VP8X", "VP8L"}) {
+		t.Errorf("stripped WebP chunks = %v", got)
+	}
+	if flags := out[20]; flags != 0 {
+		t.Errorf("VP8X flags = %#x, want none", flags)
+	}
+	if _, err := webp.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped WebP does not decode: %v", err)
+	}
+
+	for _, b := range [][]byte{nil, []byte("GIF89a"), dirty[:40]} {
+		if got := StripMetadata(b); !bytes.Equal(got, b) {
+			t.Errorf("StripMetadata(%q) changed unrecognised input", b)
+		}
+	}
+}
+
+func TestOutputComment(t *testing.T) {
+	OutputComment = "Icon via faviconsvc © 2024"
+	defer func() { OutputComment = "" }()
+
+	b, _ := EncodeByFormat(testIcon(), "png", 0)
+	if got := pngChunks(t, b); !reflect.DeepEqual(got, []string{"IHDR", "tEXt", "IDAT", "IEND"}) {
+		t.Fatalf("PNG chunks = %v", got)
+	}
+	if !bytes.Contains(b, []byte("Comment\x00Icon via faviconsvc ? 2024")) {
+		t.Error("comment text not embedded")
+	}
+	if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+		t.Errorf("commented PNG does not decode: %v", err)
+	}
+
+	b, _ = EncodeByFormat(testIcon(), "webp", 0)
+	if bytes.Contains(b, []byte("faviconsvc")) {
+		t.Error("comment added to WebP output")
+	}
+}
@@ -0,0 +1,121 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// DefaultMonoColor is the colour of monochrome silhouettes when none is
+// given.
+const DefaultMonoColor = "000000"
+
+const (
+	// monoContrast is the channel difference from the background at which
+	// a pixel of an opaque icon counts as fully part of the silhouette;
+	// smaller differences fade out, keeping antialiased edges smooth.
+	monoContrast = 96
+	// monoBackgroundSpread is the channel difference from the border's
+	// mean within which a pixel of an opaque icon is background.
+	monoBackgroundSpread = 16
+)
+
+// ParseMono returns the canonical colour of the monochrome mode selected
+// by mono ("1", "true" or "yes") and colour (3 or 6 hex digits, with or
+// without "#"; empty or invalid = DefaultMonoColor) as 6 lowercase hex
+// digits, e.g. "000000". It returns "" when mono does not select the mode.
+func ParseMono(mono, colour string) string {
+	switch strings.ToLower(strings.TrimSpace(mono)) {
+	case "1", "true", "yes":
+	default:
+		return ""
+	}
+	hex := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(colour), "#"))
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil || len(hex) != 6 {
+		return DefaultMonoColor
+	}
+	return hex
+}
+
+// Monochrome returns img as a silhouette in the colour named by mono, a
+// value returned by ParseMono: every pixel has that colour, and the alpha
+// channel alone carries the icon's shape, as pinned tabs and toolbars
+// expect. An icon with transparent areas keeps its alpha as the shape. An
+// opaque one has no shape in its alpha, so its background is taken from
+// the mean colour of its border and pixels are as opaque as they differ
+// from it. Invalid colours leave img unchanged.
+func Monochrome(img image.Image, mono string) image.Image {
+	var r, g, bl uint8
+	if _, err := fmt.Sscanf(mono, "%02x%02x%02x", &r, &g, &bl); err != nil || len(mono) != 6 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	transparent := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A < 0x40 {
+				transparent++
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+
+	dst := image.NewNRGBA(src.Rect)
+	// As in ApplyTheme, icons with under 5% transparent pixels are opaque
+	opaque := transparent*20 < w*h
+	var bg [3]int
+	if opaque {
+		bg = borderMean(src)
+	}
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := int(src.Pix[i+3])
+		if opaque {
+			d := 0
+			for c := 0; c < 3; c++ {
+				d = max(d, absInt(int(src.Pix[i+c])-bg[c]))
+			}
+			cover := min(max(d-monoBackgroundSpread, 0)*255/(monoContrast-monoBackgroundSpread), 255)
+			a = a * cover / 255
+		}
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = r, g, bl, uint8(a)
+	}
+	return dst
+}
+
+// borderMean returns the mean colour of the outermost pixels of img.
+func borderMean(img *image.NRGBA) [3]int {
+	b := img.Bounds()
+	var sum [3]int
+	n := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if y != b.Min.Y && y != b.Max.Y-1 && x != b.Min.X && x != b.Max.X-1 {
+				continue
+			}
+			i := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				sum[c] += int(img.Pix[i+c])
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return sum
+	}
+	return [3]int{sum[0] / n, sum[1] / n, sum[2] / n}
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseMono(t *testing.T) {
+	tests := []struct {
+		mono, colour, want string
+	}{
+		{"1", "", DefaultMonoColor},
+		{"true", "#1A2B3C", "1a2b3c"},
+		{"yes", "f80", "ff8800"},
+		{"1", "red", DefaultMonoColor},
+		{"1", "12345", DefaultMonoColor},
+		{"0", "ff0000", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseMono(tt.mono, tt.colour); got != tt.want {
+			t.Errorf("ParseMono(%q, %q) = %q, want %q", tt.mono, tt.colour, got, tt.want)
+		}
+	}
+}
+
+func TestMonochrome(t *testing.T) {
+	at := func(img image.Image, x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+
+	t.Run("transparent icon keeps its alpha", func(t *testing.T) {
+		out := Monochrome(glyph(color.NRGBA{R: 0x10, G: 0x80, B: 0x20, A: 0xff}, false), "ff0000")
+		if c := at(out, 16, 16); c != (color.NRGBA{R: 0xff, A: 0xff}) {
+			t.Errorf("inside = %v, want opaque red", c)
+		}
+		if c := at(out, 2, 2); c.A != 0 {
+			t.Errorf("outside = %v, want transparent", c)
+		}
+	})
+
+	t.Run("opaque icon is cut from its background", func(t *testing.T) {
+		img := glyph(color.NRGBA{R: 0xfa, G: 0xfa, B: 0xfa, A: 0xff}, true)
+		for y := 8; y < 24; y++ {
+			for x := 8; x < 24; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{R: 0x20, G: 0x30, B: 0xc0, A: 0xff})
+			}
+		}
+		// A faint background speckle stays background
+		img.SetNRGBA(3, 3, color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff})
+		out := Monochrome(img, DefaultMonoColor)
+		if c := at(out, 16, 16); c != (color.NRGBA{A: 0xff}) {
+			t.Errorf("glyph = %v, want opaque black", c)
+		}
+		for _, p := range []image.Point{{1, 1}, {3, 3}} {
+			if c := at(out, p.X, p.Y); c.A != 0 {
+				t.Errorf("background at %v = %v, want transparent", p, c)
+			}
+		}
+	})
+
+	if img := glyph(color.NRGBA{R: 0xff, A: 0xff}, false); Monochrome(img, "bad") != image.Image(img) {
+		t.Error("invalid colour changed the icon")
+	}
+}
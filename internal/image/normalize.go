@@ -0,0 +1,129 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// MaxPad is the largest margin ParsePad accepts, in percent of the edge.
+const MaxPad = 40
+
+const (
+	// trimAlpha is the alpha below which a pixel counts as transparent
+	// background when trimming.
+	trimAlpha = 0x20
+	// trimTolerance is the largest per-channel difference from an opaque
+	// background colour that still counts as background.
+	trimTolerance = 24
+)
+
+// ParsePad parses a pad parameter such as "10%" or "10": the margin, in
+// percent of the edge, that Normalize leaves around an icon's content.
+// ok is false for empty, malformed or out-of-range values.
+func ParsePad(s string) (pad int, ok bool) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	pad, err := strconv.Atoi(s)
+	if err != nil || pad < 0 || pad > MaxPad {
+		return 0, false
+	}
+	return pad, true
+}
+
+// Normalize trims img to the bounds of its content and scales that, keeping
+// its aspect ratio and using the resampling filter named by filter, into the
+// centre of a size x size image with a margin of pad percent on every side.
+// Apple touch icons ship with padding built in while favicon.ico files are
+// edge to edge; normalizing both gives icons a uniform visual weight side by
+// side.
+//
+// The background is transparency when the corners are transparent, or the
+// corners' colour when they are opaque and alike, and the margin is filled
+// with it. Icons with neither, or without content, are only resized.
+func Normalize(img image.Image, size, pad int, filter string) image.Image {
+	content, bg, ok := contentBounds(img)
+	if !ok {
+		return ResizeImageWith(img, size, filter)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	inner := float64(size) * float64(100-2*pad) / 100
+	scale := inner / float64(max(content.Dx(), content.Dy()))
+	w, h := int(float64(content.Dx())*scale+0.5), int(float64(content.Dy())*scale+0.5)
+	w, h = max(w, 1), max(h, 1)
+	r := image.Rect((size-w)/2, (size-h)/2, (size-w)/2+w, (size-h)/2+h)
+	src := img
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		src = s.SubImage(content)
+	}
+	scaler(filter, src, max(w, h)).Scale(dst, r, img, content, draw.Over, nil)
+	return dst
+}
+
+// contentBounds returns the smallest rectangle holding every pixel of img
+// that differs from its background, and that background. ok is false when
+// the background cannot be told from the corners or img has no content.
+func contentBounds(img image.Image) (content image.Rectangle, bg color.NRGBA, ok bool) {
+	b := img.Bounds()
+	if b.Empty() {
+		return image.Rectangle{}, bg, false
+	}
+	at := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+	corners := []color.NRGBA{at(b.Min.X, b.Min.Y), at(b.Max.X-1, b.Min.Y), at(b.Min.X, b.Max.Y-1), at(b.Max.X-1, b.Max.Y-1)}
+
+	var isBackground func(c color.NRGBA) bool
+	switch {
+	case allCorners(corners, func(c color.NRGBA) bool { return c.A < trimAlpha }):
+		isBackground = func(c color.NRGBA) bool { return c.A < trimAlpha }
+	case allCorners(corners, func(c color.NRGBA) bool { return c.A == 0xff && similar(c, corners[0]) }):
+		bg = corners[0]
+		isBackground = func(c color.NRGBA) bool { return c.A < trimAlpha || similar(c, bg) }
+	default:
+		return image.Rectangle{}, bg, false
+	}
+
+	minX, minY, maxX, maxY := b.Max.X, b.Max.Y, b.Min.X-1, b.Min.Y-1
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if isBackground(at(x, y)) {
+				continue
+			}
+			minX, maxX = min(minX, x), max(maxX, x)
+			minY, maxY = min(minY, y), max(maxY, y)
+		}
+	}
+	if maxX < minX {
+		return image.Rectangle{}, bg, false
+	}
+	return image.Rect(minX, minY, maxX+1, maxY+1), bg, true
+}
+
+func allCorners(corners []color.NRGBA, pred func(color.NRGBA) bool) bool {
+	for _, c := range corners {
+		if !pred(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// similar reports whether a and b differ by at most trimTolerance in every
+// colour channel.
+func similar(a, b color.NRGBA) bool {
+	d := func(x, y uint8) int {
+		if x > y {
+			return int(x - y)
+		}
+		return int(y - x)
+	}
+	return d(a.R, b.R) <= trimTolerance && d(a.G, b.G) <= trimTolerance && d(a.B, b.B) <= trimTolerance
+}
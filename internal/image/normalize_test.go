@@ -0,0 +1,78 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParsePad(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"10%", 10, true},
+		{" 0 ", 0, true},
+		{"40", 40, true},
+		{"41%", 0, false},
+		{"-5", 0, false},
+		{"wide", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := ParsePad(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("ParsePad(%q) = %d, %v; want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	white := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+	// A touch icon: red logo with a wide white margin built in
+	touch := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := white
+			if x >= 16 && x < 48 && y >= 16 && y < 48 {
+				c = red
+			}
+			touch.SetNRGBA(x, y, c)
+		}
+	}
+	// No common background colour: left as is
+	mixed := glyph(red, true)
+	mixed.SetNRGBA(0, 0, white)
+
+	at := func(img image.Image, x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+		pad  int
+		x, y int
+		want color.NRGBA
+	}{
+		{"touch icon trimmed", touch, 0, 1, 1, red},
+		{"touch icon re-padded", touch, 25, 2, 2, white},
+		{"touch icon re-padded centre", touch, 25, 16, 16, red},
+		{"transparent glyph trimmed", glyph(red, false), 10, 4, 4, red},
+		{"transparent glyph margin", glyph(red, false), 10, 1, 1, color.NRGBA{}},
+		{"mixed corners untouched", mixed, 0, 0, 0, white},
+		{"mixed corners content", mixed, 0, 1, 1, red},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := Normalize(tt.img, 32, tt.pad, FilterAuto)
+			if out.Bounds().Dx() != 32 || out.Bounds().Dy() != 32 {
+				t.Fatalf("bounds = %v, want 32x32", out.Bounds())
+			}
+			if got := at(out, tt.x, tt.y); got != tt.want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", tt.x, tt.y, got, tt.want)
+			}
+		})
+	}
+}
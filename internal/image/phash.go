@@ -0,0 +1,111 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// phashSampleSize is the edge an image is scaled to before hashing, and
+// phashBits the edge of the block of lowest DCT frequencies kept.
+const (
+	phashSampleSize = 32
+	phashBits       = 8
+)
+
+// phashDeadZone is how far above the median a DCT coefficient must be for
+// its bit to be set: a cosine of 2 grey levels over the sample. Without it
+// the near-zero coefficients of flat icons would take their bits from
+// encoding noise.
+const phashDeadZone = 2 * phashSampleSize * phashSampleSize / 4
+
+// PerceptualHash is a 64-bit DCT hash (pHash) of an image's luminance.
+// Visually identical images hash alike whatever their encoding, metadata or
+// resolution, and similar ones differ in few bits. It ignores colour: a
+// logo and its recoloured copy hash alike.
+type PerceptualHash uint64
+
+// String returns h as 16 hex digits.
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// Distance returns the number of bits h and o differ in, from 0 for
+// identical-looking images to 64.
+func (h PerceptualHash) Distance(o PerceptualHash) int {
+	return bits.OnesCount64(uint64(h ^ o))
+}
+
+// PHash returns the perceptual hash of img, flattened over white as in
+// CompareImages: one bit per low-frequency DCT coefficient of its
+// luminance, set where the coefficient is clearly above their median.
+func PHash(img image.Image) PerceptualHash {
+	const n, k = phashSampleSize, phashBits
+	px := flattenForDiff(img, n)
+	var lum [n][n]float64
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			i := px.PixOffset(x, y)
+			lum[y][x] = 0.299*float64(px.Pix[i]) + 0.587*float64(px.Pix[i+1]) + 0.114*float64(px.Pix[i+2])
+		}
+	}
+	var basis [k][n]float64
+	for u := range basis {
+		for x := range basis[u] {
+			basis[u][x] = math.Cos(math.Pi * float64(u) * (2*float64(x) + 1) / (2 * n))
+		}
+	}
+	// Separable 2-D DCT-II, keeping only the k×k lowest frequencies
+	var rows [n][k]float64
+	for y := 0; y < n; y++ {
+		for u := 0; u < k; u++ {
+			for x := 0; x < n; x++ {
+				rows[y][u] += lum[y][x] * basis[u][x]
+			}
+		}
+	}
+	coeffs := make([]float64, 0, k*k)
+	for v := 0; v < k; v++ {
+		for u := 0; u < k; u++ {
+			var c float64
+			for y := 0; y < n; y++ {
+				c += rows[y][u] * basis[v][y]
+			}
+			coeffs = append(coeffs, c)
+		}
+	}
+
+	// The DC term is overall brightness, which would skew the median
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var h uint64
+	for i, c := range coeffs {
+		if c > median+phashDeadZone {
+			h |= 1 << (63 - i)
+		}
+	}
+	return PerceptualHash(h)
+}
+
+// AverageColor returns the mean colour of img flattened over white, which
+// tells apart images PHash cannot, such as recoloured copies of a logo.
+func AverageColor(img image.Image) color.RGBA {
+	px := flattenForDiff(img, phashSampleSize)
+	var sum [3]int
+	for i := 0; i < len(px.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			sum[c] += int(px.Pix[i+c])
+		}
+	}
+	pixels := phashSampleSize * phashSampleSize
+	return color.RGBA{
+		R: uint8((sum[0] + pixels/2) / pixels),
+		G: uint8((sum[1] + pixels/2) / pixels),
+		B: uint8((sum[2] + pixels/2) / pixels),
+		A: 0xff,
+	}
+}
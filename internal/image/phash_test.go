@@ -0,0 +1,80 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// phashTestIcon draws a dark disc with a bar on white, w pixels wide.
+func phashTestIcon(w int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, w))
+	for y := 0; y < w; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+			dx, dy := 2*x-w, 2*y-w
+			if dx*dx+dy*dy < w*w*9/16 {
+				c = color.NRGBA{R: 20, G: 60, B: 160, A: 255}
+			}
+			if y > w/8 && y < w/4 {
+				c = color.NRGBA{R: 240, G: 160, B: 20, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestPHash(t *testing.T) {
+	icon := phashTestIcon(64)
+	h := PHash(icon)
+	if len(h.String()) != 16 {
+		t.Errorf("String() = %q, want 16 hex digits", h)
+	}
+
+	// Drawn at twice the resolution its edges are antialiased differently
+	if d := h.Distance(PHash(phashTestIcon(128))); d > 6 {
+		t.Errorf("same icon at another resolution differs in %d bits, want at most 6", d)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, icon, &jpeg.Options{Quality: 70}); err != nil {
+		t.Fatal(err)
+	}
+	reencoded, _ := jpeg.Decode(&buf)
+	if d := h.Distance(PHash(reencoded)); d > 2 {
+		t.Errorf("JPEG re-encoded icon differs in %d bits, want at most 2", d)
+	}
+
+	// Flat icons have no structure for noise to flip bits of
+	flat := solidNRGBA(color.NRGBA{R: 30, G: 120, B: 90, A: 255})
+	noisy := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(noisy.Pix); i += 4 {
+		d := uint8(i / 4 % 3)
+		noisy.Pix[i], noisy.Pix[i+1], noisy.Pix[i+2], noisy.Pix[i+3] = 29+d, 119+d, 89+d, 255
+	}
+	if a, b := PHash(flat), PHash(noisy); a != b {
+		t.Errorf("flat icon hashes %s, with ±1 noise %s", a, b)
+	}
+
+	flipped := image.NewNRGBA(icon.Bounds())
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			flipped.SetNRGBA(x, 63-y, icon.NRGBAAt(x, y))
+		}
+	}
+	if d := h.Distance(PHash(flipped)); d < 10 {
+		t.Errorf("flipped icon differs in only %d bits", d)
+	}
+}
+
+func TestAverageColor(t *testing.T) {
+	if got := AverageColor(solidNRGBA(color.NRGBA{R: 200, G: 30, B: 30, A: 255})); got != (color.RGBA{R: 200, G: 30, B: 30, A: 255}) {
+		t.Errorf("solid red average = %v", got)
+	}
+	// Transparency is taken as white
+	if got := AverageColor(solidNRGBA(color.NRGBA{})); got != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("transparent average = %v, want white", got)
+	}
+}
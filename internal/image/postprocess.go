@@ -0,0 +1,290 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+)
+
+// PostProcessor transforms the final image of a response, after resizing
+// and the request's variants and before it is encoded. Deployments register
+// one to apply their own transforms, such as a watermark or the redaction
+// of marks they may not show, without changing this package.
+type PostProcessor struct {
+	// Name identifies the processor in logs and metrics, and is part of
+	// the cache key of the variants it produced.
+	Name string
+	// Process returns the transformed image, which should have the bounds
+	// of img. It must not draw on img, which may be shared.
+	Process func(img image.Image) (image.Image, error)
+	// Version, if set, returns a token that changes whenever Process
+	// starts producing other output. It is part of the cache key too, so
+	// variants cached before the change are not served.
+	Version func() string
+}
+
+var (
+	postProcessorsMu sync.RWMutex
+	postProcessors   []PostProcessor
+)
+
+// RegisterPostProcessor appends p to the processors PostProcess runs,
+// replacing a processor with the same name in place.
+func RegisterPostProcessor(p PostProcessor) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	for i := range postProcessors {
+		if postProcessors[i].Name == p.Name {
+			postProcessors[i] = p
+			return
+		}
+	}
+	postProcessors = append(postProcessors, p)
+}
+
+// UnregisterPostProcessor removes the processor registered under name.
+func UnregisterPostProcessor(name string) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	for i := range postProcessors {
+		if postProcessors[i].Name == name {
+			postProcessors = append(postProcessors[:i], postProcessors[i+1:]...)
+			return
+		}
+	}
+}
+
+// PostProcessors returns a snapshot of the registered processors in the
+// order they run.
+func PostProcessors() []PostProcessor {
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+	return append([]PostProcessor(nil), postProcessors...)
+}
+
+// PostProcessKey names the registered processors and their versions for
+// cache keys, so variants cached before a processor was added, removed or
+// changed are not served as its output. It is "" without processors.
+func PostProcessKey() string {
+	procs := PostProcessors()
+	names := make([]string, 0, len(procs))
+	for _, p := range procs {
+		name := p.Name
+		if p.Version != nil {
+			name += "@" + p.Version()
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "+")
+}
+
+// PostProcess runs the registered processors on img in order. A processor
+// that fails, or returns an image of other bounds, is skipped and its input
+// passed on, so the response is served untransformed rather than not at
+// all; ok is false then, and the result must not be cached as the
+// processors' output. Every run is counted in the favicon_post_process_total
+// metric.
+func PostProcess(img image.Image) (_ image.Image, ok bool) {
+	ok = true
+	for _, p := range PostProcessors() {
+		out, err := p.Process(img)
+		result := "ok"
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			result = "timeout"
+		case err == nil && (out == nil || out.Bounds().Size() != img.Bounds().Size()):
+			err = errors.New("returned an image of other bounds")
+			fallthrough
+		case err != nil:
+			result = "error"
+		}
+		metrics.Get().IncPostProcess(p.Name, result)
+		if err != nil {
+			logger.Warn("Post-processor %s failed, serving its input: %v", p.Name, err)
+			ok = false
+			continue
+		}
+		img = out
+	}
+	return img, ok
+}
+
+// DefaultPostProcessTimeout bounds one run of a post-process command.
+const DefaultPostProcessTimeout = 2 * time.Second
+
+// postProcessVersionTTL is how long PostProcessCommand.Version trusts its
+// last look at the executable, as it is asked for every resized variant.
+const postProcessVersionTTL = 10 * time.Second
+
+// PostProcessCommandOptions configures NewPostProcessCommand.
+type PostProcessCommandOptions struct {
+	Path        string        // executable, resolved via PATH
+	Timeout     time.Duration // per image (0 = DefaultPostProcessTimeout)
+	Concurrency int           // parallel runs (0 = DefaultExternalConcurrency)
+}
+
+// PostProcessCommand is a post-processor backed by an operator-supplied
+// executable. It reads the image as a PNG on stdin and writes the
+// transformed image as a PNG of the same size to stdout; a non-zero exit
+// status fails the run. Like ExternalConverter, it runs with a minimal
+// environment, which sets FAVICON_WIDTH and FAVICON_HEIGHT, in a private
+// working directory.
+type PostProcessCommand struct {
+	path    string
+	timeout time.Duration
+	dir     string
+	sem     chan struct{}
+
+	digestMu  sync.Mutex
+	digestOf  fileStamp // state of the executable digest was taken of
+	digest    string
+	checkedAt time.Time // when digestOf was last compared with the file
+}
+
+// fileStamp tells whether a file changed since it was last read.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewPostProcessCommand locates the executable of a post-process command
+// and prepares its working directory. Call Close to remove the directory.
+func NewPostProcessCommand(opts PostProcessCommandOptions) (*PostProcessCommand, error) {
+	if opts.Path == "" {
+		return nil, errors.New("post-process command: no path")
+	}
+	resolved, err := exec.LookPath(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("post-process command: %w", err)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultPostProcessTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultExternalConcurrency
+	}
+	dir, err := os.MkdirTemp("", "favicon-postprocess-")
+	if err != nil {
+		return nil, err
+	}
+	return &PostProcessCommand{
+		path:    resolved,
+		timeout: opts.Timeout,
+		dir:     dir,
+		sem:     make(chan struct{}, opts.Concurrency),
+	}, nil
+}
+
+// Name returns "command-" and the base name of the executable.
+func (c *PostProcessCommand) Name() string { return "command-" + filepath.Base(c.path) }
+
+// Close removes the working directory.
+func (c *PostProcessCommand) Close() error {
+	return os.RemoveAll(c.dir)
+}
+
+// PostProcessor returns a registry entry backed by c.
+func (c *PostProcessCommand) PostProcessor() PostProcessor {
+	return PostProcessor{Name: c.Name(), Process: c.Run, Version: c.Version}
+}
+
+// Version returns the first 12 hex digits of the SHA-256 of the
+// executable, recomputed when its size or modification time changes, so
+// editing the command invalidates the variants it produced within
+// postProcessVersionTTL. Files it runs in turn are not covered. It is "" if
+// the executable cannot be read.
+func (c *PostProcessCommand) Version() string {
+	c.digestMu.Lock()
+	defer c.digestMu.Unlock()
+	now := time.Now()
+	if c.digest != "" && now.Sub(c.checkedAt) < postProcessVersionTTL {
+		return c.digest
+	}
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return ""
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	if c.digest != "" && stamp == c.digestOf {
+		c.checkedAt = now
+		return c.digest
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	c.digest, c.digestOf, c.checkedAt = hex.EncodeToString(h.Sum(nil))[:12], stamp, now
+	return c.digest
+}
+
+// Run pipes img through the command and returns its output.
+func (c *PostProcessCommand) Run(img image.Image) (image.Image, error) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, img); err != nil {
+		return nil, err
+	}
+
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	size := img.Bounds().Size()
+	cmd := exec.CommandContext(ctx, c.path)
+	cmd.Dir = c.dir
+	cmd.Env = []string{
+		"PATH=/usr/bin:/bin", "HOME=" + c.dir, "TMPDIR=" + c.dir,
+		"FAVICON_WIDTH=" + strconv.Itoa(size.X),
+		"FAVICON_HEIGHT=" + strconv.Itoa(size.Y),
+	}
+	cmd.Stdin = &in
+	stdout := &cappedBuffer{max: maxExternalOutput}
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	sandboxCommand(cmd)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name(), ctx.Err())
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			if len(msg) > 200 {
+				msg = msg[:200]
+			}
+			return nil, fmt.Errorf("%s: %v: %s", c.Name(), err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", c.Name(), err)
+	}
+
+	cfg, err := png.DecodeConfig(bytes.NewReader(stdout.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("%s output: %w", c.Name(), err)
+	}
+	if cfg.Width != size.X || cfg.Height != size.Y {
+		return nil, fmt.Errorf("%s output is %dx%d, want %dx%d", c.Name(), cfg.Width, cfg.Height, size.X, size.Y)
+	}
+	return png.Decode(bytes.NewReader(stdout.Bytes()))
+}
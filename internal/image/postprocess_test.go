@@ -0,0 +1,169 @@
+//go:build unix
+
+package image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"faviconsvc/pkg/metrics"
+)
+
+// fakePostProcessor writes an executable shell script standing in for an
+// operator's post-process command.
+func fakePostProcessor(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "watermark")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPostProcess(t *testing.T) {
+	metrics.Reset()
+	defer metrics.Reset()
+
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	red := color.NRGBA{R: 255, A: 255}
+	RegisterPostProcessor(PostProcessor{Name: "test-red", Process: func(img image.Image) (image.Image, error) {
+		out := image.NewNRGBA(img.Bounds())
+		out.Set(0, 0, red)
+		return out, nil
+	}})
+	defer UnregisterPostProcessor("test-red")
+	RegisterPostProcessor(PostProcessor{Name: "test-fail", Process: func(image.Image) (image.Image, error) {
+		return nil, errors.New("redaction service down")
+	}})
+	defer UnregisterPostProcessor("test-fail")
+	RegisterPostProcessor(PostProcessor{Name: "test-shrink", Process: func(image.Image) (image.Image, error) {
+		return image.NewNRGBA(image.Rect(0, 0, 8, 8)), nil
+	}})
+	defer UnregisterPostProcessor("test-shrink")
+
+	if got := PostProcessKey(); got != "test-red+test-fail+test-shrink" {
+		t.Errorf("PostProcessKey = %q", got)
+	}
+	out, ok := PostProcess(src)
+	if ok {
+		t.Error("PostProcess reported success with failing processors")
+	}
+	if out.Bounds() != src.Bounds() || out.At(0, 0) != red {
+		t.Errorf("PostProcess did not keep the output of test-red past the failing processors")
+	}
+	if src.At(0, 0) == red {
+		t.Error("PostProcess drew on its input")
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Get().Handler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+	// Labels are written in no particular order
+	series := map[string]string{"test-red": "ok", "test-fail": "error", "test-shrink": "error"}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "favicon_post_process_total{") {
+			continue
+		}
+		for name, result := range series {
+			if strings.Contains(line, `processor="`+name+`"`) && strings.Contains(line, `result="`+result+`"`) && strings.HasSuffix(line, " 1") {
+				delete(series, name)
+			}
+		}
+	}
+	for name, result := range series {
+		t.Errorf("metrics lack a %s run of %s", result, name)
+	}
+
+	UnregisterPostProcessor("test-fail")
+	UnregisterPostProcessor("test-shrink")
+	if _, ok := PostProcess(src); !ok {
+		t.Error("PostProcess reported a failure with only test-red")
+	}
+	UnregisterPostProcessor("test-red")
+	if got := PostProcessKey(); got != "" {
+		t.Errorf("PostProcessKey without processors = %q", got)
+	}
+}
+
+func TestPostProcessCommand(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 24, 12))
+	src.Set(3, 3, color.NRGBA{B: 255, A: 255})
+
+	// The server's environment, such as its API keys, is not passed on
+	t.Setenv("FAVICON_TEST_SECRET", "hunter2")
+	script := `[ "$FAVICON_WIDTH" = 24 ] && [ "$FAVICON_HEIGHT" = 12 ] || exit 3
+[ -z "$FAVICON_TEST_SECRET" ] && [ "$(pwd)" = "$HOME" ] && [ "$TMPDIR" = "$HOME" ] || exit 4
+cat`
+	cmd, err := NewPostProcessCommand(PostProcessCommandOptions{Path: fakePostProcessor(t, script)})
+	if err != nil {
+		t.Fatalf("NewPostProcessCommand() error = %v", err)
+	}
+	defer cmd.Close()
+	if cmd.Name() != "command-watermark" {
+		t.Errorf("Name = %q", cmd.Name())
+	}
+	// Editing the executable changes its version and so the cache key
+	v := cmd.Version()
+	if len(v) != 12 || cmd.Version() != v {
+		t.Errorf("Version = %q, then %q", v, cmd.Version())
+	}
+	RegisterPostProcessor(cmd.PostProcessor())
+	defer UnregisterPostProcessor(cmd.Name())
+	if got := PostProcessKey(); got != "command-watermark@"+v {
+		t.Errorf("PostProcessKey = %q", got)
+	}
+	if err := os.WriteFile(cmd.path, []byte("#!/bin/sh\n"+script+" # watermark v2\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Version() != v {
+		t.Error("Version looked at the executable again within postProcessVersionTTL")
+	}
+	cmd.checkedAt = time.Time{}
+	if cmd.Version() == v {
+		t.Error("Version did not change with the executable")
+	}
+	out, err := cmd.Run(src)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if out.Bounds() != src.Bounds() {
+		t.Fatalf("output bounds = %v, want %v", out.Bounds(), src.Bounds())
+	}
+	if _, _, b, _ := out.At(3, 3).RGBA(); b != 0xffff {
+		t.Error("output lost the pixels of the input")
+	}
+
+	failing, _ := NewPostProcessCommand(PostProcessCommandOptions{Path: fakePostProcessor(t, "cat > /dev/null\necho 'no license' >&2\nexit 1")})
+	defer failing.Close()
+	if _, err := failing.Run(src); err == nil || !strings.Contains(err.Error(), "no license") {
+		t.Errorf("failing command: err = %v, want its stderr", err)
+	}
+
+	// A 1x1 PNG for the 24x12 input
+	resized, _ := NewPostProcessCommand(PostProcessCommandOptions{Path: fakePostProcessor(t, `cat > /dev/null
+printf '\211PNG\r\n\032\n\000\000\000\rIHDR\000\000\000\001\000\000\000\001\010\006\000\000\000\037\025\304\211'`)})
+	defer resized.Close()
+	if _, err := resized.Run(src); err == nil || !strings.Contains(err.Error(), "want 24x12") {
+		t.Errorf("resizing command: err = %v", err)
+	}
+
+	slow, _ := NewPostProcessCommand(PostProcessCommandOptions{Path: fakePostProcessor(t, "sleep 5"), Timeout: 100 * time.Millisecond})
+	defer slow.Close()
+	start := time.Now()
+	if _, err := slow.Run(src); err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Errorf("slow command: err = %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("slow command was not killed at the timeout")
+	}
+
+	if _, err := NewPostProcessCommand(PostProcessCommandOptions{Path: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("NewPostProcessCommand accepted a missing executable")
+	}
+}
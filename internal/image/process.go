@@ -30,11 +30,40 @@ func getResvgContext() *resvg.Context {
 	return resvgCtx
 }
 
-// RasterizeSVG converts SVG to raster image using resvg (full SVG support including gradients)
-// Preserves transparency
+// RasterizeSVG converts SVG to raster image using the configured SVGRenderer
+// (embedded resvg by default, full SVG support including gradients).
+// Preserves transparency. Gzip-compressed SVG (.svgz) is decompressed, up
+// to MaxSVGBytes. The SVG is passed through SanitizeSVG first, so
+// renderers never see scripts or external references.
 func RasterizeSVG(svgBytes []byte, width, height int) (image.Image, error) {
+	if err := checkPixels(width, height); err != nil {
+		return nil, err
+	}
+	svgBytes, err := gunzipSVG(svgBytes)
+	if err != nil {
+		return nil, err
+	}
+	svgBytes, err = SanitizeSVG(svgBytes)
+	if err != nil {
+		return nil, err
+	}
 	svgBytes = preprocessSVG(svgBytes)
 
+	img, err := currentSVGRenderer().Render(svgBytes, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to RGBA but preserve transparency
+	return toRGBA(img), nil
+}
+
+// resvgWASMRenderer runs resvg compiled to WebAssembly in-process.
+type resvgWASMRenderer struct{}
+
+func (resvgWASMRenderer) Name() string { return SVGRendererEmbedded }
+
+func (resvgWASMRenderer) Render(svgBytes []byte, width, height int) (image.Image, error) {
 	ctx := getResvgContext()
 	if ctx == nil {
 		return nil, fmt.Errorf("resvg not available")
@@ -58,9 +87,7 @@ func RasterizeSVG(svgBytes []byte, width, height int) (image.Image, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decode: %w", err)
 	}
-
-	// Convert to RGBA but preserve transparency
-	return toRGBA(img), nil
+	return img, nil
 }
 
 func preprocessSVG(data []byte) []byte {
@@ -155,15 +182,10 @@ func IsNearlyBlankOrBlack(img image.Image) bool {
 	return opaque < 5 || colored < 3
 }
 
+// ResizeImage scales img to size x size, choosing the resampling filter
+// with PickFilter.
 func ResizeImage(img image.Image, size int) image.Image {
-	bounds := img.Bounds()
-	if bounds.Dx() == size && bounds.Dy() == size {
-		return img
-	}
-	dst := image.NewRGBA(image.Rect(0, 0, size, size))
-	// Transparent background
-	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
-	return dst
+	return ResizeImageWith(img, size, FilterAuto)
 }
 
 func ResizeImageWithBackground(img image.Image, size int, bgColor color.Color) image.Image {
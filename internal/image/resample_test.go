@@ -0,0 +1,203 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// checker returns an n x n black and white checkerboard of 1px squares.
+func checker(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			c := color.NRGBA{A: 0xff}
+			if (x+y)%2 == 0 {
+				c = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// gradient returns an n x n image with a distinct colour per pixel.
+func gradient(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / n), G: uint8(y * 255 / n), B: 0x80, A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestPickFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		src  image.Image
+		size int
+		want string
+	}{
+		{"pixel art upscaled 4x", checker(16), 64, FilterNearest},
+		{"pixel art upscaled 1.5x", checker(16), 24, FilterCatmullRom},
+		{"photo 16px upscaled", gradient(16), 64, FilterCatmullRom},
+		{"large pixel art upscaled", checker(64), 256, FilterCatmullRom},
+		{"downscale", gradient(128), 32, FilterLanczos},
+	}
+	for _, tt := range tests {
+		if got := PickFilter(tt.src, tt.size); got != tt.want {
+			t.Errorf("%s: PickFilter = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResizeImageWith(t *testing.T) {
+	// Only nearest neighbour keeps every pixel pure black or white
+	pure := func(img image.Image) bool {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				if r != 0 && r != 0xffff {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, tt := range []struct {
+		filter string
+		pure   bool
+	}{
+		{FilterAuto, true},
+		{FilterNearest, true},
+		{FilterCatmullRom, false},
+		{FilterLanczos, false},
+		{"bogus", true},
+	} {
+		out := ResizeImageWith(checker(16), 64, tt.filter)
+		if out.Bounds().Dx() != 64 {
+			t.Fatalf("%s: bounds = %v", tt.filter, out.Bounds())
+		}
+		if got := pure(out); got != tt.pure {
+			t.Errorf("%s: pure pixels = %v, want %v", tt.filter, got, tt.pure)
+		}
+	}
+
+	for _, tt := range []struct {
+		t, want float64
+	}{{0, 1}, {1, 0}, {2, 0}, {0.5, 0.6079}} {
+		if got := lanczos3.At(tt.t); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("lanczos3(%g) = %g, want %g", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	for in, want := range map[string]string{"Lanczos": FilterLanczos, " nearest ": FilterNearest, "FAST": FilterFast, "auto": FilterAuto, "box": "", "": ""} {
+		if got := ParseFilter(in); got != want {
+			t.Errorf("ParseFilter(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// photo returns an n x n image of smooth gradients crossed by hard edges
+// and a translucent disc, standing in for a detailed icon source.
+func photo(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			c := color.NRGBA{R: uint8(x * 255 / n), G: uint8(y * 255 / n), B: uint8((x + y) * 127 / n), A: 0xff}
+			if (x*8/n+y*8/n)%2 == 0 {
+				c.B = 0xff - c.B
+			}
+			if dx, dy := x-n/2, y-n/2; dx*dx+dy*dy < n*n/9 {
+				c.A = 0x80
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestFastFilterQuality(t *testing.T) {
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 300, 300), image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i % 251)
+	}
+	for _, tt := range []struct {
+		name string
+		src  image.Image
+		size int
+	}{
+		{"512 to 64", photo(512), 64},
+		{"500 to 48", photo(500), 48},
+		{"1024 to 16", photo(1024), 16},
+		{"96 to 64", photo(96), 64},
+		{"16 up to 64", gradient(16), 64},
+		{"ycbcr 300 to 32", ycbcr, 32},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fast := ResizeImageWith(tt.src, tt.size, FilterFast)
+			if fast.Bounds() != image.Rect(0, 0, tt.size, tt.size) {
+				t.Fatalf("bounds = %v", fast.Bounds())
+			}
+			ref := ResizeImageWith(tt.src, tt.size, FilterLanczos)
+			d := CompareImages(fast, ref, tt.size)
+			// About what BiLinear, a proper kernel filter, scores
+			if d.Similarity < 0.98 || d.Changed > 0.01 {
+				t.Errorf("fast vs lanczos: similarity %.4f, changed %.3f", d.Similarity, d.Changed)
+			}
+		})
+	}
+
+	// Fully transparent pixels must not bleed their colour into the average
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(src.Pix); i += 4 {
+		if i/4%64 < 32 {
+			copy(src.Pix[i:], []uint8{0xff, 0xff, 0xff, 0})
+		} else {
+			copy(src.Pix[i:], []uint8{0, 0, 0xff, 0xff})
+		}
+	}
+	mid := boxShrink(src, src.Bounds(), 32)
+	if got := mid.RGBA64At(0, 0); got != (color.RGBA64{}) {
+		t.Errorf("transparent box = %v, want transparent black", got)
+	}
+	if got := mid.RGBA64At(1, 1); got != (color.RGBA64{B: 0xffff, A: 0xffff}) {
+		t.Errorf("opaque box = %v", got)
+	}
+}
+
+func TestResizeKeepsFaintColour(t *testing.T) {
+	// At alpha 8, 8-bit premultiplied storage leaves only nine levels per
+	// channel; the colour must still survive the round trip
+	big := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(big.Pix); i += 4 {
+		copy(big.Pix[i:], []uint8{200, 100, 50, 8})
+	}
+	for _, filter := range []string{FilterLanczos, FilterCatmullRom, FilterBilinear, FilterFast} {
+		got := color.NRGBAModel.Convert(ResizeImageWith(big, 16, filter).At(8, 8)).(color.NRGBA)
+		if absDiff(got.R, 200) > 2 || absDiff(got.G, 100) > 2 || absDiff(got.B, 50) > 2 || got.A != 8 {
+			t.Errorf("%s: pixel = %v, want {200 100 50 8}", filter, got)
+		}
+	}
+}
+
+func BenchmarkResizeImageWith(b *testing.B) {
+	for _, src := range []struct {
+		edge, size int
+	}{{512, 64}, {1024, 32}, {128, 64}} {
+		img := photo(src.edge)
+		for _, filter := range []string{FilterCatmullRom, FilterLanczos, FilterBilinear, FilterFast} {
+			b.Run(fmt.Sprintf("%d-%d/%s", src.edge, src.size, filter), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					ResizeImageWith(img, src.size, filter)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package image
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// touchIcon returns an n x n stand-in for an apple-touch-icon: a white
+// rounded tile with thin dark strokes and a red disc, the detail a 16px
+// favicon loses first.
+func touchIcon(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	r := n / 6
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			// Rounded corners stay transparent
+			cx, cy := min(max(x, r), n-1-r), min(max(y, r), n-1-r)
+			if dx, dy := x-cx, y-cy; dx*dx+dy*dy > r*r {
+				continue
+			}
+			c := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			stroke := n / 24
+			if (x/stroke)%4 == 1 && y > n/4 && y < 3*n/4 {
+				c = color.NRGBA{R: 0x20, G: 0x20, B: 0x40, A: 0xff}
+			}
+			if dx, dy := x-3*n/4, y-n/4; dx*dx+dy*dy < n*n/64 {
+				c = color.NRGBA{R: 0xe0, G: 0x20, B: 0x20, A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func setSharpen(t *testing.T, amount float64) {
+	t.Helper()
+	old := Sharpen
+	Sharpen = amount
+	t.Cleanup(func() { Sharpen = old })
+}
+
+// edgeEnergy sums the absolute differences between horizontal neighbours,
+// a rough measure of how crisp an image looks.
+func edgeEnergy(img image.Image) int {
+	b := img.Bounds()
+	sum := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X + 1; x < b.Max.X; x++ {
+			p, q := color.RGBAModel.Convert(img.At(x-1, y)).(color.RGBA), color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			sum += absDiff(p.R, q.R) + absDiff(p.G, q.G) + absDiff(p.B, q.B)
+		}
+	}
+	return sum
+}
+
+func TestSharpenGolden(t *testing.T) {
+	setSharpen(t, 0.8)
+	src := touchIcon(192)
+	for _, tt := range []struct {
+		name   string
+		size   int
+		filter string
+	}{
+		{"lanczos-16", 16, FilterLanczos},
+		{"lanczos-32", 32, FilterLanczos},
+		{"fast-16", 16, FilterFast},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ResizeImageWith(src, tt.size, tt.filter)
+			path := filepath.Join("testdata", "sharpen-"+tt.name+".png")
+			if *updateGolden {
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, got); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create)", err)
+			}
+			want, err := png.Decode(bytes.NewReader(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want.Bounds() != got.Bounds() {
+				t.Fatalf("bounds = %v, golden %v", got.Bounds(), want.Bounds())
+			}
+			// Floating point may round differently across architectures
+			b := got.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					p := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+					q := color.NRGBAModel.Convert(want.At(x, y)).(color.NRGBA)
+					if absDiff(p.R, q.R) > 2 || absDiff(p.G, q.G) > 2 || absDiff(p.B, q.B) > 2 || absDiff(p.A, q.A) > 2 {
+						t.Fatalf("pixel (%d,%d) = %v, golden %v", x, y, p, q)
+					}
+				}
+			}
+
+			Sharpen = 0
+			plain := ResizeImageWith(src, tt.size, tt.filter)
+			Sharpen = 0.8
+			if e, pe := edgeEnergy(got), edgeEnergy(plain); e <= pe {
+				t.Errorf("edge energy %d, unsharpened %d", e, pe)
+			}
+		})
+	}
+}
+
+func TestSharpenSkips(t *testing.T) {
+	setSharpen(t, 1)
+	same := func(a, b image.Image) bool {
+		return CompareImages(a, b, a.Bounds().Dx()).Similarity == 1
+	}
+	unsharpened := func(img image.Image, size int, filter string) image.Image {
+		Sharpen = 0
+		defer func() { Sharpen = 1 }()
+		return ResizeImageWith(img, size, filter)
+	}
+
+	// Larger outputs, upscales and nearest neighbour are left alone
+	for _, tt := range []struct {
+		name   string
+		src    image.Image
+		size   int
+		filter string
+	}{
+		{"48px output", touchIcon(192), 48, FilterLanczos},
+		{"upscale", checker(8), 16, FilterCatmullRom},
+		{"nearest", touchIcon(64), 16, FilterNearest},
+	} {
+		if !same(ResizeImageWith(tt.src, tt.size, tt.filter), unsharpened(tt.src, tt.size, tt.filter)) {
+			t.Errorf("%s: sharpened", tt.name)
+		}
+	}
+
+	// Smooth gradients fall under the threshold
+	if g := gradient(128); !same(ResizeImageWith(g, 16, FilterLanczos), unsharpened(g, 16, FilterLanczos)) {
+		t.Error("gradient sharpened")
+	}
+
+	// An opaque square on transparency gets no halo: transparent pixels
+	// stay transparent black and colour never exceeds alpha
+	sq := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for y := 32; y < 96; y++ {
+		for x := 32; x < 96; x++ {
+			sq.SetNRGBA(x, y, color.NRGBA{R: 0x30, G: 0x90, B: 0xf0, A: 0xff})
+		}
+	}
+	out := ResizeImageWith(sq, 16, FilterLanczos)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			r, g, b, a := out.At(x, y).RGBA()
+			if a == 0 && r|g|b != 0 || r > a || g > a || b > a {
+				t.Fatalf("pixel (%d,%d) = %v", x, y, out.At(x, y))
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SVG renderer backend names accepted by NewSVGRenderer.
+const (
+	SVGRendererEmbedded = "resvg-wasm"
+	SVGRendererCLI      = "resvg-cli"
+)
+
+// SVGRenderer rasterizes an SVG document at the given pixel size.
+type SVGRenderer interface {
+	Name() string
+	Render(svg []byte, width, height int) (image.Image, error)
+}
+
+var (
+	svgRendererMu sync.RWMutex
+	svgRenderer   SVGRenderer = resvgWASMRenderer{}
+)
+
+// SetSVGRenderer replaces the backend used by RasterizeSVG.
+func SetSVGRenderer(r SVGRenderer) {
+	svgRendererMu.Lock()
+	svgRenderer = r
+	svgRendererMu.Unlock()
+}
+
+func currentSVGRenderer() SVGRenderer {
+	svgRendererMu.RLock()
+	defer svgRendererMu.RUnlock()
+	return svgRenderer
+}
+
+// NewSVGRenderer builds a backend by name. binPath is only used by the
+// CLI backend ("" = look up "resvg" on PATH).
+func NewSVGRenderer(name, binPath string) (SVGRenderer, error) {
+	switch name {
+	case "", SVGRendererEmbedded:
+		return resvgWASMRenderer{}, nil
+	case SVGRendererCLI:
+		return NewResvgCLIRenderer(binPath, 0)
+	default:
+		return nil, fmt.Errorf("unknown svg renderer %q", name)
+	}
+}
+
+// DefaultResvgCLITimeout bounds one invocation of the external resvg binary.
+const DefaultResvgCLITimeout = 5 * time.Second
+
+// resvgCLIRenderer pipes SVGs through an external resvg executable.
+type resvgCLIRenderer struct {
+	path    string
+	timeout time.Duration
+}
+
+// NewResvgCLIRenderer returns a backend that runs the resvg binary at path
+// (resolved via PATH). SVGs referencing external resources are rejected
+// since the binary, unlike the embedded build, can read the filesystem.
+func NewResvgCLIRenderer(path string, timeout time.Duration) (SVGRenderer, error) {
+	if path == "" {
+		path = "resvg"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("resvg binary: %w", err)
+	}
+	if timeout <= 0 {
+		timeout = DefaultResvgCLITimeout
+	}
+	return &resvgCLIRenderer{path: resolved, timeout: timeout}, nil
+}
+
+func (r *resvgCLIRenderer) Name() string { return SVGRendererCLI }
+
+func (r *resvgCLIRenderer) Render(svgBytes []byte, width, height int) (image.Image, error) {
+	if hasExternalReferences(svgBytes) {
+		return nil, errors.New("svg references external resources")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	// "-" reads stdin, "-c" writes the PNG to stdout
+	cmd := exec.CommandContext(ctx, r.path,
+		"--width", strconv.Itoa(width),
+		"--height", strconv.Itoa(height),
+		"-", "-c")
+	cmd.Stdin = bytes.NewReader(svgBytes)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("resvg: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("resvg: %w", err)
+	}
+
+	img, err := png.Decode(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return img, nil
+}
+
+var hrefAttr = regexp.MustCompile(`(?i)href\s*=\s*["']\s*([^"']*)`)
+
+// hasExternalReferences reports whether any href points outside the document
+// (anything but fragment and data: references).
+func hasExternalReferences(svg []byte) bool {
+	for _, m := range hrefAttr.FindAllSubmatch(svg, -1) {
+		v := strings.ToLower(string(m[1]))
+		if v == "" || strings.HasPrefix(v, "#") || strings.HasPrefix(v, "data:") {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os/exec"
+	"testing"
+)
+
+type stubSVGRenderer struct {
+	calls int
+	w, h  int
+}
+
+func (r *stubSVGRenderer) Name() string { return "stub" }
+
+func (r *stubSVGRenderer) Render(svg []byte, width, height int) (image.Image, error) {
+	r.calls++
+	r.w, r.h = width, height
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.NRGBA{B: 255, A: 255})
+	return img, nil
+}
+
+func TestSetSVGRenderer(t *testing.T) {
+	prev := currentSVGRenderer()
+	defer SetSVGRenderer(prev)
+
+	stub := &stubSVGRenderer{}
+	SetSVGRenderer(stub)
+
+	img, err := RasterizeSVG([]byte(`<svg viewBox="0 0 1 1"></svg>`), 24, 24)
+	if err != nil {
+		t.Fatalf("RasterizeSVG() error = %v", err)
+	}
+	if stub.calls != 1 || stub.w != 24 || stub.h != 24 {
+		t.Errorf("renderer called %d times at %dx%d", stub.calls, stub.w, stub.h)
+	}
+	if _, ok := img.(*image.RGBA); !ok {
+		t.Errorf("RasterizeSVG() returned %T, want *image.RGBA", img)
+	}
+}
+
+func TestNewSVGRenderer(t *testing.T) {
+	r, err := NewSVGRenderer("", "")
+	if err != nil || r.Name() != SVGRendererEmbedded {
+		t.Errorf("default renderer = %v, %v", r, err)
+	}
+	if _, err := NewSVGRenderer("canvas", ""); err == nil {
+		t.Error("unknown backend should fail")
+	}
+	if _, err := NewSVGRenderer(SVGRendererCLI, "/nonexistent/resvg"); err == nil {
+		t.Error("missing resvg binary should fail at construction")
+	}
+}
+
+func TestHasExternalReferences(t *testing.T) {
+	tests := []struct {
+		svg  string
+		want bool
+	}{
+		{`<svg><use href="#a"/></svg>`, false},
+		{`<svg><image xlink:href="data:image/png;base64,AAAA"/></svg>`, false},
+		{`<svg><image href="/etc/passwd"/></svg>`, true},
+		{`<svg><image xlink:href='file:///tmp/x.png'/></svg>`, true},
+		{`<svg><image HREF = "https://example.com/x.png"/></svg>`, true},
+	}
+	for _, tt := range tests {
+		if got := hasExternalReferences([]byte(tt.svg)); got != tt.want {
+			t.Errorf("hasExternalReferences(%s) = %v, want %v", tt.svg, got, tt.want)
+		}
+	}
+}
+
+func TestResvgCLIRenderer(t *testing.T) {
+	if _, err := exec.LookPath("resvg"); err != nil {
+		t.Skip("resvg binary not installed")
+	}
+	r, err := NewResvgCLIRenderer("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := r.Render([]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect width="10" height="10" fill="red"/></svg>`), 16, 16)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if img.Bounds().Dx() != 16 {
+		t.Errorf("width = %d, want 16", img.Bounds().Dx())
+	}
+	if _, err := r.Render([]byte(`<svg><image href="/etc/hosts"/></svg>`), 16, 16); err == nil || errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("external reference should be rejected, got %v", err)
+	}
+}
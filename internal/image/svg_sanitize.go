@@ -0,0 +1,159 @@
+package image
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// svgDroppedElements are removed with their whole subtree: scripts, and
+// elements that embed HTML or other documents.
+var svgDroppedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"handler":       true, // SVG Tiny event handler
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+}
+
+var (
+	cssURL    = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+	cssImport = regexp.MustCompile(`(?i)@import[^;]*;?`)
+)
+
+// SanitizeSVG returns svg with everything that can run code or reach
+// outside the document removed:
+//   - script, foreignObject, handler, iframe, embed and object elements,
+//     with their content
+//   - on* event attributes
+//   - href and xlink:href values other than "#fragment" references and
+//     raster data: images
+//   - CSS @import rules and url() references other than fragments and
+//     raster data: images, in style elements and attributes like fill
+//   - the DOCTYPE (and with it any entity definitions), processing
+//     instructions and comments
+//
+// The result is re-serialized UTF-8. Malformed XML yields an error.
+func SanitizeSVG(svg []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(svg))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charset.NewReaderLabel
+
+	var out bytes.Buffer
+	// RawToken leaves nesting unchecked; open tracks it so a stray end tag
+	// cannot close a dropped element early
+	var open []xml.Name
+	skip := 0        // depth inside a dropped element
+	inStyle := false // directly inside a <style> element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("svg: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skip > 0 || svgDroppedElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			inStyle = strings.EqualFold(t.Name.Local, "style")
+			out.WriteByte('<')
+			out.WriteString(qualifiedName(t.Name))
+			for _, a := range t.Attr {
+				v, ok := sanitizeSVGAttr(a)
+				if !ok {
+					continue
+				}
+				out.WriteByte(' ')
+				out.WriteString(qualifiedName(a.Name))
+				out.WriteString(`="`)
+				xml.EscapeText(&out, []byte(v))
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, fmt.Errorf("svg: unexpected end element </%s>", qualifiedName(t.Name))
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</")
+			out.WriteString(qualifiedName(t.Name))
+			out.WriteByte('>')
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			text := []byte(t)
+			if inStyle {
+				text = []byte(sanitizeCSS(string(t)))
+			}
+			xml.EscapeText(&out, text)
+		}
+		// Directives, processing instructions and comments are dropped
+	}
+	if len(open) > 0 {
+		return nil, fmt.Errorf("svg: unclosed element <%s>", qualifiedName(open[len(open)-1]))
+	}
+	return out.Bytes(), nil
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// sanitizeSVGAttr returns the value to keep for a, or false to drop it.
+func sanitizeSVGAttr(a xml.Attr) (string, bool) {
+	name := strings.ToLower(a.Name.Local)
+	if a.Name.Space == "" && strings.HasPrefix(name, "on") {
+		return "", false
+	}
+	if name == "href" && a.Name.Space != "xmlns" {
+		return a.Value, internalSVGRef(a.Value)
+	}
+	if strings.Contains(strings.ToLower(a.Value), "url(") || strings.Contains(strings.ToLower(a.Value), "@import") {
+		return sanitizeCSS(a.Value), true
+	}
+	return a.Value, true
+}
+
+// sanitizeCSS drops @import rules and replaces external url() references
+// with none.
+func sanitizeCSS(css string) string {
+	css = cssImport.ReplaceAllString(css, "")
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		if sub := cssURL.FindStringSubmatch(m); internalSVGRef(sub[2]) {
+			return m
+		}
+		return "none"
+	})
+}
+
+// internalSVGRef reports whether ref stays inside the document: a
+// fragment, or a raster data: image within MaxPixels (SVG data: images
+// could nest the references being removed).
+func internalSVGRef(ref string) bool {
+	lower := strings.ToLower(strings.TrimSpace(ref))
+	if strings.HasPrefix(lower, "#") {
+		return true
+	}
+	return strings.HasPrefix(lower, "data:image/") && !strings.HasPrefix(lower, "data:image/svg") && dataURIWithinBudget(ref)
+}
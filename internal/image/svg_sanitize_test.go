@@ -0,0 +1,122 @@
+package image
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		drop []string // substrings that must be gone
+		keep []string // substrings that must survive
+	}{
+		{
+			name: "script",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><SCRIPT type="text/ecmascript"><![CDATA[fetch("//evil")]]></SCRIPT><rect width="1" height="1"/></svg>`,
+			drop: []string{"script", "SCRIPT", "alert", "evil"},
+			keep: []string{`<rect width="1" height="1">`},
+		},
+		{
+			name: "event attributes",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><circle r="1" onClick="alert(2)" offset="0"/></svg>`,
+			drop: []string{"onload", "onClick", "alert"},
+			keep: []string{`offset="0"`},
+		},
+		{
+			name: "foreignObject",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg"><foreignObject width="10" height="10"><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="http://evil/"></iframe></body></foreignObject><g/></svg>`,
+			drop: []string{"foreignObject", "body", "iframe", "evil"},
+			keep: []string{"<g></g>"},
+		},
+		{
+			name: "external href",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image href="http://evil/a.png"/><image xlink:href="file:///etc/passwd"/><use href="https://evil/sprite.svg#a"/><image href="data:image/svg+xml;base64,PHN2Zy8+"/></svg>`,
+			drop: []string{"evil", "passwd", "svg+xml"},
+			keep: []string{`xmlns:xlink="http://www.w3.org/1999/xlink"`},
+		},
+		{
+			name: "internal href",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><defs><linearGradient id="g"/></defs><use xlink:href="#g"/><image href="data:image/png;base64,iVBORw0KGgo="/></svg>`,
+			keep: []string{`xlink:href="#g"`, `href="data:image/png;base64,iVBORw0KGgo="`},
+		},
+		{
+			name: "css",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg"><style>@import url("http://evil/a.css"); rect { fill: url(http://evil/p.svg#p) } circle { fill: url(#g) }</style><rect style="background: url('//evil/b.png')" fill="url(#g)" mask="url(http://evil/m)"/></svg>`,
+			drop: []string{"evil", "@import"},
+			keep: []string{"fill: url(#g)", `fill="url(#g)"`, `mask="none"`},
+		},
+		{
+			name: "entities",
+			in:   `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><!-- hi --><svg xmlns="http://www.w3.org/2000/svg"><text>&xxe;</text></svg>`,
+			drop: []string{"DOCTYPE", "ENTITY", "passwd", "<?xml", "hi"},
+			keep: []string{"<text>"},
+		},
+		{
+			name: "escaping",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg"><text id="a&quot;b">1 &lt; 2 &amp;&nbsp;</text></svg>`,
+			keep: []string{`id="a&#34;b"`, "1 &lt; 2 &amp;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := SanitizeSVG([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("SanitizeSVG() error = %v", err)
+			}
+			got := string(out)
+			for _, s := range tt.drop {
+				if strings.Contains(got, s) {
+					t.Errorf("output still contains %q: %s", s, got)
+				}
+			}
+			for _, s := range tt.keep {
+				if !strings.Contains(got, s) {
+					t.Errorf("output lost %q: %s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeSVGMalformed(t *testing.T) {
+	for _, in := range []string{
+		`<svg><g></svg>`,
+		`<svg><g>`,
+		`<svg><script></g>alert(1)</script></svg>`,
+	} {
+		if _, err := SanitizeSVG([]byte(in)); err == nil {
+			t.Errorf("SanitizeSVG(%s) accepted mismatched tags", in)
+		}
+	}
+}
+
+type capturingSVGRenderer struct {
+	stubSVGRenderer
+	svg string
+}
+
+func (r *capturingSVGRenderer) Render(svg []byte, width, height int) (image.Image, error) {
+	r.svg = string(svg)
+	return r.stubSVGRenderer.Render(svg, width, height)
+}
+
+func TestRasterizeSVGSanitizes(t *testing.T) {
+	prev := currentSVGRenderer()
+	defer SetSVGRenderer(prev)
+
+	r := &capturingSVGRenderer{}
+	SetSVGRenderer(r)
+
+	if _, err := RasterizeSVG([]byte(`<svg viewBox="0 0 1 1"><script>alert(1)</script></svg>`), 16, 16); err != nil {
+		t.Fatalf("RasterizeSVG() error = %v", err)
+	}
+	if strings.Contains(r.svg, "script") {
+		t.Errorf("renderer got unsanitized SVG: %s", r.svg)
+	}
+	if _, err := RasterizeSVG([]byte(`<svg><g></svg>`), 16, 16); err == nil {
+		t.Error("RasterizeSVG() accepted malformed SVG")
+	}
+}
@@ -0,0 +1,59 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// MaxSVGBytes caps a gzip-compressed SVG once decompressed, so a small
+// .svgz cannot expand into a decompression bomb.
+const MaxSVGBytes = 4 << 20
+
+// ErrSVGTooLarge is returned for compressed SVGs that decompress to more
+// than MaxSVGBytes.
+var ErrSVGTooLarge = errors.New("decompressed SVG exceeds the size limit")
+
+// gzipMagic starts every gzip stream (RFC 1952).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip reports whether b is gzip data, as .svgz files and SVGs served
+// pre-compressed without a Content-Encoding header are.
+func isGzip(b []byte) bool {
+	return bytes.HasPrefix(b, gzipMagic)
+}
+
+// gunzipSVG returns b decompressed when it is gzip data and b itself
+// otherwise.
+func gunzipSVG(b []byte) ([]byte, error) {
+	if !isGzip(b) {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, MaxSVGBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxSVGBytes {
+		return nil, ErrSVGTooLarge
+	}
+	return out, nil
+}
+
+// gunzipHead returns up to the first n decompressed bytes of gzip data b,
+// for sniffing without inflating the whole stream.
+func gunzipHead(b []byte, n int) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	head := make([]byte, n)
+	m, _ := io.ReadFull(zr, head)
+	return head[:m]
+}
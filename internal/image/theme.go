@@ -0,0 +1,131 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Themes name the UI background an icon is shown on.
+const (
+	ThemeDark  = "dark"
+	ThemeLight = "light"
+)
+
+// Themes lists every supported theme.
+var Themes = []string{ThemeDark, ThemeLight}
+
+const (
+	// themeClashFraction is the share of visible pixels that must be close
+	// to the background's brightness for an icon to count as lost on it.
+	themeClashFraction = 0.9
+	// themeChromaLimit is the channel spread below which a pixel is grey;
+	// icons with almost only grey pixels are inverted rather than plated.
+	themeChromaLimit = 48
+	// themePlateScale is the icon's edge length on a plate relative to the
+	// plate's diameter, leaving its corners inside the circle.
+	themePlateScale = 0.72
+)
+
+// Theme plate colours: a light plate behind dark icons on dark UIs, and the
+// reverse.
+var (
+	plateForDark  = color.NRGBA{R: 0xf1, G: 0xf3, B: 0xf4, A: 0xff}
+	plateForLight = color.NRGBA{R: 0x20, G: 0x21, B: 0x24, A: 0xff}
+)
+
+// ThemeAdjustment is what ApplyTheme did to an icon.
+type ThemeAdjustment string
+
+const (
+	ThemeUnchanged ThemeAdjustment = "none"
+	ThemeInverted  ThemeAdjustment = "inverted"
+	ThemePlated    ThemeAdjustment = "plate"
+)
+
+// ApplyTheme adapts img for display on a dark or light background. An icon
+// with transparent areas whose visible pixels are almost all as dark (or as
+// light) as the background would disappear on it: a monochrome one is
+// inverted, a coloured one is drawn on a contrasting circular plate.
+// Opaque icons carry their own background and, like every icon for an
+// unknown theme, are returned unchanged.
+func ApplyTheme(img image.Image, theme string) (image.Image, ThemeAdjustment) {
+	var plate color.NRGBA
+	var clashes func(lum int) bool
+	switch theme {
+	case ThemeDark:
+		plate, clashes = plateForDark, func(lum int) bool { return lum < 80 }
+	case ThemeLight:
+		plate, clashes = plateForLight, func(lum int) bool { return lum > 176 }
+	default:
+		return img, ThemeUnchanged
+	}
+
+	b := img.Bounds()
+	var visible, transparent, clash, coloured int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 0x40 {
+				transparent++
+				continue
+			}
+			visible++
+			if clashes((299*int(c.R) + 587*int(c.G) + 114*int(c.B)) / 1000) {
+				clash++
+			}
+			if max(int(c.R), max(int(c.G), int(c.B)))-int(min(c.R, c.G, c.B)) > themeChromaLimit {
+				coloured++
+			}
+		}
+	}
+	if visible == 0 || transparent*20 < b.Dx()*b.Dy() || float64(clash) < themeClashFraction*float64(visible) {
+		return img, ThemeUnchanged
+	}
+	if coloured*20 <= visible {
+		return invertImage(img), ThemeInverted
+	}
+	return plateImage(img, plate), ThemePlated
+}
+
+// invertImage inverts the colour of every pixel, keeping its alpha.
+func invertImage(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			dst.SetNRGBA(x-b.Min.X, y-b.Min.Y, color.NRGBA{R: 255 - c.R, G: 255 - c.G, B: 255 - c.B, A: c.A})
+		}
+	}
+	return dst
+}
+
+// plateImage draws img, scaled down, on a circle of colour plate filling
+// the image's bounds.
+func plateImage(img image.Image, plate color.NRGBA) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	// Antialiased edge: coverage falls off over the outermost pixel
+	cx, cy, r := float64(w)/2, float64(h)/2, float64(min(w, h))/2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)
+			cover := math.Max(0, math.Min(1, r-d+0.5))
+			if cover > 0 {
+				c := plate
+				c.A = uint8(cover * 255)
+				dst.Set(x, y, c)
+			}
+		}
+	}
+
+	iw, ih := int(math.Round(float64(w)*themePlateScale)), int(math.Round(float64(h)*themePlateScale))
+	inner := image.Rect((w-iw)/2, (h-ih)/2, (w-iw)/2+iw, (h-ih)/2+ih)
+	draw.CatmullRom.Scale(dst, inner, img, b, draw.Over, nil)
+	return dst
+}
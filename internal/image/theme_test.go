@@ -0,0 +1,68 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// glyph draws c as a centred square covering half of a transparent 32x32
+// canvas, or the whole canvas when opaque is set.
+func glyph(c color.NRGBA, opaque bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if opaque || (x >= 8 && x < 24 && y >= 8 && y < 24) {
+				img.SetNRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func TestApplyTheme(t *testing.T) {
+	black := color.NRGBA{R: 0x10, G: 0x10, B: 0x10, A: 0xff}
+	navy := color.NRGBA{R: 0x10, G: 0x20, B: 0x80, A: 0xff}
+	white := color.NRGBA{R: 0xfa, G: 0xfa, B: 0xfa, A: 0xff}
+	tests := []struct {
+		name  string
+		img   image.Image
+		theme string
+		want  ThemeAdjustment
+	}{
+		{"black glyph on dark", glyph(black, false), ThemeDark, ThemeInverted},
+		{"black glyph on light", glyph(black, false), ThemeLight, ThemeUnchanged},
+		{"white glyph on light", glyph(white, false), ThemeLight, ThemeInverted},
+		{"navy glyph on dark", glyph(navy, false), ThemeDark, ThemePlated},
+		{"opaque black square", glyph(black, true), ThemeDark, ThemeUnchanged},
+		{"unknown theme", glyph(black, false), "sepia", ThemeUnchanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, adj := ApplyTheme(tt.img, tt.theme)
+			if adj != tt.want {
+				t.Fatalf("adjustment = %s, want %s", adj, tt.want)
+			}
+			if out.Bounds().Size() != tt.img.Bounds().Size() {
+				t.Errorf("size = %v, want %v", out.Bounds().Size(), tt.img.Bounds().Size())
+			}
+			centre := color.NRGBAModel.Convert(out.At(16, 16)).(color.NRGBA)
+			corner := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA)
+			switch adj {
+			case ThemeInverted:
+				in := color.NRGBAModel.Convert(tt.img.At(16, 16)).(color.NRGBA)
+				if centre.R != 255-in.R || centre.A != in.A || corner.A != 0 {
+					t.Errorf("centre %v, corner %v; want inverted glyph, transparency kept", centre, corner)
+				}
+			case ThemePlated:
+				edge := color.NRGBAModel.Convert(out.At(2, 16)).(color.NRGBA)
+				if edge != plateForDark || corner.A != 0 {
+					t.Errorf("edge %v, corner %v; want a round plate", edge, corner)
+				}
+				if centre.B < 0x70 || centre.R > 0x30 {
+					t.Errorf("centre %v, want the glyph's colour kept", centre)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Package ipfs provides a minimal client for the IPFS (Kubo) HTTP RPC API,
+// used to pin exported favicons into content-addressed storage.
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MaxBlockBytes is the largest block a Kubo node accepts by default.
+// Larger payloads would be chunked and receive a different CID.
+const MaxBlockBytes = 1 << 20
+
+// Client talks to the RPC API of a configured IPFS node (e.g. http://127.0.0.1:5001).
+// The node is operator-configured, so requests do not go through the SSRF-validated dialer.
+type Client struct {
+	APIURL string
+	HTTP   *http.Client
+}
+
+// NewClient creates a client for the node RPC API at apiURL.
+func NewClient(apiURL string) *Client {
+	return &Client{
+		APIURL: strings.TrimRight(apiURL, "/"),
+		HTTP:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// PutBlock stores data as a raw sha2-256 block and pins it.
+// It returns the CID reported by the node, which matches cache.ContentCID(data).
+func (c *Client) PutBlock(ctx context.Context, data []byte) (string, error) {
+	if len(data) > MaxBlockBytes {
+		return "", fmt.Errorf("ipfs: block too large (%d bytes)", len(data))
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("data", "icon")
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return "", err
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("cid-codec", "raw")
+	q.Set("mhtype", "sha2-256")
+	q.Set("pin", "true")
+	endpoint := c.APIURL + "/api/v0/block/put?" + q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ipfs: block/put status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var out struct {
+		Key string `json:"Key"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return "", err
+	}
+	if out.Key == "" {
+		return "", errors.New("ipfs: empty CID in response")
+	}
+	return out.Key, nil
+}
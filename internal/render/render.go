@@ -0,0 +1,194 @@
+// Package render loads pages in a headless Chrome via the DevTools protocol
+// and returns the DOM after scripts have run. It is used as a last-resort
+// discovery step for sites that only add their icon links from JavaScript.
+package render
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/security"
+	"faviconsvc/pkg/logger"
+
+	"github.com/chromedp/cdproto/cdp"
+	cdpfetch "github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// DefaultTimeout bounds a single page render including script execution.
+	DefaultTimeout = 10 * time.Second
+	// DefaultConcurrency is the number of tabs rendered at once.
+	DefaultConcurrency = 2
+
+	// iconPollTimeout is how long to wait after load for scripts to inject an icon link.
+	iconPollTimeout = 2 * time.Second
+	iconSelector    = `!!document.querySelector('link[rel~="icon" i], link[rel*="apple-touch-icon" i]')`
+)
+
+// Options configures a Renderer.
+type Options struct {
+	ChromePath  string        // empty = locate Chrome on PATH
+	Timeout     time.Duration // per-page render timeout
+	Concurrency int           // max simultaneous tabs
+}
+
+// Renderer owns one headless browser process shared by all renders.
+type Renderer struct {
+	allocCtx    context.Context
+	cancelAlloc context.CancelFunc
+	browserCtx  context.Context
+	cancel      context.CancelFunc
+	timeout     time.Duration
+	sem         chan struct{}
+}
+
+// New starts a headless browser. Close must be called to terminate it.
+func New(opts Options) (*Renderer, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+
+	allocOpts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.UserAgent(fetch.UABrowser),
+		chromedp.Flag("blink-settings", "imagesEnabled=false"),
+		chromedp.Flag("mute-audio", true),
+	)
+	if opts.ChromePath != "" {
+		allocOpts = append(allocOpts, chromedp.ExecPath(opts.ChromePath))
+	}
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), allocOpts...)
+	browserCtx, cancel := chromedp.NewContext(allocCtx)
+
+	// Launch the browser now so a missing binary fails at startup, not per request
+	if err := chromedp.Run(browserCtx); err != nil {
+		cancel()
+		cancelAlloc()
+		return nil, err
+	}
+
+	return &Renderer{
+		allocCtx:    allocCtx,
+		cancelAlloc: cancelAlloc,
+		browserCtx:  browserCtx,
+		cancel:      cancel,
+		timeout:     opts.Timeout,
+		sem:         make(chan struct{}, opts.Concurrency),
+	}, nil
+}
+
+// Close shuts down the browser process.
+func (r *Renderer) Close() {
+	r.cancel()
+	r.cancelAlloc()
+}
+
+// RenderDOM loads pageURL in a fresh tab and returns the serialized DOM.
+// Every request the page makes is validated against the same SSRF rules as
+// direct fetches; images, media and fonts are never downloaded.
+func (r *Renderer) RenderDOM(ctx context.Context, pageURL string) (string, error) {
+	select {
+	case r.sem <- struct{}{}:
+		defer func() { <-r.sem }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	tabCtx, cancelTab := chromedp.NewContext(r.browserCtx)
+	defer cancelTab()
+	tabCtx, cancelTimeout := context.WithTimeout(tabCtx, r.timeout)
+	defer cancelTimeout()
+
+	// Stop the render when the originating request goes away
+	stop := context.AfterFunc(ctx, cancelTab)
+	defer stop()
+
+	guard := newRequestGuard()
+	chromedp.ListenTarget(tabCtx, func(ev any) {
+		if ev, ok := ev.(*cdpfetch.EventRequestPaused); ok {
+			go guard.handle(tabCtx, ev)
+		}
+	})
+
+	var dom string
+	err := chromedp.Run(tabCtx,
+		cdpfetch.Enable(),
+		chromedp.Navigate(pageURL),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			// Icons may be injected after load; a timeout here is not an error
+			_ = chromedp.Poll(iconSelector, nil, chromedp.WithPollingTimeout(iconPollTimeout)).Do(ctx)
+			return nil
+		}),
+		chromedp.OuterHTML("html", &dom, chromedp.ByQuery),
+	)
+	if err != nil {
+		return "", err
+	}
+	if dom == "" {
+		return "", errors.New("empty dom")
+	}
+	return dom, nil
+}
+
+// requestGuard decides which intercepted requests the page may make,
+// caching validation per host so DNS is checked once per render.
+type requestGuard struct {
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+func newRequestGuard() *requestGuard {
+	return &requestGuard{hosts: make(map[string]bool)}
+}
+
+func (g *requestGuard) allowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || !security.IsAllowedScheme(u) {
+		return false
+	}
+	key := u.Scheme + "://" + u.Host
+	g.mu.Lock()
+	ok, seen := g.hosts[key]
+	g.mu.Unlock()
+	if seen {
+		return ok
+	}
+	_, err = security.NormalizeURL(key)
+	ok = err == nil
+	g.mu.Lock()
+	g.hosts[key] = ok
+	g.mu.Unlock()
+	return ok
+}
+
+func (g *requestGuard) handle(ctx context.Context, ev *cdpfetch.EventRequestPaused) {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Target == nil {
+		return
+	}
+	execCtx := cdp.WithExecutor(ctx, c.Target)
+
+	var err error
+	switch ev.ResourceType {
+	case network.ResourceTypeImage, network.ResourceTypeMedia, network.ResourceTypeFont:
+		err = cdpfetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient).Do(execCtx)
+	default:
+		if g.allowed(ev.Request.URL) {
+			err = cdpfetch.ContinueRequest(ev.RequestID).Do(execCtx)
+		} else {
+			logger.Debug("Render blocked request to %s", ev.Request.URL)
+			err = cdpfetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient).Do(execCtx)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		logger.Debug("Render interception failed for %s: %v", ev.Request.URL, err)
+	}
+}
@@ -0,0 +1,249 @@
+// Package reqctx carries request-scoped state (request ID, tenant, caller,
+// negotiated output, deadline budget, debug flags and stage timings) through the discovery, fetch and
+// image layers via context, so cross-cutting options don't have to be threaded
+// as ever-growing positional parameters.
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"faviconsvc/pkg/logger"
+)
+
+// ctxKey is unexported so no other package can collide with or forge our keys.
+type ctxKey int
+
+const stateKey ctxKey = iota
+
+// Request headers read by Middleware.
+const (
+	HeaderRequestID = "X-Request-ID"
+	HeaderTenant    = "X-Tenant-ID"
+	HeaderDebug     = "X-Debug"
+	// HeaderDeadline is the time in milliseconds the caller will wait for
+	// the response; it can only shorten the configured budget.
+	HeaderDeadline = "X-Deadline-Ms"
+)
+
+const maxRequestIDLen = 64
+
+// DebugFlags toggle per-request diagnostics.
+type DebugFlags uint32
+
+const (
+	// DebugVerbose logs discovery and fetch steps at info level for this request.
+	DebugVerbose DebugFlags = 1 << iota
+	// DebugNoCache bypasses cache reads (results are still written).
+	DebugNoCache
+)
+
+var debugNames = map[string]DebugFlags{
+	"verbose": DebugVerbose,
+	"nocache": DebugNoCache,
+}
+
+// Has reports whether all flags in f2 are set.
+func (f DebugFlags) Has(f2 DebugFlags) bool {
+	return f&f2 == f2
+}
+
+// ParseDebugFlags parses a comma-separated flag list such as "verbose,nocache".
+// Unknown names are ignored.
+func ParseDebugFlags(s string) DebugFlags {
+	var f DebugFlags
+	for _, name := range strings.Split(s, ",") {
+		f |= debugNames[strings.ToLower(strings.TrimSpace(name))]
+	}
+	return f
+}
+
+// Principal is the authenticated caller of a request. The zero Principal is
+// an anonymous caller.
+type Principal struct {
+	ID          string   // key name, HMAC key ID or token subject ("" = anonymous)
+	Method      string   // authenticator that vouched for the caller, e.g. "apikey"
+	Tenant      string   // tenant the credentials belong to ("" = none)
+	Scopes      []string // scopes granted to the credentials
+	Permissions []string // service permissions, e.g. "read" or "purge"
+}
+
+// Anonymous reports whether p carries no identity.
+func (p Principal) Anonymous() bool {
+	return p.ID == ""
+}
+
+// Can reports whether p holds permission.
+func (p Principal) Can(permission string) bool {
+	for _, perm := range p.Permissions {
+		if perm == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// State is the request-scoped bag. Fields are filled in as the request
+// progresses: Middleware sets identity and budget, the handler sets the
+// negotiated Format, Size and processing options before discovery starts.
+type State struct {
+	RequestID string
+	Tenant    string
+	Principal Principal // set by auth.Middleware
+	Format    string
+	Size      int
+	Height    int       // height of a non-square sz=WxH target, Size being its width (0 = square)
+	DPR       float64   // device pixel ratio Size and Height were scaled by (0 = none)
+	Theme     string    // UI theme to adapt the icon for ("" = none)
+	Mask      string    // shape to clip the icon to, e.g. "rounded20" ("" = none)
+	Mono      string    // silhouette colour as 6 hex digits ("" = full colour)
+	Trim      bool      // trim the icon to its content bounds
+	Pad       int       // margin in percent of the edge around trimmed content
+	Filter    string    // resampling filter ("" = automatic)
+	Fit       string    // how a non-square icon is made square ("" = stretch)
+	Quality   int       // lossy encoder quality, 1-100 (0 = encoder default)
+	Deadline  time.Time // zero = no budget
+	Debug     DebugFlags
+	Timings   *Timings // stage durations for Server-Timing (nil = not recorded)
+
+	// SkipVariantCache keeps the variant rendered out of the resized cache,
+	// for domains over their variant limit
+	SkipVariantCache bool
+}
+
+// With returns a copy of ctx carrying st.
+func With(ctx context.Context, st *State) context.Context {
+	return context.WithValue(ctx, stateKey, st)
+}
+
+// Ensure returns ctx and its State, attaching a new empty State if ctx has none.
+func Ensure(ctx context.Context) (context.Context, *State) {
+	if st, ok := ctx.Value(stateKey).(*State); ok && st != nil {
+		return ctx, st
+	}
+	st := &State{}
+	return With(ctx, st), st
+}
+
+// From returns the state carried by ctx, or an empty State if there is none,
+// so callers never need a nil check.
+func From(ctx context.Context) *State {
+	if st, ok := ctx.Value(stateKey).(*State); ok && st != nil {
+		return st
+	}
+	return &State{}
+}
+
+// Budget returns the time remaining before the request deadline,
+// or 0 if the request has no budget.
+func Budget(ctx context.Context) time.Duration {
+	st := From(ctx)
+	if st.Deadline.IsZero() {
+		return 0
+	}
+	if left := time.Until(st.Deadline); left > 0 {
+		return left
+	}
+	return -1
+}
+
+// Debugf logs at debug level, or at info level when the request has
+// DebugVerbose set. Messages are prefixed with the request ID.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	st := From(ctx)
+	if st.RequestID != "" {
+		format = "[" + st.RequestID + "] " + format
+	}
+	if st.Debug.Has(DebugVerbose) {
+		logger.Info(format, args...)
+		return
+	}
+	logger.Debug(format, args...)
+}
+
+// Options configures Middleware.
+type Options struct {
+	// Budget is the overall time allowed per request (0 = no limit).
+	Budget time.Duration
+	// AllowDebug honours the X-Debug header; leave off in production since
+	// nocache lets clients force upstream fetches.
+	AllowDebug bool
+	// AllowDeadline honours the X-Deadline-Ms header, so internal callers
+	// can hold the service to their own SLAs.
+	AllowDeadline bool
+}
+
+// Middleware attaches a State to every request. The request ID is taken
+// from X-Request-ID when present and well-formed, otherwise generated, and is
+// echoed back in the response.
+func Middleware(opts Options) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st := &State{
+				RequestID: sanitizeID(r.Header.Get(HeaderRequestID)),
+				Tenant:    sanitizeID(r.Header.Get(HeaderTenant)),
+			}
+			if st.RequestID == "" {
+				st.RequestID = newRequestID()
+			}
+			if opts.AllowDebug {
+				st.Debug = ParseDebugFlags(r.Header.Get(HeaderDebug))
+			}
+			w.Header().Set(HeaderRequestID, st.RequestID)
+
+			ctx := r.Context()
+			budget := opts.Budget
+			if opts.AllowDeadline {
+				if d := ParseDeadline(r.Header.Get(HeaderDeadline)); d > 0 && (budget <= 0 || d < budget) {
+					budget = d
+				}
+			}
+			if budget > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, budget)
+				defer cancel()
+				st.Deadline, _ = ctx.Deadline()
+			}
+			next.ServeHTTP(w, r.WithContext(With(ctx, st)))
+		})
+	}
+}
+
+// ParseDeadline parses an X-Deadline-Ms value. It returns 0 for anything
+// but a positive whole number of milliseconds.
+func ParseDeadline(s string) time.Duration {
+	ms, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || ms <= 0 || ms > int64(time.Hour/time.Millisecond) {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// sanitizeID accepts client-supplied identifiers only if they are short and
+// made of safe characters, so they can be logged and echoed verbatim.
+func sanitizeID(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > maxRequestIDLen {
+		return ""
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return ""
+		}
+	}
+	return s
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,159 @@
+package reqctx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromWithoutState(t *testing.T) {
+	st := From(context.Background())
+	if st == nil || st.RequestID != "" {
+		t.Fatalf("From(empty) = %+v", st)
+	}
+	if Budget(context.Background()) != 0 {
+		t.Error("Budget without deadline should be 0")
+	}
+}
+
+func TestEnsureKeepsExisting(t *testing.T) {
+	ctx, st := Ensure(context.Background())
+	st.Size = 64
+	ctx2, st2 := Ensure(ctx)
+	if st2 != st || From(ctx2).Size != 64 {
+		t.Error("Ensure should reuse the attached state")
+	}
+}
+
+func TestParseDebugFlags(t *testing.T) {
+	f := ParseDebugFlags("Verbose, nocache,bogus")
+	if !f.Has(DebugVerbose) || !f.Has(DebugNoCache) {
+		t.Errorf("flags = %b", f)
+	}
+	if ParseDebugFlags("").Has(DebugVerbose) {
+		t.Error("empty string should set no flags")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var got State
+	var hasDeadline bool
+	h := Middleware(Options{Budget: time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *From(r.Context())
+		_, hasDeadline = r.Context().Deadline()
+	}))
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantID     string
+		wantTenant string
+	}{
+		{"client id", map[string]string{HeaderRequestID: "abc-123", HeaderTenant: "acme", HeaderDebug: "verbose"}, "abc-123", "acme"},
+		{"unsafe id replaced", map[string]string{HeaderRequestID: "bad id\n"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/favicons", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if got.RequestID == "" || (tt.wantID != "" && got.RequestID != tt.wantID) {
+				t.Errorf("RequestID = %q, want %q", got.RequestID, tt.wantID)
+			}
+			if got.Tenant != tt.wantTenant {
+				t.Errorf("Tenant = %q, want %q", got.Tenant, tt.wantTenant)
+			}
+			if w.Header().Get(HeaderRequestID) != got.RequestID {
+				t.Error("request ID not echoed in response")
+			}
+			if got.Debug != 0 {
+				t.Error("debug flags must be ignored unless AllowDebug is set")
+			}
+			if !hasDeadline || got.Deadline.IsZero() {
+				t.Error("budget should set a deadline")
+			}
+		})
+	}
+}
+
+func TestMiddlewareDeadlineHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		header string
+		want   time.Duration // 0 = no deadline
+	}{
+		{"shortens budget", Options{Budget: time.Minute, AllowDeadline: true}, "250", 250 * time.Millisecond},
+		{"cannot extend budget", Options{Budget: time.Second, AllowDeadline: true}, "60000", time.Second},
+		{"without budget", Options{AllowDeadline: true}, "500", 500 * time.Millisecond},
+		{"invalid ignored", Options{AllowDeadline: true}, "-5", 0},
+		{"not allowed", Options{}, "250", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var left time.Duration
+			h := Middleware(tt.opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				left = Budget(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/favicons", nil)
+			req.Header.Set(HeaderDeadline, tt.header)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tt.want == 0 {
+				if left != 0 {
+					t.Errorf("Budget = %v, want none", left)
+				}
+				return
+			}
+			if left <= 0 || left > tt.want || left < tt.want-100*time.Millisecond {
+				t.Errorf("Budget = %v, want about %v", left, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimings(t *testing.T) {
+	var none *Timings
+	none.Start(StageFetch)()
+	if h := none.Header(); h != "" {
+		t.Errorf("nil Header = %q, want empty", h)
+	}
+	if h := (&State{}).Timings.Header(); h != "" {
+		t.Errorf("Header without Timings = %q, want empty", h)
+	}
+
+	tm := NewTimings()
+	ctx := With(context.Background(), &State{Timings: tm})
+	// Two overlapping fetches count once
+	a := Time(ctx, StageFetch)
+	b := Time(ctx, StageFetch)
+	time.Sleep(20 * time.Millisecond)
+	a()
+	a()
+	b()
+	Time(ctx, StageDiscovery)()
+
+	h := tm.Header()
+	parts := strings.Split(h, ", ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "discovery;dur=") || !strings.HasPrefix(parts[1], "fetch;dur=") || !strings.HasPrefix(parts[2], "total;dur=") {
+		t.Fatalf("Header = %q, want discovery, fetch and total in order", h)
+	}
+	ms := func(part string) float64 {
+		v, err := strconv.ParseFloat(part[strings.Index(part, "=")+1:], 64)
+		if err != nil {
+			t.Fatalf("%q: %v", part, err)
+		}
+		return v
+	}
+	if fetch, total := ms(parts[1]), ms(parts[2]); fetch < 20 || fetch > total {
+		t.Errorf("fetch = %vms, want at least 20ms and at most the total %vms", fetch, total)
+	}
+}
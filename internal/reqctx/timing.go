@@ -0,0 +1,110 @@
+package reqctx
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline stages recorded in Timings, in the order Header lists them.
+const (
+	StageDiscovery = "discovery" // finding a page's icon candidates
+	StageFetch     = "fetch"     // downloading icons, or revalidating cached ones
+	StageDecode    = "decode"    // decoding and resizing icons
+	StageEncode    = "encode"    // processing and encoding the response image
+	StageCache     = "cache"     // reading and writing cache entries
+)
+
+var stages = []string{StageDiscovery, StageFetch, StageDecode, StageEncode, StageCache}
+
+// Timings records how long a request spent in each pipeline stage, for the
+// Server-Timing response header. Spans of one stage that overlap, such as
+// candidates fetched in parallel, count once, so a stage never exceeds the
+// request's wall time. It is safe for concurrent use.
+type Timings struct {
+	start time.Time
+	mu    sync.Mutex
+	spans map[string]*stageSpan
+}
+
+type stageSpan struct {
+	active int       // spans of the stage in progress
+	since  time.Time // when the first of them started
+	total  time.Duration
+}
+
+// NewTimings returns Timings for a request starting now.
+func NewTimings() *Timings {
+	return &Timings{start: time.Now(), spans: make(map[string]*stageSpan)}
+}
+
+// Start opens a span of stage and returns the function closing it.
+func (t *Timings) Start(stage string) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	s := t.spans[stage]
+	if s == nil {
+		s = &stageSpan{}
+		t.spans[stage] = s
+	}
+	if s.active == 0 {
+		s.since = time.Now()
+	}
+	s.active++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if s.active--; s.active == 0 {
+				s.total += time.Since(s.since)
+			}
+		})
+	}
+}
+
+// Header returns the Server-Timing value for the stages recorded so far,
+// e.g. "discovery;dur=41.2, fetch;dur=18.0, total;dur=63.5". Durations are
+// in milliseconds; spans still open count up to now.
+func (t *Timings) Header() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var parts []string
+	for _, stage := range stages {
+		s := t.spans[stage]
+		if s == nil {
+			continue
+		}
+		d := s.total
+		if s.active > 0 {
+			d += now.Sub(s.since)
+		}
+		parts = append(parts, stage+";dur="+formatMillis(d))
+	}
+	parts = append(parts, "total;dur="+formatMillis(now.Sub(t.start)))
+	return strings.Join(parts, ", ")
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 1, 64)
+}
+
+// Time opens a span of stage in the Timings of the request carried by ctx
+// and returns the function closing it, for use as
+//
+//	defer reqctx.Time(ctx, reqctx.StageDecode)()
+//
+// It does nothing for requests without Timings.
+func Time(ctx context.Context, stage string) func() {
+	return From(ctx).Timings.Start(stage)
+}
@@ -5,38 +5,129 @@ package security
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"path"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	// blockedNets are never fetched from: loopback, link-local (where cloud
+	// metadata services live), multicast, and unspecified or reserved
+	// addresses.
+	blockedNets []*net.IPNet
+	// privateNets are fetched from only with AllowPrivate: RFC 1918,
+	// carrier-grade NAT and IPv6 unique local addresses.
+	privateNets []*net.IPNet
 )
 
-var blockedNets []*net.IPNet
+// ErrNotResolvable is returned by NormalizeURL for hostnames that have no
+// addresses, as opposed to those refused by the network policy.
+var ErrNotResolvable = errors.New("hostname not resolvable")
+
+// ErrBlockedHost matches the NormalizeURL errors of hosts the network
+// policy refuses, such as localhost or private addresses, with errors.Is.
+var ErrBlockedHost = errors.New("host blocked by the network policy")
+
+// blockedError is an error matching ErrBlockedHost that keeps its own
+// message.
+type blockedError string
+
+func (e blockedError) Error() string { return string(e) }
+
+func (e blockedError) Is(target error) bool { return target == ErrBlockedHost }
+
+// Network policy, set once at startup before requests are served.
+var (
+	// AllowPrivate permits hosts on private networks (privateNets), for
+	// deployments that serve icons of intranet sites. Loopback and
+	// link-local addresses stay blocked.
+	AllowPrivate bool
+	// RequireDot makes NormalizeURL reject hostnames without a dot, such as
+	// intranet single-label names, unless they match SingleLabelHosts.
+	RequireDot = true
+	// SingleLabelHosts are path.Match patterns of dotless hostnames accepted
+	// while RequireDot is set, e.g. "wiki" or "intranet-*".
+	SingleLabelHosts []string
+)
 
 func init() {
-	// Block private ranges
-	for _, cidr := range []string{
-		"127.0.0.0/8", "::1/128",
-		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
-		"169.254.0.0/16", "100.64.0.0/10",
-		"0.0.0.0/8", "224.0.0.0/4", "240.0.0.0/4",
-		"::/128", "fe80::/10", "fc00::/7", "ff00::/8",
-	} {
-		if _, n, err := net.ParseCIDR(cidr); err == nil {
-			blockedNets = append(blockedNets, n)
+	parse := func(cidrs ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, cidr := range cidrs {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				nets = append(nets, n)
+			}
 		}
+		return nets
 	}
+	blockedNets = parse(
+		"127.0.0.0/8", "::1/128",
+		"169.254.0.0/16", "fe80::/10",
+		"0.0.0.0/8", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "ff00::/8",
+	)
+	privateNets = parse(
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"100.64.0.0/10", "fc00::/7",
+	)
 }
 
 // IsBlockedIP checks if an IP address is in a blocked network range.
-// Blocked ranges include private IPs (RFC 1918), localhost, link-local,
-// and other reserved ranges.
+// Blocked ranges include private IPs (RFC 1918) unless AllowPrivate is set,
+// and always localhost, link-local and other reserved ranges.
 func IsBlockedIP(ip net.IP) bool {
 	for _, n := range blockedNets {
 		if n.Contains(ip) {
 			return true
 		}
 	}
+	if AllowPrivate {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHostPatterns parses a comma-separated list of SingleLabelHosts
+// patterns, lowercasing them.
+func ParseHostPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad host pattern %q", p)
+		}
+		if strings.Contains(p, ".") {
+			return nil, fmt.Errorf("host pattern %q contains a dot; only dotless names need allowing", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// singleLabelAllowed reports whether the dotless host passes the dot rule.
+func singleLabelAllowed(host string) bool {
+	if !RequireDot {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, p := range SingleLabelHosts {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
 	return false
 }
 
@@ -46,17 +137,57 @@ func IsAllowedScheme(u *url.URL) bool {
 	return u != nil && (u.Scheme == "http" || u.Scheme == "https")
 }
 
+// hostProfile maps internationalized host names the way browsers do
+// (UTS #46 with lowercase and width folding) without rejecting the ASCII
+// names, such as those with underscores, that DNS serves in practice.
+var hostProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule())
+
+// ASCIIHost returns host in its ASCII (punycode) form, e.g. "xn--bcher-kva.de"
+// for "bücher.de". ASCII hosts, including IP literals, are returned unchanged.
+func ASCIIHost(host string) (string, error) {
+	if isASCII(host) {
+		return host, nil
+	}
+	return hostProfile.ToASCII(host)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 // NormalizeURL parses and validates a URL string, adding https:// if no scheme is present.
 // It performs multiple security checks:
 //   - Validates the URL format
 //   - Checks for empty hostname
+//   - Converts internationalized hostnames to punycode
 //   - Validates scheme (HTTP/HTTPS only)
 //   - Blocks localhost
-//   - Blocks private IP addresses
+//   - Blocks private IP addresses (unless AllowPrivate)
+//   - Requires a dot in the hostname (see RequireDot and SingleLabelHosts)
 //   - Performs DNS resolution and validates resolved IPs
 //
 // Returns the parsed URL and nil if valid, or nil and an error if validation fails.
 func NormalizeURL(in string) (*url.URL, error) {
+	return NormalizeURLContext(context.Background(), in)
+}
+
+type skipResolveKey struct{}
+
+// WithoutResolve returns a context under which NormalizeURLContext skips
+// the DNS check, for requests answered from recorded traffic that never
+// dial out. Every other check still applies.
+func WithoutResolve(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipResolveKey{}, true)
+}
+
+// NormalizeURLContext is NormalizeURL with the DNS lookup bounded by ctx,
+// and skipped under WithoutResolve.
+func NormalizeURLContext(ctx context.Context, in string) (*url.URL, error) {
 	if !strings.Contains(in, "://") {
 		in = "https://" + in
 	}
@@ -72,26 +203,41 @@ func NormalizeURL(in string) (*url.URL, error) {
 	}
 
 	host := u.Hostname()
+	if !isASCII(host) {
+		ascii, err := ASCIIHost(host)
+		if err != nil || ascii == "" {
+			return nil, errors.New("invalid internationalized hostname")
+		}
+		host = ascii
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else {
+			u.Host = host
+		}
+	}
 	if strings.EqualFold(host, "localhost") {
-		return nil, errors.New("localhost not allowed")
+		return nil, blockedError("localhost not allowed")
 	}
 
 	if ip := net.ParseIP(host); ip != nil {
 		if IsBlockedIP(ip) {
-			return nil, errors.New("private ip not allowed")
+			return nil, blockedError("private ip not allowed")
 		}
 		return u, nil
 	}
 
-	if !strings.Contains(host, ".") {
-		return nil, errors.New("hostname must contain a dot")
+	if !strings.Contains(host, ".") && !singleLabelAllowed(host) {
+		return nil, blockedError("hostname must contain a dot")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	if skip, _ := ctx.Value(skipResolveKey{}).(bool); skip {
+		return u, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil || len(ips) == 0 {
-		return nil, errors.New("hostname not resolvable")
+		return nil, ErrNotResolvable
 	}
 
 	for _, ipa := range ips {
@@ -99,7 +245,7 @@ func NormalizeURL(in string) (*url.URL, error) {
 			return u, nil
 		}
 	}
-	return nil, errors.New("hostname resolves to private range only")
+	return nil, blockedError("hostname resolves to private range only")
 }
 
 // ValidatedDialContext performs DNS resolution and validates IPs before connecting.
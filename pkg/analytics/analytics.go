@@ -0,0 +1,238 @@
+// Package analytics records per-request rows into an embedded SQLite database
+// so single-binary deployments get historical request analytics without an
+// external metrics stack. Raw rows are kept for a retention window and then
+// rolled up into daily aggregates.
+package analytics
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"faviconsvc/pkg/loadctl"
+	"faviconsvc/pkg/logger"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+const (
+	queueSize     = 4096
+	flushInterval = time.Second
+	flushBatch    = 256
+	rollupEvery   = time.Hour
+)
+
+// Record is a single favicon request as stored in the analytics database.
+type Record struct {
+	Time      time.Time
+	Domain    string
+	Size      int
+	Format    string
+	CacheTier string // resized, orig, fetch, resolved, archive, history, none
+	Latency   time.Duration
+	Outcome   string // ok, stale, fallback, invalid, redirect
+}
+
+// Store is an asynchronous, batched writer backed by SQLite.
+type Store struct {
+	db              *sql.DB
+	retention       time.Duration
+	rollupRetention time.Duration
+	queue           chan Record
+	dropped         uint64
+	mu              sync.Mutex
+	stop            chan struct{}
+	done            chan struct{}
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS requests (
+	ts_ms      INTEGER NOT NULL,
+	domain     TEXT    NOT NULL,
+	size       INTEGER NOT NULL,
+	format     TEXT    NOT NULL,
+	cache_tier TEXT    NOT NULL,
+	latency_ms REAL    NOT NULL,
+	outcome    TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requests_ts ON requests(ts_ms);
+CREATE TABLE IF NOT EXISTS daily_rollup (
+	day              TEXT    NOT NULL,
+	outcome          TEXT    NOT NULL,
+	cache_tier       TEXT    NOT NULL,
+	format           TEXT    NOT NULL,
+	requests         INTEGER NOT NULL,
+	domains          INTEGER NOT NULL,
+	total_latency_ms REAL    NOT NULL,
+	max_latency_ms   REAL    NOT NULL,
+	PRIMARY KEY (day, outcome, cache_tier, format)
+);
+`
+
+// Open opens (or creates) the analytics database at path.
+// retention is how long raw rows are kept before being rolled up;
+// rollupRetention is how long daily aggregates are kept (0 = forever).
+func Open(path string, retention, rollupRetention time.Duration) (*Store, error) {
+	if retention <= 0 {
+		return nil, errors.New("analytics: retention must be positive")
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialize access through one connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		db:              db,
+		retention:       retention,
+		rollupRetention: rollupRetention,
+		queue:           make(chan Record, queueSize),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	// Catch up on rollups missed while the process was down
+	s.rollup()
+	go s.run()
+	return s, nil
+}
+
+// Record enqueues a row without blocking. Rows are dropped when the queue is full.
+func (s *Store) Record(r Record) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- r:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+}
+
+// Close flushes pending rows and closes the database.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	rollup := time.NewTicker(rollupEvery)
+	defer rollup.Stop()
+
+	batch := make([]Record, 0, flushBatch)
+	rollupPending := false
+	for {
+		select {
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= flushBatch {
+				s.insert(batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				s.insert(batch)
+				batch = batch[:0]
+			}
+			if rollupPending && !loadctl.Get().Throttled() {
+				rollupPending = false
+				s.rollup()
+			}
+		case <-rollup.C:
+			// Rollups are deferred rather than blocking inserts while under load
+			if loadctl.Get().Throttled() {
+				rollupPending = true
+			} else {
+				s.rollup()
+			}
+		case <-s.stop:
+			for {
+				select {
+				case r := <-s.queue:
+					batch = append(batch, r)
+				default:
+					if len(batch) > 0 {
+						s.insert(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Store) insert(batch []Record) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		logger.Warn("Analytics: begin failed: %v", err)
+		return
+	}
+	stmt, err := tx.Prepare(`INSERT INTO requests (ts_ms, domain, size, format, cache_tier, latency_ms, outcome) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Warn("Analytics: prepare failed: %v", err)
+		return
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		latency := float64(r.Latency) / float64(time.Millisecond)
+		if _, err := stmt.Exec(r.Time.UnixMilli(), r.Domain, r.Size, r.Format, r.CacheTier, latency, r.Outcome); err != nil {
+			_ = tx.Rollback()
+			logger.Warn("Analytics: insert failed: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Warn("Analytics: commit failed: %v", err)
+	}
+}
+
+// rollup aggregates raw rows older than the retention window into daily rows
+// (whole UTC days only) and purges expired data.
+func (s *Store) rollup() {
+	cutoff := time.Now().Add(-s.retention).UTC().Truncate(24 * time.Hour)
+	cutoffMs := cutoff.UnixMilli()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logger.Warn("Analytics: rollup begin failed: %v", err)
+		return
+	}
+	_, err = tx.Exec(`
+INSERT INTO daily_rollup (day, outcome, cache_tier, format, requests, domains, total_latency_ms, max_latency_ms)
+SELECT strftime('%Y-%m-%d', ts_ms / 1000, 'unixepoch'), outcome, cache_tier, format,
+       COUNT(*), COUNT(DISTINCT domain), SUM(latency_ms), MAX(latency_ms)
+FROM requests WHERE ts_ms < ?
+GROUP BY 1, 2, 3, 4
+ON CONFLICT (day, outcome, cache_tier, format) DO UPDATE SET
+	requests = requests + excluded.requests,
+	domains = MAX(domains, excluded.domains),
+	total_latency_ms = total_latency_ms + excluded.total_latency_ms,
+	max_latency_ms = MAX(max_latency_ms, excluded.max_latency_ms)`, cutoffMs)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM requests WHERE ts_ms < ?`, cutoffMs)
+	}
+	if err == nil && s.rollupRetention > 0 {
+		oldest := time.Now().Add(-s.rollupRetention).UTC().Format("2006-01-02")
+		_, err = tx.Exec(`DELETE FROM daily_rollup WHERE day < ?`, oldest)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Warn("Analytics: rollup failed: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Warn("Analytics: rollup commit failed: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package analytics
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_RecordAndSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	s, err := Open(path, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	now := time.Now()
+	for i, r := range []Record{
+		{Domain: "example.com", Format: "png", CacheTier: "resized", Outcome: "ok", Latency: 2 * time.Millisecond},
+		{Domain: "example.com", Format: "webp", CacheTier: "fetch", Outcome: "ok", Latency: 300 * time.Millisecond},
+		{Domain: "example.org", Format: "png", CacheTier: "none", Outcome: "fallback", Latency: 5 * time.Millisecond},
+	} {
+		r.Time = now.Add(time.Duration(i) * time.Second)
+		r.Size = 32
+		s.Record(r)
+	}
+	// Close flushes the queue
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	s, err = Open(path, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	sum, err := s.Summary(context.Background(), now.Add(-time.Hour), 5)
+	if err != nil {
+		t.Fatalf("Summary failed: %v", err)
+	}
+	if sum.Requests != 3 || sum.Domains != 2 {
+		t.Errorf("Expected 3 requests over 2 domains, got %d over %d", sum.Requests, sum.Domains)
+	}
+	if sum.ByOutcome["ok"] != 2 || sum.ByOutcome["fallback"] != 1 {
+		t.Errorf("Unexpected outcome breakdown: %v", sum.ByOutcome)
+	}
+	if sum.ByCacheTier["resized"] != 1 {
+		t.Errorf("Unexpected cache tier breakdown: %v", sum.ByCacheTier)
+	}
+	if len(sum.TopDomains) == 0 || sum.TopDomains[0].Domain != "example.com" {
+		t.Errorf("Expected example.com as top domain, got %v", sum.TopDomains)
+	}
+	if sum.LatencyP99Ms < 299 {
+		t.Errorf("Expected p99 latency near 300ms, got %.1f", sum.LatencyP99Ms)
+	}
+}
+
+func TestStore_Rollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	s, err := Open(path, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	old := time.Now().AddDate(0, 0, -3)
+	s.Record(Record{Time: old, Domain: "example.com", Size: 32, Format: "png", CacheTier: "fetch", Outcome: "ok", Latency: 10 * time.Millisecond})
+	s.Record(Record{Time: old, Domain: "example.net", Size: 32, Format: "png", CacheTier: "fetch", Outcome: "ok", Latency: 30 * time.Millisecond})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Reopening runs a rollup pass
+	s, err = Open(path, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	sum, err := s.Summary(context.Background(), old.Add(-time.Hour), 0)
+	if err != nil {
+		t.Fatalf("Summary failed: %v", err)
+	}
+	if sum.Requests != 0 {
+		t.Errorf("Expected raw rows to be rolled up, %d remain", sum.Requests)
+	}
+
+	daily, err := s.Daily(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("Daily failed: %v", err)
+	}
+	if len(daily) != 1 {
+		t.Fatalf("Expected 1 rollup row, got %d", len(daily))
+	}
+	d := daily[0]
+	if d.Day != old.UTC().Format("2006-01-02") || d.Requests != 2 || d.Domains != 2 {
+		t.Errorf("Unexpected rollup row: %+v", d)
+	}
+	if d.AvgLatencyMs < 19 || d.AvgLatencyMs > 21 {
+		t.Errorf("Expected average latency 20ms, got %.1f", d.AvgLatencyMs)
+	}
+}
@@ -0,0 +1,156 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Summary aggregates raw request rows over a recent window.
+type Summary struct {
+	Since        time.Time        `json:"since"`
+	Requests     int64            `json:"requests"`
+	Domains      int64            `json:"domains"`
+	ByOutcome    map[string]int64 `json:"by_outcome"`
+	ByCacheTier  map[string]int64 `json:"by_cache_tier"`
+	ByFormat     map[string]int64 `json:"by_format"`
+	LatencyP50Ms float64          `json:"latency_p50_ms"`
+	LatencyP95Ms float64          `json:"latency_p95_ms"`
+	LatencyP99Ms float64          `json:"latency_p99_ms"`
+	TopDomains   []DomainCount    `json:"top_domains"`
+	Dropped      uint64           `json:"dropped_records"`
+}
+
+// DomainCount is a request count for one domain.
+type DomainCount struct {
+	Domain   string `json:"domain"`
+	Requests int64  `json:"requests"`
+}
+
+// DailyRollup is one aggregated row for a UTC day.
+type DailyRollup struct {
+	Day          string  `json:"day"`
+	Outcome      string  `json:"outcome"`
+	CacheTier    string  `json:"cache_tier"`
+	Format       string  `json:"format"`
+	Requests     int64   `json:"requests"`
+	Domains      int64   `json:"domains"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+}
+
+// Summary computes request statistics for raw rows newer than since.
+// Windows extending past the raw retention only cover retained rows.
+func (s *Store) Summary(ctx context.Context, since time.Time, topN int) (Summary, error) {
+	sum := Summary{
+		Since:       since,
+		ByOutcome:   map[string]int64{},
+		ByCacheTier: map[string]int64{},
+		ByFormat:    map[string]int64{},
+	}
+	s.mu.Lock()
+	sum.Dropped = s.dropped
+	s.mu.Unlock()
+
+	// One transaction reads one snapshot, so the counts, percentile
+	// offsets and top domains agree while the writer inserts rows
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sum, err
+	}
+	defer tx.Rollback()
+
+	sinceMs := since.UnixMilli()
+	if err := tx.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(DISTINCT domain) FROM requests WHERE ts_ms >= ?`, sinceMs,
+	).Scan(&sum.Requests, &sum.Domains); err != nil {
+		return sum, err
+	}
+
+	for col, dst := range map[string]map[string]int64{
+		"outcome":    sum.ByOutcome,
+		"cache_tier": sum.ByCacheTier,
+		"format":     sum.ByFormat,
+	} {
+		// col comes from the fixed map above, never from user input
+		rows, err := tx.QueryContext(ctx,
+			`SELECT `+col+`, COUNT(*) FROM requests WHERE ts_ms >= ? GROUP BY 1`, sinceMs)
+		if err != nil {
+			return sum, err
+		}
+		for rows.Next() {
+			var k string
+			var n int64
+			if err := rows.Scan(&k, &n); err != nil {
+				rows.Close()
+				return sum, err
+			}
+			dst[k] = n
+		}
+		rows.Close()
+	}
+
+	if sum.Requests > 0 {
+		for _, q := range []struct {
+			p   float64
+			dst *float64
+		}{{0.50, &sum.LatencyP50Ms}, {0.95, &sum.LatencyP95Ms}, {0.99, &sum.LatencyP99Ms}} {
+			// Nearest-rank percentile
+			offset := int64(math.Ceil(q.p*float64(sum.Requests))) - 1
+			if err := tx.QueryRowContext(ctx,
+				`SELECT latency_ms FROM requests WHERE ts_ms >= ? ORDER BY latency_ms LIMIT 1 OFFSET ?`,
+				sinceMs, offset,
+			).Scan(q.dst); err != nil {
+				return sum, err
+			}
+		}
+	}
+
+	if topN > 0 {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT domain, COUNT(*) FROM requests WHERE ts_ms >= ? AND domain != '' GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT ?`,
+			sinceMs, topN)
+		if err != nil {
+			return sum, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var dc DomainCount
+			if err := rows.Scan(&dc.Domain, &dc.Requests); err != nil {
+				return sum, err
+			}
+			sum.TopDomains = append(sum.TopDomains, dc)
+		}
+		if err := rows.Err(); err != nil {
+			return sum, err
+		}
+	}
+
+	return sum, nil
+}
+
+// Daily returns rolled-up rows for the most recent days, newest first.
+func (s *Store) Daily(ctx context.Context, days int) ([]DailyRollup, error) {
+	oldest := time.Now().AddDate(0, 0, -days).UTC().Format("2006-01-02")
+	rows, err := s.db.QueryContext(ctx, `
+SELECT day, outcome, cache_tier, format, requests, domains, total_latency_ms, max_latency_ms
+FROM daily_rollup WHERE day >= ? ORDER BY day DESC, requests DESC`, oldest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DailyRollup
+	for rows.Next() {
+		var d DailyRollup
+		var total float64
+		if err := rows.Scan(&d.Day, &d.Outcome, &d.CacheTier, &d.Format, &d.Requests, &d.Domains, &total, &d.MaxLatencyMs); err != nil {
+			return nil, err
+		}
+		if d.Requests > 0 {
+			d.AvgLatencyMs = total / float64(d.Requests)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
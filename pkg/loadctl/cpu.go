@@ -0,0 +1,21 @@
+package loadctl
+
+import (
+	"runtime"
+	"time"
+)
+
+// cpuSample is a point-in-time reading of process CPU time.
+type cpuSample struct {
+	wall time.Time
+	cpu  time.Duration // user + system
+}
+
+// utilization returns the fraction of all cores used between prev and s.
+func (s cpuSample) utilization(prev cpuSample) float64 {
+	wall := s.wall.Sub(prev.wall)
+	if wall <= 0 {
+		return 0
+	}
+	return float64(s.cpu-prev.cpu) / (float64(wall) * float64(runtime.NumCPU()))
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package loadctl
+
+// readCPU is unavailable on this platform; only latency drives throttling.
+func readCPU() (cpuSample, bool) {
+	return cpuSample{}, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package loadctl
+
+import (
+	"syscall"
+	"time"
+)
+
+func readCPU() (cpuSample, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return cpuSample{}, false
+	}
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	return cpuSample{wall: time.Now(), cpu: cpu}, true
+}
@@ -0,0 +1,225 @@
+// Package loadctl coordinates background work (cache GC, analytics rollups,
+// revalidation, prefetch) with foreground load. A single Controller samples
+// foreground request latency and process CPU; when either crosses its
+// threshold, background tasks block in Wait until headroom returns.
+package loadctl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+)
+
+const (
+	// DefaultSampleInterval is how often load is re-evaluated.
+	DefaultSampleInterval = time.Second
+	// DefaultMaxPause bounds how long background work can be held back.
+	DefaultMaxPause = 5 * time.Minute
+
+	// resumeRatio adds hysteresis: work resumes only once load drops
+	// below this fraction of the threshold that paused it.
+	resumeRatio = 0.8
+	// ewmaAlpha weights the newest sample in the smoothed load values.
+	ewmaAlpha = 0.3
+)
+
+// Config sets the thresholds above which background work pauses.
+type Config struct {
+	LatencyThreshold time.Duration // smoothed foreground latency (0 = ignore latency)
+	CPUThreshold     float64       // process CPU as a fraction of all cores (0 = ignore CPU)
+	SampleInterval   time.Duration
+	MaxPause         time.Duration // background work proceeds anyway after this long
+}
+
+// State is a snapshot of the controller's view of load.
+type State struct {
+	Throttled bool
+	Latency   time.Duration
+	CPU       float64
+}
+
+// Controller is the shared load gate for background work.
+// The zero value never throttles.
+type Controller struct {
+	cfg Config
+
+	mu        sync.Mutex
+	latSum    time.Duration
+	latCount  int64
+	latency   float64 // EWMA, nanoseconds
+	cpu       float64 // EWMA, fraction
+	lastCPU   cpuSample
+	throttled bool
+	resumed   chan struct{} // closed while not throttled
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var global = &Controller{}
+
+// Get returns the process-wide controller.
+func Get() *Controller {
+	return global
+}
+
+// Start applies cfg and begins sampling. Calling Start again replaces the
+// previous configuration.
+func (c *Controller) Start(cfg Config) {
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = DefaultSampleInterval
+	}
+	if cfg.MaxPause <= 0 {
+		cfg.MaxPause = DefaultMaxPause
+	}
+	c.Stop()
+
+	c.mu.Lock()
+	c.cfg = cfg
+	c.lastCPU, _ = readCPU()
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+
+	if cfg.LatencyThreshold <= 0 && cfg.CPUThreshold <= 0 {
+		close(done)
+		return
+	}
+	logger.Info("Background load control: latency threshold=%v, cpu threshold=%.0f%%",
+		cfg.LatencyThreshold, cfg.CPUThreshold*100)
+	go c.run(stop, done, cfg.SampleInterval)
+}
+
+// Stop ends sampling and releases any paused background work.
+func (c *Controller) Stop() {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	c.setThrottled(false)
+}
+
+// ObserveLatency records the duration of a completed foreground request.
+func (c *Controller) ObserveLatency(d time.Duration) {
+	c.mu.Lock()
+	c.latSum += d
+	c.latCount++
+	c.mu.Unlock()
+}
+
+// Throttled reports whether background work should currently hold off.
+func (c *Controller) Throttled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.throttled
+}
+
+// State returns the current smoothed load.
+func (c *Controller) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return State{Throttled: c.throttled, Latency: time.Duration(c.latency), CPU: c.cpu}
+}
+
+// Wait blocks while background work is throttled, up to MaxPause.
+// It returns ctx.Err() if ctx is cancelled first.
+func (c *Controller) Wait(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.throttled {
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+	resumed, maxPause := c.resumed, c.cfg.MaxPause
+	c.mu.Unlock()
+
+	t := time.NewTimer(maxPause)
+	defer t.Stop()
+	select {
+	case <-resumed:
+		return nil
+	case <-t.C:
+		logger.Debug("Background work resuming after max pause of %v", maxPause)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Controller) run(stop, done chan struct{}, interval time.Duration) {
+	defer close(done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			s, ok := readCPU()
+			c.sample(now, s, ok)
+		}
+	}
+}
+
+// sample folds the latency observed since the last tick and the CPU used
+// since the last reading into the smoothed values and updates the gate.
+func (c *Controller) sample(now time.Time, cpu cpuSample, cpuOK bool) {
+	c.mu.Lock()
+	var avg float64
+	if c.latCount > 0 {
+		avg = float64(c.latSum) / float64(c.latCount)
+	}
+	c.latSum, c.latCount = 0, 0
+	c.latency += ewmaAlpha * (avg - c.latency)
+
+	if cpuOK && c.lastCPU.wall.Before(cpu.wall) {
+		c.cpu += ewmaAlpha * (cpu.utilization(c.lastCPU) - c.cpu)
+		c.lastCPU = cpu
+	}
+
+	cfg, throttled := c.cfg, c.throttled
+	lat, util := c.latency, c.cpu
+	c.mu.Unlock()
+
+	over := func(v, limit float64) bool {
+		if limit <= 0 {
+			return false
+		}
+		if throttled {
+			return v >= limit*resumeRatio
+		}
+		return v > limit
+	}
+	want := over(lat, float64(cfg.LatencyThreshold)) || over(util, cfg.CPUThreshold)
+	if want != throttled {
+		if want {
+			logger.Info("Background work paused: latency=%v cpu=%.0f%%", time.Duration(lat).Round(time.Millisecond), util*100)
+		} else {
+			logger.Info("Background work resumed: latency=%v cpu=%.0f%%", time.Duration(lat).Round(time.Millisecond), util*100)
+		}
+		c.setThrottled(want)
+	}
+}
+
+func (c *Controller) setThrottled(throttled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.throttled == throttled {
+		return
+	}
+	c.throttled = throttled
+	if throttled {
+		c.resumed = make(chan struct{})
+	} else if c.resumed != nil {
+		close(c.resumed)
+	}
+	metrics.Get().SetBackgroundThrottled(throttled)
+}
@@ -0,0 +1,93 @@
+package loadctl
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestZeroControllerNeverThrottles(t *testing.T) {
+	c := &Controller{}
+	c.ObserveLatency(time.Hour)
+	c.sample(time.Now(), cpuSample{}, false)
+	if c.Throttled() {
+		t.Fatal("unconfigured controller should not throttle")
+	}
+	if err := c.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+}
+
+func TestLatencyThrottleWithHysteresis(t *testing.T) {
+	c := &Controller{cfg: Config{LatencyThreshold: 100 * time.Millisecond, MaxPause: time.Minute}}
+	now := time.Now()
+
+	// Sustained slow requests push the EWMA over the threshold
+	for i := 0; i < 10 && !c.Throttled(); i++ {
+		c.ObserveLatency(500 * time.Millisecond)
+		c.sample(now, cpuSample{}, false)
+	}
+	if !c.Throttled() {
+		t.Fatalf("expected throttling, latency=%v", c.State().Latency)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Wait(ctx); err == nil {
+		t.Fatal("Wait() should block while throttled")
+	}
+
+	released := make(chan struct{})
+	go func() {
+		_ = c.Wait(context.Background())
+		close(released)
+	}()
+
+	// Idle ticks decay latency; work resumes only below 80% of the threshold
+	for i := 0; i < 50 && c.Throttled(); i++ {
+		c.sample(now, cpuSample{}, false)
+		if c.Throttled() && c.State().Latency < 80*time.Millisecond {
+			t.Fatalf("still throttled at %v", c.State().Latency)
+		}
+	}
+	if c.Throttled() {
+		t.Fatal("expected throttling to lift once latency decayed")
+	}
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("waiter not released on resume")
+	}
+}
+
+func TestCPUThrottle(t *testing.T) {
+	start := time.Now()
+	c := &Controller{
+		cfg:     Config{CPUThreshold: 0.5, MaxPause: time.Minute},
+		lastCPU: cpuSample{wall: start},
+	}
+	// Every core fully busy for each one-second interval
+	busy := time.Second * time.Duration(runtime.NumCPU())
+	for i := 1; i <= 10 && !c.Throttled(); i++ {
+		c.sample(start, cpuSample{wall: start.Add(time.Duration(i) * time.Second), cpu: time.Duration(i) * busy}, true)
+	}
+	if !c.Throttled() {
+		t.Fatalf("expected CPU throttling, cpu=%.2f", c.State().CPU)
+	}
+}
+
+func TestWaitMaxPause(t *testing.T) {
+	c := &Controller{cfg: Config{MaxPause: 10 * time.Millisecond}}
+	c.setThrottled(true)
+	done := make(chan error, 1)
+	go func() { done <- c.Wait(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Wait() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait() exceeded MaxPause")
+	}
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache operation results passed to ObserveCacheOp.
+const (
+	CacheHit   = "hit"   // read found a live entry
+	CacheMiss  = "miss"  // read found no entry, or only an expired one
+	CacheOK    = "ok"    // write, touch or evict succeeded
+	CacheError = "error" // the filesystem returned an error
+)
+
+// cacheOpBuckets are the upper bounds, in seconds, of the cache operation
+// latency histogram. Local disks answer in microseconds; network
+// filesystems take milliseconds when healthy and much longer when not.
+var cacheOpBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// cacheOpStats aggregates the operations of one tier and kind.
+type cacheOpStats struct {
+	buckets  []uint64 // per bucket, not cumulative; the last is +Inf
+	sumNanos uint64
+	results  sync.Map // result -> *uint64
+}
+
+// ObserveCacheOp records one cache operation taking d: tier is the cache
+// area (orig, meta, resized, resolved, candidates, history), op one of
+// read, write, touch or evict, and result one of the Cache* results.
+func (m *Metrics) ObserveCacheOp(tier, op, result string, d time.Duration) {
+	val, ok := m.cacheOps.Load(tier + "|" + op)
+	if !ok {
+		val, _ = m.cacheOps.LoadOrStore(tier+"|"+op, &cacheOpStats{buckets: make([]uint64, len(cacheOpBuckets)+1)})
+	}
+	st := val.(*cacheOpStats)
+
+	i := 0
+	for i < len(cacheOpBuckets) && d.Seconds() > cacheOpBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&st.buckets[i], 1)
+	atomic.AddUint64(&st.sumNanos, uint64(max(d, 0)))
+	count, _ := st.results.LoadOrStore(result, new(uint64))
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+func (m *Metrics) writeCacheOpMetrics(w http.ResponseWriter) {
+	m.cacheOps.Range(func(key, value interface{}) bool {
+		tier, op, _ := strings.Cut(key.(string), "|")
+		st := value.(*cacheOpStats)
+
+		st.results.Range(func(k, v interface{}) bool {
+			writeMetric(w, "favicon_cache_operations_total", "counter", atomic.LoadUint64(v.(*uint64)), map[string]string{
+				"tier":   tier,
+				"op":     op,
+				"result": k.(string),
+			})
+			return true
+		})
+
+		var cumulative uint64
+		for i := range st.buckets {
+			cumulative += atomic.LoadUint64(&st.buckets[i])
+			le := "+Inf"
+			if i < len(cacheOpBuckets) {
+				le = strconv.FormatFloat(cacheOpBuckets[i], 'g', -1, 64)
+			}
+			writeMetric(w, "favicon_cache_operation_duration_seconds_bucket", "counter", cumulative, map[string]string{
+				"tier": tier,
+				"op":   op,
+				"le":   le,
+			})
+		}
+		labels := map[string]string{"tier": tier, "op": op}
+		writeMetric(w, "favicon_cache_operation_duration_seconds_sum", "counter", time.Duration(atomic.LoadUint64(&st.sumNanos)).Seconds(), labels)
+		writeMetric(w, "favicon_cache_operation_duration_seconds_count", "counter", cumulative, labels)
+		return true
+	})
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheOpMetrics(t *testing.T) {
+	m := &Metrics{}
+	m.ObserveCacheOp("orig", "read", CacheHit, 200*time.Microsecond)
+	m.ObserveCacheOp("orig", "read", CacheMiss, 50*time.Microsecond)
+	m.ObserveCacheOp("orig", "read", CacheHit, 2*time.Second)
+	m.ObserveCacheOp("meta", "write", CacheError, 10*time.Second)
+
+	rec := httptest.NewRecorder()
+	m.writeCacheOpMetrics(rec)
+	out := rec.Body.String()
+
+	for _, want := range []struct {
+		name   string
+		labels []string
+		value  string
+	}{
+		{"favicon_cache_operations_total", []string{`tier="orig"`, `op="read"`, `result="hit"`}, "2"},
+		{"favicon_cache_operations_total", []string{`tier="orig"`, `op="read"`, `result="miss"`}, "1"},
+		{"favicon_cache_operations_total", []string{`tier="meta"`, `op="write"`, `result="error"`}, "1"},
+		{"favicon_cache_operation_duration_seconds_bucket", []string{`tier="orig"`, `op="read"`, `le="0.0001"`}, "1"},
+		{"favicon_cache_operation_duration_seconds_bucket", []string{`tier="orig"`, `op="read"`, `le="0.0005"`}, "2"},
+		{"favicon_cache_operation_duration_seconds_bucket", []string{`tier="orig"`, `op="read"`, `le="5"`}, "3"},
+		{"favicon_cache_operation_duration_seconds_bucket", []string{`tier="meta"`, `op="write"`, `le="5"`}, "0"},
+		{"favicon_cache_operation_duration_seconds_bucket", []string{`tier="meta"`, `op="write"`, `le="+Inf"`}, "1"},
+		{"favicon_cache_operation_duration_seconds_count", []string{`tier="orig"`, `op="read"`}, "3"},
+	} {
+		if !hasSample(out, want.name, want.labels, want.value) {
+			t.Errorf("Missing %s%v %s in:\n%s", want.name, want.labels, want.value, out)
+		}
+	}
+}
+
+// hasSample reports whether out has a sample of name with exactly labels,
+// in any order, and value.
+func hasSample(out, name string, labels []string, value string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		rest, ok := strings.CutPrefix(line, name+"{")
+		if !ok {
+			continue
+		}
+		set, v, ok := strings.Cut(rest, "} ")
+		if !ok || v != value {
+			continue
+		}
+		got := strings.Split(set, ",")
+		if len(got) != len(labels) {
+			continue
+		}
+		match := true
+		for _, l := range labels {
+			found := false
+			for _, g := range got {
+				found = found || g == l
+			}
+			match = match && found
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +16,7 @@ type Metrics struct {
 	requestsDuration    sync.Map // URL path -> []float64
 	requestsInFlight    int64
 	requestsByStatus    sync.Map // Status code -> count
+	fallbacksTotal      uint64 // placeholder icon responses
 	
 	// Cache metrics
 	cacheHits           uint64
@@ -35,6 +37,35 @@ type Metrics struct {
 	candidatesFound     uint64
 	candidatesProcessed uint64
 	
+	// Image pipeline metrics
+	decodesTotal        uint64
+	decodesShared       uint64 // answered by a decode in flight for another request
+	
+	// Background work throttling
+	backgroundThrottled int32
+	backgroundPauses    uint64
+
+	// External converter usage, keyed by "converter|format|result"
+	externalConversions sync.Map
+
+	// Post-processor runs, keyed by "processor|result"
+	postProcess sync.Map
+
+	// Cache operations, keyed by "tier|op"
+	cacheOps sync.Map
+
+	// Upstream traffic, keyed by domain
+	upstream        sync.Map
+	upstreamDomains int64
+
+	// Requests of authenticated callers, keyed by principalKey
+	principalRequests sync.Map
+	principals        sync.Map // "method:id" of the callers tracked
+	principalCount    int64
+
+	// Latency objectives
+	slos []*sloTracker
+	
 	mu sync.RWMutex
 }
 
@@ -88,6 +119,12 @@ func (m *Metrics) RecordRequestStatus(status int) {
 	atomic.AddUint64(count.(*uint64), 1)
 }
 
+// IncFallback counts one response that served the placeholder icon because
+// no icon was found.
+func (m *Metrics) IncFallback() {
+	atomic.AddUint64(&m.fallbacksTotal, 1)
+}
+
 // Cache metrics
 
 func (m *Metrics) IncCacheHit() {
@@ -155,6 +192,47 @@ func (m *Metrics) AddCandidatesProcessed(count int) {
 	atomic.AddUint64(&m.candidatesProcessed, uint64(count))
 }
 
+// Image pipeline metrics
+
+// IncDecode counts one icon decoded and resized for a response; shared
+// marks one that waited for the same decode of another request instead.
+func (m *Metrics) IncDecode(shared bool) {
+	if shared {
+		atomic.AddUint64(&m.decodesShared, 1)
+		return
+	}
+	atomic.AddUint64(&m.decodesTotal, 1)
+}
+
+// Background work metrics
+
+func (m *Metrics) SetBackgroundThrottled(throttled bool) {
+	if throttled {
+		if atomic.SwapInt32(&m.backgroundThrottled, 1) == 0 {
+			atomic.AddUint64(&m.backgroundPauses, 1)
+		}
+		return
+	}
+	atomic.StoreInt32(&m.backgroundThrottled, 0)
+}
+
+// External converter metrics
+
+// IncExternalConversion counts one payload handed to an external converter.
+// format is the sniffed input format, result one of ok, error, timeout or
+// rejected.
+func (m *Metrics) IncExternalConversion(converter, format, result string) {
+	count, _ := m.externalConversions.LoadOrStore(converter+"|"+format+"|"+result, new(uint64))
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+// IncPostProcess counts one image handed to a post-processor. result is
+// one of ok, error or timeout.
+func (m *Metrics) IncPostProcess(processor, result string) {
+	count, _ := m.postProcess.LoadOrStore(processor+"|"+result, new(uint64))
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
 // Prometheus exposition
 
 func (m *Metrics) Handler() http.HandlerFunc {
@@ -170,6 +248,7 @@ func (m *Metrics) Handler() http.HandlerFunc {
 		// Request metrics
 		writeMetric(w, "favicon_requests_total", "counter", atomic.LoadUint64(&m.requestsTotal), nil)
 		writeMetric(w, "favicon_requests_in_flight", "gauge", m.GetRequestsInFlight(), nil)
+		writeMetric(w, "favicon_fallbacks_total", "counter", atomic.LoadUint64(&m.fallbacksTotal), nil)
 		
 		// Write request duration histogram
 		m.requestsDuration.Range(func(key, value interface{}) bool {
@@ -204,6 +283,7 @@ func (m *Metrics) Handler() http.HandlerFunc {
 		writeMetric(w, "favicon_cache_hit_rate", "gauge", m.GetCacheHitRate(), nil)
 		writeMetric(w, "favicon_cache_size_bytes", "gauge", atomic.LoadInt64(&m.cacheSize), nil)
 		writeMetric(w, "favicon_cache_evictions_total", "counter", atomic.LoadUint64(&m.cacheEvictions), nil)
+		m.writeCacheOpMetrics(w)
 		
 		// Error metrics
 		writeMetric(w, "favicon_errors_total", "counter", atomic.LoadUint64(&m.errorsTotal), nil)
@@ -223,6 +303,42 @@ func (m *Metrics) Handler() http.HandlerFunc {
 		// Discovery metrics
 		writeMetric(w, "favicon_candidates_found_total", "counter", atomic.LoadUint64(&m.candidatesFound), nil)
 		writeMetric(w, "favicon_candidates_processed_total", "counter", atomic.LoadUint64(&m.candidatesProcessed), nil)
+		
+		// Image pipeline metrics
+		writeMetric(w, "favicon_decodes_total", "counter", atomic.LoadUint64(&m.decodesTotal), nil)
+		writeMetric(w, "favicon_decodes_shared_total", "counter", atomic.LoadUint64(&m.decodesShared), nil)
+		
+		// Background work metrics
+		writeMetric(w, "favicon_background_throttled", "gauge", int(atomic.LoadInt32(&m.backgroundThrottled)), nil)
+		writeMetric(w, "favicon_background_pauses_total", "counter", atomic.LoadUint64(&m.backgroundPauses), nil)
+
+		// External converter metrics
+		m.externalConversions.Range(func(key, value interface{}) bool {
+			parts := strings.SplitN(key.(string), "|", 3)
+			writeMetric(w, "favicon_external_conversions_total", "counter", atomic.LoadUint64(value.(*uint64)), map[string]string{
+				"converter": parts[0],
+				"format":    parts[1],
+				"result":    parts[2],
+			})
+			return true
+		})
+		m.postProcess.Range(func(key, value interface{}) bool {
+			parts := strings.SplitN(key.(string), "|", 2)
+			writeMetric(w, "favicon_post_process_total", "counter", atomic.LoadUint64(value.(*uint64)), map[string]string{
+				"processor": parts[0],
+				"result":    parts[1],
+			})
+			return true
+		})
+
+		// Upstream traffic metrics
+		m.writeUpstreamMetrics(w)
+
+		// Per-caller usage metrics
+		m.writePrincipalMetrics(w)
+
+		// SLO metrics
+		m.writeSLOMetrics(w)
 	}
 }
 
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// MaxPrincipals caps how many authenticated callers get usage series of
+// their own; requests of callers beyond it are counted under
+// PrincipalOther. API keys are few, but token subjects need not be.
+const MaxPrincipals = 1000
+
+// PrincipalOther is the principal requests are counted under once
+// MaxPrincipals callers are tracked.
+const PrincipalOther = "(other)"
+
+// principalKey identifies the requests of one caller with one status.
+type principalKey struct {
+	method, id string
+	status     int
+}
+
+// IncPrincipalRequest counts one request of an authenticated caller:
+// method is the authenticator that vouched for it (e.g. apikey), id the
+// caller, and status the response status.
+func (m *Metrics) IncPrincipalRequest(method, id string, status int) {
+	principal := method + ":" + id
+	if _, ok := m.principals.Load(principal); !ok {
+		if atomic.LoadInt64(&m.principalCount) >= MaxPrincipals {
+			id = PrincipalOther
+		} else if _, loaded := m.principals.LoadOrStore(principal, struct{}{}); !loaded {
+			atomic.AddInt64(&m.principalCount, 1)
+		}
+	}
+	count, _ := m.principalRequests.LoadOrStore(principalKey{method, id, status}, new(uint64))
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+func (m *Metrics) writePrincipalMetrics(w http.ResponseWriter) {
+	m.principalRequests.Range(func(key, value interface{}) bool {
+		k := key.(principalKey)
+		writeMetric(w, "favicon_principal_requests_total", "counter", atomic.LoadUint64(value.(*uint64)), map[string]string{
+			"method":    k.method,
+			"principal": k.id,
+			"code":      strconv.Itoa(k.status),
+		})
+		return true
+	})
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestPrincipalMetrics(t *testing.T) {
+	m := &Metrics{}
+	m.IncPrincipalRequest("apikey", "partner", 200)
+	m.IncPrincipalRequest("apikey", "partner", 200)
+	m.IncPrincipalRequest("apikey", "partner", 429)
+	m.IncPrincipalRequest("jwt", "user-1", 404)
+
+	rec := httptest.NewRecorder()
+	m.writePrincipalMetrics(rec)
+	out := rec.Body.String()
+	for _, want := range []struct {
+		labels []string
+		value  string
+	}{
+		{[]string{`method="apikey"`, `principal="partner"`, `code="200"`}, "2"},
+		{[]string{`method="apikey"`, `principal="partner"`, `code="429"`}, "1"},
+		{[]string{`method="jwt"`, `principal="user-1"`, `code="404"`}, "1"},
+	} {
+		if !hasSample(out, "favicon_principal_requests_total", want.labels, want.value) {
+			t.Errorf("Missing favicon_principal_requests_total%v %s in:\n%s", want.labels, want.value, out)
+		}
+	}
+
+	// Past the cap, new callers share one series; known ones keep theirs
+	for i := 0; i < MaxPrincipals; i++ {
+		m.IncPrincipalRequest("jwt", "sub-"+strconv.Itoa(i), 200)
+	}
+	m.IncPrincipalRequest("apikey", "partner", 200)
+	rec = httptest.NewRecorder()
+	m.writePrincipalMetrics(rec)
+	out = rec.Body.String()
+	if !hasSample(out, "favicon_principal_requests_total", []string{`method="jwt"`, `principal="(other)"`, `code="200"`}, "2") {
+		t.Errorf("callers over MaxPrincipals not counted under %s", PrincipalOther)
+	}
+	if !hasSample(out, "favicon_principal_requests_total", []string{`method="apikey"`, `principal="partner"`, `code="200"`}, "3") {
+		t.Error("a known caller lost its series past the cap")
+	}
+}
@@ -0,0 +1,255 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sloBuckets is the number of one-minute buckets kept per objective (6h).
+const sloBuckets = 360
+
+// Burn-rate windows and the multiwindow alert thresholds from the
+// Google SRE workbook: page on fast burn, ticket on slow burn.
+var (
+	sloWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+	sloAlerts = []struct {
+		severity    string
+		long, short time.Duration
+		burn        float64
+	}{
+		{"page", time.Hour, 5 * time.Minute, 14.4},
+		{"ticket", 6 * time.Hour, 30 * time.Minute, 6},
+	}
+)
+
+// SLO is a latency objective: Target fraction of requests in Tier must
+// complete within Threshold. An empty Tier matches all favicon requests.
+type SLO struct {
+	Name      string
+	Tier      string
+	Threshold time.Duration
+	Target    float64
+}
+
+type sloBucket struct {
+	minute int64
+	good   uint64
+	total  uint64
+}
+
+type sloTracker struct {
+	slo     SLO
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+	good    uint64
+	total   uint64
+}
+
+// SLOStatus is the JSON view of one objective served at /slo.
+type SLOStatus struct {
+	Name        string             `json:"name"`
+	Tier        string             `json:"tier"`
+	ThresholdMs float64            `json:"threshold_ms"`
+	Target      float64            `json:"target"`
+	Requests    uint64             `json:"requests_total"`
+	Good        uint64             `json:"good_total"`
+	BurnRates   map[string]float64 `json:"burn_rates"`
+	Alerts      map[string]bool    `json:"alerts"`
+}
+
+// ParseSLOs parses a comma-separated list of objectives in the form
+// name:tier:threshold:target, e.g. "cache-hit:resized:50ms:99".
+// Use "*" as tier for all requests. Targets above 1 are read as percentages.
+func ParseSLOs(spec string) ([]SLO, error) {
+	var out []SLO
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := strings.Split(part, ":")
+		if len(f) != 4 {
+			return nil, fmt.Errorf("slo %q: want name:tier:threshold:target", part)
+		}
+		threshold, err := time.ParseDuration(f[2])
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("slo %q: invalid threshold", part)
+		}
+		target, err := strconv.ParseFloat(f[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("slo %q: invalid target", part)
+		}
+		if target > 1 {
+			target /= 100
+		}
+		if target <= 0 || target >= 1 {
+			return nil, fmt.Errorf("slo %q: target must be between 0 and 100%%", part)
+		}
+		tier := f[1]
+		if tier == "*" {
+			tier = ""
+		}
+		if f[0] == "" {
+			return nil, errors.New("slo: empty name")
+		}
+		out = append(out, SLO{Name: f[0], Tier: tier, Threshold: threshold, Target: target})
+	}
+	return out, nil
+}
+
+// SetSLOs replaces the configured objectives, discarding previous history.
+func (m *Metrics) SetSLOs(slos []SLO) {
+	trackers := make([]*sloTracker, 0, len(slos))
+	for _, s := range slos {
+		trackers = append(trackers, &sloTracker{slo: s})
+	}
+	m.mu.Lock()
+	m.slos = trackers
+	m.mu.Unlock()
+}
+
+// ObserveRequest records a completed favicon request served from the
+// given cache tier against every matching objective.
+func (m *Metrics) ObserveRequest(tier string, duration time.Duration) {
+	m.mu.RLock()
+	trackers := m.slos
+	m.mu.RUnlock()
+	if len(trackers) == 0 {
+		return
+	}
+	minute := time.Now().Unix() / 60
+	for _, t := range trackers {
+		if t.slo.Tier != "" && t.slo.Tier != tier {
+			continue
+		}
+		t.observe(minute, duration <= t.slo.Threshold)
+	}
+}
+
+func (t *sloTracker) observe(minute int64, good bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[minute%sloBuckets]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	t.total++
+	if good {
+		b.good++
+		t.good++
+	}
+}
+
+// burnRate returns the error-budget burn rate over the trailing window:
+// 1.0 means the budget is consumed exactly at the sustainable pace.
+func (t *sloTracker) burnRate(now time.Time, window time.Duration) float64 {
+	minute := now.Unix() / 60
+	n := int64(window / time.Minute)
+	var good, total uint64
+	t.mu.Lock()
+	for i := int64(0); i < n && i < sloBuckets; i++ {
+		b := t.buckets[(minute-i)%sloBuckets]
+		if b.minute == minute-i {
+			good += b.good
+			total += b.total
+		}
+	}
+	t.mu.Unlock()
+	if total == 0 {
+		return 0
+	}
+	errRate := float64(total-good) / float64(total)
+	return errRate / (1 - t.slo.Target)
+}
+
+func (t *sloTracker) status(now time.Time) SLOStatus {
+	st := SLOStatus{
+		Name:        t.slo.Name,
+		Tier:        t.slo.Tier,
+		ThresholdMs: float64(t.slo.Threshold) / float64(time.Millisecond),
+		Target:      t.slo.Target,
+		BurnRates:   map[string]float64{},
+		Alerts:      map[string]bool{},
+	}
+	if st.Tier == "" {
+		st.Tier = "*"
+	}
+	t.mu.Lock()
+	st.Requests, st.Good = t.total, t.good
+	t.mu.Unlock()
+
+	rates := make(map[time.Duration]float64, len(sloWindows))
+	for _, w := range sloWindows {
+		rates[w] = t.burnRate(now, w)
+		st.BurnRates[formatWindow(w)] = rates[w]
+	}
+	for _, a := range sloAlerts {
+		st.Alerts[a.severity] = rates[a.long] > a.burn && rates[a.short] > a.burn
+	}
+	return st
+}
+
+// SLOStatuses returns the current state of every configured objective.
+func (m *Metrics) SLOStatuses() []SLOStatus {
+	m.mu.RLock()
+	trackers := m.slos
+	m.mu.RUnlock()
+	now := time.Now()
+	out := make([]SLOStatus, 0, len(trackers))
+	for _, t := range trackers {
+		out = append(out, t.status(now))
+	}
+	return out
+}
+
+// SLOHandler serves the status of all configured objectives as JSON.
+func (m *Metrics) SLOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(map[string]interface{}{"objectives": m.SLOStatuses()})
+	}
+}
+
+func (m *Metrics) writeSLOMetrics(w http.ResponseWriter) {
+	for _, st := range m.SLOStatuses() {
+		labels := map[string]string{"slo": st.Name, "tier": st.Tier}
+		writeMetric(w, "favicon_slo_requests_total", "counter", st.Requests, labels)
+		writeMetric(w, "favicon_slo_good_total", "counter", st.Good, labels)
+		writeMetric(w, "favicon_slo_target", "gauge", st.Target, labels)
+		for _, win := range sloWindows {
+			key := formatWindow(win)
+			writeMetric(w, "favicon_slo_burn_rate", "gauge", st.BurnRates[key], map[string]string{
+				"slo":    st.Name,
+				"window": key,
+			})
+		}
+		for _, a := range sloAlerts {
+			v := 0
+			if st.Alerts[a.severity] {
+				v = 1
+			}
+			writeMetric(w, "favicon_slo_alert", "gauge", v, map[string]string{
+				"slo":      st.Name,
+				"severity": a.severity,
+			})
+		}
+	}
+}
+
+func formatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := ParseSLOs("cache-hit:resized:50ms:99, overall:*:1s:0.995")
+	if err != nil {
+		t.Fatalf("ParseSLOs failed: %v", err)
+	}
+	if len(slos) != 2 {
+		t.Fatalf("Expected 2 SLOs, got %d", len(slos))
+	}
+	if slos[0].Tier != "resized" || slos[0].Threshold != 50*time.Millisecond || slos[0].Target != 0.99 {
+		t.Errorf("Unexpected first SLO: %+v", slos[0])
+	}
+	if slos[1].Tier != "" || slos[1].Target != 0.995 {
+		t.Errorf("Unexpected second SLO: %+v", slos[1])
+	}
+
+	for _, bad := range []string{"x:resized:50ms", "x:resized:fast:99", "x:resized:50ms:100", ":*:1s:99"} {
+		if _, err := ParseSLOs(bad); err == nil {
+			t.Errorf("ParseSLOs(%q) should fail", bad)
+		}
+	}
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	m := &Metrics{}
+	m.SetSLOs([]SLO{{Name: "hit", Tier: "resized", Threshold: 50 * time.Millisecond, Target: 0.99}})
+
+	// 10% of matching requests are slow: burn rate 10x the sustainable pace
+	for i := 0; i < 100; i++ {
+		d := 10 * time.Millisecond
+		if i%10 == 0 {
+			d = 200 * time.Millisecond
+		}
+		m.ObserveRequest("resized", d)
+	}
+	// Other tiers do not count against this objective
+	m.ObserveRequest("fetch", time.Second)
+
+	st := m.SLOStatuses()
+	if len(st) != 1 {
+		t.Fatalf("Expected 1 status, got %d", len(st))
+	}
+	if st[0].Requests != 100 || st[0].Good != 90 {
+		t.Errorf("Expected 90/100 good, got %d/%d", st[0].Good, st[0].Requests)
+	}
+	if br := st[0].BurnRates["5m"]; br < 9.99 || br > 10.01 {
+		t.Errorf("Expected 5m burn rate 10, got %f", br)
+	}
+	if st[0].Alerts["page"] {
+		t.Error("Burn rate 10 should not page (threshold 14.4)")
+	}
+	if !st[0].Alerts["ticket"] {
+		t.Error("Burn rate 10 should open a ticket (threshold 6)")
+	}
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// upstreamBuckets is the number of one-minute buckets kept per
+	// upstream domain (1h).
+	upstreamBuckets = 60
+	// MaxUpstreamDomains caps how many upstream domains are tracked one by
+	// one; traffic to domains beyond it is counted under UpstreamOther.
+	MaxUpstreamDomains = 5000
+	// upstreamMetricDomains is how many domains, those with the most bytes
+	// fetched, get labelled Prometheus series; totals cover the rest.
+	upstreamMetricDomains = 50
+)
+
+// UpstreamOther is the domain traffic is counted under once
+// MaxUpstreamDomains domains are tracked.
+const UpstreamOther = "(other)"
+
+// upstreamWindows are the rolling windows UpstreamStats reports.
+var upstreamWindows = []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour}
+
+// UpstreamCounts counts traffic to one upstream domain.
+type UpstreamCounts struct {
+	Requests uint64 `json:"requests"`
+	// Bytes is the response bytes read, as transferred (gzip stays
+	// compressed).
+	Bytes uint64 `json:"bytes"`
+	// Errors counts requests that failed without a response: timeouts,
+	// refused connections, TLS failures.
+	Errors uint64 `json:"errors"`
+	// Throttled counts responses asking the service to back off: 429 Too
+	// Many Requests and 503 Service Unavailable.
+	Throttled uint64 `json:"throttled"`
+}
+
+func (c *UpstreamCounts) add(o UpstreamCounts) {
+	c.Requests += o.Requests
+	c.Bytes += o.Bytes
+	c.Errors += o.Errors
+	c.Throttled += o.Throttled
+}
+
+// UpstreamStat is the JSON view of one upstream domain in the stats API:
+// lifetime totals and the counts over each rolling window.
+type UpstreamStat struct {
+	Domain string `json:"domain"`
+	UpstreamCounts
+	Windows map[string]UpstreamCounts `json:"windows"`
+}
+
+type upstreamBucket struct {
+	minute int64
+	UpstreamCounts
+}
+
+type upstreamTracker struct {
+	mu      sync.Mutex
+	buckets [upstreamBuckets]upstreamBucket
+	total   UpstreamCounts
+}
+
+func (t *upstreamTracker) add(now time.Time, c UpstreamCounts) {
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total.add(c)
+	b := &t.buckets[minute%upstreamBuckets]
+	if b.minute > minute {
+		return // older than the window, totals only
+	}
+	if b.minute != minute {
+		*b = upstreamBucket{minute: minute}
+	}
+	b.add(c)
+}
+
+// window returns the counts of the trailing window.
+func (t *upstreamTracker) window(now time.Time, window time.Duration) UpstreamCounts {
+	minute := now.Unix() / 60
+	var c UpstreamCounts
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := int64(0); i < int64(window/time.Minute) && i < upstreamBuckets; i++ {
+		if b := t.buckets[(minute-i)%upstreamBuckets]; b.minute == minute-i {
+			c.add(b.UpstreamCounts)
+		}
+	}
+	return c
+}
+
+func (t *upstreamTracker) totals() UpstreamCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+func (m *Metrics) upstreamTracker(domain string) *upstreamTracker {
+	if v, ok := m.upstream.Load(domain); ok {
+		return v.(*upstreamTracker)
+	}
+	if atomic.LoadInt64(&m.upstreamDomains) >= MaxUpstreamDomains {
+		domain = UpstreamOther
+	}
+	v, loaded := m.upstream.LoadOrStore(domain, &upstreamTracker{})
+	if !loaded {
+		atomic.AddInt64(&m.upstreamDomains, 1)
+	}
+	return v.(*upstreamTracker)
+}
+
+// ObserveUpstreamRequest records one request sent to an upstream domain:
+// status is the response status, or 0 when err says the request failed.
+// Redirects are separate requests.
+func (m *Metrics) ObserveUpstreamRequest(domain string, status int, err error) {
+	c := UpstreamCounts{Requests: 1}
+	switch {
+	case err != nil:
+		c.Errors = 1
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		c.Throttled = 1
+	}
+	m.upstreamTracker(domain).add(time.Now(), c)
+}
+
+// AddUpstreamBytes records n response bytes read from an upstream domain.
+func (m *Metrics) AddUpstreamBytes(domain string, n int) {
+	if n > 0 {
+		m.upstreamTracker(domain).add(time.Now(), UpstreamCounts{Bytes: uint64(n)})
+	}
+}
+
+// UpstreamStats returns the top upstream domains by bytes fetched over the
+// last hour, busiest first, at most top of them.
+func (m *Metrics) UpstreamStats(top int) []UpstreamStat {
+	now := time.Now()
+	var out []UpstreamStat
+	m.upstream.Range(func(key, value interface{}) bool {
+		t := value.(*upstreamTracker)
+		st := UpstreamStat{Domain: key.(string), UpstreamCounts: t.totals(), Windows: make(map[string]UpstreamCounts, len(upstreamWindows))}
+		for _, w := range upstreamWindows {
+			st.Windows[formatWindow(w)] = t.window(now, w)
+		}
+		out = append(out, st)
+		return true
+	})
+	hour := formatWindow(time.Hour)
+	slices.SortFunc(out, func(a, b UpstreamStat) int {
+		if a.Windows[hour].Bytes != b.Windows[hour].Bytes {
+			return cmpDesc(a.Windows[hour].Bytes, b.Windows[hour].Bytes)
+		}
+		if a.Bytes != b.Bytes {
+			return cmpDesc(a.Bytes, b.Bytes)
+		}
+		return cmpDesc(b.Domain, a.Domain)
+	})
+	return out[:min(len(out), max(top, 0))]
+}
+
+func cmpDesc[T uint64 | string](a, b T) int {
+	switch {
+	case a > b:
+		return -1
+	case a < b:
+		return 1
+	}
+	return 0
+}
+
+func (m *Metrics) writeUpstreamMetrics(w http.ResponseWriter) {
+	var all []UpstreamStat
+	var total UpstreamCounts
+	m.upstream.Range(func(key, value interface{}) bool {
+		c := value.(*upstreamTracker).totals()
+		all = append(all, UpstreamStat{Domain: key.(string), UpstreamCounts: c})
+		total.add(c)
+		return true
+	})
+	writeMetric(w, "favicon_upstream_requests_total", "counter", total.Requests, nil)
+	writeMetric(w, "favicon_upstream_bytes_total", "counter", total.Bytes, nil)
+	writeMetric(w, "favicon_upstream_errors_total", "counter", total.Errors, nil)
+	writeMetric(w, "favicon_upstream_throttled_total", "counter", total.Throttled, nil)
+
+	// Per-domain series would be unbounded; label the heaviest only
+	slices.SortFunc(all, func(a, b UpstreamStat) int { return cmpDesc(a.Bytes, b.Bytes) })
+	for _, st := range all[:min(len(all), upstreamMetricDomains)] {
+		labels := map[string]string{"domain": st.Domain}
+		writeMetric(w, "favicon_upstream_domain_requests_total", "counter", st.Requests, labels)
+		writeMetric(w, "favicon_upstream_domain_bytes_total", "counter", st.Bytes, labels)
+		writeMetric(w, "favicon_upstream_domain_errors_total", "counter", st.Errors, labels)
+		writeMetric(w, "favicon_upstream_domain_throttled_total", "counter", st.Throttled, labels)
+	}
+}
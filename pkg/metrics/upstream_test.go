@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	m := &Metrics{}
+	for i := 0; i < 3; i++ {
+		m.ObserveUpstreamRequest("example.com", 200, nil)
+		m.AddUpstreamBytes("example.com", 1000)
+	}
+	m.ObserveUpstreamRequest("example.com", 429, nil)
+	m.ObserveUpstreamRequest("example.org", 0, errors.New("timeout"))
+	m.ObserveUpstreamRequest("example.net", 503, nil)
+	m.AddUpstreamBytes("example.net", 5000)
+	// Traffic from before the last hour counts only in the totals
+	m.upstreamTracker("example.org").add(time.Now().Add(-2*time.Hour), UpstreamCounts{Requests: 1, Bytes: 9000})
+
+	st := m.UpstreamStats(10)
+	if len(st) != 3 {
+		t.Fatalf("got %d domains, want 3", len(st))
+	}
+	if st[0].Domain != "example.net" || st[1].Domain != "example.com" || st[2].Domain != "example.org" {
+		t.Errorf("order = %s, %s, %s; want busiest in the last hour first", st[0].Domain, st[1].Domain, st[2].Domain)
+	}
+	if got, want := st[1].Windows["5m"], (UpstreamCounts{Requests: 4, Bytes: 3000, Throttled: 1}); got != want {
+		t.Errorf("example.com 5m = %+v, want %+v", got, want)
+	}
+	if got, want := st[2].UpstreamCounts, (UpstreamCounts{Requests: 2, Bytes: 9000, Errors: 1}); got != want {
+		t.Errorf("example.org total = %+v, want %+v", got, want)
+	}
+	if got := st[2].Windows["1h"]; got.Bytes != 0 || got.Requests != 1 {
+		t.Errorf("example.org 1h = %+v, want the old traffic left out", got)
+	}
+	if got := m.UpstreamStats(1); len(got) != 1 || got[0].Domain != "example.net" {
+		t.Errorf("UpstreamStats(1) = %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	m.writeUpstreamMetrics(rec)
+	out := rec.Body.String()
+	for _, want := range []struct {
+		name   string
+		labels []string
+		value  string
+	}{
+		{"favicon_upstream_domain_bytes_total", []string{`domain="example.org"`}, "9000"},
+		{"favicon_upstream_domain_requests_total", []string{`domain="example.com"`}, "4"},
+		{"favicon_upstream_domain_throttled_total", []string{`domain="example.net"`}, "1"},
+		{"favicon_upstream_domain_errors_total", []string{`domain="example.org"`}, "1"},
+	} {
+		if !hasSample(out, want.name, want.labels, want.value) {
+			t.Errorf("Missing %s%v %s in:\n%s", want.name, want.labels, want.value, out)
+		}
+	}
+}
+
+func TestUpstreamDomainCap(t *testing.T) {
+	m := &Metrics{}
+	for i := 0; i < MaxUpstreamDomains+10; i++ {
+		m.ObserveUpstreamRequest(fmt.Sprintf("site%d.example", i), 200, nil)
+	}
+	st := m.UpstreamStats(MaxUpstreamDomains + 10)
+	if len(st) != MaxUpstreamDomains+1 {
+		t.Fatalf("tracked %d domains, want %d plus %s", len(st), MaxUpstreamDomains, UpstreamOther)
+	}
+	for _, s := range st {
+		if s.Domain == UpstreamOther && s.Requests != 10 {
+			t.Errorf("%s has %d requests, want 10", UpstreamOther, s.Requests)
+		}
+	}
+}
@@ -3,8 +3,11 @@
 package ratelimit
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,9 +17,10 @@ import (
 // Limiter provides rate limiting functionality using token bucket algorithm.
 type Limiter struct {
 	globalBucket  *TokenBucket
-	ipBuckets     sync.Map // IP address -> *TokenBucket
-	ipRate        int      // requests per second per IP
-	ipBurst       int      // burst capacity per IP
+	ipBuckets     sync.Map         // IP address or key -> *TokenBucket
+	ipRate        int              // requests per second per IP
+	ipBurst       int              // burst capacity per IP
+	keyLimits     map[string]Limit // keys with a limit of their own
 	cleanupTicker *time.Ticker
 	stopCleanup   chan struct{}
 }
@@ -30,6 +34,47 @@ type TokenBucket struct {
 	mu         sync.Mutex
 }
 
+// Limit is the rate limit of one key: Rate requests per second with bursts
+// of up to Burst. A Rate of 0 leaves the key unlimited.
+type Limit struct {
+	Rate  int
+	Burst int
+}
+
+// ParseLimits parses comma-separated key=rate[/burst] entries, e.g.
+// "partner=50/100,trial=2", as taken by the -auth-key-limits flag. A
+// missing burst defaults to twice the rate.
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, spec, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("entry %q is not key=rate[/burst]", entry)
+		}
+		rate, burst, hasBurst := strings.Cut(spec, "/")
+		var lim Limit
+		var err error
+		if lim.Rate, err = strconv.Atoi(strings.TrimSpace(rate)); err != nil || lim.Rate < 0 {
+			return nil, fmt.Errorf("entry %q: rate must be a non-negative integer", entry)
+		}
+		lim.Burst = lim.Rate * 2
+		if hasBurst {
+			if lim.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || lim.Burst < 1 {
+				return nil, fmt.Errorf("entry %q: burst must be a positive integer", entry)
+			}
+		}
+		if _, dup := limits[key]; dup {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		limits[key] = lim
+	}
+	return limits, nil
+}
+
 // NewLimiter creates a new rate limiter with the specified limits.
 // globalRate: global requests per second (0 = unlimited)
 // globalBurst: global burst capacity
@@ -37,14 +82,22 @@ type TokenBucket struct {
 // ipBurst: burst capacity per IP
 // Returns nil if both rates are 0 (completely unlimited).
 func NewLimiter(globalRate, globalBurst, ipRate, ipBurst int) *Limiter {
+	return NewKeyedLimiter(globalRate, globalBurst, ipRate, ipBurst, nil)
+}
+
+// NewKeyedLimiter is like NewLimiter but gives the keys in keyLimits their
+// own limit in place of the per-IP one, e.g. a higher one for a partner's
+// API key. Returns nil if both rates are 0 and there are no key limits.
+func NewKeyedLimiter(globalRate, globalBurst, ipRate, ipBurst int, keyLimits map[string]Limit) *Limiter {
 	// If both rates are 0, no limiting needed
-	if globalRate == 0 && ipRate == 0 {
+	if globalRate == 0 && ipRate == 0 && len(keyLimits) == 0 {
 		return nil
 	}
 
 	l := &Limiter{
 		ipRate:      ipRate,
 		ipBurst:     ipBurst,
+		keyLimits:   keyLimits,
 		stopCleanup: make(chan struct{}),
 	}
 
@@ -65,7 +118,8 @@ func (l *Limiter) Stop() {
 	l.cleanupTicker.Stop()
 }
 
-// Allow checks if a request from the given IP should be allowed.
+// Allow checks if a request from the given IP, or with the given key,
+// should be allowed.
 // Returns true if allowed, false if rate limited.
 func (l *Limiter) Allow(ip string) bool {
 	// Check global limit first
@@ -74,9 +128,18 @@ func (l *Limiter) Allow(ip string) bool {
 		return false
 	}
 
+	// Check key-specific limit, which replaces the per-IP one
+	if lim, ok := l.keyLimits[ip]; ok {
+		if lim.Rate > 0 && !l.getOrCreateBucket(ip, lim.Rate, lim.Burst).allow() {
+			metrics.Get().IncError("rate_limit_key")
+			return false
+		}
+		return true
+	}
+
 	// Check IP-specific limit
 	if l.ipRate > 0 {
-		bucket := l.getOrCreateIPBucket(ip)
+		bucket := l.getOrCreateBucket(ip, l.ipRate, l.ipBurst)
 		if !bucket.allow() {
 			metrics.Get().IncError("rate_limit_ip")
 			return false
@@ -86,13 +149,13 @@ func (l *Limiter) Allow(ip string) bool {
 	return true
 }
 
-func (l *Limiter) getOrCreateIPBucket(ip string) *TokenBucket {
+func (l *Limiter) getOrCreateBucket(ip string, rate, burst int) *TokenBucket {
 	val, ok := l.ipBuckets.Load(ip)
 	if ok {
 		return val.(*TokenBucket)
 	}
 
-	bucket := newTokenBucket(float64(l.ipRate), float64(l.ipBurst))
+	bucket := newTokenBucket(float64(rate), float64(burst))
 	actual, _ := l.ipBuckets.LoadOrStore(ip, bucket)
 	return actual.(*TokenBucket)
 }
@@ -156,13 +219,17 @@ func (b *TokenBucket) allow() bool {
 
 // Middleware returns an HTTP middleware that applies rate limiting.
 func Middleware(limiter *Limiter) func(http.Handler) http.Handler {
+	return KeyedMiddleware(limiter, getClientIP)
+}
+
+// KeyedMiddleware is like Middleware but gives each key(r) its own bucket
+// in place of the client IP, e.g. to limit authenticated callers per
+// principal however many addresses they use.
+func KeyedMiddleware(limiter *Limiter, key func(r *http.Request) string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract IP address
-			ip := getClientIP(r)
-
 			// Check rate limit
-			if !limiter.Allow(ip) {
+			if !limiter.Allow(key(r)) {
 				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 				return
 			}
@@ -172,6 +239,11 @@ func Middleware(limiter *Limiter) func(http.Handler) http.Handler {
 	}
 }
 
+// ClientIP returns the client IP Middleware buckets requests by.
+func ClientIP(r *http.Request) string {
+	return getClientIP(r)
+}
+
 // getClientIP extracts the client IP from the request.
 // It checks X-Forwarded-For and X-Real-IP headers first,
 // then falls back to RemoteAddr.
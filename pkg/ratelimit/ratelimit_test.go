@@ -1,6 +1,8 @@
 package ratelimit
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -171,6 +173,81 @@ func TestLimiter_GlobalUnlimited(t *testing.T) {
 	}
 }
 
+func TestKeyedMiddleware(t *testing.T) {
+	limiter := NewLimiter(0, 0, 1, 1)
+	defer limiter.Stop()
+	h := KeyedMiddleware(limiter, func(r *http.Request) string {
+		return r.Header.Get("X-Key")
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(key string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// One address, two keys: each gets its own burst
+	if status("a") != http.StatusOK || status("b") != http.StatusOK {
+		t.Error("first request per key was limited")
+	}
+	if status("a") != http.StatusTooManyRequests {
+		t.Error("second request for key a was not limited")
+	}
+}
+
+func TestKeyedLimiter_KeyLimits(t *testing.T) {
+	limiter := NewKeyedLimiter(0, 0, 1, 1, map[string]Limit{
+		"apikey:partner":   {Rate: 1, Burst: 3},
+		"apikey:unlimited": {Rate: 0},
+	})
+	defer limiter.Stop()
+
+	allowed := func(key string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if limiter.Allow(key) {
+				count++
+			}
+		}
+		return count
+	}
+	if got := allowed("apikey:partner", 5); got != 3 {
+		t.Errorf("partner key: %d of 5 allowed, want its burst of 3", got)
+	}
+	if got := allowed("apikey:unlimited", 50); got != 50 {
+		t.Errorf("unlimited key: %d of 50 allowed", got)
+	}
+	if got := allowed("192.0.2.1", 5); got != 1 {
+		t.Errorf("other callers: %d of 5 allowed, want the per-IP burst of 1", got)
+	}
+
+	if NewKeyedLimiter(0, 0, 0, 0, nil) != nil {
+		t.Error("NewKeyedLimiter without limits returned a limiter")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(" partner=50/100 , trial=2,free=0,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Limit{"partner": {50, 100}, "trial": {2, 4}, "free": {0, 0}}
+	if len(limits) != len(want) {
+		t.Fatalf("ParseLimits = %v, want %v", limits, want)
+	}
+	for k, v := range want {
+		if limits[k] != v {
+			t.Errorf("ParseLimits[%s] = %v, want %v", k, limits[k], v)
+		}
+	}
+	for _, bad := range []string{"partner", "=5", "a=x", "a=-1", "a=5/0", "a=1,a=2"} {
+		if _, err := ParseLimits(bad); err == nil {
+			t.Errorf("ParseLimits(%q) accepted", bad)
+		}
+	}
+}
+
 func TestTokenBucket_ZeroRate(t *testing.T) {
 	// This shouldn't happen in practice due to checks in Allow(),
 	// but let's ensure it doesn't panic
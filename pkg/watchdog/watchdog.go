@@ -0,0 +1,246 @@
+// Package watchdog speaks the systemd service notification protocol
+// (sd_notify) and runs periodic health self-checks. Under a unit with
+// WatchdogSec=, the watchdog is only petted while every check passes, so
+// a process whose pipeline has deadlocked stops answering and systemd
+// restarts it. Without systemd, the checks still run and their result is
+// reported by Status, e.g. on /health.
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"faviconsvc/pkg/logger"
+	"faviconsvc/pkg/metrics"
+)
+
+// Notification states sent with Notify.
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// ErrCheckTimeout is the error of a check that did not finish within
+// Config.Timeout, or was still running from an earlier round.
+var ErrCheckTimeout = errors.New("check did not finish in time")
+
+// Notify sends state to the service manager through the socket in
+// $NOTIFY_SOCKET. It reports whether the state was sent: false with a nil
+// error means the process is not run by systemd with notifications on.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Timeout returns the watchdog timeout systemd set for this process in
+// $WATCHDOG_USEC, or 0 when the watchdog is off or meant for another
+// process ($WATCHDOG_PID).
+func Timeout() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Check is one health self-check. Func should return promptly once ctx is
+// done; one that does not is reported as ErrCheckTimeout until it returns.
+type Check struct {
+	Name string
+	Func func(ctx context.Context) error
+}
+
+// Config configures the self-checks.
+type Config struct {
+	// Interval is how often the checks run; with a systemd watchdog, at
+	// most half its timeout, so a passing round always pets it in time
+	// (0 = half the watchdog timeout, or no checks without one)
+	Interval time.Duration
+	// Timeout bounds each round of checks, which run concurrently
+	// (0 = Interval)
+	Timeout time.Duration
+	Checks  []Check
+}
+
+// Status is the outcome of the latest round of checks.
+type Status struct {
+	Healthy   bool      `json:"healthy"`
+	Failed    string    `json:"failed,omitempty"` // name of the first failing check
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Watchdog runs the checks of a Config and pets the systemd watchdog
+// while they pass. A nil *Watchdog runs nothing and is always healthy.
+type Watchdog struct {
+	cfg      Config
+	watchdog bool
+
+	mu      sync.Mutex
+	status  Status
+	running map[string]bool // checks still running from an earlier round
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start begins running the checks of cfg, returning nil when there is
+// nothing to run: no interval and no systemd watchdog.
+func Start(cfg Config) *Watchdog {
+	timeout := Timeout()
+	if half := timeout / 2; half > 0 && (cfg.Interval <= 0 || cfg.Interval > half) {
+		cfg.Interval = half
+	}
+	if cfg.Interval <= 0 {
+		return nil
+	}
+	if cfg.Timeout <= 0 || cfg.Timeout > cfg.Interval {
+		cfg.Timeout = cfg.Interval
+	}
+	w := &Watchdog{
+		cfg:      cfg,
+		watchdog: timeout > 0,
+		status:   Status{Healthy: true, CheckedAt: time.Now()},
+		running:  make(map[string]bool),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if w.watchdog {
+		logger.Info("systemd watchdog enabled: timeout %v, self-checks every %v", timeout, cfg.Interval)
+	} else {
+		logger.Info("Health self-checks every %v", cfg.Interval)
+	}
+	go w.run()
+	return w
+}
+
+// Stop ends the checks.
+func (w *Watchdog) Stop() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// Status returns the outcome of the latest round of checks.
+func (w *Watchdog) Status() Status {
+	if w == nil {
+		return Status{Healthy: true}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *Watchdog) run() {
+	defer close(w.done)
+	// The first round waits an interval, giving listeners time to start
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.round()
+		}
+	}
+}
+
+// round runs every check once, concurrently and within the check timeout,
+// and pets the watchdog when all pass.
+func (w *Watchdog) round() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.Timeout)
+	defer cancel()
+	results := make([]<-chan error, len(w.cfg.Checks))
+	for i, c := range w.cfg.Checks {
+		results[i] = w.startCheck(ctx, c)
+	}
+	st := Status{Healthy: true, CheckedAt: time.Now()}
+	for i, c := range w.cfg.Checks {
+		var err error
+		select {
+		case err = <-results[i]:
+		case <-ctx.Done():
+			err = ErrCheckTimeout
+		}
+		if err != nil && st.Healthy {
+			st = Status{Failed: c.Name, Error: err.Error(), CheckedAt: st.CheckedAt}
+		}
+	}
+
+	w.mu.Lock()
+	prev := w.status
+	w.status = st
+	w.mu.Unlock()
+
+	if !st.Healthy {
+		metrics.Get().IncError("self_check_" + st.Failed)
+		logger.Warn("Health self-check %s failed: %s", st.Failed, st.Error)
+		return
+	}
+	if !prev.Healthy {
+		logger.Info("Health self-checks pass again")
+	}
+	if w.watchdog {
+		if _, err := Notify(StateWatchdog); err != nil {
+			logger.Warn("Failed to notify the systemd watchdog: %v", err)
+		}
+	}
+}
+
+// startCheck runs c under ctx and returns the channel its result arrives
+// on. A check still running from an earlier round fails at once with
+// ErrCheckTimeout, rather than piling up another goroutine each round.
+func (w *Watchdog) startCheck(ctx context.Context, c Check) <-chan error {
+	result := make(chan error, 1)
+	w.mu.Lock()
+	if w.running[c.Name] {
+		w.mu.Unlock()
+		result <- ErrCheckTimeout
+		return result
+	}
+	w.running[c.Name] = true
+	w.mu.Unlock()
+
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			delete(w.running, c.Name)
+			w.mu.Unlock()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				result <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		result <- c.Func(ctx)
+	}()
+	return result
+}
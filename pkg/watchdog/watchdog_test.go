@@ -0,0 +1,157 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotify points $NOTIFY_SOCKET at a socket of the test and returns
+// the channel the states sent to it arrive on.
+func listenNotify(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	states := make(chan string, 64)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(StateReady); sent || err != nil {
+		t.Errorf("Notify without systemd = %v, %v; want false, nil", sent, err)
+	}
+
+	states := listenNotify(t)
+	if sent, err := Notify(StateReady); !sent || err != nil {
+		t.Fatalf("Notify = %v, %v", sent, err)
+	}
+	select {
+	case got := <-states:
+		if got != StateReady {
+			t.Errorf("received %q, want %q", got, StateReady)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification received")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := Timeout(); got != 30*time.Second {
+		t.Errorf("Timeout = %v, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := Timeout(); got != 0 {
+		t.Errorf("Timeout for another process = %v, want 0", got)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := Timeout(); got != 0 {
+		t.Errorf("Timeout without watchdog = %v, want 0", got)
+	}
+}
+
+func TestWatchdogPetsOnlyWhileHealthy(t *testing.T) {
+	states := listenNotify(t)
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "100000") // 100ms, so checks run every 50ms
+
+	var stuck atomic.Bool
+	release := make(chan struct{})
+	w := Start(Config{Checks: []Check{
+		{Name: "ok", Func: func(context.Context) error { return nil }},
+		{Name: "pipeline", Func: func(ctx context.Context) error {
+			if stuck.Load() {
+				// A deadlock: ignores ctx until released
+				<-release
+			}
+			return nil
+		}},
+	}})
+	if w == nil {
+		t.Fatal("Start returned nil under a watchdog")
+	}
+	defer w.Stop()
+	defer close(release)
+
+	select {
+	case got := <-states:
+		if got != StateWatchdog {
+			t.Fatalf("received %q, want %q", got, StateWatchdog)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("healthy checks did not pet the watchdog")
+	}
+	if st := w.Status(); !st.Healthy {
+		t.Errorf("Status = %+v, want healthy", st)
+	}
+
+	stuck.Store(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Status().Healthy && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := w.Status()
+	if st.Healthy || st.Failed != "pipeline" || st.Error != ErrCheckTimeout.Error() {
+		t.Fatalf("Status = %+v, want pipeline timed out", st)
+	}
+	// Drain pets sent before the check got stuck, then expect silence
+	time.Sleep(60 * time.Millisecond)
+	for len(states) > 0 {
+		<-states
+	}
+	select {
+	case got := <-states:
+		t.Errorf("received %q while a check is stuck", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStartWithoutWatchdog(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if w := Start(Config{}); w != nil {
+		t.Error("Start without interval or watchdog returned a Watchdog")
+	}
+	var nilW *Watchdog
+	if !nilW.Status().Healthy {
+		t.Error("nil Watchdog is not healthy")
+	}
+	nilW.Stop()
+
+	failing := errors.New("disk full")
+	w := Start(Config{Interval: 20 * time.Millisecond, Checks: []Check{
+		{Name: "cache", Func: func(context.Context) error { return failing }},
+	}})
+	defer w.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Status().Healthy && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := w.Status(); st.Failed != "cache" || st.Error != "disk full" {
+		t.Errorf("Status = %+v, want cache: disk full", st)
+	}
+}
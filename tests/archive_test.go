@@ -0,0 +1,298 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	goimage "image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"faviconsvc/internal/archive"
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/fetch"
+	"faviconsvc/internal/handler"
+)
+
+func putSnapshot(t *testing.T, a *archive.Archive, domain, day string, icon []byte) {
+	t.Helper()
+	at, _ := time.Parse(archive.DateLayout, day)
+	meta := archive.Meta{
+		Domain:      domain,
+		Date:        day,
+		IconURL:     "https://" + domain + "/favicon.png",
+		CID:         cache.ContentCID(icon),
+		ContentType: "image/png",
+		Bytes:       len(icon),
+		ArchivedAt:  at,
+	}
+	if err := a.Put(context.Background(), meta, icon); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveLookup(t *testing.T) {
+	store, err := archive.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := archive.New(store)
+	jan1 := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	jan10 := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	putSnapshot(t, a, "example.com", "2024-01-01", jan1)
+	putSnapshot(t, a, "example.com", "2024-01-10", jan10)
+
+	day := func(s string) time.Time { d, _ := time.Parse(archive.DateLayout, s); return d }
+	tests := []struct {
+		asOf     string
+		wantDate string
+	}{
+		{"2024-01-01", "2024-01-01"},
+		{"2024-01-09", "2024-01-01"},
+		{"2024-01-10", "2024-01-10"},
+		{"2024-02-05", "2024-01-10"},
+		{"2023-12-31", ""},
+		{"2024-03-01", ""}, // beyond the lookback window
+	}
+	for _, tt := range tests {
+		meta, icon, err := a.Lookup(context.Background(), "example.com", day(tt.asOf))
+		if tt.wantDate == "" {
+			if !errors.Is(err, archive.ErrNotFound) {
+				t.Errorf("as_of %s: err = %v, want ErrNotFound", tt.asOf, err)
+			}
+			continue
+		}
+		if err != nil || meta.Date != tt.wantDate {
+			t.Errorf("as_of %s: got %q, %v; want %s", tt.asOf, meta.Date, err, tt.wantDate)
+			continue
+		}
+		if meta.CID != cache.ContentCID(icon) {
+			t.Errorf("as_of %s: icon does not match its CID", tt.asOf)
+		}
+	}
+
+	// A snapshot without meta.json is incomplete and skipped
+	_ = store.Put(context.Background(), "2024-01-20/example.com/icon", []byte("partial"), "image/png")
+	if meta, _, _ := a.Lookup(context.Background(), "example.com", day("2024-01-20")); meta.Date != "2024-01-10" {
+		t.Errorf("incomplete snapshot served: %q", meta.Date)
+	}
+
+	if err := a.Put(context.Background(), archive.Meta{Domain: "../etc", Date: "2024-01-01"}, nil); err == nil {
+		t.Error("Put accepted a path-like domain")
+	}
+}
+
+func TestArchiveScheduler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{G: 255, A: 255})
+	fetches := 0
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			fetches++
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	dir := t.TempDir()
+	store, _ := archive.NewLocalStore(dir)
+	sched := &archive.Scheduler{
+		Archive: archive.New(store),
+		Domains: []string{"203.0.113.10"},
+		Fetch:   handler.ArchiveFetcher(cfg),
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if n := sched.RunOnce(context.Background(), now); n != 1 {
+		t.Fatalf("first run wrote %d snapshots, want 1", n)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "2024-01-01", "203.0.113.10", "icon"))
+	if err != nil || !bytes.Equal(got, icon) {
+		t.Fatalf("archived icon = %d bytes, %v", len(got), err)
+	}
+
+	// Later the same day nothing is refetched
+	if n := sched.RunOnce(context.Background(), now.Add(6*time.Hour)); n != 0 || fetches != 1 {
+		t.Errorf("second run wrote %d snapshots after %d page fetches, want 0 after 1", n, fetches)
+	}
+	if n := sched.RunOnce(context.Background(), now.Add(24*time.Hour)); n != 1 {
+		t.Errorf("next day wrote %d snapshots, want 1", n)
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	got, err := archive.ParseDomains("Example.com, https://www.example.org/path ,example.com")
+	if err != nil || strings.Join(got, " ") != "example.com www.example.org" {
+		t.Errorf("ParseDomains = %v, %v", got, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	_ = os.WriteFile(path, []byte("# popular sites\ngithub.com\n\nwikipedia.org # encyclopedia\n"), 0o644)
+	got, err = archive.ParseDomains("@" + path)
+	if err != nil || strings.Join(got, " ") != "github.com wikipedia.org" {
+		t.Errorf("ParseDomains(@file) = %v, %v", got, err)
+	}
+
+	if _, err := archive.ParseDomains("example.com,not a domain"); err == nil {
+		t.Error("ParseDomains accepted an invalid domain")
+	}
+}
+
+func TestFaviconHandler_AsOf(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+	// Archive lookups must not touch the network
+	fetch.HTTPClient = &http.Client{Transport: failingTransport{}}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	store, _ := archive.NewLocalStore(t.TempDir())
+	cfg.Archive = archive.New(store)
+	putSnapshot(t, cfg.Archive, "example.com", "2024-01-01", solidPNG(t, color.NRGBA{R: 255, A: 255}))
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/favicons?"+query, nil)
+		req.Header.Set("Accept", "image/png")
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	w := get("domain=example.com&sz=16&as_of=2024-01-15")
+	if w.Code != http.StatusOK || w.Header().Get(handler.HeaderArchivedDate) != "2024-01-01" {
+		t.Fatalf("status %d, archived date %q", w.Code, w.Header().Get(handler.HeaderArchivedDate))
+	}
+	img, _, err := goimage.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 {
+		t.Errorf("width = %d, want 16", b.Dx())
+	}
+	if r, g, b, _ := img.At(8, 8).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+		t.Errorf("pixel = %d,%d,%d; want the archived red icon", r>>8, g>>8, b>>8)
+	}
+	if w.Header().Get("Last-Modified") != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", w.Header().Get("Last-Modified"))
+	}
+
+	for _, q := range []string{
+		"domain=example.com&as_of=2023-06-01",
+		"domain=other.example&as_of=2024-01-15",
+		"domain=example.com&as_of=yesterday",
+	} {
+		w := get(q)
+		if w.Code != http.StatusOK || w.Header().Get(handler.HeaderArchivedDate) != "" {
+			t.Errorf("%s: status %d, archived date %q; want fallback", q, w.Code, w.Header().Get(handler.HeaderArchivedDate))
+		}
+	}
+}
+
+func TestFaviconHandler_AsOfHistory(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	red := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	blue := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(red))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/favicons?"+query, nil)
+		req.Header.Set("Accept", "image/png")
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+	centre := func(w *httptest.ResponseRecorder) color.Color {
+		img, _, err := goimage.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return color.NRGBAModel.Convert(img.At(8, 8))
+	}
+
+	// A live request records the icon it resolved
+	get("url=https://203.0.113.10/&sz=16")
+	if v, ok := cm.IconVersionAt("203.0.113.10", time.Now()); !ok || v.CID != cache.ContentCID(red) {
+		t.Fatalf("recorded version = %+v, %v", v, ok)
+	}
+
+	// The icon changed from blue to red at the start of February
+	jan := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)
+	_ = cm.RecordIconVersion("example.com", "https://example.com/icon.png", blue, jan)
+	_ = cm.RecordIconVersion("example.com", "https://example.com/icon.png", blue, jan.Add(time.Hour))
+	_ = cm.RecordIconVersion("example.com", "https://example.com/icon.png", red, feb)
+
+	tests := []struct {
+		asOf     string
+		wantDate string
+		want     color.NRGBA
+	}{
+		{"2024-01-15", "2024-01-01", color.NRGBA{B: 255, A: 255}},
+		{"2024-02-01", "2024-02-01", color.NRGBA{R: 255, A: 255}},
+		{"2024-06-01", "2024-02-01", color.NRGBA{R: 255, A: 255}},
+	}
+	for _, tt := range tests {
+		w := get("domain=example.com&sz=16&as_of=" + tt.asOf)
+		if got := w.Header().Get(handler.HeaderArchivedDate); got != tt.wantDate {
+			t.Errorf("as_of %s: version date %q, want %s", tt.asOf, got, tt.wantDate)
+			continue
+		}
+		if got := centre(w); got != tt.want {
+			t.Errorf("as_of %s: pixel %v, want %v", tt.asOf, got, tt.want)
+		}
+	}
+	if w := get("domain=example.com&as_of=2023-12-31"); w.Header().Get(handler.HeaderArchivedDate) != "" {
+		t.Error("as_of before the first version did not serve the fallback")
+	}
+
+	// Archive snapshots take precedence over the recorded history
+	store, _ := archive.NewLocalStore(t.TempDir())
+	cfg.Archive = archive.New(store)
+	putSnapshot(t, cfg.Archive, "example.com", "2024-01-10", solidPNG(t, color.NRGBA{G: 255, A: 255}))
+	w := get("domain=example.com&sz=16&as_of=2024-01-15")
+	if got := w.Header().Get(handler.HeaderArchivedDate); got != "2024-01-10" {
+		t.Errorf("with archive: version date %q, want 2024-01-10", got)
+	}
+}
@@ -0,0 +1,305 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"faviconsvc/internal/batch"
+	"faviconsvc/internal/cache"
+	"faviconsvc/internal/handler"
+)
+
+func waitJob(t *testing.T, j *batch.Job) batch.Status {
+	t.Helper()
+	select {
+	case <-j.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("batch did not finish")
+	}
+	return j.Status()
+}
+
+func TestBatchPerSitePoliteness(t *testing.T) {
+	const perHost, interval = 2, 20 * time.Millisecond
+
+	var mu sync.Mutex
+	active := make(map[string]int)
+	peak := make(map[string]int)
+	var starts []time.Time
+	resolve := func(ctx context.Context, domain string) batch.Result {
+		site := "example.com"
+		if !strings.HasSuffix(domain, ".example.com") {
+			site = domain
+		}
+		mu.Lock()
+		active[site]++
+		peak[site] = max(peak[site], active[site])
+		if site == "example.com" {
+			starts = append(starts, time.Now())
+		}
+		mu.Unlock()
+		time.Sleep(15 * time.Millisecond)
+		mu.Lock()
+		active[site]--
+		mu.Unlock()
+		return batch.Result{IconURL: "https://" + domain + "/favicon.ico"}
+	}
+
+	mgr := batch.NewManager(resolve, batch.Options{Concurrency: 8, PerHost: perHost, HostInterval: interval})
+	defer mgr.Close()
+
+	var domains []string
+	for i := 0; i < 20; i++ {
+		domains = append(domains, fmt.Sprintf("s%d.example.com", i))
+	}
+	domains = append(domains, "other.org", "203.0.113.10")
+
+	job, err := mgr.Submit(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := waitJob(t, job)
+	if st.State != batch.StateDone || st.Completed != len(domains) || st.Failed != 0 {
+		t.Fatalf("status = %+v", st)
+	}
+	if peak["example.com"] > perHost {
+		t.Errorf("peak concurrency against example.com = %d, want <= %d", peak["example.com"], perHost)
+	}
+	th := st.Throttle
+	if th.Sites != 3 || th.MaxSiteLookups != 20 || th.PerHostLimit != perHost {
+		t.Errorf("throttle = %+v, want 3 sites, 20 lookups for the busiest", th)
+	}
+	if th.PeakSiteConcurrent > perHost || th.HostWaits == 0 || th.HostWaitMs <= 0 {
+		t.Errorf("throttle = %+v, want waits and peak <= %d", th, perHost)
+	}
+	for i := 1; i < len(starts); i++ {
+		// Allow a little scheduler slack
+		if gap := starts[i].Sub(starts[i-1]); gap < interval-2*time.Millisecond {
+			t.Errorf("lookup %d started %v after the previous one, want >= %v", i, gap, interval)
+		}
+	}
+	for i, r := range st.Results {
+		if r.Domain != domains[i] || r.IconURL == "" {
+			t.Errorf("result %d = %+v", i, r)
+		}
+	}
+}
+
+func TestCanonicalDomain(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"example.com", "example.com"},
+		{"  Example.COM. ", "example.com"},
+		{"www.example.com", "example.com"},
+		{"https://WWW.Example.com/some/path?q=1", "example.com"},
+		{"http://example.com:80/", "example.com"},
+		{"https://example.com:8443", "example.com:8443"},
+		{"www.com", "www.com"},
+		{"shop.example.com..", "shop.example.com"},
+		{"Bücher.de", "xn--bcher-kva.de"},
+		{"203.0.113.10", "203.0.113.10"},
+		{"[2001:db8::1]", "[2001:db8::1]"},
+	}
+	for _, tt := range tests {
+		if got := batch.CanonicalDomain(tt.input); got != tt.want {
+			t.Errorf("CanonicalDomain(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+
+	domains, aliases := batch.Dedupe([]string{"example.com", "WWW.example.com", "https://example.com/", "other.org", "Other.org."})
+	if fmt.Sprint(domains) != "[example.com other.org]" {
+		t.Errorf("Dedupe domains = %v", domains)
+	}
+	want := map[string]string{
+		"WWW.example.com":      "example.com",
+		"https://example.com/": "example.com",
+		"Other.org.":           "other.org",
+	}
+	if fmt.Sprint(aliases) != fmt.Sprint(want) {
+		t.Errorf("Dedupe aliases = %v, want %v", aliases, want)
+	}
+	if _, aliases := batch.Dedupe([]string{"a.test", "b.test"}); aliases != nil {
+		t.Errorf("Dedupe of canonical input: aliases = %v, want nil", aliases)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	resolve := func(ctx context.Context, domain string) batch.Result {
+		if domain == "bad.test" {
+			return batch.Result{Error: "no icon found"}
+		}
+		return batch.Result{IconURL: "https://" + domain + "/favicon.ico"}
+	}
+	mgr := batch.NewManager(resolve, batch.Options{MaxDomains: 3, HostInterval: time.Millisecond})
+	defer mgr.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicons/batch", handler.BatchHandler(mgr))
+	mux.HandleFunc("/favicons/batch/", handler.BatchStatusHandler(mgr, handler.NewConfig(cache.New(t.TempDir(), time.Hour), time.Hour, time.Hour, true)))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/favicons/batch", strings.NewReader(body)))
+		return rr
+	}
+	for _, body := range []string{`{"domains":[]}`, `{"domains":["a.test","b.test","c.test","d.test"]}`, `not json`} {
+		if rr := post(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: status %d, want 400", body, rr.Code)
+		}
+	}
+
+	if rr := post(`{"domains":["a.test","A.test.","www.a.test"]}`); rr.Code != http.StatusAccepted {
+		t.Errorf("duplicates only: status %d, want 202", rr.Code)
+	}
+
+	rr := post(`{"domains":["a.test"," bad.test ","https://A.test/"]}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body)
+	}
+	var accepted struct {
+		ID         string            `json:"id"`
+		StatusURL  string            `json:"status_url"`
+		Submitted  int               `json:"submitted"`
+		Duplicates int               `json:"duplicates"`
+		Aliases    map[string]string `json:"aliases"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &accepted); err != nil || accepted.ID == "" {
+		t.Fatalf("body %s: %v", rr.Body, err)
+	}
+	if accepted.Submitted != 3 || accepted.Duplicates != 1 || accepted.Aliases["https://A.test/"] != "a.test" || accepted.Aliases[" bad.test "] != "bad.test" {
+		t.Errorf("accepted = %+v, want the URL entry merged into a.test", accepted)
+	}
+	if rr.Header().Get("Location") != accepted.StatusURL {
+		t.Errorf("Location = %q, want %q", rr.Header().Get("Location"), accepted.StatusURL)
+	}
+
+	job, ok := mgr.Get(accepted.ID)
+	if !ok {
+		t.Fatal("job not registered")
+	}
+	waitJob(t, job)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, accepted.StatusURL, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body)
+	}
+	var st batch.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.State != batch.StateDone || st.Submitted != 3 || st.Total != 2 || st.Completed != 2 || st.Failed != 1 {
+		t.Errorf("status = %+v", st)
+	}
+	if st.Results[1].Domain != "bad.test" || st.Results[1].Error == "" {
+		t.Errorf("results = %+v", st.Results)
+	}
+	if st.Throttle.PerHostLimit != batch.DefaultPerHost {
+		t.Errorf("throttle = %+v", st.Throttle)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/favicons/batch/nope", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", rr.Code)
+	}
+}
+
+func TestBatchResultsDownload(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	_ = cm.WriteOrigToCache("https://a.test/icon.png", icon)
+
+	release := make(chan struct{})
+	resolve := func(ctx context.Context, domain string) batch.Result {
+		<-release
+		if domain == "b.test" {
+			return batch.Result{Error: "no icon found"}
+		}
+		return batch.Result{IconURL: "https://" + domain + "/icon.png"}
+	}
+	dir := t.TempDir()
+	opts := batch.Options{HostInterval: time.Millisecond, Dir: dir}
+	mgr := batch.NewManager(resolve, opts)
+	defer mgr.Close()
+
+	get := func(mgr *batch.Manager, path string, header http.Header) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		handler.BatchStatusHandler(mgr, cfg)(rr, req)
+		return rr
+	}
+
+	job, _ := mgr.Submit([]string{"a.test", "b.test"})
+	id := job.Status().ID
+	if rr := get(mgr, "/favicons/batch/"+id+"/results", nil); rr.Code != http.StatusConflict {
+		t.Errorf("running job: status %d, want 409", rr.Code)
+	}
+	close(release)
+	waitJob(t, job)
+
+	rr := get(mgr, "/favicons/batch/"+id+"/results", nil)
+	var st batch.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); rr.Code != http.StatusOK || err != nil || len(st.Results) != 2 {
+		t.Fatalf("json results: status %d, %v: %s", rr.Code, err, rr.Body)
+	}
+
+	rr = get(mgr, "/favicons/batch/"+id+"/results?format=zip", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("zip results: status %d, type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	zipped := rr.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if len(files) != 2 || !bytes.Equal(files["icons/a.test.png"], icon) || files["results.json"] == nil {
+		t.Errorf("zip entries = %v, want results.json and icons/a.test.png", len(files))
+	}
+
+	// An interrupted download resumes from an offset
+	rr = get(mgr, "/favicons/batch/"+id+"/results?format=zip", http.Header{
+		"Range":    {"bytes=100-"},
+		"If-Range": {rr.Header().Get("ETag")},
+	})
+	if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), zipped[100:]) {
+		t.Errorf("ranged download: status %d, %d bytes, want 206 with %d", rr.Code, rr.Body.Len(), len(zipped)-100)
+	}
+
+	// Results outlive the process and are served unchanged
+	restarted := batch.NewManager(resolve, opts)
+	defer restarted.Close()
+	rr = get(restarted, "/favicons/batch/"+id+"/results?format=zip", nil)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), zipped) {
+		t.Errorf("after restart: status %d, archive changed", rr.Code)
+	}
+	if rr := get(restarted, "/favicons/batch/"+id, nil); rr.Code != http.StatusOK {
+		t.Errorf("status after restart: %d", rr.Code)
+	}
+	if rr := get(mgr, "/favicons/batch/"+id+"/results?format=tar", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", rr.Code)
+	}
+}
@@ -1,12 +1,20 @@
 package tests
 
 import (
+	"context"
+	"errors"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	bolt "go.etcd.io/bbolt"
+
 	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
+	"faviconsvc/pkg/metrics"
 )
 
 func TestCacheBasicOperations(t *testing.T) {
@@ -133,3 +141,561 @@ func TestCachePaths(t *testing.T) {
 		t.Errorf("Expected resized directory, got %s", filepath.Base(resizedDir))
 	}
 }
+
+func TestContentCID(t *testing.T) {
+	// Well-known CIDv1 of the empty raw block
+	if got := cache.ContentCID(nil); got != "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku" {
+		t.Errorf("ContentCID(empty) = %s", got)
+	}
+}
+
+func TestExportOrigByCID(t *testing.T) {
+	tmpDir := t.TempDir()
+	cm := cache.New(tmpDir, 1*time.Hour)
+
+	if err := cm.EnsureDirs(); err != nil {
+		t.Fatalf("Failed to create cache dirs: %v", err)
+	}
+
+	data := []byte("same icon bytes")
+	for _, u := range []string{"https://a.example.com/favicon.ico", "https://b.example.com/favicon.ico"} {
+		if err := cm.WriteOrigToCache(u, data); err != nil {
+			t.Fatalf("Failed to write to cache: %v", err)
+		}
+		_ = cm.WriteOrigMeta(u, cache.OrigMeta{URL: u, UpdatedAt: time.Now()})
+	}
+
+	outDir := filepath.Join(tmpDir, "export")
+	entries, err := cm.ExportOrigByCID(outDir, 0)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	cid := cache.ContentCID(data)
+	exported, err := os.ReadFile(filepath.Join(outDir, cid))
+	if err != nil {
+		t.Fatalf("Expected exported file for %s: %v", cid, err)
+	}
+	if string(exported) != string(data) {
+		t.Errorf("Exported data mismatch")
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "index.json")); err != nil {
+		t.Errorf("Expected index.json: %v", err)
+	}
+}
+
+func TestCandidatesCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	cm := cache.New(tmpDir, time.Hour)
+	cm.CandidatesTTL = 20 * time.Millisecond
+
+	if err := cm.EnsureDirs(); err != nil {
+		t.Fatalf("Failed to create cache dirs: %v", err)
+	}
+
+	pageURL := "https://example.com/"
+	cands := []discovery.IconCandidate{
+		{URL: "https://example.com/icon-32.png", Sizes: []int{32}, RelRank: 1},
+		{URL: "https://example.com/favicon.ico", RelRank: 3},
+	}
+	if err := cm.WriteCandidates(pageURL, cands); err != nil {
+		t.Fatalf("Failed to write candidates: %v", err)
+	}
+
+	var got []discovery.IconCandidate
+	if !cm.ReadCandidates(pageURL, &got) {
+		t.Fatal("Failed to read candidates")
+	}
+	if len(got) != 2 || got[0].URL != cands[0].URL || got[0].Sizes[0] != 32 {
+		t.Errorf("Candidates mismatch: got %+v", got)
+	}
+
+	var other []discovery.IconCandidate
+	if cm.ReadCandidates("https://other.example/", &other) {
+		t.Error("Unexpected hit for a different page")
+	}
+
+	// Candidate lists expire on their own TTL, independent of the icon cache
+	time.Sleep(30 * time.Millisecond)
+	if cm.ReadCandidates(pageURL, &got) {
+		t.Error("Candidates should have expired")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+
+	cacheIcon := func(iconURL string, sizes ...int) {
+		_ = cm.WriteOrigToCache(iconURL, []byte("icon "+iconURL))
+		_ = cm.WriteOrigMeta(iconURL, cache.OrigMeta{URL: iconURL, UpdatedAt: time.Now()})
+		for _, sz := range sizes {
+			_ = cm.WriteResizedToCache(iconURL, sz, "png", []byte("resized"))
+		}
+	}
+	// shop.example.com serves its icon from a CDN on another host
+	_ = cm.WriteResolvedIcon("https://shop.example.com/", "https://cdn.example.net/shop.png")
+	_ = cm.WriteResolvedIcon("https://shop.example.com/ rank=closest-size", "https://cdn.example.net/shop.png")
+	_ = cm.WriteCandidates("https://shop.example.com/", []string{"https://cdn.example.net/shop.png"})
+	cacheIcon("https://cdn.example.net/shop.png", 32, 64)
+	cacheIcon("https://blog.example.com/favicon.ico", 16)
+	_ = cm.WriteNegative("https://old.example.com/", "not-found", time.Hour)
+	_ = cm.WriteResolvedIcon("https://example.com/", "https://example.com/favicon.ico")
+	cacheIcon("https://example.com/favicon.ico", 32)
+
+	opts := cache.PurgeOptions{HostPattern: "*.Example.com", DryRun: true, Sizes: []int{16, 32, 64}, Formats: []string{"png", "webp"}}
+	entries, err := cm.Purge(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := map[string]int{}
+	for _, e := range entries {
+		tiers[e.Tier]++
+		if e.Bytes <= 0 || e.Key == "" {
+			t.Errorf("entry %+v has no size or key", e)
+		}
+		if strings.Contains(e.Key, "://example.com/") {
+			t.Errorf("apex entry matched *.example.com: %+v", e)
+		}
+	}
+	// Both rankings' mappings, one failed lookup, one candidate list, two
+	// icons (orig + meta each) and their three resized variants
+	want := map[string]int{cache.TierResolved: 2, cache.TierNegative: 1, cache.TierCandidates: 1, cache.TierOrig: 2, cache.TierMeta: 2, cache.TierResized: 3}
+	for tier, n := range want {
+		if tiers[tier] != n {
+			t.Errorf("%s entries = %d, want %d (all: %+v)", tier, tiers[tier], n, entries)
+		}
+	}
+	if _, ok := cm.ReadResolvedIcon("https://shop.example.com/"); !ok {
+		t.Fatal("dry run deleted entries")
+	}
+
+	opts.DryRun = false
+	if _, err := cm.Purge(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.ReadResolvedIcon("https://shop.example.com/"); ok {
+		t.Error("resolved mapping survived purge")
+	}
+	if _, ok := cm.ReadOrigFromCache("https://cdn.example.net/shop.png"); ok {
+		t.Error("CDN icon of a purged page survived purge")
+	}
+	if _, ok := cm.ReadOrigMeta("https://blog.example.com/favicon.ico"); ok {
+		t.Error("metadata survived purge")
+	}
+	if _, ok := cm.ReadNegative("https://old.example.com/"); ok {
+		t.Error("failed lookup survived purge")
+	}
+	if _, ok := cm.ReadOrigFromCache("https://example.com/favicon.ico"); !ok {
+		t.Error("unmatched apex icon was purged")
+	}
+	if entries, _ := cm.Purge(cache.PurgeOptions{HostPattern: "example.*", DryRun: true}); len(entries) != 3 {
+		t.Errorf("example.* matched %d entries, want 3: %+v", len(entries), entries)
+	}
+
+	// AllVariants finds resized variants of any size and format
+	_ = cm.WriteResizedToCache("https://example.com/favicon.ico", 48, "webp-pad10-dark", []byte("resized"))
+	entries, _ = cm.Purge(cache.PurgeOptions{HostPattern: "example.*", DryRun: true, AllVariants: true})
+	if n := len(entries); n != 5 {
+		t.Errorf("example.* with AllVariants matched %d entries, want 5: %+v", n, entries)
+	}
+
+	for _, bad := range []string{"", "[", "../orig"} {
+		if _, err := cm.Purge(cache.PurgeOptions{HostPattern: bad}); err != cache.ErrBadHostPattern {
+			t.Errorf("pattern %q: err = %v, want ErrBadHostPattern", bad, err)
+		}
+	}
+}
+
+func TestCacheOperationMetrics(t *testing.T) {
+	metrics.Reset()
+	cm := cache.New(t.TempDir(), time.Hour)
+	if err := cm.EnsureDirs(); err != nil {
+		t.Fatalf("Failed to create cache dirs: %v", err)
+	}
+
+	const iconURL = "https://example.com/favicon.ico"
+	cm.ReadOrigFromCache(iconURL)
+	if err := cm.WriteOrigToCache(iconURL, []byte("icon")); err != nil {
+		t.Fatalf("Failed to write to cache: %v", err)
+	}
+	cm.ReadOrigFromCache(iconURL)
+	cm.ReadOrigMeta(iconURL)
+
+	rec := httptest.NewRecorder()
+	metrics.Get().Handler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var found []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "favicon_cache_operations_total{") {
+			found = append(found, line)
+		}
+	}
+	for _, want := range [][]string{
+		{`tier="orig"`, `op="read"`, `result="hit"`},
+		{`tier="orig"`, `op="read"`, `result="miss"`},
+		{`tier="orig"`, `op="write"`, `result="ok"`},
+		{`tier="history"`, `op="write"`, `result="ok"`},
+		{`tier="meta"`, `op="read"`, `result="miss"`},
+	} {
+		ok := false
+		for _, line := range found {
+			all := true
+			for _, l := range want {
+				all = all && strings.Contains(line, l)
+			}
+			ok = ok || all
+		}
+		if !ok {
+			t.Errorf("No favicon_cache_operations_total sample with %v in %v", want, found)
+		}
+	}
+}
+
+func TestCacheUsage(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+
+	_ = cm.WriteOrigToCache("https://example.com/favicon.ico", []byte("icon"))
+	_ = cm.WriteOrigMeta("https://example.com/favicon.ico", cache.OrigMeta{URL: "https://example.com/favicon.ico", UpdatedAt: time.Now()})
+	_ = cm.WriteResizedToCache("https://example.com/favicon.ico", 16, "png", []byte("resized16"))
+	_ = cm.WriteResizedToCache("https://example.com/favicon.ico", 32, "png", []byte("resized32"))
+	_ = cm.WriteResolvedIcon("https://example.com/", "https://example.com/favicon.ico")
+	// Leftovers of interrupted writes are not entries
+	_ = os.WriteFile(filepath.Join(cm.ResizedCacheDir(), ".tmp-123"), []byte("partial"), 0o644)
+
+	usage, err := cm.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage[cache.TierResized]; u.Entries != 2 || u.Bytes != int64(len("resized16")+len("resized32")) {
+		t.Errorf("resized usage = %+v, want 2 entries of %d bytes", u, len("resized16")+len("resized32"))
+	}
+	for _, tier := range []string{cache.TierOrig, cache.TierMeta, cache.TierResolved} {
+		if u := usage[tier]; u.Entries != 1 || u.Bytes <= 0 || u.Oldest.IsZero() || u.Newest.Before(u.Oldest) {
+			t.Errorf("%s usage = %+v, want one entry", tier, u)
+		}
+	}
+	if u, ok := usage[cache.TierCandidates]; ok {
+		t.Errorf("empty candidates tier reported: %+v", u)
+	}
+
+	if _, err := cache.New(filepath.Join(t.TempDir(), "missing"), time.Hour).Usage(); err == nil {
+		t.Error("missing cache directory reported no error")
+	}
+}
+
+func TestCacheInspect(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	cm.CandidatesTTL = 10 * time.Minute
+	_ = cm.EnsureDirs()
+
+	const iconURL = "https://cdn.example.net/shop.png"
+	png := []byte("\x89PNG\r\n\x1a\n icon")
+	_ = cm.WriteResolvedIcon("https://shop.example.com/", iconURL)
+	_ = cm.WriteCandidates("https://shop.example.com/", []string{iconURL, "https://shop.example.com/favicon.ico"})
+	_ = cm.WriteOrigToCache(iconURL, png)
+	_ = cm.WriteOrigMeta(iconURL, cache.OrigMeta{URL: iconURL, ETag: `"v1"`, UpdatedAt: time.Now()})
+	_ = cm.WriteResizedToCache(iconURL, 64, "png", []byte("resized64"))
+	_ = cm.WriteResizedToCache(iconURL, 32, "webp-pad10-dark", []byte("resized32"))
+	_ = cm.WriteResizedToCache("https://example.com/favicon.ico", 32, "png", []byte("other host"))
+
+	got, err := cm.Inspect("shop.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Pages) != 2 {
+		t.Fatalf("pages = %+v, want resolved mapping and candidate list", got.Pages)
+	}
+	for _, p := range got.Pages {
+		switch p.Tier {
+		case cache.TierResolved:
+			if p.IconURL != iconURL || p.Expires == nil || p.Expires.Sub(p.Modified) != time.Hour {
+				t.Errorf("resolved page = %+v", p)
+			}
+		case cache.TierCandidates:
+			if p.Candidates != 2 || p.Expires == nil || p.Expires.Sub(p.Modified) != 10*time.Minute {
+				t.Errorf("candidates page = %+v, want 2 candidates expiring after CandidatesTTL", p)
+			}
+		}
+	}
+	if len(got.Icons) != 1 {
+		t.Fatalf("icons = %+v, want only the resolved CDN icon", got.Icons)
+	}
+	ic := got.Icons[0]
+	if ic.URL != iconURL || ic.ContentHash != cache.ContentCID(png) || ic.ContentType != "image/png" || ic.Original == nil {
+		t.Errorf("icon = %+v", ic)
+	}
+	if ic.Meta == nil || ic.Meta.ETag != `"v1"` {
+		t.Errorf("icon meta = %+v, want ETag", ic.Meta)
+	}
+	if len(ic.Variants) != 2 ||
+		ic.Variants[0].Size != 64 || ic.Variants[0].Format != "png" ||
+		ic.Variants[1].Size != 32 || ic.Variants[1].Format != "webp-pad10-dark" {
+		t.Errorf("variants = %+v, want png@64 and webp-pad10-dark@32", ic.Variants)
+	}
+
+	if _, err := cm.Inspect("["); err != cache.ErrBadHostPattern {
+		t.Errorf("bad pattern: err = %v, want ErrBadHostPattern", err)
+	}
+}
+
+func TestCacheResizedShared(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+
+	const a, b, c = "https://a.example/icon.png", "https://b.example/icon.png", "https://c.example/icon.png"
+	stat := func(iconURL string, size int) os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(cm.ResizedCachePath(iconURL, size, "png"))
+		if err != nil {
+			t.Fatalf("%s@%d not cached: %v", iconURL, size, err)
+		}
+		return info
+	}
+
+	_ = cm.WriteResizedShared(a, 32, "png", "key1", []byte("rendered from a"))
+	_ = cm.WriteResizedShared(b, 32, "png", "key1", []byte("rendered from b"))
+	_ = cm.WriteResizedShared(b, 64, "png", "key1", []byte("b at 64"))
+	_ = cm.WriteResizedShared(c, 32, "png", "key2", []byte("rendered from c"))
+	if !os.SameFile(stat(a, 32), stat(b, 32)) {
+		t.Error("variants with one visual key are stored twice")
+	}
+	if got, _, _ := cm.ReadResizedFromCacheWithMod(b, 32, "png"); string(got) != "rendered from a" {
+		t.Errorf("b@32 = %q, want the shared bytes", got)
+	}
+	if os.SameFile(stat(b, 32), stat(b, 64)) || os.SameFile(stat(a, 32), stat(c, 32)) {
+		t.Error("variants of another size or key are shared")
+	}
+	// Writing a shared variant again is harmless
+	if err := cm.WriteResizedShared(b, 32, "png", "key1", []byte("again")); err != nil || !os.SameFile(stat(a, 32), stat(b, 32)) {
+		t.Errorf("relinking: err = %v", err)
+	}
+
+	// Purging one host leaves the others' links readable
+	if _, err := cm.Purge(cache.PurgeOptions{HostPattern: "a.example", AllVariants: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, _ := cm.ReadResizedFromCacheWithMod(b, 32, "png"); !ok || string(got) != "rendered from a" {
+		t.Errorf("b@32 after purging a = %q, %v", got, ok)
+	}
+
+	// An expired shared file is replaced, not linked to
+	old := time.Now().Add(-2 * time.Hour)
+	shared, _ := filepath.Glob(filepath.Join(cm.SharedResizedCacheDir(), "*.png"))
+	for _, p := range shared {
+		_ = os.Chtimes(p, old, old)
+	}
+	_ = cm.WriteResizedShared(a, 32, "png", "key1", []byte("fresh"))
+	if got, ok, _ := cm.ReadResizedFromCacheWithMod(a, 32, "png"); !ok || string(got) != "fresh" {
+		t.Errorf("a@32 after expiry = %q, %v, want fresh bytes", got, ok)
+	}
+
+	_ = cm.WriteResizedShared(c, 16, "png", "", []byte("unshared"))
+	if got, ok, _ := cm.ReadResizedFromCacheWithMod(c, 16, "png"); !ok || string(got) != "unshared" {
+		t.Errorf("keyless write = %q, %v", got, ok)
+	}
+}
+
+func TestCacheMigrate(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	if v, err := cm.Schema(); err != nil || v != cache.SchemaVersion {
+		t.Fatalf("empty directory: schema %d, %v; want %d", v, err, cache.SchemaVersion)
+	}
+
+	iconURL, pageURL := "https://example.com/favicon.ico", "https://example.com/"
+	_ = cm.WriteOrigToCache(iconURL, []byte("icon"))
+	_ = cm.WriteResizedToCache(iconURL, 32, "png", []byte("resized"))
+	_ = cm.WriteResolvedIcon(pageURL, iconURL)
+	_ = cm.WriteCandidates(pageURL, []string{iconURL})
+
+	// Schemas 1 and 2 kept metadata in a file next to the original
+	origs, _ := filepath.Glob(filepath.Join(cm.OrigCacheDir(), "??", "*"))
+	if len(origs) != 1 {
+		t.Fatalf("originals = %v, want one", origs)
+	}
+	if err := os.WriteFile(origs[0]+".meta", []byte(`{"url": "`+iconURL+`", "etag": "\"v1\""}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shard := filepath.Dir(origs[0])
+	_ = os.WriteFile(filepath.Join(shard, filepath.Base(shard)+strings.Repeat("0", 62)+".meta"), []byte("not json"), 0o644)
+
+	// Flatten the shards into the layout of schema 1
+	for _, dir := range []string{cm.OrigCacheDir(), cm.ResizedCacheDir(), cm.ResolvedCacheDir(), cm.CandidatesCacheDir()} {
+		paths, _ := filepath.Glob(filepath.Join(dir, "??", "*"))
+		for _, p := range paths {
+			if err := os.Rename(p, filepath.Join(dir, filepath.Base(p))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_ = os.WriteFile(filepath.Join(cm.ResizedCacheDir(), ".tmp-1"), []byte("partial"), 0o644)
+	if _, ok := cm.ReadOrigFromCache(iconURL); ok {
+		t.Fatal("flat entry read without migrating")
+	}
+	if _, ok := cm.ReadOrigMeta(iconURL); ok {
+		t.Fatal("metadata file read without migrating")
+	}
+	if v, _ := cm.Schema(); v != 1 {
+		t.Fatalf("unversioned directory with entries: schema %d, want 1", v)
+	}
+
+	var logged []string
+	steps, err := cm.Migrate(func(format string, args ...any) { logged = append(logged, format) })
+	if err != nil || len(steps) != 2 {
+		t.Fatalf("Migrate() = %d steps, %v; want 2 steps", len(steps), err)
+	}
+	if len(logged) < 3 {
+		t.Errorf("logged %d lines, want start, progress and end", len(logged))
+	}
+	if v, _ := cm.Schema(); v != cache.SchemaVersion {
+		t.Errorf("schema after Migrate = %d, want %d", v, cache.SchemaVersion)
+	}
+	if b, ok := cm.ReadOrigFromCache(iconURL); !ok || string(b) != "icon" {
+		t.Error("original lost by the migration")
+	}
+	if meta, ok := cm.ReadOrigMeta(iconURL); !ok || meta.ETag != `"v1"` {
+		t.Error("metadata lost by the migration")
+	}
+	if _, ok, _ := cm.ReadResizedFromCacheWithMod(iconURL, 32, "png"); !ok {
+		t.Error("resized variant lost by the migration")
+	}
+	if r, ok := cm.ReadResolvedIcon(pageURL); !ok || r.IconURL != iconURL {
+		t.Error("resolved mapping lost by the migration")
+	}
+	var cands []string
+	if !cm.ReadCandidates(pageURL, &cands) || len(cands) != 1 {
+		t.Error("candidates lost by the migration")
+	}
+	if _, err := os.Stat(filepath.Join(cm.ResizedCacheDir(), ".tmp-1")); !os.IsNotExist(err) {
+		t.Error("temp file left behind")
+	}
+	if left, _ := filepath.Glob(filepath.Join(cm.OrigCacheDir(), "??", "*.meta")); len(left) != 0 {
+		t.Errorf("metadata files left behind: %v", left)
+	}
+
+	// A directory of schema 2 without a SCHEMA file is told by its metadata files
+	_ = os.Remove(filepath.Join(cm.CacheDir, "SCHEMA"))
+	_ = os.WriteFile(origs[0]+".meta", []byte(`{"url": "`+iconURL+`", "etag": "\"v2\""}`), 0o644)
+	if v, _ := cm.Schema(); v != 2 {
+		t.Errorf("unversioned directory with metadata files: schema %d, want 2", v)
+	}
+	if steps, err := cm.Migrate(nil); err != nil || len(steps) != 1 {
+		t.Errorf("Migrate() from schema 2 = %d steps, %v; want 1 step", len(steps), err)
+	}
+	if meta, ok := cm.ReadOrigMeta(iconURL); !ok || meta.ETag != `"v2"` {
+		t.Errorf("metadata after migrating from schema 2 = %+v, want ETag \"v2\"", meta)
+	}
+
+	if steps, err := cm.Migrate(nil); err != nil || len(steps) != 0 {
+		t.Errorf("second Migrate() = %d steps, %v; want none", len(steps), err)
+	}
+	_ = os.WriteFile(filepath.Join(cm.CacheDir, "SCHEMA"), []byte("99\n"), 0o644)
+	if _, err := cm.Migrate(nil); !errors.Is(err, cache.ErrNewerSchema) {
+		t.Errorf("newer schema: err = %v, want ErrNewerSchema", err)
+	}
+}
+
+func TestCacheIndex(t *testing.T) {
+	const iconURL = "https://example.com/favicon.ico"
+	dir := t.TempDir()
+	cm := cache.New(dir, time.Hour)
+	_ = cm.EnsureDirs()
+	if err := cm.WriteOrigToCache(iconURL, []byte("icon")); err != nil {
+		t.Fatalf("WriteOrigToCache() = %v", err)
+	}
+	if err := cm.WriteOrigMeta(iconURL, cache.OrigMeta{URL: iconURL, ETag: `"v1"`}); err != nil {
+		t.Fatalf("WriteOrigMeta() = %v", err)
+	}
+
+	// The index is not held between operations, so another process, such
+	// as a second replica on the same volume, can write to it
+	db, err := bolt.Open(filepath.Join(dir, "index.db"), 0o644, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("opening the index after a write: %v", err)
+	}
+	// A writer holding it keeps others out of metadata only
+	if err := cm.WriteOrigMeta(iconURL, cache.OrigMeta{URL: iconURL}); !errors.Is(err, cache.ErrIndexInUse) {
+		t.Errorf("WriteOrigMeta() = %v, want ErrIndexInUse", err)
+	}
+	if _, err := cm.Purge(cache.PurgeOptions{HostPattern: "example.com", DryRun: true}); !errors.Is(err, cache.ErrIndexInUse) {
+		t.Errorf("Purge() = %v, want ErrIndexInUse", err)
+	}
+	if usage, err := cm.Usage(); err != nil || usage[cache.TierOrig].Entries != 1 {
+		t.Errorf("Usage() = %+v, %v; want the original", usage, err)
+	} else if u, ok := usage[cache.TierMeta]; ok {
+		t.Errorf("Usage() reports the busy index: %+v", u)
+	}
+	// The CID export goes without source URLs then
+	entries, err := cm.ExportOrigByCID(t.TempDir(), 0)
+	if err != nil || len(entries) != 1 || entries[0].URL != "" {
+		t.Errorf("ExportOrigByCID() next to a writer = %+v, %v; want the original without its URL", entries, err)
+	}
+	_ = db.Close()
+
+	// Readers share it
+	db, err = bolt.Open(filepath.Join(dir, "index.db"), 0o644, &bolt.Options{ReadOnly: true, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, ok := cm.ReadOrigMeta(iconURL); !ok || meta.ETag != `"v1"` {
+		t.Errorf("ReadOrigMeta() next to a reader = %+v, %v", meta, ok)
+	}
+	entries, err = cm.ExportOrigByCID(t.TempDir(), 0)
+	if err != nil || len(entries) != 1 || entries[0].URL != iconURL {
+		t.Errorf("ExportOrigByCID() next to a reader = %+v, %v", entries, err)
+	}
+	_ = db.Close()
+
+	// An unreadable index is replaced, as it only caches metadata
+	dir = t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "index.db"), []byte(strings.Repeat("garbage!", 1000)), 0o644)
+	cm = cache.New(dir, time.Hour)
+	if err := cm.WriteOrigMeta(iconURL, cache.OrigMeta{URL: iconURL, ETag: `"v1"`}); err != nil {
+		t.Fatalf("WriteOrigMeta() over a corrupt index = %v", err)
+	}
+	if meta, ok := cm.ReadOrigMeta(iconURL); !ok || meta.ETag != `"v1"` {
+		t.Errorf("ReadOrigMeta() = %+v, %v", meta, ok)
+	}
+}
+
+func TestJanitorPrunesIndex(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	const kept, orphan = "https://example.com/favicon.ico", "https://gone.example.com/favicon.ico"
+	_ = cm.WriteOrigToCache(kept, []byte("icon"))
+	_ = cm.WriteOrigMeta(kept, cache.OrigMeta{URL: kept, ETag: `"v1"`})
+	_ = cm.WriteOrigMeta(orphan, cache.OrigMeta{URL: orphan, ETag: `"v1"`})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.RunJanitor(ctx, time.Hour, cm.CacheDir, time.Hour, 0, 0)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, ok := cm.ReadOrigMeta(orphan); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor kept the metadata of an original not cached")
+		}
+	}
+	if _, ok := cm.ReadOrigMeta(kept); !ok {
+		t.Error("janitor removed the metadata of a cached original")
+	}
+}
+
+func TestCacheProbe(t *testing.T) {
+	dir := t.TempDir()
+	cm := cache.New(dir, time.Hour)
+	if err := cm.Probe(); err != nil {
+		t.Fatalf("Probe() = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Probe left %d files behind", len(entries))
+	}
+	if err := cache.New(filepath.Join(dir, "missing"), time.Hour).Probe(); err == nil {
+		t.Error("Probe() of a missing directory succeeded")
+	}
+}
@@ -1,9 +1,18 @@
 package tests
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"faviconsvc/internal/discovery"
+	"faviconsvc/internal/fetch"
 )
 
 func TestIsICO(t *testing.T) {
@@ -30,6 +39,29 @@ func TestIsICO(t *testing.T) {
 	}
 }
 
+func TestIconCandidateFormat(t *testing.T) {
+	tests := []struct {
+		typ  string
+		url  string
+		want string
+	}{
+		{"image/svg+xml", "https://example.com/icon", "svg"},
+		{"image/vnd.microsoft.icon", "https://example.com/icon.png", "ico"},
+		{"image/png; charset=binary", "https://example.com/icon", "png"},
+		{"", "https://example.com/favicon.ico?v=2", "ico"},
+		{"", "https://example.com/Logo.JPG", "jpeg"},
+		{"", "https://example.com/icon", ""},
+		{"image/webp", "data:image/webp;base64,AAAA", "webp"},
+	}
+
+	for _, tt := range tests {
+		c := discovery.IconCandidate{URL: tt.url, Type: tt.typ}
+		if got := c.Format(); got != tt.want {
+			t.Errorf("Format() of %q (%q) = %q, want %q", tt.url, tt.typ, got, tt.want)
+		}
+	}
+}
+
 func TestIsSVGContentType(t *testing.T) {
 	tests := []struct {
 		contentType string
@@ -108,6 +140,22 @@ func TestCanonicalizeURLString(t *testing.T) {
 			"https://example.com",
 			"https://example.com/",
 		},
+		{
+			"https://Bücher.de/icon.png",
+			"https://xn--bcher-kva.de/icon.png",
+		},
+		{
+			"https://b%C3%BCcher.de:443/",
+			"https://xn--bcher-kva.de/",
+		},
+		{
+			"https://xn--bcher-kva.de",
+			"https://xn--bcher-kva.de/",
+		},
+		{
+			"https://日本語。jp",
+			"https://xn--wgv71a119e.jp/",
+		},
 	}
 
 	for _, tt := range tests {
@@ -128,3 +176,498 @@ func TestParseSizes(t *testing.T) {
 func TestComputeSizeScore(t *testing.T) {
 	// Similar to above - internal function
 }
+
+func TestDecodeDataURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    string
+		wantCT  string
+		wantErr bool
+	}{
+		{"base64 png", "data:image/png;base64,aGVsbG8=", "hello", "image/png", false},
+		{"wrapped base64", "data:image/png;base64,aGVs\n bG8=", "hello", "image/png", false},
+		{"unpadded base64", "data:image/png;base64,aGVsbG8", "hello", "image/png", false},
+		{"percent-encoded svg", "data:image/svg+xml,%3Csvg%2F%3E", "<svg/>", "image/svg+xml", false},
+		{"no media type", "data:,hi", "hi", "text/plain", false},
+		{"missing comma", "data:image/png;base64", "", "", true},
+		{"not a data uri", "https://example.com/favicon.ico", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ct, err := discovery.DecodeDataURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeDataURI(%q) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("DecodeDataURI(%q) = %q, want %q", tt.uri, got, tt.want)
+			}
+			if ct != tt.wantCT {
+				t.Errorf("DecodeDataURI(%q) content type = %q, want %q", tt.uri, ct, tt.wantCT)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeURLString_DataURI(t *testing.T) {
+	uri := "data:image/png;base64,aGVsbG8="
+	if got := discovery.CanonicalizeURLString(uri); got != uri {
+		t.Errorf("CanonicalizeURLString(%q) = %q, want unchanged", uri, got)
+	}
+}
+
+type stubRenderer struct {
+	dom   string
+	calls int
+}
+
+func (r *stubRenderer) RenderDOM(ctx context.Context, pageURL string) (string, error) {
+	r.calls++
+	return r.dom, nil
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("offline")
+}
+
+func TestDiscoverFromPageThenRoot_RenderedDOM(t *testing.T) {
+	prevClient, prevRenderer := fetch.HTTPClient, discovery.PageRenderer
+	defer func() { fetch.HTTPClient, discovery.PageRenderer = prevClient, prevRenderer }()
+
+	// Static fetch yields nothing, so only the rendered DOM can supply icons
+	fetch.HTTPClient = &http.Client{Transport: failingTransport{}}
+	r := &stubRenderer{dom: `<html><head><link rel="icon" href="/static/app.png" sizes="64x64"></head></html>`}
+	discovery.PageRenderer = r
+
+	u, _ := url.Parse("https://spa.example.com/app")
+	cands := discovery.DiscoverFromPageThenRoot(context.Background(), u, 32)
+	if r.calls != 1 {
+		t.Fatalf("renderer called %d times, want 1", r.calls)
+	}
+	if len(cands) == 0 || cands[0].URL != "https://spa.example.com/static/app.png" {
+		t.Fatalf("first candidate = %+v, want rendered icon", cands)
+	}
+
+	discovery.PageRenderer = nil
+	cands = discovery.DiscoverFromPageThenRoot(context.Background(), u, 32)
+	if len(cands) == 0 || cands[0].URL != "https://spa.example.com/favicon.ico" {
+		t.Errorf("without renderer first candidate = %+v, want root favicon.ico", cands)
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	cands := []discovery.IconCandidate{
+		{URL: "https://example.com/favicon.ico", RelRank: 3},
+		{URL: "https://example.com/icon-16.png", Sizes: []int{16}, RelRank: 1},
+		{URL: "https://example.com/icon-64.png", Sizes: []int{64}, RelRank: 1},
+	}
+
+	discovery.RankCandidates(cands, 64)
+	if cands[0].URL != "https://example.com/icon-64.png" || cands[2].RelRank != 3 {
+		t.Errorf("sz=64 order = %v, %v, %v", cands[0].URL, cands[1].URL, cands[2].URL)
+	}
+
+	discovery.RankCandidates(cands, 16)
+	if cands[0].URL != "https://example.com/icon-16.png" || cands[0].SizeScore != 0 {
+		t.Errorf("sz=16 first = %+v", cands[0])
+	}
+}
+
+// pageTransport serves canned HTML keyed by request URL.
+type pageTransport map[string]string
+
+func (p pageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := p[req.URL.String()]
+	if !ok {
+		return nil, errors.New("offline")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestDiscoverFromPageThenRoot_FollowsRedirects(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// Public IP literals keep security validation free of DNS lookups
+	tests := []struct {
+		name  string
+		pages pageTransport
+		want  string
+	}{
+		{
+			name: "meta refresh",
+			pages: pageTransport{
+				"https://203.0.113.10/":      `<meta http-equiv="Refresh" content="0; URL='https://198.51.100.20/home'">`,
+				"https://198.51.100.20/home": `<link rel="icon" href="/i.png">`,
+			},
+			want: "https://198.51.100.20/i.png",
+		},
+		{
+			name: "canonical",
+			pages: pageTransport{
+				"https://203.0.113.10/":  `<link rel="canonical" href="https://198.51.100.20/">`,
+				"https://198.51.100.20/": `<link rel="icon" href="/c.svg">`,
+			},
+			want: "https://198.51.100.20/c.svg",
+		},
+		{
+			name: "private target rejected",
+			pages: pageTransport{
+				"https://203.0.113.10/": `<meta http-equiv="refresh" content="0;url=http://10.0.0.1/">`,
+				"http://10.0.0.1/":      `<link rel="icon" href="/x.png">`,
+			},
+			want: "https://203.0.113.10/favicon.ico",
+		},
+		{
+			name: "single level only",
+			pages: pageTransport{
+				"https://203.0.113.10/":  `<link rel="canonical" href="https://198.51.100.20/">`,
+				"https://198.51.100.20/": `<link rel="canonical" href="https://192.0.2.30/">`,
+				"https://192.0.2.30/":    `<link rel="icon" href="/deep.png">`,
+			},
+			want: "https://203.0.113.10/favicon.ico",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch.HTTPClient = &http.Client{Transport: tt.pages}
+			u, _ := url.Parse("https://203.0.113.10/")
+			cands := discovery.DiscoverFromPageThenRoot(context.Background(), u, 32)
+			if len(cands) == 0 || cands[0].URL != tt.want {
+				t.Errorf("first candidate = %+v, want %s", cands, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverFromPageThenRoot_AlternatePages(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+	defer func() { discovery.AlternatePages = false }()
+
+	tests := []struct {
+		name    string
+		enabled bool
+		pages   pageTransport
+		want    string
+	}{
+		{
+			name:    "amp",
+			enabled: true,
+			pages: pageTransport{
+				"https://203.0.113.10/":     `<link rel="alternate" media="only screen and (max-width: 640px)" href="/m/"><link rel="amphtml" href="/amp/">`,
+				"https://203.0.113.10/amp/": `<link rel="icon" href="/amp.png">`,
+				"https://203.0.113.10/m/":   `<link rel="icon" href="/m.png">`,
+			},
+			want: "https://203.0.113.10/amp.png",
+		},
+		{
+			name:    "mobile after empty amp",
+			enabled: true,
+			pages: pageTransport{
+				"https://203.0.113.10/":    `<link rel="amphtml" href="https://203.0.113.10/amp"><link rel="alternate" media="handheld" href="https://198.51.100.20/">`,
+				"https://203.0.113.10/amp": `<p>no icons</p>`,
+				"https://198.51.100.20/":   `<link rel="shortcut icon" href="/m.ico">`,
+			},
+			want: "https://198.51.100.20/m.ico",
+		},
+		{
+			name:    "feeds and languages ignored",
+			enabled: true,
+			pages: pageTransport{
+				"https://203.0.113.10/":     `<link rel="alternate" type="application/rss+xml" media="all" href="/feed"><link rel="alternate" hreflang="de" media="all" href="/de/">`,
+				"https://203.0.113.10/feed": `<link rel="icon" href="/feed.png">`,
+				"https://203.0.113.10/de/":  `<link rel="icon" href="/de.png">`,
+			},
+			want: "https://203.0.113.10/favicon.ico",
+		},
+		{
+			name: "disabled",
+			pages: pageTransport{
+				"https://203.0.113.10/":    `<link rel="amphtml" href="/amp">`,
+				"https://203.0.113.10/amp": `<link rel="icon" href="/amp.png">`,
+			},
+			want: "https://203.0.113.10/favicon.ico",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discovery.AlternatePages = tt.enabled
+			fetch.HTTPClient = &http.Client{Transport: tt.pages}
+			u, _ := url.Parse("https://203.0.113.10/")
+			cands := discovery.DiscoverFromPageThenRoot(context.Background(), u, 32)
+			if len(cands) == 0 || cands[0].URL != tt.want {
+				t.Fatalf("first candidate = %+v, want %s", cands, tt.want)
+			}
+			if tt.want != "https://203.0.113.10/favicon.ico" && cands[0].Source != discovery.SourceAlternate {
+				t.Errorf("source = %q, want %q", cands[0].Source, discovery.SourceAlternate)
+			}
+		})
+	}
+}
+
+func TestRankingStrategies(t *testing.T) {
+	for _, name := range []string{"largest", "closest-size", "vector-first"} {
+		if _, ok := discovery.LookupRankingStrategy(name); !ok {
+			t.Fatalf("builtin strategy %q not registered", name)
+		}
+	}
+
+	icon16 := discovery.RankedIcon{Width: 16, Height: 16}
+	icon32 := discovery.RankedIcon{Width: 32, Height: 32}
+	icon256 := discovery.RankedIcon{Width: 256, Height: 256}
+	svg := discovery.RankedIcon{Vector: true}
+
+	// best returns the index of the highest-scoring icon
+	best := func(s discovery.RankingStrategy, size int, icons ...discovery.RankedIcon) int {
+		b := 0
+		for i, ic := range icons {
+			if s.Score(ic, size) > s.Score(icons[b], size) {
+				b = i
+			}
+		}
+		return b
+	}
+
+	largest, _ := discovery.LookupRankingStrategy("largest")
+	if got := best(largest, 16, icon16, icon256, icon32); got != 1 {
+		t.Errorf("largest picked #%d", got)
+	}
+	if got := best(largest, 16, icon256, svg); got != 1 {
+		t.Errorf("largest should prefer vectors, picked #%d", got)
+	}
+
+	closest, _ := discovery.LookupRankingStrategy("closest-size")
+	if got := best(closest, 16, icon256, svg, icon16, icon32); got != 2 {
+		t.Errorf("closest-size picked #%d", got)
+	}
+	if got := best(closest, 24, icon16, icon32); got != 1 {
+		t.Errorf("closest-size should prefer downscaling at equal distance, picked #%d", got)
+	}
+	if !closest.Sufficient(icon16, 16, 16) || closest.Sufficient(icon32, 16, 16) {
+		t.Error("closest-size should stop only on an exact match")
+	}
+
+	vector, _ := discovery.LookupRankingStrategy("vector-first")
+	cands := []discovery.IconCandidate{
+		{URL: "https://example.com/a.png", Sizes: []int{32}, RelRank: 1},
+		{URL: "https://example.com/b.svg", RelRank: 1, FormatRank: 2},
+	}
+	vector.Order(cands, 32)
+	if cands[0].URL != "https://example.com/b.svg" {
+		t.Errorf("vector-first order = %v, %v", cands[0].URL, cands[1].URL)
+	}
+	if !vector.Sufficient(svg, 32, 32) || vector.Sufficient(icon256, 32, 32) {
+		t.Error("vector-first should stop only on a vector")
+	}
+}
+
+func TestTrustDeclaredSizes(t *testing.T) {
+	largest, _ := discovery.LookupRankingStrategy("largest")
+	trusting := discovery.TrustDeclaredSizes(largest)
+	if trusting.Name() != largest.Name() {
+		t.Errorf("Name = %q, want %q", trusting.Name(), largest.Name())
+	}
+
+	cands := []discovery.IconCandidate{
+		{URL: "https://example.com/small.png", Sizes: []int{16}},
+		{URL: "https://example.com/logo.svg", FormatRank: 2},
+		{URL: "https://example.com/odd.jpg", Sizes: []int{512}, FormatRank: 1},
+		{URL: "https://example.com/large.png", Sizes: []int{16, 256}},
+	}
+	trusting.Order(cands, 64)
+	if cands[0].URL != "https://example.com/large.png" {
+		t.Errorf("first candidate = %s, want the one declaring 256 px", cands[0].URL)
+	}
+
+	// A candidate decoding smaller than it declares still stops the search
+	liar := discovery.RankedIcon{Candidate: cands[0], Width: 32, Height: 32}
+	if largest.Sufficient(liar, 64, 64) || !trusting.Sufficient(liar, 64, 64) {
+		t.Error("only the trusting strategy should stop on the declared size")
+	}
+	for _, c := range cands[1:] {
+		if trusting.Sufficient(discovery.RankedIcon{Candidate: c, Width: 16, Height: 16}, 64, 64) {
+			t.Errorf("%s declares no trusted size but was sufficient", c.URL)
+		}
+	}
+}
+
+func TestApexURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://blog.example.com/post/1", "https://example.com/"},
+		{"http://a.b.shop.example.com", "http://example.com/"},
+		{"https://app.example.co.uk/", "https://example.co.uk/"},
+		{"https://user.github.io/", ""},
+		{"https://Blog.Example.com:8443/", "https://example.com:8443/"},
+		{"https://example.com/", ""},
+		{"https://example.co.uk/", ""},
+		{"https://203.0.113.10/", ""},
+		{"https://[2001:db8::1]/", ""},
+		{"http://localhost/", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := url.Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if apex := discovery.ApexURL(u); apex != nil {
+				got = apex.String()
+			}
+			if got != tt.want {
+				t.Errorf("ApexURL(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestDiscoverFromPageThenRoot_Charset(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			// 图标 in GBK, declared in the Content-Type header
+			name:        "gbk header",
+			contentType: "text/html; charset=gbk",
+			body:        "<link rel=\"icon\" href=\"/\xcd\xbc\xb1\xea.png\">",
+			want:        "https://203.0.113.10/%E5%9B%BE%E6%A0%87.png",
+		},
+		{
+			// アイコン in Shift-JIS, declared only by <meta charset>
+			name:        "shift-jis meta",
+			contentType: "text/html",
+			body:        "<meta charset=\"shift_jis\"><link rel=\"icon\" href=\"/\x83\x41\x83\x43\x83\x52\x83\x93.png\">",
+			want:        "https://203.0.113.10/%E3%82%A2%E3%82%A4%E3%82%B3%E3%83%B3.png",
+		},
+		{
+			name:        "utf-8",
+			contentType: "text/html; charset=utf-8",
+			body:        `<link rel="icon" href="/图标.png">`,
+			want:        "https://203.0.113.10/%E5%9B%BE%E6%A0%87.png",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Path != "/" {
+					return nil, errors.New("offline")
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": {tt.contentType}},
+					Body:       io.NopCloser(strings.NewReader(tt.body)),
+					Request:    req,
+				}, nil
+			})}
+			u, _ := url.Parse("https://203.0.113.10/")
+			cands := discovery.DiscoverFromPageThenRoot(context.Background(), u, 32)
+			if len(cands) == 0 || cands[0].URL != tt.want {
+				t.Errorf("first candidate = %+v, want %s", cands, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverFromPageThenRoot_RootSchemes(t *testing.T) {
+	prevClient, prevHTTPSOnly := fetch.HTTPClient, discovery.HTTPSOnly
+	defer func() { fetch.HTTPClient, discovery.HTTPSOnly = prevClient, prevHTTPSOnly }()
+
+	tests := []struct {
+		name      string
+		page      string
+		hsts      string
+		httpsOnly bool
+		want      []string
+	}{
+		{"https without hsts", "https://203.0.113.10/", "", false,
+			[]string{"https://203.0.113.10/favicon.ico", "http://203.0.113.10/favicon.ico"}},
+		{"https with hsts", "https://203.0.113.10/", "max-age=31536000; includeSubDomains", false,
+			[]string{"https://203.0.113.10/favicon.ico"}},
+		{"hsts revoked", "https://203.0.113.10/", "max-age=0", false,
+			[]string{"https://203.0.113.10/favicon.ico", "http://203.0.113.10/favicon.ico"}},
+		{"hsts over http is ignored", "http://203.0.113.10/", "max-age=31536000", false,
+			[]string{"http://203.0.113.10/favicon.ico", "https://203.0.113.10/favicon.ico"}},
+		{"https-only mode", "http://203.0.113.10/", "", true,
+			[]string{"https://203.0.113.10/favicon.ico"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discovery.HTTPSOnly = tt.httpsOnly
+			fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				h := http.Header{"Content-Type": {"text/html"}}
+				if tt.hsts != "" {
+					h.Set("Strict-Transport-Security", tt.hsts)
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: h, Body: io.NopCloser(strings.NewReader("<html></html>")), Request: req}, nil
+			})}
+
+			u, _ := url.Parse(tt.page)
+			var got []string
+			for _, c := range discovery.DiscoverFromPageThenRoot(context.Background(), u, 32) {
+				got = append(got, c.URL)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHintsFile(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "hints.json")
+	_ = os.WriteFile(jsonPath, []byte(`{
+		"Example.com": "https://cdn.example.net/example.svg",
+		"shop.example.com": ["https://shop.example.com/a.png", "https://shop.example.com/b.png"]
+	}`), 0o644)
+	csvPath := filepath.Join(dir, "hints.csv")
+	_ = os.WriteFile(csvPath, []byte("domain,url\nexample.com,https://cdn.example.net/example.svg\n# comment\nhttps://shop.example.com/,https://shop.example.com/a.png,https://shop.example.com/b.png\n"), 0o644)
+
+	for _, p := range []string{jsonPath, csvPath} {
+		h, err := discovery.LoadHintsFile(p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if got := h.Lookup("EXAMPLE.com."); len(got) != 1 || got[0] != "https://cdn.example.net/example.svg" {
+			t.Errorf("%s: example.com = %v", p, got)
+		}
+		if got := h.Lookup("shop.example.com"); len(got) != 2 || got[1] != "https://shop.example.com/b.png" {
+			t.Errorf("%s: shop.example.com = %v", p, got)
+		}
+		if h.Len() != 2 {
+			t.Errorf("%s: %d hosts, want 2", p, h.Len())
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	_ = os.WriteFile(bad, []byte(`{"example.com": "ftp://example.com/icon.png"}`), 0o644)
+	if _, err := discovery.LoadHintsFile(bad); err == nil {
+		t.Error("non-HTTP hint URL accepted")
+	}
+}
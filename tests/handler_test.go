@@ -1,14 +1,45 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"faviconsvc/internal/auth"
 	"faviconsvc/internal/cache"
+	"faviconsvc/internal/discovery"
 	"faviconsvc/internal/fetch"
 	"faviconsvc/internal/handler"
+	"faviconsvc/internal/image"
+	"faviconsvc/internal/reqctx"
+	"faviconsvc/pkg/metrics"
+
+	ico "github.com/sergeymakinen/go-ico"
 )
 
 func TestFaviconHandler_NoURL(t *testing.T) {
@@ -151,6 +182,285 @@ func TestFaviconHandler_ETag(t *testing.T) {
 	}
 }
 
+func TestFaviconHandler_ETagHash(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(inm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/favicons", nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	sha := get("").Header().Get("ETag")
+	cfg.ETagHash, cfg.WeakETag = handler.ETagCRC32C, true
+	weak := get("").Header().Get("ETag")
+	if !strings.HasPrefix(weak, `W/"`) || weak == "W/"+sha {
+		t.Fatalf("crc32c weak ETag = %q (sha256 %q), want a different weak tag", weak, sha)
+	}
+	for _, inm := range []string{weak, strings.TrimPrefix(weak, "W/"), `"other", ` + weak, "*"} {
+		if w := get(inm); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: status %d, want 304", inm, w.Code)
+		}
+	}
+	if w := get(sha); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match with the sha256 ETag: status %d, want 200", w.Code)
+	}
+}
+func TestFaviconHandler_IfModifiedSince(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{G: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.UseETag = false
+	get := func(method string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/favicons?url=https://203.0.113.10/&sz=32&format=png", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	// Placeholders are drawn anew each time; a cached variant keeps its
+	// Last-Modified once it is written
+	get("GET")
+	lm := get("GET").Header().Get("Last-Modified")
+	lastMod, err := http.ParseTime(lm)
+	if err != nil {
+		t.Fatalf("Last-Modified %q: %v", lm, err)
+	}
+	later := lastMod.Add(time.Hour).Format(http.TimeFormat)
+	earlier := lastMod.Add(-time.Hour).Format(http.TimeFormat)
+	for _, ims := range []string{lm, later} {
+		w := get("GET", "If-Modified-Since", ims)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-Modified-Since %s: status %d with %d bytes, want an empty 304", ims, w.Code, w.Body.Len())
+		}
+	}
+	if w := get("HEAD", "If-Modified-Since", lm); w.Code != http.StatusNotModified {
+		t.Errorf("HEAD If-Modified-Since: status %d, want 304", w.Code)
+	}
+	if w := get("GET", "If-Modified-Since", earlier); w.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since before Last-Modified: status %d, want 200", w.Code)
+	}
+	if w := get("GET", "If-Modified-Since", "yesterday"); w.Code != http.StatusOK {
+		t.Errorf("malformed If-Modified-Since: status %d, want 200", w.Code)
+	}
+
+	// If-None-Match takes precedence when ETags are on
+	cfg.UseETag = true
+	if w := get("GET", "If-None-Match", `"other"`, "If-Modified-Since", later); w.Code != http.StatusOK {
+		t.Errorf("non-matching If-None-Match with If-Modified-Since: status %d, want 200", w.Code)
+	}
+	if w := get("GET", "If-Modified-Since", later); w.Code != http.StatusNotModified || w.Header().Get("ETag") == "" {
+		t.Errorf("If-Modified-Since with ETags on: status %d, ETag %q; want 304 with an ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestFaviconHandler_FallbackStatus(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query, inm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/favicons?format=png"+query, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	before := metricValue(t, "favicon_fallbacks_total")
+	w := get("", "")
+	if w.Code != http.StatusOK || w.Header().Get(handler.HeaderIconFallback) != "true" {
+		t.Fatalf("default: status %d, %s %q; want 200 and true", w.Code, handler.HeaderIconFallback, w.Header().Get(handler.HeaderIconFallback))
+	}
+	if got := metricValue(t, "favicon_fallbacks_total"); got != before+1 {
+		t.Errorf("favicon_fallbacks_total = %v, want %v", got, before+1)
+	}
+	etag := w.Header().Get("ETag")
+
+	w = get("&fallback_status=404", etag)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("fallback_status=404: status %d, want 404 despite a matching ETag", w.Code)
+	}
+	if _, err := png.Decode(w.Body); err != nil {
+		t.Errorf("fallback_status=404: body is not the placeholder PNG: %v", err)
+	}
+
+	cfg.FallbackStatus = http.StatusNotFound
+	if w := get("", ""); w.Code != http.StatusNotFound {
+		t.Errorf("-fallback-status 404: status %d, want 404", w.Code)
+	}
+	if w := get("&fallback_status=200", ""); w.Code != http.StatusOK {
+		t.Errorf("fallback_status=200 overriding 404: status %d, want 200", w.Code)
+	}
+}
+
+func TestFaviconHandler_DefaultImage(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// The page has no icon; the default image is solid red
+	red := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+	draw.Draw(red, red.Bounds(), &goimage.Uniform{color.NRGBA{R: 255, A: 255}}, goimage.Point{}, draw.Src)
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, red)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}
+		if req.URL.Host == "203.0.113.61" && req.URL.Path == "/default.png" {
+			resp.StatusCode = http.StatusOK
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(def string) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/favicons?format=png&url=https://203.0.113.60/&default="+url.QueryEscape(def), nil)
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		if w.Header().Get(handler.HeaderIconFallback) != "true" {
+			t.Errorf("default=%s: %s not set", def, handler.HeaderIconFallback)
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("default=%s: %v", def, err)
+		}
+		r, g, b, _ := img.At(16, 16).RGBA()
+		return w, r == 0xffff && g == 0 && b == 0
+	}
+
+	if _, isRed := get("https://203.0.113.61/default.png"); isRed {
+		t.Error("default image served without -default-image-allow")
+	}
+	cfg.DefaultImageAllow = []string{"203.0.113.61"}
+	if w, isRed := get("https://203.0.113.61/default.png"); w.Code != http.StatusOK || !isRed {
+		t.Errorf("allowed default image: status %d, red %v; want 200 and the default image", w.Code, isRed)
+	}
+	if _, isRed := get("https://203.0.113.62/default.png"); isRed {
+		t.Error("default image served from a host not allowed")
+	}
+	if w, _ := get("404"); w.Code != http.StatusNotFound {
+		t.Errorf("default=404: status %d, want 404", w.Code)
+	}
+}
+
+func TestFaviconHandler_ErrorImage(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// 203.0.113.70 fails with server errors, every other site has no icon
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		code := http.StatusNotFound
+		if req.URL.Host == "203.0.113.70" {
+			code = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: code, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(page string) (*httptest.ResponseRecorder, []byte) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/favicons?format=png&fallback=error-image&url="+url.QueryEscape(page), nil)
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		if w.Header().Get(handler.HeaderIconFallback) != "true" {
+			t.Errorf("%s: %s not set", page, handler.HeaderIconFallback)
+		}
+		return w, w.Body.Bytes()
+	}
+
+	cases := []struct{ page, status string }{
+		{"http://127.0.0.1/", handler.StatusBlocked},
+		{"https://203.0.113.70/", handler.StatusUnavailable},
+		{"https://203.0.113.71/", handler.StatusNotFound},
+	}
+	bodies := map[string]string{}
+	for _, c := range cases {
+		w, body := get(c.page)
+		if got := w.Header().Get(handler.HeaderStatus); got != c.status {
+			t.Errorf("%s: %s %q, want %q", c.page, handler.HeaderStatus, got, c.status)
+		}
+		img, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", c.page, err)
+		}
+		if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+			t.Errorf("%s: image is %dx%d, want 32x32", c.page, b.Dx(), b.Dy())
+		}
+		for other, page := range bodies {
+			if other == string(body) {
+				t.Errorf("%s and %s got the same error image", page, c.page)
+			}
+		}
+		bodies[string(body)] = c.page
+	}
+
+	// Placeholders are drawn once per class and variant
+	files, _ := os.ReadDir(cm.FallbackCacheDir())
+	if len(files) != len(cases) {
+		t.Errorf("fallback cache holds %d images, want %d", len(files), len(cases))
+	}
+	if _, body := get("https://203.0.113.72/"); bodies[string(body)] != "https://203.0.113.71/" {
+		t.Error("second not-found lookup got a different image")
+	}
+	if files, _ := os.ReadDir(cm.FallbackCacheDir()); len(files) != len(cases) {
+		t.Errorf("fallback cache holds %d images after a repeated class, want %d", len(files), len(cases))
+	}
+}
+
+// metricValue returns the value of an unlabelled metric from the
+// Prometheus exposition.
+func metricValue(t *testing.T, name string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Get().Handler()(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, name+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("metric %s not exported", name)
+	return 0
+}
+
 func TestFaviconHandler_CacheHeaders(t *testing.T) {
 	tmpDir := t.TempDir()
 	cm := cache.New(tmpDir, 1*time.Hour)
@@ -206,3 +516,3276 @@ func TestFaviconHandler_WebPAccept(t *testing.T) {
 		t.Errorf("Unexpected content type: %s", contentType)
 	}
 }
+
+// tiffEncoder stands in for an encoder registered by an embedder.
+type tiffEncoder struct{}
+
+func (tiffEncoder) Name() string                         { return "tiff-test" }
+func (tiffEncoder) ContentType() string                  { return "image/x-tiff-test" }
+func (tiffEncoder) Available() bool                      { return true }
+func (tiffEncoder) Encode(goimage.Image) ([]byte, error) { return []byte("II*\x00"), nil }
+
+func TestFaviconHandler_RegisteredEncoder(t *testing.T) {
+	image.RegisterEncoder(tiffEncoder{})
+	t.Cleanup(func() { image.UnregisterEncoder(tiffEncoder{}.Name()) })
+
+	tmpDir := t.TempDir()
+	cm := cache.New(tmpDir, 1*time.Hour)
+	_ = cm.EnsureDirs()
+
+	fetch.InitHTTPClient()
+
+	cfg := handler.NewConfig(
+		cm,
+		1*time.Hour,
+		1*time.Hour,
+		true,
+	)
+
+	req := httptest.NewRequest("GET", "/favicons", nil)
+	req.Header.Set("Accept", "image/x-tiff-test")
+	w := httptest.NewRecorder()
+
+	handler.FaviconHandler(cfg)(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != "image/x-tiff-test" {
+		t.Errorf("Expected registered encoder content type, got %s", ct)
+	}
+
+	// Not requested explicitly: the default stays PNG
+	req = httptest.NewRequest("GET", "/favicons", nil)
+	req.Header.Set("Accept", "image/*")
+	w = httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected image/png for image/*, got %s", ct)
+	}
+}
+
+func TestFaviconHandler_FormatParam(t *testing.T) {
+	tmpDir := t.TempDir()
+	cm := cache.New(tmpDir, 1*time.Hour)
+	_ = cm.EnsureDirs()
+
+	fetch.InitHTTPClient()
+
+	cfg := handler.NewConfig(
+		cm,
+		1*time.Hour,
+		1*time.Hour,
+		true,
+	)
+
+	req := httptest.NewRequest("GET", "/favicons?format=ico&sz=48", nil)
+	req.Header.Set("Accept", "image/webp,image/png")
+	w := httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != "image/x-icon" {
+		t.Fatalf("Expected image/x-icon for format=ico, got %s", ct)
+	}
+	img, err := ico.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Response is not a valid ICO: %v", err)
+	}
+	if got := img.Bounds().Dx(); got != 48 {
+		t.Errorf("Expected a 48px entry, got %d", got)
+	}
+
+	// Unknown formats fall back to Accept negotiation
+	req = httptest.NewRequest("GET", "/favicons?format=bogus", nil)
+	w = httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected image/png for unknown format, got %s", ct)
+	}
+}
+
+func TestFaviconHandler_AnimatedGIFPassthrough(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	pal := color.Palette{color.Transparent, color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}}
+	anim := &gif.GIF{Config: goimage.Config{ColorModel: pal, Width: 32, Height: 32}}
+	for i := 1; i <= 2; i++ {
+		frame := goimage.NewPaletted(goimage.Rect(0, 0, 32, 32), pal)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 50)
+	}
+	var animated bytes.Buffer
+	if err := gif.EncodeAll(&animated, anim); err != nil {
+		t.Fatal(err)
+	}
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/spin.gif">`))
+		case "/spin.gif":
+			resp.Header.Set("Content-Type", "image/gif")
+			resp.Body = io.NopCloser(bytes.NewReader(animated.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&"+query, nil))
+		return w
+	}
+
+	// Twice, so the second request takes the resolved-icon cache path
+	for i := 0; i < 2; i++ {
+		w := get("format=gif&sz=16")
+		if ct := w.Header().Get("Content-Type"); ct != "image/gif" {
+			t.Fatalf("Content-Type = %s, want image/gif", ct)
+		}
+		g, err := gif.DecodeAll(w.Body)
+		if err != nil {
+			t.Fatalf("response is not a GIF: %v", err)
+		}
+		if len(g.Image) != 2 || g.Config.Width != 32 {
+			t.Errorf("got %d frames at %dpx, want the original 2-frame 32px animation", len(g.Image), g.Config.Width)
+		}
+	}
+
+	// Other formats get a single resized frame
+	w := get("sz=16")
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("response is not a PNG: %v", err)
+	}
+	if img.Bounds().Dx() != 16 {
+		t.Errorf("PNG width = %d, want 16", img.Bounds().Dx())
+	}
+}
+
+func TestFaviconHandler_Theme(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A black glyph on a transparent background, invisible on dark UIs
+	glyph := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+	for y := 8; y < 24; y++ {
+		for x := 8; x < 24; x++ {
+			glyph.SetNRGBA(x, y, color.NRGBA{A: 255})
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, glyph)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/glyph.png">`))
+		case "/glyph.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	centre := func(query string) uint32 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		r, _, _, _ := img.At(16, 16).RGBA()
+		return r >> 8
+	}
+
+	// Themed and plain variants are cached apart, so the order must not matter
+	for _, tc := range []struct {
+		query string
+		want  uint32
+	}{
+		{"&theme=dark", 255},
+		{"", 0},
+		{"&theme=dark", 255},
+		{"&theme=light", 0},
+		{"&theme=bogus", 0},
+	} {
+		if got := centre(tc.query); got != tc.want {
+			t.Errorf("%q: centre red = %d, want %d", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestFaviconHandler_TrustDeclaredSizes(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// Both icons are 32 px, whatever they declare
+	icon := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	var mu sync.Mutex
+	fetched := map[string]int{}
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		fetched[req.URL.Path]++
+		mu.Unlock()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/small.png" sizes="16x16"><link rel="icon" href="/large.png" sizes="128x128">`))
+		case "/small.png", "/large.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	for _, trust := range []bool{false, true} {
+		fetched = map[string]int{}
+		cm := cache.New(t.TempDir(), time.Hour)
+		_ = cm.EnsureDirs()
+		cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+		cfg.ParallelFetches = 1
+		cfg.TrustDeclaredSizes = trust
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64&format=png", nil))
+		if w.Code != http.StatusOK || w.Header().Get(handler.HeaderIconFallback) != "" {
+			t.Fatalf("trust=%v: status %d, fallback %q", trust, w.Code, w.Header().Get(handler.HeaderIconFallback))
+		}
+		mu.Lock()
+		small, large := fetched["/small.png"], fetched["/large.png"]
+		mu.Unlock()
+		if large != 1 {
+			t.Errorf("trust=%v: /large.png fetched %d times, want 1", trust, large)
+		}
+		// Only trusting the declared 128 px stops the search at /large.png
+		if want := map[bool]int{false: 1, true: 0}[trust]; small != want {
+			t.Errorf("trust=%v: /small.png fetched %d times, want %d", trust, small, want)
+		}
+	}
+}
+
+func TestFaviconHandler_RaceCandidates(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	red, green, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{G: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	icons := map[string][]byte{"/red.png": solidPNG(t, red), "/green.png": solidPNG(t, green), "/blue.png": solidPNG(t, blue)}
+	// Per case, the icons that hang until their request is cancelled, the
+	// one held until they are in flight, and how long the others take
+	var (
+		mu        sync.Mutex
+		page      string
+		hang      map[string]bool
+		winner    string
+		delay     map[string]time.Duration
+		started   = make(chan string, 3)
+		cancelled []string
+	)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		mu.Lock()
+		body, hangs, wait, held := icons[req.URL.Path], hang[req.URL.Path], delay[req.URL.Path], req.URL.Path == winner
+		mu.Unlock()
+		switch {
+		case req.URL.Path == "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(page))
+		case body == nil:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		case hangs:
+			started <- req.URL.Path
+			<-req.Context().Done()
+			mu.Lock()
+			cancelled = append(cancelled, req.URL.Path)
+			mu.Unlock()
+			return nil, req.Context().Err()
+		default:
+			if held {
+				<-started
+				<-started
+			}
+			time.Sleep(wait)
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		return resp, nil
+	})}
+	serve := func(sz int) color.Color {
+		t.Helper()
+		cm := cache.New(t.TempDir(), time.Hour)
+		_ = cm.EnsureDirs()
+		cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+		cfg.SpeculativeRootFetch = false
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&format=png&sz="+strconv.Itoa(sz), nil))
+		img, err := png.Decode(w.Body)
+		if w.Code != http.StatusOK || err != nil || w.Header().Get(handler.HeaderIconFallback) != "" {
+			t.Fatalf("status %d, fallback %q, decode error %v", w.Code, w.Header().Get(handler.HeaderIconFallback), err)
+		}
+		return color.NRGBAModel.Convert(img.At(sz/2, sz/2))
+	}
+
+	// A sufficient icon wins while the candidates ranked above it are
+	// still in flight, and they are cancelled
+	page = `<link rel="icon" href="/red.png"><link rel="icon" href="/green.png"><link rel="icon" href="/blue.png">`
+	hang = map[string]bool{"/red.png": true, "/green.png": true}
+	winner = "/blue.png"
+	done := make(chan color.Color, 1)
+	go func() { done <- serve(32) }()
+	select {
+	case got := <-done:
+		if got != blue {
+			t.Errorf("sufficient candidate: served %v, want blue", got)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("request waited for the candidates in flight")
+	}
+	mu.Lock()
+	slices.Sort(cancelled)
+	if !slices.Equal(cancelled, []string{"/green.png", "/red.png"}) {
+		t.Errorf("cancelled fetches %v, want /green.png and /red.png", cancelled)
+	}
+	mu.Unlock()
+
+	// Without a sufficient icon every candidate is fetched, and of equal
+	// ones the first declared wins, however late it arrives
+	page = `<link rel="icon" href="/red.png" sizes="32x32"><link rel="icon" href="/green.png" sizes="32x32">`
+	hang, winner = nil, ""
+	delay = map[string]time.Duration{"/red.png": 100 * time.Millisecond}
+	if got := serve(64); got != red {
+		t.Errorf("tie: served %v, want red, declared first", got)
+	}
+}
+
+func TestFaviconHandler_SharedDecode(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A decoder that holds every decode until released
+	var decodes atomic.Int32
+	release := make(chan struct{})
+	image.RegisterDecoder(image.Decoder{
+		Name:  "slowtest",
+		Sniff: func(b []byte, _, _ string) bool { return bytes.HasPrefix(b, []byte("SLOWTEST")) },
+		Decode: func(b []byte, size int) (goimage.Image, error) {
+			decodes.Add(1)
+			<-release
+			img := goimage.NewNRGBA(goimage.Rect(0, 0, 64, 64))
+			draw.Draw(img, img.Bounds(), &goimage.Uniform{color.NRGBA{G: 255, A: 255}}, goimage.Point{}, draw.Src)
+			return img, nil
+		},
+	})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/slow.png">`))
+		case "/slow.png":
+			resp.Body = io.NopCloser(strings.NewReader("SLOWTEST"))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	// Deduplication decodes the original once more for its perceptual hash
+	cfg.DedupVariants = false
+	shared := metricValue(t, "favicon_decodes_shared_total")
+
+	formats := []string{"png", "jpeg", "ico"}
+	results := make([]*httptest.ResponseRecorder, len(formats))
+	var wg sync.WaitGroup
+	for i, f := range formats {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = httptest.NewRecorder()
+			handler.FaviconHandler(cfg)(results[i], httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format="+f, nil))
+		}()
+	}
+	// Release the decode once it runs and the other requests had time to
+	// reach it
+	deadline := time.Now().Add(5 * time.Second)
+	for decodes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := decodes.Load(); n != 1 {
+		t.Errorf("icon decoded %d times for %d formats, want once", n, len(formats))
+	}
+	if got := metricValue(t, "favicon_decodes_shared_total"); got != shared+float64(len(formats)-1) {
+		t.Errorf("favicon_decodes_shared_total = %v, want %v", got, shared+float64(len(formats)-1))
+	}
+	for i, f := range formats {
+		w := results[i]
+		if w.Code != http.StatusOK || w.Header().Get(handler.HeaderIconFallback) != "" || w.Header().Get("Content-Type") != image.ContentTypeFor(f) {
+			t.Errorf("format=%s: status %d, Content-Type %q, fallback %q", f, w.Code, w.Header().Get("Content-Type"), w.Header().Get(handler.HeaderIconFallback))
+		}
+	}
+}
+
+func TestFaviconHandler_ProblemErrors(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/favicons?"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		query, accept string
+		status        int
+		code, param   string
+	}{
+		{"errors=json", "", http.StatusBadRequest, handler.ProblemMissingURL, "url"},
+		{"url=https://203.0.113.10/&sz=abc", "application/json", http.StatusBadRequest, handler.ProblemInvalidSize, "sz"},
+		{"url=https://203.0.113.10/&size=1000", "application/problem+json", http.StatusBadRequest, handler.ProblemInvalidSize, "size"},
+		{"url=https://203.0.113.10/&sz=16,32,8&errors=json", "", http.StatusBadRequest, handler.ProblemInvalidSize, "sz"},
+		{"url=ftp://203.0.113.10/&errors=json", "", http.StatusBadRequest, handler.ProblemInvalidURL, "url"},
+		{"domain=localhost&errors=json", "", http.StatusForbidden, handler.ProblemBlockedHost, "domain"},
+		{"url=http://10.0.0.1/&errors=json", "", http.StatusForbidden, handler.ProblemBlockedHost, "url"},
+	} {
+		w := get(tc.query, tc.accept)
+		var p struct {
+			Type, Title, Code, Param, Detail string
+			Status                           int
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Errorf("%s: body %q: %v", tc.query, w.Body.String(), err)
+			continue
+		}
+		if w.Code != tc.status || w.Header().Get("Content-Type") != "application/problem+json" || p.Status != tc.status || p.Code != tc.code || p.Param != tc.param || p.Type != "about:blank" || p.Title == "" || p.Detail == "" {
+			t.Errorf("%s: status %d, Content-Type %q, problem %+v; want %d %s for %s", tc.query, w.Code, w.Header().Get("Content-Type"), p, tc.status, tc.code, tc.param)
+		}
+	}
+
+	// Without problem mode, invalid requests still get the placeholder
+	for _, tc := range []struct{ query, accept string }{
+		{"sz=1000", ""},
+		{"domain=localhost", "image/webp,*/*"},
+		{"domain=localhost&errors=image", "application/json"},
+	} {
+		if w := get(tc.query, tc.accept); !strings.HasPrefix(w.Header().Get("Content-Type"), "image/") {
+			t.Errorf("%s (Accept %q): Content-Type %q, want an image", tc.query, tc.accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestFaviconHandler_PostProcess(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	// Reports whether the pixel at (0,0) of the served icon is blue
+	blue := func() bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.11/&sz=32&format=png", nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("response is not a PNG: %v", err)
+		}
+		r, _, b, _ := img.At(0, 0).RGBA()
+		return b>>8 == 255 && r == 0
+	}
+
+	if blue() {
+		t.Fatal("icon is blue without a post-processor")
+	}
+	image.RegisterPostProcessor(image.PostProcessor{Name: "test-blue", Process: func(img goimage.Image) (goimage.Image, error) {
+		out := goimage.NewNRGBA(img.Bounds())
+		draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+		out.Set(0, 0, color.NRGBA{B: 255, A: 255})
+		return out, nil
+	}})
+	defer image.UnregisterPostProcessor("test-blue")
+	// The variant cached before is not served as the processor's output
+	if !blue() {
+		t.Error("post-processor was not applied")
+	}
+	image.UnregisterPostProcessor("test-blue")
+	if blue() {
+		t.Error("processed variant served after the post-processor was removed")
+	}
+
+	// A failing processor serves the icon untransformed, but does not
+	// cache it as its output
+	failing := true
+	image.RegisterPostProcessor(image.PostProcessor{Name: "test-flaky", Process: func(img goimage.Image) (goimage.Image, error) {
+		if failing {
+			return nil, errors.New("watermark service down")
+		}
+		out := goimage.NewNRGBA(img.Bounds())
+		draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+		out.Set(0, 0, color.NRGBA{B: 255, A: 255})
+		return out, nil
+	}})
+	defer image.UnregisterPostProcessor("test-flaky")
+	if blue() {
+		t.Error("failing post-processor changed the icon")
+	}
+	failing = false
+	if !blue() {
+		t.Error("icon served untransformed after a failure was cached")
+	}
+}
+
+func TestFaviconHandler_Mask(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	alpha := func(query string, x, y int) uint32 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		_, _, _, a := img.At(x, y).RGBA()
+		return a >> 8
+	}
+
+	// Every mask and radius is cached apart, so the order must not matter
+	for _, tc := range []struct {
+		query string
+		x, y  int
+		want  uint32
+	}{
+		{"&mask=circle", 0, 0, 0},
+		{"", 0, 0, 255},
+		{"&mask=circle", 16, 16, 255},
+		{"&mask=rounded&radius=10", 2, 2, 255},
+		{"&mask=rounded&radius=50", 2, 2, 0},
+		{"&mask=bogus", 0, 0, 255},
+	} {
+		if got := alpha(tc.query, tc.x, tc.y); got != tc.want {
+			t.Errorf("%q: alpha at (%d,%d) = %d, want %d", tc.query, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestFaviconHandler_Mono(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A red square in the middle of a transparent canvas
+	logo := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+	for y := 8; y < 24; y++ {
+		for x := 8; x < 24; x++ {
+			logo.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, logo)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/logo.png">`))
+		case "/logo.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	fetchAt := func(query string, x, y int) color.NRGBA {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+
+	// Each colour is cached apart from the full-colour icon and the others
+	for _, tc := range []struct {
+		query string
+		x, y  int
+		want  color.NRGBA
+	}{
+		{"", 16, 16, color.NRGBA{R: 255, A: 255}},
+		{"&mono=1", 16, 16, color.NRGBA{A: 255}},
+		{"&mono=1", 2, 2, color.NRGBA{}},
+		{"&mono=1&color=%23fff", 16, 16, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{"&mono=1&color=336699&theme=dark", 16, 16, color.NRGBA{R: 0x33, G: 0x66, B: 0x99, A: 255}},
+		{"&mono=0", 16, 16, color.NRGBA{R: 255, A: 255}},
+	} {
+		got := fetchAt(tc.query, tc.x, tc.y)
+		if tc.want.A == 0 {
+			if got.A != 0 {
+				t.Errorf("%q: alpha at (%d,%d) = %d, want 0", tc.query, tc.x, tc.y, got.A)
+			}
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: pixel at (%d,%d) = %v, want %v", tc.query, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestFaviconHandler_MaxVariantsPerDomain(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.MaxVariantsPerDomain = 2
+	cached := func() int {
+		// Variants are sharded; the shared copies are hard links and not counted
+		paths, _ := filepath.Glob(filepath.Join(cm.ResizedCacheDir(), "??", "*"))
+		return len(paths)
+	}
+	get := func(query string) (width int, snapped string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		return img.Bounds().Dx(), w.Header().Get(handler.HeaderSize)
+	}
+
+	for _, tc := range []struct {
+		query   string
+		width   int
+		snapped string
+		cached  int
+	}{
+		{"&sz=16", 16, "", 1},
+		{"&sz=64", 64, "", 2},
+		{"&sz=16", 16, "", 2},
+		// Past the limit, new sizes get the nearest cached one
+		{"&sz=20", 16, "16", 2},
+		{"&sz=48", 64, "64", 2},
+		{"&sz=40", 16, "16", 2},
+		// A format key without variants is rendered but not cached
+		{"&sz=24&mask=circle", 24, "", 2},
+		// Multi-size requests are snapped too
+		{"&sz=17,63", 0, "", 2},
+	} {
+		if tc.width == 0 {
+			w := httptest.NewRecorder()
+			handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&format=png"+tc.query, nil))
+			var body struct{ Icons []struct{ Size int } }
+			_ = json.Unmarshal(w.Body.Bytes(), &body)
+			if len(body.Icons) != 2 || body.Icons[0].Size != 16 || body.Icons[1].Size != 64 {
+				t.Errorf("%s: icons %+v, want 16 and 64", tc.query, body.Icons)
+			}
+		} else if width, snapped := get(tc.query); width != tc.width || snapped != tc.snapped {
+			t.Errorf("%s: width %d, %s %q; want %d, %q", tc.query, width, handler.HeaderSize, snapped, tc.width, tc.snapped)
+		}
+		if n := cached(); n != tc.cached {
+			t.Errorf("%s: %d variants cached, want %d", tc.query, n, tc.cached)
+		}
+	}
+}
+
+func TestFaviconHandler_MaxVariantDomains(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), 300*time.Millisecond)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.DedupVariants = false
+	cfg.MaxVariantDomains = 2
+	cachedFor := func(host string) bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?sz=32&format=png&url=https://"+host+"/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", host, w.Code)
+		}
+		_, err := os.Stat(cm.ResizedCachePath("https://"+host+"/red.png", 32, "png"))
+		return err == nil
+	}
+
+	if !cachedFor("203.0.113.10") || !cachedFor("203.0.113.11") {
+		t.Fatal("variants of the first two domains not cached")
+	}
+	// Past the cap, new domains are served but not tracked or cached
+	if cachedFor("203.0.113.12") {
+		t.Error("variant of a domain past MaxVariantDomains cached")
+	}
+	// Domains whose variants all expired are forgotten, making room
+	time.Sleep(1100 * time.Millisecond)
+	if !cachedFor("203.0.113.12") {
+		t.Error("variant not cached after the tracked domains expired")
+	}
+}
+
+func TestFaviconHandler_NegativeCache(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// Host .30 has no icons, host .31 fails with server errors
+	var requests atomic.Int64
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		resp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader(""))}
+		if req.URL.Hostname() == "203.0.113.31" {
+			resp.StatusCode = http.StatusServiceUnavailable
+		} else if req.URL.Path == "" || req.URL.Path == "/" {
+			resp.StatusCode = http.StatusOK
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/gone.png">`))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(host string) (status string, upstream int64) {
+		t.Helper()
+		before := requests.Load()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://"+host+"/&sz=32", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want the placeholder", host, w.Code)
+		}
+		return w.Header().Get(handler.HeaderStatus), requests.Load() - before
+	}
+
+	status, n := get("203.0.113.30")
+	if status != handler.StatusNotFound || n == 0 {
+		t.Fatalf("first lookup: status %q after %d requests, want %q after some", status, n, handler.StatusNotFound)
+	}
+	if status, n := get("203.0.113.30"); status != handler.StatusNotFound || n != 0 {
+		t.Errorf("repeated lookup: status %q after %d requests, want %q from cache", status, n, handler.StatusNotFound)
+	}
+	entries, _ := cm.Inspect("203.0.113.30")
+	negative := 0
+	for _, p := range entries.Pages {
+		if p.Negative == handler.StatusNotFound {
+			negative++
+		}
+	}
+	if negative != 1 {
+		t.Errorf("inspect: pages %+v, want one not-found entry", entries.Pages)
+	}
+
+	if status, n := get("203.0.113.31"); status != handler.StatusUnavailable || n == 0 {
+		t.Fatalf("failing site: status %q after %d requests, want %q after some", status, n, handler.StatusUnavailable)
+	}
+	if status, n := get("203.0.113.31"); status != handler.StatusUnavailable || n != 0 {
+		t.Errorf("repeated failing lookup: status %q after %d requests, want %q from cache", status, n, handler.StatusUnavailable)
+	}
+
+	// A zero TTL disables the cache
+	cfg.UnavailableTTL = 0
+	if status, n := get("203.0.113.32"); status != handler.StatusNotFound || n == 0 {
+		t.Fatalf("uncached site: status %q after %d requests", status, n)
+	}
+	cfg.NotFoundTTL = 0
+	get("203.0.113.33")
+	if _, n := get("203.0.113.33"); n == 0 {
+		t.Error("with -not-found-ttl 0 the lookup was not repeated")
+	}
+}
+
+func TestFaviconHandler_Redirect(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	var pages, icons atomic.Int64
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			pages.Add(1)
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/blue.png">`))
+		case "/blue.png":
+			icons.Add(1)
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?response_type=redirect&"+query, nil))
+		return w
+	}
+
+	w := get("url=https://203.0.113.40/")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://203.0.113.40/blue.png" {
+		t.Fatalf("status %d, Location %q; want a 302 to the icon", w.Code, w.Header().Get("Location"))
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "max-age=3600") || strings.Contains(cc, "immutable") {
+		t.Errorf("Cache-Control = %q, want a max-age without immutable", cc)
+	}
+	wantPages, wantIcons := pages.Load(), icons.Load()
+
+	// The discovery result is cached and the icon is not fetched again
+	w = get("url=https://203.0.113.40/&sz=64")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://203.0.113.40/blue.png" {
+		t.Fatalf("repeated: status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if w.Header().Get(handler.HeaderCache) != handler.CacheHit {
+		t.Errorf("repeated: X-Cache = %q, want %q", w.Header().Get(handler.HeaderCache), handler.CacheHit)
+	}
+	if pages.Load() != wantPages || icons.Load() != wantIcons {
+		t.Errorf("repeated redirect contacted the site: %d page and %d icon fetches, want %d and %d", pages.Load(), icons.Load(), wantPages, wantIcons)
+	}
+
+	// Image responses share the resolved mapping
+	w = httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.40/&format=png", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("image request: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if pages.Load() != wantPages {
+		t.Errorf("image request rediscovered the page")
+	}
+
+	// A page with no icon gets the placeholder
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+	w = get("url=https://203.0.113.41/")
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "" || w.Header().Get(handler.HeaderStatus) != handler.StatusNotFound {
+		t.Errorf("no icon: status %d, Location %q, %s %q; want the placeholder", w.Code, w.Header().Get("Location"), handler.HeaderStatus, w.Header().Get(handler.HeaderStatus))
+	}
+}
+
+func TestFaviconHandler_Pad(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A small red logo in the middle of a transparent canvas
+	logo := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+	for y := 8; y < 24; y++ {
+		for x := 8; x < 24; x++ {
+			logo.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, logo)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/logo.png">`))
+		case "/logo.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	alpha := func(query string, x, y int) uint32 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		_, _, _, a := img.At(x, y).RGBA()
+		return a >> 8
+	}
+
+	// Trimmed and padded variants are cached apart, so the order must not matter
+	for _, tc := range []struct {
+		query string
+		x, y  int
+		want  uint32
+	}{
+		{"&trim=1", 2, 2, 255},
+		{"", 2, 2, 0},
+		{"&pad=0", 2, 2, 255},
+		{"&pad=25%25", 6, 6, 0},
+		{"&pad=25%25", 10, 10, 255},
+		{"&pad=90%25", 2, 2, 0},
+	} {
+		if got := alpha(tc.query, tc.x, tc.y); got != tc.want {
+			t.Errorf("%q: alpha at (%d,%d) = %d, want %d", tc.query, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestFaviconHandler_Filter(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// 16px pixel art: a black and white checkerboard
+	art := goimage.NewNRGBA(goimage.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if (x+y)%2 == 0 {
+				art.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			} else {
+				art.SetNRGBA(x, y, color.NRGBA{A: 255})
+			}
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, art)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/art.png">`))
+		case "/art.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	// pure reports whether every pixel of the response is black or white
+	pure := func(query string) bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r != 0 && r != 0xffff {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	// Automatic selection upscales pixel art with nearest neighbour; the
+	// override is cached as its own variant
+	if !pure("") {
+		t.Error("auto filter smoothed a pixel-art upscale")
+	}
+	if pure("&filter=catmullrom") {
+		t.Error("filter=catmullrom served the nearest-neighbour variant")
+	}
+	if !pure("&filter=bogus") {
+		t.Error("unknown filter was not ignored")
+	}
+}
+
+func TestFaviconHandler_LetterFallback(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	// corner returns the alpha of the response's top-left pixel: the globe
+	// is drawn on transparency, a letter tile is opaque
+	corner := func(query string) uint32 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		_, _, _, a := img.At(0, 0).RGBA()
+		return a
+	}
+
+	if a := corner(""); a != 0 {
+		t.Errorf("Default fallback corner alpha = %d, want the transparent globe", a)
+	}
+	if a := corner("&fallback=letter"); a != 0xffff {
+		t.Errorf("fallback=letter corner alpha = %d, want an opaque tile", a)
+	}
+	cfg.FallbackStyle = "letter"
+	if a := corner("&fallback=globe"); a != 0 {
+		t.Errorf("fallback=globe did not override the configured letter style")
+	}
+}
+
+func TestFaviconHandler_Fit(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A 4:1 banner logo with a 1px transparent frame
+	banner := goimage.NewNRGBA(goimage.Rect(0, 0, 128, 32))
+	for y := 1; y < 31; y++ {
+		for x := 1; x < 127; x++ {
+			banner.SetNRGBA(x, y, color.NRGBA{R: 200, A: 255})
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, banner)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/logo.png">`))
+		case "/logo.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	// topAlpha returns the alpha of a pixel near the top of the response,
+	// inside a stretched or cropped banner but above a letterboxed one
+	topAlpha := func(query string) uint32 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64&format=png"+query, nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		_, _, _, a := img.At(32, 8).RGBA()
+		return a
+	}
+
+	// Stretching is the default; each fit is cached as its own variant
+	if a := topAlpha(""); a != 0xffff {
+		t.Errorf("default fit top alpha = %d, want the stretched banner", a)
+	}
+	if a := topAlpha("&fit=contain"); a != 0 {
+		t.Errorf("fit=contain top alpha = %d, want a letterbox", a)
+	}
+	if a := topAlpha("&fit=cover"); a != 0xffff {
+		t.Errorf("fit=cover top alpha = %d, want a crop", a)
+	}
+	cfg.Fit = "contain"
+	if a := topAlpha("&fit=bogus"); a != 0 {
+		t.Errorf("unknown fit did not fall back to the configured contain")
+	}
+	// Trimming keeps the aspect ratio on its own, with one variant for any fit
+	if a := topAlpha("&pad=0&fit=stretch"); a != 0 {
+		t.Errorf("pad=0 top alpha = %d, want the trimmed banner letterboxed", a)
+	}
+}
+
+func TestFaviconHandler_NonSquare(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) (goimage.Image, *httptest.ResponseRecorder) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?format=png&"+query, nil))
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		return img, w
+	}
+	alpha := func(img goimage.Image, x, y int) uint32 {
+		_, _, _, a := img.At(x, y).RGBA()
+		return a
+	}
+
+	// The square icon is pillarboxed by default, keeping its shape
+	img, _ := get("url=https://203.0.113.10/&sz=64x40")
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 40 {
+		t.Fatalf("sz=64x40 bounds = %v", b)
+	}
+	if alpha(img, 5, 20) != 0 || alpha(img, 32, 20) != 0xffff {
+		t.Error("sz=64x40 did not letterbox the square icon")
+	}
+	if _, w := get("url=https://203.0.113.10/&sz=64x40"); w.Header().Get(handler.HeaderCache) != handler.CacheHit {
+		t.Errorf("second sz=64x40: %s = %q, want a cached variant", handler.HeaderCache, w.Header().Get(handler.HeaderCache))
+	}
+	// An explicit stretch fills the target, and is cached apart
+	img, _ = get("url=https://203.0.113.10/&sz=64x40&fit=stretch")
+	if alpha(img, 5, 20) != 0xffff {
+		t.Error("fit=stretch left the sides transparent")
+	}
+	// The square and the non-square variant of one width are distinct
+	if img, _ := get("url=https://203.0.113.10/&sz=64"); img.Bounds().Dy() != 64 {
+		t.Errorf("sz=64 after sz=64x40: bounds %v", img.Bounds())
+	}
+	// WxH with equal edges is the square size, and placeholders take the shape too
+	if img, _ := get("url=https://203.0.113.10/&sz=48X48"); img.Bounds().Dx() != 48 || img.Bounds().Dy() != 48 {
+		t.Errorf("sz=48X48 bounds = %v", img.Bounds())
+	}
+	if img, _ := get("sz=32x20"); img.Bounds().Dx() != 32 || img.Bounds().Dy() != 20 {
+		t.Errorf("placeholder at sz=32x20 bounds = %v", img.Bounds())
+	}
+}
+
+func TestFaviconHandler_DPR(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string, hdr http.Header) (goimage.Image, *httptest.ResponseRecorder) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/favicons?format=png&url=https://203.0.113.10/&"+query, nil)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", query, err)
+		}
+		return img, w
+	}
+
+	img, w := get("sz=32&dpr=2", nil)
+	if img.Bounds().Dx() != 64 || w.Header().Get(handler.HeaderContentDPR) != "2" {
+		t.Errorf("sz=32&dpr=2: bounds %v, %s %q; want 64px and 2", img.Bounds(), handler.HeaderContentDPR, w.Header().Get(handler.HeaderContentDPR))
+	}
+	// The same pixels are the same variant
+	if _, w := get("sz=64", nil); w.Header().Get(handler.HeaderCache) != handler.CacheHit || w.Header().Get(handler.HeaderContentDPR) != "" {
+		t.Errorf("sz=64 after sz=32&dpr=2: %s %q, %s %q; want a cached variant without a ratio",
+			handler.HeaderCache, w.Header().Get(handler.HeaderCache), handler.HeaderContentDPR, w.Header().Get(handler.HeaderContentDPR))
+	}
+	// Ratios are clamped, and capped so the image stays within MaxSize
+	if img, w := get("sz=16&dpr=9", nil); img.Bounds().Dx() != 16*handler.MaxDPR || w.Header().Get(handler.HeaderContentDPR) != "4" {
+		t.Errorf("dpr=9: bounds %v, %s %q", img.Bounds(), handler.HeaderContentDPR, w.Header().Get(handler.HeaderContentDPR))
+	}
+	if img, w := get("sz=200&dpr=2x", nil); img.Bounds().Dx() != handler.MaxSize || w.Header().Get(handler.HeaderContentDPR) != "1.28" {
+		t.Errorf("sz=200&dpr=2x: bounds %v, %s %q; want 256px and 1.28", img.Bounds(), handler.HeaderContentDPR, w.Header().Get(handler.HeaderContentDPR))
+	}
+	if img, _ := get("sz=64x40&dpr=1.5", nil); img.Bounds().Dx() != 96 || img.Bounds().Dy() != 60 {
+		t.Errorf("sz=64x40&dpr=1.5: bounds %v, want 96x60", img.Bounds())
+	}
+	if img, w := get("sz=32&dpr=bogus", nil); img.Bounds().Dx() != 32 || w.Header().Get(handler.HeaderContentDPR) != "" {
+		t.Errorf("dpr=bogus: bounds %v, want 32px without a ratio", img.Bounds())
+	}
+
+	// The client hint is only honoured, and varied on, when enabled
+	hint := http.Header{"Sec-Ch-Dpr": {"2"}}
+	if img, w := get("sz=32", hint); img.Bounds().Dx() != 32 || strings.Contains(w.Header().Get("Vary"), "Sec-CH-DPR") {
+		t.Errorf("hint while disabled: bounds %v, Vary %q", img.Bounds(), w.Header().Get("Vary"))
+	}
+	cfg.DPRClientHints = true
+	img, w = get("sz=32", hint)
+	if img.Bounds().Dx() != 64 || w.Header().Get("Accept-CH") != "Sec-CH-DPR" || !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Sec-CH-DPR") {
+		t.Errorf("hint: bounds %v, Accept-CH %q, Vary %q", img.Bounds(), w.Header().Get("Accept-CH"), w.Header().Values("Vary"))
+	}
+	if img, _ := get("sz=32&dpr=1", hint); img.Bounds().Dx() != 32 {
+		t.Errorf("dpr=1 with a hint: bounds %v, want the parameter to win", img.Bounds())
+	}
+}
+
+func TestFaviconHandler_Wait(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// The page answers once release is closed
+	icon := solidPNG(t, color.NRGBA{G: 255, A: 255})
+	release := make(chan struct{})
+	var pageFetches atomic.Int32
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			pageFetches.Add(1)
+			<-release
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(wait string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?format=png&url=https://203.0.113.80/&wait="+wait, nil))
+		return w
+	}
+
+	// Out of time: the placeholder, not to be cached, while the lookup runs on
+	w := get("20ms")
+	if w.Header().Get(handler.HeaderWait) != handler.WaitPending || w.Header().Get(handler.HeaderIconFallback) != "true" {
+		t.Fatalf("short wait: %s %q, fallback %q; want a pending placeholder", handler.HeaderWait, w.Header().Get(handler.HeaderWait), w.Header().Get(handler.HeaderIconFallback))
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("pending placeholder Cache-Control = %q, want no-store", cc)
+	}
+	// A second request joins the running lookup
+	if w := get("20ms"); w.Header().Get(handler.HeaderWait) != handler.WaitPending {
+		t.Errorf("second short wait: %s %q", handler.HeaderWait, w.Header().Get(handler.HeaderWait))
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	w = get("30s")
+	if w.Header().Get(handler.HeaderWait) != handler.WaitReady || w.Header().Get(handler.HeaderIconFallback) != "" {
+		t.Fatalf("long wait: %s %q, fallback %q; want the icon", handler.HeaderWait, w.Header().Get(handler.HeaderWait), w.Header().Get(handler.HeaderIconFallback))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, g, _, _ := img.At(16, 16).RGBA(); g != 0xffff {
+		t.Error("long wait did not serve the icon")
+	}
+	if n := pageFetches.Load(); n != 1 {
+		t.Errorf("page fetched %d times, want once", n)
+	}
+	// Without wait the cached icon is served as usual
+	if w := get(""); w.Header().Get(handler.HeaderWait) != "" || w.Header().Get(handler.HeaderCache) != handler.CacheHit {
+		t.Errorf("after the lookup: %s %q, %s %q", handler.HeaderWait, w.Header().Get(handler.HeaderWait), handler.HeaderCache, w.Header().Get(handler.HeaderCache))
+	}
+}
+
+func TestFaviconHandler_HeadAndRange(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, G: 255, A: 255})
+	var iconFetches atomic.Int32
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			iconFetches.Add(1)
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	do := func(method, target string, hdr ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+	const target = "/favicons?format=png&url=https://203.0.113.90/"
+
+	full := do("GET", target)
+	body := full.Body.Bytes()
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("GET: status %d, Accept-Ranges %q", full.Code, full.Header().Get("Accept-Ranges"))
+	}
+
+	// HEAD of a cached variant: the GET headers from the cache, no body
+	head := do("HEAD", target)
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d, %d body bytes; want 200 and none", head.Code, head.Body.Len())
+	}
+	if head.Header().Get("Content-Length") != strconv.Itoa(len(body)) || head.Header().Get("ETag") != full.Header().Get("ETag") {
+		t.Errorf("HEAD headers %v differ from GET %v", head.Header(), full.Header())
+	}
+	if head.Header().Get(handler.HeaderCache) != handler.CacheHit || iconFetches.Load() != 1 {
+		t.Errorf("HEAD: %s %q after %d icon fetches, want a cache hit", handler.HeaderCache, head.Header().Get(handler.HeaderCache), iconFetches.Load())
+	}
+
+	etag := full.Header().Get("ETag")
+	n := len(body)
+	cases := []struct {
+		name, rng, ifRange string
+		status             int
+		part               []byte
+		contentRange       string
+	}{
+		{"first bytes", "bytes=0-7", "", http.StatusPartialContent, body[:8], "bytes 0-7/" + strconv.Itoa(n)},
+		{"open end", "bytes=10-", "", http.StatusPartialContent, body[10:], "bytes 10-" + strconv.Itoa(n-1) + "/" + strconv.Itoa(n)},
+		{"suffix", "bytes=-4", "", http.StatusPartialContent, body[n-4:], "bytes " + strconv.Itoa(n-4) + "-" + strconv.Itoa(n-1) + "/" + strconv.Itoa(n)},
+		{"past the end", "bytes=" + strconv.Itoa(n) + "-", "", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */" + strconv.Itoa(n)},
+		{"matching If-Range", "bytes=0-7", etag, http.StatusPartialContent, body[:8], "bytes 0-7/" + strconv.Itoa(n)},
+		{"stale If-Range", "bytes=0-7", `"other"`, http.StatusOK, body, ""},
+		{"several ranges", "bytes=0-1,4-5", "", http.StatusOK, body, ""},
+		{"malformed", "bytes=x-y", "", http.StatusOK, body, ""},
+	}
+	for _, c := range cases {
+		hdr := []string{"Range", c.rng}
+		if c.ifRange != "" {
+			hdr = append(hdr, "If-Range", c.ifRange)
+		}
+		w := do("GET", target, hdr...)
+		if w.Code != c.status || !bytes.Equal(w.Body.Bytes(), c.part) || w.Header().Get("Content-Range") != c.contentRange {
+			t.Errorf("%s: status %d, %d bytes, Content-Range %q; want %d, %d bytes, %q",
+				c.name, w.Code, w.Body.Len(), w.Header().Get("Content-Range"), c.status, len(c.part), c.contentRange)
+		}
+	}
+
+	// Placeholders sent as 404 are not ranged
+	cfg.FallbackStatus = http.StatusNotFound
+	if w := do("GET", "/favicons?format=png", "Range", "bytes=0-7"); w.Code != http.StatusNotFound || w.Header().Get("Content-Range") != "" {
+		t.Errorf("ranged 404 placeholder: status %d, Content-Range %q", w.Code, w.Header().Get("Content-Range"))
+	}
+}
+
+func TestFaviconHandler_UpstreamHeaders(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	const originLM = "Tue, 02 Jan 2018 15:04:05 GMT"
+	icon := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Header.Set("Last-Modified", originLM)
+			resp.Header.Set("ETag", `"origin-v1"`)
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	newCfg := func(policy string) *handler.Config {
+		t.Helper()
+		cm := cache.New(t.TempDir(), time.Hour)
+		_ = cm.EnsureDirs()
+		cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+		names, err := handler.ParseUpstreamHeaders(policy)
+		if err != nil {
+			t.Fatalf("ParseUpstreamHeaders(%q): %v", policy, err)
+		}
+		cfg.UpstreamHeaders = names
+		return cfg
+	}
+	get := func(cfg *handler.Config, h http.HandlerFunc, target string, hdr ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	const target = "/favicons?format=png&url=https://203.0.113.91/"
+
+	t.Run("default", func(t *testing.T) {
+		cfg := newCfg("")
+		w := get(cfg, handler.FaviconHandler(cfg), target)
+		if lm := w.Header().Get("Last-Modified"); lm == "" || lm == originLM {
+			t.Errorf("Last-Modified %q, want the service's", lm)
+		}
+		if v := w.Header().Get(handler.HeaderUpstreamETag); v != "" {
+			t.Errorf("%s %q without the policy", handler.HeaderUpstreamETag, v)
+		}
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		cfg := newCfg("Last-Modified, etag")
+		fh := handler.FaviconHandler(cfg)
+		miss := get(cfg, fh, target)
+		hit := get(cfg, fh, target)
+		for name, w := range map[string]*httptest.ResponseRecorder{"miss": miss, "hit": hit} {
+			if lm := w.Header().Get("Last-Modified"); lm != originLM {
+				t.Errorf("%s: Last-Modified %q, want %q", name, lm, originLM)
+			}
+			if v := w.Header().Get(handler.HeaderUpstreamETag); v != `"origin-v1"` {
+				t.Errorf("%s: %s %q", name, handler.HeaderUpstreamETag, v)
+			}
+			if etag := w.Header().Get("ETag"); etag == "" || etag == `"origin-v1"` {
+				t.Errorf("%s: ETag %q, want the service's", name, etag)
+			}
+		}
+		if hit.Header().Get(handler.HeaderCache) != handler.CacheHit {
+			t.Fatalf("second request: %s %q", handler.HeaderCache, hit.Header().Get(handler.HeaderCache))
+		}
+
+		// If-Range is checked against the Last-Modified sent
+		rng := get(cfg, fh, target, "Range", "bytes=0-3", "If-Range", originLM)
+		if rng.Code != http.StatusPartialContent {
+			t.Errorf("If-Range with the origin's date: status %d, want 206", rng.Code)
+		}
+
+		info := get(cfg, handler.IconInfoHandler(cfg), "/api/icon?url=https://203.0.113.91/")
+		var resp struct {
+			Cache struct {
+				OriginLastModified time.Time `json:"origin_last_modified"`
+				OriginETag         string    `json:"origin_etag"`
+			} `json:"cache"`
+		}
+		if err := json.Unmarshal(info.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("/api/icon: %v: %s", err, info.Body.String())
+		}
+		want, _ := http.ParseTime(originLM)
+		if !resp.Cache.OriginLastModified.Equal(want) || resp.Cache.OriginETag != `"origin-v1"` {
+			t.Errorf("/api/icon cache %+v, want %s and the origin's ETag", resp.Cache, originLM)
+		}
+	})
+
+	if _, err := handler.ParseUpstreamHeaders("last-modified,cookie"); err == nil {
+		t.Error("ParseUpstreamHeaders accepted cookie")
+	}
+}
+
+func TestFaviconHandler_JPEGQuality(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A detailed icon, so quality visibly changes the encoded size
+	src := goimage.NewNRGBA(goimage.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: uint8((x ^ y) * 4), A: 255})
+		}
+	}
+	var icon bytes.Buffer
+	_ = png.Encode(&icon, src)
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon.Bytes()))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	low := get("&format=jpg&q=10", "")
+	if ct := low.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatalf("format=jpg content type = %q, want image/jpeg", ct)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(low.Body.Bytes())); err != nil {
+		t.Fatalf("response is not a JPEG: %v", err)
+	}
+	// Each quality is cached as its own variant
+	if high := get("&format=jpeg&q=95", ""); high.Body.Len() <= low.Body.Len() {
+		t.Errorf("q=95 gave %d bytes, q=10 %d; want larger", high.Body.Len(), low.Body.Len())
+	}
+	if again := get("&format=jpeg&q=10", ""); !bytes.Equal(again.Body.Bytes(), low.Body.Bytes()) {
+		t.Error("cached q=10 variant differs from the first response")
+	}
+	// JPEG drops transparency, so Accept alone never selects it
+	if ct := get("", "image/jpeg").Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Accept: image/jpeg content type = %q, want image/png", ct)
+	}
+}
+
+func TestDebugRecordReplay(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{G: 180, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/logo.png">`))
+		case "/logo.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	w := httptest.NewRecorder()
+	handler.DebugRecordHandler(cfg)(w, httptest.NewRequest("GET", "/debug/record?url=https://203.0.113.10/&sz=32&format=png", nil))
+	var bundle fetch.Bundle
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("record: status %d, %v: %s", w.Code, err, w.Body.String())
+	}
+	var urls []string
+	for _, e := range bundle.Exchanges {
+		urls = append(urls, e.URL)
+	}
+	if !slices.Contains(urls, "https://203.0.113.10/") || !slices.Contains(urls, "https://203.0.113.10/logo.png") {
+		t.Errorf("recorded exchanges %v, want the page and its icon", urls)
+	}
+	if bundle.Response == nil || bundle.Response.Status != http.StatusOK || bundle.Response.ContentType != "image/png" {
+		t.Errorf("recorded response %+v", bundle.Response)
+	}
+	if _, ok := cm.ReadResolvedIcon("https://203.0.113.10/"); ok {
+		t.Error("recording wrote to the live cache")
+	}
+
+	// The site is gone; the replay must come from the bundle alone
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("replay reached the network: %s", req.URL)
+		return nil, errors.New("offline")
+	})}
+	replay := func(b fetch.Bundle) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(b)
+		w := httptest.NewRecorder()
+		handler.DebugReplayHandler(cfg)(w, httptest.NewRequest("POST", "/debug/replay", bytes.NewReader(body)))
+		return w
+	}
+	w = replay(bundle)
+	if w.Code != http.StatusOK || w.Header().Get(handler.HeaderReplayMatch) != "true" || w.Header().Get(handler.HeaderReplayMissing) != "0" {
+		t.Errorf("replay: status %d, match %q, missing %q", w.Code, w.Header().Get(handler.HeaderReplayMatch), w.Header().Get(handler.HeaderReplayMissing))
+	}
+	if _, err := png.Decode(w.Body); err != nil {
+		t.Errorf("replay is not a PNG: %v", err)
+	}
+
+	// Without the icon's exchange the replay diverges and says so
+	pruned := bundle
+	pruned.Exchanges = nil
+	for _, e := range bundle.Exchanges {
+		if !strings.HasSuffix(e.URL, "/logo.png") {
+			pruned.Exchanges = append(pruned.Exchanges, e)
+		}
+	}
+	w = replay(pruned)
+	if w.Header().Get(handler.HeaderReplayMatch) != "false" || w.Header().Get(handler.HeaderReplayMissing) == "0" {
+		t.Errorf("pruned replay: match %q, missing %q", w.Header().Get(handler.HeaderReplayMatch), w.Header().Get(handler.HeaderReplayMissing))
+	}
+
+	bundle.Version = 99
+	if w := replay(bundle); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown version: status %d, want 400", w.Code)
+	}
+}
+
+func TestFaviconHandler_MultiSize(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{B: 200, A: 255})
+	var iconFetches int
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			iconFetches++
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	want := []int{16, 32, 64}
+
+	var etag string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=16,32,64,32", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Content-Type = %s", ct)
+		}
+		var resp struct {
+			IconURL string `json:"icon_url"`
+			Icons   []struct {
+				Size        int    `json:"size"`
+				ContentType string `json:"content_type"`
+				DataURI     string `json:"data_uri"`
+			} `json:"icons"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if resp.IconURL != "https://203.0.113.10/icon.png" {
+			t.Errorf("icon_url = %q", resp.IconURL)
+		}
+		if len(resp.Icons) != len(want) {
+			t.Fatalf("got %d icons, want %d", len(resp.Icons), len(want))
+		}
+		for j, ic := range resp.Icons {
+			b64, ok := strings.CutPrefix(ic.DataURI, "data:image/png;base64,")
+			if !ok || ic.ContentType != "image/png" {
+				t.Fatalf("icon %d: content type %s, data URI %.40s", j, ic.ContentType, ic.DataURI)
+			}
+			raw, _ := base64.StdEncoding.DecodeString(b64)
+			img, err := png.Decode(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("icon %d: %v", j, err)
+			}
+			if ic.Size != want[j] || img.Bounds().Dx() != want[j] {
+				t.Errorf("icon %d: size %d, image %dpx, want %d", j, ic.Size, img.Bounds().Dx(), want[j])
+			}
+		}
+		if i == 1 && w.Header().Get("ETag") != etag {
+			t.Errorf("ETag changed between identical responses")
+		}
+		etag = w.Header().Get("ETag")
+	}
+	if iconFetches != 1 {
+		t.Errorf("icon fetched %d times, want once (second response from cache)", iconFetches)
+	}
+
+	// Each size is cached like a single-size response
+	w := httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64", nil))
+	if img, err := png.Decode(w.Body); err != nil || img.Bounds().Dx() != 64 {
+		t.Errorf("single size after multi-size: err %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=16,32", nil)
+	r.Header.Set("Accept", "multipart/mixed, image/png")
+	w = httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, r)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %s", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var sizes []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		if _, err := png.Decode(part); err != nil {
+			t.Errorf("part %s: %v", part.Header.Get(handler.HeaderSize), err)
+		}
+		sizes = append(sizes, part.Header.Get(handler.HeaderSize))
+	}
+	if fmt.Sprint(sizes) != "[16 32]" {
+		t.Errorf("part sizes = %v", sizes)
+	}
+}
+
+func TestFaviconHandler_CacheInfoHeaders(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 30, G: 120, B: 90, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	w := httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=48", nil))
+	if h := w.Header().Get(handler.HeaderContentHash) + w.Header().Get(handler.HeaderCacheKey); h != "" {
+		t.Errorf("cache info exposed without ExposeCacheInfo: %q", h)
+	}
+
+	cfg.ExposeCacheInfo = true
+	for _, tier := range []string{"orig", "resized"} {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=64", nil))
+		if got, want := w.Header().Get(handler.HeaderContentHash), cache.ContentCID(icon); got != want {
+			t.Errorf("%s: %s = %q, want %q", tier, handler.HeaderContentHash, got, want)
+		}
+		entries, err := cm.Purge(cache.PurgeOptions{HostPattern: "203.0.113.10", DryRun: true, Sizes: []int{64}, Formats: []string{"png"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, e := range entries {
+			if e.Tier == cache.TierResized {
+				paths = append(paths, e.Path)
+			}
+		}
+		if key := w.Header().Get(handler.HeaderCacheKey); len(paths) != 1 || key != paths[0] {
+			t.Errorf("%s: %s = %q, purge lists %v", tier, handler.HeaderCacheKey, key, paths)
+		}
+	}
+}
+
+func TestFaviconHandler_Blurhash(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 30, G: 120, B: 90, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+	img, err := png.Decode(bytes.NewReader(icon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := image.Blurhash(img)
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&"+query, nil))
+		return w
+	}
+
+	if h := get("sz=48").Header().Get(handler.HeaderBlurhash); h != "" {
+		t.Errorf("blurhash sent without Blurhash: %q", h)
+	}
+
+	cfg.Blurhash = true
+	// A resized cache hit, then a re-encode from the original
+	for _, query := range []string{"sz=48", "sz=64"} {
+		if got := get(query).Header().Get(handler.HeaderBlurhash); got != want {
+			t.Errorf("%s: %s = %q, want %q", query, handler.HeaderBlurhash, got, want)
+		}
+	}
+
+	w := get("sz=16,32")
+	var resp struct {
+		Blurhash string `json:"blurhash"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Blurhash != want || w.Header().Get(handler.HeaderBlurhash) != want {
+		t.Errorf("multi-size blurhash = %q, header %q, want %q", resp.Blurhash, w.Header().Get(handler.HeaderBlurhash), want)
+	}
+}
+
+func TestFaviconHandler_DedupVariants(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	green := color.NRGBA{R: 30, G: 120, B: 90, A: 255}
+	// example "CDN" hosts serving one icon as PNG, two of them the same
+	// file, one re-encoded as JPEG, and another serving it recoloured
+	icons := map[string][]byte{
+		"203.0.113.10": solidPNG(t, green),
+		"203.0.113.11": solidPNG(t, green),
+		"203.0.113.20": func() []byte {
+			img := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+			draw.Draw(img, img.Bounds(), goimage.NewUniform(green), goimage.Point{}, draw.Src)
+			var buf bytes.Buffer
+			_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+			return buf.Bytes()
+		}(),
+		"203.0.113.30": solidPNG(t, color.NRGBA{R: 200, G: 30, B: 30, A: 255}),
+	}
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon">`))
+		case "/icon":
+			resp.Body = io.NopCloser(bytes.NewReader(icons[req.URL.Hostname()]))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.ExposeCacheInfo = true
+	variant := func(host string) (os.FileInfo, string) {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?sz=48&url=https://"+host+"/", nil))
+		if w.Code != http.StatusOK || w.Header().Get(handler.HeaderCache) == handler.CacheFallback {
+			t.Fatalf("%s: status %d, X-Cache %s", host, w.Code, w.Header().Get(handler.HeaderCache))
+		}
+		info, err := os.Stat(filepath.Join(cm.CacheDir, w.Header().Get(handler.HeaderCacheKey)))
+		if err != nil {
+			t.Fatalf("%s: variant not cached: %v", host, err)
+		}
+		return info, w.Header().Get(handler.HeaderPerceptualHash)
+	}
+
+	png1, hash1 := variant("203.0.113.10")
+	png2, _ := variant("203.0.113.11")
+	jpg1, hash2 := variant("203.0.113.20")
+	red, _ := variant("203.0.113.30")
+	if hash1 == "" || hash1 != hash2 {
+		t.Errorf("perceptual hashes %q and %q, want equal for the re-encoded icon", hash1, hash2)
+	}
+	if !os.SameFile(png1, png2) {
+		t.Error("byte-identical variants are stored twice")
+	}
+	// Looking alike is not enough: each host is served its own pixels
+	if os.SameFile(png1, jpg1) {
+		t.Error("re-encoded icon shares a variant with the original")
+	}
+	if os.SameFile(png1, red) {
+		t.Error("recoloured icon shares a variant with the original")
+	}
+	meta, _ := cm.ReadOrigMeta("https://203.0.113.10/icon")
+	if meta.PHash != hash1 || meta.AvgColor != "#1e785a" {
+		t.Errorf("meta = %+v, want phash %s and avg_color #1e785a", meta, hash1)
+	}
+
+	cfg.DedupVariants = false
+	_ = os.RemoveAll(cm.ResizedCacheDir())
+	_ = cm.EnsureDirs()
+	png1, _ = variant("203.0.113.10")
+	png2, _ = variant("203.0.113.11")
+	if os.SameFile(png1, png2) {
+		t.Error("variants shared with DedupVariants off")
+	}
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	h, err := handler.ParseResponseHeaders("*:Timing-Allow-Origin: * ; icon:x-cdn-route: favicons;icon:Link: <a>;icon:Link: <b>;icon:Vary:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h[handler.RouteAll].Get("Timing-Allow-Origin"); got != "*" {
+		t.Errorf("* Timing-Allow-Origin = %q", got)
+	}
+	if got := h[handler.RouteIcon].Get("X-Cdn-Route"); got != "favicons" {
+		t.Errorf("icon X-CDN-Route = %q", got)
+	}
+	if links := h[handler.RouteIcon].Values("Link"); len(links) != 2 {
+		t.Errorf("icon Link = %q, want both values", links)
+	}
+	if vals, ok := h[handler.RouteIcon]["Vary"]; !ok || len(vals) != 1 || vals[0] != "" {
+		t.Errorf("icon Vary = %q, want one empty value", vals)
+	}
+
+	path := filepath.Join(t.TempDir(), "headers")
+	_ = os.WriteFile(path, []byte("# CDN\nsizes:Strict-Transport-Security: max-age=63072000; includeSubDomains\n\n"), 0o644)
+	if h, err := handler.ParseResponseHeaders("@" + path); err != nil || h[handler.RouteSizes].Get("Strict-Transport-Security") != "max-age=63072000; includeSubDomains" {
+		t.Errorf("@file: %v, %v", h, err)
+	}
+
+	for _, bad := range []string{"X-Foo: bar", "admin:X-Foo: bar", "icon:X Foo: bar", "icon:Content-Length: 1", "icon"} {
+		if _, err := handler.ParseResponseHeaders(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestFaviconHandler_ServerTiming(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	stages := func() []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=32&format=png", nil))
+		h := w.Header().Get(handler.HeaderServerTiming)
+		if h == "" {
+			return nil
+		}
+		var names []string
+		for _, part := range strings.Split(h, ", ") {
+			name, dur, ok := strings.Cut(part, ";dur=")
+			if _, err := strconv.ParseFloat(dur, 64); !ok || err != nil {
+				t.Fatalf("malformed Server-Timing entry %q in %q", part, h)
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+
+	cfg.ServerTiming = true
+	if got, want := strings.Join(stages(), ","), "discovery,fetch,decode,encode,cache,total"; got != want {
+		t.Errorf("cold request stages = %s, want %s", got, want)
+	}
+	// Answered from the resized cache
+	if got, want := strings.Join(stages(), ","), "cache,total"; got != want {
+		t.Errorf("cached request stages = %s, want %s", got, want)
+	}
+
+	cfg.ServerTiming = false
+	if got := stages(); got != nil {
+		t.Errorf("Server-Timing sent while disabled: %v", got)
+	}
+}
+
+func TestFaviconHandler_ResponseHeaders(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 30, G: 120, B: 90, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	var err error
+	cfg.ResponseHeaders, err = handler.ParseResponseHeaders(
+		"*:Timing-Allow-Origin: *;icon:Cache-Control: public, max-age=60;icon:Vary:;sizes:X-CDN-Route: sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string, hdr ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&"+query, nil)
+		if len(hdr) == 2 {
+			req.Header.Set(hdr[0], hdr[1])
+		}
+		handler.FaviconHandler(cfg)(w, req)
+		return w
+	}
+
+	w := get("sz=48")
+	if w.Header().Get("Timing-Allow-Origin") != "*" || w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("icon headers = %v, want Timing-Allow-Origin and the configured Cache-Control", w.Header())
+	}
+	if _, ok := w.Header()["Vary"]; ok || w.Header().Get("X-Cdn-Route") != "" {
+		t.Errorf("icon headers = %v, want Vary removed and no sizes headers", w.Header())
+	}
+	// Revalidated responses get them too
+	if nm := get("sz=48", "If-None-Match", w.Header().Get("ETag")); nm.Code != http.StatusNotModified || nm.Header().Get("Timing-Allow-Origin") != "*" {
+		t.Errorf("304: status %d, headers %v", nm.Code, nm.Header())
+	}
+
+	w = get("sz=16,32")
+	if w.Header().Get("X-Cdn-Route") != "sizes" || w.Header().Get("Timing-Allow-Origin") != "*" || w.Header().Get("Vary") == "" {
+		t.Errorf("sizes headers = %v", w.Header())
+	}
+}
+
+func TestFaviconHandler_XCache(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 200, G: 60, B: 20, A: 255})
+	var originDown atomic.Bool
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader(""))}
+		switch req.URL.Path {
+		case "/", "/about", "/contact":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			switch {
+			case originDown.Load():
+				resp.StatusCode = http.StatusServiceUnavailable
+			case req.Header.Get("If-None-Match") == `"v1"`:
+				resp.StatusCode = http.StatusNotModified
+			default:
+				resp.Header.Set("Content-Type", "image/png")
+				resp.Header.Set("ETag", `"v1"`)
+				resp.Body = io.NopCloser(bytes.NewReader(icon))
+			}
+		default:
+			resp.StatusCode = http.StatusNotFound
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	steps := []struct {
+		query, want string
+		down        bool
+	}{
+		{"sz=48", handler.CacheFallback, false},
+		{"url=https://203.0.113.10/&sz=48", handler.CacheMiss, false},
+		{"url=https://203.0.113.10/&sz=48", handler.CacheHit, false},
+		{"url=https://203.0.113.10/&sz=64", handler.CacheReencoded, false},
+		{"url=https://203.0.113.10/about&sz=96", handler.CacheRevalidated, false},
+		{"url=https://203.0.113.10/contact&sz=128", handler.CacheStale, true},
+		{"url=https://203.0.113.10/&sz=48,64", handler.CacheHit, false},
+		{"url=https://203.0.113.10/&sz=32,48", handler.CacheReencoded, false},
+	}
+	for _, s := range steps {
+		originDown.Store(s.down)
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?"+s.query, nil))
+		if got := w.Header().Get(handler.HeaderCache); got != s.want {
+			t.Errorf("%s: %s = %q, want %q", s.query, handler.HeaderCache, got, s.want)
+		}
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 10, G: 90, B: 200, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req, Body: io.NopCloser(strings.NewReader(""))}
+		switch req.URL.Path {
+		case "", "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" type="image/png" sizes="64x64" href="/icon.png">` +
+				`<link rel="icon" href="/gone.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	w := httptest.NewRecorder()
+	handler.ReportHandler(cfg)(w, httptest.NewRequest("GET", "/report?domain=203.0.113.10", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var rep struct {
+		Selected string `json:"selected"`
+		Icons    []struct {
+			URL    string `json:"url"`
+			Rel    string `json:"rel"`
+			OK     bool   `json:"ok"`
+			Width  int    `json:"width"`
+			Format string `json:"format"`
+		} `json:"icons"`
+		Recommendations []struct {
+			Code string   `json:"code"`
+			URLs []string `json:"urls"`
+		} `json:"recommendations"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Selected != "https://203.0.113.10/icon.png" {
+		t.Errorf("selected = %q", rep.Selected)
+	}
+	byURL := map[string]int{}
+	for i, ic := range rep.Icons {
+		byURL[ic.URL] = i
+	}
+	if i, ok := byURL["https://203.0.113.10/icon.png"]; !ok || !rep.Icons[i].OK || rep.Icons[i].Width != 32 || rep.Icons[i].Format != "png" {
+		t.Errorf("icon.png entry = %+v", rep.Icons)
+	}
+	if i, ok := byURL["https://203.0.113.10/gone.png"]; !ok || rep.Icons[i].OK {
+		t.Errorf("gone.png not reported broken: %+v", rep.Icons)
+	}
+	if i, ok := byURL["https://203.0.113.10/favicon.ico"]; !ok || rep.Icons[i].Rel != "root" {
+		t.Errorf("root probe missing: %+v", rep.Icons)
+	}
+	codes := map[string][]string{}
+	for _, rec := range rep.Recommendations {
+		codes[rec.Code] = rec.URLs
+	}
+	for _, want := range []string{"broken_icons", "no_root_favicon", "missing_apple_touch_icon", "no_svg", "small_icons", "size_mismatch"} {
+		if _, ok := codes[want]; !ok {
+			t.Errorf("missing recommendation %s in %v", want, codes)
+		}
+	}
+	if got := codes["broken_icons"]; len(got) != 1 || got[0] != "https://203.0.113.10/gone.png" {
+		t.Errorf("broken_icons urls = %v", got)
+	}
+	if _, ok := codes["no_icon_links"]; ok {
+		t.Error("no_icon_links reported for a page with links")
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/report?domain=203.0.113.10", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	handler.ReportHandler(cfg)(w, req)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("browser Accept got Content-Type %q", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "gone.png") || !strings.Contains(body, "apple-touch-icon") {
+		t.Errorf("HTML report lacks the icons or recommendations:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ReportHandler(cfg)(w, httptest.NewRequest("GET", "/report", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("missing domain: status %d, want 400", w.Code)
+	}
+}
+
+func solidPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := goimage.NewNRGBA(goimage.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDiffHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	current := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(current))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	// An earlier, blue version of the icon is in the history
+	old := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	_ = cm.WriteOrigToCache("https://203.0.113.10/old.png", old)
+
+	diff := func(query string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		handler.DiffHandler(cfg)(w, httptest.NewRequest("GET", "/favicons/diff?"+query, nil))
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, body := diff("url=https://203.0.113.10/&sz=32&old=" + cache.ContentCID(old))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if body["changed"] != true || body["current"] != cache.ContentCID(current) {
+		t.Errorf("changed/current = %v/%v", body["changed"], body["current"])
+	}
+	if sim, _ := body["similarity"].(float64); sim <= 0 || sim >= 0.8 {
+		t.Errorf("similarity = %v, want well below 1 for red vs blue", sim)
+	}
+	if px, _ := body["changed_pixels"].(float64); px != 1 {
+		t.Errorf("changed_pixels = %v, want 1", px)
+	}
+	composite, _ := body["composite"].(string)
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(composite, "data:image/png;base64,"))
+	if err != nil {
+		t.Fatalf("composite is not base64 PNG: %v", err)
+	}
+	if cfg, err := png.DecodeConfig(bytes.NewReader(raw)); err != nil || cfg.Width <= 3*32 || cfg.Height != 32 {
+		t.Errorf("composite = %+v, %v; want three 32px panels", cfg, err)
+	}
+
+	// Comparing against the current version itself
+	_, body = diff("url=https://203.0.113.10/&old=" + cache.ContentCID(current))
+	if body["changed"] != false || body["similarity"] != 1.0 {
+		t.Errorf("self diff = %v/%v, want unchanged and identical", body["changed"], body["similarity"])
+	}
+
+	for _, q := range []string{
+		"url=https://203.0.113.10/",
+		"url=https://203.0.113.10/&old=../../etc/passwd",
+		"old=" + cache.ContentCID(old),
+	} {
+		if w, _ := diff(q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+	if w, _ := diff("url=https://203.0.113.10/&old=" + cache.ContentCID([]byte("never seen"))); w.Code != http.StatusNotFound {
+		t.Errorf("unknown old version: status = %d, want 404", w.Code)
+	}
+}
+
+func TestBundleHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{G: 200, A: 255})
+	var iconFetches int
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/icon.png">`))
+		case "/icon.png":
+			iconFetches++
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.BundleHandler(cfg)(w, httptest.NewRequest("GET", "/favicons/bundle.ico?url=https://203.0.113.10/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/x-icon" {
+			t.Errorf("Content-Type = %s", ct)
+		}
+		entries, err := ico.DecodeAll(w.Body)
+		if err != nil {
+			t.Fatalf("not a valid ICO: %v", err)
+		}
+		var sizes []int
+		for _, e := range entries {
+			sizes = append(sizes, e.Bounds().Dx())
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(handler.BundleSizes) {
+			t.Errorf("entry sizes = %v, want %v", sizes, handler.BundleSizes)
+		}
+	}
+	if iconFetches != 1 {
+		t.Errorf("icon fetched %d times, want once (second bundle from cache)", iconFetches)
+	}
+
+	w := httptest.NewRecorder()
+	handler.BundleHandler(cfg)(w, httptest.NewRequest("GET", "/favicons/bundle.ico", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("missing url: status = %d, want 400", w.Code)
+	}
+}
+
+func TestFaviconHandler_Deadline(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// The upstream site never answers, so only the deadline ends a request
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	h := reqctx.Middleware(reqctx.Options{AllowDeadline: true})(handler.FaviconHandler(cfg))
+
+	get := func(deadline string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=16", nil)
+		req.Header.Set(reqctx.HeaderDeadline, deadline)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("50")
+	if w.Code != http.StatusOK || w.Header().Get(handler.HeaderDeadlineStatus) != "fallback" {
+		t.Errorf("no history: status %d, %s = %q, want 200 fallback", w.Code, handler.HeaderDeadlineStatus, w.Header().Get(handler.HeaderDeadlineStatus))
+	}
+	if cm.ReadCandidates("https://203.0.113.10/", new([]discovery.IconCandidate)) {
+		t.Error("candidates discovered before the deadline expired were cached")
+	}
+
+	// A version seen long ago is better than the fallback
+	old := solidPNG(t, color.NRGBA{B: 255, A: 255})
+	_ = cm.RecordIconVersion("203.0.113.10", "https://203.0.113.10/old.png", old, time.Now().Add(-30*24*time.Hour))
+	w = get("50")
+	if got := w.Header().Get(handler.HeaderDeadlineStatus); got != "stale" {
+		t.Fatalf("%s = %q, want stale", handler.HeaderDeadlineStatus, got)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("stale response is not a PNG: %v", err)
+	}
+	if r, _, b, _ := img.At(8, 8).RGBA(); b>>8 != 255 || r != 0 {
+		t.Errorf("stale response is not the recorded icon: %v", img.At(8, 8))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/favicons", nil))
+	if got := w.Header().Get(handler.HeaderDeadlineStatus); got != "" {
+		t.Errorf("%s = %q without a deadline, want none", handler.HeaderDeadlineStatus, got)
+	}
+}
+
+func TestFaviconHandler_SpeculativeRootFetch(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 200, A: 255})
+	rootRequested := make(chan struct{})
+	var mu sync.Mutex
+	var rootFetches int
+	var overlapped bool
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			// The page answers only once the root icon has been asked for
+			select {
+			case <-rootRequested:
+				mu.Lock()
+				overlapped = true
+				mu.Unlock()
+			case <-time.After(2 * time.Second):
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<html><head><title>no icons</title></head></html>`))
+		case "/favicon.ico":
+			if req.URL.Scheme == "https" {
+				mu.Lock()
+				if rootFetches++; rootFetches == 1 {
+					close(rootRequested)
+				}
+				mu.Unlock()
+			}
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	w := httptest.NewRecorder()
+	handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/&sz=16", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("response is not a PNG: %v", err)
+	}
+	if r, _, _, _ := img.At(8, 8).RGBA(); r>>8 != 200 {
+		t.Errorf("served %v, want the root icon", img.At(8, 8))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !overlapped {
+		t.Error("root icon was not fetched while the page was being discovered")
+	}
+	if rootFetches != 1 {
+		t.Errorf("https root icon fetched %d times, want once", rootFetches)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cm.TimelineVersions = 3
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	icons := []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}, {R: 255, G: 255, A: 255}}
+	var cids []string
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, c := range icons {
+		b := solidPNG(t, c)
+		cids = append(cids, cache.ContentCID(b))
+		at := day.AddDate(0, i, 0)
+		_ = cm.RecordIconVersion("example.com", "https://example.com/icon.png", b, at)
+		// Unchanged icons do not add entries
+		_ = cm.RecordIconVersion("example.com", "https://example.com/icon.png", b, at.Add(time.Hour))
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, map[string]any) {
+		w := httptest.NewRecorder()
+		handler.HistoryHandler(cfg)(w, httptest.NewRequest("GET", "/api/history?"+query, nil))
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, body := get("domain=Example.COM")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	changes, _ := body["changes"].([]any)
+	if body["current"] != cids[3] || len(changes) != 3 {
+		t.Fatalf("body = %v, want the 3 most recent of 4 versions", body)
+	}
+	newest := changes[0].(map[string]any)
+	oldest := changes[2].(map[string]any)
+	if newest["cid"] != cids[3] || newest["previous_cid"] != cids[2] {
+		t.Errorf("newest change = %v", newest)
+	}
+	// The oldest retained entry no longer knows what it replaced
+	if oldest["cid"] != cids[1] || oldest["previous_cid"] != nil {
+		t.Errorf("oldest change = %v", oldest)
+	}
+
+	if _, body := get("url=https://example.com/page&since=2024-05-01"); body["count"] != float64(2) {
+		t.Errorf("since: count = %v, want 2", body["count"])
+	}
+	for query, want := range map[string]int{
+		"":                           http.StatusBadRequest,
+		"domain=example.com&since=x": http.StatusBadRequest,
+		"domain=unknown.example":     http.StatusNotFound,
+	} {
+		if w, _ := get(query); w.Code != want {
+			t.Errorf("%q: status %d, want %d", query, w.Code, want)
+		}
+	}
+}
+
+func TestIconInfoHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	icon := solidPNG(t, color.NRGBA{R: 255, A: 255})
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch {
+		case req.URL.Host != "203.0.113.10":
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		case req.URL.Path == "" || req.URL.Path == "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/red.png">`))
+		case req.URL.Path == "/red.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) (*httptest.ResponseRecorder, map[string]any) {
+		w := httptest.NewRecorder()
+		handler.IconInfoHandler(cfg)(w, httptest.NewRequest("GET", "/api/icon?"+query, nil))
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, body := get("url=https://203.0.113.10/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	for field, want := range map[string]any{
+		"icon_url":       "https://203.0.113.10/red.png",
+		"fallback":       false,
+		"format":         "png",
+		"content_type":   "image/png",
+		"bytes":          float64(len(icon)),
+		"width":          float64(32),
+		"height":         float64(32),
+		"content_hash":   cache.ContentCID(icon),
+		"dominant_color": "#ff0000",
+	} {
+		if body[field] != want {
+			t.Errorf("%s = %v, want %v", field, body[field], want)
+		}
+	}
+	if ph, _ := body["perceptual_hash"].(string); len(ph) != 16 {
+		t.Errorf("perceptual_hash = %q, want 16 hex digits", ph)
+	}
+	info, _ := body["cache"].(map[string]any)
+	fetched, err1 := time.Parse(time.RFC3339, fmt.Sprint(info["fetched_at"]))
+	expires, err2 := time.Parse(time.RFC3339, fmt.Sprint(info["expires_at"]))
+	if info["status"] != handler.CacheMiss || err1 != nil || err2 != nil || expires.Sub(fetched) != time.Hour {
+		t.Errorf("cache = %v, want a miss expiring an hour after it was fetched", info)
+	}
+
+	// The resolved icon is cached now, as for /favicons
+	w, body = get("domain=203.0.113.10")
+	info, _ = body["cache"].(map[string]any)
+	if w.Header().Get(handler.HeaderCache) != handler.CacheHit || info["status"] != handler.CacheHit {
+		t.Errorf("second lookup: %s %v, want a hit", w.Header().Get(handler.HeaderCache), info)
+	}
+
+	w, body = get("url=https://203.0.113.11/")
+	if w.Code != http.StatusOK || body["fallback"] != true || body["icon_url"] != nil || body["cache"] != nil {
+		t.Errorf("site without icons: status %d, body %v, want only fallback", w.Code, body)
+	}
+	if w, _ := get(""); w.Code != http.StatusBadRequest {
+		t.Errorf("without url: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// A 64×32 banner, only on allowed hosts
+	banner := goimage.NewNRGBA(goimage.Rect(0, 0, 64, 32))
+	draw.Draw(banner, banner.Bounds(), &goimage.Uniform{color.NRGBA{G: 255, A: 255}}, goimage.Point{}, draw.Src)
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, banner)
+	var fetches atomic.Int64
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetches.Add(1)
+		if req.Header.Get("Cookie") != "" {
+			t.Errorf("upstream request carried Cookie %q", req.Header.Get("Cookie"))
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		resp.Header.Set("Set-Cookie", "tracker=1")
+		switch req.URL.Path {
+		case "/banner.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		case "/page.html":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader("<html></html>"))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/proxy?format=png&"+query, nil)
+		req.Header.Set("Cookie", "session=secret")
+		w := httptest.NewRecorder()
+		handler.ProxyHandler(cfg)(w, req)
+		return w
+	}
+
+	if w := get("url=https://203.0.113.50/banner.png"); w.Code != http.StatusNotFound {
+		t.Errorf("without -proxy-allow: status %d, want 404", w.Code)
+	}
+	cfg.ProxyAllow = []string{"203.0.113.50"}
+
+	w := get("url=https://203.0.113.50/banner.png&sz=64")
+	if w.Code != http.StatusOK {
+		t.Fatalf("allowed image: status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("response carried Set-Cookie %q", w.Header().Get("Set-Cookie"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("response is not a PNG: %v", err)
+	}
+	// Letterboxed by default: the top and bottom edges are transparent
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Errorf("size %v, want 64×64", img.Bounds())
+	}
+	if _, _, _, a := img.At(32, 2).RGBA(); a != 0 {
+		t.Errorf("top edge alpha = %d, want a transparent letterbox", a)
+	}
+	if _, g, _, _ := img.At(32, 32).RGBA(); g>>8 != 255 {
+		t.Errorf("centre green = %d, want the image", g>>8)
+	}
+
+	n := fetches.Load()
+	if w := get("url=https://203.0.113.50/banner.png&sz=64"); w.Code != http.StatusOK || w.Header().Get(handler.HeaderCache) != handler.CacheHit || fetches.Load() != n {
+		t.Errorf("repeated: status %d, X-Cache %q, %d fetches; want a cache hit", w.Code, w.Header().Get(handler.HeaderCache), fetches.Load()-n)
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"url=https://203.0.113.51/banner.png", http.StatusForbidden},
+		{"url=http://127.0.0.1/banner.png", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+		{"url=https://203.0.113.50/page.html", http.StatusUnsupportedMediaType},
+		{"url=https://203.0.113.50/missing.png", http.StatusBadGateway},
+	} {
+		if w := get(tc.query); w.Code != tc.code {
+			t.Errorf("%q: status %d, want %d", tc.query, w.Code, tc.code)
+		}
+	}
+
+	cfg.ProxyMaxBytes = 16
+	if w := get("url=https://203.0.113.50/banner.png&sz=32"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over -proxy-max-bytes: status %d, want 413", w.Code)
+	}
+}
+
+func TestDebugDiscoverHandler(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+
+	// 16px is below the requested size, so no candidate stops the search early
+	img := goimage.NewNRGBA(goimage.Rect(0, 0, 16, 16))
+	img.Set(3, 3, color.NRGBA{G: 255, A: 255})
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	small := buf.Bytes()
+
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`
+				<link rel="icon" href="/icon.png" sizes="16x16">
+				<link rel="icon" href="/missing.png" sizes="64x64">
+				<link rel="apple-touch-icon" href="/login">`))
+		case "/icon.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(small))
+		case "/login":
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader("<html>sign in</html>"))
+		default:
+			resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+
+	w := httptest.NewRecorder()
+	handler.DebugDiscoverHandler(cfg)(w, httptest.NewRequest("GET", "/debug/discover?url=https://203.0.113.10/&sz=32", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	var trace struct {
+		Selected string `json:"selected"`
+		Fallback bool   `json:"fallback"`
+		Stages   []struct {
+			Candidates []struct {
+				URL     string `json:"url"`
+				Source  string `json:"source"`
+				Status  string `json:"status"`
+				Reason  string `json:"reason"`
+				Decoder string `json:"decoder"`
+				Width   int    `json:"width"`
+			} `json:"candidates"`
+		} `json:"stages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.Fallback || trace.Selected != "https://203.0.113.10/icon.png" {
+		t.Errorf("selected = %q (fallback %v)", trace.Selected, trace.Fallback)
+	}
+	if len(trace.Stages) != 1 {
+		t.Fatalf("got %d stages, want 1", len(trace.Stages))
+	}
+
+	byURL := map[string]string{}
+	for _, c := range trace.Stages[0].Candidates {
+		byURL[c.URL] = c.Source + " " + c.Status + ": " + c.Reason
+		if c.URL == "https://203.0.113.10/icon.png" && (c.Decoder != "png" || c.Width != 16) {
+			t.Errorf("icon.png decoded by %q at width %d", c.Decoder, c.Width)
+		}
+	}
+	for url, want := range map[string]string{
+		"https://203.0.113.10/icon.png":    "link selected",
+		"https://203.0.113.10/missing.png": "link rejected: status 404",
+		"https://203.0.113.10/login":       "link rejected: not an image",
+		"https://203.0.113.10/favicon.ico": "root rejected",
+	} {
+		if got, ok := byURL[url]; !ok || !strings.HasPrefix(got, want) {
+			t.Errorf("%s: got %q, want prefix %q", url, got, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.DebugDiscoverHandler(cfg)(w, httptest.NewRequest("GET", "/debug/discover", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("missing url: status = %d, want 400", w.Code)
+	}
+}
+
+func TestAdminAuthJWT(t *testing.T) {
+	jwt, err := auth.NewJWT([]byte("k"), "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(scope string) string {
+		enc := func(v any) string {
+			b, _ := json.Marshal(v)
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+		signing := enc(map[string]string{"alg": "HS256"}) + "." + enc(map[string]string{"sub": "ops-bot", "scope": scope})
+		mac := hmac.New(sha256.New, []byte("k"))
+		mac.Write([]byte(signing))
+		return signing + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	var principal reqctx.Principal
+	h := handler.AdminAuthJWT("s3cret", jwt, auth.PermPurge, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = reqctx.From(r.Context()).Principal
+	}))
+
+	for _, tt := range []struct {
+		name, bearer string
+		want         int
+	}{
+		{"admin token", "s3cret", http.StatusOK},
+		{"token with purge scope", token("read purge"), http.StatusOK},
+		{"token without purge scope", token("read upload"), http.StatusForbidden},
+		{"wrong admin token", "wrong", http.StatusUnauthorized},
+		{"forged token", token("purge") + "x", http.StatusUnauthorized},
+	} {
+		principal = reqctx.Principal{}
+		req := httptest.NewRequest("POST", "/admin/purge", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.bearer)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.name == "token with purge scope" && principal.ID != "ops-bot" {
+			t.Errorf("%s: principal %+v not recorded", tt.name, principal)
+		}
+	}
+}
+
+func TestTenantBranding(t *testing.T) {
+	prevClient := fetch.HTTPClient
+	defer func() { fetch.HTTPClient = prevClient }()
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	store, err := handler.LoadTenantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := handler.AdminTenantsHandler(store)
+	put := func(body string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		admin(w, httptest.NewRequest("PUT", "/admin/tenants", strings.NewReader(body)))
+		return w.Code
+	}
+	red := "data:image/png;base64," + base64.StdEncoding.EncodeToString(solidPNG(t, color.NRGBA{R: 255, A: 255}))
+	if code := put(`{"tenant": "acme", "fallback_image": "` + red + `", "size": 48, "format": "png"}`); code != http.StatusOK {
+		t.Fatalf("PUT acme: status %d", code)
+	}
+	if code := put(`{"tenant": "globex", "fallback_style": "letter", "palette": ["#123456"]}`); code != http.StatusOK {
+		t.Fatalf("PUT globex: status %d", code)
+	}
+	for _, body := range []string{
+		`{"tenant": "bad", "palette": ["blue"]}`,
+		`{"tenant": "bad", "size": 1000}`,
+		`{"tenant": "bad", "fallback_image": "https://example.com/x.png"}`,
+		`{"tenant": "no/slash"}`,
+	} {
+		if code := put(body); code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", body, code)
+		}
+	}
+
+	// Branding survives a restart
+	reloaded, err := handler.LoadTenantStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := reloaded.All(); len(all) != 2 || all["acme"].Size != 48 {
+		t.Fatalf("reloaded store = %v, want acme and globex", all)
+	}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	cfg.Tenants = reloaded
+	get := func(tenant, query string) (goimage.Image, *httptest.ResponseRecorder) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/favicons?"+query, nil)
+		// The client-supplied tenant is not trusted, only the credentials'
+		st := &reqctx.State{Tenant: "acme"}
+		if tenant != "" {
+			st.Principal = reqctx.Principal{ID: "caller", Method: "jwt", Tenant: tenant}
+		}
+		req = req.WithContext(reqctx.With(req.Context(), st))
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, req)
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tenant, query, err)
+		}
+		return img, w
+	}
+
+	img, w := get("acme", "")
+	if img.Bounds().Dx() != 48 {
+		t.Errorf("acme default size: %v, want 48px", img.Bounds())
+	}
+	if r, g, _, _ := img.At(24, 24).RGBA(); r != 0xffff || g != 0 {
+		t.Error("acme did not get its fallback image")
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") {
+		t.Errorf("branded Cache-Control = %q, want private", cc)
+	}
+	if img, _ := get("acme", "sz=16"); img.Bounds().Dx() != 16 {
+		t.Errorf("acme with sz=16: %v, want the parameter to win", img.Bounds())
+	}
+
+	img, _ = get("globex", "domain=203.0.113.95")
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 0x12 || g>>8 != 0x34 || b>>8 != 0x56 {
+		t.Errorf("globex letter tile background = %02x%02x%02x, want its palette", r>>8, g>>8, b>>8)
+	}
+
+	img, w = get("", "")
+	if img.Bounds().Dx() != handler.DefaultSize {
+		t.Errorf("untenanted request: %v, want the default size", img.Bounds())
+	}
+	if r, g, _, _ := img.At(16, 16).RGBA(); r == 0xffff && g == 0 {
+		t.Error("X-Tenant-ID alone applied a tenant's branding")
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+		t.Errorf("untenanted Cache-Control = %q, want public", cc)
+	}
+
+	dw := httptest.NewRecorder()
+	admin(dw, httptest.NewRequest("DELETE", "/admin/tenants?tenant=acme", nil))
+	if dw.Code != http.StatusNoContent || store.Lookup("acme") != nil {
+		t.Errorf("DELETE acme: status %d", dw.Code)
+	}
+}
+
+func TestAdminPurgeHandler(t *testing.T) {
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	_ = cm.WriteResolvedIcon("https://a.example.com/", "https://a.example.com/favicon.ico")
+	_ = cm.WriteOrigToCache("https://a.example.com/favicon.ico", []byte("icon"))
+	_ = cm.WriteResizedToCache("https://a.example.com/favicon.ico", 32, "png", []byte("resized"))
+
+	h := handler.AdminAuth("s3cret", handler.AdminPurgeHandler(cfg))
+	do := func(method, query, token string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest(method, "/admin/purge?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	if w, _ := do("POST", "host=*.example.com", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status = %d, want 401", w.Code)
+	}
+	if w, _ := do("POST", "host=*.example.com", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", w.Code)
+	}
+	if w, _ := do("GET", "host=*.example.com", "s3cret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET without dry_run: status = %d, want 405", w.Code)
+	}
+	if w, _ := do("POST", "host=[", "s3cret"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad pattern: status = %d, want 400", w.Code)
+	}
+
+	// Resolved mapping, original and one resized variant
+	w, body := do("GET", "host=*.example.com&dry_run=1", "s3cret")
+	if w.Code != http.StatusOK || body["dry_run"] != true || body["count"] != 3.0 {
+		t.Fatalf("dry run: status %d, body %s", w.Code, w.Body.String())
+	}
+	if n, _ := body["bytes"].(float64); n <= float64(len("icon")+len("resized")) {
+		t.Errorf("dry run bytes = %v, want the sum of all three entries", n)
+	}
+	if _, ok := cm.ReadResolvedIcon("https://a.example.com/"); !ok {
+		t.Fatal("dry run deleted entries")
+	}
+
+	if _, body := do("POST", "host=*.example.com", "s3cret"); body["count"] != 3.0 {
+		t.Errorf("purge: body %v", body)
+	}
+	if _, ok, _ := cm.ReadResizedFromCacheWithMod("https://a.example.com/favicon.ico", 32, "png"); ok {
+		t.Error("resized variant survived purge")
+	}
+}
+
+func TestFaviconHandler_IconHints(t *testing.T) {
+	prevClient, prevHints := fetch.HTTPClient, discovery.IconHints
+	defer func() { fetch.HTTPClient, discovery.IconHints = prevClient, prevHints }()
+
+	icon := solidPNG(t, color.NRGBA{G: 255, A: 255})
+	var pageFetches int
+	fetch.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+		switch req.URL.Path {
+		case "/", "":
+			pageFetches++
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Body = io.NopCloser(strings.NewReader(`<link rel="icon" href="/page.png">`))
+		case "/hinted.png", "/page.png":
+			resp.Header.Set("Content-Type", "image/png")
+			resp.Body = io.NopCloser(bytes.NewReader(icon))
+		default:
+			resp.StatusCode = http.StatusNotFound
+			resp.Body = io.NopCloser(strings.NewReader(""))
+		}
+		return resp, nil
+	})}
+
+	discovery.IconHints = discovery.NewHints()
+	hints := handler.AdminHintsHandler(discovery.IconHints)
+	put := httptest.NewRecorder()
+	hints(put, httptest.NewRequest("PUT", "/admin/hints", strings.NewReader(`{"domain":"203.0.113.10","urls":["https://203.0.113.10/hinted.png"]}`)))
+	if put.Code != http.StatusOK {
+		t.Fatalf("PUT hint: status %d, body %s", put.Code, put.Body.String())
+	}
+
+	cm := cache.New(t.TempDir(), time.Hour)
+	_ = cm.EnsureDirs()
+	cfg := handler.NewConfig(cm, time.Hour, time.Hour, true)
+	get := func() {
+		w := httptest.NewRecorder()
+		handler.FaviconHandler(cfg)(w, httptest.NewRequest("GET", "/favicons?url=https://203.0.113.10/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d", w.Code)
+		}
+	}
+
+	get()
+	if resolved, _ := cm.ReadResolvedIcon(discovery.CanonicalizeURLString("https://203.0.113.10/")); resolved.IconURL != "https://203.0.113.10/hinted.png" || pageFetches != 0 {
+		t.Errorf("resolved %q after %d page fetches, want the hint without fetching the page", resolved.IconURL, pageFetches)
+	}
+
+	// A broken hint falls back to normal discovery
+	_ = discovery.IconHints.Set("203.0.113.10", []string{"https://203.0.113.10/gone.png"})
+	_ = os.RemoveAll(cm.ResolvedCacheDir())
+	_ = cm.EnsureDirs()
+	get()
+	if resolved, _ := cm.ReadResolvedIcon(discovery.CanonicalizeURLString("https://203.0.113.10/")); resolved.IconURL != "https://203.0.113.10/page.png" || pageFetches != 1 {
+		t.Errorf("resolved %q after %d page fetches, want the page icon", resolved.IconURL, pageFetches)
+	}
+
+	del := httptest.NewRecorder()
+	hints(del, httptest.NewRequest("DELETE", "/admin/hints?domain=203.0.113.10", nil))
+	if del.Code != http.StatusNoContent || discovery.IconHints.Len() != 0 {
+		t.Errorf("DELETE hint: status %d, %d hints left", del.Code, discovery.IconHints.Len())
+	}
+}
+
+func TestCapabilitiesHandler(t *testing.T) {
+	if err := image.SetDisabledFormats([]string{"avif"}, []string{"heif"}); err != nil {
+		t.Fatal(err)
+	}
+	defer image.SetDisabledFormats(nil, nil)
+
+	w := httptest.NewRecorder()
+	handler.CapabilitiesHandler()(w, httptest.NewRequest("GET", "/api/capabilities", nil))
+	var resp struct {
+		Encoders []struct {
+			Name        string `json:"name"`
+			ContentType string `json:"content_type"`
+			Available   bool   `json:"available"`
+			Disabled    bool   `json:"disabled"`
+		} `json:"encoders"`
+		Decoders []struct {
+			Name      string `json:"name"`
+			Available bool   `json:"available"`
+			Disabled  bool   `json:"disabled"`
+		} `json:"decoders"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, w.Body)
+	}
+	encoders := map[string]bool{}
+	for _, e := range resp.Encoders {
+		encoders[e.Name] = e.Available
+		if e.Name == "avif" && (e.Available || !e.Disabled) {
+			t.Errorf("avif encoder = %+v, want disabled", e)
+		}
+	}
+	if !encoders["png"] || !encoders["webp"] {
+		t.Errorf("encoders %+v, want png and webp available", resp.Encoders)
+	}
+	for _, d := range resp.Decoders {
+		if d.Name == "heif" && (d.Available || !d.Disabled) {
+			t.Errorf("heif decoder = %+v, want disabled", d)
+		}
+	}
+
+	// The formats served follow the same state
+	w = httptest.NewRecorder()
+	handler.FaviconHandler(handler.NewConfig(cache.New(t.TempDir(), time.Hour), time.Hour, time.Hour, true))(w, httptest.NewRequest("GET", "/favicons?format=avif", nil))
+	if ct := w.Header().Get("Content-Type"); ct == "image/avif" {
+		t.Errorf("format=avif served %s with avif disabled", ct)
+	}
+}
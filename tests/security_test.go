@@ -1,7 +1,9 @@
 package tests
 
 import (
+	"errors"
 	"net"
+	"strings"
 	"testing"
 
 	"faviconsvc/internal/security"
@@ -60,6 +62,93 @@ func TestNormalizeURL(t *testing.T) {
 	}
 }
 
+func TestNetworkPolicy(t *testing.T) {
+	defer func(private, dot bool, hosts []string) {
+		security.AllowPrivate, security.RequireDot, security.SingleLabelHosts = private, dot, hosts
+	}(security.AllowPrivate, security.RequireDot, security.SingleLabelHosts)
+
+	security.AllowPrivate = true
+	for ip, blocked := range map[string]bool{
+		"10.0.0.1":        false,
+		"192.168.1.20":    false,
+		"fd00::1":         false,
+		"127.0.0.1":       true,
+		"169.254.169.254": true,
+		"fe80::1":         true,
+	} {
+		if got := security.IsBlockedIP(net.ParseIP(ip)); got != blocked {
+			t.Errorf("AllowPrivate: IsBlockedIP(%s) = %v, want %v", ip, got, blocked)
+		}
+	}
+	if _, err := security.NormalizeURL("http://10.1.2.3/"); err != nil {
+		t.Errorf("AllowPrivate: private IP rejected: %v", err)
+	}
+	if _, err := security.NormalizeURL("http://localhost/"); !errors.Is(err, security.ErrBlockedHost) {
+		t.Errorf("AllowPrivate: localhost: err = %v, want ErrBlockedHost", err)
+	}
+	if _, err := security.NormalizeURL("ftp://10.1.2.3/"); err == nil || errors.Is(err, security.ErrBlockedHost) {
+		t.Errorf("ftp URL: err = %v, want an error other than ErrBlockedHost", err)
+	}
+
+	// Dotless names fail the dot rule before any DNS lookup; allowed ones
+	// get as far as resolution, which fails in the test environment for
+	// another reason
+	patterns, err := security.ParseHostPatterns(" Wiki, intranet-* ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	security.SingleLabelHosts = patterns
+	dotErr := func(host string) bool {
+		_, err := security.NormalizeURL("http://" + host + "/")
+		return err != nil && strings.Contains(err.Error(), "dot")
+	}
+	for host, rejected := range map[string]bool{"wiki": false, "intranet-hr": false, "printer": true} {
+		if got := dotErr(host); got != rejected {
+			t.Errorf("RequireDot: %s rejected for its dot = %v, want %v", host, got, rejected)
+		}
+	}
+	security.RequireDot = false
+	if dotErr("printer") {
+		t.Error("RequireDot off: printer still rejected for its dot")
+	}
+
+	for _, bad := range []string{"[", "*.local"} {
+		if _, err := security.ParseHostPatterns(bad); err == nil {
+			t.Errorf("ParseHostPatterns(%q) accepted", bad)
+		}
+	}
+}
+
+func TestASCIIHost(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"example.com", "example.com", false},
+		{"203.0.113.10", "203.0.113.10", false},
+		{"my_host.example.com", "my_host.example.com", false},
+		{"bücher.de", "xn--bcher-kva.de", false},
+		{"BÜCHER.de", "xn--bcher-kva.de", false},
+		{"日本語.jp", "xn--wgv71a119e.jp", false},
+		{"ü.xn--a.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := security.ASCIIHost(tt.input)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+				t.Errorf("ASCIIHost(%q) = %q, %v; want %q, wantErr %v", tt.input, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	// Invalid IDNs are rejected before any DNS lookup
+	if _, err := security.NormalizeURL("https://ü.xn--a.com/"); err == nil || err.Error() != "invalid internationalized hostname" {
+		t.Errorf("NormalizeURL(invalid IDN) error = %v", err)
+	}
+}
+
 func parseIP(s string) net.IP {
 	return net.ParseIP(s)
 }